@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"path"
+	"strings"
+
+	"github.com/coder/coder/codersdk"
+)
+
+// acceptEnv returns the variables of env that clients are allowed to set,
+// and the names of the rest. Every variable is accepted without a policy.
+func acceptEnv(policy *codersdk.WorkspaceAgentSSHAcceptEnv, env []string) (accepted []string, rejected []string) {
+	if policy == nil {
+		return env, nil
+	}
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if acceptEnvName(policy.Patterns, name) {
+			accepted = append(accepted, kv)
+		} else {
+			rejected = append(rejected, name)
+		}
+	}
+	return accepted, rejected
+}
+
+func acceptEnvName(patterns []string, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		match, err := path.Match(pattern, name)
+		if err == nil && match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// activityTracker records when clients last used the workspace through SSH,
+// reconnecting PTYs or port forwards, so coderd can tell idle workspaces
+// apart from ones that only have background traffic.
+type activityTracker struct {
+	mutex sync.Mutex
+	// active is the number of open connections.
+	active int
+	// last is when a connection was last opened or closed.
+	last time.Time
+}
+
+// newActivityTracker returns a tracker that considers the workspace used at
+// the time the agent started.
+func newActivityTracker(now time.Time) *activityTracker {
+	return &activityTracker{
+		last: now,
+	}
+}
+
+// start records a connection opening, and returns a function that records it
+// closing, which can be called more than once.
+func (t *activityTracker) start() func() {
+	t.mutex.Lock()
+	t.active++
+	t.last = time.Now()
+	t.mutex.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mutex.Lock()
+			t.active--
+			t.last = time.Now()
+			t.mutex.Unlock()
+		})
+	}
+}
+
+// idle returns how long the workspace hasn't had open connections, or zero
+// if it has one.
+func (t *activityTracker) idle() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.active > 0 {
+		return 0
+	}
+	return time.Since(t.last)
+}
+
+// connections returns the number of open connections.
+func (t *activityTracker) connections() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.active
+}
@@ -3,8 +3,7 @@ package agent
 import (
 	"bufio"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -13,36 +12,34 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/armon/circbuf"
 	"github.com/gliderlabs/ssh"
 	"github.com/google/uuid"
-	"github.com/pkg/sftp"
 	"github.com/spf13/afero"
 	"go.uber.org/atomic"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/xerrors"
+	"tailscale.com/derp"
 	"tailscale.com/net/speedtest"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netlogtype"
 
 	"cdr.dev/slog"
-	"github.com/coder/coder/agent/usershell"
+	"cdr.dev/slog/sloggers/sloghuman"
+	"github.com/coder/coder/agent/agentdns"
 	"github.com/coder/coder/buildinfo"
 	"github.com/coder/coder/coderd/gitauth"
 	"github.com/coder/coder/codersdk"
 	"github.com/coder/coder/pty"
 	"github.com/coder/coder/tailnet"
-	"github.com/coder/retry"
 )
 
 const (
@@ -54,6 +51,11 @@ const (
 	// command just returning a nonzero exit code, and is chosen as an arbitrary, high number
 	// unlikely to shadow other exit codes, which are typically 1, 2, 3, etc.
 	MagicSessionErrorCode = 229
+	// MagicSessionErrorSignal is sent in an "exit-signal" request before
+	// MagicSessionErrorCode, with the error that failed the session as the
+	// message. It's an extension name, so clients that don't know it
+	// ignore it.
+	MagicSessionErrorSignal = "session-error@coder.com"
 )
 
 type Options struct {
@@ -64,6 +66,134 @@ type Options struct {
 	ReconnectingPTYTimeout time.Duration
 	EnvironmentVariables   map[string]string
 	Logger                 slog.Logger
+	// EnvironmentPassthrough are patterns of the environment variables of
+	// the agent that sessions inherit, like "AWS_*", which are matched
+	// with path.Match. PATH, HOME, SHELL, LOGNAME, LANG, LC_* and TZ are
+	// always inherited. Sessions inherit every variable if it's nil.
+	EnvironmentPassthrough []string
+	// SetHostname sets the hostname of the workspace to the
+	// one provided in the metadata.
+	SetHostname bool
+	// StartPTY starts commands for PTY sessions. It defaults to
+	// pty.Start, and can be replaced with pty.StartVirtual where a
+	// PTY can't be allocated or for deterministic tests.
+	StartPTY func(cmd *exec.Cmd, opt ...pty.StartOption) (pty.PTY, pty.Process, error)
+	// CoderURL is the URL of coderd. When the startup script fails,
+	// diagnostics check that it's reachable.
+	CoderURL *url.URL
+	// StartupLogMaxSize limits the size of the startup script logs in
+	// bytes. The head and tail of the output are kept when it's exceeded.
+	StartupLogMaxSize int64
+	// HomeDir returns the home directory of the user, where sessions
+	// start and ~/.hushlogin is looked up. It defaults to $HOME, or the
+	// home directory of the current user.
+	HomeDir func() (string, error)
+	// ProvisionHomeDir creates the home directory if it doesn't exist,
+	// and copies the files of HomeSkeletonDir into it if it's empty,
+	// before sessions and the startup script run.
+	ProvisionHomeDir bool
+	// HomeSkeletonDir defaults to /etc/skel.
+	HomeSkeletonDir string
+	// EnvironmentFile is a file of KEY=VALUE lines that override the
+	// environment variables of the metadata in sessions. It's read again
+	// when the agent is reloaded.
+	EnvironmentFile string
+	// ReopenLogs is called when the agent is reloaded, so log files that
+	// were rotated by another process are reopened.
+	ReopenLogs func() error
+	// SessionTempDirQuota limits the total size of the temporary
+	// directories of sessions in bytes. Sessions started while it's
+	// exceeded use the default temporary directory. It's unlimited if
+	// negative.
+	SessionTempDirQuota int64
+	// ReconnectMinInterval and ReconnectMaxInterval bound the exponential
+	// backoff between attempts to connect to coderd, which is randomized
+	// so agents don't reconnect at once. The maximum interval of the
+	// metadata overrides ReconnectMaxInterval.
+	ReconnectMinInterval time.Duration
+	ReconnectMaxInterval time.Duration
+	// HardenedHost avoids operations that mandatory access control
+	// policies commonly deny, like allocating PTYs and setting the
+	// hostname. Sessions use virtual PTYs instead.
+	HardenedHost bool
+	// DisableVSCodeGitAuth stops the agent from writing the settings of
+	// VS Code that make it use Git authentication from Coder.
+	DisableVSCodeGitAuth bool
+	// SSHHostKeyFile is where the SSH host key is stored, so it's stable
+	// across restarts. A random key is used on every start if it's empty.
+	SSHHostKeyFile string
+	// Resolver resolves the hostnames of HTTP requests the agent makes
+	// itself, like fetching the MOTD. It defaults to the resolver of the
+	// workspace.
+	Resolver *net.Resolver
+	// SessionRecorder is called when sessions open and close, and with
+	// the input and output of their PTYs. NewAsciicastRecorder records
+	// them to files.
+	SessionRecorder SessionRecorder
+	// PreSessionHook is called before SSH sessions and reconnecting PTYs
+	// start, and can deny them or attach reason codes to them.
+	PreSessionHook PreSessionHook
+	// PTYRetention is how long the output of reconnecting PTYs is kept in
+	// the temporary directory after the agent stops, so clients that
+	// reconnect after it restarts see it. It defaults to an hour, and a
+	// negative value disables persisting it.
+	PTYRetention time.Duration
+	// ReconnectingPTYBufferSize is the size of the scrollback of
+	// reconnecting PTYs in bytes, which is replayed to clients that
+	// reconnect. It defaults to 64KiB, and is bounded between 1KiB and
+	// 16MiB. The metadata and clients override it.
+	ReconnectingPTYBufferSize int
+	// ReconnectingPTYScrollbackLimit bounds the scrollback of all
+	// reconnecting PTYs together in bytes. When it's reached, the oldest
+	// output of the PTY that was least recently used is evicted. It
+	// defaults to 64MiB.
+	ReconnectingPTYScrollbackLimit int
+	// NamedReconnectingPTYTimeout is how long named reconnecting PTYs are
+	// kept without connections. Zero keeps them until their process
+	// exits.
+	NamedReconnectingPTYTimeout time.Duration
+	// SFTP restricts SFTP sessions. The policy of the metadata applies
+	// too, so sessions are read-only if either is, and paths must be
+	// allowed by both.
+	SFTP *codersdk.WorkspaceAgentSFTP
+	// MaxListenerConnections is how many connections each tailnet
+	// listener of the agent, like the one of SSH, handles at once.
+	// Defaults to 1024.
+	MaxListenerConnections int
+	// ControlSocketPath is the Unix socket that `coder agent` subcommands
+	// in the workspace use to inspect the agent. It's disabled if empty.
+	ControlSocketPath string
+	// AgentLogFile is the log of the agent, which is served over the
+	// control socket.
+	AgentLogFile string
+	// PrewarmSessions computes the shell and environment of sessions
+	// when the metadata changes, rather than when the next session
+	// starts.
+	PrewarmSessions bool
+	// PrewarmShells keeps this many shells of the user started ahead of
+	// sessions, which run the commands of sessions without a PTY. It's
+	// disabled if zero.
+	PrewarmShells int
+	// Pprof serves the profiles of net/http/pprof under /debug/pprof on
+	// the statistics server, which clients reach over tailnet.
+	Pprof bool
+	// EmbeddedDERP runs a DERP server inside the agent when the metadata
+	// doesn't configure one, for air-gapped workspaces whose templates
+	// start the agent with it.
+	EmbeddedDERP *codersdk.WorkspaceAgentEmbeddedDERP
+}
+
+// Agent is a running workspace agent.
+type Agent interface {
+	io.Closer
+	// CloseWithTimeout drains the agent before closing it. It stops
+	// accepting connections, tells sessions with a terminal that the
+	// agent is shutting down, and waits until the open connections end or
+	// the context is done.
+	CloseWithTimeout(ctx context.Context) error
+	// Reload re-fetches metadata, re-reads the environment file and
+	// reopens log files without restarting the agent.
+	Reload(ctx context.Context) error
 }
 
 type Client interface {
@@ -72,34 +202,160 @@ type Client interface {
 	AgentReportStats(ctx context.Context, log slog.Logger, stats func() *codersdk.AgentStats) (io.Closer, error)
 	PostWorkspaceAgentAppHealth(ctx context.Context, req codersdk.PostWorkspaceAppHealthsRequest) error
 	PostWorkspaceAgentVersion(ctx context.Context, version string) error
+	PostWorkspaceAgentHandshake(ctx context.Context, req codersdk.WorkspaceAgentHandshakeRequest) (codersdk.WorkspaceAgentHandshakeResponse, error)
+	PatchStartupLogs(ctx context.Context, req codersdk.PatchStartupLogs) error
+	PostWorkspaceAgentBootTiming(ctx context.Context, req codersdk.WorkspaceAgentBootTiming) error
+	WorkspaceAgentAuthorizedKeys(ctx context.Context) (codersdk.WorkspaceAgentAuthorizedKeys, error)
+	PostAgentConnectionEvents(ctx context.Context, req codersdk.PostAgentConnectionEventsRequest) error
+	PostWorkspaceAgentDriftReport(ctx context.Context, req codersdk.WorkspaceAgentDriftReport) error
+	PostWorkspaceAgentDeclaredPorts(ctx context.Context, req codersdk.PostWorkspaceAgentDeclaredPortsRequest) error
+	PostWorkspaceAgentStartupScriptResult(ctx context.Context, req codersdk.WorkspaceAgentStartupScriptResult) error
+	PostAgentCrashReport(ctx context.Context, req codersdk.AgentCrashReport) error
+	WatchWorkspaceAgentMetadata(ctx context.Context) (<-chan struct{}, error)
 }
 
-func New(options Options) io.Closer {
+func New(options Options) Agent {
 	if options.ReconnectingPTYTimeout == 0 {
 		options.ReconnectingPTYTimeout = 5 * time.Minute
 	}
+	if options.PTYRetention == 0 {
+		options.PTYRetention = defaultPTYRetention
+	}
+	if options.MaxListenerConnections <= 0 {
+		options.MaxListenerConnections = defaultMaxListenerConnections
+	}
+	if options.ReconnectingPTYBufferSize == 0 {
+		options.ReconnectingPTYBufferSize = defaultPTYBufferSize
+	}
+	if size := clampPTYBufferSize(options.ReconnectingPTYBufferSize); size != options.ReconnectingPTYBufferSize {
+		options.Logger.Warn(context.Background(), "reconnecting pty buffer size out of bounds",
+			slog.F("requested", options.ReconnectingPTYBufferSize),
+			slog.F("size", size),
+		)
+		options.ReconnectingPTYBufferSize = size
+	}
+	if options.ReconnectingPTYScrollbackLimit == 0 {
+		options.ReconnectingPTYScrollbackLimit = defaultPTYScrollbackLimit
+	}
 	if options.Filesystem == nil {
 		options.Filesystem = afero.NewOsFs()
 	}
 	if options.TempDir == "" {
 		options.TempDir = os.TempDir()
 	}
+	if options.SessionTempDirQuota == 0 {
+		options.SessionTempDirQuota = defaultSessionTempDirQuota
+	}
+	if options.HomeSkeletonDir == "" {
+		options.HomeSkeletonDir = defaultHomeSkeletonDir
+	}
+	if options.StartupLogMaxSize == 0 {
+		options.StartupLogMaxSize = defaultStartupLogMaxSize
+	}
+	if options.ReconnectMinInterval == 0 {
+		options.ReconnectMinInterval = defaultReconnectMinInterval
+	}
+	if options.ReconnectMaxInterval == 0 {
+		options.ReconnectMaxInterval = defaultReconnectMaxInterval
+	}
+	if options.StartPTY == nil {
+		options.StartPTY = pty.Start
+	}
+	if options.SessionRecorder == nil {
+		options.SessionRecorder = nopSessionRecorder{}
+	}
 	if options.ExchangeToken == nil {
 		options.ExchangeToken = func(ctx context.Context) (string, error) {
 			return "", nil
 		}
 	}
+	// The recent logs are sent with crash reports.
+	recentLogs := newLogRing(crashReportLogLines)
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	server := &agent{
 		reconnectingPTYTimeout: options.ReconnectingPTYTimeout,
-		logger:                 options.Logger,
+		ptyRetention:           options.PTYRetention,
+		ptyBufferSize:          options.ReconnectingPTYBufferSize,
+		ptyScrollback:          newPTYScrollbackStore(options.ReconnectingPTYScrollbackLimit),
+		namedPTYTimeout:        options.NamedReconnectingPTYTimeout,
+		maxListenerConnections: options.MaxListenerConnections,
+		controlSocketPath:      options.ControlSocketPath,
+		agentLogFile:           options.AgentLogFile,
+		logger:                 options.Logger.AppendSinks(sloghuman.Sink(recentLogs)),
+		recentLogs:             recentLogs,
+		closeCtx:               ctx,
 		closeCancel:            cancelFunc,
 		closed:                 make(chan struct{}),
 		envVars:                options.EnvironmentVariables,
+		envPassthrough:         options.EnvironmentPassthrough,
 		client:                 options.Client,
 		exchangeToken:          options.ExchangeToken,
 		filesystem:             options.Filesystem,
 		tempDir:                options.TempDir,
+		setHostname:            options.SetHostname,
+		startPTY:               options.StartPTY,
+		activePTYs:             map[string]pty.PTY{},
+		ptySnapshots:           map[uuid.UUID]ptySnapshot{},
+		activeSessions:         map[string]*activeSession{},
+		languageServers:        map[string]*languageServer{},
+		quickActionRuns:        map[string]*quickActionRun{},
+		reverseForwards:        map[string]*reverseForward{},
+		motdCache:              map[string]cachedMOTD{},
+		coderURL:               options.CoderURL,
+		startupLogMaxSize:      options.StartupLogMaxSize,
+		homeDir:                options.HomeDir,
+		provisionHome:          options.ProvisionHomeDir,
+		homeSkeletonDir:        options.HomeSkeletonDir,
+		environmentFile:        options.EnvironmentFile,
+		reopenLogs:             options.ReopenLogs,
+		sessionTempDirQuota:    options.SessionTempDirQuota,
+		maxReconnectInterval:   options.ReconnectMaxInterval,
+		disableVSCodeGitAuth:   options.DisableVSCodeGitAuth,
+		hardenedHost:           options.HardenedHost,
+		prewarmSessions:        options.PrewarmSessions,
+		shellPool:              newShellPool(options.PrewarmShells),
+		pprof:                  options.Pprof,
+		embeddedDERP:           options.EmbeddedDERP,
+		mac:                    detectMAC(options.Filesystem),
+		userNamespace:          detectUserNamespace(options.Filesystem),
+		sshLimiter:             newSSHLimiter(),
+		sshHostKeyFile:         options.SSHHostKeyFile,
+		sftpPolicy:             options.SFTP,
+		sessionRecorder:        options.SessionRecorder,
+		preSessionHook:         options.PreSessionHook,
+		bootTimer:              newBootTimer(time.Now()),
+		connectionEvents:       newConnectionEvents(),
+		activity:               newActivityTracker(time.Now()),
+		connectionPaths:        newConnectionPaths(time.Now()),
+		fdReserve:              newFDReserve(reservedFileDescriptors),
+		httpClient:             http.DefaultClient,
+		resolver:               net.DefaultResolver,
+		metadataReady:          make(chan struct{}),
+		startupScriptDone:      make(chan struct{}),
+		appsChanged:            make(chan struct{}, 1),
+		outputScheduler:        newOutputScheduler(),
+		pressure:               newPressureMonitor(options.Logger.Named("pressure"), options.Filesystem),
+		appProxy:               newAppProxy(options.Logger.Named("app-proxy")),
+		startup: codersdk.WorkspaceAgentStartupResponse{
+			State: codersdk.WorkspaceAgentStartupRunning,
+		},
+	}
+	if server.homeDir == nil {
+		server.homeDir = server.userHomeDir
+	}
+	if options.Resolver != nil {
+		server.resolver = options.Resolver
+		server.httpClient = &http.Client{
+			Transport: agentdns.Transport(options.Resolver),
+		}
+	}
+	server.reconnect = &reconnectBackoff{
+		floor: options.ReconnectMinInterval,
+		ceil:  server.reconnectMaxInterval,
+	}
+	err := server.loadEnvironmentFile()
+	if err != nil {
+		options.Logger.Warn(ctx, "load environment file", slog.Error(err))
 	}
 	server.init(ctx)
 	return server
@@ -111,22 +367,234 @@ type agent struct {
 	exchangeToken func(ctx context.Context) (string, error)
 	filesystem    afero.Fs
 	tempDir       string
+	setHostname   bool
+	startPTY      func(cmd *exec.Cmd, opt ...pty.StartOption) (pty.PTY, pty.Process, error)
+	coderURL      *url.URL
+	// startupLogMaxSize limits the size of the startup script logs.
+	startupLogMaxSize int64
+	homeDir           func() (string, error)
+	provisionHome     bool
+	homeSkeletonDir   string
+	// sessionTempDirQuota limits the size of the temporary directories
+	// of sessions.
+	sessionTempDirQuota int64
+	// reconnect backs off attempts to connect to coderd.
+	reconnect            *reconnectBackoff
+	maxReconnectInterval time.Duration
+	// httpClient is used for requests the agent makes itself, which
+	// aren't to coderd or apps in the workspace.
+	httpClient *http.Client
+	// resolver resolves the hostnames the agent connects to itself.
+	resolver *net.Resolver
+	// pprof serves profiles on the statistics server.
+	pprof bool
+	// embeddedDERP is used when the metadata doesn't configure an embedded
+	// DERP server.
+	embeddedDERP *codersdk.WorkspaceAgentEmbeddedDERP
+	// disableVSCodeGitAuth skips writing VS Code settings for git auth.
+	disableVSCodeGitAuth bool
+	// hardenedHost avoids operations that are commonly denied by the
+	// mandatory access control of mac. ptyDenied is set once allocating
+	// a PTY was denied, so later sessions use virtual PTYs.
+	hardenedHost bool
+	mac          macStatus
+	ptyDenied    atomic.Bool
+	// shellMissing is set once a command ran without the shell of the
+	// user, so the fallback is only logged once.
+	shellMissing atomic.Bool
+	// sessionEnv is the environment of sessions, which is computed again
+	// when sessionEnvGeneration is incremented. prewarmSessions computes
+	// it right away.
+	sessionEnv           atomic.Pointer[sessionEnvironment]
+	sessionEnvGeneration atomic.Uint64
+	prewarmSessions      bool
+	// shellPool runs the commands of sessions without a PTY with shells
+	// that were started ahead of them.
+	shellPool *shellPool
+	// userNamespace is reported in stats, since root in a rootless
+	// container can't do everything root can.
+	userNamespace userNamespace
+	// identityKey signs nonces of clients, which verify it against the
+	// public key that's registered with coderd in the handshake.
+	identityKey ed25519.PrivateKey
+
+	// reloadMutex serializes reloads.
+	reloadMutex     sync.Mutex
+	reopenLogs      func() error
+	environmentFile string
+	// environmentFileVars are the variables of the environment file,
+	// stored as a map[string]string.
+	environmentFileVars atomic.Value
+
+	// startup is the state of the startup script.
+	startupMutex sync.Mutex
+	startup      codersdk.WorkspaceAgentStartupResponse
+	// startupScriptDone is closed when the startup script ended, after
+	// startupScriptResult is stored.
+	startupScriptDone     chan struct{}
+	startupScriptResult   atomic.Pointer[codersdk.WorkspaceAgentStartupScriptResult]
+	startupScriptReported atomic.Bool
+	// startupScriptMutex serializes runs of the startup script, which runs
+	// again when it changes. lastStartupScript is the script that ran
+	// last.
+	startupScriptMutex sync.Mutex
+	lastStartupScript  string
+	// appsChanged restarts the health checks of apps when the apps in the
+	// metadata changed.
+	appsChanged chan struct{}
 
 	reconnectingPTYs       sync.Map
 	reconnectingPTYTimeout time.Duration
+	// ptyBufferSize is the default size of the scrollback of reconnecting
+	// PTYs.
+	ptyBufferSize int
+	// ptyScrollback keeps the scrollback of reconnecting PTYs.
+	ptyScrollback *ptyScrollbackStore
+	// namedPTYTimeout is how long named reconnecting PTYs are kept without
+	// connections, or zero to keep them until they exit.
+	namedPTYTimeout time.Duration
+	// maxListenerConnections limits the connections each tailnet listener
+	// handles at once.
+	maxListenerConnections int
+	controlSocketPath      string
+	agentLogFile           string
+	// ptySnapshots are the reconnecting PTYs that were serialized before
+	// the workspace was snapshotted, keyed by ID, until they're
+	// reconnected to.
+	ptySnapshotsMutex sync.Mutex
+	ptySnapshots      map[uuid.UUID]ptySnapshot
+	// ptyRetention is how long persisted reconnecting PTYs are restored
+	// for, and ptysChanged is set when their output changed since they
+	// were last persisted.
+	ptyRetention    time.Duration
+	ptysChanged     atomic.Bool
+	ptyPersistMutex sync.Mutex
+
+	// activePTYs are the PTYs of active SSH and reconnecting PTY
+	// sessions, keyed by session ID.
+	activePTYsMutex sync.Mutex
+	activePTYs      map[string]pty.PTY
+	// activeSessions are the SSH and reconnecting PTY sessions that can
+	// be listed and terminated, keyed by session ID.
+	activeSessionsMutex sync.Mutex
+	activeSessions      map[string]*activeSession
+	// outputScheduler takes turns writing the output of PTYs.
+	outputScheduler *outputScheduler
+	// appTokens are the tokens coderd sends with proxied app requests
+	// that haven't expired, newest first.
+	appTokensMutex sync.Mutex
+	appTokens      []appToken
+	// appHealthProbes records the health probes of apps.
+	appHealthProbes appHealthProbes
+	// appProxy limits and counts the connections to apps.
+	appProxy *appProxy
+	// usage counts features used between stats reports.
+	usage usageCounter
+	// pressure backs off periodic work when the workspace is under load.
+	pressure *pressureMonitor
+	// skippedStats is the number of stats reports in a row that skipped
+	// extracting traffic stats because of pressure. It's only accessed
+	// by the stats reporter.
+	skippedStats int
+
+	// languageServers are the language servers kept warm by the
+	// agent, keyed by name.
+	languageServersMutex sync.Mutex
+	languageServers      map[string]*languageServer
+
+	// quickActionRuns are the most recent runs of quick actions, keyed
+	// by name.
+	quickActionRunsMutex sync.Mutex
+	quickActionRuns      map[string]*quickActionRun
+
+	// reverseForwards are the active reverse port forwards,
+	// keyed by ID.
+	reverseForwardsMutex sync.Mutex
+	reverseForwards      map[string]*reverseForward
+
+	// motdCache is the last MOTD fetched from each source, keyed by
+	// the URL and command of the source.
+	motdMutex sync.Mutex
+	motdCache map[string]cachedMOTD
+
+	// quicPort is the loopback UDP port of the QUIC listener, or zero
+	// if QUIC is disabled.
+	quicPort atomic.Uint32
 
 	connCloseWait sync.WaitGroup
+	closeCtx      context.Context
 	closeCancel   context.CancelFunc
 	closeMutex    sync.Mutex
 	closed        chan struct{}
 
 	envVars map[string]string
+	// envPassthrough are patterns of the variables of the agent that
+	// sessions inherit, or nil to inherit every variable.
+	envPassthrough []string
+	// metadataReady is closed when the first metadata is fetched.
+	metadataReady chan struct{}
 	// metadata is atomic because values can change after reconnection.
 	metadata     atomic.Value
 	sessionToken atomic.Pointer[string]
-	sshServer    *ssh.Server
+	// metadataFetchedAt is when metadata was last fetched.
+	metadataFetchedAt atomic.Pointer[time.Time]
+	// coordinatorConnectedAt is when the agent connected to the
+	// coordinator, or nil while it isn't connected.
+	coordinatorConnectedAt atomic.Pointer[time.Time]
+	// handshake is the protocol version and capabilities
+	// negotiated with coderd on the most recent connection.
+	handshake atomic.Pointer[codersdk.WorkspaceAgentHandshakeResponse]
+	// currentRun restarts the current run when a goroutine of it panics.
+	currentRun atomic.Pointer[runRestart]
+	recentLogs *logRing
+	// pendingCrashReports are the panics that weren't sent to coderd yet.
+	crashReportsMutex     sync.Mutex
+	pendingCrashReports   []codersdk.AgentCrashReport
+	sendCrashReportsMutex sync.Mutex
+	sshServer             *ssh.Server
+	// sshLimiter rate limits SSH connections per peer.
+	sshLimiter *sshLimiter
+	// malformedPTYInits counts reconnecting PTY connections that were
+	// closed because of their init message.
+	malformedPTYInits atomic.Int64
+	// sshHostKeyFile persists the host key, if it's set.
+	sshHostKeyFile string
+	// sftpPolicy restricts SFTP sessions with the policy of the metadata.
+	sftpPolicy *codersdk.WorkspaceAgentSFTP
+	// authorizedKeys caches the SSH public keys fetched from coderd.
+	authorizedKeys authorizedKeys
+	// sessionRecorder is called with the sessions and PTY I/O.
+	sessionRecorder SessionRecorder
+	// preSessionHook decides whether sessions start, when it's set.
+	preSessionHook PreSessionHook
+	// bootTimer measures the phases of starting the agent.
+	bootTimer *bootTimer
+	// connectionEvents records connections to the agent for auditing.
+	connectionEvents *connectionEvents
+	// timeline records significant events of the agent to disk for
+	// postmortems.
+	timeline *eventTimeline
+	// activity tracks connections to the agent to report how long the
+	// workspace has been idle.
+	activity *activityTracker
+	// fdReserve is released when the process runs out of file
+	// descriptors.
+	fdReserve *fdReserve
+	// draining is set once the agent stops accepting connections before
+	// it closes, see CloseWithTimeout.
+	draining atomic.Bool
+	// connectionPaths accumulates how long peers were connected directly
+	// and through DERP.
+	connectionPaths *connectionPaths
+	// driftReportedAt is when the workspace was last compared to the
+	// drift manifest and reported.
+	driftReportedAt atomic.Time
 
 	network *tailnet.Conn
+
+	derpListener   net.Listener
+	derpServer     *derp.Server
+	derpHTTPServer *http.Server
 }
 
 // runLoop attempts to start the agent in a retry loop.
@@ -134,9 +602,13 @@ type agent struct {
 // may be happening, but regardless after the intermittent
 // failure, you'll want the agent to reconnect.
 func (a *agent) runLoop(ctx context.Context) {
-	for retrier := retry.New(100*time.Millisecond, 10*time.Second); retrier.Wait(ctx); {
-		a.logger.Info(ctx, "running loop")
-		err := a.run(ctx)
+	for a.reconnect.Wait(ctx) {
+		state := a.reconnect.State()
+		a.logger.Info(ctx, "running loop",
+			slog.F("attempt", state.Attempt),
+			slog.F("max_interval", a.reconnectMaxInterval()))
+		err := a.runRecovered(ctx)
+		a.reconnect.Disconnected(err)
 		// Cancel after the run is complete to clean up any leaked resources!
 		if err == nil {
 			continue
@@ -147,6 +619,7 @@ func (a *agent) runLoop(ctx context.Context) {
 		if a.isClosed() {
 			return
 		}
+		a.timeline.record(codersdk.AgentEventDisconnected, "Disconnected from Coder: %s", err)
 		if errors.Is(err, io.EOF) {
 			a.logger.Info(ctx, "likely disconnected from coder", slog.Error(err))
 			continue
@@ -159,67 +632,156 @@ func (a *agent) run(ctx context.Context) error {
 	// This allows the agent to refresh it's token if necessary.
 	// For instance identity this is required, since the instance
 	// may not have re-provisioned, but a new agent ID was created.
+	exchangeStarted := time.Now()
 	sessionToken, err := a.exchangeToken(ctx)
 	if err != nil {
-		return xerrors.Errorf("exchange token: %w", err)
+		return xerrors.Errorf("exchange token: %w", codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorTokenExchangeFailed, err))
 	}
 	a.sessionToken.Store(&sessionToken)
+	a.sessionEnvironmentChanged(ctx)
+	a.bootTimer.recordSince(bootPhaseTokenExchange, exchangeStarted)
 
 	err = a.client.PostWorkspaceAgentVersion(ctx, buildinfo.Version())
 	if err != nil {
 		return xerrors.Errorf("update workspace agent version: %w", err)
 	}
 
+	handshake, err := a.negotiate(ctx)
+	if err != nil {
+		return xerrors.Errorf("negotiate protocol: %w", err)
+	}
+	a.handshake.Store(&handshake)
+	// Reporters depend on the capabilities of this connection, so they
+	// stop when it ends.
+	reportCtx, reportCancel := context.WithCancel(ctx)
+	defer reportCancel()
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityBootTiming) {
+		a.goRun(ctx, "boot-timing", func() {
+			a.bootTimer.report(reportCtx, a.logger.Named("boot-timing"), a.client.PostWorkspaceAgentBootTiming)
+		})
+	}
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityConnectionEvents) {
+		a.goRun(ctx, "connection-events", func() {
+			a.connectionEvents.report(reportCtx, a.logger.Named("connection-events"), a.client.PostAgentConnectionEvents)
+		})
+	}
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityDrift) {
+		a.goRun(ctx, "drift", func() {
+			a.reportDrift(reportCtx)
+		})
+	}
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityDeclaredPorts) {
+		a.goRun(ctx, "declared-ports", func() {
+			a.reportDeclaredPorts(reportCtx)
+		})
+	}
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityStartupScriptResult) {
+		a.goRun(ctx, "startup-script-result", func() {
+			a.reportStartupScriptResult(reportCtx)
+		})
+	}
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityMetadataWatch) {
+		a.goRun(ctx, "metadata-watch", func() {
+			a.watchMetadata(reportCtx)
+		})
+	}
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityCrashReport) {
+		// Panics that happened before or while disconnected are sent
+		// now.
+		go a.sendCrashReports(reportCtx)
+	}
+
+	metadataStarted := time.Now()
 	metadata, err := a.client.WorkspaceAgentMetadata(ctx)
 	if err != nil {
 		return xerrors.Errorf("fetch metadata: %w", err)
 	}
+	metadata, err = a.validateMetadata(ctx, metadata)
+	if err != nil {
+		return xerrors.Errorf("validate metadata: %w", err)
+	}
+	a.bootTimer.recordSince(bootPhaseMetadataFetch, metadataStarted)
+	fetchedAt := time.Now()
+	a.metadataFetchedAt.Store(&fetchedAt)
 	a.logger.Info(ctx, "fetched metadata")
+	a.reconnect.Connected()
+	// The home directory is provisioned before the first metadata is
+	// stored, since sessions wait for it.
+	if a.provisionHome && a.metadata.Load() == nil {
+		err = a.provisionHomeDir(ctx)
+		if err != nil {
+			a.logger.Warn(ctx, "provision home directory", slog.Error(err))
+		}
+	}
+	oldPTYTimeout := a.ptyTimeout()
 	oldMetadata := a.metadata.Swap(metadata)
+	a.sessionEnvironmentChanged(ctx)
+	a.applyPTYTimeout(ctx, oldPTYTimeout)
+	if oldMetadata == nil {
+		close(a.metadataReady)
+	}
 
-	// The startup script should only execute on the first run!
+	// Subsystems are started with the flags of the first metadata.
 	if oldMetadata == nil {
-		go func() {
-			err := a.runStartupScript(ctx, metadata.StartupScript)
-			if errors.Is(err, context.Canceled) {
-				return
-			}
-			if err != nil {
-				a.logger.Warn(ctx, "agent script failed", slog.Error(err))
-			}
-		}()
+		logFeatureFlags(ctx, a.logger, metadata.FeatureFlags)
+	}
+
+	if oldMetadata == nil && a.setHostname {
+		a.applyHostname(ctx, metadata.Hostname)
+	}
+
+	// The startup script should only execute on the first run! It runs
+	// again when it changed while the agent was disconnected.
+	a.startStartupScript(ctx, oldMetadata != nil)
+	if oldMetadata == nil {
+		a.startLanguageServers(ctx, metadata.LanguageServers, metadata.Directory)
+		a.startShellHistorySync(ctx, metadata.ShellHistory)
 	}
 
-	if metadata.GitAuthConfigs > 0 {
+	if metadata.GitAuthConfigs > 0 && !a.disableVSCodeGitAuth {
 		err = gitauth.OverrideVSCodeConfigs(a.filesystem)
 		if err != nil {
-			return xerrors.Errorf("override vscode configuration for git auth: %w", err)
+			// The settings are in the home directory, which can be
+			// read-only. Git authentication still works outside of
+			// VS Code, so the agent keeps running.
+			a.logger.Warn(ctx, "override vscode configuration for git auth, set CODER_AGENT_DISABLE_VSCODE_GIT_AUTH to skip it",
+				slog.Error(explainWriteError(err, "HOME")))
 		}
 	}
 
-	// This automatically closes when the context ends!
-	appReporterCtx, appReporterCtxCancel := context.WithCancel(ctx)
-	defer appReporterCtxCancel()
-	go NewWorkspaceAppHealthReporter(
-		a.logger, metadata.Apps, a.client.PostWorkspaceAgentAppHealth)(appReporterCtx)
+	if handshake.Has(codersdk.WorkspaceAgentCapabilityAppHealth) {
+		// This automatically closes when the context ends!
+		appReporterCtx, appReporterCtxCancel := context.WithCancel(ctx)
+		defer appReporterCtxCancel()
+		a.goRun(ctx, "app-health", func() {
+			a.reportAppHealth(appReporterCtx, metadata.Apps)
+		})
+	}
 
-	a.logger.Debug(ctx, "running tailnet with derpmap", slog.F("derpmap", metadata.DERPMap))
+	derpMap, err := a.resolveDERPMap(ctx, metadata)
+	if err != nil {
+		return xerrors.Errorf("derp map: %w", err)
+	}
 
 	a.closeMutex.Lock()
 	network := a.network
 	a.closeMutex.Unlock()
 	if network == nil {
 		a.logger.Debug(ctx, "creating tailnet")
-		network, err = a.createTailnet(ctx, metadata.DERPMap)
+		tailnetStarted := time.Now()
+		network, err = a.createTailnet(ctx, derpMap, metadata)
 		if err != nil {
 			return xerrors.Errorf("create tailnet: %w", err)
 		}
+		a.bootTimer.recordSince(bootPhaseTailnetUp, tailnetStarted)
 		a.closeMutex.Lock()
 		a.network = network
 		a.closeMutex.Unlock()
 	} else {
 		// Update the DERP map!
-		network.SetDERPMap(metadata.DERPMap)
+		network.SetDERPMap(derpMap)
+		network.SetKeepAlive(keepAliveInterval(metadata), metadata.DisableKeepAlive)
+		network.SetBlockEndpoints(metadata.DisableDirectConnections)
 	}
 
 	a.logger.Debug(ctx, "running coordinator")
@@ -231,7 +793,100 @@ func (a *agent) run(ctx context.Context) error {
 	return nil
 }
 
-func (a *agent) createTailnet(ctx context.Context, derpMap *tailcfg.DERPMap) (*tailnet.Conn, error) {
+// logFeatureFlags logs the feature flags set for the agent, and warns about
+// flags that this version doesn't support, which are ignored.
+func logFeatureFlags(ctx context.Context, logger slog.Logger, flags map[codersdk.WorkspaceAgentFeatureFlag]bool) {
+	if len(flags) == 0 {
+		return
+	}
+	supported := make(map[codersdk.WorkspaceAgentFeatureFlag]struct{}, len(codersdk.WorkspaceAgentFeatureFlags))
+	for _, flag := range codersdk.WorkspaceAgentFeatureFlags {
+		supported[flag] = struct{}{}
+	}
+	for flag, enabled := range flags {
+		if _, ok := supported[flag]; !ok {
+			logger.Warn(ctx, "ignoring unsupported feature flag", slog.F("flag", flag), slog.F("enabled", enabled))
+			continue
+		}
+		logger.Info(ctx, "feature flag set", slog.F("flag", flag), slog.F("enabled", enabled))
+	}
+}
+
+// featureEnabled evaluates a feature flag with the metadata the agent last
+// fetched, returning fallback if it isn't set.
+func (a *agent) featureEnabled(flag codersdk.WorkspaceAgentFeatureFlag, fallback bool) bool {
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	return metadata.FeatureEnabled(flag, fallback)
+}
+
+// legacyCapabilities are assumed when coderd predates the handshake.
+var legacyCapabilities = []codersdk.WorkspaceAgentCapability{
+	codersdk.WorkspaceAgentCapabilityStatsReport,
+	codersdk.WorkspaceAgentCapabilityAppHealth,
+	codersdk.WorkspaceAgentCapabilityListeningPorts,
+}
+
+// negotiate agrees on a protocol version and set of capabilities
+// with coderd. Older versions of coderd don't support the handshake,
+// so the first protocol version is assumed instead of failing.
+func (a *agent) negotiate(ctx context.Context) (codersdk.WorkspaceAgentHandshakeResponse, error) {
+	resp, err := a.client.PostWorkspaceAgentHandshake(ctx, codersdk.WorkspaceAgentHandshakeRequest{
+		Version:         buildinfo.Version(),
+		ProtocolVersion: codersdk.WorkspaceAgentProtocolVersion,
+		Capabilities:    codersdk.WorkspaceAgentCapabilities,
+		IdentityKey:     a.identityPublicKey(),
+	})
+	if err != nil {
+		var sdkErr *codersdk.Error
+		if !xerrors.As(err, &sdkErr) || sdkErr.StatusCode() != http.StatusNotFound {
+			return codersdk.WorkspaceAgentHandshakeResponse{}, err
+		}
+		a.logger.Info(ctx, "coderd does not support the handshake, assuming legacy protocol")
+		return codersdk.WorkspaceAgentHandshakeResponse{
+			ProtocolVersion: 1,
+			Capabilities:    legacyCapabilities,
+		}, nil
+	}
+	a.logger.Info(ctx, "negotiated protocol with coderd",
+		slog.F("protocol_version", resp.ProtocolVersion),
+		slog.F("capabilities", resp.Capabilities))
+	return resp, nil
+}
+
+// ptyTimeout returns how long reconnecting PTYs are kept without
+// connections. The metadata overrides the timeout in the options.
+func (a *agent) ptyTimeout() time.Duration {
+	metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if ok && metadata.ReconnectingPTYTimeoutSeconds > 0 {
+		return time.Duration(metadata.ReconnectingPTYTimeoutSeconds) * time.Second
+	}
+	return a.reconnectingPTYTimeout
+}
+
+// applyPTYTimeout applies a changed timeout to existing reconnecting PTYs.
+func (a *agent) applyPTYTimeout(ctx context.Context, old time.Duration) {
+	timeout := a.ptyTimeout()
+	if timeout == old {
+		return
+	}
+	a.logger.Info(ctx, "reconnecting pty timeout changed", slog.F("timeout", timeout))
+	a.reconnectingPTYs.Range(func(_, value any) bool {
+		rpty, ok := value.(*reconnectingPTY)
+		// Named PTYs have a timeout of their own.
+		if ok && rpty.name == "" {
+			rpty.setTimeout(timeout)
+		}
+		return true
+	})
+}
+
+// keepAliveInterval returns the WireGuard keepalive interval configured
+// in the metadata.
+func keepAliveInterval(metadata codersdk.WorkspaceAgentMetadata) time.Duration {
+	return time.Duration(metadata.KeepAliveIntervalSeconds) * time.Second
+}
+
+func (a *agent) createTailnet(ctx context.Context, derpMap *tailcfg.DERPMap, metadata codersdk.WorkspaceAgentMetadata) (*tailnet.Conn, error) {
 	a.closeMutex.Lock()
 	if a.isClosed() {
 		a.closeMutex.Unlock()
@@ -242,87 +897,132 @@ func (a *agent) createTailnet(ctx context.Context, derpMap *tailcfg.DERPMap) (*t
 		DERPMap:            derpMap,
 		Logger:             a.logger.Named("tailnet"),
 		EnableTrafficStats: true,
+		KeepAliveInterval:  keepAliveInterval(metadata),
+		DisableKeepAlive:   metadata.DisableKeepAlive,
+		BlockEndpoints:     metadata.DisableDirectConnections,
 	})
 	if err != nil {
 		a.closeMutex.Unlock()
-		return nil, xerrors.Errorf("create tailnet: %w", err)
+		return nil, xerrors.Errorf("create tailnet: %w", codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorTailnetInitFailed, err))
 	}
 	a.network = network
-	a.connCloseWait.Add(4)
+	a.connCloseWait.Add(8)
 	a.closeMutex.Unlock()
+	network.SetUnboundPortHandler(a.handleUnboundPort)
+	// Connections without a listener are forwarded to local ports, like
+	// with "coder port-forward".
+	network.SetForwardTCPCallback(func(conn net.Conn, listenerExists bool) net.Conn {
+		// Draining agents refuse new connections, so only the ones
+		// that are open keep it running.
+		if a.draining.Load() {
+			_ = conn.Close()
+			return nil
+		}
+		if listenerExists {
+			return conn
+		}
+		metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+		conn = a.appProxy.forward(conn, metadata)
+		if conn == nil {
+			return nil
+		}
+		return &recordedConn{
+			Conn:         a.connectionEvents.forwardedConn(conn),
+			disconnected: a.activity.start(),
+		}
+	})
 
-	sshListener, err := network.Listen("tcp", ":"+strconv.Itoa(codersdk.TailnetSSHPort))
+	sshListener, err := a.listen(network, codersdk.TailnetSSHPort)
 	if err != nil {
 		return nil, xerrors.Errorf("listen on the ssh port: %w", err)
 	}
 	go func() {
 		defer a.connCloseWait.Done()
-		for {
-			conn, err := sshListener.Accept()
-			if err != nil {
+		a.serveListener(ctx, "ssh", sshListener, func(conn net.Conn) {
+			if !a.sshLimiter.allow(sshPeerKey(conn.RemoteAddr())) {
+				a.logger.Debug(ctx, "rejected ssh connection from rate limited peer",
+					slog.F("remote_addr", conn.RemoteAddr().String()))
+				_ = conn.Close()
 				return
 			}
-			go a.sshServer.HandleConn(conn)
-		}
+			inactive := a.activity.start()
+			defer inactive()
+			a.sshServer.HandleConn(conn)
+		})
 	}()
 
-	reconnectingPTYListener, err := network.Listen("tcp", ":"+strconv.Itoa(codersdk.TailnetReconnectingPTYPort))
+	reconnectingPTYListener, err := a.listen(network, codersdk.TailnetReconnectingPTYPort)
 	if err != nil {
 		return nil, xerrors.Errorf("listen for reconnecting pty: %w", err)
 	}
 	go func() {
 		defer a.connCloseWait.Done()
-		for {
-			conn, err := reconnectingPTYListener.Accept()
-			if err != nil {
-				a.logger.Debug(ctx, "accept pty failed", slog.Error(err))
-				return
-			}
-			// This cannot use a JSON decoder, since that can
-			// buffer additional data that is required for the PTY.
-			rawLen := make([]byte, 2)
-			_, err = conn.Read(rawLen)
-			if err != nil {
-				continue
-			}
-			length := binary.LittleEndian.Uint16(rawLen)
-			data := make([]byte, length)
-			_, err = conn.Read(data)
-			if err != nil {
-				continue
-			}
-			var msg codersdk.ReconnectingPTYInit
-			err = json.Unmarshal(data, &msg)
-			if err != nil {
-				continue
-			}
-			go a.handleReconnectingPTY(ctx, msg, conn)
-		}
+		// The init is read in the goroutine of the connection, so a peer
+		// that stalls doesn't block other connections.
+		a.serveListener(ctx, "reconnecting_pty", reconnectingPTYListener, func(conn net.Conn) {
+			a.handleReconnectingPTYConn(ctx, conn)
+		})
 	}()
 
-	speedtestListener, err := network.Listen("tcp", ":"+strconv.Itoa(codersdk.TailnetSpeedtestPort))
+	speedtestListener, err := a.listen(network, codersdk.TailnetSpeedtestPort)
 	if err != nil {
 		return nil, xerrors.Errorf("listen for speedtest: %w", err)
 	}
 	go func() {
 		defer a.connCloseWait.Done()
-		for {
-			conn, err := speedtestListener.Accept()
-			if err != nil {
-				a.logger.Debug(ctx, "speedtest listener failed", slog.Error(err))
-				return
-			}
+		a.serveListener(ctx, "speedtest", speedtestListener, func(conn net.Conn) {
 			a.closeMutex.Lock()
 			a.connCloseWait.Add(1)
 			a.closeMutex.Unlock()
-			go func() {
-				defer a.connCloseWait.Done()
-				_ = speedtest.ServeConn(conn)
-			}()
-		}
+			defer a.connCloseWait.Done()
+			a.usage.speedtests.Inc()
+			_ = speedtest.ServeConn(conn)
+		})
+	}()
+
+	languageServerListener, err := a.listen(network, codersdk.TailnetLanguageServerPort)
+	if err != nil {
+		return nil, xerrors.Errorf("listen for language servers: %w", err)
+	}
+	go func() {
+		defer a.connCloseWait.Done()
+		a.serveListener(ctx, "language_server", languageServerListener, func(conn net.Conn) {
+			a.handleLanguageServerConn(ctx, conn)
+		})
+	}()
+
+	fileSyncListener, err := a.listen(network, codersdk.TailnetFileSyncPort)
+	if err != nil {
+		return nil, xerrors.Errorf("listen for file sync: %w", err)
+	}
+	go func() {
+		defer a.connCloseWait.Done()
+		a.serveListener(ctx, "file_sync", fileSyncListener, func(conn net.Conn) {
+			a.handleFileSyncConn(ctx, conn)
+		})
+	}()
+
+	execListener, err := a.listen(network, codersdk.TailnetExecPort)
+	if err != nil {
+		return nil, xerrors.Errorf("listen for exec: %w", err)
+	}
+	go func() {
+		defer a.connCloseWait.Done()
+		a.serveListener(ctx, "exec", execListener, func(conn net.Conn) {
+			a.handleExecConn(ctx, conn)
+		})
+	}()
+
+	socksListener, err := a.listen(network, codersdk.TailnetSocksPort)
+	if err != nil {
+		return nil, xerrors.Errorf("listen for socks: %w", err)
+	}
+	go func() {
+		defer a.connCloseWait.Done()
+		a.serveSOCKS(ctx, socksListener)
 	}()
 
-	statisticsListener, err := network.Listen("tcp", ":"+strconv.Itoa(codersdk.TailnetStatisticsPort))
+	statisticsListener, err := a.listen(network, codersdk.TailnetStatisticsPort)
 	if err != nil {
 		return nil, xerrors.Errorf("listen for statistics: %w", err)
 	}
@@ -330,7 +1030,7 @@ func (a *agent) createTailnet(ctx context.Context, derpMap *tailcfg.DERPMap) (*t
 		defer a.connCloseWait.Done()
 		defer statisticsListener.Close()
 		server := &http.Server{
-			Handler:           a.statisticsHandler(),
+			Handler:           a.statisticsHandler(ctx),
 			ReadTimeout:       20 * time.Second,
 			ReadHeaderTimeout: 20 * time.Second,
 			WriteTimeout:      20 * time.Second,
@@ -347,18 +1047,101 @@ func (a *agent) createTailnet(ctx context.Context, derpMap *tailcfg.DERPMap) (*t
 		}
 	}()
 
+	if metadata.FeatureEnabled(codersdk.WorkspaceAgentFeatureQUIC, metadata.ExperimentalQUIC) {
+		err = a.startQUIC(ctx)
+		if err != nil {
+			// Clients fall back to TCP when QUIC isn't offered.
+			a.logger.Warn(ctx, "start quic listener", slog.Error(err))
+		}
+	}
+
 	return network, nil
 }
 
+// readReconnectingPTYInit reads the init message at the start of a
+// reconnecting PTY connection.
+func readReconnectingPTYInit(conn net.Conn) (codersdk.ReconnectingPTYInit, error) {
+	var msg codersdk.ReconnectingPTYInit
+	err := readInitMessage(conn, codersdk.ReconnectingPTYInitTimeout, codersdk.MaxReconnectingPTYInitSize, &msg)
+	return msg, err
+}
+
+// readInitMessage reads the length-prefixed JSON message at the start of a
+// connection. This cannot use a JSON decoder, since that can buffer
+// additional data that follows it. Peers that stall or send an oversized
+// message are cut off by the timeout and the limit on the size.
+func readInitMessage(conn net.Conn, timeout time.Duration, maxSize int, msg interface{}) error {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return xerrors.Errorf("set read deadline: %w", err)
+	}
+	rawLen := make([]byte, 2)
+	_, err = io.ReadFull(conn, rawLen)
+	if err != nil {
+		return xerrors.Errorf("read length: %w", err)
+	}
+	length := int(binary.LittleEndian.Uint16(rawLen))
+	if length > maxSize {
+		return xerrors.Errorf("init of %d bytes exceeds the limit of %d", length, maxSize)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		return xerrors.Errorf("read init: %w", err)
+	}
+	err = json.Unmarshal(data, msg)
+	if err != nil {
+		return xerrors.Errorf("unmarshal init: %w", err)
+	}
+	err = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return xerrors.Errorf("clear read deadline: %w", err)
+	}
+	return nil
+}
+
+// handleReconnectingPTYConn reads the init message of a reconnecting PTY
+// connection and serves it. Connections with a malformed init are closed
+// and counted.
+func (a *agent) handleReconnectingPTYConn(ctx context.Context, conn net.Conn) {
+	// The address isn't available after the connection is closed.
+	remoteAddr := conn.RemoteAddr().String()
+	// Closing the connection stops reading the init when the agent closes.
+	read := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-read:
+		}
+	}()
+	msg, err := readReconnectingPTYInit(conn)
+	close(read)
+	if err != nil {
+		a.malformedPTYInits.Inc()
+		a.logger.Debug(ctx, "read reconnecting pty init",
+			slog.F("remote_addr", remoteAddr), slog.Error(err))
+		_ = conn.Close()
+		return
+	}
+	a.handleReconnectingPTY(ctx, msg, conn, nil)
+}
+
 // runCoordinator runs a coordinator and returns whether a reconnect
 // should occur.
 func (a *agent) runCoordinator(ctx context.Context, network *tailnet.Conn) error {
+	started := time.Now()
 	coordinator, err := a.client.ListenWorkspaceAgent(ctx)
 	if err != nil {
 		return err
 	}
 	defer coordinator.Close()
+	a.bootTimer.recordSince(bootPhaseCoordinatorConnected, started)
 	a.logger.Info(ctx, "connected to coordination server")
+	a.timeline.record(codersdk.AgentEventConnected, "Connected to Coder.")
+	connectedAt := time.Now()
+	a.coordinatorConnectedAt.Store(&connectedAt)
+	defer a.coordinatorConnectedAt.Store(nil)
 	sendNodes, errChan := tailnet.ServeCoordinator(coordinator, network.UpdateNodes)
 	network.SetNodeCallback(sendNodes)
 	select {
@@ -369,63 +1152,112 @@ func (a *agent) runCoordinator(ctx context.Context, network *tailnet.Conn) error
 	}
 }
 
-func (a *agent) runStartupScript(ctx context.Context, script string) error {
+// runStartupScript runs the script until it succeeds or the retries of the
+// policy are used up, and returns the number of attempts.
+func (a *agent) runStartupScript(ctx context.Context, script string, policy codersdk.WorkspaceAgentStartupScriptPolicy) (int, error) {
 	if script == "" {
-		return nil
+		return 0, nil
 	}
 
 	a.logger.Info(ctx, "running startup script", slog.F("script", script))
-	writer, err := a.filesystem.OpenFile(filepath.Join(a.tempDir, "coder-startup-script.log"), os.O_CREATE|os.O_RDWR, 0o600)
+	// The logs are truncated when opened, since their size is limited
+	// from the start.
+	writer, err := a.filesystem.OpenFile(filepath.Join(a.tempDir, "coder-startup-script.log"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
 	if err != nil {
-		return xerrors.Errorf("open startup script log file: %w", err)
+		return 0, xerrors.Errorf("open startup script log file: %w", explainWriteError(err, "CODER_AGENT_TEMP_DIR"))
 	}
 	defer func() {
 		_ = writer.Close()
 	}()
-	cmd, err := a.createCommand(ctx, script, nil)
+	limitWriter := newLogLimitWriter(writer, a.startupLogMaxSize)
+	defer func() {
+		_ = limitWriter.Close()
+	}()
+	// The plain text log has colors and other escape sequences removed,
+	// so it can be rendered and searched. Terminals can show the raw log.
+	plainWriter, err := a.filesystem.OpenFile(filepath.Join(a.tempDir, "coder-startup-script.plain.log"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
 	if err != nil {
-		return xerrors.Errorf("create command: %w", err)
+		return 0, xerrors.Errorf("open startup script plain log file: %w", explainWriteError(err, "CODER_AGENT_TEMP_DIR"))
 	}
-	cmd.Stdout = writer
-	cmd.Stderr = writer
-	err = cmd.Run()
-	if err != nil {
-		// cmd.Run does not return a context canceled error, it returns "signal: killed".
-		if ctx.Err() != nil {
-			return ctx.Err()
+	defer func() {
+		_ = plainWriter.Close()
+	}()
+	plainLimitWriter := newLogLimitWriter(plainWriter, a.startupLogMaxSize)
+	defer func() {
+		_ = plainLimitWriter.Close()
+	}()
+	plainOutput := io.Writer(plainLimitWriter)
+	// The plain output is streamed to coderd too, if it accepts it.
+	if handshake := a.handshake.Load(); handshake != nil && handshake.Has(codersdk.WorkspaceAgentCapabilityStartupLogs) {
+		sender := newStartupLogSender(ctx, a.logger.Named("startup-logs"), a.client.PatchStartupLogs, a.startupLogMaxSize)
+		defer func() {
+			_ = sender.Close()
+		}()
+		plainOutput = io.MultiWriter(plainLimitWriter, sender)
+	}
+	output := io.MultiWriter(limitWriter, newANSIStripWriter(plainOutput))
+	timeout := time.Duration(policy.TimeoutSeconds) * time.Second
+	attempts := int(policy.Retries) + 1
+	for attempt := 1; ; attempt++ {
+		err = a.runStartupScriptAttempt(ctx, script, timeout, output)
+		if err == nil || ctx.Err() != nil || attempt == attempts {
+			return attempt, err
+		}
+		a.logger.Warn(ctx, "startup script failed, retrying",
+			slog.F("attempt", attempt),
+			slog.F("attempts", attempts),
+			slog.Error(err))
+		_, _ = io.WriteString(output, startupScriptRetryMessage(attempt, attempts, err))
+		timer := time.NewTimer(startupScriptRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, ctx.Err()
+		case <-timer.C:
 		}
-
-		return xerrors.Errorf("run: %w", err)
 	}
-
-	return nil
 }
 
 func (a *agent) init(ctx context.Context) {
-	a.logger.Info(ctx, "generating host key")
+	a.identityKey = generateIdentityKey()
+	a.checkTempDir(ctx)
+	a.timeline = newEventTimeline(a.filesystem, filepath.Join(a.tempDir, eventTimelineFile), a.logger.Named("timeline"))
+	a.timeline.recordStarted(buildinfo.Version())
+	if a.ptyRetention > 0 {
+		a.restorePersistedPTYs(ctx)
+	}
+	// PTYs serialized before a VM snapshot take precedence, since they
+	// were serialized right before the agent stopped.
+	a.restorePTYSnapshots(ctx)
+	a.logMAC(ctx)
+	a.logUserNamespace(ctx)
 	// Clients' should ignore the host key when connecting.
 	// The agent needs to authenticate with coderd to SSH,
 	// so SSH authentication doesn't improve security.
-	randomHostKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err)
-	}
-	randomSigner, err := gossh.NewSignerFromKey(randomHostKey)
-	if err != nil {
-		panic(err)
-	}
+	hostSigner := a.hostSigner(ctx)
 	sshLogger := a.logger.Named("ssh-server")
-	forwardHandler := &ssh.ForwardedTCPHandler{}
 	a.sshServer = &ssh.Server{
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"direct-tcpip": ssh.DirectTCPIPHandler,
-			"session":      ssh.DefaultSessionHandler,
+			"direct-tcpip": func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+				a.usage.portForwards.Inc()
+				directTCPIPHandler(srv, conn, newChan, ctx, func(destination string) func() {
+					return a.connectionEvents.connected(codersdk.AgentConnectionTypePortForward, "", ctx.RemoteAddr(), ctx.User(), "", destination)
+				})
+			},
+			"session": ssh.DefaultSessionHandler,
 		},
 		ConnectionFailedCallback: func(conn net.Conn, err error) {
 			sshLogger.Info(ctx, "ssh connection ended", slog.Error(err))
+			if a.sshLimiter.fail(sshPeerKey(conn.RemoteAddr())) {
+				sshLogger.Warn(ctx, "banned peer after repeated failed ssh handshakes",
+					slog.F("remote_addr", conn.RemoteAddr().String()),
+					slog.F("duration", sshBanDuration))
+			}
 		},
 		Handler: func(session ssh.Session) {
+			defer a.recoverPanic(ctx, "ssh")
 			err := a.handleSSHSession(session)
+			err = a.checkFDs(ctx, err)
 			var exitError *exec.ExitError
 			if xerrors.As(err, &exitError) {
 				a.logger.Debug(ctx, "ssh session returned", slog.Error(exitError))
@@ -433,14 +1265,19 @@ func (a *agent) init(ctx context.Context) {
 				return
 			}
 			if err != nil {
-				a.logger.Warn(ctx, "ssh session failed", slog.Error(err))
+				a.logger.Warn(ctx, "ssh session failed",
+					slog.F("code", codersdk.WorkspaceAgentErrorCodeOf(err)),
+					slog.Error(err))
+				// The exit code alone doesn't explain the failure.
+				_, _ = io.WriteString(session.Stderr(), terminalMessage(codersdk.FormatWorkspaceAgentError(err)))
+				sendSessionError(session, err)
 				// This exit code is designed to be unlikely to be confused for a legit exit code
 				// from the process.
 				_ = session.Exit(MagicSessionErrorCode)
 				return
 			}
 		},
-		HostSigners: []ssh.Signer{randomSigner},
+		HostSigners: []ssh.Signer{hostSigner},
 		LocalPortForwardingCallback: func(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
 			// Allow local port forwarding all!
 			sshLogger.Debug(ctx, "local port forward",
@@ -451,25 +1288,27 @@ func (a *agent) init(ctx context.Context) {
 		PtyCallback: func(ctx ssh.Context, pty ssh.Pty) bool {
 			return true
 		},
-		ReversePortForwardingCallback: func(ctx ssh.Context, bindHost string, bindPort uint32) bool {
-			// Allow reverse port forwarding all!
-			sshLogger.Debug(ctx, "local port forward",
-				slog.F("bind-host", bindHost),
-				slog.F("bind-port", bindPort))
-			return true
-		},
 		RequestHandlers: map[string]ssh.RequestHandler{
-			"tcpip-forward":        forwardHandler.HandleSSHRequest,
-			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+			// Reverse port forwards are checked against the policy
+			// in the metadata by the handler.
+			"tcpip-forward":        a.handleReverseForwardRequest,
+			"cancel-tcpip-forward": a.handleReverseForwardRequest,
 		},
+		// Connections are authenticated by the tailnet, unless the
+		// metadata requires SSH user certificates issued by coderd or
+		// public keys of the owner of the workspace.
+		PublicKeyHandler: a.handleSSHPublicKey,
 		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
 			return &gossh.ServerConfig{
-				NoClientAuth: true,
+				NoClientAuth: a.sshUserCertificateAuthority() == nil && !a.sshPublicKeyAuth(),
 			}
 		},
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
 			"sftp": func(session ssh.Session) {
 				ctx := session.Context()
+				a.usage.sftpSessions.Inc()
+				disconnected := a.connectionEvents.connected(codersdk.AgentConnectionTypeSFTP, "", session.RemoteAddr(), session.User(), "", "")
+				defer disconnected()
 
 				// Typically sftp sessions don't request a TTY, but if they do,
 				// we must ensure the gliderlabs/ssh CRLF emulation is disabled.
@@ -477,19 +1316,25 @@ func (a *agent) init(ctx context.Context) {
 				// `RequestTTY force` in their SSH config.
 				session.DisablePTYEmulation()
 
-				var opts []sftp.ServerOption
-				// Change current working directory to the users home
-				// directory so that SFTP connections land there.
-				homedir, err := userHomeDir()
+				recorded := RecordedSession{
+					ID:        uuid.NewString(),
+					Type:      codersdk.WorkspaceAgentSessionTypeSFTP,
+					User:      session.User(),
+					StartedAt: time.Now(),
+					Peer:      session.RemoteAddr().String(),
+				}
+				_, err := a.checkSession(ctx, recorded)
 				if err != nil {
-					sshLogger.Warn(ctx, "get sftp working directory failed, unable to get home dir", slog.Error(err))
-				} else {
-					opts = append(opts, sftp.WithServerWorkingDirectory(homedir))
+					_, _ = io.WriteString(session.Stderr(), terminalMessage(codersdk.FormatWorkspaceAgentError(err)))
+					sendSessionError(session, err)
+					_ = session.Exit(MagicSessionErrorCode)
+					return
 				}
 
-				server, err := sftp.NewServer(session, opts...)
+				server, err := a.newSFTPServer(ctx, session)
 				if err != nil {
-					sshLogger.Debug(ctx, "initialize sftp server", slog.Error(err))
+					sshLogger.Warn(ctx, "initialize sftp server", slog.Error(err))
+					_ = session.Exit(1)
 					return
 				}
 				defer server.Close()
@@ -514,14 +1359,69 @@ func (a *agent) init(ctx context.Context) {
 	}
 
 	go a.runLoop(ctx)
+	go a.sampleConnectionPaths(ctx)
+	if a.shellPool.size > 0 {
+		go a.runShellPool(ctx)
+	}
+	a.serveControlSocket(ctx)
+	if a.ptyRetention > 0 {
+		a.connCloseWait.Add(1)
+		go a.persistPTYsLoop(ctx)
+	}
 	cl, err := a.client.AgentReportStats(ctx, a.logger, func() *codersdk.AgentStats {
 		stats := map[netlogtype.Connection]netlogtype.Counts{}
+		var natInfo tailnet.NATInfo
+		var ipFamilies tailnet.IPFamilies
+		var derpHealth tailnet.DERPHealth
+		var derpRegion string
+		var directDisabled bool
+		// Under pressure, traffic stats are extracted less often. They
+		// accumulate in the meantime, so no traffic goes unreported.
+		throttled := a.pressure.Throttled()
+		extract := !throttled || a.skippedStats >= throttleFactor-1
+		if extract {
+			a.skippedStats = 0
+		} else {
+			a.skippedStats++
+		}
 		a.closeMutex.Lock()
 		if a.network != nil {
-			stats = a.network.ExtractTrafficStats()
+			if extract {
+				stats = a.network.ExtractTrafficStats()
+			}
+			natInfo = a.network.NATInfo()
+			ipFamilies = a.network.IPFamilies()
+			derpHealth = a.network.DERPHealth()
+			directDisabled = a.network.BlockEndpoints()
+			if self := a.network.Status().Self; self != nil {
+				derpRegion = self.Relay
+			}
 		}
 		a.closeMutex.Unlock()
-		return convertAgentStats(stats)
+		agentStats := convertAgentStats(stats)
+		agentStats.Throttled = throttled
+		// These are reported so relayed connections can be
+		// attributed to the network of the workspace.
+		agentStats.CGNAT = natInfo.CGNAT
+		agentStats.NAT64 = natInfo.NAT64
+		agentStats.IPv4 = ipFamilies.IPv4
+		agentStats.IPv6 = ipFamilies.IPv6
+		agentStats.DERPDegraded = derpHealth.Degraded
+		agentStats.DERPFailovers = derpHealth.Failovers
+		agentStats.DERPRegion = derpRegion
+		agentStats.DirectConnectionsDisabled = directDisabled
+		agentStats.DirectSeconds, agentStats.DERPSeconds, agentStats.DERPSecondsByRegion = a.connectionPaths.report()
+		agentStats.UserNamespace = a.userNamespace.Nested
+		agentStats.Rootless = a.userNamespace.Rootless
+		agentStats.SSHRejectedConnections, agentStats.SSHBans = a.sshLimiter.stats()
+		agentStats.MalformedReconnectingPTYInits = a.malformedPTYInits.Load()
+		// The reserve is refilled once file descriptors are available.
+		a.fdReserve.refill()
+		agentStats.FileDescriptorExhaustions = a.fdReserve.stats()
+		agentStats.Usage = a.usageStats()
+		agentStats.IdleSeconds = int64(a.activity.idle() / time.Second)
+		agentStats.Apps = a.appProxy.stats()
+		return agentStats
 	})
 	if err != nil {
 		a.logger.Error(ctx, "report stats", slog.Error(err))
@@ -552,29 +1452,42 @@ func convertAgentStats(counts map[netlogtype.Connection]netlogtype.Counts) *code
 	return stats
 }
 
+// metadataWaitTimeout limits how long sessions wait for the agent to fetch
+// metadata, which is required to start commands.
+const metadataWaitTimeout = 30 * time.Second
+
+// waitForMetadata waits for the first metadata to be fetched, since sessions
+// can arrive right after the agent starts. The client is told why the
+// session is delayed with progress.
+func (a *agent) waitForMetadata(ctx context.Context, progress io.Writer) error {
+	select {
+	case <-a.metadataReady:
+		return nil
+	default:
+	}
+	_, _ = io.WriteString(progress, terminalMessage("Waiting for the agent to fetch metadata from Coder..."))
+	timer := time.NewTimer(metadataWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-a.metadataReady:
+		return nil
+	case <-timer.C:
+		return codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorMetadataUnavailable,
+			xerrors.Errorf("metadata wasn't fetched within %s", metadataWaitTimeout))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // createCommand processes raw command input with OpenSSH-like behavior.
 // If the rawCommand provided is empty, it will default to the users shell.
 // This injects environment variables specified by the user at launch too.
 func (a *agent) createCommand(ctx context.Context, rawCommand string, env []string) (*exec.Cmd, error) {
-	currentUser, err := user.Current()
-	if err != nil {
-		return nil, xerrors.Errorf("get current user: %w", err)
-	}
-	username := currentUser.Username
-
-	shell, err := usershell.Get(username)
+	sessionEnv, err := a.sessionEnvironment()
 	if err != nil {
-		return nil, xerrors.Errorf("get user shell: %w", err)
-	}
-
-	rawMetadata := a.metadata.Load()
-	if rawMetadata == nil {
-		return nil, xerrors.Errorf("no metadata was provided: %w", err)
-	}
-	metadata, valid := rawMetadata.(codersdk.WorkspaceAgentMetadata)
-	if !valid {
-		return nil, xerrors.Errorf("metadata is the wrong type: %T", metadata)
+		return nil, err
 	}
+	shell := sessionEnv.shell
 
 	// OpenSSH executes all commands with the users current shell.
 	// We replicate that behavior for IDE support.
@@ -595,73 +1508,59 @@ func (a *agent) createCommand(ctx context.Context, rawCommand string, env []stri
 		}
 	}
 
-	cmd := exec.CommandContext(ctx, shell, args...)
-	cmd.Dir = metadata.Directory
-	if cmd.Dir == "" {
-		// Default to user home if a directory is not set.
-		homedir, err := userHomeDir()
+	name := shell
+	if runtime.GOOS != "windows" {
+		var direct bool
+		name, args, direct, err = resolveShell(exec.LookPath, shell, args, rawCommand)
 		if err != nil {
-			return nil, xerrors.Errorf("get home dir: %w", err)
+			return nil, err
+		}
+		if name != shell && !a.shellMissing.Swap(true) {
+			a.logger.Warn(ctx, "shell of the user doesn't exist, commands run with a fallback",
+				slog.F("shell", shell), slog.F("fallback", name), slog.F("direct", direct))
 		}
-		cmd.Dir = homedir
-	}
-	cmd.Env = append(os.Environ(), env...)
-	executablePath, err := os.Executable()
-	if err != nil {
-		return nil, xerrors.Errorf("getting os executable: %w", err)
-	}
-	// Set environment variables reliable detection of being inside a
-	// Coder workspace.
-	cmd.Env = append(cmd.Env, "CODER=true")
-	cmd.Env = append(cmd.Env, fmt.Sprintf("USER=%s", username))
-	// Git on Windows resolves with UNIX-style paths.
-	// If using backslashes, it's unable to find the executable.
-	unixExecutablePath := strings.ReplaceAll(executablePath, "\\", "/")
-	cmd.Env = append(cmd.Env, fmt.Sprintf(`GIT_SSH_COMMAND=%s gitssh --`, unixExecutablePath))
-
-	// Specific Coder subcommands require the agent token exposed!
-	cmd.Env = append(cmd.Env, fmt.Sprintf("CODER_AGENT_TOKEN=%s", *a.sessionToken.Load()))
-
-	// Set SSH connection environment variables (these are also set by OpenSSH
-	// and thus expected to be present by SSH clients). Since the agent does
-	// networking in-memory, trying to provide accurate values here would be
-	// nonsensical. For now, we hard code these values so that they're present.
-	srcAddr, srcPort := "0.0.0.0", "0"
-	dstAddr, dstPort := "0.0.0.0", "0"
-	cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_CLIENT=%s %s %s", srcAddr, srcPort, dstPort))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", srcAddr, srcPort, dstAddr, dstPort))
-
-	// This adds the ports dialog to code-server that enables
-	// proxying a port dynamically.
-	cmd.Env = append(cmd.Env, fmt.Sprintf("VSCODE_PROXY_URI=%s", metadata.VSCodePortProxyURI))
-
-	// Hide Coder message on code-server's "Getting Started" page
-	cmd.Env = append(cmd.Env, "CS_DISABLE_GETTING_STARTED_OVERRIDE=true")
-
-	// Load environment variables passed via the agent.
-	// These should override all variables we manually specify.
-	for envKey, value := range metadata.EnvironmentVariables {
-		// Expanding environment variables allows for customization
-		// of the $PATH, among other variables. Customers can prepend
-		// or append to the $PATH, so allowing expand is required!
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envKey, os.ExpandEnv(value)))
-	}
-
-	// Agent-level environment variables should take over all!
-	// This is used for setting agent-specific variables like "CODER_AGENT_TOKEN".
-	for envKey, value := range a.envVars {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envKey, value))
 	}
 
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = sessionEnv.dir
+	cmd.Env = sessionEnv.commandEnv(env)
 	return cmd, nil
 }
 
 func (a *agent) handleSSHSession(session ssh.Session) (retErr error) {
 	ctx := session.Context()
-	cmd, err := a.createCommand(ctx, session.RawCommand(), session.Environ())
+	sessionID := uuid.NewString()
+	disconnected := a.connectionEvents.connected(codersdk.AgentConnectionTypeSSH, sessionID, session.RemoteAddr(), session.User(), session.RawCommand(), "")
+	defer disconnected()
+	if a.fdReserve.exhausted() {
+		return errFDsExhausted
+	}
+	err := a.waitForMetadata(ctx, session.Stderr())
+	if err != nil {
+		return err
+	}
+	err = a.waitForStartupScript(ctx, session.Stderr())
+	if err != nil {
+		return err
+	}
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	env, rejectedEnv := acceptEnv(metadata.SSHAcceptEnv, session.Environ())
+	if len(rejectedEnv) > 0 {
+		a.logger.Debug(ctx, "ignoring environment variables that aren't accepted", slog.F("names", rejectedEnv))
+	}
+	cmd, err := a.createCommand(ctx, session.RawCommand(), env)
 	if err != nil {
 		return err
 	}
+	started := time.Now()
+	defer func() {
+		a.logSessionEnd(ctx, "ssh", sessionID, cmd, started, retErr, slog.F("user", session.User()))
+	}()
+	tempDir, removeTempDir := a.createSessionTempDir(ctx, sessionID)
+	defer removeTempDir()
+	if tempDir != "" {
+		cmd.Env = append(cmd.Env, "TMPDIR="+tempDir)
+	}
 
 	if ssh.AgentRequested(session) {
 		l, err := ssh.NewAgentListener()
@@ -674,18 +1573,46 @@ func (a *agent) handleSSHSession(session ssh.Session) (retErr error) {
 	}
 
 	sshPty, windowSize, isPty := session.Pty()
+	if !isPty {
+		if forcePTY(metadata.ForcePTYCommands, session.RawCommand(), session.Environ()) {
+			a.logger.Debug(ctx, "forcing pty allocation", slog.F("command", session.RawCommand()))
+			sshPty = forcedPTY
+			isPty = true
+		}
+	}
+	recorded := RecordedSession{
+		ID:        sessionID,
+		Type:      codersdk.WorkspaceAgentSessionTypeSSH,
+		User:      session.User(),
+		Command:   session.RawCommand(),
+		PTY:       isPty,
+		Width:     uint16(sshPty.Window.Width),
+		Height:    uint16(sshPty.Window.Height),
+		Term:      sshPty.Term,
+		StartedAt: started,
+		Peer:      session.RemoteAddr().String(),
+	}
+	recorded.ReasonCodes, err = a.checkSession(ctx, recorded)
+	if err != nil {
+		return err
+	}
+	a.sessionRecorder.SessionOpened(ctx, recorded)
+	defer func() {
+		a.sessionRecorder.SessionClosed(ctx, recorded, retErr)
+	}()
 	if isPty {
 		// Disable minimal PTY emulation set by gliderlabs/ssh (NL-to-CRNL).
 		// See https://github.com/coder/coder/issues/3371.
 		session.DisablePTYEmulation()
 
-		if !isQuietLogin(session.RawCommand()) {
+		if !a.isQuietLogin(session.RawCommand()) {
 			metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
 			if ok {
-				err = showMOTD(session, metadata.MOTDFile)
+				err = a.showMOTD(session, metadata.MOTDFile)
 				if err != nil {
 					a.logger.Error(ctx, "show MOTD", slog.Error(err))
 				}
+				a.showMOTDSources(ctx, session, metadata.MOTDSources)
 			} else {
 				a.logger.Warn(ctx, "metadata lookup failed, unable to show MOTD")
 			}
@@ -694,13 +1621,20 @@ func (a *agent) handleSSHSession(session ssh.Session) (retErr error) {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", sshPty.Term))
 
 		// The pty package sets `SSH_TTY` on supported platforms.
-		ptty, process, err := pty.Start(cmd, pty.WithPTYOption(
+		ptty, process, err := a.startSessionPTY(ctx, cmd, pty.WithPTYOption(
 			pty.WithSSHRequest(sshPty),
 			pty.WithLogger(slog.Stdlib(ctx, a.logger, slog.LevelInfo)),
 		))
 		if err != nil {
-			return xerrors.Errorf("start command: %w", err)
+			return xerrors.Errorf("start command: %w", codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorPTYFailed, err))
 		}
+		a.trackPTY(sessionID, ptty)
+		tracked := a.trackSession(recorded, func() {
+			_ = process.Kill()
+			_ = session.Close()
+		})
+		defer a.untrackSession(sessionID)
+		defer a.forwardSignals(ctx, session, process.Signal)()
 		defer func() {
 			closeErr := ptty.Close()
 			if closeErr != nil {
@@ -710,21 +1644,39 @@ func (a *agent) handleSSHSession(session ssh.Session) (retErr error) {
 				}
 			}
 		}()
-		go func() {
-			for win := range windowSize {
-				resizeErr := ptty.Resize(uint16(win.Height), uint16(win.Width))
-				if resizeErr != nil {
-					a.logger.Warn(ctx, "failed to resize tty", slog.Error(resizeErr))
+		// Forced PTYs aren't resized, because the client
+		// doesn't have a terminal.
+		if windowSize != nil {
+			go func() {
+				for win := range windowSize {
+					resizeErr := ptty.Resize(uint16(win.Height), uint16(win.Width))
+					if resizeErr != nil {
+						a.logger.Warn(ctx, "failed to resize tty", slog.Error(resizeErr))
+					}
 				}
-			}
-		}()
+			}()
+		}
 		go func() {
-			_, _ = io.Copy(ptty.Input(), session)
+			_, _ = io.Copy(ptty.Input(), io.TeeReader(tracked.countIn(session), recordWriter(func(p []byte) {
+				a.sessionRecorder.PTYInput(recorded, p)
+			})))
 		}()
+		recorder := a.recordSession(ctx, sessionID, uint16(sshPty.Window.Width), uint16(sshPty.Window.Height), sshPty.Term)
+		outputReader := &drainReader{file: ptty.Output().Reader}
+		outputDone := make(chan struct{})
 		go func() {
-			_, _ = io.Copy(session, ptty.Output())
+			defer close(outputDone)
+			defer recorder.Close()
+			output := a.outputScheduler.writer(session.User(), io.MultiWriter(tracked.countOut(session), recorder, recordWriter(func(p []byte) {
+				a.sessionRecorder.PTYOutput(recorded, p)
+			})))
+			_, _ = io.Copy(output, outputReader)
 		}()
 		err = process.Wait()
+		// Broadcasts write to the TTY, so it's only hung up once they
+		// can't anymore.
+		a.untrackPTY(sessionID)
+		waitForOutput(ctx, ptty, outputReader, outputDone)
 		var exitErr *exec.ExitError
 		// ExitErrors just mean the command we run returned a non-zero exit code, which is normal
 		// and not something to be concerned about.  But, if it's something else, we should log it.
@@ -734,8 +1686,34 @@ func (a *agent) handleSSHSession(session ssh.Session) (retErr error) {
 		return err
 	}
 
-	cmd.Stdout = session
-	cmd.Stderr = session.Stderr()
+	// The process is only known once it starts, so it's killed by
+	// closing the session until then.
+	var process atomic.Pointer[os.Process]
+	tracked := a.trackSession(recorded, func() {
+		if p := process.Load(); p != nil {
+			_ = p.Kill()
+		}
+		_ = session.Close()
+	})
+	defer a.untrackSession(sessionID)
+	defer a.forwardSignals(ctx, session, func(sig os.Signal) error {
+		p := process.Load()
+		if p == nil {
+			return xerrors.New("the process hasn't started")
+		}
+		return p.Signal(sig)
+	})()
+	// An idle shell of the pool runs the command if it can, which saves
+	// starting the shell.
+	if shell, script := a.shellPool.take(cmd); shell != nil {
+		a.shellPool.refill()
+		process.Store(shell.cmd.Process)
+		err = shell.run(ctx, script, tracked.countIn(session), tracked.countOut(session), tracked.countOut(session.Stderr()))
+		cmd.ProcessState = shell.cmd.ProcessState
+		return err
+	}
+	cmd.Stdout = tracked.countOut(session)
+	cmd.Stderr = tracked.countOut(session.Stderr())
 	// This blocks forever until stdin is received if we don't
 	// use StdinPipe. It's unknown what causes this.
 	stdinPipe, err := cmd.StdinPipe()
@@ -743,20 +1721,100 @@ func (a *agent) handleSSHSession(session ssh.Session) (retErr error) {
 		return xerrors.Errorf("create stdin pipe: %w", err)
 	}
 	go func() {
-		_, _ = io.Copy(stdinPipe, session)
+		_, _ = io.Copy(stdinPipe, tracked.countIn(session))
 		_ = stdinPipe.Close()
 	}()
 	err = cmd.Start()
 	if err != nil {
-		return xerrors.Errorf("start: %w", err)
+		return xerrors.Errorf("start: %w", codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorCommandStartFailed, err))
 	}
+	process.Store(cmd.Process)
 	return cmd.Wait()
 }
 
-func (a *agent) handleReconnectingPTY(ctx context.Context, msg codersdk.ReconnectingPTYInit, conn net.Conn) {
+// outputDrainTimeout limits how long the output of a PTY session is read
+// after its process exits, when other processes hold the TTY open.
+const outputDrainTimeout = time.Second
+
+// drainReader reads the output of a PTY. Once draining, reads fail when no
+// output is written for outputDrainTimeout, but time spent writing the
+// output elsewhere isn't limited.
+type drainReader struct {
+	file     *os.File
+	draining atomic.Bool
+}
+
+func (r *drainReader) Read(p []byte) (int, error) {
+	if r.draining.Load() {
+		_ = r.file.SetReadDeadline(time.Now().Add(outputDrainTimeout))
+	}
+	return r.file.Read(p)
+}
+
+func (r *drainReader) drain() {
+	r.draining.Store(true)
+	_ = r.file.SetReadDeadline(time.Now().Add(outputDrainTimeout))
+}
+
+// waitForOutput waits for the output of a PTY session to be copied after
+// its process exits. The TTY is hung up, so reading ends after the output
+// that's buffered is read, unless processes the command started still hold
+// it open.
+func waitForOutput(ctx context.Context, ptty pty.PTY, reader *drainReader, done <-chan struct{}) {
+	hangup, ok := ptty.(pty.WithHangup)
+	if !ok || hangup.Hangup() != nil {
+		return
+	}
+	reader.drain()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// sendSessionError sends the error that failed the session to the client,
+// so clients like "coder ssh" can show the cause instead of only
+// MagicSessionErrorCode.
+func sendSessionError(session ssh.Session, err error) {
+	// The payload of "exit-signal" requests is defined in RFC 4254
+	// section 6.10.
+	payload := gossh.Marshal(struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{
+		Signal: MagicSessionErrorSignal,
+		Error:  err.Error(),
+	})
+	_, _ = session.SendRequest("exit-signal", false, payload)
+}
+
+// terminalMessage ends each line of the message with CRLF, since it's
+// written to terminals that may be in raw mode.
+func terminalMessage(message string) string {
+	return strings.ReplaceAll(message, "\n", "\r\n") + "\r\n"
+}
+
+// handleReconnectingPTY serves a connection to a reconnecting PTY, creating
+// it if it doesn't exist. The participants of the PTY are sent to updates
+// when they change, unless it's nil.
+func (a *agent) handleReconnectingPTY(ctx context.Context, msg codersdk.ReconnectingPTYInit, conn net.Conn, updates chan codersdk.ReconnectingPTYControl) {
 	defer conn.Close()
 
-	connectionID := uuid.NewString()
+	if !validPTYRole(msg.Role) {
+		_, _ = io.WriteString(conn, terminalMessage(fmt.Sprintf("Unknown reconnecting PTY role %q.", msg.Role)))
+		return
+	}
+	if msg.Name != "" {
+		msg.Name = sanitizeSessionLabel(msg.Name)
+		if msg.Name == "" {
+			_, _ = io.WriteString(conn, terminalMessage("The name of the reconnecting PTY is empty."))
+			return
+		}
+		msg.ID = namedPTYID(msg.Name)
+	}
+	participant := newPTYParticipant(msg, conn, updates)
 	var rpty *reconnectingPTY
 	rawRPTY, ok := a.reconnectingPTYs.Load(msg.ID)
 	if ok {
@@ -766,24 +1824,73 @@ func (a *agent) handleReconnectingPTY(ctx context.Context, msg codersdk.Reconnec
 			return
 		}
 	} else {
+		if participant.readOnly() {
+			_, _ = io.WriteString(conn, terminalMessage("The terminal isn't running, and read-only connections can't start it."))
+			return
+		}
+		if a.fdReserve.exhausted() {
+			_, _ = io.WriteString(conn, terminalMessage(codersdk.FormatWorkspaceAgentError(errFDsExhausted)))
+			return
+		}
+		err := a.waitForMetadata(ctx, conn)
+		if err == nil {
+			err = a.waitForStartupScript(ctx, conn)
+		}
+		if err != nil {
+			a.logger.Warn(ctx, "wait for metadata and startup script", slog.Error(err))
+			_, _ = io.WriteString(conn, terminalMessage(codersdk.FormatWorkspaceAgentError(err)))
+			return
+		}
+		recorded := RecordedSession{
+			ID:      msg.ID.String(),
+			Type:    codersdk.WorkspaceAgentSessionTypeReconnectingPTY,
+			Command: msg.Command,
+			PTY:     true,
+			Width:   msg.Width,
+			Height:  msg.Height,
+			Term:    "xterm-256color",
+			Peer:    conn.RemoteAddr().String(),
+		}
+		recorded.ReasonCodes, err = a.checkSession(ctx, recorded)
+		if err != nil {
+			_, _ = io.WriteString(conn, terminalMessage(codersdk.FormatWorkspaceAgentError(err)))
+			return
+		}
 		// Empty command will default to the users shell!
 		cmd, err := a.createCommand(ctx, msg.Command, nil)
 		if err != nil {
+			err = a.checkFDs(ctx, err)
 			a.logger.Error(ctx, "create reconnecting pty command", slog.Error(err))
+			_, _ = io.WriteString(conn, terminalMessage(codersdk.FormatWorkspaceAgentError(err)))
 			return
 		}
 		cmd.Env = append(cmd.Env, "TERM=xterm-256color")
 
-		// Default to buffer 64KiB.
-		circularBuffer, err := circbuf.NewBuffer(64 << 10)
-		if err != nil {
-			a.logger.Error(ctx, "create circular buffer", slog.Error(err))
-			return
+		circularBuffer := a.ptyScrollback.newBuffer(a.newPTYBufferSize(ctx, msg))
+		// The process of a PTY that was restored from a snapshot ended,
+		// so its output is replayed before the output of the new one.
+		screen := newScreenTracker()
+		output := io.MultiWriter(circularBuffer, screen)
+		if snapshot, ok := a.takePTYSnapshot(msg.ID); ok {
+			_, _ = output.Write(snapshot.Output)
+			_, _ = output.Write([]byte(snapshot.restoredMessage()))
+			if msg.Label == "" {
+				msg.Label = snapshot.Label
+			}
+		}
+		if msg.Label == "" {
+			msg.Label = msg.Name
 		}
 
-		ptty, process, err := pty.Start(cmd)
+		tempDir, removeTempDir := a.createSessionTempDir(ctx, msg.ID.String())
+		if tempDir != "" {
+			cmd.Env = append(cmd.Env, "TMPDIR="+tempDir)
+		}
+		ptty, process, err := a.startSessionPTY(ctx, cmd)
 		if err != nil {
+			removeTempDir()
 			a.logger.Error(ctx, "start reconnecting pty command", slog.F("id", msg.ID), slog.Error(err))
+			_, _ = io.WriteString(conn, terminalMessage(codersdk.FormatWorkspaceAgentError(a.checkFDs(ctx, codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorPTYFailed, err)))))
 			return
 		}
 
@@ -791,34 +1898,76 @@ func (a *agent) handleReconnectingPTY(ctx context.Context, msg codersdk.Reconnec
 		a.connCloseWait.Add(1)
 		a.closeMutex.Unlock()
 		ctx, cancelFunc := context.WithCancel(ctx)
+		started := time.Now()
 		rpty = &reconnectingPTY{
-			activeConns: map[string]net.Conn{
+			participants: map[string]*ptyParticipant{
 				// We have to put the connection in the map instantly otherwise
 				// the connection won't be closed if the process instantly dies.
-				connectionID: conn,
+				participant.info.ID: participant,
 			},
-			ptty: ptty,
-			// Timeouts created with an after func can be reset!
-			timeout:        time.AfterFunc(a.reconnectingPTYTimeout, cancelFunc),
+			ptty:           ptty,
 			circularBuffer: circularBuffer,
+			screen:         screen,
+			height:         msg.Height,
+			width:          msg.Width,
+			name:           msg.Name,
+			lastActive:     started,
+			recorded:       recorded,
 		}
+		rpty.recorded.StartedAt = started
+		rpty.timeoutMutex.Lock()
+		// Timeouts created with an after func can be reset!
+		rpty.timeout = time.AfterFunc(a.ptyTimeoutFor(rpty), func() {
+			// The PTY only times out without connections.
+			if rpty.connected() {
+				rpty.resetTimeout(a.ptyTimeoutFor(rpty))
+				return
+			}
+			cancelFunc()
+		})
+		rpty.timeoutMutex.Unlock()
+		// The session is tracked before the PTY is stored, since other
+		// connections and snapshots use it.
+		rpty.session = a.trackSession(rpty.recorded, cancelFunc)
 		a.reconnectingPTYs.Store(msg.ID, rpty)
+		a.trackPTY(msg.ID.String(), ptty)
 		go func() {
-			// CommandContext isn't respected for Windows PTYs right now,
-			// so we need to manually track the lifecycle.
+			// CommandContext isn't respected for Windows PTYs, which are
+			// started without exec.Cmd, so the lifecycle is tracked
+			// manually. Killing the process kills its children on Windows.
 			// When the context has been completed either:
 			// 1. The timeout completed.
 			// 2. The parent context was canceled.
 			<-ctx.Done()
 			_ = process.Kill()
 		}()
+		a.sessionRecorder.SessionOpened(ctx, rpty.recorded)
+		// The session is closed for the recorder after the output was
+		// copied, which can end before the process exits.
+		exited := make(chan error, 1)
+		outputDone := make(chan struct{})
 		go func() {
 			// If the process dies randomly, we should
 			// close the pty.
-			_ = process.Wait()
+			err := process.Wait()
+			exited <- err
+			a.logSessionEnd(ctx, "reconnecting_pty", msg.ID.String(), cmd, started, err)
+			removeTempDir()
+			// The output the process wrote before it exited is read
+			// first, or it's lost when the PTY is closed.
+			timer := time.NewTimer(ptyOutputDrainTimeout)
+			select {
+			case <-outputDone:
+			case <-timer.C:
+			}
+			timer.Stop()
 			rpty.Close()
 		}()
+		recorder := a.recordSession(ctx, msg.ID.String(), msg.Width, msg.Height, "xterm-256color")
+		titles := newTitleParser(rpty.session.title.Store)
 		go func() {
+			defer close(outputDone)
+			defer recorder.Close()
 			buffer := make([]byte, 1024)
 			for {
 				read, err := rpty.ptty.Output().Read(buffer)
@@ -827,88 +1976,128 @@ func (a *agent) handleReconnectingPTY(ctx context.Context, msg codersdk.Reconnec
 					break
 				}
 				part := buffer[:read]
+				_, _ = recorder.Write(part)
+				a.sessionRecorder.PTYOutput(rpty.recorded, part)
+				_, _ = titles.Write(part)
 				rpty.circularBufferMutex.Lock()
-				_, err = rpty.circularBuffer.Write(part)
+				_, err = output.Write(part)
 				rpty.circularBufferMutex.Unlock()
+				a.ptysChanged.Store(true)
 				if err != nil {
 					a.logger.Error(ctx, "reconnecting pty write buffer", slog.Error(err), slog.F("id", msg.ID))
 					break
 				}
-				rpty.activeConnsMutex.Lock()
-				for _, conn := range rpty.activeConns {
-					_, _ = conn.Write(part)
+				// Reconnecting PTYs don't identify the user, so
+				// they share turns. The output is queued for every
+				// connection, so slow ones don't stall the others.
+				release := a.outputScheduler.acquire("")
+				rpty.participantsMutex.Lock()
+				for _, participant := range rpty.participants {
+					participant.output.push(part)
 				}
-				rpty.activeConnsMutex.Unlock()
+				rpty.participantsMutex.Unlock()
+				release()
 			}
 
 			// Cleanup the process, PTY, and delete it's
 			// ID from memory.
 			_ = process.Kill()
 			rpty.Close()
+			a.sessionRecorder.SessionClosed(ctx, rpty.recorded, <-exited)
 			a.reconnectingPTYs.Delete(msg.ID)
+			a.ptysChanged.Store(true)
+			a.untrackPTY(msg.ID.String())
+			a.untrackSession(msg.ID.String())
 			a.connCloseWait.Done()
 		}()
 	}
-	// Resize the PTY to initial height + width.
-	err := rpty.ptty.Resize(msg.Height, msg.Width)
-	if err != nil {
-		// We can continue after this, it's not fatal!
-		a.logger.Error(ctx, "resize reconnecting pty", slog.F("id", msg.ID), slog.Error(err))
+	if msg.Label != "" {
+		rpty.session.label.Store(sanitizeSessionLabel(msg.Label))
+		a.ptysChanged.Store(true)
 	}
-	// Write any previously stored data for the TTY.
-	rpty.circularBufferMutex.RLock()
-	_, err = conn.Write(rpty.circularBuffer.Bytes())
-	rpty.circularBufferMutex.RUnlock()
+	// Write any previously stored data for the TTY, for the size of the
+	// terminal of this connection.
+	err := rpty.replay(conn, msg.Height, msg.Width, a.featureEnabled(codersdk.WorkspaceAgentFeatureScreenSnapshotReconnect, true))
 	if err != nil {
 		a.logger.Warn(ctx, "write reconnecting pty buffer", slog.F("id", msg.ID), slog.Error(err))
+		// The connection is a participant already if it created the PTY.
+		rpty.leave(participant)
 		return
 	}
-	// Multiple connections to the same TTY are permitted.
-	// This could easily be used for terminal sharing, but
-	// we do it because it's a nice user experience to
-	// copy/paste a terminal URL and have it _just work_.
-	rpty.activeConnsMutex.Lock()
-	rpty.activeConns[connectionID] = conn
-	rpty.activeConnsMutex.Unlock()
-	// Resetting this timeout prevents the PTY from exiting.
-	rpty.timeout.Reset(a.reconnectingPTYTimeout)
-
-	ctx, cancelFunc := context.WithCancel(ctx)
-	defer cancelFunc()
-	heartbeat := time.NewTicker(a.reconnectingPTYTimeout / 2)
-	defer heartbeat.Stop()
-	go func() {
-		// Keep updating the activity while this
-		// connection is alive!
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-heartbeat.C:
-			}
-			rpty.timeout.Reset(a.reconnectingPTYTimeout)
+	// Multiple connections to the same TTY are permitted, so
+	// terminals can be shared with observers that can't write,
+	// and it's a nice user experience to copy/paste a terminal
+	// URL and have it _just work_.
+	rpty.join(participant)
+	disconnected := a.connectionEvents.connected(codersdk.AgentConnectionTypeReconnectingPTY, msg.ID.String(), conn.RemoteAddr(), participant.info.Name, rpty.recorded.Command, "")
+	defer disconnected()
+	inactive := a.activity.start()
+	defer inactive()
+	// Resize the PTY to initial height + width. This happens after the
+	// output was replayed, so programs redraw for this connection.
+	if !participant.readOnly() {
+		err = rpty.resize(msg.Height, msg.Width)
+		if err != nil {
+			// We can continue after this, it's not fatal!
+			a.logger.Error(ctx, "resize reconnecting pty", slog.F("id", msg.ID), slog.Error(err))
 		}
-	}()
+	}
+	// Resetting this timeout prevents the PTY from exiting.
+	rpty.resetTimeout(a.ptyTimeoutFor(rpty))
 	defer func() {
 		// After this connection ends, remove it from
-		// the PTYs active connections. If it isn't
-		// removed, all PTY data will be sent to it.
-		rpty.activeConnsMutex.Lock()
-		delete(rpty.activeConns, connectionID)
-		rpty.activeConnsMutex.Unlock()
+		// the PTYs participants. If it isn't removed,
+		// all PTY data will be sent to it.
+		rpty.leave(participant)
+		// The timeout starts when the last connection ends.
+		rpty.resetTimeout(a.ptyTimeoutFor(rpty))
 	}()
-	decoder := json.NewDecoder(conn)
+	input := &ptyInputReader{r: conn}
+	decoder := json.NewDecoder(input)
+	limiter := newPTYInputLimiter(time.Now)
 	var req codersdk.ReconnectingPTYRequest
 	for {
+		input.reset(decoder.InputOffset())
 		err = decoder.Decode(&req)
 		if xerrors.Is(err, io.EOF) {
 			return
 		}
+		if xerrors.Is(err, errPTYInputTooLarge) {
+			a.logger.Warn(ctx, "reconnecting pty input too large", slog.F("id", msg.ID), slog.F("remote_addr", conn.RemoteAddr().String()))
+			// A client that floods the PTY may not read, so it isn't
+			// waited on to receive the error.
+			_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_, _ = io.WriteString(conn, terminalMessage(codersdk.FormatWorkspaceAgentError(
+				codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorPTYInputTooLarge, err))))
+			// Closing a connection with unread input resets it, which can
+			// discard the error before the client reads it.
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _ = io.Copy(io.Discard, conn)
+			return
+		}
 		if err != nil {
 			a.logger.Warn(ctx, "reconnecting pty buffer read error", slog.F("id", msg.ID), slog.Error(err))
 			return
 		}
-		_, err = rpty.ptty.Input().Write([]byte(req.Data))
+		// Connections that send input faster than the limit wait before
+		// it's written, so they don't starve the other connections.
+		if delay := limiter.take(len(req.Data)); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		// The input of observers is read until they disconnect, but
+		// it's not written to the PTY.
+		if participant.readOnly() {
+			continue
+		}
+		written, err := rpty.ptty.Input().Write([]byte(req.Data))
+		rpty.session.bytesIn.Add(int64(written))
+		a.sessionRecorder.PTYInput(rpty.recorded, []byte(req.Data)[:written])
 		if err != nil {
 			a.logger.Warn(ctx, "write to reconnecting pty", slog.F("id", msg.ID), slog.Error(err))
 			return
@@ -917,7 +2106,7 @@ func (a *agent) handleReconnectingPTY(ctx context.Context, msg codersdk.Reconnec
 		if req.Height == 0 || req.Width == 0 {
 			continue
 		}
-		err = rpty.ptty.Resize(req.Height, req.Width)
+		err = rpty.resize(req.Height, req.Width)
 		if err != nil {
 			// We can continue after this, it's not fatal!
 			a.logger.Error(ctx, "resize reconnecting pty", slog.F("id", msg.ID), slog.Error(err))
@@ -942,38 +2131,95 @@ func (a *agent) Close() error {
 		return nil
 	}
 	close(a.closed)
+	a.timeline.record(codersdk.AgentEventStopped, "Agent stopped.")
+	if a.ptyRetention > 0 {
+		err := a.persistPTYs(true)
+		if err != nil {
+			a.logger.Warn(context.Background(), "persist reconnecting ptys", slog.F("path", a.ptyPersistPath()), slog.Error(err))
+		}
+	}
 	a.closeCancel()
+	a.shellPool.close()
 	if a.network != nil {
 		_ = a.network.Close()
 	}
 	_ = a.sshServer.Close()
+	a.closeReverseForwards()
+	if a.derpHTTPServer != nil {
+		_ = a.derpHTTPServer.Close()
+		_ = a.derpServer.Close()
+	}
 	a.connCloseWait.Wait()
 	return nil
 }
 
 type reconnectingPTY struct {
-	activeConnsMutex sync.Mutex
-	activeConns      map[string]net.Conn
+	participantsMutex sync.Mutex
+	participants      map[string]*ptyParticipant
 
-	circularBuffer      *circbuf.Buffer
+	circularBuffer      *ptyScrollback
 	circularBufferMutex sync.RWMutex
-	timeout             *time.Timer
-	ptty                pty.PTY
+	// screen tracks where the screen was last cleared in the buffer, and
+	// height and width the size that output is written for. They're
+	// guarded by the buffer mutex.
+	screen        *screenTracker
+	height, width uint16
+	ptty          pty.PTY
+	// name is set for PTYs that clients attach to by name.
+	name string
+	// session tracks the reconnecting PTY for the sessions API.
+	session *activeSession
+	// recorded describes the reconnecting PTY to the session recorder.
+	recorded RecordedSession
+
+	timeoutMutex sync.Mutex
+	timeout      *time.Timer
+	// lastActive is when a connection to the PTY last started or ended,
+	// which the timeout is relative to.
+	lastActive time.Time
+}
+
+// connected returns whether any connections to the PTY are active.
+func (r *reconnectingPTY) connected() bool {
+	r.participantsMutex.Lock()
+	defer r.participantsMutex.Unlock()
+	return len(r.participants) > 0
+}
+
+// resetTimeout restarts the timeout of the PTY from now.
+func (r *reconnectingPTY) resetTimeout(timeout time.Duration) {
+	r.timeoutMutex.Lock()
+	defer r.timeoutMutex.Unlock()
+	r.lastActive = time.Now()
+	r.timeout.Reset(timeout)
+}
+
+// setTimeout changes the timeout of the PTY without restarting it. The PTY
+// times out immediately if it was idle for longer than the timeout.
+func (r *reconnectingPTY) setTimeout(timeout time.Duration) {
+	r.timeoutMutex.Lock()
+	defer r.timeoutMutex.Unlock()
+	r.timeout.Reset(time.Until(r.lastActive.Add(timeout)))
 }
 
 // Close ends all connections to the reconnecting
 // PTY and clear the circular buffer.
 func (r *reconnectingPTY) Close() {
-	r.activeConnsMutex.Lock()
-	defer r.activeConnsMutex.Unlock()
-	for _, conn := range r.activeConns {
-		_ = conn.Close()
+	r.participantsMutex.Lock()
+	defer r.participantsMutex.Unlock()
+	for _, participant := range r.participants {
+		// The writer of the participant closes the connection after the
+		// output that's queued was written.
+		_ = participant.conn.SetWriteDeadline(time.Now().Add(ptyOutputFlushTimeout))
+		participant.output.end()
 	}
 	_ = r.ptty.Close()
 	r.circularBufferMutex.Lock()
 	r.circularBuffer.Reset()
 	r.circularBufferMutex.Unlock()
+	r.timeoutMutex.Lock()
 	r.timeout.Stop()
+	r.timeoutMutex.Unlock()
 }
 
 // Bicopy copies all of the data between the two connections and will close them
@@ -1019,7 +2265,7 @@ func Bicopy(ctx context.Context, c1, c2 io.ReadWriteCloser) {
 // isQuietLogin checks if the SSH server should perform a quiet login or not.
 //
 // https://github.com/openssh/openssh-portable/blob/25bd659cc72268f2858c5415740c442ee950049f/session.c#L816
-func isQuietLogin(rawCommand string) bool {
+func (a *agent) isQuietLogin(rawCommand string) bool {
 	// We are always quiet unless this is a login shell.
 	if len(rawCommand) != 0 {
 		return true
@@ -1027,12 +2273,12 @@ func isQuietLogin(rawCommand string) bool {
 
 	// Best effort, if we can't get the home directory,
 	// we can't lookup .hushlogin.
-	homedir, err := userHomeDir()
+	homedir, err := a.homeDir()
 	if err != nil {
 		return false
 	}
 
-	_, err = os.Stat(filepath.Join(homedir, ".hushlogin"))
+	_, err = a.filesystem.Stat(filepath.Join(homedir, ".hushlogin"))
 	return err == nil
 }
 
@@ -1040,12 +2286,12 @@ func isQuietLogin(rawCommand string) bool {
 // the given filename to dest, if the file exists.
 //
 // https://github.com/openssh/openssh-portable/blob/25bd659cc72268f2858c5415740c442ee950049f/session.c#L784
-func showMOTD(dest io.Writer, filename string) error {
+func (a *agent) showMOTD(dest io.Writer, filename string) error {
 	if filename == "" {
 		return nil
 	}
 
-	f, err := os.Open(filename)
+	f, err := a.filesystem.Open(filename)
 	if err != nil {
 		if xerrors.Is(err, os.ErrNotExist) {
 			// This is not an error, there simply isn't a MOTD to show.
@@ -1055,11 +2301,16 @@ func showMOTD(dest io.Writer, filename string) error {
 	}
 	defer f.Close()
 
-	s := bufio.NewScanner(f)
+	return writeMOTD(dest, f)
+}
+
+// writeMOTD writes the message of the day from src to dest.
+func writeMOTD(dest io.Writer, src io.Reader) error {
+	s := bufio.NewScanner(src)
 	for s.Scan() {
 		// Carriage return ensures each line starts
 		// at the beginning of the terminal.
-		_, err = fmt.Fprint(dest, s.Text()+"\r\n")
+		_, err := fmt.Fprint(dest, s.Text()+"\r\n")
 		if err != nil {
 			return xerrors.Errorf("write MOTD: %w", err)
 		}
@@ -1073,17 +2324,22 @@ func showMOTD(dest io.Writer, filename string) error {
 
 // userHomeDir returns the home directory of the current user, giving
 // priority to the $HOME environment variable.
-func userHomeDir() (string, error) {
+func (a *agent) userHomeDir() (string, error) {
+	u, found := currentUser()
 	// First we check the environment.
 	homedir, err := os.UserHomeDir()
-	if err == nil {
-		return homedir, nil
-	}
-
-	// As a fallback, we try the user information.
-	u, err := user.Current()
 	if err != nil {
-		return "", xerrors.Errorf("current user: %w", err)
+		// As a fallback, we use the user information.
+		return u.HomeDir, nil
+	}
+	// Rootless containers can inherit $HOME from the host, where it
+	// doesn't exist in the container.
+	if found && homedir != u.HomeDir && a.userNamespace.Rootless {
+		if _, err := a.filesystem.Stat(homedir); xerrors.Is(err, os.ErrNotExist) {
+			if _, err := a.filesystem.Stat(u.HomeDir); err == nil {
+				return u.HomeDir, nil
+			}
+		}
 	}
-	return u.HomeDir, nil
+	return homedir, nil
 }
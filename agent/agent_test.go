@@ -4,11 +4,18 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
@@ -35,13 +42,17 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
 	"golang.org/x/text/encoding/unicode"
 	"golang.org/x/text/transform"
+	"nhooyr.io/websocket"
 
 	"cdr.dev/slog"
 	"cdr.dev/slog/sloggers/slogtest"
 	"github.com/coder/coder/agent"
 	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/pty"
 	"github.com/coder/coder/pty/ptytest"
 	"github.com/coder/coder/tailnet"
 	"github.com/coder/coder/tailnet/tailnettest"
@@ -49,6 +60,10 @@ import (
 )
 
 func TestMain(m *testing.M) {
+	if os.Getenv("CODER_AGENT_TEST_LANGUAGE_SERVER") != "" {
+		runFakeLanguageServer()
+		return
+	}
 	goleak.VerifyTestMain(m)
 }
 
@@ -110,6 +125,97 @@ func TestAgent(t *testing.T) {
 				"never saw stats: %+v", s,
 			)
 		})
+
+		t.Run("Idle", func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+			defer cancel()
+
+			conn, stats, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+
+			// The workspace is idle after the agent starts.
+			var s *codersdk.AgentStats
+			require.Eventuallyf(t, func() bool {
+				var ok bool
+				s, ok = <-stats
+				return ok && s.IdleSeconds > 0
+			}, testutil.WaitLong, testutil.IntervalFast,
+				"never saw idle stats: %+v", s,
+			)
+
+			// An open connection means the workspace isn't idle.
+			sshClient, err := conn.SSHClient(ctx)
+			require.NoError(t, err)
+			defer sshClient.Close()
+			require.Eventuallyf(t, func() bool {
+				var ok bool
+				s, ok = <-stats
+				return ok && s.IdleSeconds == 0
+			}, testutil.WaitLong, testutil.IntervalFast,
+				"never saw active stats: %+v", s,
+			)
+		})
+
+		t.Run("IPv6Only", func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+			defer cancel()
+
+			conn, stats, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+				DERPMap: tailnettest.RunDERPAndSTUNIPv6(t),
+			}, 0)
+
+			sshClient, err := conn.SSHClient(ctx)
+			require.NoError(t, err)
+			defer sshClient.Close()
+			session, err := sshClient.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+			require.NoError(t, session.Run("echo test"))
+
+			var s *codersdk.AgentStats
+			require.Eventuallyf(t, func() bool {
+				var ok bool
+				s, ok = <-stats
+				return ok && s.IPv6 && !s.IPv4
+			}, testutil.WaitLong, testutil.IntervalFast,
+				"never saw ipv6-only stats: %+v", s,
+			)
+		})
+
+		t.Run("Usage", func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+			defer cancel()
+
+			conn, stats, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+				TelemetryEnabled: true,
+			}, 0)
+
+			sshClient, err := conn.SSHClient(ctx)
+			require.NoError(t, err)
+			defer sshClient.Close()
+			client, err := sftp.NewClient(sshClient)
+			require.NoError(t, err)
+			_, err = client.Getwd()
+			require.NoError(t, err)
+			require.NoError(t, client.Close())
+
+			// Usage is reset after each report, so it's summed until
+			// the session is counted.
+			var sftpSessions int64
+			require.Eventuallyf(t, func() bool {
+				s, ok := <-stats
+				if !ok || s.Usage == nil {
+					return false
+				}
+				sftpSessions += s.Usage.SFTPSessions
+				return sftpSessions > 0
+			}, testutil.WaitLong, testutil.IntervalFast,
+				"never saw usage",
+			)
+			require.EqualValues(t, 1, sftpSessions)
+		})
 	})
 
 	t.Run("SessionExec", func(t *testing.T) {
@@ -125,6 +231,41 @@ func TestAgent(t *testing.T) {
 		require.Equal(t, "test", strings.TrimSpace(string(output)))
 	})
 
+	t.Run("SessionTempDir", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		conn, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		tempDir := func() string {
+			session, err := sshClient.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+			output, err := session.Output("echo $TMPDIR")
+			require.NoError(t, err)
+			return strings.TrimSpace(string(output))
+		}
+
+		// Each session has its own temporary directory.
+		first := tempDir()
+		second := tempDir()
+		require.NotEqual(t, first, second)
+		root := filepath.Join(os.TempDir(), "coder-session-tmp")
+		for _, dir := range []string{first, second} {
+			require.Equal(t, root, filepath.Dir(dir))
+		}
+		// They're removed when the session ends.
+		require.Eventually(t, func() bool {
+			infos, err := afero.ReadDir(fs, root)
+			return err == nil && len(infos) == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
 	t.Run("GitSSH", func(t *testing.T) {
 		t.Parallel()
 		session := setupSSHSession(t, codersdk.WorkspaceAgentMetadata{})
@@ -137,6 +278,264 @@ func TestAgent(t *testing.T) {
 		require.True(t, strings.HasSuffix(strings.TrimSpace(string(output)), "gitssh --"))
 	})
 
+	t.Run("SessionForcePTY", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			ForcePTYCommands: []string{"tt*"},
+		}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		run := func(command string, env ...string) string {
+			session, err := sshClient.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+			for i := 0; i < len(env); i += 2 {
+				err = session.Setenv(env[i], env[i+1])
+				require.NoError(t, err)
+			}
+			// tty exits with a non-zero code without a TTY.
+			output, _ := session.Output(command)
+			return strings.TrimSpace(string(output))
+		}
+
+		// Programs matching a pattern are run with a PTY.
+		require.Contains(t, run("/usr/bin/tty"), "/dev/")
+		require.Equal(t, "not a tty", run("sh -c tty"))
+		// Clients can force a PTY for any command.
+		require.Contains(t, run("sh -c tty", "CODER_FORCE_PTY", "true"), "/dev/")
+		require.Equal(t, "not a tty", run("tty", "CODER_FORCE_PTY", "false"))
+	})
+
+	t.Run("SessionAcceptEnv", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("the command is written for POSIX shells")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			SSHAcceptEnv: &codersdk.WorkspaceAgentSSHAcceptEnv{
+				Patterns: []string{"LC_*", "EDITOR"},
+			},
+		}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		for key, value := range map[string]string{
+			"LC_TEST":    "lc",
+			"EDITOR":     "vim",
+			"SECRET_KEY": "secret",
+		} {
+			err = session.Setenv(key, value)
+			require.NoError(t, err)
+		}
+		output, err := session.Output(`echo "$LC_TEST,$EDITOR,$SECRET_KEY"`)
+		require.NoError(t, err)
+		require.Equal(t, "lc,vim,", strings.TrimSpace(string(output)))
+
+		// Exec requests are restricted too.
+		var stdout bytes.Buffer
+		exitCode, err := conn.Exec(ctx, codersdk.ExecRequest{
+			Command: `echo "$LC_TEST,$SECRET_KEY"`,
+			Env:     map[string]string{"LC_TEST": "lc", "SECRET_KEY": "secret"},
+		}, &stdout, nil)
+		require.NoError(t, err)
+		require.Zero(t, exitCode)
+		require.Equal(t, "lc,", strings.TrimSpace(stdout.String()))
+	})
+
+	t.Run("ControlSocket", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("the command is written for POSIX shells")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		// The path of Unix sockets is limited to about 100 bytes, which
+		// t.TempDir() can exceed.
+		dir, err := os.MkdirTemp("", "coder")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = os.RemoveAll(dir)
+		})
+		socketPath := filepath.Join(dir, "agent.sock")
+		conn, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(options *agent.Options) {
+			options.ControlSocketPath = socketPath
+			options.AgentLogFile = "/agent.log"
+		})
+		err = afero.WriteFile(fs, "/agent.log", []byte("one\ntwo\nthree\n"), 0o600)
+		require.NoError(t, err)
+
+		control := codersdk.NewAgentControlClient(socketPath)
+		var status codersdk.AgentControlStatus
+		require.Eventually(t, func() bool {
+			status, err = control.Status(ctx)
+			return err == nil
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.NotEmpty(t, status.Version)
+		require.False(t, status.Draining)
+		require.Empty(t, status.Services)
+		info, err := os.Stat(socketPath)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+		// Sessions find the socket in their environment.
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("echo $" + codersdk.AgentControlSocketEnv)
+		require.NoError(t, err)
+		require.Equal(t, socketPath, strings.TrimSpace(string(output)))
+
+		var logs bytes.Buffer
+		err = control.Logs(ctx, "agent", 2, &logs)
+		require.NoError(t, err)
+		require.Equal(t, "two\nthree\n", logs.String())
+
+		// The agent connected to Coder after it started.
+		var events codersdk.AgentEventsResponse
+		require.Eventually(t, func() bool {
+			events, err = control.Events(ctx, 0)
+			return err == nil && len(events.Events) >= 2
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, codersdk.AgentEventStarted, events.Events[0].Type)
+		require.Equal(t, codersdk.AgentEventConnected, events.Events[1].Type)
+
+		err = control.RestartService(ctx, "unknown")
+		var sdkErr *codersdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusNotFound, sdkErr.StatusCode())
+	})
+
+	t.Run("SessionSignal", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("the command is written for POSIX shells")
+		}
+		for _, isPTY := range []bool{false, true} {
+			isPTY := isPTY
+			t.Run(fmt.Sprintf("PTY=%t", isPTY), func(t *testing.T) {
+				t.Parallel()
+				session := setupSSHSession(t, codersdk.WorkspaceAgentMetadata{})
+				if isPTY {
+					err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{})
+					require.NoError(t, err)
+				}
+				stdout, err := session.StdoutPipe()
+				require.NoError(t, err)
+				err = session.Start(`trap "echo interrupted; exit 3" INT; echo ready; while :; do sleep 0.1; done`)
+				require.NoError(t, err)
+				reader := bufio.NewReader(stdout)
+				line, err := reader.ReadString('\n')
+				require.NoError(t, err)
+				require.Equal(t, "ready", strings.TrimSpace(line))
+
+				err = session.Signal(ssh.SIGINT)
+				require.NoError(t, err)
+				line, err = reader.ReadString('\n')
+				require.NoError(t, err)
+				require.Equal(t, "interrupted", strings.TrimSpace(line))
+				err = session.Wait()
+				var exitErr *ssh.ExitError
+				require.ErrorAs(t, err, &exitErr)
+				require.Equal(t, 3, exitErr.ExitStatus())
+			})
+		}
+	})
+
+	t.Run("SessionTTYOutputAfterExit", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		// Writing the output is slower than the command, so most of it
+		// is still in the PTY when the command exits.
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			o.SessionRecorder = slowOutputRecorder{delay: 100 * time.Millisecond}
+		})
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		err = session.Setenv("CODER_FORCE_PTY", "true")
+		require.NoError(t, err)
+		output, err := session.Output("seq 10000")
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(output)), "\r\n")
+		require.Len(t, lines, 10000)
+		require.Equal(t, "10000", lines[len(lines)-1])
+	})
+
+	t.Run("SessionPrewarmedShells", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS != "linux" {
+			t.Skip("The command line of the shell is read from /proc.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		dir := t.TempDir()
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			Directory: dir,
+			EnvironmentVariables: map[string]string{
+				"FOO": "bar",
+			},
+		}, 0, func(o *agent.Options) {
+			o.PrewarmShells = 1
+		})
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		run := func() (string, string, error) {
+			session, err := sshClient.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+			var stdout, stderr bytes.Buffer
+			session.Stdin = strings.NewReader("input\n")
+			session.Stdout = &stdout
+			session.Stderr = &stderr
+			err = session.Run(`tr '\0' ' ' < /proc/$$/cmdline; echo; echo "$FOO $(pwd)"; cat; test -e /dev/fd/3 && echo leaked; echo error >&2; exit 3`)
+			return stdout.String(), stderr.String(), err
+		}
+
+		// The pool is filled once the metadata is fetched, and every
+		// session takes the shell that was started in place of the last.
+		pooled := 0
+		require.Eventually(t, func() bool {
+			stdout, stderr, err := run()
+			var exitErr *ssh.ExitError
+			require.ErrorAs(t, err, &exitErr)
+			require.Equal(t, 3, exitErr.ExitStatus())
+			lines := strings.Split(stdout, "\n")
+			require.Equal(t, []string{"bar " + dir, "input", ""}, lines[1:])
+			require.Equal(t, "error\n", stderr)
+			if strings.HasSuffix(strings.TrimSpace(lines[0]), "-c . /dev/fd/3") {
+				pooled++
+			}
+			return pooled == 3
+		}, testutil.WaitLong, testutil.IntervalFast)
+	})
+
 	t.Run("SessionTTYShell", func(t *testing.T) {
 		t.Parallel()
 		if runtime.GOOS == "windows" {
@@ -194,8 +593,25 @@ func TestAgent(t *testing.T) {
 		}
 	})
 
-	//nolint:paralleltest // This test sets an environment variable.
+	t.Run("SessionError", func(t *testing.T) {
+		t.Parallel()
+		// The command can't start in a directory that doesn't exist.
+		session := setupSSHSession(t, codersdk.WorkspaceAgentMetadata{
+			Directory: filepath.Join(t.TempDir(), "missing"),
+		})
+		var stderr bytes.Buffer
+		session.Stderr = &stderr
+		err := session.Run("true")
+		exitErr := &ssh.ExitError{}
+		require.True(t, xerrors.As(err, &exitErr))
+		require.Equal(t, agent.MagicSessionErrorCode, exitErr.ExitStatus())
+		require.Equal(t, agent.MagicSessionErrorSignal, exitErr.Signal())
+		require.Contains(t, exitErr.Msg(), string(codersdk.WorkspaceAgentErrorCommandStartFailed))
+		require.Contains(t, stderr.String(), codersdk.WorkspaceAgentErrorCommandStartFailed.Guidance())
+	})
+
 	t.Run("Session TTY MOTD", func(t *testing.T) {
+		t.Parallel()
 		if runtime.GOOS == "windows" {
 			// This might be our implementation, or ConPTY itself.
 			// It's difficult to find extensive tests for it, so
@@ -205,16 +621,21 @@ func TestAgent(t *testing.T) {
 
 		wantMOTD := "Welcome to your Coder workspace!"
 
+		// The MOTD is read from the filesystem of the agent, and the
+		// home directory has no ~/.hushlogin.
 		tmpdir := t.TempDir()
+		fs := afero.NewMemMapFs()
 		name := filepath.Join(tmpdir, "motd")
-		err := os.WriteFile(name, []byte(wantMOTD), 0o600)
+		err := afero.WriteFile(fs, name, []byte(wantMOTD), 0o600)
 		require.NoError(t, err, "write motd file")
 
-		// Set HOME so we can ensure no ~/.hushlogin is present.
-		t.Setenv("HOME", tmpdir)
-
 		session := setupSSHSession(t, codersdk.WorkspaceAgentMetadata{
 			MOTDFile: name,
+		}, func(options *agent.Options) {
+			options.Filesystem = fs
+			options.HomeDir = func() (string, error) {
+				return tmpdir, nil
+			}
 		})
 		err = session.RequestPty("xterm", 128, 128, ssh.TerminalModes{})
 		require.NoError(t, err)
@@ -234,8 +655,8 @@ func TestAgent(t *testing.T) {
 		require.Contains(t, stdout.String(), wantMOTD, "should show motd")
 	})
 
-	//nolint:paralleltest // This test sets an environment variable.
 	t.Run("Session TTY Hushlogin", func(t *testing.T) {
+		t.Parallel()
 		if runtime.GOOS == "windows" {
 			// This might be our implementation, or ConPTY itself.
 			// It's difficult to find extensive tests for it, so
@@ -246,21 +667,22 @@ func TestAgent(t *testing.T) {
 		wantNotMOTD := "Welcome to your Coder workspace!"
 
 		tmpdir := t.TempDir()
+		fs := afero.NewMemMapFs()
 		name := filepath.Join(tmpdir, "motd")
-		err := os.WriteFile(name, []byte(wantNotMOTD), 0o600)
+		err := afero.WriteFile(fs, name, []byte(wantNotMOTD), 0o600)
 		require.NoError(t, err, "write motd file")
 
-		// Create hushlogin to silence motd.
-		f, err := os.Create(filepath.Join(tmpdir, ".hushlogin"))
+		// Create hushlogin in the home directory to silence motd.
+		err = afero.WriteFile(fs, filepath.Join(tmpdir, ".hushlogin"), nil, 0o600)
 		require.NoError(t, err, "create .hushlogin file")
-		err = f.Close()
-		require.NoError(t, err, "close .hushlogin file")
-
-		// Set HOME so we can ensure ~/.hushlogin is present.
-		t.Setenv("HOME", tmpdir)
 
 		session := setupSSHSession(t, codersdk.WorkspaceAgentMetadata{
 			MOTDFile: name,
+		}, func(options *agent.Options) {
+			options.Filesystem = fs
+			options.HomeDir = func() (string, error) {
+				return tmpdir, nil
+			}
 		})
 		err = session.RequestPty("xterm", 128, 128, ssh.TerminalModes{})
 		require.NoError(t, err)
@@ -280,6 +702,65 @@ func TestAgent(t *testing.T) {
 		require.NotContains(t, stdout.String(), wantNotMOTD, "should not show motd")
 	})
 
+	t.Run("Session TTY MOTD Sources", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			// This might be our implementation, or ConPTY itself.
+			// It's difficult to find extensive tests for it, so
+			// it seems like it could be either.
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			_, _ = w.Write([]byte("Notice from the URL"))
+		}))
+		defer srv.Close()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			MOTDSources: []codersdk.WorkspaceAgentMOTDSource{
+				{URL: srv.URL},
+				{Command: "echo Notice from the command"},
+				// Failing sources don't prevent logging in.
+				{Command: "exit 1"},
+			},
+		}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+
+		login := func() string {
+			session, err := sshClient.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+			err = session.RequestPty("xterm", 128, 128, ssh.TerminalModes{})
+			require.NoError(t, err)
+
+			ptty := ptytest.New(t)
+			var stdout bytes.Buffer
+			session.Stdout = &stdout
+			session.Stderr = ptty.Output()
+			session.Stdin = ptty.Input()
+			err = session.Shell()
+			require.NoError(t, err)
+
+			ptty.WriteLine("exit 0")
+			err = session.Wait()
+			require.NoError(t, err)
+			return stdout.String()
+		}
+		for i := 0; i < 2; i++ {
+			output := login()
+			require.Contains(t, output, "Notice from the URL")
+			require.Contains(t, output, "Notice from the command")
+		}
+		// The MOTD is cached between logins.
+		require.EqualValues(t, 1, requests.Load())
+	})
+
 	t.Run("LocalForwarding", func(t *testing.T) {
 		t.Parallel()
 		random, err := net.Listen("tcp", "127.0.0.1:0")
@@ -314,15 +795,111 @@ func TestAgent(t *testing.T) {
 		<-done
 	})
 
-	t.Run("SFTP", func(t *testing.T) {
+	t.Run("LocalForwardingIPv6", func(t *testing.T) {
 		t.Parallel()
 		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
 		defer cancel()
-		u, err := user.Current()
-		require.NoError(t, err, "get current user")
-		home := u.HomeDir
-		if runtime.GOOS == "windows" {
-			home = "/" + strings.ReplaceAll(home, "\\", "/")
+
+		// Applications increasingly bind only to the IPv6 loopback,
+		// so forwarding to "localhost" must reach them, but addresses
+		// are dialed as given.
+		local, err := net.Listen("tcp", "[::1]:0")
+		require.NoError(t, err)
+		defer local.Close()
+		go func() {
+			for {
+				conn, err := local.Accept()
+				if err != nil {
+					return
+				}
+				go testAccept(t, conn)
+			}
+		}()
+		localPort := local.Addr().(*net.TCPAddr).Port
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		forwarded, err := sshClient.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(localPort)))
+		require.NoError(t, err)
+		testDial(t, forwarded)
+		_ = forwarded.Close()
+		_, err = sshClient.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+		require.Error(t, err)
+	})
+
+	t.Run("LocalForwardingLoopbackAddress", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS != "linux" {
+			t.Skip("Only Linux routes all of 127.0.0.0/8 to the loopback interface.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		// Services like systemd-resolved bind to other loopback
+		// addresses, which are distinct from 127.0.0.1.
+		local, err := net.Listen("tcp", "127.0.0.2:0")
+		require.NoError(t, err)
+		defer local.Close()
+		go func() {
+			for {
+				conn, err := local.Accept()
+				if err != nil {
+					return
+				}
+				go testAccept(t, conn)
+			}
+		}()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		forwarded, err := sshClient.Dial("tcp", local.Addr().String())
+		require.NoError(t, err)
+		testDial(t, forwarded)
+		_ = forwarded.Close()
+	})
+
+	t.Run("SSHHostKeys", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+		hostKeys, err := conn.SSHHostKeys(ctx, "coder.workspace")
+		require.NoError(t, err)
+		require.NotEmpty(t, hostKeys.KnownHosts)
+
+		knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+		err = os.WriteFile(knownHostsFile, []byte(strings.Join(hostKeys.KnownHosts, "\n")+"\n"), 0o600)
+		require.NoError(t, err)
+		hostKeyCallback, err := knownhosts.New(knownHostsFile)
+		require.NoError(t, err)
+
+		// Strict host key checking must succeed with the served keys.
+		netConn, err := conn.SSH(ctx)
+		require.NoError(t, err)
+		defer netConn.Close()
+		sshConn, channels, requests, err := ssh.NewClientConn(netConn, "coder.workspace:22", &ssh.ClientConfig{
+			HostKeyCallback: hostKeyCallback,
+		})
+		require.NoError(t, err)
+		sshClient := ssh.NewClient(sshConn, channels, requests)
+		defer sshClient.Close()
+	})
+
+	t.Run("SFTP", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		u, err := user.Current()
+		require.NoError(t, err, "get current user")
+		home := u.HomeDir
+		if runtime.GOOS == "windows" {
+			home = "/" + strings.ReplaceAll(home, "\\", "/")
 		}
 		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
 		sshClient, err := conn.SSHClient(ctx)
@@ -348,6 +925,80 @@ func TestAgent(t *testing.T) {
 		require.NoError(t, err)
 	})
 
+	t.Run("SFTPReadOnly", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0o600))
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			o.SFTP = &codersdk.WorkspaceAgentSFTP{
+				ReadOnly: true,
+			}
+		})
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		client, err := sftp.NewClient(sshClient)
+		require.NoError(t, err)
+		defer client.Close()
+
+		file, err := client.Open(sftpPath(filepath.Join(dir, "file")))
+		require.NoError(t, err)
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+		require.NoError(t, file.Close())
+
+		_, err = client.Create(sftpPath(filepath.Join(dir, "other")))
+		require.Error(t, err)
+		require.Error(t, client.Remove(sftpPath(filepath.Join(dir, "file"))))
+		_, err = os.Stat(filepath.Join(dir, "other"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("SFTPAllowedPaths", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		allowed := t.TempDir()
+		denied := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(denied, "secret"), []byte("secret"), 0o600))
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			SFTP: &codersdk.WorkspaceAgentSFTP{
+				AllowedPaths: []string{allowed},
+			},
+		}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		client, err := sftp.NewClient(sshClient)
+		require.NoError(t, err)
+		defer client.Close()
+
+		file, err := client.Create(sftpPath(filepath.Join(allowed, "file")))
+		require.NoError(t, err)
+		_, err = file.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		data, err := os.ReadFile(filepath.Join(allowed, "file"))
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+		entries, err := client.ReadDir(sftpPath(allowed))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		_, err = client.Open(sftpPath(filepath.Join(denied, "secret")))
+		require.Error(t, err)
+		_, err = client.Create(sftpPath(filepath.Join(denied, "file")))
+		require.Error(t, err)
+		require.Error(t, client.Rename(sftpPath(filepath.Join(allowed, "file")), sftpPath(filepath.Join(denied, "file"))))
+		_, err = client.ReadDir(sftpPath(denied))
+		require.Error(t, err)
+		_, err = os.Stat(filepath.Join(denied, "file"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
 	t.Run("SCP", func(t *testing.T) {
 		t.Parallel()
 
@@ -485,65 +1136,2389 @@ func TestAgent(t *testing.T) {
 		require.Equal(t, content, strings.TrimSpace(gotContent))
 	})
 
-	t.Run("ReconnectingPTY", func(t *testing.T) {
+	t.Run("StartupRequiredMounts", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		fs := afero.NewMemMapFs()
+		mountInfo := "22 1 0:21 / / rw,relatime - overlay overlay rw\n"
+		require.NoError(t, afero.WriteFile(fs, "/proc/self/mountinfo", []byte(mountInfo), 0o444))
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript: "true",
+			RequiredMounts: &codersdk.WorkspaceAgentRequiredMounts{
+				Paths: []string{"/mnt/data"},
+			},
+		}, 0, func(options *agent.Options) {
+			options.Filesystem = fs
+		})
+		require.True(t, conn.AwaitReachable(ctx))
+
+		// The startup script waits for the volume to be mounted.
+		require.Eventually(t, func() bool {
+			startup, err := conn.Startup(ctx)
+			return err == nil && len(startup.PendingMounts) == 1 && startup.PendingMounts[0] == "/mnt/data"
+		}, testutil.WaitShort, testutil.IntervalFast)
+		startup, err := conn.Startup(ctx)
+		require.NoError(t, err)
+		require.Equal(t, codersdk.WorkspaceAgentStartupRunning, startup.State)
+
+		require.NoError(t, fs.MkdirAll("/mnt/data", 0o755))
+		mountInfo += "36 22 98:0 / /mnt/data rw,noatime - ext4 /dev/sdb rw\n"
+		require.NoError(t, afero.WriteFile(fs, "/proc/self/mountinfo", []byte(mountInfo), 0o444))
+		require.Eventually(t, func() bool {
+			startup, err = conn.Startup(ctx)
+			return err == nil && startup.State == codersdk.WorkspaceAgentStartupReady
+		}, testutil.WaitLong, testutil.IntervalFast)
+		require.Empty(t, startup.PendingMounts)
+	})
+
+	t.Run("Pprof", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(options *agent.Options) {
+			options.Pprof = true
+		})
+		require.True(t, conn.AwaitReachable(ctx))
+		profile, err := conn.Profile(ctx, "goroutine", 0)
+		require.NoError(t, err)
+		defer profile.Close()
+		data, err := io.ReadAll(profile)
+		require.NoError(t, err)
+		require.NotEmpty(t, data)
+
+		// Profiles aren't served unless they're enabled.
+		conn, _, _ = setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+		_, err = conn.Profile(ctx, "goroutine", 0)
+		require.Error(t, err)
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		fs := afero.NewMemMapFs()
+		mountInfo := "22 1 0:21 / / rw,relatime - overlay overlay rw\n"
+		require.NoError(t, afero.WriteFile(fs, "/proc/self/mountinfo", []byte(mountInfo), 0o444))
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript: "true",
+			RequiredMounts: &codersdk.WorkspaceAgentRequiredMounts{
+				Paths: []string{"/mnt/data"},
+			},
+		}, 0, func(options *agent.Options) {
+			options.Filesystem = fs
+		})
+		require.True(t, conn.AwaitReachable(ctx))
+
+		// The agent is healthy while the startup script waits, but the
+		// workspace isn't ready.
+		var health codersdk.WorkspaceAgentHealth
+		require.Eventually(t, func() bool {
+			var err error
+			health, err = conn.Health(ctx)
+			return err == nil && health.Healthy
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.True(t, health.Tailnet.Up)
+		require.True(t, health.Coordinator.Connected)
+		require.NotNil(t, health.MetadataFetchedAt)
+		require.False(t, health.Ready)
+		require.Equal(t, []string{"The startup script hasn't finished."}, health.Problems)
+
+		require.NoError(t, fs.MkdirAll("/mnt/data", 0o755))
+		mountInfo += "36 22 98:0 / /mnt/data rw,noatime - ext4 /dev/sdb rw\n"
+		require.NoError(t, afero.WriteFile(fs, "/proc/self/mountinfo", []byte(mountInfo), 0o444))
+		require.Eventually(t, func() bool {
+			var err error
+			health, err = conn.Ready(ctx)
+			return err == nil && health.Ready
+		}, testutil.WaitLong, testutil.IntervalFast)
+		require.Empty(t, health.Problems)
+	})
+
+	t.Run("Reload", func(t *testing.T) {
 		t.Parallel()
 		if runtime.GOOS == "windows" {
-			// This might be our implementation, or ConPTY itself.
-			// It's difficult to find extensive tests for it, so
-			// it seems like it could be either.
-			t.Skip("ConPTY appears to be inconsistent on Windows.")
+			t.Skip("This test uses a POSIX shell")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		fs := afero.NewMemMapFs()
+		require.NoError(t, afero.WriteFile(fs, "/etc/coder/env", []byte("# Comment\nFOO=bar\n"), 0o600))
+		var reopened atomic.Int32
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			EnvironmentVariables: map[string]string{
+				"FOO": "metadata",
+			},
+		}, 0, func(options *agent.Options) {
+			options.Filesystem = fs
+			options.EnvironmentFile = "/etc/coder/env"
+			options.ReopenLogs = func() error {
+				reopened.Add(1)
+				return nil
+			}
+		})
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		echo := func() string {
+			session, err := sshClient.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+			output, err := session.Output("echo $FOO")
+			require.NoError(t, err)
+			return strings.TrimSpace(string(output))
+		}
+		// The environment file overrides the metadata.
+		require.Equal(t, "bar", echo())
+
+		require.NoError(t, afero.WriteFile(fs, "/etc/coder/env", []byte("FOO=baz\n"), 0o600))
+		require.Equal(t, "bar", echo())
+		require.NoError(t, conn.Reload(ctx))
+		require.Equal(t, "baz", echo())
+		require.EqualValues(t, 1, reopened.Load())
+	})
+
+	t.Run("PersonalEnvironmentVariables", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		var agentClient *client
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			EnvironmentVariables: map[string]string{
+				"FOO": "template",
+			},
+			PersonalEnvironmentVariables: map[string]string{
+				"FOO": "personal",
+			},
+		}, 0, func(options *agent.Options) {
+			agentClient, _ = options.Client.(*client)
+			agentClient.metadataChanges = make(chan struct{})
+		})
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		echo := func() string {
+			session, err := sshClient.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+			output, err := session.Output("echo $FOO")
+			require.NoError(t, err)
+			return strings.TrimSpace(string(output))
+		}
+		// Personal variables override the template.
+		require.Equal(t, "personal", echo())
+
+		// The agent fetches metadata when it's notified of changes.
+		agentClient.setMetadata(func(metadata *codersdk.WorkspaceAgentMetadata) {
+			metadata.PersonalEnvironmentVariables = map[string]string{
+				"FOO": "changed",
+			}
+		})
+		require.Eventually(t, func() bool {
+			return echo() == "changed"
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
+	t.Run("MetadataHotReload", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+		output := filepath.Join(t.TempDir(), "startup")
+		var probes atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			probes.Add(1)
+			rw.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		var agentClient *client
+		_, _, _ = setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript: fmt.Sprintf("echo one >> %q", output),
+		}, 0, func(options *agent.Options) {
+			agentClient, _ = options.Client.(*client)
+			agentClient.metadataChanges = make(chan struct{})
+		})
+		require.Eventually(t, func() bool {
+			return agentClient.getStartupScriptResult() != nil
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// Changing the startup script runs it again, and the health
+		// checks of apps restart with the changed apps.
+		agentClient.setMetadata(func(metadata *codersdk.WorkspaceAgentMetadata) {
+			metadata.StartupScript = fmt.Sprintf("echo two >> %q", output)
+			metadata.Apps = []codersdk.WorkspaceApp{{
+				ID:     uuid.New(),
+				Slug:   "app",
+				Health: codersdk.WorkspaceAppHealthInitializing,
+				Healthcheck: codersdk.Healthcheck{
+					URL:       server.URL,
+					Interval:  1,
+					Threshold: 1,
+				},
+			}}
+		})
+		require.Eventually(t, func() bool {
+			content, err := os.ReadFile(output)
+			return err == nil && string(content) == "one\ntwo\n"
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Eventually(t, func() bool {
+			return probes.Load() > 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// Metadata that changed elsewhere doesn't run the script again.
+		agentClient.setMetadata(func(metadata *codersdk.WorkspaceAgentMetadata) {
+			metadata.MOTDFile = "/etc/motd"
+		})
+		time.Sleep(testutil.IntervalMedium)
+		content, err := os.ReadFile(output)
+		require.NoError(t, err)
+		require.Equal(t, "one\ntwo\n", string(content))
+	})
+
+	t.Run("StartupScriptPlainLog", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("printf isn't available on Windows")
+		}
+		_, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript: `printf '\033[31mred\033[0m\n'`,
+		}, 0)
+		plainPath := filepath.Join(os.TempDir(), "coder-startup-script.plain.log")
+		require.Eventually(t, func() bool {
+			content, err := afero.ReadFile(fs, plainPath)
+			return err == nil && len(content) > 0
+		}, testutil.WaitShort, testutil.IntervalMedium)
+		content, err := afero.ReadFile(fs, plainPath)
+		require.NoError(t, err)
+		require.Equal(t, "red\n", string(content))
+		content, err = afero.ReadFile(fs, filepath.Join(os.TempDir(), "coder-startup-script.log"))
+		require.NoError(t, err)
+		require.Equal(t, "\x1b[31mred\x1b[0m\n", string(content))
+	})
+
+	t.Run("StartupScriptLogs", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("printf isn't available on Windows")
+		}
+		var agentClient *client
+		_, _, _ = setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript: `printf 'first\r\n\033[31msecond\033[0m\nlast'`,
+		}, 0, func(options *agent.Options) {
+			agentClient, _ = options.Client.(*client)
+		})
+		require.NotNil(t, agentClient)
+		var logs []codersdk.StartupLog
+		require.Eventually(t, func() bool {
+			logs = agentClient.getStartupLogs()
+			return len(logs) == 3
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, "first", logs[0].Output)
+		require.Equal(t, "second", logs[1].Output)
+		require.Equal(t, "last", logs[2].Output)
+	})
+
+	t.Run("BootTiming", func(t *testing.T) {
+		t.Parallel()
+		var agentClient *client
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript: "echo ready",
+		}, 0, func(options *agent.Options) {
+			agentClient, _ = options.Client.(*client)
+		})
+		require.NotNil(t, agentClient)
+		require.Eventually(t, func() bool {
+			timing := agentClient.getBootTiming()
+			return timing.CoordinatorConnectedMillis != nil && timing.StartupScriptMillis != nil
+		}, testutil.WaitShort, testutil.IntervalFast)
+		timing := agentClient.getBootTiming()
+		require.False(t, timing.StartedAt.IsZero())
+		require.NotNil(t, timing.TokenExchangeMillis)
+		require.NotNil(t, timing.MetadataFetchMillis)
+		require.NotNil(t, timing.TailnetUpMillis)
+		require.Nil(t, timing.FirstSessionMillis)
+
+		// The first session is reported when it starts.
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		_, err = session.Output("echo test")
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return agentClient.getBootTiming().FirstSessionMillis != nil
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
+	t.Run("StartupScriptRetries", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("the script is written for POSIX shells")
 		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		marker := filepath.Join(t.TempDir(), "attempted")
+		var agentClient *client
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			// The script fails on the first attempt only.
+			StartupScript: fmt.Sprintf("test -f %[1]s && exit 0; touch %[1]s; exit 1", marker),
+			StartupScriptPolicy: &codersdk.WorkspaceAgentStartupScriptPolicy{
+				Retries: 2,
+			},
+		}, 0, func(options *agent.Options) {
+			agentClient, _ = options.Client.(*client)
+		})
+		require.NotNil(t, agentClient)
+		require.True(t, conn.AwaitReachable(ctx))
+		var startup codersdk.WorkspaceAgentStartupResponse
+		var err error
+		require.Eventually(t, func() bool {
+			startup, err = conn.Startup(ctx)
+			return err == nil && startup.State != codersdk.WorkspaceAgentStartupRunning
+		}, testutil.WaitLong, testutil.IntervalFast)
+		require.Equal(t, codersdk.WorkspaceAgentStartupReady, startup.State)
+		require.Equal(t, codersdk.WorkspaceAgentStartupScriptOK, startup.Result)
+		require.EqualValues(t, 2, startup.Attempts)
+
+		require.Eventually(t, func() bool {
+			return agentClient.getStartupScriptResult() != nil
+		}, testutil.WaitShort, testutil.IntervalFast)
+		result := agentClient.getStartupScriptResult()
+		require.Equal(t, codersdk.WorkspaceAgentStartupScriptOK, result.State)
+		require.EqualValues(t, 2, result.Attempts)
+		require.Empty(t, result.Error)
+	})
 
+	t.Run("StartupScriptTimeoutBlocksSessions", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("the script is written for POSIX shells")
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
 		defer cancel()
+		var agentClient *client
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript: "sleep 30",
+			StartupScriptPolicy: &codersdk.WorkspaceAgentStartupScriptPolicy{
+				TimeoutSeconds: 1,
+				FailurePolicy:  codersdk.WorkspaceAgentStartupScriptFailurePolicyBlock,
+			},
+		}, 0, func(options *agent.Options) {
+			agentClient, _ = options.Client.(*client)
+		})
+		require.NotNil(t, agentClient)
+		require.True(t, conn.AwaitReachable(ctx))
+
+		// Sessions wait for the script, and are refused once it timed out.
+		_, err := conn.Exec(ctx, codersdk.ExecRequest{Command: "true"}, nil, nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), string(codersdk.WorkspaceAgentErrorStartupScriptFailed))
+
+		startup, err := conn.Startup(ctx)
+		require.NoError(t, err)
+		require.Equal(t, codersdk.WorkspaceAgentStartupScriptTimedOut, startup.Result)
+		require.EqualValues(t, 1, startup.Attempts)
+		require.Eventually(t, func() bool {
+			return agentClient.getStartupScriptResult() != nil
+		}, testutil.WaitShort, testutil.IntervalFast)
+		result := agentClient.getStartupScriptResult()
+		require.Equal(t, codersdk.WorkspaceAgentStartupScriptTimedOut, result.State)
+		require.Contains(t, result.Error, "timed out")
+	})
+
+	t.Run("StartupDiagnostics", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		coderd := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}))
+		defer coderd.Close()
+		coderURL, err := url.Parse(coderd.URL)
+		require.NoError(t, err)
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			StartupScript:  "exit 1",
+			GitAuthConfigs: 1,
+		}, 0, func(options *agent.Options) {
+			options.CoderURL = coderURL
+		})
+		require.True(t, conn.AwaitReachable(ctx))
+		var startup codersdk.WorkspaceAgentStartupResponse
+		require.Eventually(t, func() bool {
+			startup, err = conn.Startup(ctx)
+			return err == nil && startup.State != codersdk.WorkspaceAgentStartupRunning
+		}, testutil.WaitLong, testutil.IntervalFast)
+		require.Equal(t, codersdk.WorkspaceAgentStartupError, startup.State)
+		require.Contains(t, startup.Error, "exit status 1")
+		require.NotNil(t, startup.StartedAt)
+		require.NotNil(t, startup.CompletedAt)
+		require.NotNil(t, startup.Diagnostics)
+
+		diagnostics := map[string]codersdk.WorkspaceAgentDiagnostic{}
+		for _, diagnostic := range startup.Diagnostics.Diagnostics {
+			diagnostics[diagnostic.Name] = diagnostic
+		}
+		for _, name := range []string{"disk", "writable", "dns", "proxy", "git_auth", "package_managers"} {
+			require.Contains(t, diagnostics, name)
+		}
+		require.NotEqual(t, codersdk.WorkspaceAgentDiagnosticFailed, diagnostics["writable"].Status)
+		require.Contains(t, diagnostics["git_auth"].Details, coderURL.String()+": reachable")
+		// Coder is reached by address, so only DERP hosts are resolved.
+		require.Equal(t, codersdk.WorkspaceAgentDiagnosticOK, diagnostics["dns"].Status)
+	})
+
+	t.Run("ReconnectingPTY", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			// This might be our implementation, or ConPTY itself.
+			// It's difficult to find extensive tests for it, so
+			// it seems like it could be either.
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		id := uuid.New()
+		netConn, err := conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		bufRead := bufio.NewReader(netConn)
+
+		// Brief pause to reduce the likelihood that we send keystrokes while
+		// the shell is simultaneously sending a prompt.
+		time.Sleep(100 * time.Millisecond)
+
+		data, err := json.Marshal(codersdk.ReconnectingPTYRequest{
+			Data: "echo test\r\n",
+		})
+		require.NoError(t, err)
+		_, err = netConn.Write(data)
+		require.NoError(t, err)
+
+		expectLine := func(matcher func(string) bool) {
+			for {
+				line, err := bufRead.ReadString('\n')
+				require.NoError(t, err)
+				if matcher(line) {
+					break
+				}
+			}
+		}
+
+		matchEchoCommand := func(line string) bool {
+			return strings.Contains(line, "echo test")
+		}
+		matchEchoOutput := func(line string) bool {
+			return strings.Contains(line, "test") && !strings.Contains(line, "echo")
+		}
+
+		// Once for typing the command...
+		expectLine(matchEchoCommand)
+		// And another time for the actual output.
+		expectLine(matchEchoOutput)
+
+		_ = netConn.Close()
+		netConn, err = conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		bufRead = bufio.NewReader(netConn)
+
+		// Same output again!
+		expectLine(matchEchoCommand)
+		expectLine(matchEchoOutput)
+	})
+
+	t.Run("ReconnectingPTYWebSocket", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		init := codersdk.ReconnectingPTYInit{
+			ID:      uuid.New(),
+			Height:  100,
+			Width:   100,
+			Command: "/bin/bash",
+		}
+		ws, err := conn.ReconnectingPTYWebSocket(ctx, init)
+		require.NoError(t, err)
+		defer ws.Close(websocket.StatusNormalClosure, "")
+
+		// readUntil reads output until it contains the text, and returns
+		// the control messages in between.
+		readUntil := func(ws *websocket.Conn, text string) []codersdk.ReconnectingPTYControl {
+			var (
+				output   strings.Builder
+				controls []codersdk.ReconnectingPTYControl
+			)
+			for !strings.Contains(output.String(), text) {
+				typ, data, err := ws.Read(ctx)
+				require.NoError(t, err)
+				if typ == websocket.MessageBinary {
+					_, _ = output.Write(data)
+					continue
+				}
+				var control codersdk.ReconnectingPTYControl
+				require.NoError(t, json.Unmarshal(data, &control))
+				controls = append(controls, control)
+			}
+			return controls
+		}
+
+		writeControl := func(control codersdk.ReconnectingPTYControl) {
+			data, err := json.Marshal(control)
+			require.NoError(t, err)
+			require.NoError(t, ws.Write(ctx, websocket.MessageText, data))
+		}
+		writeControl(codersdk.ReconnectingPTYControl{Type: codersdk.ReconnectingPTYControlResize, Height: 50, Width: 120})
+		writeControl(codersdk.ReconnectingPTYControl{Type: codersdk.ReconnectingPTYControlPing})
+		require.NoError(t, ws.Write(ctx, websocket.MessageBinary, []byte("stty size; echo test\r\n")))
+		controls := readUntil(ws, "50 120")
+		require.Contains(t, controls, codersdk.ReconnectingPTYControl{Type: codersdk.ReconnectingPTYControlPong})
+
+		// The PTY outlives the connection, and replays its output.
+		require.NoError(t, ws.Close(websocket.StatusNormalClosure, ""))
+		ws, err = conn.ReconnectingPTYWebSocket(ctx, init)
+		require.NoError(t, err)
+		defer ws.Close(websocket.StatusNormalClosure, "")
+		readUntil(ws, "50 120")
+	})
+
+	t.Run("ReconnectingPTYWebSocketDisabled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			FeatureFlags: map[codersdk.WorkspaceAgentFeatureFlag]bool{
+				codersdk.WorkspaceAgentFeaturePTYv2: false,
+			},
+		}, 0)
+		_, err := conn.ReconnectingPTYWebSocket(ctx, codersdk.ReconnectingPTYInit{
+			ID:      uuid.New(),
+			Command: "/bin/bash",
+		})
+		var apiErr *codersdk.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusNotFound, apiErr.StatusCode())
+	})
+
+	t.Run("ReconnectingPTYSharing", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		init := codersdk.ReconnectingPTYInit{
+			ID:          uuid.New(),
+			Height:      100,
+			Width:       100,
+			Command:     "/bin/bash",
+			Participant: "alice",
+		}
+
+		// readParticipants reads until the participants are sent, and
+		// returns them with the output in between.
+		readParticipants := func(ws *websocket.Conn, count int) (codersdk.ReconnectingPTYControl, string) {
+			var output strings.Builder
+			for {
+				typ, data, err := ws.Read(ctx)
+				require.NoError(t, err)
+				if typ == websocket.MessageBinary {
+					_, _ = output.Write(data)
+					continue
+				}
+				var control codersdk.ReconnectingPTYControl
+				require.NoError(t, json.Unmarshal(data, &control))
+				if control.Type == codersdk.ReconnectingPTYControlParticipants && len(control.Participants) == count {
+					return control, output.String()
+				}
+			}
+		}
+
+		writer, err := conn.ReconnectingPTYWebSocket(ctx, init)
+		require.NoError(t, err)
+		defer writer.Close(websocket.StatusNormalClosure, "")
+		readParticipants(writer, 1)
+
+		// Observers can't start terminals.
+		ws, err := conn.ReconnectingPTYWebSocket(ctx, codersdk.ReconnectingPTYInit{
+			ID:   uuid.New(),
+			Role: codersdk.ReconnectingPTYRoleReadOnly,
+		})
+		require.NoError(t, err)
+		_, data, err := ws.Read(ctx)
+		require.NoError(t, err)
+		require.Contains(t, string(data), "read-only connections can't start it")
+		_ = ws.Close(websocket.StatusNormalClosure, "")
+
+		init.Role = codersdk.ReconnectingPTYRoleReadOnly
+		init.Participant = "bob"
+		observer, err := conn.ReconnectingPTYWebSocket(ctx, init)
+		require.NoError(t, err)
+		defer observer.Close(websocket.StatusNormalClosure, "")
+		control, _ := readParticipants(observer, 2)
+		require.Equal(t, "alice", control.Participants[0].Name)
+		require.Equal(t, codersdk.ReconnectingPTYRoleReadWrite, control.Participants[0].Role)
+		require.Equal(t, "bob", control.Participants[1].Name)
+		require.Equal(t, codersdk.ReconnectingPTYRoleReadOnly, control.Participants[1].Role)
+		require.Equal(t, control.Participants[1].ID, control.ParticipantID)
+		readParticipants(writer, 2)
+
+		// The input of observers is ignored, and they see the output of
+		// the terminal.
+		require.NoError(t, observer.Write(ctx, websocket.MessageBinary, []byte("echo observer\r\n")))
+		require.NoError(t, writer.Write(ctx, websocket.MessageBinary, []byte("echo writer\r\n")))
+		var output strings.Builder
+		for !strings.Contains(output.String(), "writer\r\n") {
+			typ, data, err := observer.Read(ctx)
+			require.NoError(t, err)
+			if typ == websocket.MessageBinary {
+				_, _ = output.Write(data)
+			}
+		}
+		require.NotContains(t, output.String(), "observer")
+
+		participants, err := conn.ReconnectingPTYParticipants(ctx, init.ID)
+		require.NoError(t, err)
+		require.Len(t, participants, 2)
+		require.Error(t, conn.RevokeReconnectingPTYParticipant(ctx, init.ID, participants[0].ID))
+		require.NoError(t, conn.RevokeReconnectingPTYParticipant(ctx, init.ID, participants[1].ID))
+		for {
+			_, _, err = observer.Read(ctx)
+			if err != nil {
+				break
+			}
+		}
+		control, _ = readParticipants(writer, 1)
+		require.Equal(t, "alice", control.Participants[0].Name)
+	})
+
+	t.Run("NamedReconnectingPTY", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		// Reconnecting PTYs without names time out quickly.
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 100*time.Millisecond)
+		readUntil := func(netConn net.Conn, text string) {
+			var output strings.Builder
+			bufRead := bufio.NewReader(netConn)
+			for !strings.Contains(output.String(), text) {
+				line, err := bufRead.ReadString('\n')
+				require.NoError(t, err)
+				_, _ = output.WriteString(line)
+			}
+		}
+		for _, init := range []codersdk.ReconnectingPTYInit{
+			{Name: "dev", Command: "/bin/bash", Height: 100, Width: 100},
+			{ID: uuid.New(), Command: "/bin/bash", Height: 100, Width: 100},
+		} {
+			netConn, err := conn.DialReconnectingPTY(ctx, init)
+			require.NoError(t, err)
+			data, err := json.Marshal(codersdk.ReconnectingPTYRequest{Data: "echo hello-$((1+1))\r\n"})
+			require.NoError(t, err)
+			_, err = netConn.Write(data)
+			require.NoError(t, err)
+			readUntil(netConn, "hello-2")
+			require.NoError(t, netConn.Close())
+		}
+
+		var ptys []codersdk.ReconnectingPTYInfo
+		require.Eventually(t, func() bool {
+			var err error
+			ptys, err = conn.ReconnectingPTYs(ctx)
+			return err == nil && len(ptys) == 1
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, "dev", ptys[0].Name)
+		require.Equal(t, "dev", ptys[0].Label)
+
+		// Clients attach by name, and list the terminals.
+		ws, err := conn.ReconnectingPTYWebSocket(ctx, codersdk.ReconnectingPTYInit{
+			Name:   "dev",
+			Height: 100,
+			Width:  100,
+		})
+		require.NoError(t, err)
+		defer ws.Close(websocket.StatusNormalClosure, "")
+		data, err := json.Marshal(codersdk.ReconnectingPTYControl{Type: codersdk.ReconnectingPTYControlList})
+		require.NoError(t, err)
+		require.NoError(t, ws.Write(ctx, websocket.MessageText, data))
+		var (
+			output    strings.Builder
+			terminals []codersdk.ReconnectingPTYInfo
+		)
+		for terminals == nil || !strings.Contains(output.String(), "hello-2") {
+			typ, data, err := ws.Read(ctx)
+			require.NoError(t, err)
+			if typ == websocket.MessageBinary {
+				_, _ = output.Write(data)
+				continue
+			}
+			var control codersdk.ReconnectingPTYControl
+			require.NoError(t, json.Unmarshal(data, &control))
+			if control.Type == codersdk.ReconnectingPTYControlTerminals {
+				terminals = control.Terminals
+			}
+		}
+		require.Len(t, terminals, 1)
+		require.Equal(t, ptys[0].ID, terminals[0].ID)
+		require.Equal(t, 1, terminals[0].Participants)
+	})
+
+	t.Run("ReconnectingPTYInputTooLarge", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		netConn, err := conn.DialReconnectingPTY(ctx, codersdk.ReconnectingPTYInit{
+			ID:      uuid.New(),
+			Height:  100,
+			Width:   100,
+			Command: "/bin/bash",
+		})
+		require.NoError(t, err)
+		defer netConn.Close()
+		go func() {
+			// The agent stops reading the message, so the write fails.
+			_ = json.NewEncoder(netConn).Encode(codersdk.ReconnectingPTYRequest{
+				Data: strings.Repeat("a", 2<<20),
+			})
+		}()
+		var output strings.Builder
+		bufRead := bufio.NewReader(netConn)
+		for !strings.Contains(output.String(), string(codersdk.WorkspaceAgentErrorPTYInputTooLarge)) {
+			line, err := bufRead.ReadString('\n')
+			require.NoError(t, err)
+			_, _ = output.WriteString(line)
+		}
+	})
+
+	t.Run("PreSessionHook", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("The sessions run POSIX commands.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		peers := make(chan string, 10)
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			QuickActions: []codersdk.WorkspaceAgentQuickAction{{
+				Name:    "denied",
+				Command: "echo denied",
+			}},
+		}, 0, func(o *agent.Options) {
+			o.PreSessionHook = agent.PreSessionHookFunc(func(ctx context.Context, session agent.RecordedSession) (agent.SessionDecision, error) {
+				peers <- session.Peer
+				if strings.Contains(session.Command, "denied") || session.Type == codersdk.WorkspaceAgentSessionTypeSFTP {
+					return agent.SessionDecision{Deny: true, Reason: "blocked by dlp", ReasonCodes: []string{"dlp:secret"}}, nil
+				}
+				return agent.SessionDecision{ReasonCodes: []string{"dlp:scanned"}}, nil
+			})
+		})
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		output, err := session.CombinedOutput("echo denied")
+		require.Error(t, err)
+		require.Contains(t, string(output), string(codersdk.WorkspaceAgentErrorSessionDenied))
+		require.Contains(t, string(output), "blocked by dlp")
+		require.NotContains(t, string(output), "denied\n")
+		require.NotEmpty(t, <-peers)
+
+		// Reason codes are attached to sessions that are allowed.
+		session, err = sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		require.NoError(t, session.Start("sleep 30"))
+		require.Eventually(t, func() bool {
+			sessions, err := conn.Sessions(ctx)
+			if err != nil || len(sessions.Sessions) != 1 {
+				return false
+			}
+			return assert.ObjectsAreEqual([]string{"dlp:scanned"}, sessions.Sessions[0].ReasonCodes)
+		}, testutil.WaitShort, testutil.IntervalFast)
+		<-peers
+
+		// Reconnecting PTYs are denied before their process starts.
+		netConn, err := conn.DialReconnectingPTY(ctx, codersdk.ReconnectingPTYInit{
+			ID:      uuid.New(),
+			Height:  100,
+			Width:   100,
+			Command: "echo denied",
+		})
+		require.NoError(t, err)
+		defer netConn.Close()
+		ptyOutput, err := io.ReadAll(netConn)
+		require.NoError(t, err)
+		require.Contains(t, string(ptyOutput), "blocked by dlp")
+		require.NotEmpty(t, <-peers)
+
+		// Every other kind of session is checked too.
+		var stdout bytes.Buffer
+		_, err = conn.Exec(ctx, codersdk.ExecRequest{Command: "echo denied"}, &stdout, nil)
+		require.ErrorContains(t, err, "blocked by dlp")
+		require.Empty(t, stdout.String())
+		require.NotEmpty(t, <-peers)
+
+		_, err = conn.RunQuickAction(ctx, "denied")
+		var sdkErr *codersdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusForbidden, sdkErr.StatusCode())
+		<-peers
+
+		_, err = sftp.NewClient(sshClient)
+		require.Error(t, err)
+		require.NotEmpty(t, <-peers)
+	})
+
+	t.Run("ReconnectingPTYBufferSize", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		init := codersdk.ReconnectingPTYInit{
+			ID:         uuid.New(),
+			Height:     100,
+			Width:      100,
+			Command:    "seq 1 2000; echo done; sleep 60",
+			BufferSize: 1 << 10,
+		}
+		readUntilDone := func(netConn net.Conn) string {
+			var output strings.Builder
+			bufRead := bufio.NewReader(netConn)
+			for !strings.Contains(output.String(), "done") {
+				line, err := bufRead.ReadString('\n')
+				require.NoError(t, err)
+				output.WriteString(line)
+			}
+			return output.String()
+		}
+		netConn, err := conn.DialReconnectingPTY(ctx, init)
+		require.NoError(t, err)
+		output := readUntilDone(netConn)
+		require.Greater(t, len(output), 1<<10)
+		_ = netConn.Close()
+
+		// Only the end of the output fits in the scrollback.
+		netConn, err = conn.DialReconnectingPTY(ctx, init)
+		require.NoError(t, err)
+		defer netConn.Close()
+		output = readUntilDone(netConn)
+		require.LessOrEqual(t, len(output), 1<<10)
+		require.Contains(t, output, "1999")
+		require.NotContains(t, output, "\r\n100\r\n")
+	})
+
+	t.Run("ReconnectingPTYMalformedInit", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, stats, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		ptyAddr := netip.AddrPortFrom(codersdk.TailnetIP, uint16(codersdk.TailnetReconnectingPTYPort))
+
+		// A peer that never sends its init doesn't block others.
+		stalled, err := conn.DialContextTCP(ctx, ptyAddr)
+		require.NoError(t, err)
+		defer stalled.Close()
+		netConn, err := conn.ReconnectingPTY(ctx, uuid.New(), 100, 100, "echo test")
+		require.NoError(t, err)
+		defer netConn.Close()
+		bufRead := bufio.NewReader(netConn)
+		line, err := bufRead.ReadString('\n')
+		require.NoError(t, err)
+		require.Contains(t, line, "test")
+
+		// Oversized inits are rejected before they're read.
+		oversized, err := conn.DialContextTCP(ctx, ptyAddr)
+		require.NoError(t, err)
+		defer oversized.Close()
+		_, err = oversized.Write([]byte{0xff, 0xff})
+		require.NoError(t, err)
+		_, err = oversized.Read(make([]byte, 1))
+		require.Error(t, err)
+
+		require.Eventuallyf(t, func() bool {
+			s, ok := <-stats
+			return ok && s.MalformedReconnectingPTYInits > 0
+		}, testutil.WaitLong, testutil.IntervalFast,
+			"never saw malformed init",
+		)
+
+		// Clients refuse to send inits the agent would reject.
+		_, err = conn.ReconnectingPTY(ctx, uuid.New(), 100, 100, strings.Repeat("a", codersdk.MaxReconnectingPTYInitSize))
+		require.ErrorContains(t, err, "limit")
+	})
+
+	t.Run("ReconnectingPTYResizedReplay", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		id := uuid.New()
+		command := `printf 'before\033[2Jafter\n'; echo done; sleep 60`
+		readUntilDone := func(netConn net.Conn) string {
+			var output strings.Builder
+			bufRead := bufio.NewReader(netConn)
+			for !strings.Contains(output.String(), "done") {
+				line, err := bufRead.ReadString('\n')
+				require.NoError(t, err)
+				output.WriteString(line)
+			}
+			return output.String()
+		}
+		netConn, err := conn.ReconnectingPTY(ctx, id, 100, 100, command)
+		require.NoError(t, err)
+		require.Contains(t, readUntilDone(netConn), "before")
+		_ = netConn.Close()
+
+		// Reconnecting with the same size replays all of the output.
+		netConn, err = conn.ReconnectingPTY(ctx, id, 100, 100, command)
+		require.NoError(t, err)
+		require.Contains(t, readUntilDone(netConn), "before")
+		_ = netConn.Close()
+
+		// Output from before the screen was cleared isn't replayed to a
+		// terminal of another size.
+		netConn, err = conn.ReconnectingPTY(ctx, id, 40, 80, command)
+		require.NoError(t, err)
+		defer netConn.Close()
+		output := readUntilDone(netConn)
+		require.True(t, strings.HasPrefix(output, "\x1b[H\x1b[2J"), "output %q", output)
+		require.Contains(t, output, "after")
+		require.NotContains(t, output, "before")
+	})
+
+	t.Run("ReconnectingPTYSnapshot", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		tempDir := t.TempDir()
+		conn, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			o.TempDir = tempDir
+		})
+		id := uuid.New()
+		netConn, err := conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		bufRead := bufio.NewReader(netConn)
+
+		// Brief pause to reduce the likelihood that we send keystrokes while
+		// the shell is simultaneously sending a prompt.
+		time.Sleep(100 * time.Millisecond)
+
+		data, err := json.Marshal(codersdk.ReconnectingPTYRequest{
+			Data: "echo snap$((1+1))shot\r\n",
+		})
+		require.NoError(t, err)
+		_, err = netConn.Write(data)
+		require.NoError(t, err)
+
+		expectLine := func(matcher func(string) bool) {
+			for {
+				line, err := bufRead.ReadString('\n')
+				require.NoError(t, err)
+				if matcher(line) {
+					break
+				}
+			}
+		}
+		matchOutput := func(line string) bool {
+			return strings.Contains(line, "snap2shot")
+		}
+		expectLine(matchOutput)
+		_ = netConn.Close()
+
+		resp, err := conn.Quiesce(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 1, resp.ReconnectingPTYs)
+
+		// A new agent with the same filesystem behaves like an agent that
+		// restarted after the workspace resumed.
+		conn, _, _ = setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			o.Filesystem = fs
+			o.TempDir = tempDir
+		})
+		netConn, err = conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		defer netConn.Close()
+		bufRead = bufio.NewReader(netConn)
+
+		expectLine(matchOutput)
+		expectLine(func(line string) bool {
+			return strings.Contains(line, "resumed from a snapshot")
+		})
+	})
+
+	t.Run("ReconnectingPTYPersisted", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		tempDir := t.TempDir()
+		conn, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			o.TempDir = tempDir
+		})
+		id := uuid.New()
+		netConn, err := conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		bufRead := bufio.NewReader(netConn)
+
+		// Brief pause to reduce the likelihood that we send keystrokes while
+		// the shell is simultaneously sending a prompt.
+		time.Sleep(100 * time.Millisecond)
+
+		data, err := json.Marshal(codersdk.ReconnectingPTYRequest{
+			Data: "echo per$((1+1))sisted\r\n",
+		})
+		require.NoError(t, err)
+		_, err = netConn.Write(data)
+		require.NoError(t, err)
+
+		expectLine := func(matcher func(string) bool) {
+			for {
+				line, err := bufRead.ReadString('\n')
+				require.NoError(t, err)
+				if matcher(line) {
+					break
+				}
+			}
+		}
+		matchOutput := func(line string) bool {
+			return strings.Contains(line, "per2sisted")
+		}
+		expectLine(matchOutput)
+		_ = netConn.Close()
+
+		// The output is persisted while the agent runs, so it survives
+		// the agent being killed.
+		path := filepath.Join(tempDir, "coder-reconnecting-pty-buffers.json")
+		require.Eventually(t, func() bool {
+			data, err := afero.ReadFile(fs, path)
+			if err != nil {
+				return false
+			}
+			var persisted struct {
+				PTYs []struct {
+					Output []byte `json:"output"`
+				} `json:"ptys"`
+			}
+			err = json.Unmarshal(data, &persisted)
+			return err == nil && len(persisted.PTYs) == 1 && strings.Contains(string(persisted.PTYs[0].Output), "per2sisted")
+		}, testutil.WaitLong, testutil.IntervalMedium)
+
+		// A new agent with the same filesystem behaves like an agent that
+		// restarted.
+		conn, _, _ = setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			o.Filesystem = fs
+			o.TempDir = tempDir
+		})
+		netConn, err = conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		defer netConn.Close()
+		bufRead = bufio.NewReader(netConn)
+
+		expectLine(matchOutput)
+		expectLine(func(line string) bool {
+			return strings.Contains(line, "agent restarted")
+		})
+	})
+
+	t.Run("BroadcastMessage", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		netConn, err := conn.ReconnectingPTY(ctx, uuid.New(), 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		defer netConn.Close()
+		bufRead := bufio.NewReader(netConn)
+
+		// The session is registered once the PTY starts, so retry
+		// until the message has been written to it.
+		require.Eventually(t, func() bool {
+			resp, err := conn.BroadcastMessage(ctx, "maintenance in 5 minutes\x1b[2J")
+			return err == nil && resp.Sessions == 1
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		for {
+			line, err := bufRead.ReadString('\n')
+			require.NoError(t, err)
+			if strings.Contains(line, "maintenance in 5 minutes") {
+				// Control characters must be stripped.
+				require.NotContains(t, line, "\x1b")
+				break
+			}
+		}
+
+		_, err = conn.BroadcastMessage(ctx, "")
+		require.Error(t, err)
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		require.NoError(t, session.Start("echo ready && sleep 600"))
+		// Sessions are listed oldest first, so the SSH session must be
+		// registered before the reconnecting PTY starts.
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			return err == nil && len(resp.Sessions) == 1 && resp.Sessions[0].BytesOut > 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		ptyID := uuid.New()
+		netConn, err := conn.ReconnectingPTY(ctx, ptyID, 100, 100, "/bin/sh")
+		require.NoError(t, err)
+		defer netConn.Close()
+
+		var sessions []codersdk.WorkspaceAgentSession
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			if err != nil {
+				return false
+			}
+			sessions = resp.Sessions
+			return len(sessions) == 2
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, codersdk.WorkspaceAgentSessionTypeSSH, sessions[0].Type)
+		require.Equal(t, "echo ready && sleep 600", sessions[0].Command)
+		require.NotEmpty(t, sessions[0].Peer)
+		require.Equal(t, codersdk.WorkspaceAgentSessionTypeReconnectingPTY, sessions[1].Type)
+		require.Equal(t, ptyID.String(), sessions[1].ID)
+
+		require.NoError(t, conn.TerminateSession(ctx, sessions[0].ID))
+		require.Error(t, session.Wait())
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			return err == nil && len(resp.Sessions) == 1 && resp.Sessions[0].ID == ptyID.String()
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		err = conn.TerminateSession(ctx, sessions[0].ID)
+		var sdkErr *codersdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusNotFound, sdkErr.StatusCode())
+	})
+
+	t.Run("QuickActions", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			QuickActions: []codersdk.WorkspaceAgentQuickAction{{
+				Name:        "clear-cache",
+				DisplayName: "Clear cache",
+				Command:     `printf '\033[1mcleared\033[0m\n'; echo failed >&2; exit 3`,
+			}, {
+				Name:           "restart",
+				Command:        "sleep 600",
+				TimeoutSeconds: 1,
+			}},
+		}, 0)
+
+		resp, err := conn.QuickActions(ctx)
+		require.NoError(t, err)
+		require.Len(t, resp.QuickActions, 2)
+		require.Equal(t, "Clear cache", resp.QuickActions[0].DisplayName)
+		require.Nil(t, resp.QuickActions[0].LastRun)
+		// The name is displayed if there isn't a display name.
+		require.Equal(t, "restart", resp.QuickActions[1].DisplayName)
+
+		run, err := conn.RunQuickAction(ctx, "clear-cache")
+		require.NoError(t, err)
+		require.NotEqual(t, uuid.Nil, run.ID)
+		var lastRun *codersdk.WorkspaceAgentQuickActionRun
+		require.Eventually(t, func() bool {
+			resp, err := conn.QuickActions(ctx)
+			if err != nil {
+				return false
+			}
+			lastRun = resp.QuickActions[0].LastRun
+			return lastRun != nil && lastRun.Status != codersdk.WorkspaceAgentQuickActionRunRunning
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, run.ID, lastRun.ID)
+		require.Equal(t, codersdk.WorkspaceAgentQuickActionRunFailed, lastRun.Status)
+		require.NotNil(t, lastRun.ExitCode)
+		require.Equal(t, 3, *lastRun.ExitCode)
+		require.NotNil(t, lastRun.FinishedAt)
+		require.Equal(t, "cleared\nfailed\n", lastRun.Output)
+
+		run, err = conn.RunQuickAction(ctx, "restart")
+		require.NoError(t, err)
+		// Running actions are listed with the sessions.
+		sessions, err := conn.Sessions(ctx)
+		require.NoError(t, err)
+		require.Len(t, sessions.Sessions, 1)
+		require.Equal(t, codersdk.WorkspaceAgentSessionTypeQuickAction, sessions.Sessions[0].Type)
+		require.Equal(t, run.ID.String(), sessions.Sessions[0].ID)
+		require.Equal(t, "sleep 600", sessions.Sessions[0].Command)
+		// Actions only run once at a time.
+		_, err = conn.RunQuickAction(ctx, "restart")
+		var sdkErr *codersdk.Error
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusConflict, sdkErr.StatusCode())
+		require.Eventually(t, func() bool {
+			resp, err := conn.QuickActions(ctx)
+			if err != nil {
+				return false
+			}
+			lastRun = resp.QuickActions[1].LastRun
+			return lastRun != nil && lastRun.Status == codersdk.WorkspaceAgentQuickActionRunTimedOut
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			return err == nil && len(resp.Sessions) == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// Only the commands of the metadata can be run.
+		_, err = conn.RunQuickAction(ctx, "rm -rf /")
+		require.ErrorAs(t, err, &sdkErr)
+		require.Equal(t, http.StatusNotFound, sdkErr.StatusCode())
+	})
+
+	t.Run("SessionLabels", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		init := codersdk.ReconnectingPTYInit{
+			ID:      uuid.New(),
+			Height:  100,
+			Width:   100,
+			Command: `printf '\033]0;make all\007'; sleep 600`,
+			Label:   "build",
+		}
+		netConn, err := conn.DialReconnectingPTY(ctx, init)
+		require.NoError(t, err)
+		defer netConn.Close()
+
+		var session codersdk.WorkspaceAgentSession
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			if err != nil || len(resp.Sessions) != 1 {
+				return false
+			}
+			session = resp.Sessions[0]
+			return session.Title != ""
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, "build", session.Label)
+		require.Equal(t, "make all", session.Title)
+
+		// Clients that reconnect with a label rename the PTY.
+		init.Label = "release build"
+		renamed, err := conn.DialReconnectingPTY(ctx, init)
+		require.NoError(t, err)
+		defer renamed.Close()
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			return err == nil && len(resp.Sessions) == 1 && resp.Sessions[0].Label == "release build"
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
+	t.Run("AppToken", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		expiresAt := time.Now().Add(time.Hour)
+		require.NoError(t, conn.SetAppToken(ctx, codersdk.AppTokenRequest{
+			Token:     "first",
+			ExpiresAt: expiresAt,
+		}))
+		require.NoError(t, conn.SetAppToken(ctx, codersdk.AppTokenRequest{
+			Token:     "second",
+			ExpiresAt: expiresAt,
+		}))
+		err := conn.SetAppToken(ctx, codersdk.AppTokenRequest{
+			Token:     "expired",
+			ExpiresAt: time.Now().Add(-time.Minute),
+		})
+		require.Error(t, err)
+
+		// The path of the token file is exported to processes.
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("echo $CODER_APP_TOKEN_FILE")
+		require.NoError(t, err)
+
+		// The previous token stays valid until it expires.
+		content, err := afero.ReadFile(fs, strings.TrimSpace(string(output)))
+		require.NoError(t, err)
+		expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+		require.Equal(t, "second "+expiry+"\nfirst "+expiry+"\n", string(content))
+	})
+
+	t.Run("ShellHistory", func(t *testing.T) {
+		t.Parallel()
+
+		var (
+			mutex   sync.Mutex
+			stored  = map[string]string{"bash_history": "echo restored\n"}
+			uploads = map[string]int{}
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer test" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			name := path.Base(r.URL.Path)
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch r.Method {
+			case http.MethodGet:
+				content, ok := stored[name]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				_, _ = w.Write([]byte(content))
+			case http.MethodPut:
+				content, _ := io.ReadAll(r.Body)
+				stored[name] = string(content)
+				uploads[name]++
+			}
+		}))
+		defer srv.Close()
+
+		_, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			ShellHistory: &codersdk.WorkspaceAgentShellHistory{
+				URL: srv.URL + "/history/",
+				Headers: map[string]string{
+					"Authorization": "Bearer test",
+				},
+				IntervalSeconds: 1,
+			},
+		}, 0)
+		homedir, err := os.UserHomeDir()
+		require.NoError(t, err)
+
+		// History is restored when the agent starts.
+		require.Eventually(t, func() bool {
+			content, err := afero.ReadFile(fs, filepath.Join(homedir, ".bash_history"))
+			return err == nil && string(content) == "echo restored\n"
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// Changed history is uploaded.
+		err = afero.WriteFile(fs, filepath.Join(homedir, ".zsh_history"), []byte("ls\n"), 0o600)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return stored["zsh_history"] == "ls\n"
+		}, testutil.WaitShort, testutil.IntervalFast)
+		mutex.Lock()
+		defer mutex.Unlock()
+		require.Zero(t, uploads["bash_history"], "unchanged history is not uploaded")
+	})
+
+	t.Run("ReconnectingPTYTimeoutMetadata", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		// The metadata overrides the default timeout of the agent.
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			ReconnectingPTYTimeoutSeconds: 1,
+		}, 0)
+		netConn, err := conn.ReconnectingPTY(ctx, uuid.New(), 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		defer netConn.Close()
+
+		sessions := func() int {
+			resp, err := conn.BroadcastMessage(ctx, "test")
+			if err != nil {
+				return -1
+			}
+			return resp.Sessions
+		}
+		require.Eventually(t, func() bool {
+			return sessions() == 1
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// The PTY doesn't time out while it's connected.
+		time.Sleep(2 * time.Second)
+		require.Equal(t, 1, sessions())
+
+		_ = netConn.Close()
+		require.Eventually(t, func() bool {
+			return sessions() == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
+	t.Run("SessionTranscripts", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			SessionRecording: &codersdk.WorkspaceAgentSessionRecording{},
+		}, 0)
+		id := uuid.New()
+		netConn, err := conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		defer netConn.Close()
+
+		data, err := json.Marshal(codersdk.ReconnectingPTYRequest{
+			Data: "echo transcript-test\r\n",
+		})
+		require.NoError(t, err)
+		_, err = netConn.Write(data)
+		require.NoError(t, err)
+
+		var transcript []byte
+		require.Eventually(t, func() bool {
+			resp, err := conn.SessionTranscripts(ctx)
+			if err != nil || len(resp.Transcripts) != 1 {
+				return false
+			}
+			if resp.Transcripts[0].ID != id.String() {
+				return false
+			}
+			reader, err := conn.SessionTranscript(ctx, id.String())
+			if err != nil {
+				return false
+			}
+			defer reader.Close()
+			transcript, err = io.ReadAll(reader)
+			return err == nil && bytes.Contains(transcript, []byte("transcript-test"))
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// The first line is the asciicast header.
+		header, _, _ := bytes.Cut(transcript, []byte("\n"))
+		var parsed map[string]interface{}
+		require.NoError(t, json.Unmarshal(header, &parsed))
+		require.EqualValues(t, 2, parsed["version"])
+
+		_, err = conn.SessionTranscript(ctx, uuid.NewString())
+		require.Error(t, err)
+		_, err = conn.SessionTranscript(ctx, "..")
+		require.Error(t, err)
+	})
+
+	t.Run("SessionRecorder", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+
+		recordings := afero.NewMemMapFs()
+		session := setupSSHSession(t, codersdk.WorkspaceAgentMetadata{}, func(o *agent.Options) {
+			o.SessionRecorder = agent.NewAsciicastRecorder(slogtest.Make(t, nil), recordings, "/recordings")
+		})
+		err := session.RequestPty("xterm", 128, 128, ssh.TerminalModes{})
+		require.NoError(t, err)
+		session.Stdin = strings.NewReader("recorder-test\n")
+		output, err := session.Output("head -n 1")
+		require.NoError(t, err)
+		require.Contains(t, string(output), "recorder-test")
+
+		var names []string
+		require.Eventually(t, func() bool {
+			infos, err := afero.ReadDir(recordings, "/recordings")
+			if err != nil || len(infos) != 2 {
+				return false
+			}
+			names = []string{infos[0].Name(), infos[1].Name()}
+			return true
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.True(t, strings.HasSuffix(names[0], ".cast"))
+		require.Equal(t, names[0]+".sha256", names[1])
+
+		recording, err := afero.ReadFile(recordings, "/recordings/"+names[0])
+		require.NoError(t, err)
+		header, _, _ := bytes.Cut(recording, []byte("\n"))
+		var parsed map[string]interface{}
+		require.NoError(t, json.Unmarshal(header, &parsed))
+		require.EqualValues(t, 2, parsed["version"])
+		require.Equal(t, "head -n 1", parsed["title"])
+		// Both the input and the output are recorded.
+		require.Contains(t, string(recording), `"i","recorder-test`)
+		require.Contains(t, string(recording), `"o","recorder-test`)
+
+		digest, err := afero.ReadFile(recordings, "/recordings/"+names[1])
+		require.NoError(t, err)
+		sum := sha256.Sum256(recording)
+		require.Equal(t, fmt.Sprintf("%x  %s\n", sum, names[0]), string(digest))
+	})
+
+	t.Run("LanguageServer", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("The fake language server is started with a POSIX shell.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		executable, err := os.Executable()
+		require.NoError(t, err)
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			LanguageServers: []codersdk.WorkspaceAgentLanguageServer{{
+				Name:    "fake",
+				Command: fmt.Sprintf("CODER_AGENT_TEST_LANGUAGE_SERVER=1 exec %q", executable),
+			}},
+		}, 0)
+
+		connect := func() (net.Conn, *bufio.Reader) {
+			var lsConn net.Conn
+			require.Eventually(t, func() bool {
+				lsConn, err = conn.LanguageServer(ctx, "fake")
+				return err == nil
+			}, testutil.WaitShort, testutil.IntervalFast)
+			t.Cleanup(func() {
+				_ = lsConn.Close()
+			})
+			return lsConn, bufio.NewReader(lsConn)
+		}
+		first, firstReader := connect()
+		second, secondReader := connect()
+
+		// Every client initializes, but the server is only
+		// initialized once by the agent.
+		for _, client := range []struct {
+			conn   net.Conn
+			reader *bufio.Reader
+		}{{first, firstReader}, {second, secondReader}} {
+			writeLSP(t, client.conn, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`)
+			resp := readLSP(t, client.reader)
+			require.JSONEq(t, `1`, string(resp["id"]))
+			require.JSONEq(t, `{"serverInfo":{"name":"fake"}}`, string(resp["result"]))
+			writeLSP(t, client.conn, `{"jsonrpc":"2.0","method":"initialized","params":{}}`)
+		}
+
+		// Both clients open the same document, which the server
+		// sees as a single open followed by a change.
+		didOpen := `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///main.go","version":1,"text":"package main"}}}`
+		writeLSP(t, first, didOpen)
+		writeLSP(t, first, `{"jsonrpc":"2.0","id":2,"method":"test/state"}`)
+		resp := readLSP(t, firstReader)
+		require.JSONEq(t, `2`, string(resp["id"]))
+		require.JSONEq(t, `{"initializes":1,"opens":1,"changes":0}`, string(resp["result"]))
+
+		writeLSP(t, second, didOpen)
+		writeLSP(t, second, `{"jsonrpc":"2.0","id":2,"method":"test/state"}`)
+		resp = readLSP(t, secondReader)
+		require.JSONEq(t, `2`, string(resp["id"]))
+		require.JSONEq(t, `{"initializes":1,"opens":1,"changes":1}`, string(resp["result"]))
+
+		// Notifications from the server are sent to every client.
+		writeLSP(t, first, `{"jsonrpc":"2.0","method":"test/notify"}`)
+		for _, reader := range []*bufio.Reader{firstReader, secondReader} {
+			resp = readLSP(t, reader)
+			require.JSONEq(t, `"test/notified"`, string(resp["method"]))
+		}
+	})
+
+	t.Run("VirtualPTY", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("The virtual PTY is tested with a POSIX shell.")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(options *agent.Options) {
+			options.StartPTY = pty.StartVirtual
+		})
+		netConn, err := conn.ReconnectingPTY(ctx, uuid.New(), 100, 100, "/bin/sh")
+		require.NoError(t, err)
+		defer netConn.Close()
+
+		// Without a line discipline input isn't echoed, so only
+		// the output of the command is read back.
+		data, err := json.Marshal(codersdk.ReconnectingPTYRequest{
+			Data: "echo $((40 + 2))\n",
+		})
+		require.NoError(t, err)
+		_, err = netConn.Write(data)
+		require.NoError(t, err)
+
+		bufRead := bufio.NewReader(netConn)
+		for {
+			line, err := bufRead.ReadString('\n')
+			require.NoError(t, err)
+			if strings.TrimSpace(line) == "42" {
+				break
+			}
+		}
+	})
+
+	t.Run("ReversePortForward", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		// Find a free port to allow.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := uint16(listener.Addr().(*net.TCPAddr).Port)
+		require.NoError(t, listener.Close())
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			ReversePortForwarding: &codersdk.WorkspaceAgentReversePortForwarding{
+				LoopbackOnly: true,
+				AllowedPorts: []codersdk.WorkspaceAgentPortRange{{Start: port, End: port}},
+			},
+		}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+
+		// Ports outside the allowed ranges, dynamically allocated
+		// ports, and non-loopback addresses are denied.
+		_, err = sshClient.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port-1))
+		require.Error(t, err)
+		_, err = sshClient.Listen("tcp", "127.0.0.1:0")
+		require.Error(t, err)
+		_, err = sshClient.Listen("tcp", fmt.Sprintf("192.0.2.1:%d", port))
+		require.Error(t, err)
+
+		// The wildcard address is bound to loopback instead.
+		remote, err := sshClient.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+		require.NoError(t, err)
+		go func() {
+			c, err := remote.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte("hello"))
+			_ = c.Close()
+		}()
+		local, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		data, err := io.ReadAll(local)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+		_ = local.Close()
+
+		forwards, err := conn.ReversePortForwards(ctx)
+		require.NoError(t, err)
+		require.Len(t, forwards.Forwards, 1)
+		require.Equal(t, "localhost", forwards.Forwards[0].BindHost)
+		require.Equal(t, port, forwards.Forwards[0].BindPort)
+
+		// Canceling the forward closes the listener.
+		require.NoError(t, remote.Close())
+		require.Eventually(t, func() bool {
+			forwards, err := conn.ReversePortForwards(ctx)
+			return err == nil && len(forwards.Forwards) == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// Forwards are cleaned up when the connection ends.
+		_, err = sshClient.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		require.NoError(t, sshClient.Close())
+		require.Eventually(t, func() bool {
+			forwards, err := conn.ReversePortForwards(ctx)
+			return err == nil && len(forwards.Forwards) == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
+	t.Run("SSHUserCertificate", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		newSigner := func() ssh.Signer {
+			_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+			require.NoError(t, err)
+			signer, err := ssh.NewSignerFromKey(privateKey)
+			require.NoError(t, err)
+			return signer
+		}
+		authority := newSigner()
+		principal := uuid.NewString()
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			SSHUserCertificateAuthority: &codersdk.WorkspaceAgentSSHUserCertificateAuthority{
+				PublicKey: string(ssh.MarshalAuthorizedKey(authority.PublicKey())),
+				Principal: principal,
+			},
+		}, 0)
+		certAuth := func(authority ssh.Signer, principal string, validBefore time.Time) ssh.AuthMethod {
+			signer := newSigner()
+			cert := &ssh.Certificate{
+				Key:             signer.PublicKey(),
+				CertType:        ssh.UserCert,
+				KeyId:           "test",
+				ValidPrincipals: []string{principal},
+				ValidBefore:     uint64(validBefore.Unix()),
+			}
+			require.NoError(t, cert.SignCert(rand.Reader, authority))
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			require.NoError(t, err)
+			return ssh.PublicKeys(certSigner)
+		}
+		validBefore := time.Now().Add(time.Minute)
+
+		// Connections without a valid certificate are rejected.
+		for _, auth := range [][]ssh.AuthMethod{
+			nil,
+			{ssh.PublicKeys(newSigner())},
+			{certAuth(newSigner(), principal, validBefore)},
+			{certAuth(authority, uuid.NewString(), validBefore)},
+			{certAuth(authority, principal, time.Now().Add(-time.Minute))},
+		} {
+			_, err := conn.SSHClient(ctx, auth...)
+			require.Error(t, err)
+		}
+
+		sshClient, err := conn.SSHClient(ctx, certAuth(authority, principal, validBefore))
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("echo test")
+		require.NoError(t, err)
+		require.Equal(t, "test", strings.TrimSpace(string(output)))
+
+		// Exec requests would bypass the certificate.
+		_, err = conn.Exec(ctx, codersdk.ExecRequest{Command: "echo test"}, nil, nil)
+		require.ErrorContains(t, err, "require a public key or user certificate")
+	})
+
+	t.Run("SSHPublicKeyAuth", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		newSigner := func() ssh.Signer {
+			_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+			require.NoError(t, err)
+			signer, err := ssh.NewSignerFromKey(privateKey)
+			require.NoError(t, err)
+			return signer
+		}
+		var agentClient *client
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			SSHPublicKeyAuth: true,
+		}, 0, func(o *agent.Options) {
+			agentClient = o.Client.(*client)
+		})
+		authorized := newSigner()
+		agentClient.setAuthorizedKeys(
+			"not a key",
+			string(ssh.MarshalAuthorizedKey(authorized.PublicKey())),
+		)
+
+		// Connections without an authorized key are rejected.
+		for _, auth := range [][]ssh.AuthMethod{
+			nil,
+			{ssh.PublicKeys(newSigner())},
+		} {
+			_, err := conn.SSHClient(ctx, auth...)
+			require.Error(t, err)
+		}
+
+		sshClient, err := conn.SSHClient(ctx, ssh.PublicKeys(newSigner(), authorized))
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("echo test")
+		require.NoError(t, err)
+		require.Equal(t, "test", strings.TrimSpace(string(output)))
+
+		// Exec requests would bypass the key.
+		_, err = conn.Exec(ctx, codersdk.ExecRequest{Command: "echo test"}, nil, nil)
+		require.ErrorContains(t, err, "require a public key or user certificate")
+	})
+
+	t.Run("ConnectionEvents", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go testAccept(t, c)
+			}
+		}()
+
+		var agentClient *client
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			agentClient = o.Client.(*client)
+		})
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("echo test")
+		require.NoError(t, err)
+		require.Equal(t, "test", strings.TrimSpace(string(output)))
+
+		forwarded, err := conn.DialContext(ctx, "tcp", l.Addr().String())
+		require.NoError(t, err)
+		testDial(t, forwarded)
+		require.NoError(t, forwarded.Close())
+
+		connects := map[codersdk.AgentConnectionType]codersdk.AgentConnectionEvent{}
+		disconnects := map[codersdk.AgentConnectionType]codersdk.AgentConnectionEvent{}
+		require.Eventually(t, func() bool {
+			for _, event := range agentClient.getConnectionEvents() {
+				if event.Action == codersdk.AgentConnectionActionConnect {
+					connects[event.Type] = event
+				} else {
+					disconnects[event.Type] = event
+				}
+			}
+			_, ssh := disconnects[codersdk.AgentConnectionTypeSSH]
+			_, forward := disconnects[codersdk.AgentConnectionTypePortForward]
+			return ssh && forward
+		}, testutil.WaitLong, testutil.IntervalFast)
+
+		sshEvent := connects[codersdk.AgentConnectionTypeSSH]
+		require.Equal(t, "echo test", sshEvent.Command)
+		require.NotEmpty(t, sshEvent.SessionID)
+		require.NotEmpty(t, sshEvent.Peer)
+		require.Equal(t, sshEvent.ConnectionID, disconnects[codersdk.AgentConnectionTypeSSH].ConnectionID)
+		forwardEvent := connects[codersdk.AgentConnectionTypePortForward]
+		require.Equal(t, net.JoinHostPort("localhost", strconv.Itoa(l.Addr().(*net.TCPAddr).Port)), forwardEvent.Destination)
+		require.NotEmpty(t, forwardEvent.Peer)
+		require.Equal(t, forwardEvent.ConnectionID, disconnects[codersdk.AgentConnectionTypePortForward].ConnectionID)
+	})
+
+	t.Run("Drift", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("This test uses a POSIX shell")
+		}
+
+		gitconfig := []byte("[user]\n\tname = Coder\n")
+		checksum := sha256.Sum256(gitconfig)
+		var agentClient *client
+		setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			Directory: t.TempDir(),
+			EnvironmentVariables: map[string]string{
+				"GOFLAGS": "-mod=mod",
+			},
+			DriftManifest: &codersdk.WorkspaceAgentDriftManifest{
+				Tools: []codersdk.WorkspaceAgentDriftTool{{
+					Name:    "go",
+					Command: "echo go version go1.20.1",
+					Version: "go1.20",
+				}, {
+					Name:    "node",
+					Command: "echo v18.12.0",
+					Version: "v20",
+				}},
+				EnvironmentVariables: map[string]string{
+					"GOFLAGS":            "-mod=vendor",
+					"CODER_DRIFT_EDITOR": "vim",
+				},
+				Files: []codersdk.WorkspaceAgentDriftFile{{
+					Path:   "~/.gitconfig",
+					SHA256: hex.EncodeToString(checksum[:]),
+				}},
+			},
+		}, 0, func(o *agent.Options) {
+			agentClient = o.Client.(*client)
+			o.HomeDir = func() (string, error) {
+				return "/home/coder", nil
+			}
+			require.NoError(t, afero.WriteFile(o.Filesystem, "/home/coder/.gitconfig", gitconfig, 0o600))
+		})
+
+		var report *codersdk.WorkspaceAgentDriftReport
+		require.Eventually(t, func() bool {
+			report = agentClient.getDriftReport()
+			return report != nil
+		}, testutil.WaitLong, testutil.IntervalFast)
+		require.Equal(t, 5, report.Checks)
+		require.True(t, report.Drifted)
+		require.Len(t, report.Drifts, 3)
+		require.Equal(t, codersdk.WorkspaceAgentDrift{
+			Type:     codersdk.WorkspaceAgentDriftTypeTool,
+			Name:     "node",
+			Expected: "v20",
+			Actual:   "v18.12.0",
+		}, report.Drifts[0])
+		require.Equal(t, codersdk.WorkspaceAgentDrift{
+			Type:     codersdk.WorkspaceAgentDriftTypeEnvironmentVariable,
+			Name:     "CODER_DRIFT_EDITOR",
+			Expected: "vim",
+			Error:    "The environment variable isn't set.",
+		}, report.Drifts[1])
+		require.Equal(t, codersdk.WorkspaceAgentDrift{
+			Type:     codersdk.WorkspaceAgentDriftTypeEnvironmentVariable,
+			Name:     "GOFLAGS",
+			Expected: "-mod=vendor",
+			Actual:   "-mod=mod",
+		}, report.Drifts[2])
+	})
+
+	t.Run("DeclaredPorts", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		var agentClient *client
+		conn, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0, func(o *agent.Options) {
+			agentClient = o.Client.(*client)
+			o.TempDir = "/tmp"
+			require.NoError(t, afero.WriteFile(o.Filesystem, "/tmp/coder-ports.json", []byte(`[{"port": 3000, "name": "frontend"}]`), 0o600))
+		})
+		require.Eventually(t, func() bool {
+			ports := agentClient.getDeclaredPorts()
+			return len(ports) == 1 && ports[0].Port == 3000 && ports[0].Name == "frontend"
+		}, testutil.WaitLong, testutil.IntervalFast)
+
+		// Processes find the file in the environment.
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+		output, err := session.Output("echo $CODER_PORTS_FILE")
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join("/tmp", "coder-ports.json"), strings.TrimSpace(string(output)))
+
+		// Removing the file removes the declared ports.
+		require.NoError(t, fs.Remove("/tmp/coder-ports.json"))
+		require.Eventually(t, func() bool {
+			return len(agentClient.getDeclaredPorts()) == 0
+		}, testutil.WaitLong, testutil.IntervalFast)
+	})
+
+	t.Run("QUIC", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go testAccept(t, c)
+			}
+		}()
+		port := uint16(l.Addr().(*net.TCPAddr).Port)
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			ExperimentalQUIC: true,
+		}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+
+		// Port forwards are multiplexed as streams.
+		conn1, err := conn.DialQUIC(ctx, port)
+		require.NoError(t, err)
+		defer conn1.Close()
+		conn2, err := conn.DialQUIC(ctx, port)
+		require.NoError(t, err)
+		defer conn2.Close()
+		testDial(t, conn2)
+		testDial(t, conn1)
+
+		conn.ExperimentalQUIC = true
+		ptyConn, err := conn.ReconnectingPTY(ctx, uuid.New(), 100, 100, "/bin/bash")
+		require.NoError(t, err)
+		defer ptyConn.Close()
+		require.Equal(t, "udp", ptyConn.RemoteAddr().Network())
+		data, err := json.Marshal(codersdk.ReconnectingPTYRequest{
+			Data: "echo test\r\n",
+		})
+		require.NoError(t, err)
+		_, err = ptyConn.Write(data)
+		require.NoError(t, err)
+		bufRead := bufio.NewReader(ptyConn)
+		for {
+			line, err := bufRead.ReadString('\n')
+			require.NoError(t, err)
+			if strings.Contains(line, "test") && !strings.Contains(line, "echo") {
+				break
+			}
+		}
+	})
+
+	t.Run("AppStarting", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		// Find a port that nothing is listening on.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := l.Addr().(*net.TCPAddr).Port
+		require.NoError(t, l.Close())
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			Apps: []codersdk.WorkspaceApp{{
+				ID:          uuid.New(),
+				Slug:        "code-server",
+				DisplayName: "code-server",
+				URL:         fmt.Sprintf("http://localhost:%d/?folder=/home/coder", port),
+				Health:      codersdk.WorkspaceAppHealthDisabled,
+			}},
+		}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+		client := &http.Client{
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				DialContext:       conn.DialContext,
+			},
+		}
+		get := func(port int) (*http.Response, string) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/", port), nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			return resp, string(body)
+		}
+
+		resp, body := get(port)
+		require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		require.Equal(t, "5", resp.Header.Get("Retry-After"))
+		require.Contains(t, body, "code-server is starting")
+		require.Contains(t, body, "Health checks are disabled.")
+
+		// Once the app listens, requests are forwarded to it.
+		l, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("started"))
+			}),
+			ReadHeaderTimeout: testutil.WaitLong,
+		}
+		go func() {
+			_ = server.Serve(l)
+		}()
+		defer server.Close()
+		resp, body = get(port)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "started", body)
+	})
+
+	t.Run("DisableDirectConnections", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		conn, stats, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			DisableDirectConnections: true,
+		}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+		_, err := conn.Ping(ctx)
+		require.NoError(t, err)
+
+		var s *codersdk.AgentStats
+		require.Eventuallyf(t, func() bool {
+			var ok bool
+			s, ok = <-stats
+			return ok && s.DirectConnectionsDisabled
+		}, testutil.WaitLong, testutil.IntervalFast,
+			"never saw stats: %+v", s,
+		)
+	})
+
+	t.Run("PortListening", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		listeningPort := uint16(l.Addr().(*net.TCPAddr).Port)
+		// Find a port that nothing is listening on.
+		unbound, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := uint16(unbound.Addr().(*net.TCPAddr).Port)
+		require.NoError(t, unbound.Close())
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			Apps: []codersdk.WorkspaceApp{{
+				ID:          uuid.New(),
+				Slug:        "code-server",
+				DisplayName: "code-server",
+				URL:         fmt.Sprintf("https://localhost:%d", port),
+				Health:      codersdk.WorkspaceAppHealthDisabled,
+			}},
+		}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+
+		resp, err := conn.PortListening(ctx, listeningPort)
+		require.NoError(t, err)
+		require.True(t, resp.Listening)
+		require.Empty(t, resp.Reason)
+
+		resp, err = conn.PortListening(ctx, port)
+		require.NoError(t, err)
+		require.False(t, resp.Listening)
+		require.False(t, resp.AppStarting)
+		require.Equal(t, 5, resp.RetryAfterSeconds)
+		require.Contains(t, resp.Reason, `The app "code-server" isn't listening`)
+		require.Contains(t, resp.Reason, "Health checks are disabled.")
+	})
+
+	t.Run("AppConnectionLimits", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("dev server"))
+			}),
+			ReadHeaderTimeout: testutil.WaitLong,
+		}
+		go func() {
+			_ = server.Serve(l)
+		}()
+		defer server.Close()
+		port := l.Addr().(*net.TCPAddr).Port
+
+		conn, stats, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			Apps: []codersdk.WorkspaceApp{{
+				ID:     uuid.New(),
+				Slug:   "dev",
+				URL:    fmt.Sprintf("http://localhost:%d", port),
+				Health: codersdk.WorkspaceAppHealthDisabled,
+			}},
+			AppConnectionLimits: map[string]codersdk.WorkspaceAgentAppConnectionLimit{
+				"dev": {
+					MaxConnections:     1,
+					IdleTimeoutSeconds: 1,
+				},
+			},
+		}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+		get := func() *http.Response {
+			client := &http.Client{
+				Transport: &http.Transport{
+					DisableKeepAlives: true,
+					DialContext:       conn.DialContext,
+				},
+			}
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/", port), nil)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			return resp
+		}
+
+		// The open connection takes the only slot of the app.
+		open, err := conn.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		defer open.Close()
+		require.Eventually(t, func() bool {
+			return get().StatusCode == http.StatusServiceUnavailable
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// The idle connection is closed, which frees the slot.
+		require.Eventually(t, func() bool {
+			return get().StatusCode == http.StatusOK
+		}, testutil.WaitShort, testutil.IntervalMedium)
+
+		require.Eventually(t, func() bool {
+			s, ok := <-stats
+			if !ok || s.Apps == nil {
+				return false
+			}
+			app := s.Apps["dev"]
+			return app.RejectedConnections > 0 && app.IdleTimeouts > 0 && app.Connections >= 2
+		}, testutil.WaitLong, testutil.IntervalFast)
+	})
+
+	t.Run("QUICUnavailable", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go testAccept(t, c)
+			}
+		}()
 
 		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
-		id := uuid.New()
-		netConn, err := conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		require.True(t, conn.AwaitReachable(ctx))
+		_, err = conn.DialQUIC(ctx, uint16(l.Addr().(*net.TCPAddr).Port))
+		require.Error(t, err)
+
+		// Connections fall back to TCP.
+		conn.ExperimentalQUIC = true
+		conn1, err := conn.DialContext(ctx, "tcp", l.Addr().String())
 		require.NoError(t, err)
-		bufRead := bufio.NewReader(netConn)
+		defer conn1.Close()
+		require.Equal(t, "tcp", conn1.RemoteAddr().Network())
+		testDial(t, conn1)
+	})
 
-		// Brief pause to reduce the likelihood that we send keystrokes while
-		// the shell is simultaneously sending a prompt.
-		time.Sleep(100 * time.Millisecond)
+	t.Run("QUICFeatureFlag", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
 
-		data, err := json.Marshal(codersdk.ReconnectingPTYRequest{
-			Data: "echo test\r\n",
-		})
-		require.NoError(t, err)
-		_, err = netConn.Write(data)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
 		require.NoError(t, err)
-
-		expectLine := func(matcher func(string) bool) {
+		defer l.Close()
+		go func() {
 			for {
-				line, err := bufRead.ReadString('\n')
-				require.NoError(t, err)
-				if matcher(line) {
-					break
+				c, err := l.Accept()
+				if err != nil {
+					return
 				}
+				go testAccept(t, c)
 			}
-		}
-
-		matchEchoCommand := func(line string) bool {
-			return strings.Contains(line, "echo test")
-		}
-		matchEchoOutput := func(line string) bool {
-			return strings.Contains(line, "test") && !strings.Contains(line, "echo")
-		}
+		}()
+		port := uint16(l.Addr().(*net.TCPAddr).Port)
 
-		// Once for typing the command...
-		expectLine(matchEchoCommand)
-		// And another time for the actual output.
-		expectLine(matchEchoOutput)
+		// Feature flags override the deployment in both directions.
+		disabled, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			ExperimentalQUIC: true,
+			FeatureFlags: map[codersdk.WorkspaceAgentFeatureFlag]bool{
+				codersdk.WorkspaceAgentFeatureQUIC: false,
+			},
+		}, 0)
+		require.True(t, disabled.AwaitReachable(ctx))
+		_, err = disabled.DialQUIC(ctx, port)
+		require.Error(t, err)
 
-		_ = netConn.Close()
-		netConn, err = conn.ReconnectingPTY(ctx, id, 100, 100, "/bin/bash")
+		enabled, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{
+			FeatureFlags: map[codersdk.WorkspaceAgentFeatureFlag]bool{
+				codersdk.WorkspaceAgentFeatureQUIC: true,
+				"unsupported":                      true,
+			},
+		}, 0)
+		require.True(t, enabled.AwaitReachable(ctx))
+		conn, err := enabled.DialQUIC(ctx, port)
 		require.NoError(t, err)
-		bufRead = bufio.NewReader(netConn)
-
-		// Same output again!
-		expectLine(matchEchoCommand)
-		expectLine(matchEchoOutput)
+		defer conn.Close()
+		testDial(t, conn)
 	})
 
 	t.Run("Dial", func(t *testing.T) {
@@ -561,6 +3536,14 @@ func TestAgent(t *testing.T) {
 					return l
 				},
 			},
+			{
+				name: "TCPIPv6",
+				setup: func(t *testing.T) net.Listener {
+					l, err := net.Listen("tcp", "[::1]:0")
+					require.NoError(t, err, "create TCP listener")
+					return l
+				},
+			},
 			{
 				name: "UDP",
 				setup: func(t *testing.T) net.Listener {
@@ -624,6 +3607,197 @@ func TestAgent(t *testing.T) {
 		t.Logf("%.2f MBits/s", res[len(res)-1].MBitsPerSecond())
 	})
 
+	t.Run("SOCKS", func(t *testing.T) {
+		t.Parallel()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c, err := l.Accept()
+			if assert.NoError(t, err) {
+				testAccept(t, c)
+			}
+		}()
+
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		require.True(t, conn.AwaitReachable(context.Background()))
+		dialer, err := proxy.SOCKS5("tcp", "", nil, socksDialer{conn: conn})
+		require.NoError(t, err)
+		// The hostname is resolved by the agent.
+		port := l.Addr().(*net.TCPAddr).Port
+		c, err := dialer.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		require.NoError(t, err)
+		defer c.Close()
+		testDial(t, c)
+		<-done
+	})
+
+	t.Run("FileSync", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		conn, _, fs := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+
+		local := afero.NewMemMapFs()
+		require.NoError(t, local.MkdirAll("/local/dir", 0o755))
+		require.NoError(t, afero.WriteFile(local, "/local/dir/file", []byte("hello"), 0o644))
+		stats, err := conn.SyncFiles(ctx, codersdk.SyncFilesOptions{
+			Direction:  codersdk.FileSyncDirectionUpload,
+			LocalPath:  "/local",
+			RemotePath: "/remote",
+			Filesystem: local,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Transferred)
+		data, err := afero.ReadFile(fs, "/remote/dir/file")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+
+		require.NoError(t, afero.WriteFile(fs, "/remote/other", []byte("world"), 0o644))
+		stats, err = conn.SyncFiles(ctx, codersdk.SyncFilesOptions{
+			Direction:  codersdk.FileSyncDirectionDownload,
+			LocalPath:  "/local",
+			RemotePath: "/remote",
+			Filesystem: local,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Transferred)
+		data, err = afero.ReadFile(local, "/local/other")
+		require.NoError(t, err)
+		require.Equal(t, "world", string(data))
+
+		_, err = conn.SyncFiles(ctx, codersdk.SyncFilesOptions{
+			Direction:  codersdk.FileSyncDirectionDownload,
+			LocalPath:  "/local",
+			RemotePath: "/missing",
+			Filesystem: local,
+		})
+		require.ErrorContains(t, err, "/missing")
+	})
+
+	t.Run("Exec", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("The commands use a POSIX shell.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		conn, _, _ := setupAgent(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		require.True(t, conn.AwaitReachable(ctx))
+
+		dir := t.TempDir()
+		var stdout, stderr bytes.Buffer
+		exitCode, err := conn.Exec(ctx, codersdk.ExecRequest{
+			Command: `echo "$EXEC_TEST"; pwd; echo error >&2; exit 3`,
+			Env:     map[string]string{"EXEC_TEST": "hello"},
+			Dir:     dir,
+		}, &stdout, &stderr)
+		require.NoError(t, err)
+		require.Equal(t, 3, exitCode)
+		resolved, err := filepath.EvalSymlinks(dir)
+		require.NoError(t, err)
+		require.Equal(t, "hello\n"+resolved+"\n", stdout.String())
+		require.Equal(t, "error\n", stderr.String())
+
+		exitCode, err = conn.Exec(ctx, codersdk.ExecRequest{
+			Command: "sleep 30",
+			Timeout: 100 * time.Millisecond,
+		}, nil, nil)
+		require.ErrorContains(t, err, "timed out")
+		require.NotZero(t, exitCode)
+
+		// Commands are listed with the sessions, and terminating them
+		// kills the command.
+		done := make(chan error, 1)
+		go func() {
+			_, err := conn.Exec(ctx, codersdk.ExecRequest{
+				Command: "sleep 600",
+			}, nil, nil)
+			done <- err
+		}()
+		var sessions []codersdk.WorkspaceAgentSession
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			if err != nil {
+				return false
+			}
+			sessions = resp.Sessions
+			return len(sessions) == 1
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.Equal(t, codersdk.WorkspaceAgentSessionTypeExec, sessions[0].Type)
+		require.Equal(t, "sleep 600", sessions[0].Command)
+		require.NotEmpty(t, sessions[0].Peer)
+		require.NoError(t, conn.TerminateSession(ctx, sessions[0].ID))
+		select {
+		case <-done:
+		case <-ctx.Done():
+			t.Fatal("exec didn't end after the session was terminated")
+		}
+		require.Eventually(t, func() bool {
+			resp, err := conn.Sessions(ctx)
+			return err == nil && len(resp.Sessions) == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+	})
+
+	t.Run("CloseWithTimeout", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("ConPTY appears to be inconsistent on Windows.")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		conn, _, _, closer := setupAgentWithCloser(t, codersdk.WorkspaceAgentMetadata{}, 0)
+		sshClient, err := conn.SSHClient(ctx)
+		require.NoError(t, err)
+		defer sshClient.Close()
+		session, err := sshClient.NewSession()
+		require.NoError(t, err)
+		require.NoError(t, session.RequestPty("xterm", 80, 80, ssh.TerminalModes{}))
+		stdout, err := session.StdoutPipe()
+		require.NoError(t, err)
+		require.NoError(t, session.Start("echo ready; sleep 60"))
+		output := bufio.NewReader(stdout)
+		readUntil := func(text string) {
+			for {
+				line, err := output.ReadString('\n')
+				require.NoError(t, err)
+				if strings.Contains(line, text) {
+					return
+				}
+			}
+		}
+		readUntil("ready")
+
+		closed := make(chan error, 1)
+		go func() {
+			closed <- closer.CloseWithTimeout(ctx)
+		}()
+		// Sessions are told the agent is shutting down.
+		readUntil("shutting down")
+
+		// New connections are refused while the session keeps the
+		// agent open.
+		_, err = conn.SSHClient(ctx)
+		require.Error(t, err)
+		select {
+		case <-closed:
+			t.Fatal("agent closed with an open session")
+		default:
+		}
+
+		// The agent closes once the session ends.
+		_ = sshClient.Close()
+		select {
+		case err := <-closed:
+			require.NoError(t, err)
+		case <-time.After(testutil.WaitShort):
+			t.Fatal("agent didn't close after the session ended")
+		}
+	})
+
 	t.Run("Reconnect", func(t *testing.T) {
 		t.Parallel()
 		// After the agent is disconnected from a coordinator, it's supposed
@@ -663,6 +3837,80 @@ func TestAgent(t *testing.T) {
 		}, testutil.WaitShort, testutil.IntervalFast)
 	})
 
+	t.Run("EmbeddedDERP", func(t *testing.T) {
+		t.Parallel()
+
+		// The embedded DERP is configured by the metadata, or by an option
+		// of the agent.
+		for _, fromOption := range []bool{false, true} {
+			fromOption := fromOption
+			name := "Metadata"
+			if fromOption {
+				name = "Option"
+			}
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+				defer cancel()
+
+				// Find a free port for the embedded DERP to listen on, since
+				// clients must know the port ahead of time.
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				require.NoError(t, err)
+				port := listener.Addr().(*net.TCPAddr).Port
+				require.NoError(t, listener.Close())
+
+				embeddedDERP := &codersdk.WorkspaceAgentEmbeddedDERP{
+					ListenAddress: fmt.Sprintf("127.0.0.1:%d", port),
+					HostName:      "127.0.0.1",
+					RegionID:      999,
+					RegionCode:    "agent",
+					RegionName:    "Agent",
+				}
+				metadata := codersdk.WorkspaceAgentMetadata{
+					// This mimics an air-gapped deployment where the only
+					// region is served by the agent itself.
+					DERPMap: &tailcfg.DERPMap{
+						Regions: map[int]*tailcfg.DERPRegion{
+							999: {
+								RegionID:   999,
+								RegionCode: "agent",
+								RegionName: "Agent",
+								Nodes: []*tailcfg.DERPNode{{
+									Name:      "999a",
+									RegionID:  999,
+									HostName:  "127.0.0.1",
+									DERPPort:  port,
+									STUNPort:  -1,
+									ForceHTTP: true,
+								}},
+							},
+						},
+					},
+				}
+				var opts []func(*agent.Options)
+				if fromOption {
+					opts = append(opts, func(o *agent.Options) {
+						o.EmbeddedDERP = embeddedDERP
+					})
+				} else {
+					metadata.EmbeddedDERP = embeddedDERP
+				}
+				conn, _, _ := setupAgent(t, metadata, 0, opts...)
+				require.True(t, conn.AwaitReachable(ctx))
+				sshClient, err := conn.SSHClient(ctx)
+				require.NoError(t, err)
+				defer sshClient.Close()
+				session, err := sshClient.NewSession()
+				require.NoError(t, err)
+				defer session.Close()
+				output, err := session.Output("echo test")
+				require.NoError(t, err)
+				require.Equal(t, "test", strings.TrimSpace(string(output)))
+			})
+		}
+	})
+
 	t.Run("WriteVSCodeConfigs", func(t *testing.T) {
 		t.Parallel()
 		client := &client{
@@ -738,10 +3986,10 @@ func setupSSHCommand(t *testing.T, beforeArgs []string, afterArgs []string) *exe
 	return exec.Command("ssh", args...)
 }
 
-func setupSSHSession(t *testing.T, options codersdk.WorkspaceAgentMetadata) *ssh.Session {
+func setupSSHSession(t *testing.T, options codersdk.WorkspaceAgentMetadata, opts ...func(*agent.Options)) *ssh.Session {
 	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
 	defer cancel()
-	conn, _, _ := setupAgent(t, options, 0)
+	conn, _, _ := setupAgent(t, options, 0, opts...)
 	sshClient, err := conn.SSHClient(ctx)
 	require.NoError(t, err)
 	t.Cleanup(func() {
@@ -758,10 +4006,22 @@ func (c closeFunc) Close() error {
 	return c()
 }
 
-func setupAgent(t *testing.T, metadata codersdk.WorkspaceAgentMetadata, ptyTimeout time.Duration) (
+func setupAgent(t *testing.T, metadata codersdk.WorkspaceAgentMetadata, ptyTimeout time.Duration, opts ...func(*agent.Options)) (
+	*codersdk.AgentConn,
+	<-chan *codersdk.AgentStats,
+	afero.Fs,
+) {
+	conn, stats, fs, _ := setupAgentWithCloser(t, metadata, ptyTimeout, opts...)
+	return conn, stats, fs
+}
+
+// setupAgentWithCloser is setupAgent for tests that close the agent
+// themselves.
+func setupAgentWithCloser(t *testing.T, metadata codersdk.WorkspaceAgentMetadata, ptyTimeout time.Duration, opts ...func(*agent.Options)) (
 	*codersdk.AgentConn,
 	<-chan *codersdk.AgentStats,
 	afero.Fs,
+	agent.Agent,
 ) {
 	if metadata.DERPMap == nil {
 		metadata.DERPMap = tailnettest.RunDERPAndSTUN(t)
@@ -770,7 +4030,7 @@ func setupAgent(t *testing.T, metadata codersdk.WorkspaceAgentMetadata, ptyTimeo
 	agentID := uuid.New()
 	statsCh := make(chan *codersdk.AgentStats, 50)
 	fs := afero.NewMemMapFs()
-	closer := agent.New(agent.Options{
+	options := agent.Options{
 		Client: &client{
 			t:           t,
 			agentID:     agentID,
@@ -781,7 +4041,11 @@ func setupAgent(t *testing.T, metadata codersdk.WorkspaceAgentMetadata, ptyTimeo
 		Filesystem:             fs,
 		Logger:                 slogtest.Make(t, nil).Leveled(slog.LevelDebug),
 		ReconnectingPTYTimeout: ptyTimeout,
-	})
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	closer := agent.New(options)
 	t.Cleanup(func() {
 		_ = closer.Close()
 	})
@@ -805,7 +4069,31 @@ func setupAgent(t *testing.T, metadata codersdk.WorkspaceAgentMetadata, ptyTimeo
 	conn.SetNodeCallback(sendNode)
 	return &codersdk.AgentConn{
 		Conn: conn,
-	}, statsCh, fs
+	}, statsCh, fs, closer
+}
+
+// socksDialer dials the SOCKS5 proxy of the agent for proxy.SOCKS5.
+// slowOutputRecorder delays the output of PTY sessions.
+type slowOutputRecorder struct {
+	delay time.Duration
+}
+
+func (slowOutputRecorder) SessionOpened(context.Context, agent.RecordedSession) {}
+
+func (slowOutputRecorder) SessionClosed(context.Context, agent.RecordedSession, error) {}
+
+func (slowOutputRecorder) PTYInput(agent.RecordedSession, []byte) {}
+
+func (r slowOutputRecorder) PTYOutput(agent.RecordedSession, []byte) {
+	time.Sleep(r.delay)
+}
+
+type socksDialer struct {
+	conn *codersdk.AgentConn
+}
+
+func (d socksDialer) Dial(_, _ string) (net.Conn, error) {
+	return d.conn.DialSocks(context.Background())
 }
 
 var dialTestPayload = []byte("dean-was-here123")
@@ -817,6 +4105,16 @@ func testDial(t *testing.T, c net.Conn) {
 	assertReadPayload(t, c, dialTestPayload)
 }
 
+// sftpPath converts a local path to the path of an SFTP request, which is
+// separated by slashes, e.g. "/C:/Users/..." on Windows.
+func sftpPath(name string) string {
+	name = filepath.ToSlash(name)
+	if !path.IsAbs(name) {
+		name = path.Join("/", name)
+	}
+	return name
+}
+
 func testAccept(t *testing.T, c net.Conn) {
 	t.Helper()
 	defer c.Close()
@@ -846,12 +4144,33 @@ type client struct {
 	statsChan          chan *codersdk.AgentStats
 	coordinator        tailnet.Coordinator
 	lastWorkspaceAgent func()
+
+	mu               sync.Mutex
+	startupLogs      []codersdk.StartupLog
+	bootTiming       codersdk.WorkspaceAgentBootTiming
+	authorizedKeys   []string
+	connectionEvents []codersdk.AgentConnectionEvent
+	driftReport      *codersdk.WorkspaceAgentDriftReport
+	declaredPorts    []codersdk.WorkspaceAgentDeclaredPort
+	startupScript    *codersdk.WorkspaceAgentStartupScriptResult
+	// metadataChanges notifies the agents that watch metadata.
+	metadataChanges chan struct{}
 }
 
 func (c *client) WorkspaceAgentMetadata(_ context.Context) (codersdk.WorkspaceAgentMetadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.metadata, nil
 }
 
+// setMetadata changes the metadata and notifies the agent.
+func (c *client) setMetadata(change func(metadata *codersdk.WorkspaceAgentMetadata)) {
+	c.mu.Lock()
+	change(&c.metadata)
+	c.mu.Unlock()
+	c.metadataChanges <- struct{}{}
+}
+
 func (c *client) ListenWorkspaceAgent(_ context.Context) (net.Conn, error) {
 	clientConn, serverConn := net.Pipe()
 	closed := make(chan struct{})
@@ -908,3 +4227,206 @@ func (*client) PostWorkspaceAgentAppHealth(_ context.Context, _ codersdk.PostWor
 func (*client) PostWorkspaceAgentVersion(_ context.Context, _ string) error {
 	return nil
 }
+
+func (*client) PostWorkspaceAgentHandshake(_ context.Context, req codersdk.WorkspaceAgentHandshakeRequest) (codersdk.WorkspaceAgentHandshakeResponse, error) {
+	return codersdk.NegotiateWorkspaceAgentHandshake(req, codersdk.WorkspaceAgentProtocolVersion, codersdk.WorkspaceAgentCapabilities), nil
+}
+
+func (c *client) PatchStartupLogs(_ context.Context, req codersdk.PatchStartupLogs) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.startupLogs = append(c.startupLogs, req.Logs...)
+	return nil
+}
+
+func (c *client) getStartupLogs() []codersdk.StartupLog {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]codersdk.StartupLog(nil), c.startupLogs...)
+}
+
+func (c *client) PostWorkspaceAgentBootTiming(_ context.Context, req codersdk.WorkspaceAgentBootTiming) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bootTiming = req
+	return nil
+}
+
+func (c *client) getBootTiming() codersdk.WorkspaceAgentBootTiming {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bootTiming
+}
+
+func (c *client) WorkspaceAgentAuthorizedKeys(_ context.Context) (codersdk.WorkspaceAgentAuthorizedKeys, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return codersdk.WorkspaceAgentAuthorizedKeys{
+		PublicKeys: append([]string(nil), c.authorizedKeys...),
+	}, nil
+}
+
+func (c *client) setAuthorizedKeys(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.authorizedKeys = keys
+}
+
+func (c *client) PostAgentConnectionEvents(_ context.Context, req codersdk.PostAgentConnectionEventsRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connectionEvents = append(c.connectionEvents, req.Events...)
+	return nil
+}
+
+func (c *client) getConnectionEvents() []codersdk.AgentConnectionEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]codersdk.AgentConnectionEvent(nil), c.connectionEvents...)
+}
+
+func (c *client) PostWorkspaceAgentDriftReport(_ context.Context, req codersdk.WorkspaceAgentDriftReport) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.driftReport = &req
+	return nil
+}
+
+func (c *client) getDriftReport() *codersdk.WorkspaceAgentDriftReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.driftReport
+}
+
+func (c *client) PostWorkspaceAgentDeclaredPorts(_ context.Context, req codersdk.PostWorkspaceAgentDeclaredPortsRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.declaredPorts = req.Ports
+	return nil
+}
+
+func (c *client) getDeclaredPorts() []codersdk.WorkspaceAgentDeclaredPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.declaredPorts
+}
+
+func (c *client) PostWorkspaceAgentStartupScriptResult(_ context.Context, req codersdk.WorkspaceAgentStartupScriptResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.startupScript = &req
+	return nil
+}
+
+func (*client) PostAgentCrashReport(_ context.Context, _ codersdk.AgentCrashReport) error {
+	return nil
+}
+
+func (c *client) WatchWorkspaceAgentMetadata(ctx context.Context) (<-chan struct{}, error) {
+	changes := make(chan struct{})
+	go func() {
+		defer close(changes)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.metadataChanges:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case changes <- struct{}{}:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func (c *client) getStartupScriptResult() *codersdk.WorkspaceAgentStartupScriptResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.startupScript
+}
+
+func writeLSP(t *testing.T, w io.Writer, msg string) {
+	t.Helper()
+	_, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	require.NoError(t, err)
+}
+
+func readLSP(t *testing.T, r *bufio.Reader) map[string]json.RawMessage {
+	t.Helper()
+	msg, err := readLSPMessage(r)
+	require.NoError(t, err)
+	return msg
+}
+
+func readLSPMessage(r *bufio.Reader) (map[string]json.RawMessage, error) {
+	length := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-Length: ") {
+			length, err = strconv.Atoi(strings.TrimPrefix(line, "Content-Length: "))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+	var msg map[string]json.RawMessage
+	return msg, json.Unmarshal(data, &msg)
+}
+
+// runFakeLanguageServer speaks just enough of the Language Server Protocol
+// over stdio to test the language servers kept warm by the agent.
+func runFakeLanguageServer() {
+	var initializes, opens, changes int
+	reader := bufio.NewReader(os.Stdin)
+	write := func(msg interface{}) {
+		data, _ := json.Marshal(msg)
+		_, _ = fmt.Fprintf(os.Stdout, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	}
+	for {
+		msg, err := readLSPMessage(reader)
+		if err != nil {
+			return
+		}
+		var method string
+		_ = json.Unmarshal(msg["method"], &method)
+		switch method {
+		case "initialize":
+			initializes++
+			write(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      msg["id"],
+				"result":  map[string]interface{}{"serverInfo": map[string]string{"name": "fake"}},
+			})
+		case "textDocument/didOpen":
+			opens++
+		case "textDocument/didChange":
+			changes++
+		case "test/state":
+			write(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      msg["id"],
+				"result":  map[string]int{"initializes": initializes, "opens": opens, "changes": changes},
+			})
+		case "test/notify":
+			write(map[string]string{
+				"jsonrpc": "2.0",
+				"method":  "test/notified",
+			})
+		}
+	}
+}
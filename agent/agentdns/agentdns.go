@@ -0,0 +1,220 @@
+// Package agentdns resolves the hostnames of requests the agent makes
+// itself, like to Coder, with configured DNS servers instead of the
+// resolver of the workspace. Workspaces with a broken /etc/resolv.conf can
+// then still reach Coder.
+package agentdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"golang.org/x/xerrors"
+)
+
+// dohMaxMessageSize is the maximum size of a DNS message.
+const dohMaxMessageSize = 65535
+
+// NewResolver returns a resolver that queries the servers in order,
+// moving to the next one when a query fails. A server is an IP address
+// with an optional port, like "1.1.1.1" or "[2606:4700::1111]:53", or the
+// URL of a DNS-over-HTTPS server, like "https://1.1.1.1/dns-query". The
+// host of a DNS-over-HTTPS URL is resolved with the other servers, so it
+// should be an IP address unless an IP address server is configured too.
+func NewResolver(servers []string) (*net.Resolver, error) {
+	if len(servers) == 0 {
+		return nil, xerrors.New("no dns servers")
+	}
+	var (
+		addresses []string
+		dohURLs   []string
+	)
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		if strings.HasPrefix(server, "https://") {
+			dohURLs = append(dohURLs, server)
+			continue
+		}
+		address, err := serverAddress(server)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+
+	dialer := &net.Dialer{}
+	if len(addresses) > 0 {
+		dialer.Resolver = addressResolver(addresses)
+	}
+	dohClient := &http.Client{
+		Transport: Transport(dialer.Resolver),
+	}
+	// Queries rotate through the servers, so a failed query is retried
+	// with the next server.
+	var next atomic.Uint64
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			index := int(next.Inc()-1) % (len(addresses) + len(dohURLs))
+			if index < len(addresses) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addresses[index])
+			}
+			return &dohConn{
+				ctx:    ctx,
+				client: dohClient,
+				url:    dohURLs[index-len(addresses)],
+			}, nil
+		},
+	}, nil
+}
+
+// Transport returns an HTTP transport like the default one that resolves
+// hostnames with the resolver. A nil resolver uses the resolver of the
+// system.
+func Transport(resolver *net.Resolver) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  resolver,
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// serverAddress adds the default DNS port to an IP address.
+func serverAddress(server string) (string, error) {
+	if ip := net.ParseIP(strings.Trim(server, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", xerrors.Errorf("dns server %q must be an ip address with an optional port, or an https url", server)
+	}
+	return server, nil
+}
+
+// addressResolver queries the servers over plain DNS.
+func addressResolver(addresses []string) *net.Resolver {
+	var next atomic.Uint64
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addresses[int(next.Inc()-1)%len(addresses)])
+		},
+	}
+}
+
+// dohConn sends DNS messages to a DNS-over-HTTPS server (RFC 8484). It
+// isn't a net.PacketConn, so the Go resolver frames messages like over
+// TCP, with a two byte length prefix.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	mutex    sync.Mutex
+	deadline time.Time
+	request  bytes.Buffer
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.request.Write(b)
+	for c.request.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.request.Bytes()[:2]))
+		if c.request.Len() < 2+size {
+			break
+		}
+		c.request.Next(2)
+		message := make([]byte, size)
+		_, _ = c.request.Read(message)
+		response, err := c.exchange(message)
+		if err != nil {
+			return 0, err
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(response)))
+		c.response.Write(prefix[:])
+		c.response.Write(response)
+	}
+	return len(b), nil
+}
+
+// exchange sends a DNS message and returns the response. The caller must
+// hold the mutex.
+func (c *dohConn) exchange(message []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(message))
+	if err != nil {
+		return nil, xerrors.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	response, err := io.ReadAll(io.LimitReader(res.Body, dohMaxMessageSize+1))
+	if err != nil {
+		return nil, xerrors.Errorf("read response: %w", err)
+	}
+	if len(response) > dohMaxMessageSize {
+		return nil, xerrors.New("response exceeds the maximum dns message size")
+	}
+	return response, nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.response.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.response.Read(b)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (*dohConn) Close() error { return nil }
+
+func (*dohConn) LocalAddr() net.Addr { return dohAddr{} }
+
+func (c *dohConn) RemoteAddr() net.Addr { return dohAddr{url: c.url} }
+
+type dohAddr struct {
+	url string
+}
+
+func (dohAddr) Network() string { return "https" }
+
+func (a dohAddr) String() string { return a.url }
@@ -0,0 +1,120 @@
+package agentdns
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/coder/coder/testutil"
+)
+
+// answer responds to a DNS query with an A record of 127.0.0.1 for
+// coder.test, and with NXDOMAIN for other names.
+func answer(t *testing.T, query []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	require.NoError(t, err)
+	question, err := parser.Question()
+	require.NoError(t, err)
+
+	header.Response = true
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.EnableCompression()
+	require.NoError(t, builder.StartQuestions())
+	require.NoError(t, builder.Question(question))
+	require.NoError(t, builder.StartAnswers())
+	if question.Name.String() == "coder.test." && question.Type == dnsmessage.TypeA {
+		require.NoError(t, builder.AResource(dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}))
+	}
+	response, err := builder.Finish()
+	require.NoError(t, err)
+	return response
+}
+
+func TestNewResolver(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewResolver(nil)
+		require.Error(t, err)
+		_, err = NewResolver([]string{"dns.example.com"})
+		require.ErrorContains(t, err, "must be an ip address")
+	})
+
+	t.Run("Address", func(t *testing.T) {
+		t.Parallel()
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = server.Close()
+		})
+		go func() {
+			buffer := make([]byte, 512)
+			for {
+				n, addr, err := server.ReadFrom(buffer)
+				if err != nil {
+					return
+				}
+				_, _ = server.WriteTo(answer(t, buffer[:n]), addr)
+			}
+		}()
+
+		resolver, err := NewResolver([]string{server.LocalAddr().String()})
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitShort)
+		defer cancel()
+		ips, err := resolver.LookupIP(ctx, "ip4", "coder.test")
+		require.NoError(t, err)
+		require.Len(t, ips, 1)
+		require.Equal(t, "127.0.0.1", ips[0].String())
+	})
+}
+
+func TestDoHConn(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(answer(t, query))
+	}))
+	t.Cleanup(server.Close)
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{
+				ctx:    ctx,
+				client: server.Client(),
+				url:    server.URL + "/dns-query",
+			}, nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitShort)
+	defer cancel()
+	ips, err := resolver.LookupIP(ctx, "ip4", "coder.test")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	require.Equal(t, "127.0.0.1", ips[0].String())
+
+	_, err = resolver.LookupIP(ctx, "ip4", "missing.test")
+	require.Error(t, err)
+}
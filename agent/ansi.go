@@ -0,0 +1,78 @@
+package agent
+
+import "io"
+
+const (
+	ansiText = iota
+	// ansiEscape follows an ESC byte.
+	ansiEscape
+	// ansiCSI is inside a control sequence, e.g. a color: ESC [ 3 1 m
+	ansiCSI
+	// ansiString is inside a string terminated by BEL or ST, e.g. a
+	// window title: ESC ] 0 ; title BEL
+	ansiString
+	// ansiStringEscape follows an ESC byte inside a string.
+	ansiStringEscape
+)
+
+// ansiStripWriter removes ANSI escape sequences from the output written to
+// it, so logs can be rendered and searched as plain text. Sequences may be
+// split across writes.
+type ansiStripWriter struct {
+	writer io.Writer
+	state  int
+	buf    []byte
+}
+
+func newANSIStripWriter(w io.Writer) *ansiStripWriter {
+	return &ansiStripWriter{writer: w}
+}
+
+func (w *ansiStripWriter) Write(p []byte) (int, error) {
+	w.buf = w.buf[:0]
+	for _, b := range p {
+		switch w.state {
+		case ansiText:
+			if b == 0x1b {
+				w.state = ansiEscape
+				continue
+			}
+			w.buf = append(w.buf, b)
+		case ansiEscape:
+			switch b {
+			case '[':
+				w.state = ansiCSI
+			case ']', 'P', 'X', '^', '_':
+				w.state = ansiString
+			default:
+				// Two byte sequences, e.g. ESC 7 to save the cursor.
+				w.state = ansiText
+			}
+		case ansiCSI:
+			// Parameters and intermediate bytes precede the final byte.
+			if b >= 0x40 && b <= 0x7e {
+				w.state = ansiText
+			}
+		case ansiString:
+			switch b {
+			case 0x07:
+				w.state = ansiText
+			case 0x1b:
+				w.state = ansiStringEscape
+			}
+		case ansiStringEscape:
+			if b == '\\' {
+				w.state = ansiText
+			} else {
+				w.state = ansiString
+			}
+		}
+	}
+	if len(w.buf) > 0 {
+		_, err := w.writer.Write(w.buf)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
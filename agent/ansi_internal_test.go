@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestANSIStripWriter(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"Plain", "hello\nworld\n", "hello\nworld\n"},
+		{"Color", "\x1b[1;31merror\x1b[0m: failed", "error: failed"},
+		{"Cursor", "50%\x1b[2K\x1b[1G100%", "50%100%"},
+		{"TitleBEL", "\x1b]0;title\x07done", "done"},
+		{"TitleST", "\x1b]0;title\x1b\\done", "done"},
+		{"TwoByte", "\x1b7saved\x1b8", "saved"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			n, err := newANSIStripWriter(&buf).Write([]byte(tc.input))
+			require.NoError(t, err)
+			require.Equal(t, len(tc.input), n)
+			require.Equal(t, tc.output, buf.String())
+		})
+	}
+
+	t.Run("SplitWrites", func(t *testing.T) {
+		t.Parallel()
+		var buf bytes.Buffer
+		w := newANSIStripWriter(&buf)
+		for _, b := range []byte("\x1b[32mok\x1b]0;t\x1b\\\x1b[0m") {
+			_, err := w.Write([]byte{b})
+			require.NoError(t, err)
+		}
+		require.Equal(t, "ok", buf.String())
+	})
+}
@@ -2,12 +2,17 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"net/http"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/xerrors"
+	"google.golang.org/grpc/credentials"
 
 	"cdr.dev/slog"
 	"github.com/coder/coder/codersdk"
@@ -20,11 +25,23 @@ type WorkspaceAgentApps func(context.Context) ([]codersdk.WorkspaceApp, error)
 // PostWorkspaceAgentAppHealth updates the workspace app health.
 type PostWorkspaceAgentAppHealth func(context.Context, codersdk.PostWorkspaceAppHealthsRequest) error
 
+// AppHealthProbeObserver records the duration and result of a health probe
+// of an app.
+type AppHealthProbeObserver func(appID uuid.UUID, duration time.Duration, err error)
+
+// maxConcurrentHealthProbes limits how many apps are probed at once, so
+// templates with many apps don't open a connection to each at the same
+// time.
+const maxConcurrentHealthProbes = 8
+
 // WorkspaceAppHealthReporter is a function that checks and reports the health of the workspace apps until the passed context is canceled.
 type WorkspaceAppHealthReporter func(ctx context.Context)
 
 // NewWorkspaceAppHealthReporter creates a WorkspaceAppHealthReporter that reports app health to coderd.
-func NewWorkspaceAppHealthReporter(logger slog.Logger, apps []codersdk.WorkspaceApp, postWorkspaceAgentAppHealth PostWorkspaceAgentAppHealth) WorkspaceAppHealthReporter {
+// Health checks run less often while throttled returns true. It may be nil.
+// Apps are probed concurrently, up to maxConcurrentHealthProbes at a time,
+// and each probe is passed to observe if it isn't nil.
+func NewWorkspaceAppHealthReporter(logger slog.Logger, apps []codersdk.WorkspaceApp, postWorkspaceAgentAppHealth PostWorkspaceAgentAppHealth, throttled func() bool, observe AppHealthProbeObserver) WorkspaceAppHealthReporter {
 	runHealthcheckLoop := func(ctx context.Context) error {
 		// no need to run this loop if no apps for this workspace.
 		if len(apps) == 0 {
@@ -47,12 +64,19 @@ func NewWorkspaceAppHealthReporter(logger slog.Logger, apps []codersdk.Workspace
 
 		// run a ticker for each app health check.
 		var mu sync.RWMutex
+		probes := make(chan struct{}, maxConcurrentHealthProbes)
 		failures := make(map[uuid.UUID]int, 0)
+		successes := make(map[uuid.UUID]int, 0)
 		for _, nextApp := range apps {
 			if !shouldStartTicker(nextApp) {
 				continue
 			}
 			app := nextApp
+			probe := newAppHealthProbe(app.Healthcheck)
+			healthyThreshold := int(app.Healthcheck.HealthyThreshold)
+			if healthyThreshold < 1 {
+				healthyThreshold = 1
+			}
 			go func() {
 				t := time.NewTicker(time.Duration(app.Healthcheck.Interval) * time.Second)
 				defer t.Stop()
@@ -63,29 +87,30 @@ func NewWorkspaceAppHealthReporter(logger slog.Logger, apps []codersdk.Workspace
 						return
 					case <-t.C:
 					}
-					// we set the http timeout to the healthcheck interval to prevent getting too backed up.
-					client := &http.Client{
-						Timeout: time.Duration(app.Healthcheck.Interval) * time.Second,
+					if throttled != nil && throttled() {
+						// the workspace is under heavy load, so the last health is kept
+						// and the check is skipped to avoid competing with the user.
+						t.Reset(time.Duration(app.Healthcheck.Interval) * time.Second * throttleFactor)
+						continue
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case probes <- struct{}{}:
+					}
+					start := time.Now()
+					err := probe.probe(ctx)
+					duration := time.Since(start)
+					<-probes
+					if observe != nil {
+						observe(app.ID, duration, err)
+					}
+					if ctx.Err() != nil {
+						return
 					}
-					err := func() error {
-						req, err := http.NewRequestWithContext(ctx, http.MethodGet, app.Healthcheck.URL, nil)
-						if err != nil {
-							return err
-						}
-						res, err := client.Do(req)
-						if err != nil {
-							return err
-						}
-						// successful healthcheck is a non-5XX status code
-						res.Body.Close()
-						if res.StatusCode >= http.StatusInternalServerError {
-							return xerrors.Errorf("error status code: %d", res.StatusCode)
-						}
-
-						return nil
-					}()
 					if err != nil {
 						mu.Lock()
+						successes[app.ID] = 0
 						if failures[app.ID] < int(app.Healthcheck.Threshold) {
 							// increment the failure count and keep status the same.
 							// we will change it when we hit the threshold.
@@ -98,9 +123,16 @@ func NewWorkspaceAppHealthReporter(logger slog.Logger, apps []codersdk.Workspace
 						mu.Unlock()
 					} else {
 						mu.Lock()
-						// we only need one successful health check to be considered healthy.
-						health[app.ID] = codersdk.WorkspaceAppHealthHealthy
+						// apps are healthy after the healthy threshold of
+						// consecutive successful health checks, which is one
+						// by default.
 						failures[app.ID] = 0
+						if successes[app.ID] < healthyThreshold {
+							successes[app.ID]++
+						}
+						if successes[app.ID] >= healthyThreshold {
+							health[app.ID] = codersdk.WorkspaceAppHealthHealthy
+						}
 						mu.Unlock()
 					}
 
@@ -152,6 +184,117 @@ func NewWorkspaceAppHealthReporter(logger slog.Logger, apps []codersdk.Workspace
 	}
 }
 
+// appHealthProbe checks the health of an app with its healthcheck.
+type appHealthProbe struct {
+	healthcheck codersdk.Healthcheck
+	client      *http.Client
+	bodyRegex   *regexp.Regexp
+	// grpcTarget and grpcCredentials connect to apps with gRPC health
+	// checks.
+	grpcTarget      string
+	grpcCredentials credentials.TransportCredentials
+	// err is returned by every probe of an invalid healthcheck, so the
+	// app is unhealthy.
+	err error
+}
+
+func newAppHealthProbe(healthcheck codersdk.Healthcheck) *appHealthProbe {
+	probe := &appHealthProbe{
+		healthcheck: healthcheck,
+		client:      http.DefaultClient,
+	}
+	if healthcheck.InsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		//nolint:gosec // Apps in workspaces often have self-signed certificates.
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		probe.client = &http.Client{Transport: transport}
+	}
+	switch healthcheck.Type {
+	case "", codersdk.HealthcheckTypeHTTP:
+	case codersdk.HealthcheckTypeGRPC:
+		target, creds, err := grpcHealthTarget(healthcheck)
+		if err != nil {
+			probe.err = xerrors.Errorf("grpc health check: %w", err)
+		}
+		probe.grpcTarget = target
+		probe.grpcCredentials = creds
+	default:
+		probe.err = xerrors.Errorf("unsupported health check type %q", healthcheck.Type)
+	}
+	if healthcheck.BodyRegex != "" {
+		bodyRegex, err := regexp.Compile(healthcheck.BodyRegex)
+		if err != nil {
+			probe.err = xerrors.Errorf("compile body regex: %w", err)
+		}
+		probe.bodyRegex = bodyRegex
+	}
+	return probe
+}
+
+// probe checks the health of the app. It times out after the healthcheck
+// interval, so probes of an app don't back up.
+func (p *appHealthProbe) probe(ctx context.Context) error {
+	if p.err != nil {
+		return p.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.healthcheck.Interval)*time.Second)
+	defer cancel()
+	if p.healthcheck.Type == codersdk.HealthcheckTypeGRPC {
+		return p.probeGRPC(ctx)
+	}
+	method := p.healthcheck.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if p.healthcheck.Body != "" {
+		body = strings.NewReader(p.healthcheck.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.healthcheck.URL, body)
+	if err != nil {
+		return err
+	}
+	for name, value := range p.healthcheck.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if !p.healthyStatus(res.StatusCode) {
+		return xerrors.Errorf("error status code: %d", res.StatusCode)
+	}
+	if p.bodyRegex != nil {
+		content, err := io.ReadAll(io.LimitReader(res.Body, codersdk.HealthcheckMaxBodySize))
+		if err != nil {
+			return xerrors.Errorf("read body: %w", err)
+		}
+		if !p.bodyRegex.Match(content) {
+			return xerrors.Errorf("body doesn't match %q", p.healthcheck.BodyRegex)
+		}
+	}
+	return nil
+}
+
+func (p *appHealthProbe) healthyStatus(status int) bool {
+	// Without expected statuses, a successful healthcheck is a non-5XX
+	// status code.
+	if len(p.healthcheck.ExpectedStatuses) == 0 {
+		return status < http.StatusInternalServerError
+	}
+	for _, expected := range p.healthcheck.ExpectedStatuses {
+		if expected.Contains(status) {
+			return true
+		}
+	}
+	return false
+}
+
 func shouldStartTicker(app codersdk.WorkspaceApp) bool {
 	return app.Healthcheck.URL != "" && app.Healthcheck.Interval > 0 && app.Healthcheck.Threshold > 0
 }
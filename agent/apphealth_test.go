@@ -2,6 +2,9 @@ package agent_test
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -9,7 +12,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"cdr.dev/slog"
 	"cdr.dev/slog/sloggers/slogtest"
@@ -48,7 +56,7 @@ func TestAppHealth(t *testing.T) {
 				httpapi.Write(r.Context(), w, http.StatusOK, nil)
 			}),
 		}
-		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers)
+		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers, nil, nil)
 		defer closeFn()
 		apps, err := getApps(ctx)
 		require.NoError(t, err)
@@ -84,7 +92,7 @@ func TestAppHealth(t *testing.T) {
 				httpapi.Write(r.Context(), w, http.StatusInternalServerError, nil)
 			}),
 		}
-		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers)
+		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers, nil, nil)
 		defer closeFn()
 		require.Eventually(t, func() bool {
 			apps, err := getApps(ctx)
@@ -119,7 +127,7 @@ func TestAppHealth(t *testing.T) {
 				httpapi.Write(r.Context(), w, http.StatusOK, nil)
 			}),
 		}
-		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers)
+		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers, nil, nil)
 		defer closeFn()
 		require.Eventually(t, func() bool {
 			apps, err := getApps(ctx)
@@ -131,6 +139,163 @@ func TestAppHealth(t *testing.T) {
 		}, testutil.WaitLong, testutil.IntervalSlow)
 	})
 
+	t.Run("CustomRequest", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		apps := []codersdk.WorkspaceApp{
+			{
+				Slug: "graphql",
+				Healthcheck: codersdk.Healthcheck{
+					Interval:  1,
+					Threshold: 1,
+					Method:    http.MethodPost,
+					Headers: map[string]string{
+						"Content-Type": "application/json",
+					},
+					Body: `{"query":"{ health }"}`,
+					ExpectedStatuses: []codersdk.HealthcheckStatusRange{
+						{Min: 202, Max: 202},
+					},
+					BodyRegex: `"health":\s*"ok"`,
+				},
+				Health: codersdk.WorkspaceAppHealthInitializing,
+			},
+		}
+		handlers := []http.Handler{
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || string(body) != `{"query":"{ health }"}` {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusAccepted)
+				_, _ = w.Write([]byte(`{"data":{"health": "ok"}}`))
+			}),
+		}
+		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers, nil, nil)
+		defer closeFn()
+		require.Eventually(t, func() bool {
+			apps, err := getApps(ctx)
+			if err != nil {
+				return false
+			}
+
+			return apps[0].Health == codersdk.WorkspaceAppHealthHealthy
+		}, testutil.WaitLong, testutil.IntervalSlow)
+	})
+
+	t.Run("BodyMismatch", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		apps := []codersdk.WorkspaceApp{
+			{
+				Slug: "graphql",
+				Healthcheck: codersdk.Healthcheck{
+					Interval:  1,
+					Threshold: 1,
+					BodyRegex: `"health":\s*"ok"`,
+				},
+				Health: codersdk.WorkspaceAppHealthInitializing,
+			},
+		}
+		handlers := []http.Handler{
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// GraphQL servers respond with errors and a 200.
+				_, _ = w.Write([]byte(`{"errors":[{"message":"database is down"}]}`))
+			}),
+		}
+		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers, nil, nil)
+		defer closeFn()
+		require.Eventually(t, func() bool {
+			apps, err := getApps(ctx)
+			if err != nil {
+				return false
+			}
+
+			return apps[0].Health == codersdk.WorkspaceAppHealthUnhealthy
+		}, testutil.WaitLong, testutil.IntervalSlow)
+	})
+
+	t.Run("InsecureSkipVerify", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			httpapi.Write(r.Context(), w, http.StatusOK, nil)
+		}))
+		defer srv.Close()
+		apps := []codersdk.WorkspaceApp{
+			{
+				Slug: "self-signed",
+				Healthcheck: codersdk.Healthcheck{
+					URL:                srv.URL,
+					Interval:           1,
+					Threshold:          1,
+					InsecureSkipVerify: true,
+				},
+				Health: codersdk.WorkspaceAppHealthInitializing,
+			},
+		}
+		getApps, closeFn := setupAppReporter(ctx, t, apps, []http.Handler{nil}, nil, nil)
+		defer closeFn()
+		require.Eventually(t, func() bool {
+			apps, err := getApps(ctx)
+			if err != nil {
+				return false
+			}
+
+			return apps[0].Health == codersdk.WorkspaceAppHealthHealthy
+		}, testutil.WaitLong, testutil.IntervalSlow)
+	})
+
+	t.Run("GRPC", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		healthServer := health.NewServer()
+		healthServer.SetServingStatus("dev.Service", healthpb.HealthCheckResponse_SERVING)
+		srv := grpc.NewServer()
+		healthpb.RegisterHealthServer(srv, healthServer)
+		go func() {
+			_ = srv.Serve(listener)
+		}()
+		defer srv.Stop()
+		apps := []codersdk.WorkspaceApp{
+			{
+				Slug: "grpc",
+				Healthcheck: codersdk.Healthcheck{
+					Type:        codersdk.HealthcheckTypeGRPC,
+					URL:         "grpc://" + listener.Addr().String(),
+					Interval:    1,
+					Threshold:   1,
+					GRPCService: "dev.Service",
+				},
+				Health: codersdk.WorkspaceAppHealthInitializing,
+			},
+		}
+		getApps, closeFn := setupAppReporter(ctx, t, apps, []http.Handler{nil}, nil, nil)
+		defer closeFn()
+		appHealth := func() codersdk.WorkspaceAppHealth {
+			apps, err := getApps(ctx)
+			if err != nil {
+				return ""
+			}
+			return apps[0].Health
+		}
+		require.Eventually(t, func() bool {
+			return appHealth() == codersdk.WorkspaceAppHealthHealthy
+		}, testutil.WaitLong, testutil.IntervalSlow)
+
+		healthServer.SetServingStatus("dev.Service", healthpb.HealthCheckResponse_NOT_SERVING)
+		require.Eventually(t, func() bool {
+			return appHealth() == codersdk.WorkspaceAppHealthUnhealthy
+		}, testutil.WaitLong, testutil.IntervalSlow)
+	})
+
 	t.Run("NotSpamming", func(t *testing.T) {
 		t.Parallel()
 		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
@@ -154,16 +319,115 @@ func TestAppHealth(t *testing.T) {
 				atomic.AddInt32(counter, 1)
 			}),
 		}
-		_, closeFn := setupAppReporter(ctx, t, apps, handlers)
+		_, closeFn := setupAppReporter(ctx, t, apps, handlers, nil, nil)
 		defer closeFn()
 		// Ensure we haven't made more than 2 (expected 1 + 1 for buffer) requests in the last second.
 		// if there is a bug where we are spamming the healthcheck route this will catch it.
 		time.Sleep(time.Second)
 		require.LessOrEqual(t, *counter, int32(2))
 	})
+
+	t.Run("BoundedConcurrency", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		const count = 20
+		var (
+			inFlight    int32
+			maxInFlight int32
+			apps        []codersdk.WorkspaceApp
+			handlers    []http.Handler
+		)
+		for i := 0; i < count; i++ {
+			apps = append(apps, codersdk.WorkspaceApp{
+				ID:   uuid.New(),
+				Slug: fmt.Sprintf("app%d", i),
+				Healthcheck: codersdk.Healthcheck{
+					Interval:  1,
+					Threshold: 1,
+				},
+				Health: codersdk.WorkspaceAppHealthInitializing,
+			})
+			handlers = append(handlers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				current := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for {
+					seen := atomic.LoadInt32(&maxInFlight)
+					if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+						break
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+				httpapi.Write(r.Context(), w, http.StatusOK, nil)
+			}))
+		}
+		var (
+			mu        sync.Mutex
+			durations = map[uuid.UUID]time.Duration{}
+		)
+		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers, nil, func(appID uuid.UUID, duration time.Duration, err error) {
+			assert.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			durations[appID] = duration
+		})
+		defer closeFn()
+		require.Eventually(t, func() bool {
+			apps, err := getApps(ctx)
+			if err != nil {
+				return false
+			}
+			for _, app := range apps {
+				if app.Health != codersdk.WorkspaceAppHealthHealthy {
+					return false
+				}
+			}
+			return true
+		}, testutil.WaitLong, testutil.IntervalSlow)
+		// Apps are probed concurrently, but not all at once.
+		require.Greater(t, atomic.LoadInt32(&maxInFlight), int32(1))
+		require.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(8))
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, durations, count)
+		for _, duration := range durations {
+			require.GreaterOrEqual(t, duration, 100*time.Millisecond)
+		}
+	})
+
+	t.Run("Throttled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		apps := []codersdk.WorkspaceApp{
+			{
+				Slug: "app1",
+				Healthcheck: codersdk.Healthcheck{
+					Interval:  1,
+					Threshold: 1,
+				},
+				Health: codersdk.WorkspaceAppHealthInitializing,
+			},
+		}
+		var counter = new(int32)
+		handlers := []http.Handler{
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(counter, 1)
+			}),
+		}
+		getApps, closeFn := setupAppReporter(ctx, t, apps, handlers, func() bool { return true }, nil)
+		defer closeFn()
+		// The first check is skipped and the next is delayed, so the app
+		// isn't checked while the workspace is under pressure.
+		time.Sleep(2 * time.Second)
+		require.Zero(t, atomic.LoadInt32(counter))
+		apps, err := getApps(ctx)
+		require.NoError(t, err)
+		require.Equal(t, codersdk.WorkspaceAppHealthInitializing, apps[0].Health)
+	})
 }
 
-func setupAppReporter(ctx context.Context, t *testing.T, apps []codersdk.WorkspaceApp, handlers []http.Handler) (agent.WorkspaceAgentApps, func()) {
+func setupAppReporter(ctx context.Context, t *testing.T, apps []codersdk.WorkspaceApp, handlers []http.Handler, throttled func() bool, observe agent.AppHealthProbeObserver) (agent.WorkspaceAgentApps, func()) {
 	closers := []func(){}
 	for i, handler := range handlers {
 		if handler == nil {
@@ -199,7 +463,7 @@ func setupAppReporter(ctx context.Context, t *testing.T, apps []codersdk.Workspa
 		return nil
 	}
 
-	go agent.NewWorkspaceAppHealthReporter(slogtest.Make(t, nil).Leveled(slog.LevelDebug), apps, postWorkspaceAgentAppHealth)(ctx)
+	go agent.NewWorkspaceAppHealthReporter(slogtest.Make(t, nil).Leveled(slog.LevelDebug), apps, postWorkspaceAgentAppHealth, throttled, observe)(ctx)
 
 	return workspaceAgentApps, func() {
 		for _, closeFn := range closers {
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/coder/coder/codersdk"
+)
+
+// grpcHealthTarget returns the address and the credentials of the gRPC
+// health checks of an app, whose URL is grpc://<host>:<port>, or grpcs://
+// for TLS.
+func grpcHealthTarget(healthcheck codersdk.Healthcheck) (string, credentials.TransportCredentials, error) {
+	parsed, err := url.Parse(healthcheck.URL)
+	if err != nil {
+		return "", nil, xerrors.Errorf("parse url: %w", err)
+	}
+	if parsed.Host == "" {
+		return "", nil, xerrors.Errorf("url %q has no host", healthcheck.URL)
+	}
+	switch parsed.Scheme {
+	case "grpc":
+		return parsed.Host, insecure.NewCredentials(), nil
+	case "grpcs":
+		return parsed.Host, credentials.NewTLS(&tls.Config{
+			//nolint:gosec // Apps in workspaces often have self-signed certificates.
+			InsecureSkipVerify: healthcheck.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		}), nil
+	default:
+		return "", nil, xerrors.Errorf("unsupported scheme %q, use grpc or grpcs", parsed.Scheme)
+	}
+}
+
+// probeGRPC calls the standard health check of gRPC servers, which is
+// healthy while the service is SERVING.
+func (p *appHealthProbe) probeGRPC(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, p.grpcTarget, grpc.WithTransportCredentials(p.grpcCredentials))
+	if err != nil {
+		return xerrors.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: p.healthcheck.GRPCService,
+	})
+	if err != nil {
+		return xerrors.Errorf("check: %w", err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return xerrors.Errorf("status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// appHealthProbes records the duration and result of the health probes of
+// each app, so slow or failing probes can be found.
+type appHealthProbes struct {
+	mutex  sync.Mutex
+	probes map[uuid.UUID]*codersdk.WorkspaceAgentAppHealthProbe
+}
+
+func (p *appHealthProbes) observe(appID uuid.UUID, duration time.Duration, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.probes == nil {
+		p.probes = map[uuid.UUID]*codersdk.WorkspaceAgentAppHealthProbe{}
+	}
+	probe, ok := p.probes[appID]
+	if !ok {
+		probe = &codersdk.WorkspaceAgentAppHealthProbe{AppID: appID}
+		p.probes[appID] = probe
+	}
+	ms := float64(duration) / float64(time.Millisecond)
+	probe.Probes++
+	probe.LastDurationMS = ms
+	if ms > probe.MaxDurationMS {
+		probe.MaxDurationMS = ms
+	}
+	probe.LastProbedAt = time.Now()
+	probe.LastError = ""
+	if err != nil {
+		probe.Failures++
+		probe.LastError = err.Error()
+	}
+}
+
+// get returns the record of the probes of an app.
+func (p *appHealthProbes) get(appID uuid.UUID) (codersdk.WorkspaceAgentAppHealthProbe, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	probe, ok := p.probes[appID]
+	if !ok {
+		return codersdk.WorkspaceAgentAppHealthProbe{}, false
+	}
+	return *probe, true
+}
+
+// list returns the records of the probes, ordered by app ID.
+func (p *appHealthProbes) list() []codersdk.WorkspaceAgentAppHealthProbe {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	probes := make([]codersdk.WorkspaceAgentAppHealthProbe, 0, len(p.probes))
+	for _, probe := range p.probes {
+		probes = append(probes, *probe)
+	}
+	sort.Slice(probes, func(i, j int) bool {
+		return probes[i].AppID.String() < probes[j].AppID.String()
+	})
+	return probes
+}
+
+func (p *appHealthProbes) handler(rw http.ResponseWriter, r *http.Request) {
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.WorkspaceAgentAppHealthProbesResponse{
+		Probes: p.list(),
+	})
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// appProxy limits the connections that are forwarded to the ports of apps,
+// so fragile dev servers aren't overwhelmed, like by dashboards that poll
+// them. It counts the connections of every app for the stats of the agent.
+type appProxy struct {
+	logger slog.Logger
+
+	mutex sync.Mutex
+	apps  map[string]*codersdk.AgentAppStats
+}
+
+func newAppProxy(logger slog.Logger) *appProxy {
+	return &appProxy{
+		logger: logger,
+		apps:   map[string]*codersdk.AgentAppStats{},
+	}
+}
+
+// forward returns the connection that's forwarded to the port of an app,
+// or nil if the app has its maximum connections open. Refused connections
+// are closed in the background, after HTTP apps are sent a 503.
+func (p *appProxy) forward(conn net.Conn, metadata codersdk.WorkspaceAgentMetadata) net.Conn {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return conn
+	}
+	var (
+		app    codersdk.WorkspaceApp
+		scheme string
+		found  bool
+	)
+	for _, candidate := range metadata.Apps {
+		port, candidateScheme, ok := appLocalPort(candidate.URL)
+		if ok && int(port) == addr.Port {
+			app, scheme, found = candidate, candidateScheme, true
+			break
+		}
+	}
+	if !found {
+		return conn
+	}
+	limit := metadata.AppConnectionLimits[app.Slug]
+
+	p.mutex.Lock()
+	stats, ok := p.apps[app.Slug]
+	if !ok {
+		stats = &codersdk.AgentAppStats{}
+		p.apps[app.Slug] = stats
+	}
+	if limit.MaxConnections > 0 && stats.OpenConnections >= int64(limit.MaxConnections) {
+		stats.RejectedConnections++
+		p.mutex.Unlock()
+		p.logger.Debug(context.Background(), "refused connection to app with its maximum connections open",
+			slog.F("app", app.Slug), slog.F("max_connections", limit.MaxConnections))
+		go p.refuse(conn, scheme)
+		return nil
+	}
+	stats.OpenConnections++
+	stats.Connections++
+	p.mutex.Unlock()
+
+	proxied := &appProxyConn{
+		Conn: conn,
+		closed: func(idle bool) {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			stats.OpenConnections--
+			if idle {
+				stats.IdleTimeouts++
+			}
+		},
+	}
+	if limit.IdleTimeoutSeconds > 0 {
+		proxied.closeWhenIdle(time.Duration(limit.IdleTimeoutSeconds) * time.Second)
+	}
+	return proxied
+}
+
+// refuse closes a connection to an app that has its maximum connections
+// open. Clients of HTTP apps are told to retry, rather than getting a
+// connection error.
+func (*appProxy) refuse(conn net.Conn, scheme string) {
+	defer conn.Close()
+	if scheme != "http" {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(appStartingTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	_ = req.Body.Close()
+	body := "The app has too many open connections. Try again shortly.\n"
+	resp := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+			"Retry-After":  []string{"1"},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+	_ = resp.Write(conn)
+}
+
+// stats returns the connections of every app since the agent started.
+func (p *appProxy) stats() map[string]codersdk.AgentAppStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.apps) == 0 {
+		return nil
+	}
+	apps := make(map[string]codersdk.AgentAppStats, len(p.apps))
+	for slug, stats := range p.apps {
+		apps[slug] = *stats
+	}
+	return apps
+}
+
+// appProxyConn is a connection to an app, which is closed when it's idle
+// for longer than the idle timeout of the app.
+type appProxyConn struct {
+	net.Conn
+	// lastActive is when data was last read or written, in nanoseconds
+	// since the epoch.
+	lastActive atomic.Int64
+	idle       atomic.Bool
+	closeOnce  sync.Once
+	closed     func(idle bool)
+
+	timerMutex sync.Mutex
+	timer      *time.Timer
+}
+
+func (c *appProxyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *appProxyConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *appProxyConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.timerMutex.Lock()
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.timerMutex.Unlock()
+		c.closed(c.idle.Load())
+	})
+	return err
+}
+
+func (c *appProxyConn) closeWhenIdle(timeout time.Duration) {
+	c.lastActive.Store(time.Now().UnixNano())
+	c.timerMutex.Lock()
+	defer c.timerMutex.Unlock()
+	c.timer = time.AfterFunc(timeout, func() {
+		idle := time.Since(time.Unix(0, c.lastActive.Load()))
+		if idle < timeout {
+			c.timerMutex.Lock()
+			c.timer.Reset(timeout - idle)
+			c.timerMutex.Unlock()
+			return
+		}
+		c.idle.Store(true)
+		_ = c.Close()
+	})
+}
@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// appStartingRefresh is how often the page served for apps that aren't
+	// listening yet reloads.
+	appStartingRefresh = 5 * time.Second
+	// appStartingTimeout limits how long reading the request and writing
+	// the page can take.
+	appStartingTimeout = 10 * time.Second
+)
+
+var appStartingTemplate = template.Must(template.New("app-starting").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.RefreshSeconds}}">
+<title>{{.Title}} is starting</title>
+<style>
+body { font-family: sans-serif; background: #17172e; color: #fff; display: flex; justify-content: center; padding-top: 15vh; }
+main { max-width: 560px; }
+p { color: #b3b3c6; line-height: 1.5; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}} is starting</h1>
+<p>Nothing is listening on port {{.Port}} in the workspace yet. This page reloads every {{.RefreshSeconds}} seconds.</p>
+{{range .Apps}}<p><strong>{{.Name}}</strong>: {{.Health}}</p>
+{{end}}</main>
+</body>
+</html>
+`))
+
+type appStartingPage struct {
+	Title          string
+	Port           uint16
+	RefreshSeconds int
+	Apps           []appStartingApp
+}
+
+type appStartingApp struct {
+	Name   string
+	Health string
+}
+
+// appPort returns the port of an app that is served over HTTP on the
+// loopback address of the workspace, which connections to the port of the
+// agent are forwarded to.
+func appPort(rawURL string) (uint16, bool) {
+	port, scheme, ok := appLocalPort(rawURL)
+	if !ok || scheme != "http" {
+		return 0, false
+	}
+	return port, true
+}
+
+// appLocalPort returns the port and the scheme of an app that is served
+// over HTTP or HTTPS on the loopback address of the workspace.
+func appLocalPort(rawURL string) (uint16, string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, "", false
+	}
+	defaultPort := uint64(80)
+	switch u.Scheme {
+	case "http":
+	case "https":
+		defaultPort = 443
+	default:
+		return 0, "", false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1", "0.0.0.0":
+	default:
+		return 0, "", false
+	}
+	port := defaultPort
+	if u.Port() != "" {
+		port, err = strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil || port == 0 {
+			return 0, "", false
+		}
+	}
+	return uint16(port), u.Scheme, true
+}
+
+// handleUnboundPort serves a page that the app is starting, with the
+// status of its health checks, for connections to the port of an HTTP app
+// that nothing is listening on yet. Users would get a raw connection error
+// otherwise. It returns false for ports that aren't of apps.
+func (a *agent) handleUnboundPort(conn net.Conn, port uint16) bool {
+	metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if !ok {
+		return false
+	}
+	var apps []codersdk.WorkspaceApp
+	for _, app := range metadata.Apps {
+		p, ok := appPort(app.URL)
+		if ok && p == port {
+			apps = append(apps, app)
+		}
+	}
+	if len(apps) == 0 {
+		return false
+	}
+
+	ctx := context.Background()
+	_ = conn.SetDeadline(time.Now().Add(appStartingTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		a.logger.Debug(ctx, "read request to app that is starting", slog.F("port", port), slog.Error(err))
+		return true
+	}
+	_ = req.Body.Close()
+
+	page := appStartingPage{
+		Title:          appName(apps[0]),
+		Port:           port,
+		RefreshSeconds: int(appStartingRefresh.Seconds()),
+	}
+	for _, app := range apps {
+		page.Apps = append(page.Apps, appStartingApp{
+			Name:   appName(app),
+			Health: a.appHealthStatus(app),
+		})
+	}
+	var body bytes.Buffer
+	err = appStartingTemplate.Execute(&body, page)
+	if err != nil {
+		a.logger.Error(ctx, "render app starting page", slog.Error(err))
+		return true
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  []string{"text/html; charset=utf-8"},
+			"Cache-Control": []string{"no-store"},
+			"Retry-After":   []string{strconv.Itoa(page.RefreshSeconds)},
+		},
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+		Request:       req,
+	}
+	err = resp.Write(conn)
+	if err != nil {
+		a.logger.Debug(ctx, "write app starting page", slog.F("port", port), slog.Error(err))
+	}
+	return true
+}
+
+func appName(app codersdk.WorkspaceApp) string {
+	if app.DisplayName != "" {
+		return app.DisplayName
+	}
+	return app.Slug
+}
+
+// appHealthStatus describes the last health check of an app.
+func (a *agent) appHealthStatus(app codersdk.WorkspaceApp) string {
+	if app.Healthcheck.URL == "" {
+		return "Health checks are disabled."
+	}
+	probe, ok := a.appHealthProbes.get(app.ID)
+	if !ok {
+		return "Waiting for the first health check."
+	}
+	ago := time.Since(probe.LastProbedAt).Round(time.Second)
+	if probe.LastError != "" {
+		return fmt.Sprintf("The last health check failed %s ago: %s", ago, probe.LastError)
+	}
+	return fmt.Sprintf("The last health check passed %s ago.", ago)
+}
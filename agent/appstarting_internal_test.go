@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppPort(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		url  string
+		port uint16
+		ok   bool
+	}{
+		{url: "http://localhost:8080", port: 8080, ok: true},
+		{url: "http://127.0.0.1:3000/?folder=/home/coder", port: 3000, ok: true},
+		{url: "http://[::1]:8000", port: 8000, ok: true},
+		{url: "http://localhost", port: 80, ok: true},
+		// The page can't be served to clients that expect TLS.
+		{url: "https://localhost:8443"},
+		// Connections are only forwarded to the loopback address.
+		{url: "http://example.com:8080"},
+		{url: ""},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.url, func(t *testing.T) {
+			t.Parallel()
+			port, ok := appPort(c.url)
+			require.Equal(t, c.ok, ok)
+			require.Equal(t, c.port, port)
+		})
+	}
+}
+
+func TestAppLocalPort(t *testing.T) {
+	t.Parallel()
+
+	port, scheme, ok := appLocalPort("https://localhost")
+	require.True(t, ok)
+	require.Equal(t, uint16(443), port)
+	require.Equal(t, "https", scheme)
+
+	port, scheme, ok = appLocalPort("http://127.0.0.1:3000")
+	require.True(t, ok)
+	require.Equal(t, uint16(3000), port)
+	require.Equal(t, "http", scheme)
+
+	_, _, ok = appLocalPort("tcp://localhost:5432")
+	require.False(t, ok)
+}
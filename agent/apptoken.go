@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// appToken is a token that coderd sends to apps with proxied requests.
+type appToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// appTokenFile lists the valid app tokens. Its path is exported to
+// processes as CODER_APP_TOKEN_FILE, since tokens rotate more often than
+// apps are restarted.
+func (a *agent) appTokenFile() string {
+	return filepath.Join(a.tempDir, "coder-app-tokens")
+}
+
+// addAppToken adds a token from coderd and rewrites the token file without
+// expired tokens. The previous token stays valid until it expires, so
+// requests that were proxied before a rotation aren't rejected.
+func (a *agent) addAppToken(token string, expiresAt time.Time) error {
+	a.appTokensMutex.Lock()
+	defer a.appTokensMutex.Unlock()
+	now := time.Now()
+	tokens := []appToken{{token: token, expiresAt: expiresAt}}
+	for _, existing := range a.appTokens {
+		if existing.token == token || !existing.expiresAt.After(now) {
+			continue
+		}
+		tokens = append(tokens, existing)
+	}
+	a.appTokens = tokens
+	err := writeAppTokens(a.filesystem, a.appTokenFile(), tokens)
+	if err != nil {
+		return explainWriteError(err, "CODER_AGENT_TEMP_DIR")
+	}
+	return nil
+}
+
+// writeAppTokens writes a token and its expiry as a Unix timestamp on each
+// line, e.g. "4c7c1a... 1672531200". The file is replaced atomically, so
+// apps never read a partial file.
+func writeAppTokens(filesystem afero.Fs, path string, tokens []appToken) error {
+	var content strings.Builder
+	for _, token := range tokens {
+		_, _ = fmt.Fprintf(&content, "%s %d\n", token.token, token.expiresAt.Unix())
+	}
+	tmp := path + ".tmp"
+	err := afero.WriteFile(filesystem, tmp, []byte(content.String()), 0o600)
+	if err != nil {
+		return xerrors.Errorf("write tokens: %w", err)
+	}
+	err = filesystem.Rename(tmp, path)
+	if err != nil {
+		_ = filesystem.Remove(tmp)
+		return xerrors.Errorf("rename tokens: %w", err)
+	}
+	return nil
+}
+
+func (a *agent) appTokenHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req codersdk.AppTokenRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if req.Token == "" || strings.ContainsAny(req.Token, " \n") {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "A token without whitespace is required.",
+		})
+		return
+	}
+	if !req.ExpiresAt.After(time.Now()) {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "The token has already expired.",
+		})
+		return
+	}
+	err := a.addAppToken(req.Token, req.ExpiresAt)
+	if err != nil {
+		a.logger.Warn(ctx, "add app token", slog.Error(err))
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Failed to store the app token.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Stored the app token.",
+	})
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/cryptorand"
+)
+
+const (
+	defaultReconnectMinInterval = 100 * time.Millisecond
+	defaultReconnectMaxInterval = 10 * time.Second
+)
+
+// reconnectBackoff spaces out attempts to connect to coderd. It backs off
+// exponentially with full jitter, so a fleet of agents that lose coderd at
+// the same time don't reconnect at the same time when it's back.
+type reconnectBackoff struct {
+	floor time.Duration
+	// ceil returns the maximum interval, which can change when metadata
+	// is fetched.
+	ceil func() time.Duration
+
+	mutex           sync.Mutex
+	attempt         int
+	connected       bool
+	lastError       string
+	lastConnectedAt *time.Time
+	nextAttemptAt   *time.Time
+}
+
+// delay returns a random interval up to the exponential backoff of the
+// attempt, which never exceeds the ceiling.
+func (b *reconnectBackoff) delay(attempt int) time.Duration {
+	ceil := b.ceil()
+	backoff := b.floor
+	for i := 0; i < attempt && backoff < ceil; i++ {
+		backoff *= 2
+	}
+	if backoff > ceil {
+		backoff = ceil
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	jitter, err := cryptorand.Int63n(int64(backoff))
+	if err != nil {
+		return backoff
+	}
+	return time.Duration(jitter)
+}
+
+// Wait sleeps before the next attempt, and returns false if the context
+// is canceled first.
+func (b *reconnectBackoff) Wait(ctx context.Context) bool {
+	b.mutex.Lock()
+	delay := b.delay(b.attempt)
+	b.attempt++
+	nextAttemptAt := time.Now().Add(delay)
+	b.nextAttemptAt = &nextAttemptAt
+	b.mutex.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Connected resets the backoff once the agent is connected to coderd.
+func (b *reconnectBackoff) Connected() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.attempt = 0
+	b.connected = true
+	b.lastError = ""
+	b.lastConnectedAt = &now
+	b.nextAttemptAt = nil
+}
+
+// Disconnected records why the agent lost its connection to coderd.
+func (b *reconnectBackoff) Disconnected(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.connected = false
+	if err != nil {
+		b.lastError = err.Error()
+	}
+}
+
+// State returns the current state of the backoff.
+func (b *reconnectBackoff) State() codersdk.WorkspaceAgentReconnectState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return codersdk.WorkspaceAgentReconnectState{
+		Connected:          b.connected,
+		Attempt:            b.attempt,
+		LastError:          b.lastError,
+		LastConnectedAt:    b.lastConnectedAt,
+		NextAttemptAt:      b.nextAttemptAt,
+		MaxIntervalSeconds: b.ceil().Seconds(),
+	}
+}
+
+// reconnectMaxInterval returns the maximum interval between attempts to
+// connect to coderd. The interval of the metadata overrides the interval
+// of the agent.
+func (a *agent) reconnectMaxInterval() time.Duration {
+	metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if ok && metadata.ReconnectMaxIntervalSeconds > 0 {
+		return time.Duration(metadata.ReconnectMaxIntervalSeconds) * time.Second
+	}
+	return a.maxReconnectInterval
+}
+
+func (a *agent) reconnectHandler(rw http.ResponseWriter, r *http.Request) {
+	httpapi.Write(r.Context(), rw, http.StatusOK, a.reconnect.State())
+}
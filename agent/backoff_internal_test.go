@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Jitter", func(t *testing.T) {
+		t.Parallel()
+		backoff := &reconnectBackoff{
+			floor: time.Second,
+			ceil: func() time.Duration {
+				return 10 * time.Second
+			},
+		}
+		for attempt, limit := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+			for i := 0; i < 20; i++ {
+				delay := backoff.delay(attempt)
+				require.GreaterOrEqual(t, delay, time.Duration(0))
+				require.Less(t, delay, limit)
+			}
+		}
+	})
+
+	t.Run("CeilingBelowFloor", func(t *testing.T) {
+		t.Parallel()
+		backoff := &reconnectBackoff{
+			floor: time.Second,
+			ceil: func() time.Duration {
+				return time.Millisecond
+			},
+		}
+		require.Less(t, backoff.delay(0), time.Millisecond)
+	})
+
+	t.Run("State", func(t *testing.T) {
+		t.Parallel()
+		backoff := &reconnectBackoff{
+			floor: time.Millisecond,
+			ceil: func() time.Duration {
+				return time.Minute
+			},
+		}
+		ctx := context.Background()
+		require.True(t, backoff.Wait(ctx))
+		require.True(t, backoff.Wait(ctx))
+		backoff.Disconnected(errors.New("connection refused"))
+		state := backoff.State()
+		require.False(t, state.Connected)
+		require.Equal(t, 2, state.Attempt)
+		require.Equal(t, "connection refused", state.LastError)
+		require.NotNil(t, state.NextAttemptAt)
+		require.Equal(t, time.Minute.Seconds(), state.MaxIntervalSeconds)
+
+		// Connecting resets the backoff.
+		backoff.Connected()
+		state = backoff.State()
+		require.True(t, state.Connected)
+		require.Zero(t, state.Attempt)
+		require.Empty(t, state.LastError)
+		require.NotNil(t, state.LastConnectedAt)
+		require.Nil(t, state.NextAttemptAt)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		t.Parallel()
+		backoff := &reconnectBackoff{
+			floor: time.Hour,
+			ceil: func() time.Duration {
+				return time.Hour
+			},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.False(t, backoff.Wait(ctx))
+	})
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// bootPhase is a phase of starting the agent that is timed.
+type bootPhase int
+
+const (
+	bootPhaseTokenExchange bootPhase = iota
+	bootPhaseMetadataFetch
+	bootPhaseTailnetUp
+	bootPhaseCoordinatorConnected
+	bootPhaseStartupScript
+	bootPhaseFirstSession
+)
+
+// bootTimingRetryInterval is how long the agent waits to report the boot
+// timing again after reporting failed.
+const bootTimingRetryInterval = 5 * time.Second
+
+// bootTimer measures how long the phases of starting the agent take, and
+// reports them to coderd as they complete.
+type bootTimer struct {
+	// startedAt is when the agent started, which the first session is
+	// measured from.
+	startedAt time.Time
+
+	mutex  sync.Mutex
+	timing codersdk.WorkspaceAgentBootTiming
+	// version is incremented on every change to the timing, and sent is
+	// the version that was last reported.
+	version int
+	sent    int
+	changed chan struct{}
+}
+
+func newBootTimer(startedAt time.Time) *bootTimer {
+	return &bootTimer{
+		startedAt: startedAt,
+		timing: codersdk.WorkspaceAgentBootTiming{
+			StartedAt: startedAt,
+		},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// record sets how long a phase took, unless it completed before.
+func (b *bootTimer) record(phase bootPhase, duration time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var field **int64
+	switch phase {
+	case bootPhaseTokenExchange:
+		field = &b.timing.TokenExchangeMillis
+	case bootPhaseMetadataFetch:
+		field = &b.timing.MetadataFetchMillis
+	case bootPhaseTailnetUp:
+		field = &b.timing.TailnetUpMillis
+	case bootPhaseCoordinatorConnected:
+		field = &b.timing.CoordinatorConnectedMillis
+	case bootPhaseStartupScript:
+		field = &b.timing.StartupScriptMillis
+	case bootPhaseFirstSession:
+		field = &b.timing.FirstSessionMillis
+	default:
+		return
+	}
+	if *field != nil {
+		return
+	}
+	millis := duration.Milliseconds()
+	*field = &millis
+	b.version++
+	select {
+	case b.changed <- struct{}{}:
+	default:
+	}
+}
+
+// recordSince sets how long a phase that started at started took.
+func (b *bootTimer) recordSince(phase bootPhase, started time.Time) {
+	b.record(phase, time.Since(started))
+}
+
+// pending returns the timing and its version if it changed since it was
+// last reported.
+func (b *bootTimer) pending() (codersdk.WorkspaceAgentBootTiming, int, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// Values are never changed once set, so the pointers are shared.
+	return b.timing, b.version, b.version != b.sent
+}
+
+// report sends the timing to coderd whenever it changes, until the
+// context is canceled. Failures are retried, since the timing of phases
+// that complete before a disconnect would be lost otherwise.
+func (b *bootTimer) report(ctx context.Context, logger slog.Logger, post func(ctx context.Context, timing codersdk.WorkspaceAgentBootTiming) error) {
+	var retry <-chan time.Time
+	for {
+		timing, version, pending := b.pending()
+		if pending {
+			err := post(ctx, timing)
+			if err == nil {
+				b.mutex.Lock()
+				b.sent = version
+				b.mutex.Unlock()
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Debug(ctx, "report boot timing", slog.Error(err))
+			retry = time.After(bootTimingRetryInterval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.changed:
+		case <-retry:
+		}
+		retry = nil
+	}
+}
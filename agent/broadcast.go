@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/pty"
+)
+
+// maxBroadcastMessageLength is the maximum length of a message
+// broadcast to active sessions.
+const maxBroadcastMessageLength = 4096
+
+// trackPTY registers the PTY of an active session so that
+// broadcast messages are written to it.
+func (a *agent) trackPTY(id string, ptty pty.PTY) {
+	a.activePTYsMutex.Lock()
+	defer a.activePTYsMutex.Unlock()
+	a.activePTYs[id] = ptty
+}
+
+func (a *agent) untrackPTY(id string) {
+	a.activePTYsMutex.Lock()
+	defer a.activePTYsMutex.Unlock()
+	delete(a.activePTYs, id)
+}
+
+// broadcast writes the message to the terminal of every active PTY
+// session, like wall(1). It returns the number of sessions written to.
+func (a *agent) broadcast(ctx context.Context, message string) int {
+	formatted := formatBroadcastMessage(message, time.Now())
+
+	a.activePTYsMutex.Lock()
+	defer a.activePTYsMutex.Unlock()
+	written := 0
+	for id, ptty := range a.activePTYs {
+		// Writing to the output of the PTY is equivalent to
+		// writing to the TTY device, which is what wall does.
+		_, err := ptty.Output().Write([]byte(formatted))
+		if err != nil {
+			a.logger.Debug(ctx, "write broadcast message", slog.F("id", id), slog.Error(err))
+			continue
+		}
+		written++
+	}
+	return written
+}
+
+// formatBroadcastMessage formats the message similarly to wall(1).
+// Control characters are removed so the message can't alter the
+// state of the terminal.
+func formatBroadcastMessage(message string, now time.Time) string {
+	message = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, message)
+	message = strings.ReplaceAll(strings.TrimRight(message, "\n"), "\n", "\r\n")
+	return fmt.Sprintf("\r\n\aBroadcast message from Coder (%s):\r\n\r\n%s\r\n\r\n", now.Format(time.ANSIC), message)
+}
+
+func (a *agent) broadcastHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req codersdk.BroadcastMessageRequest
+	err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 2*maxBroadcastMessageLength)).Decode(&req)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Request body must be valid JSON.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if req.Message == "" || len(req.Message) > maxBroadcastMessageLength {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: fmt.Sprintf("Message must be between 1 and %d bytes.", maxBroadcastMessageLength),
+		})
+		return
+	}
+
+	sessions := a.broadcast(ctx, req.Message)
+	a.logger.Info(ctx, "broadcast message to sessions", slog.F("sessions", sessions))
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.BroadcastMessageResponse{
+		Sessions: sessions,
+	})
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// connectionEventsFlushInterval is how often connection events are sent
+	// to coderd.
+	connectionEventsFlushInterval = time.Second
+	// connectionEventsMaxQueued bounds the events that are kept while they
+	// can't be sent, like while coderd is unreachable. The oldest events
+	// are dropped first.
+	connectionEventsMaxQueued = 10000
+)
+
+// connectionEvents records clients connecting to and disconnecting from the
+// agent, and sends them to coderd in batches so connections to the
+// workspace can be audited.
+type connectionEvents struct {
+	mutex sync.Mutex
+	queue []codersdk.AgentConnectionEvent
+	// dropped is the number of events that were dropped from the queue
+	// since it was last reported.
+	dropped int
+	// failing is set while sending fails, so failures are logged once.
+	failing bool
+}
+
+func newConnectionEvents() *connectionEvents {
+	return &connectionEvents{}
+}
+
+// connected records that a client connected, and returns a function that
+// records it disconnecting, which can be called more than once.
+func (c *connectionEvents) connected(connectionType codersdk.AgentConnectionType, sessionID string, peer net.Addr, user, command, destination string) func() {
+	event := codersdk.AgentConnectionEvent{
+		ConnectionID: uuid.New(),
+		SessionID:    sessionID,
+		Type:         connectionType,
+		User:         user,
+		Command:      command,
+		Destination:  destination,
+	}
+	if peer != nil {
+		event.Peer = peer.String()
+	}
+	c.record(event, codersdk.AgentConnectionActionConnect)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.record(event, codersdk.AgentConnectionActionDisconnect)
+		})
+	}
+}
+
+func (c *connectionEvents) record(event codersdk.AgentConnectionEvent, action codersdk.AgentConnectionAction) {
+	event.ID = uuid.New()
+	event.Action = action
+	event.Time = time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.queue) >= connectionEventsMaxQueued {
+		c.queue = c.queue[1:]
+		c.dropped++
+	}
+	c.queue = append(c.queue, event)
+}
+
+// forwardedConn records the connection forwarded from the tailnet to a
+// local port, until it's closed.
+func (c *connectionEvents) forwardedConn(conn net.Conn) net.Conn {
+	destination := ""
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		destination = net.JoinHostPort("localhost", strconv.Itoa(addr.Port))
+	}
+	return &recordedConn{
+		Conn:         conn,
+		disconnected: c.connected(codersdk.AgentConnectionTypePortForward, "", conn.RemoteAddr(), "", "", destination),
+	}
+}
+
+// recordedConn records a disconnect event when it's closed.
+type recordedConn struct {
+	net.Conn
+	disconnected func()
+}
+
+func (c *recordedConn) Close() error {
+	err := c.Conn.Close()
+	c.disconnected()
+	return err
+}
+
+// report sends the queued events to coderd until the context is canceled.
+// Events that fail to send are retried, so they're sent again after the
+// agent reconnects.
+func (c *connectionEvents) report(ctx context.Context, logger slog.Logger, post func(ctx context.Context, req codersdk.PostAgentConnectionEventsRequest) error) {
+	ticker := time.NewTicker(connectionEventsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.send(ctx, logger, post)
+	}
+}
+
+// send sends the queued events in batches.
+func (c *connectionEvents) send(ctx context.Context, logger slog.Logger, post func(ctx context.Context, req codersdk.PostAgentConnectionEventsRequest) error) {
+	for {
+		c.mutex.Lock()
+		if c.dropped > 0 {
+			logger.Warn(ctx, "dropped connection events that couldn't be sent", slog.F("count", c.dropped))
+			c.dropped = 0
+		}
+		batch := c.queue
+		if len(batch) > codersdk.MaxAgentConnectionEventsBatchSize {
+			batch = batch[:codersdk.MaxAgentConnectionEventsBatchSize]
+		}
+		batch = append([]codersdk.AgentConnectionEvent(nil), batch...)
+		c.mutex.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		err := post(ctx, codersdk.PostAgentConnectionEventsRequest{Events: batch})
+		if err != nil {
+			if ctx.Err() == nil && !c.failing {
+				logger.Warn(ctx, "send connection events, retrying", slog.Error(err))
+			}
+			c.failing = true
+			return
+		}
+		c.failing = false
+		c.mutex.Lock()
+		// Events may have been dropped from the front of the queue while
+		// the batch was sent, so only the events of the batch that are
+		// still queued are removed.
+		sent := 0
+		if len(c.queue) > 0 {
+			for i, event := range batch {
+				if event.ID == c.queue[0].ID {
+					sent = len(batch) - i
+					break
+				}
+			}
+		}
+		c.queue = c.queue[sent:]
+		c.mutex.Unlock()
+	}
+}
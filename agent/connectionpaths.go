@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// connectionPathSampleInterval is how often the paths of connections to
+// peers are sampled.
+const connectionPathSampleInterval = 5 * time.Second
+
+// connectionPaths accumulates how long active peers were connected to the
+// agent directly and through DERP, so the share of relayed connections can
+// be tracked over time.
+type connectionPaths struct {
+	mutex       sync.Mutex
+	lastSample  time.Time
+	direct      time.Duration
+	derp        time.Duration
+	derpRegions map[string]time.Duration
+}
+
+func newConnectionPaths(now time.Time) *connectionPaths {
+	return &connectionPaths{
+		lastSample:  now,
+		derpRegions: map[string]time.Duration{},
+	}
+}
+
+// sample attributes the time since the previous sample to the path each
+// active peer uses now.
+func (p *connectionPaths) sample(status *ipnstate.Status, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	elapsed := now.Sub(p.lastSample)
+	p.lastSample = now
+	if elapsed <= 0 || status == nil {
+		return
+	}
+	// Samples that are much later than expected, like after the workspace
+	// was suspended, would attribute time to paths that weren't used.
+	if elapsed > 2*connectionPathSampleInterval {
+		elapsed = connectionPathSampleInterval
+	}
+	for _, peer := range status.Peer {
+		if !peer.Active {
+			continue
+		}
+		switch {
+		case peer.CurAddr != "":
+			p.direct += elapsed
+		case peer.Relay != "":
+			p.derp += elapsed
+			p.derpRegions[peer.Relay] += elapsed
+		}
+	}
+}
+
+// report returns the seconds accumulated since the previous report, and
+// resets them.
+func (p *connectionPaths) report() (direct, derp int64, derpRegions map[string]int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	direct = int64(p.direct / time.Second)
+	derp = int64(p.derp / time.Second)
+	// Fractions of seconds are kept for the next report.
+	p.direct -= time.Duration(direct) * time.Second
+	p.derp -= time.Duration(derp) * time.Second
+	for region, duration := range p.derpRegions {
+		seconds := int64(duration / time.Second)
+		if seconds == 0 {
+			continue
+		}
+		if derpRegions == nil {
+			derpRegions = map[string]int64{}
+		}
+		derpRegions[region] = seconds
+		p.derpRegions[region] -= time.Duration(seconds) * time.Second
+	}
+	return direct, derp, derpRegions
+}
+
+// sampleConnectionPaths samples the paths of connections until the context
+// is canceled.
+func (a *agent) sampleConnectionPaths(ctx context.Context) {
+	ticker := time.NewTicker(connectionPathSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var status *ipnstate.Status
+		a.closeMutex.Lock()
+		if a.network != nil {
+			status = a.network.Status()
+		}
+		a.closeMutex.Unlock()
+		a.connectionPaths.sample(status, time.Now())
+	}
+}
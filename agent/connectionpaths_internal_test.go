@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestConnectionPaths(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	paths := newConnectionPaths(now)
+	status := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {Active: true, CurAddr: "192.0.2.1:41641"},
+			key.NewNode().Public(): {Active: true, Relay: "nyc"},
+			key.NewNode().Public(): {Active: true, Relay: "fra"},
+			// Inactive peers aren't counted.
+			key.NewNode().Public(): {Relay: "nyc"},
+		},
+	}
+	now = now.Add(connectionPathSampleInterval)
+	paths.sample(status, now)
+	now = now.Add(connectionPathSampleInterval)
+	paths.sample(status, now)
+
+	direct, derp, regions := paths.report()
+	require.EqualValues(t, 10, direct)
+	require.EqualValues(t, 20, derp)
+	require.Equal(t, map[string]int64{"nyc": 10, "fra": 10}, regions)
+
+	// Seconds are reset after they're reported, and late samples only
+	// count for an interval.
+	now = now.Add(time.Hour)
+	paths.sample(status, now)
+	direct, derp, regions = paths.report()
+	require.EqualValues(t, 5, direct)
+	require.EqualValues(t, 10, derp)
+	require.Equal(t, map[string]int64{"nyc": 5, "fra": 5}, regions)
+
+	direct, derp, regions = paths.report()
+	require.Zero(t, direct)
+	require.Zero(t, derp)
+	require.Nil(t, regions)
+}
@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/buildinfo"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// maxControlLogTail is how much of the end of a log is read for the last
+// lines of it.
+const maxControlLogTail = 1 << 20
+
+// serveControlSocket serves the control API on a Unix socket, so users in
+// the workspace can inspect the agent with `coder agent` subcommands
+// without access to coderd. The socket is only accessible by the user of
+// the agent.
+func (a *agent) serveControlSocket(ctx context.Context) {
+	if a.controlSocketPath == "" {
+		return
+	}
+	// A socket left behind by a previous agent would fail listening.
+	err := os.Remove(a.controlSocketPath)
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		a.logger.Warn(ctx, "remove stale control socket", slog.F("path", a.controlSocketPath), slog.Error(err))
+	}
+	listener, err := net.Listen("unix", a.controlSocketPath)
+	if err != nil {
+		a.logger.Warn(ctx, "listen on control socket", slog.F("path", a.controlSocketPath), slog.Error(err))
+		return
+	}
+	err = os.Chmod(a.controlSocketPath, 0o600)
+	if err != nil {
+		_ = listener.Close()
+		a.logger.Warn(ctx, "restrict control socket", slog.F("path", a.controlSocketPath), slog.Error(err))
+		return
+	}
+	server := &http.Server{
+		Handler:           a.controlHandler(),
+		ReadHeaderTimeout: 20 * time.Second,
+		ErrorLog:          slog.Stdlib(ctx, a.logger.Named("control_http_server"), slog.LevelInfo),
+	}
+
+	a.closeMutex.Lock()
+	if a.isClosed() {
+		a.closeMutex.Unlock()
+		_ = listener.Close()
+		return
+	}
+	a.connCloseWait.Add(1)
+	a.closeMutex.Unlock()
+	go func() {
+		defer a.connCloseWait.Done()
+		<-ctx.Done()
+		_ = server.Close()
+		_ = os.Remove(a.controlSocketPath)
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !xerrors.Is(err, http.ErrServerClosed) {
+			a.logger.Warn(ctx, "serve control socket", slog.Error(err))
+		}
+	}()
+	a.logger.Info(ctx, "serving control socket", slog.F("path", a.controlSocketPath))
+}
+
+func (a *agent) controlHandler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/api/v0/status", a.controlStatusHandler)
+	r.Get("/api/v0/sessions", a.sessionsHandler)
+	r.Post("/api/v0/services/{name}/restart", a.restartServiceHandler)
+	r.Get("/api/v0/logs/{name}", a.logsHandler)
+	r.Get("/api/v0/events", a.eventsHandler)
+	return r
+}
+
+func (a *agent) controlStatusHandler(rw http.ResponseWriter, r *http.Request) {
+	a.startupMutex.Lock()
+	startup := a.startup
+	a.startupMutex.Unlock()
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.AgentControlStatus{
+		Version:   buildinfo.Version(),
+		StartedAt: a.bootTimer.startedAt,
+		Draining:  a.draining.Load(),
+		Reconnect: a.reconnect.State(),
+		Startup:   startup,
+		Sessions:  len(a.listSessions()),
+		Services:  a.services(),
+		Health:    a.health(),
+	})
+}
+
+// services returns the services of the agent, sorted by name.
+func (a *agent) services() []codersdk.AgentControlService {
+	a.languageServersMutex.Lock()
+	defer a.languageServersMutex.Unlock()
+	services := make([]codersdk.AgentControlService, 0, len(a.languageServers))
+	for name, server := range a.languageServers {
+		services = append(services, codersdk.AgentControlService{
+			Name:    name,
+			Type:    codersdk.AgentControlServiceTypeLanguageServer,
+			Running: server.running(),
+			LogFile: server.logFile,
+		})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+func (a *agent) restartServiceHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := chi.URLParam(r, "name")
+	a.languageServersMutex.Lock()
+	server, ok := a.languageServers[name]
+	a.languageServersMutex.Unlock()
+	if !ok {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "Service not found.",
+			Detail:  "Run `coder agent status` to list the services.",
+		})
+		return
+	}
+	if !server.restart() {
+		httpapi.Write(ctx, rw, http.StatusConflict, codersdk.Response{
+			Message: "The service isn't running.",
+			Detail:  "It's started again automatically.",
+		})
+		return
+	}
+	a.logger.Info(ctx, "restarting service", slog.F("name", name))
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Restarting the service.",
+	})
+}
+
+// logFile returns the path of the log of the agent, the startup script or
+// a service.
+func (a *agent) logFile(name string) (string, bool) {
+	switch name {
+	case "agent":
+		return a.agentLogFile, a.agentLogFile != ""
+	case "startup-script":
+		return filepath.Join(a.tempDir, "coder-startup-script.log"), true
+	}
+	a.languageServersMutex.Lock()
+	defer a.languageServersMutex.Unlock()
+	server, ok := a.languageServers[name]
+	if !ok {
+		return "", false
+	}
+	return server.logFile, true
+}
+
+func (a *agent) logsHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := chi.URLParam(r, "name")
+	path, ok := a.logFile(name)
+	if !ok {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "Log not found.",
+			Detail:  "Logs are available for the agent, the startup-script and services.",
+		})
+		return
+	}
+	var lines int
+	if raw := r.URL.Query().Get("lines"); raw != "" {
+		var err error
+		lines, err = strconv.Atoi(raw)
+		if err != nil || lines < 0 {
+			httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Invalid lines.",
+				Validations: []codersdk.ValidationError{{
+					Field:  "lines",
+					Detail: "must be a positive number",
+				}},
+			})
+			return
+		}
+	}
+	file, err := a.filesystem.Open(path)
+	if xerrors.Is(err, os.ErrNotExist) {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "The log doesn't exist yet.",
+			Detail:  path,
+		})
+		return
+	}
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error opening log.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	defer file.Close()
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if lines == 0 {
+		_, _ = io.Copy(rw, file)
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error reading log.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if info.Size() > maxControlLogTail {
+		_, err = file.Seek(info.Size()-maxControlLogTail, io.SeekStart)
+		if err != nil {
+			httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+				Message: "Internal error reading log.",
+				Detail:  err.Error(),
+			})
+			return
+		}
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error reading log.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	_, _ = rw.Write(lastLines(content, lines))
+}
+
+// lastLines returns the last n lines of content.
+func lastLines(content []byte, n int) []byte {
+	end := len(content)
+	// A trailing newline ends the last line rather than starting another.
+	if end > 0 && content[end-1] == '\n' {
+		end--
+	}
+	start := end
+	for ; n > 0; n-- {
+		index := bytes.LastIndexByte(content[:start], '\n')
+		if index < 0 {
+			return content
+		}
+		start = index
+	}
+	return content[start+1:]
+}
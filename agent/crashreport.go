@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/buildinfo"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// crashReportLogLines is how many recent log lines are sent with a
+	// crash report.
+	crashReportLogLines = 100
+	// maxCrashReportStack limits the size of the stack of a crash report.
+	maxCrashReportStack = 64 << 10
+	// maxPendingCrashReports limits the crash reports that are kept while
+	// they can't be sent. Later reports are dropped, since the first panic
+	// usually explains the others.
+	maxPendingCrashReports = 10
+	// crashReportTimeout limits how long sending crash reports takes.
+	crashReportTimeout = 10 * time.Second
+)
+
+// logRing keeps the last lines the agent logged, which are sent with
+// crash reports.
+type logRing struct {
+	mutex sync.Mutex
+	lines []string
+	next  int
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		lines: make([]string, 0, size),
+	}
+}
+
+// Write stores an entry of the log, which sinks write at once.
+func (r *logRing) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.lines) < cap(r.lines) {
+		r.lines = append(r.lines, line)
+		return len(p), nil
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	return len(p), nil
+}
+
+// recent returns the stored lines, oldest first.
+func (r *logRing) recent() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	lines := make([]string, 0, len(r.lines))
+	lines = append(lines, r.lines[r.next:]...)
+	return append(lines, r.lines[:r.next]...)
+}
+
+// runRestart restarts the current run of the agent when a goroutine of it
+// panicked, which starts the goroutine again.
+type runRestart struct {
+	cancel    context.CancelFunc
+	component atomic.Pointer[string]
+}
+
+func (r *runRestart) restart(component string) {
+	r.component.CompareAndSwap(nil, &component)
+	r.cancel()
+}
+
+// runRecovered runs the agent once. Panics of the run and its goroutines
+// are reported to coderd, and returned as errors so the loop restarts it.
+func (a *agent) runRecovered(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	restart := &runRestart{cancel: cancel}
+	a.currentRun.Store(restart)
+	defer func() {
+		if r := recover(); r != nil {
+			a.reportPanic(ctx, "run", r)
+			err = xerrors.Errorf("run panicked: %v", r)
+			return
+		}
+		// A goroutine that panicked canceled the run, which is restarted
+		// rather than stopped like when the agent is closed.
+		if component := restart.component.Load(); component != nil {
+			err = xerrors.Errorf("restarting after %s panicked", *component)
+		}
+	}()
+	return a.run(ctx)
+}
+
+// goRun runs fn in a goroutine of the current run. If it panics, the run
+// is restarted.
+func (a *agent) goRun(ctx context.Context, component string, fn func()) {
+	run := a.currentRun.Load()
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				a.reportPanic(ctx, component, r)
+				if run != nil {
+					run.restart(component)
+				}
+			}
+		}()
+		fn()
+	}()
+}
+
+// recoverPanic recovers a panic of a goroutine that isn't restarted, like
+// one of a connection, and reports it. It must be deferred directly, since
+// recover only stops a panic there.
+func (a *agent) recoverPanic(ctx context.Context, component string) {
+	if r := recover(); r != nil {
+		a.reportPanic(ctx, component, r)
+	}
+}
+
+// reportPanic logs a panic of a component with its stack, and sends it to
+// coderd with the recent logs. It's called while recovering, so the stack
+// is the one of the panic.
+func (a *agent) reportPanic(ctx context.Context, component string, value any) {
+	stack := debug.Stack()
+	if len(stack) > maxCrashReportStack {
+		stack = stack[:maxCrashReportStack]
+	}
+	report := codersdk.AgentCrashReport{
+		Component: component,
+		Panic:     fmt.Sprint(value),
+		Stack:     string(stack),
+		// The logs are read before the panic is logged.
+		RecentLogs: a.recentLogs.recent(),
+		Version:    buildinfo.Version(),
+		OccurredAt: time.Now(),
+	}
+	a.timeline.record(codersdk.AgentEventPanic, "%s panicked: %s", component, report.Panic)
+	a.logger.Error(ctx, "recovered from panic",
+		slog.F("component", component),
+		slog.F("panic", report.Panic),
+		slog.F("stack", report.Stack))
+
+	a.crashReportsMutex.Lock()
+	if len(a.pendingCrashReports) < maxPendingCrashReports {
+		a.pendingCrashReports = append(a.pendingCrashReports, report)
+	}
+	a.crashReportsMutex.Unlock()
+	// The context of the component is likely done after the panic.
+	sendCtx, cancel := context.WithTimeout(context.Background(), crashReportTimeout)
+	defer cancel()
+	a.sendCrashReports(sendCtx)
+}
+
+// sendCrashReports sends the crash reports that weren't sent yet, if
+// coderd accepts them. Reports that fail are sent again by the next run.
+func (a *agent) sendCrashReports(ctx context.Context) {
+	handshake := a.handshake.Load()
+	if handshake == nil || !handshake.Has(codersdk.WorkspaceAgentCapabilityCrashReport) {
+		return
+	}
+	a.sendCrashReportsMutex.Lock()
+	defer a.sendCrashReportsMutex.Unlock()
+	for {
+		a.crashReportsMutex.Lock()
+		if len(a.pendingCrashReports) == 0 {
+			a.crashReportsMutex.Unlock()
+			return
+		}
+		// Reports are only appended, so the first stays the same.
+		report := a.pendingCrashReports[0]
+		a.crashReportsMutex.Unlock()
+		err := a.client.PostAgentCrashReport(ctx, report)
+		if err != nil {
+			a.logger.Warn(ctx, "send crash report", slog.F("component", report.Component), slog.Error(err))
+			return
+		}
+		a.crashReportsMutex.Lock()
+		a.pendingCrashReports = a.pendingCrashReports[1:]
+		a.crashReportsMutex.Unlock()
+	}
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog"
+	"cdr.dev/slog/sloggers/sloghuman"
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/testutil"
+)
+
+// crashClient records the crash reports the agent sends.
+type crashClient struct {
+	Client
+	mutex   sync.Mutex
+	reports []codersdk.AgentCrashReport
+}
+
+func (c *crashClient) PostAgentCrashReport(_ context.Context, report codersdk.AgentCrashReport) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reports = append(c.reports, report)
+	return nil
+}
+
+func TestLogRing(t *testing.T) {
+	t.Parallel()
+
+	ring := newLogRing(2)
+	require.Empty(t, ring.recent())
+	_, _ = ring.Write([]byte("one\n"))
+	require.Equal(t, []string{"one"}, ring.recent())
+	_, _ = ring.Write([]byte("two\n"))
+	_, _ = ring.Write([]byte("three\n"))
+	require.Equal(t, []string{"two", "three"}, ring.recent())
+}
+
+func TestCrashReport(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitShort)
+	defer cancel()
+	client := &crashClient{}
+	recentLogs := newLogRing(crashReportLogLines)
+	a := &agent{
+		logger:     slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}).AppendSinks(sloghuman.Sink(recentLogs)).Leveled(slog.LevelDebug),
+		recentLogs: recentLogs,
+		client:     client,
+		timeline:   newEventTimeline(afero.NewMemMapFs(), "/events.jsonl", slogtest.Make(t, nil)),
+	}
+	a.logger.Info(ctx, "before the panic")
+
+	// Panics are kept until coderd accepts crash reports.
+	func() {
+		defer a.recoverPanic(ctx, "test")
+		panic("oops")
+	}()
+	require.Len(t, a.pendingCrashReports, 1)
+	require.Empty(t, client.reports)
+	events := a.timeline.list(0)
+	require.Len(t, events, 1)
+	require.Equal(t, codersdk.AgentEventPanic, events[0].Type)
+	require.Equal(t, "test panicked: oops", events[0].Message)
+
+	a.handshake.Store(&codersdk.WorkspaceAgentHandshakeResponse{
+		Capabilities: []codersdk.WorkspaceAgentCapability{codersdk.WorkspaceAgentCapabilityCrashReport},
+	})
+	a.sendCrashReports(ctx)
+	require.Empty(t, a.pendingCrashReports)
+	require.Len(t, client.reports, 1)
+	report := client.reports[0]
+	require.Equal(t, "test", report.Component)
+	require.Equal(t, "oops", report.Panic)
+	require.Contains(t, report.Stack, "TestCrashReport")
+	require.Len(t, report.RecentLogs, 1)
+	require.Contains(t, report.RecentLogs[0], "before the panic")
+
+	// A goroutine of a run that panics restarts the run.
+	runCtx, runCancel := context.WithCancel(ctx)
+	defer runCancel()
+	restart := &runRestart{cancel: runCancel}
+	a.currentRun.Store(restart)
+	a.goRun(runCtx, "reporter", func() {
+		panic("reporter failed")
+	})
+	<-runCtx.Done()
+	require.Equal(t, "reporter", *restart.component.Load())
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	require.Len(t, client.reports, 2)
+	require.Equal(t, "reporter", client.reports[1].Component)
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// declaredPortsPollInterval is how often the declared ports file is checked
+// for changes.
+const declaredPortsPollInterval = 2 * time.Second
+
+// declaredPortsFile is where processes in the workspace, like the startup
+// script, declare ports as a JSON array of objects with a port and a name.
+// Its path is exported to processes as CODER_PORTS_FILE.
+func (a *agent) declaredPortsFile() string {
+	return filepath.Join(a.tempDir, "coder-ports.json")
+}
+
+// reportDeclaredPorts sends the ports of the declared ports file to coderd
+// when it changes, until the context is canceled. They're sent when the
+// agent connects too, so ports declared by a previous agent are removed.
+func (a *agent) reportDeclaredPorts(ctx context.Context) {
+	logger := a.logger.Named("declared-ports")
+	ticker := time.NewTicker(declaredPortsPollInterval)
+	defer ticker.Stop()
+	// handled is the content of the file that was last sent or rejected,
+	// or nil until the ports are sent on this connection.
+	var handled []byte
+	for {
+		content, err := a.readDeclaredPortsFile()
+		switch {
+		case err != nil:
+			logger.Warn(ctx, "read declared ports file", slog.Error(err))
+		case handled != nil && bytes.Equal(content, handled):
+		default:
+			var ports []codersdk.WorkspaceAgentDeclaredPort
+			if len(bytes.TrimSpace(content)) > 0 {
+				err = json.Unmarshal(content, &ports)
+			}
+			if err != nil {
+				// Invalid files are ignored until they change, so the
+				// previous ports stay declared.
+				logger.Warn(ctx, "parse declared ports file", slog.F("path", a.declaredPortsFile()), slog.Error(err))
+				handled = content
+				break
+			}
+			err = a.client.PostWorkspaceAgentDeclaredPorts(ctx, codersdk.PostWorkspaceAgentDeclaredPortsRequest{
+				Ports: ports,
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logger.Warn(ctx, "send declared ports", slog.Error(err))
+				break
+			}
+			handled = content
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readDeclaredPortsFile returns the content of the declared ports file, which
+// is empty if the file doesn't exist.
+func (a *agent) readDeclaredPortsFile() ([]byte, error) {
+	content, err := afero.ReadFile(a.filesystem, a.declaredPortsFile())
+	if xerrors.Is(err, os.ErrNotExist) {
+		return []byte{}, nil
+	}
+	return content, err
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/tailnet"
+)
+
+// resolveDERPMap returns the DERP map of the metadata, with the IPv6
+// addresses of its nodes.
+func (a *agent) resolveDERPMap(ctx context.Context, metadata codersdk.WorkspaceAgentMetadata) (*tailcfg.DERPMap, error) {
+	derpMap, err := a.derpMap(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	// netcheck only resolves the hostnames of DERP nodes to IPv4
+	// addresses, so STUN fails in IPv6-only networks without these.
+	resolveCtx, cancelResolve := context.WithTimeout(ctx, 5*time.Second)
+	derpMap = tailnet.ResolveDERPNodesIPv6(resolveCtx, a.resolver, derpMap)
+	cancelResolve()
+	a.logger.Debug(ctx, "running tailnet with derpmap", slog.F("derpmap", derpMap))
+	return derpMap, nil
+}
+
+// derpMap returns the DERP map the agent should use. If an embedded DERP
+// server is configured by the metadata or the options of the agent it's
+// started, and its region is added to the map from coderd.
+func (a *agent) derpMap(ctx context.Context, metadata codersdk.WorkspaceAgentMetadata) (*tailcfg.DERPMap, error) {
+	options := metadata.EmbeddedDERP
+	if options == nil {
+		options = a.embeddedDERP
+	}
+	if options == nil {
+		return metadata.DERPMap, nil
+	}
+	port, err := a.startEmbeddedDERP(ctx, options.ListenAddress)
+	if err != nil {
+		return nil, xerrors.Errorf("start embedded derp: %w", err)
+	}
+
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{},
+	}
+	if metadata.DERPMap != nil {
+		derpMap.OmitDefaultRegions = metadata.DERPMap.OmitDefaultRegions
+		for id, region := range metadata.DERPMap.Regions {
+			derpMap.Regions[id] = region
+		}
+	}
+	// The embedded region always takes precedence, since it's
+	// the only region known to be reachable in air-gapped labs.
+	derpMap.Regions[options.RegionID] = &tailcfg.DERPRegion{
+		RegionID:   options.RegionID,
+		RegionCode: options.RegionCode,
+		RegionName: options.RegionName,
+		Nodes: []*tailcfg.DERPNode{{
+			Name:     fmt.Sprintf("%da", options.RegionID),
+			RegionID: options.RegionID,
+			HostName: options.HostName,
+			DERPPort: port,
+			// STUN is not served by the embedded DERP.
+			STUNPort: -1,
+			// There are no certificates for the agent to serve TLS with.
+			ForceHTTP: true,
+		}},
+	}
+	return derpMap, nil
+}
+
+// startEmbeddedDERP starts the embedded DERP server once and returns the
+// port it's listening on.
+func (a *agent) startEmbeddedDERP(ctx context.Context, address string) (int, error) {
+	a.closeMutex.Lock()
+	defer a.closeMutex.Unlock()
+	if a.isClosed() {
+		return 0, xerrors.New("closed")
+	}
+	if a.derpListener == nil {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return 0, xerrors.Errorf("listen on %q: %w", address, err)
+		}
+		logger := a.logger.Named("derp")
+		server := derp.NewServer(key.NewNode(), tailnet.Logger(logger))
+		mux := http.NewServeMux()
+		mux.Handle("/derp", derphttp.Handler(server))
+		// This is used when UDP is blocked, and latency must be checked via HTTP(s).
+		mux.HandleFunc("/derp/latency-check", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		httpServer := &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 20 * time.Second,
+			ErrorLog:          slog.Stdlib(ctx, logger, slog.LevelInfo),
+		}
+		a.derpListener = listener
+		a.derpServer = server
+		a.derpHTTPServer = httpServer
+		a.connCloseWait.Add(1)
+		go func() {
+			defer a.connCloseWait.Done()
+			err := httpServer.Serve(listener)
+			if err != nil && !xerrors.Is(err, http.ErrServerClosed) && !strings.Contains(err.Error(), "use of closed network connection") {
+				logger.Critical(ctx, "serve embedded derp", slog.Error(err))
+			}
+		}()
+		logger.Info(ctx, "started embedded derp", slog.F("address", listener.Addr().String()))
+	}
+	tcpAddr, valid := a.derpListener.Addr().(*net.TCPAddr)
+	if !valid {
+		return 0, xerrors.Errorf("unexpected listener address type: %T", a.derpListener.Addr())
+	}
+	return tcpAddr.Port, nil
+}
@@ -0,0 +1,412 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// diagnosticsTimeout limits how long diagnostics run, since checks
+	// can hang on network timeouts.
+	diagnosticsTimeout = 15 * time.Second
+	// lowDiskFree is the free space at which a disk is nearly full.
+	lowDiskFree = 1 << 30
+	// minDiskFree is the free space at which a disk is full enough to
+	// make most commands fail.
+	minDiskFree = 100 << 20
+)
+
+// proxyEnvs are the environment variables that configure proxies for most
+// tools, in both cases since tools disagree on which is used.
+var proxyEnvs = []string{
+	"HTTP_PROXY", "http_proxy",
+	"HTTPS_PROXY", "https_proxy",
+	"ALL_PROXY", "all_proxy",
+	"NO_PROXY", "no_proxy",
+}
+
+// packageManagers are checked when they're installed, since startup
+// scripts commonly install packages.
+var packageManagers = []string{"apt-get", "dnf", "yum", "apk", "pacman", "zypper", "brew", "pip3", "npm"}
+
+// setStartup updates the state of the startup script.
+func (a *agent) setStartup(fn func(startup *codersdk.WorkspaceAgentStartupResponse)) {
+	a.startupMutex.Lock()
+	defer a.startupMutex.Unlock()
+	fn(&a.startup)
+}
+
+// startupHandler returns the state of the startup script, with diagnostics
+// if it failed.
+func (a *agent) startupHandler(rw http.ResponseWriter, r *http.Request) {
+	a.startupMutex.Lock()
+	startup := a.startup
+	a.startupMutex.Unlock()
+	httpapi.Write(r.Context(), rw, http.StatusOK, startup)
+}
+
+// diagnose checks the workspace for common problems that make startup
+// scripts fail, so they can be troubleshot without access to the workspace.
+func (a *agent) diagnose(ctx context.Context, metadata codersdk.WorkspaceAgentMetadata) *codersdk.WorkspaceAgentDiagnosticsReport {
+	ctx, cancel := context.WithTimeout(ctx, diagnosticsTimeout)
+	defer cancel()
+	env := a.diagnosticsEnv(ctx)
+
+	checks := []func() codersdk.WorkspaceAgentDiagnostic{
+		func() codersdk.WorkspaceAgentDiagnostic { return a.diagnoseDisk(metadata) },
+		func() codersdk.WorkspaceAgentDiagnostic { return a.diagnoseWritable() },
+		func() codersdk.WorkspaceAgentDiagnostic { return a.diagnoseDNS(ctx, metadata) },
+		func() codersdk.WorkspaceAgentDiagnostic { return diagnoseProxy(ctx, env) },
+		func() codersdk.WorkspaceAgentDiagnostic { return a.diagnoseGitAuth(ctx, metadata, env) },
+		func() codersdk.WorkspaceAgentDiagnostic { return a.diagnosePackageManagers(ctx) },
+	}
+	diagnostics := make([]codersdk.WorkspaceAgentDiagnostic, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		i, check := i, check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			diagnostics[i] = check()
+		}()
+	}
+	wg.Wait()
+
+	return &codersdk.WorkspaceAgentDiagnosticsReport{
+		CreatedAt:   time.Now(),
+		Diagnostics: diagnostics,
+	}
+}
+
+// diagnosticsEnv returns the environment of commands run by the agent,
+// which is what the startup script ran with.
+func (a *agent) diagnosticsEnv(ctx context.Context) map[string]string {
+	env := map[string]string{}
+	cmd, err := a.createCommand(ctx, "", nil)
+	if err != nil {
+		a.logger.Warn(ctx, "create command for diagnostics", slog.Error(err))
+		return env
+	}
+	// Later variables override earlier ones, like they do for commands.
+	for _, kv := range cmd.Env {
+		key, value, ok := strings.Cut(kv, "=")
+		if ok {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+func (a *agent) diagnoseDisk(metadata codersdk.WorkspaceAgentMetadata) codersdk.WorkspaceAgentDiagnostic {
+	diagnostic := codersdk.WorkspaceAgentDiagnostic{
+		Name:    "disk",
+		Status:  codersdk.WorkspaceAgentDiagnosticOK,
+		Message: "Disks have enough free space.",
+	}
+	paths := []string{a.tempDir}
+	if homedir, err := a.homeDir(); err == nil {
+		paths = append(paths, homedir)
+	}
+	if metadata.Directory != "" {
+		paths = append(paths, metadata.Directory)
+	}
+	checked := map[string]struct{}{}
+	for _, path := range paths {
+		if _, ok := checked[path]; ok {
+			continue
+		}
+		checked[path] = struct{}{}
+		free, total, err := diskSpace(path)
+		if err != nil {
+			diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s: %s", path, err))
+			continue
+		}
+		diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s: %s free of %s", path, formatBytes(free), formatBytes(total)))
+		switch {
+		case free < minDiskFree:
+			diagnostic.Status = codersdk.WorkspaceAgentDiagnosticFailed
+			diagnostic.Message = fmt.Sprintf("The disk of %s is full.", path)
+		case free < lowDiskFree && diagnostic.Status == codersdk.WorkspaceAgentDiagnosticOK:
+			diagnostic.Status = codersdk.WorkspaceAgentDiagnosticWarning
+			diagnostic.Message = fmt.Sprintf("The disk of %s is nearly full.", path)
+		}
+	}
+	return diagnostic
+}
+
+// diagnoseWritable checks the directories the agent and startup scripts
+// write to, which are read-only in containers with a read-only root
+// filesystem unless volumes are mounted.
+func (a *agent) diagnoseWritable() codersdk.WorkspaceAgentDiagnostic {
+	diagnostic := codersdk.WorkspaceAgentDiagnostic{
+		Name:    "writable",
+		Status:  codersdk.WorkspaceAgentDiagnosticOK,
+		Message: "Directories are writable.",
+	}
+	err := checkWritable(a.filesystem, a.tempDir)
+	if err != nil {
+		diagnostic.Status = codersdk.WorkspaceAgentDiagnosticFailed
+		diagnostic.Message = fmt.Sprintf("The temporary directory %s isn't writable. Set CODER_AGENT_TEMP_DIR to a writable directory.", a.tempDir)
+		diagnostic.Details = append(diagnostic.Details, err.Error())
+	}
+	if homedir, err := a.homeDir(); err == nil {
+		err = checkWritable(a.filesystem, homedir)
+		if err != nil {
+			if diagnostic.Status == codersdk.WorkspaceAgentDiagnosticOK {
+				diagnostic.Status = codersdk.WorkspaceAgentDiagnosticWarning
+				diagnostic.Message = fmt.Sprintf("The home directory %s isn't writable, so tools can't store their configuration.", homedir)
+			}
+			diagnostic.Details = append(diagnostic.Details, err.Error())
+		}
+	}
+	return diagnostic
+}
+
+// diagnoseDNS resolves the hosts the agent connects to, which are the most
+// likely to be required by the startup script too.
+func (a *agent) diagnoseDNS(ctx context.Context, metadata codersdk.WorkspaceAgentMetadata) codersdk.WorkspaceAgentDiagnostic {
+	diagnostic := codersdk.WorkspaceAgentDiagnostic{
+		Name:    "dns",
+		Status:  codersdk.WorkspaceAgentDiagnosticOK,
+		Message: "Hosts were resolved.",
+	}
+	hosts := map[string]struct{}{}
+	if a.coderURL != nil {
+		hosts[a.coderURL.Hostname()] = struct{}{}
+	}
+	if metadata.DERPMap != nil {
+		for _, region := range metadata.DERPMap.Regions {
+			for _, node := range region.Nodes {
+				hosts[node.HostName] = struct{}{}
+			}
+		}
+	}
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		// Addresses don't need to be resolved.
+		if host == "" || net.ParseIP(host) != nil {
+			continue
+		}
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		diagnostic.Message = "There are no hosts to resolve."
+		return diagnostic
+	}
+	for _, name := range names {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+		if err != nil {
+			diagnostic.Status = codersdk.WorkspaceAgentDiagnosticFailed
+			diagnostic.Message = fmt.Sprintf("Failed to resolve %s.", name)
+			diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s: %s", name, strings.Join(addrs, ", ")))
+	}
+	return diagnostic
+}
+
+// diagnoseProxy reports the proxies that are configured, and whether they
+// accept connections.
+func diagnoseProxy(ctx context.Context, env map[string]string) codersdk.WorkspaceAgentDiagnostic {
+	diagnostic := codersdk.WorkspaceAgentDiagnostic{
+		Name:    "proxy",
+		Status:  codersdk.WorkspaceAgentDiagnosticOK,
+		Message: "No proxy is configured.",
+	}
+	var dialer net.Dialer
+	for _, key := range proxyEnvs {
+		value, ok := env[key]
+		if !ok || value == "" {
+			continue
+		}
+		diagnostic.Message = "Proxies accept connections."
+		if strings.EqualFold(key, "NO_PROXY") {
+			diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s=%s", key, value))
+			continue
+		}
+		proxyURL, err := parseProxyURL(value)
+		if err != nil {
+			diagnostic.Status = codersdk.WorkspaceAgentDiagnosticFailed
+			diagnostic.Message = fmt.Sprintf("%s is invalid.", key)
+			diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s: %s", key, err))
+			continue
+		}
+		// Proxy URLs often contain credentials.
+		redacted := proxyURL.Redacted()
+		conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+		if err != nil {
+			diagnostic.Status = codersdk.WorkspaceAgentDiagnosticFailed
+			diagnostic.Message = fmt.Sprintf("The proxy in %s doesn't accept connections.", key)
+			diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s=%s: %s", key, redacted, err))
+			continue
+		}
+		_ = conn.Close()
+		diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s=%s", key, redacted))
+	}
+	return diagnostic
+}
+
+// parseProxyURL parses a proxy like Go's HTTP client does, which assumes
+// HTTP when the scheme is omitted.
+func parseProxyURL(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, xerrors.Errorf("no host in %q", proxyURL.Redacted())
+	}
+	if proxyURL.Port() == "" {
+		port := "80"
+		switch proxyURL.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		}
+		proxyURL.Host = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	return proxyURL, nil
+}
+
+// diagnoseGitAuth checks the requirements of authenticating with Git
+// providers through coderd.
+func (a *agent) diagnoseGitAuth(ctx context.Context, metadata codersdk.WorkspaceAgentMetadata, env map[string]string) codersdk.WorkspaceAgentDiagnostic {
+	diagnostic := codersdk.WorkspaceAgentDiagnostic{
+		Name:    "git_auth",
+		Status:  codersdk.WorkspaceAgentDiagnosticOK,
+		Message: "Git authentication is available.",
+	}
+	if metadata.GitAuthConfigs == 0 {
+		diagnostic.Message = "Git authentication isn't configured."
+		return diagnostic
+	}
+	fail := func(message, detail string) {
+		diagnostic.Status = codersdk.WorkspaceAgentDiagnosticFailed
+		diagnostic.Message = message
+		diagnostic.Details = append(diagnostic.Details, detail)
+	}
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		fail("Git isn't installed.", err.Error())
+	} else {
+		diagnostic.Details = append(diagnostic.Details, "git: "+gitPath)
+	}
+	if askpass := env["GIT_ASKPASS"]; askpass == "" {
+		fail("GIT_ASKPASS isn't set.", "GIT_ASKPASS is empty, so Git won't request credentials from Coder")
+	} else {
+		diagnostic.Details = append(diagnostic.Details, "GIT_ASKPASS="+askpass)
+	}
+	if a.coderURL == nil {
+		return diagnostic
+	}
+	err = checkReachable(ctx, a.httpClient, a.coderURL.JoinPath("/healthz").String())
+	if err != nil {
+		fail("Coder isn't reachable to authenticate with Git.", fmt.Sprintf("%s: %s", a.coderURL.Redacted(), err))
+	} else {
+		diagnostic.Details = append(diagnostic.Details, a.coderURL.Redacted()+": reachable")
+	}
+	return diagnostic
+}
+
+func checkReachable(ctx context.Context, client *http.Client, rawURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return xerrors.Errorf("create request: %w", err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return xerrors.Errorf("do request: %w", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return xerrors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+// diagnosePackageManagers checks that installed package managers run, and
+// that apt has package lists, which are commonly removed from images.
+func (a *agent) diagnosePackageManagers(ctx context.Context) codersdk.WorkspaceAgentDiagnostic {
+	diagnostic := codersdk.WorkspaceAgentDiagnostic{
+		Name:    "package_managers",
+		Status:  codersdk.WorkspaceAgentDiagnosticOK,
+		Message: "No package managers are installed.",
+	}
+	found := []string{}
+	for _, name := range packageManagers {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		found = append(found, name)
+		output, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+		if err != nil {
+			diagnostic.Status = codersdk.WorkspaceAgentDiagnosticWarning
+			diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		diagnostic.Details = append(diagnostic.Details, fmt.Sprintf("%s: %s", name, version))
+	}
+	if len(found) > 0 {
+		diagnostic.Message = fmt.Sprintf("Found %s.", strings.Join(found, ", "))
+	}
+	if diagnostic.Status != codersdk.WorkspaceAgentDiagnosticOK {
+		diagnostic.Message = "Package managers failed to run."
+		return diagnostic
+	}
+	if _, err := exec.LookPath("apt-get"); err == nil && !a.hasAptLists() {
+		diagnostic.Status = codersdk.WorkspaceAgentDiagnosticWarning
+		diagnostic.Message = `apt has no package lists, so packages can't be installed until "apt-get update" is run.`
+	}
+	return diagnostic
+}
+
+func (a *agent) hasAptLists() bool {
+	infos, err := afero.ReadDir(a.filesystem, filepath.Join("/var", "lib", "apt", "lists"))
+	if err != nil {
+		return false
+	}
+	for _, info := range infos {
+		if !info.IsDir() && info.Name() != "lock" {
+			return true
+		}
+	}
+	return false
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns the space available to unprivileged users and the size
+// of the filesystem containing path.
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	var stat unix.Statfs_t
+	err = unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, 0, err
+	}
+	//nolint:unconvert // The type of Bsize varies by platform.
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,14 @@
+package agent
+
+import "golang.org/x/sys/windows"
+
+// diskSpace returns the space available to the user and the size of the
+// volume containing path.
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = windows.GetDiskFreeSpaceEx(pathPtr, &free, &total, nil)
+	return free, total, err
+}
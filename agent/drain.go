@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cdr.dev/slog"
+)
+
+// drainPollInterval is how often a draining agent checks whether its
+// connections ended.
+const drainPollInterval = 250 * time.Millisecond
+
+func (a *agent) CloseWithTimeout(ctx context.Context) error {
+	if a.isClosed() {
+		return nil
+	}
+	if !a.draining.Swap(true) {
+		message := "The workspace agent is shutting down."
+		if deadline, ok := ctx.Deadline(); ok {
+			message = fmt.Sprintf("The workspace agent is shutting down. Sessions will be closed in %s.", time.Until(deadline).Round(time.Second))
+		}
+		sessions := a.broadcast(ctx, message)
+		a.logger.Info(ctx, "draining connections before closing", slog.F("notified_sessions", sessions))
+	}
+	err := a.waitForConnections(ctx)
+	if err != nil {
+		a.logger.Warn(ctx, "closing agent with open connections",
+			slog.F("connections", a.activity.connections()), slog.Error(err))
+	}
+	return a.Close()
+}
+
+// waitForConnections waits until no clients are connected to the agent.
+func (a *agent) waitForConnections(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for a.activity.connections() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-a.closed:
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
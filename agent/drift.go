@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// defaultDriftInterval is how often the workspace is compared to the
+	// drift manifest when it doesn't set an interval.
+	defaultDriftInterval = time.Hour
+	// driftRetryInterval is how long until a report that failed to send
+	// is retried.
+	driftRetryInterval = time.Minute
+	// driftStartupPollInterval is how often the startup script is checked
+	// for finishing, since tools are commonly installed by it.
+	driftStartupPollInterval = time.Second
+	// driftToolTimeout bounds the commands that print the versions of
+	// tools.
+	driftToolTimeout = 30 * time.Second
+	// maxDriftValueLength bounds the values in reports, like the output
+	// of tools.
+	maxDriftValueLength = 1024
+)
+
+// reportDrift compares the workspace to the drift manifest of the metadata
+// periodically, and reports the differences to coderd until the context is
+// canceled. The interval applies across reconnections, so the workspace
+// isn't compared every time the agent reconnects.
+func (a *agent) reportDrift(ctx context.Context) {
+	logger := a.logger.Named("drift")
+	ticker := time.NewTicker(driftStartupPollInterval)
+	defer ticker.Stop()
+	for a.startupRunning() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	for {
+		wait := defaultDriftInterval
+		metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+		manifest := metadata.DriftManifest
+		if manifest != nil {
+			interval := defaultDriftInterval
+			if manifest.IntervalSeconds > 0 {
+				interval = time.Duration(manifest.IntervalSeconds) * time.Second
+			}
+			wait = interval - time.Since(a.driftReportedAt.Load())
+			if wait <= 0 {
+				report := a.checkDrift(ctx, *manifest)
+				err := a.client.PostWorkspaceAgentDriftReport(ctx, report)
+				if ctx.Err() != nil {
+					return
+				}
+				wait = interval
+				if err != nil {
+					logger.Warn(ctx, "report drift", slog.Error(err))
+					wait = driftRetryInterval
+				} else {
+					a.driftReportedAt.Store(report.CheckedAt)
+					if report.Drifted {
+						logger.Info(ctx, "workspace drifted from the manifest", slog.F("drifts", len(report.Drifts)))
+					}
+				}
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// startupRunning returns whether the startup script hasn't finished.
+func (a *agent) startupRunning() bool {
+	a.startupMutex.Lock()
+	defer a.startupMutex.Unlock()
+	return a.startup.State == codersdk.WorkspaceAgentStartupRunning
+}
+
+// checkDrift compares the workspace to the manifest.
+func (a *agent) checkDrift(ctx context.Context, manifest codersdk.WorkspaceAgentDriftManifest) codersdk.WorkspaceAgentDriftReport {
+	report := codersdk.WorkspaceAgentDriftReport{
+		CheckedAt: time.Now(),
+		Drifts:    []codersdk.WorkspaceAgentDrift{},
+	}
+	for _, tool := range manifest.Tools {
+		report.Checks++
+		drift, ok := a.checkDriftTool(ctx, tool)
+		if !ok {
+			report.Drifts = append(report.Drifts, drift)
+		}
+	}
+
+	env := a.diagnosticsEnv(ctx)
+	names := make([]string, 0, len(manifest.EnvironmentVariables))
+	for name := range manifest.EnvironmentVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.Checks++
+		expected := manifest.EnvironmentVariables[name]
+		actual, ok := env[name]
+		if ok && actual == expected {
+			continue
+		}
+		drift := codersdk.WorkspaceAgentDrift{
+			Type:     codersdk.WorkspaceAgentDriftTypeEnvironmentVariable,
+			Name:     name,
+			Expected: expected,
+			Actual:   truncateDriftValue(actual),
+		}
+		if !ok {
+			drift.Error = "The environment variable isn't set."
+		}
+		report.Drifts = append(report.Drifts, drift)
+	}
+
+	for _, file := range manifest.Files {
+		report.Checks++
+		drift, ok := a.checkDriftFile(file)
+		if !ok {
+			report.Drifts = append(report.Drifts, drift)
+		}
+	}
+	report.Drifted = len(report.Drifts) > 0
+	return report
+}
+
+// checkDriftTool runs the command of a tool, and returns whether its output
+// contains the expected version.
+func (a *agent) checkDriftTool(ctx context.Context, tool codersdk.WorkspaceAgentDriftTool) (codersdk.WorkspaceAgentDrift, bool) {
+	drift := codersdk.WorkspaceAgentDrift{
+		Type:     codersdk.WorkspaceAgentDriftTypeTool,
+		Name:     tool.Name,
+		Expected: tool.Version,
+	}
+	ctx, cancel := context.WithTimeout(ctx, driftToolTimeout)
+	defer cancel()
+	cmd, err := a.createCommand(ctx, tool.Command, nil)
+	if err != nil {
+		drift.Error = err.Error()
+		return drift, false
+	}
+	output, err := cmd.CombinedOutput()
+	drift.Actual = truncateDriftValue(strings.TrimSpace(string(output)))
+	if err != nil {
+		drift.Error = err.Error()
+		return drift, false
+	}
+	return drift, strings.Contains(string(output), tool.Version)
+}
+
+// checkDriftFile returns whether the checksum of a file is the expected one.
+func (a *agent) checkDriftFile(file codersdk.WorkspaceAgentDriftFile) (codersdk.WorkspaceAgentDrift, bool) {
+	drift := codersdk.WorkspaceAgentDrift{
+		Type:     codersdk.WorkspaceAgentDriftTypeFile,
+		Name:     file.Path,
+		Expected: strings.ToLower(file.SHA256),
+	}
+	checksum, err := a.fileChecksum(file.Path)
+	if err != nil {
+		drift.Error = err.Error()
+		return drift, false
+	}
+	drift.Actual = checksum
+	return drift, drift.Actual == drift.Expected
+}
+
+func (a *agent) fileChecksum(path string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		homedir, err := a.homeDir()
+		if err != nil {
+			return "", xerrors.Errorf("get home dir: %w", err)
+		}
+		path = filepath.Join(homedir, strings.TrimPrefix(path, "~/"))
+	}
+	file, err := a.filesystem.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func truncateDriftValue(value string) string {
+	if len(value) > maxDriftValueLength {
+		return value[:maxDriftValueLength]
+	}
+	return value
+}
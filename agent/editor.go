@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/coder/coder/codersdk"
+)
+
+// portProxyURIVariable expands to the URI that proxies ports of the
+// workspace in the environment variables of editors.
+const portProxyURIVariable = "CODER_PORT_PROXY_URI"
+
+// editorEnvironment returns the environment variables that integrate
+// sessions with editors served from the workspace. They're the variables
+// of code-server unless the metadata disables them.
+func editorEnvironment(metadata codersdk.WorkspaceAgentMetadata) []string {
+	integration := metadata.EditorIntegration
+	if integration == nil {
+		integration = &codersdk.WorkspaceAgentEditorIntegration{}
+	}
+	var env []string
+	if !integration.DisableCodeServer {
+		// This adds the ports dialog to code-server that enables
+		// proxying a port dynamically.
+		env = append(env, fmt.Sprintf("VSCODE_PROXY_URI=%s", metadata.VSCodePortProxyURI))
+		// Hide Coder message on code-server's "Getting Started" page
+		env = append(env, "CS_DISABLE_GETTING_STARTED_OVERRIDE=true")
+	}
+	expand := func(name string) string {
+		if name == portProxyURIVariable {
+			return metadata.VSCodePortProxyURI
+		}
+		return os.Getenv(name)
+	}
+	for _, editor := range integration.Editors {
+		// Editors that set the same variable are applied in order, so
+		// the variables of each editor are too.
+		names := make([]string, 0, len(editor.EnvironmentVariables))
+		for name := range editor.EnvironmentVariables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			env = append(env, fmt.Sprintf("%s=%s", name, os.Expand(editor.EnvironmentVariables[name], expand)))
+		}
+	}
+	return env
+}
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/codersdk"
+)
+
+func TestEditorEnvironment(t *testing.T) {
+	t.Parallel()
+
+	metadata := codersdk.WorkspaceAgentMetadata{
+		VSCodePortProxyURI: "https://{{port}}--main--dev--alice.coder.com",
+	}
+	// code-server is integrated by default.
+	require.Equal(t, []string{
+		"VSCODE_PROXY_URI=https://{{port}}--main--dev--alice.coder.com",
+		"CS_DISABLE_GETTING_STARTED_OVERRIDE=true",
+	}, editorEnvironment(metadata))
+
+	metadata.EditorIntegration = &codersdk.WorkspaceAgentEditorIntegration{
+		DisableCodeServer: true,
+		Editors: []codersdk.WorkspaceAgentEditor{{
+			Name: "theia",
+			EnvironmentVariables: map[string]string{
+				"THEIA_WEBVIEW_EXTERNAL_ENDPOINT": "{{hostname}}",
+				"THEIA_MINI_BROWSER_HOST_PATTERN": "$CODER_PORT_PROXY_URI",
+			},
+		}},
+	}
+	require.Equal(t, []string{
+		"THEIA_MINI_BROWSER_HOST_PATTERN=https://{{port}}--main--dev--alice.coder.com",
+		"THEIA_WEBVIEW_EXTERNAL_ENDPOINT={{hostname}}",
+	}, editorEnvironment(metadata))
+}
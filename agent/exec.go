@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// execRequestTimeout is how long the agent waits for the request of an
+// exec connection.
+const execRequestTimeout = 10 * time.Second
+
+var errExecRequiresSSHAuth = xerrors.New("exec requests are refused while SSH connections require a public key or user certificate, run the command over SSH instead")
+
+// handleExecConn runs the command of a codersdk.ExecRequest and streams its
+// output to the client. The command is killed when the client closes the
+// connection.
+func (a *agent) handleExecConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	var req codersdk.ExecRequest
+	err := readInitMessage(conn, execRequestTimeout, math.MaxUint16, &req)
+	if err != nil {
+		a.logger.Debug(ctx, "read exec request", slog.Error(err))
+		return
+	}
+	// Exec requests don't carry an SSH key or certificate, so they'd
+	// bypass the authentication that the metadata requires for SSH.
+	if a.sshUserCertificateAuthority() != nil || a.sshPublicKeyAuth() {
+		_ = json.NewEncoder(conn).Encode(codersdk.ExecMessage{Error: errExecRequiresSSHAuth.Error()})
+		return
+	}
+
+	sessionID := uuid.NewString()
+	disconnected := a.connectionEvents.connected(codersdk.AgentConnectionTypeExec, sessionID, conn.RemoteAddr(), "", req.Command, "")
+	defer disconnected()
+	inactive := a.activity.start()
+	defer inactive()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	recorded := RecordedSession{
+		ID:        sessionID,
+		Type:      codersdk.WorkspaceAgentSessionTypeExec,
+		Command:   req.Command,
+		StartedAt: time.Now(),
+		Peer:      conn.RemoteAddr().String(),
+	}
+	recorded.ReasonCodes, err = a.checkSession(ctx, recorded)
+	if err != nil {
+		_ = json.NewEncoder(conn).Encode(codersdk.ExecMessage{Error: err.Error()})
+		return
+	}
+	// Terminating the session kills the command, like the client closing
+	// the connection.
+	tracked := a.trackSession(recorded, cancel)
+	defer a.untrackSession(sessionID)
+	// Clients don't send anything after the request, so reading only
+	// ends when they close the connection.
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	writer := &execWriter{encoder: json.NewEncoder(tracked.countOut(conn))}
+	result := a.runExec(ctx, sessionID, req, writer)
+	_ = writer.write(result)
+}
+
+// runExec runs the command of a request with its output written to writer,
+// and returns the last message for the client.
+func (a *agent) runExec(ctx context.Context, sessionID string, req codersdk.ExecRequest, writer *execWriter) codersdk.ExecMessage {
+	err := a.waitForMetadata(ctx, io.Discard)
+	if err == nil {
+		err = a.waitForStartupScript(ctx, io.Discard)
+	}
+	if err != nil {
+		return codersdk.ExecMessage{Error: err.Error()}
+	}
+	cmdCtx := ctx
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+	env := make([]string, 0, len(req.Env))
+	for key, value := range req.Env {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	env, rejectedEnv := acceptEnv(metadata.SSHAcceptEnv, env)
+	if len(rejectedEnv) > 0 {
+		a.logger.Debug(ctx, "ignoring environment variables that aren't accepted", slog.F("names", rejectedEnv))
+	}
+	if a.fdReserve.exhausted() {
+		return codersdk.ExecMessage{Error: errFDsExhausted.Error()}
+	}
+	cmd, err := a.createCommand(cmdCtx, req.Command, env)
+	if err != nil {
+		return codersdk.ExecMessage{Error: a.checkFDs(ctx, err).Error()}
+	}
+	if req.Dir != "" {
+		dir := req.Dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(cmd.Dir, dir)
+		}
+		cmd.Dir = dir
+	}
+	cmd.Stdout = writer.stream(codersdk.ExecStreamStdout)
+	cmd.Stderr = writer.stream(codersdk.ExecStreamStderr)
+
+	started := time.Now()
+	err = cmd.Run()
+	a.logSessionEnd(ctx, "exec", sessionID, cmd, started, err)
+
+	var msg codersdk.ExecMessage
+	if cmd.ProcessState != nil {
+		exitCode := cmd.ProcessState.ExitCode()
+		msg.ExitCode = &exitCode
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case req.Timeout > 0 && xerrors.Is(cmdCtx.Err(), context.DeadlineExceeded):
+		msg.Error = fmt.Sprintf("command timed out after %s", req.Timeout)
+	case err != nil && !xerrors.As(err, &exitErr):
+		msg.Error = xerrors.Errorf("run command: %w", a.checkFDs(ctx, codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorCommandStartFailed, err))).Error()
+	}
+	return msg
+}
+
+// execWriter writes the messages of an exec connection.
+type execWriter struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func (w *execWriter) write(msg codersdk.ExecMessage) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.encoder.Encode(msg)
+}
+
+// stream returns a writer that sends output of the stream.
+func (w *execWriter) stream(stream codersdk.ExecStream) io.Writer {
+	return &execStreamWriter{
+		writer: w,
+		stream: stream,
+	}
+}
+
+type execStreamWriter struct {
+	writer *execWriter
+	stream codersdk.ExecStream
+}
+
+func (w *execStreamWriter) Write(p []byte) (int, error) {
+	err := w.writer.write(codersdk.ExecMessage{
+		Stream: w.stream,
+		Data:   p,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// reservedFileDescriptors is how many file descriptors the agent reserves
+// for running out of them.
+const reservedFileDescriptors = 8
+
+// fdReserve holds open file descriptors that are released when the process
+// runs out of them, so the agent can still log, report to Coder and reject
+// sessions with an error instead of failing in obscure ways.
+type fdReserve struct {
+	mutex sync.Mutex
+	files []*os.File
+	size  int
+	// exhaustions counts the times the process ran out of file
+	// descriptors and the reserve was released.
+	exhaustions int64
+}
+
+func newFDReserve(size int) *fdReserve {
+	r := &fdReserve{size: size}
+	r.refill()
+	return r
+}
+
+// refill reopens the reserved file descriptors. It returns whether the
+// reserve is full, which it isn't while the process is still out of file
+// descriptors.
+func (r *fdReserve) refill() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for len(r.files) < r.size {
+		file, err := os.Open(os.DevNull)
+		if err != nil {
+			return false
+		}
+		r.files = append(r.files, file)
+	}
+	return true
+}
+
+// release closes the reserved file descriptors if err is from running out
+// of them, and returns whether it is.
+func (r *fdReserve) release(err error) bool {
+	if !isFDExhausted(err) {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.files) > 0 {
+		r.exhaustions++
+	}
+	for _, file := range r.files {
+		_ = file.Close()
+	}
+	r.files = nil
+	return true
+}
+
+// exhausted returns whether the reserve was released and couldn't be
+// refilled yet, which means the process is out of file descriptors.
+func (r *fdReserve) exhausted() bool {
+	return !r.refill()
+}
+
+func (r *fdReserve) stats() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.exhaustions
+}
+
+// isFDExhausted returns whether err is from running out of file
+// descriptors in the process or the system.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// errFDsExhausted rejects sessions while the process is out of file
+// descriptors.
+var errFDsExhausted = codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorFileDescriptors, xerrors.New("the workspace is out of file descriptors"))
+
+// checkFDs releases the reserve if err is from running out of file
+// descriptors, and classifies err so clients are told why they failed.
+func (a *agent) checkFDs(ctx context.Context, err error) error {
+	if !a.fdReserve.release(err) {
+		return err
+	}
+	a.logger.Error(ctx, "out of file descriptors, released the reserve", slog.Error(err))
+	return codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorFileDescriptors, err)
+}
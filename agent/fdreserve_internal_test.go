@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestFDReserve(t *testing.T) {
+	t.Parallel()
+
+	reserve := newFDReserve(2)
+	require.Len(t, reserve.files, 2)
+	require.False(t, reserve.exhausted())
+
+	require.False(t, reserve.release(os.ErrNotExist))
+	require.Len(t, reserve.files, 2)
+
+	err := xerrors.Errorf("start command: %w", &os.PathError{Op: "open", Path: "/dev/ptmx", Err: syscall.EMFILE})
+	require.True(t, reserve.release(err))
+	require.Empty(t, reserve.files)
+	require.EqualValues(t, 1, reserve.stats())
+	// Releasing an empty reserve doesn't count again.
+	require.True(t, reserve.release(syscall.ENFILE))
+	require.EqualValues(t, 1, reserve.stats())
+
+	// The reserve is refilled once file descriptors are available.
+	require.False(t, reserve.exhausted())
+	require.Len(t, reserve.files, 2)
+	require.True(t, reserve.release(syscall.EMFILE))
+	require.EqualValues(t, 2, reserve.stats())
+}
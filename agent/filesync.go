@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/filesync"
+)
+
+// handleFileSyncConn syncs a directory of the workspace with the client
+// that selected it with a codersdk.FileSyncInit.
+func (a *agent) handleFileSyncConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	// This cannot use a JSON decoder, since that can buffer messages
+	// of the sync.
+	rawLen := make([]byte, 2)
+	_, err := io.ReadFull(conn, rawLen)
+	if err != nil {
+		return
+	}
+	data := make([]byte, binary.LittleEndian.Uint16(rawLen))
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		return
+	}
+	var msg codersdk.FileSyncInit
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		_ = filesync.Reject(conn, xerrors.Errorf("invalid init: %w", err))
+		return
+	}
+	if msg.Direction != codersdk.FileSyncDirectionUpload && msg.Direction != codersdk.FileSyncDirectionDownload {
+		_ = filesync.Reject(conn, xerrors.Errorf("invalid direction %q", msg.Direction))
+		return
+	}
+	path, err := a.fileSyncPath(msg.Path)
+	if err != nil {
+		_ = filesync.Reject(conn, err)
+		return
+	}
+
+	disconnected := a.connectionEvents.connected(codersdk.AgentConnectionTypeFileSync, "", conn.RemoteAddr(), "", string(msg.Direction)+" "+path, "")
+	defer disconnected()
+	inactive := a.activity.start()
+	defer inactive()
+	// Closing the connection stops a sync that's blocked on it.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	logger := a.logger.With(slog.F("direction", msg.Direction), slog.F("path", path))
+	var stats filesync.Stats
+	if msg.Direction == codersdk.FileSyncDirectionUpload {
+		stats, err = filesync.Receive(ctx, conn, a.filesystem, path, filesync.Options{
+			Delete: msg.Delete,
+		})
+	} else {
+		stats, err = filesync.Send(ctx, conn, a.filesystem, path)
+	}
+	if err != nil {
+		logger.Debug(ctx, "sync files", slog.Error(err))
+		return
+	}
+	logger.Debug(ctx, "synced files",
+		slog.F("transferred", stats.Transferred),
+		slog.F("literal_bytes", stats.LiteralBytes),
+		slog.F("matched_bytes", stats.MatchedBytes),
+	)
+}
+
+// fileSyncPath resolves the path of a sync, which is relative to the home
+// directory unless it's absolute.
+func (a *agent) fileSyncPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+	homedir, err := a.homeDir()
+	if err != nil {
+		return "", xerrors.Errorf("get home dir: %w", err)
+	}
+	if path == "~" {
+		return homedir, nil
+	}
+	path = strings.TrimPrefix(path, "~/")
+	return filepath.Join(homedir, path), nil
+}
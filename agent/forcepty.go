@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// forcePTYEnv forces PTY allocation for an SSH session when it's set to
+// true, for clients that can't request one (e.g. with "SetEnv
+// CODER_FORCE_PTY=true" in the SSH config).
+const forcePTYEnv = "CODER_FORCE_PTY"
+
+// forcedPTY is used for sessions that are forced to allocate a PTY, since
+// the client didn't send a terminal type or window size.
+var forcedPTY = ssh.Pty{
+	Term: "xterm-256color",
+	Window: ssh.Window{
+		Width:  80,
+		Height: 24,
+	},
+}
+
+// forcePTY returns whether an SSH session must run its command with a PTY
+// even though it didn't request one, like "RequestTTY force" in OpenSSH.
+// Interactive programs like REPLs often require a TTY, but tools that
+// integrate them run them without one. Patterns are matched against the
+// name of the program with path.Match.
+func forcePTY(patterns []string, rawCommand string, env []string) bool {
+	for _, kv := range env {
+		key, value, ok := strings.Cut(kv, "=")
+		if ok && key == forcePTYEnv {
+			force, _ := strconv.ParseBool(value)
+			return force
+		}
+	}
+	fields := strings.Fields(rawCommand)
+	if len(fields) == 0 {
+		return false
+	}
+	name := filepath.Base(fields[0])
+	for _, pattern := range patterns {
+		match, err := path.Match(pattern, name)
+		if err == nil && match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// healthHandler reports whether the agent is reachable through coderd, so
+// probes can tell a workspace whose agent is stuck apart from one that's
+// busy. It responds with 503 while the agent isn't healthy.
+func (a *agent) healthHandler(rw http.ResponseWriter, r *http.Request) {
+	health := a.health()
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	httpapi.Write(r.Context(), rw, status, health)
+}
+
+// readyHandler reports whether the workspace is ready for users, which also
+// requires the metadata and the startup script. It responds with 503 while
+// the workspace isn't ready.
+func (a *agent) readyHandler(rw http.ResponseWriter, r *http.Request) {
+	health := a.health()
+	status := http.StatusOK
+	if !health.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	httpapi.Write(r.Context(), rw, status, health)
+}
+
+// health checks the connections of the agent, and whether the workspace is
+// ready.
+func (a *agent) health() codersdk.WorkspaceAgentHealth {
+	var health codersdk.WorkspaceAgentHealth
+	var problems []string
+
+	a.closeMutex.Lock()
+	network := a.network
+	a.closeMutex.Unlock()
+	if network != nil {
+		select {
+		case <-network.Closed():
+		default:
+			health.Tailnet.Up = true
+			status := network.Status()
+			if status.Self != nil {
+				health.Tailnet.DERPRegion = status.Self.Relay
+			}
+			health.Tailnet.Peers = len(status.Peer)
+			health.Tailnet.DERPDegraded = network.DERPHealth().Degraded
+		}
+	}
+	if !health.Tailnet.Up {
+		problems = append(problems, "The tailnet isn't up.")
+	}
+
+	health.Coordinator.ConnectedAt = a.coordinatorConnectedAt.Load()
+	health.Coordinator.Connected = health.Coordinator.ConnectedAt != nil
+	health.Coordinator.LastError = a.reconnect.State().LastError
+	if !health.Coordinator.Connected {
+		problems = append(problems, "The agent isn't connected to the coordinator of coderd.")
+	}
+	health.Healthy = len(problems) == 0
+
+	health.MetadataFetchedAt = a.metadataFetchedAt.Load()
+	if health.MetadataFetchedAt == nil {
+		problems = append(problems, "The agent hasn't fetched its metadata.")
+	}
+	a.startupMutex.Lock()
+	health.Startup = a.startup
+	a.startupMutex.Unlock()
+	switch health.Startup.State {
+	case codersdk.WorkspaceAgentStartupReady:
+	case codersdk.WorkspaceAgentStartupError:
+		problems = append(problems, fmt.Sprintf("The startup script failed: %s", health.Startup.Error))
+	default:
+		problems = append(problems, "The startup script hasn't finished.")
+	}
+	health.Ready = len(problems) == 0
+	health.Problems = problems
+	return health
+}
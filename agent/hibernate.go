@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// ptySnapshotFile is where reconnecting PTYs are serialized before a
+	// VM snapshot, relative to the temporary directory of the agent.
+	ptySnapshotFile = "coder-reconnecting-ptys.json"
+	// ptyRestoredMessage is written after the output of a reconnecting PTY
+	// that was restored after its process ended.
+	ptyRestoredMessage = "\r\n[The workspace was resumed from a snapshot and the previous process of this terminal ended. A new one was started.]\r\n"
+	// ptyRestartedMessage is written after the output of a reconnecting
+	// PTY that was persisted before the agent restarted.
+	ptyRestartedMessage = "\r\n[The agent restarted and the previous process of this terminal ended. A new one was started.]\r\n"
+)
+
+// ptySnapshot is a reconnecting PTY serialized before a VM snapshot, or
+// persisted so it survives restarts of the agent.
+type ptySnapshot struct {
+	ID uuid.UUID `json:"id"`
+	// Output is the end of the output of the PTY, which is replayed to
+	// clients that reconnect after the workspace resumes.
+	Output  []byte `json:"output"`
+	Command string `json:"command,omitempty"`
+	Width   uint16 `json:"width,omitempty"`
+	Height  uint16 `json:"height,omitempty"`
+	Label   string `json:"label,omitempty"`
+	// UpdatedAt is when the PTY was last seen running, which the
+	// retention of persisted PTYs is relative to.
+	UpdatedAt time.Time `json:"updated_at"`
+	// Quiesced is whether the PTY was serialized before a VM snapshot,
+	// rather than persisted while the agent was running.
+	Quiesced bool `json:"quiesced,omitempty"`
+}
+
+// restoredMessage returns the message that is written after the output of
+// the snapshot when its PTY is started again.
+func (s ptySnapshot) restoredMessage() string {
+	if s.Quiesced {
+		return ptyRestoredMessage
+	}
+	return ptyRestartedMessage
+}
+
+type ptySnapshotFileContent struct {
+	QuiescedAt time.Time     `json:"quiesced_at"`
+	PTYs       []ptySnapshot `json:"ptys"`
+}
+
+func (a *agent) ptySnapshotPath() string {
+	return filepath.Join(a.tempDir, ptySnapshotFile)
+}
+
+// quiesce prepares the agent for a VM snapshot, by serializing the
+// reconnecting PTYs to disk. If the agent restarts after the workspace
+// resumes, their processes are gone, but clients that reconnect with their
+// IDs get their output and a new process instead of an empty terminal.
+func (a *agent) quiesce(ctx context.Context) (codersdk.QuiesceResponse, error) {
+	content := ptySnapshotFileContent{
+		QuiescedAt: time.Now(),
+		PTYs:       a.snapshotReconnectingPTYs(),
+	}
+	for i := range content.PTYs {
+		content.PTYs[i].Quiesced = true
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return codersdk.QuiesceResponse{}, xerrors.Errorf("marshal snapshot: %w", err)
+	}
+	// The snapshot is replaced atomically, so a snapshot of the VM taken
+	// while it's written doesn't contain a partial file.
+	path := a.ptySnapshotPath()
+	err = afero.WriteFile(a.filesystem, path+".tmp", data, 0o600)
+	if err == nil {
+		err = a.filesystem.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return codersdk.QuiesceResponse{}, xerrors.Errorf("write snapshot: %w", explainWriteError(err, "CODER_AGENT_TEMP_DIR"))
+	}
+	// A VM snapshot may be taken right after the agent quiesces.
+	if file, err := a.filesystem.Open(path); err == nil {
+		_ = file.Sync()
+		_ = file.Close()
+	}
+	a.logger.Info(ctx, "quiesced for snapshot", slog.F("reconnecting_ptys", len(content.PTYs)), slog.F("path", path))
+	return codersdk.QuiesceResponse{
+		ReconnectingPTYs: len(content.PTYs),
+		Path:             path,
+	}, nil
+}
+
+// snapshotReconnectingPTYs returns snapshots of the running reconnecting
+// PTYs.
+func (a *agent) snapshotReconnectingPTYs() []ptySnapshot {
+	now := time.Now()
+	snapshots := []ptySnapshot{}
+	a.reconnectingPTYs.Range(func(key, value any) bool {
+		id, ok := key.(uuid.UUID)
+		if !ok {
+			return true
+		}
+		rpty, ok := value.(*reconnectingPTY)
+		if !ok {
+			return true
+		}
+		rpty.circularBufferMutex.RLock()
+		output := rpty.circularBuffer.Bytes()
+		rpty.circularBufferMutex.RUnlock()
+		snapshots = append(snapshots, ptySnapshot{
+			ID:        id,
+			Output:    output,
+			Command:   rpty.recorded.Command,
+			Width:     rpty.recorded.Width,
+			Height:    rpty.recorded.Height,
+			Label:     rpty.session.label.Load(),
+			UpdatedAt: now,
+		})
+		return true
+	})
+	return snapshots
+}
+
+// restorePTYSnapshots reads the reconnecting PTYs that were serialized
+// before the workspace was snapshotted. The file is removed, so they're
+// only restored once.
+func (a *agent) restorePTYSnapshots(ctx context.Context) {
+	path := a.ptySnapshotPath()
+	data, err := afero.ReadFile(a.filesystem, path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			a.logger.Warn(ctx, "read reconnecting pty snapshot", slog.F("path", path), slog.Error(err))
+		}
+		return
+	}
+	_ = a.filesystem.Remove(path)
+	var content ptySnapshotFileContent
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		a.logger.Warn(ctx, "parse reconnecting pty snapshot", slog.F("path", path), slog.Error(err))
+		return
+	}
+	a.ptySnapshotsMutex.Lock()
+	defer a.ptySnapshotsMutex.Unlock()
+	for _, snapshot := range content.PTYs {
+		a.ptySnapshots[snapshot.ID] = snapshot
+	}
+	a.logger.Info(ctx, "restored reconnecting ptys from snapshot",
+		slog.F("reconnecting_ptys", len(content.PTYs)), slog.F("quiesced_at", content.QuiescedAt))
+}
+
+// takePTYSnapshot returns the snapshot of a reconnecting PTY, if it was
+// restored and hasn't been reconnected to yet.
+func (a *agent) takePTYSnapshot(id uuid.UUID) (ptySnapshot, bool) {
+	a.ptySnapshotsMutex.Lock()
+	defer a.ptySnapshotsMutex.Unlock()
+	snapshot, ok := a.ptySnapshots[id]
+	if ok {
+		delete(a.ptySnapshots, id)
+	}
+	return snapshot, ok
+}
+
+func (a *agent) quiesceHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	resp, err := a.quiesce(ctx)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Failed to quiesce the agent.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, resp)
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+const (
+	defaultHomeSkeletonDir = "/etc/skel"
+	// homeDirMode is the mode of a provisioned home directory, which
+	// matches the default of useradd.
+	homeDirMode = 0o755
+)
+
+// provisionHomeDir creates the home directory of the user if it doesn't
+// exist, and copies the skeleton files into it if it's empty. Workspaces
+// often mount an empty persistent volume as the home directory, which would
+// otherwise fail sessions and the startup script, or leave the user without
+// a shell profile. Files are created by the agent, so they're owned by the
+// user it runs as.
+func (a *agent) provisionHomeDir(ctx context.Context) error {
+	homedir, err := a.homeDir()
+	if err != nil {
+		return xerrors.Errorf("get home dir: %w", err)
+	}
+	infos, err := afero.ReadDir(a.filesystem, homedir)
+	switch {
+	case xerrors.Is(err, os.ErrNotExist):
+		err = a.filesystem.MkdirAll(homedir, homeDirMode)
+		if err != nil {
+			return xerrors.Errorf("create home dir: %w", err)
+		}
+		a.logger.Info(ctx, "created home directory", slog.F("path", homedir))
+	case err != nil:
+		return xerrors.Errorf("read home dir: %w", err)
+	case len(infos) > 0:
+		// The home directory is already initialized.
+		return nil
+	}
+
+	skeletonDir := a.homeSkeletonDir
+	if _, err := a.filesystem.Stat(skeletonDir); err != nil {
+		a.logger.Debug(ctx, "no home skeleton directory", slog.F("path", skeletonDir), slog.Error(err))
+		return nil
+	}
+	err = copyDir(a.filesystem, skeletonDir, homedir)
+	if err != nil {
+		return xerrors.Errorf("copy skeleton files from %q: %w", skeletonDir, err)
+	}
+	a.logger.Info(ctx, "copied skeleton files to home directory",
+		slog.F("path", homedir),
+		slog.F("skeleton", skeletonDir))
+	return nil
+}
+
+// copyDir copies the regular files and directories in src to dst, keeping
+// their modes. Other files, like symlinks, are skipped.
+func copyDir(filesystem afero.Fs, src, dst string) error {
+	return afero.Walk(filesystem, src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if rel == "." {
+				return nil
+			}
+			return filesystem.MkdirAll(target, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			return copyFile(filesystem, path, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+}
+
+func copyFile(filesystem afero.Fs, src, dst string, mode os.FileMode) error {
+	in, err := filesystem.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := filesystem.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
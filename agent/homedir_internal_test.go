@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func TestProvisionHomeDir(t *testing.T) {
+	t.Parallel()
+
+	setup := func(t *testing.T) (*agent, afero.Fs) {
+		t.Helper()
+		fs := afero.NewMemMapFs()
+		require.NoError(t, afero.WriteFile(fs, "/etc/skel/.bashrc", []byte("bashrc"), 0o644))
+		require.NoError(t, afero.WriteFile(fs, "/etc/skel/.config/app/config", []byte("config"), 0o600))
+		return &agent{
+			logger:     slogtest.Make(t, nil),
+			filesystem: fs,
+			homeDir: func() (string, error) {
+				return "/home/coder", nil
+			},
+			homeSkeletonDir: defaultHomeSkeletonDir,
+		}, fs
+	}
+	requireFile := func(t *testing.T, fs afero.Fs, path, content string, mode os.FileMode) {
+		t.Helper()
+		got, err := afero.ReadFile(fs, path)
+		require.NoError(t, err)
+		require.Equal(t, content, string(got))
+		info, err := fs.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, mode, info.Mode().Perm())
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		t.Parallel()
+		a, fs := setup(t)
+		require.NoError(t, a.provisionHomeDir(context.Background()))
+		info, err := fs.Stat("/home/coder")
+		require.NoError(t, err)
+		require.True(t, info.IsDir())
+		requireFile(t, fs, "/home/coder/.bashrc", "bashrc", 0o644)
+		requireFile(t, fs, "/home/coder/.config/app/config", "config", 0o600)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		t.Parallel()
+		a, fs := setup(t)
+		// An empty persistent volume is mounted as the home directory.
+		require.NoError(t, fs.MkdirAll("/home/coder", 0o755))
+		require.NoError(t, a.provisionHomeDir(context.Background()))
+		requireFile(t, fs, "/home/coder/.bashrc", "bashrc", 0o644)
+	})
+
+	t.Run("Initialized", func(t *testing.T) {
+		t.Parallel()
+		a, fs := setup(t)
+		require.NoError(t, afero.WriteFile(fs, "/home/coder/.profile", []byte("profile"), 0o644))
+		require.NoError(t, a.provisionHomeDir(context.Background()))
+		_, err := fs.Stat("/home/coder/.bashrc")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("NoSkeleton", func(t *testing.T) {
+		t.Parallel()
+		a, fs := setup(t)
+		a.homeSkeletonDir = "/etc/missing"
+		require.NoError(t, a.provisionHomeDir(context.Background()))
+		infos, err := afero.ReadDir(fs, "/home/coder")
+		require.NoError(t, err)
+		require.Empty(t, infos)
+	})
+}
+
+//nolint:paralleltest // It sets $HOME.
+func TestUserHomeDir(t *testing.T) {
+	u, found := currentUser()
+	if !found {
+		t.Skip("The current user isn't in /etc/passwd.")
+	}
+	t.Setenv("HOME", "/host/home")
+	fs := afero.NewMemMapFs()
+	require.NoError(t, fs.MkdirAll(u.HomeDir, 0o755))
+
+	a := &agent{filesystem: fs}
+	homedir, err := a.userHomeDir()
+	require.NoError(t, err)
+	require.Equal(t, "/host/home", homedir)
+
+	// Rootless containers can inherit $HOME from the host, so the home
+	// directory of the user is used when it doesn't exist.
+	a.userNamespace = userNamespace{Nested: true, Rootless: true}
+	homedir, err = a.userHomeDir()
+	require.NoError(t, err)
+	require.Equal(t, u.HomeDir, homedir)
+}
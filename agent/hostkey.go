@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// hostSigner returns the SSH host key of the agent. Clients ignore the
+// host key by default, since the agent authenticates with coderd, so a
+// random key is generated on every start. With a host key file, the key is
+// stable across restarts for tooling that pins host keys. The key is
+// generated and stored in the file if it doesn't exist.
+func (a *agent) hostSigner(ctx context.Context) gossh.Signer {
+	if a.sshHostKeyFile != "" {
+		signer, err := a.loadHostSigner()
+		if err == nil {
+			return signer
+		}
+		a.logger.Warn(ctx, "load ssh host key, using a random key until the agent restarts",
+			slog.F("file", a.sshHostKeyFile), slog.Error(err))
+	}
+	a.logger.Info(ctx, "generating host key")
+	randomHostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	randomSigner, err := gossh.NewSignerFromKey(randomHostKey)
+	if err != nil {
+		panic(err)
+	}
+	return randomSigner
+}
+
+// loadHostSigner reads the host key file, or generates an Ed25519 key and
+// writes it to the file if it doesn't exist. Keys in any format that
+// ssh-keygen writes can be provided.
+func (a *agent) loadHostSigner() (gossh.Signer, error) {
+	content, err := afero.ReadFile(a.filesystem, a.sshHostKeyFile)
+	if err == nil {
+		signer, err := gossh.ParsePrivateKey(content)
+		if err != nil {
+			return nil, xerrors.Errorf("parse host key: %w", err)
+		}
+		return signer, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, xerrors.Errorf("read host key: %w", err)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, xerrors.Errorf("generate host key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("marshal host key: %w", err)
+	}
+	err = a.filesystem.MkdirAll(filepath.Dir(a.sshHostKeyFile), 0o700)
+	if err == nil {
+		err = afero.WriteFile(a.filesystem, a.sshHostKeyFile, pem.EncodeToMemory(&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: der,
+		}), 0o600)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("write host key: %w", explainWriteError(err, "CODER_AGENT_SSH_HOST_KEY_FILE"))
+	}
+	return gossh.NewSignerFromKey(privateKey)
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func TestHostSigner(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Random", func(t *testing.T) {
+		t.Parallel()
+		a := &agent{
+			logger:     slogtest.Make(t, nil),
+			filesystem: afero.NewMemMapFs(),
+		}
+		first := a.hostSigner(context.Background())
+		second := a.hostSigner(context.Background())
+		require.NotEqual(t, first.PublicKey().Marshal(), second.PublicKey().Marshal())
+	})
+
+	t.Run("Persisted", func(t *testing.T) {
+		t.Parallel()
+		filesystem := afero.NewMemMapFs()
+		a := &agent{
+			logger:         slogtest.Make(t, nil),
+			filesystem:     filesystem,
+			sshHostKeyFile: "/var/lib/coder/ssh_host_key",
+		}
+		first := a.hostSigner(context.Background())
+		require.Equal(t, "ssh-ed25519", first.PublicKey().Type())
+		info, err := filesystem.Stat("/var/lib/coder/ssh_host_key")
+		require.NoError(t, err)
+		require.EqualValues(t, 0o600, info.Mode().Perm())
+
+		// The agent restarts with the same key.
+		second := a.hostSigner(context.Background())
+		require.Equal(t, first.PublicKey().Marshal(), second.PublicKey().Marshal())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Parallel()
+		filesystem := afero.NewMemMapFs()
+		require.NoError(t, afero.WriteFile(filesystem, "/ssh_host_key", []byte("invalid"), 0o600))
+		a := &agent{
+			logger:         slogtest.Make(t, nil),
+			filesystem:     filesystem,
+			sshHostKeyFile: "/ssh_host_key",
+		}
+		require.NotNil(t, a.hostSigner(context.Background()))
+		// The file isn't overwritten, since it may be provided.
+		content, err := afero.ReadFile(filesystem, "/ssh_host_key")
+		require.NoError(t, err)
+		require.Equal(t, "invalid", string(content))
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		t.Parallel()
+		a := &agent{
+			logger:         slogtest.Make(t, nil),
+			filesystem:     afero.NewReadOnlyFs(afero.NewMemMapFs()),
+			sshHostKeyFile: "/ssh_host_key",
+		}
+		require.NotNil(t, a.hostSigner(context.Background()))
+	})
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+)
+
+// applyHostname sets the hostname of the workspace and writes it to
+// /etc/hostname, so shell prompts and tools show a meaningful name
+// instead of a random container ID. This commonly requires elevated
+// privileges, so failures are logged rather than returned.
+func (a *agent) applyHostname(ctx context.Context, hostname string) {
+	if hostname == "" {
+		return
+	}
+	if a.hardenedHost {
+		a.logger.Info(ctx, "not setting hostname on a hardened host", slog.F("hostname", hostname))
+		return
+	}
+	err := setHostname(hostname)
+	if errors.Is(err, fs.ErrPermission) {
+		a.logger.Warn(ctx, "unable to set hostname", slog.F("hostname", hostname), slog.F("hint", a.mac.hint()), slog.Error(err))
+		return
+	}
+	if err != nil {
+		a.logger.Warn(ctx, "unable to set hostname", slog.F("hostname", hostname), slog.Error(err))
+		return
+	}
+	err = afero.WriteFile(a.filesystem, "/etc/hostname", []byte(hostname+"\n"), 0o644)
+	if err != nil {
+		a.logger.Warn(ctx, "set hostname, but unable to write /etc/hostname", slog.F("hostname", hostname), slog.Error(err))
+		return
+	}
+	a.logger.Info(ctx, "set hostname", slog.F("hostname", hostname))
+}
@@ -0,0 +1,7 @@
+package agent
+
+import "golang.org/x/sys/unix"
+
+func setHostname(hostname string) error {
+	return unix.Sethostname([]byte(hostname))
+}
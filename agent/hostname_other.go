@@ -0,0 +1,13 @@
+//go:build !linux
+
+package agent
+
+import (
+	"runtime"
+
+	"golang.org/x/xerrors"
+)
+
+func setHostname(_ string) error {
+	return xerrors.Errorf("setting the hostname is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// maxIdentityNonceSize limits the size of nonces that are signed.
+const maxIdentityNonceSize = 1024
+
+// generateIdentityKey generates the key the agent proves its identity to
+// clients with. It's generated when the agent starts, and registered with
+// coderd in the handshake, so it's never stored.
+func generateIdentityKey() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// identityPublicKey returns the public key that's registered with coderd.
+func (a *agent) identityPublicKey() ed25519.PublicKey {
+	//nolint:forcetypeassert // The public key of an Ed25519 key is always an ed25519.PublicKey.
+	return a.identityKey.Public().(ed25519.PublicKey)
+}
+
+// identityHandler signs a nonce from a client, which proves the client is
+// connected to the agent that registered the identity key with coderd.
+func (a *agent) identityHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req codersdk.WorkspaceAgentIdentityRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if len(req.Nonce) == 0 || len(req.Nonce) > maxIdentityNonceSize {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "A nonce of 1 to 1024 bytes is required.",
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.WorkspaceAgentIdentityResponse{
+		Signature: ed25519.Sign(a.identityKey, codersdk.WorkspaceAgentIdentityMessage(req.Nonce)),
+	})
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/netutil"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/tailnet"
+)
+
+// defaultMaxListenerConnections is how many connections each tailnet
+// listener of the agent handles at once by default.
+const defaultMaxListenerConnections = 1024
+
+const (
+	// minAcceptDelay and maxAcceptDelay bound the delay before accepting
+	// again after an error, which doubles on consecutive errors like in
+	// net/http.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// listen listens on a port of the tailnet. The listener accepts at most
+// maxListenerConnections connections at once, and more wait until one is
+// closed.
+func (a *agent) listen(network *tailnet.Conn, port int) (net.Listener, error) {
+	listener, err := network.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	return netutil.LimitListener(listener, a.maxListenerConnections), nil
+}
+
+// serveListener handles the connections of a listener in goroutines until
+// it's closed. Other errors, like running out of file descriptors, are
+// retried with a backoff, so they don't stop the listener until the agent
+// restarts.
+func (a *agent) serveListener(ctx context.Context, name string, listener net.Listener, handle func(conn net.Conn)) {
+	logger := a.logger.With(slog.F("listener", name))
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			delay = 0
+			go func() {
+				defer a.recoverPanic(ctx, name)
+				handle(conn)
+			}()
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) || ctx.Err() != nil || a.isClosed() {
+			logger.Debug(ctx, "listener closed", slog.Error(err))
+			return
+		}
+		// Releasing the reserve lets the agent report the failure
+		// while the process is out of file descriptors.
+		if a.fdReserve.release(err) {
+			logger.Error(ctx, "out of file descriptors, released the reserve", slog.Error(err))
+		}
+		delay = nextAcceptDelay(delay)
+		logger.Warn(ctx, "accept failed, retrying", slog.F("delay", delay), slog.Error(err))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// nextAcceptDelay returns the delay after an accept error that followed a
+// delay.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	delay *= 2
+	if delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	return delay
+}
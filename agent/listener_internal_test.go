@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/testutil"
+)
+
+// errorListener returns the results in order, and then that it's closed.
+type errorListener struct {
+	net.Listener
+	results []error
+}
+
+func (l *errorListener) Accept() (net.Conn, error) {
+	if len(l.results) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.results[0]
+	l.results = l.results[1:]
+	if err != nil {
+		return nil, err
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestServeListener(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitShort)
+	defer cancel()
+	a := &agent{
+		logger:    slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}),
+		closed:    make(chan struct{}),
+		fdReserve: newFDReserve(1),
+	}
+	// Transient errors don't stop the listener, and running out of file
+	// descriptors releases the reserve.
+	listener := &errorListener{
+		results: []error{syscall.EMFILE, syscall.EMFILE, nil},
+	}
+	handled := make(chan net.Conn, 1)
+	a.serveListener(ctx, "test", listener, func(conn net.Conn) {
+		handled <- conn
+	})
+	select {
+	case conn := <-handled:
+		_ = conn.Close()
+	case <-ctx.Done():
+		t.Fatal("connection after errors wasn't handled")
+	}
+	require.EqualValues(t, 1, a.fdReserve.stats())
+}
+
+func TestNextAcceptDelay(t *testing.T) {
+	t.Parallel()
+
+	delay := nextAcceptDelay(0)
+	require.Equal(t, minAcceptDelay, delay)
+	require.Equal(t, 2*minAcceptDelay, nextAcceptDelay(delay))
+	require.Equal(t, maxAcceptDelay, nextAcceptDelay(maxAcceptDelay))
+	require.Equal(t, maxAcceptDelay, nextAcceptDelay(time.Duration(float64(maxAcceptDelay)*0.75)))
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// defaultStartupLogMaxSize is the size the startup script log is
+	// limited to, unless configured otherwise.
+	defaultStartupLogMaxSize = 10 << 20
+	// logTruncatedMarker separates the head and tail of a log that
+	// exceeded its limit.
+	logTruncatedMarker = "\n\n[... output truncated by the Coder agent ...]\n\n"
+)
+
+// logFile is the part of a file the log limit writer uses.
+type logFile interface {
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// logLimitWriter limits the size of a log by keeping its head and tail.
+// Once the head is written, the tail is rewritten in place behind a
+// truncation marker whenever the log would exceed its limit, so a runaway
+// script can't fill the disk. Rewrites keep half of the tail, so each byte
+// is rewritten a bounded number of times, and Close writes the full tail.
+type logLimitWriter struct {
+	mutex    sync.Mutex
+	file     logFile
+	headSize int64
+	tailSize int64
+
+	// written is the size of the file.
+	written   int64
+	truncated bool
+	// tail holds the most recent output once the head is written.
+	tail []byte
+}
+
+// newLogLimitWriter limits the file to maxSize, split between the head and
+// tail of the log.
+func newLogLimitWriter(file logFile, maxSize int64) *logLimitWriter {
+	// The marker counts towards the limit.
+	headSize := (maxSize - int64(len(logTruncatedMarker))) / 2
+	if headSize < 0 {
+		headSize = 0
+	}
+	return &logLimitWriter{
+		file:     file,
+		headSize: headSize,
+		tailSize: headSize,
+	}
+}
+
+func (w *logLimitWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	n := len(p)
+	if w.written < w.headSize {
+		head := p
+		if int64(len(head)) > w.headSize-w.written {
+			head = head[:w.headSize-w.written]
+		}
+		written, err := w.file.Write(head)
+		w.written += int64(written)
+		if err != nil {
+			return written, err
+		}
+		p = p[len(head):]
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+
+	w.appendTail(p)
+	if w.written+int64(len(p)) <= w.headSize+int64(len(logTruncatedMarker))+w.tailSize {
+		// The log fits, either because the marker would take as much
+		// space as truncating saves, or the rewritten tail has room.
+		written, err := w.file.Write(p)
+		w.written += int64(written)
+		if err != nil {
+			return n - len(p) + written, err
+		}
+		return n, nil
+	}
+	err := w.rewriteTail(w.tailSize / 2)
+	if err != nil {
+		return n - len(p), err
+	}
+	return n, nil
+}
+
+// Close writes the full tail of a truncated log. It doesn't close the file.
+func (w *logLimitWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.truncated {
+		return nil
+	}
+	return w.rewriteTail(w.tailSize)
+}
+
+// appendTail keeps the most recent output in memory. The buffer is only
+// compacted when it's twice the size of the tail, so output isn't copied
+// on every write.
+func (w *logLimitWriter) appendTail(p []byte) {
+	if int64(len(p)) >= w.tailSize {
+		w.tail = append(w.tail[:0], p[int64(len(p))-w.tailSize:]...)
+		return
+	}
+	if int64(len(w.tail)+len(p)) > 2*w.tailSize {
+		keep := w.tailSize - int64(len(p))
+		w.tail = append(w.tail[:0], w.tail[int64(len(w.tail))-keep:]...)
+	}
+	w.tail = append(w.tail, p...)
+}
+
+// rewriteTail replaces everything after the head with the truncation marker
+// and the most recent size bytes of output.
+func (w *logLimitWriter) rewriteTail(size int64) error {
+	tail := w.tail
+	if int64(len(tail)) > size {
+		tail = tail[int64(len(tail))-size:]
+	}
+	data := append([]byte(logTruncatedMarker), tail...)
+	_, err := w.file.WriteAt(data, w.headSize)
+	if err != nil {
+		return xerrors.Errorf("write tail: %w", err)
+	}
+	w.written = w.headSize + int64(len(data))
+	err = w.file.Truncate(w.written)
+	if err != nil {
+		return xerrors.Errorf("truncate: %w", err)
+	}
+	// Writes continue after the tail.
+	_, err = w.file.Seek(w.written, io.SeekStart)
+	if err != nil {
+		return xerrors.Errorf("seek: %w", err)
+	}
+	w.truncated = true
+	return nil
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLimitWriter(t *testing.T) {
+	t.Parallel()
+
+	maxSize := int64(len(logTruncatedMarker)) + 200
+
+	t.Run("UnderLimit", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		file, err := fs.Create("log")
+		require.NoError(t, err)
+		w := newLogLimitWriter(file, maxSize)
+
+		output := bytes.Repeat([]byte("a"), int(maxSize))
+		_, err = w.Write(output)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		content, err := afero.ReadFile(fs, "log")
+		require.NoError(t, err)
+		require.Equal(t, output, content)
+	})
+
+	t.Run("HeadAndTail", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		file, err := fs.Create("log")
+		require.NoError(t, err)
+		w := newLogLimitWriter(file, maxSize)
+
+		var output bytes.Buffer
+		for i := 0; i < 1000; i++ {
+			line := fmt.Sprintf("line %d\n", i)
+			output.WriteString(line)
+			n, err := w.Write([]byte(line))
+			require.NoError(t, err)
+			require.Equal(t, len(line), n)
+
+			// The limit is kept while the script runs.
+			info, err := fs.Stat("log")
+			require.NoError(t, err)
+			require.LessOrEqual(t, info.Size(), maxSize)
+		}
+		require.NoError(t, w.Close())
+
+		content, err := afero.ReadFile(fs, "log")
+		require.NoError(t, err)
+		require.EqualValues(t, maxSize, len(content))
+		expected := append(append(output.Bytes()[:100:100], logTruncatedMarker...), output.Bytes()[output.Len()-100:]...)
+		require.Equal(t, string(expected), string(content))
+	})
+
+	t.Run("LargeWrite", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		file, err := fs.Create("log")
+		require.NoError(t, err)
+		w := newLogLimitWriter(file, maxSize)
+
+		output := append(bytes.Repeat([]byte("h"), 100), bytes.Repeat([]byte("x"), 1000)...)
+		output = append(output, bytes.Repeat([]byte("t"), 100)...)
+		_, err = w.Write(output)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		content, err := afero.ReadFile(fs, "log")
+		require.NoError(t, err)
+		require.Equal(t, string(bytes.Repeat([]byte("h"), 100))+logTruncatedMarker+string(bytes.Repeat([]byte("t"), 100)), string(content))
+	})
+}
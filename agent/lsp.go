@@ -0,0 +1,793 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/retry"
+)
+
+const (
+	// maxLanguageServerMessageSize bounds the size of a single message,
+	// which can contain the full contents of a document.
+	maxLanguageServerMessageSize = 64 << 20
+	// languageServerClientBuffer is the number of messages buffered for
+	// a client before it's considered too slow and disconnected.
+	languageServerClientBuffer = 1024
+	// languageServerInitializeTimeout is how long a language server has
+	// to respond to the initialize request.
+	languageServerInitializeTimeout = 5 * time.Minute
+	// languageServerInitTimeout is how long the agent waits for a client
+	// to select a language server.
+	languageServerInitTimeout = 10 * time.Second
+)
+
+var languageServerNameRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// startLanguageServers starts the language servers and keeps them running
+// until the context is canceled.
+func (a *agent) startLanguageServers(ctx context.Context, configs []codersdk.WorkspaceAgentLanguageServer, directory string) {
+	for _, config := range configs {
+		config := config
+		if !languageServerNameRegex.MatchString(config.Name) {
+			a.logger.Warn(ctx, "invalid language server name", slog.F("name", config.Name))
+			continue
+		}
+		if config.Directory == "" {
+			config.Directory = directory
+		}
+		server := &languageServer{
+			logger:  a.logger.Named("lsp").With(slog.F("name", config.Name)),
+			config:  config,
+			ready:   make(chan struct{}),
+			clients: map[*languageServerClient]struct{}{},
+			createCommand: func(ctx context.Context) (*exec.Cmd, error) {
+				cmd, err := a.createCommand(ctx, config.Command, nil)
+				if err != nil {
+					return nil, err
+				}
+				if config.Directory != "" {
+					cmd.Dir = config.Directory
+				}
+				return cmd, nil
+			},
+			filesystem: a.filesystem,
+			logFile:    filepath.Join(a.tempDir, fmt.Sprintf("coder-language-server-%s.log", config.Name)),
+		}
+
+		a.languageServersMutex.Lock()
+		if _, ok := a.languageServers[config.Name]; ok {
+			a.languageServersMutex.Unlock()
+			a.logger.Warn(ctx, "duplicate language server name", slog.F("name", config.Name))
+			continue
+		}
+		a.languageServers[config.Name] = server
+		a.languageServersMutex.Unlock()
+
+		a.closeMutex.Lock()
+		if a.isClosed() {
+			a.closeMutex.Unlock()
+			return
+		}
+		a.connCloseWait.Add(1)
+		a.closeMutex.Unlock()
+		go func() {
+			defer a.connCloseWait.Done()
+			server.run(ctx)
+		}()
+	}
+}
+
+// handleLanguageServerConn connects a client to the language server it
+// selected with a codersdk.LanguageServerInit.
+func (a *agent) handleLanguageServerConn(ctx context.Context, conn net.Conn) {
+	var msg codersdk.LanguageServerInit
+	err := readInitMessage(conn, languageServerInitTimeout, math.MaxUint16, &msg)
+	if err != nil {
+		a.logger.Debug(ctx, "read language server init", slog.Error(err))
+		_ = conn.Close()
+		return
+	}
+
+	a.languageServersMutex.Lock()
+	server, ok := a.languageServers[msg.Name]
+	a.languageServersMutex.Unlock()
+	if !ok {
+		a.logger.Debug(ctx, "unknown language server requested", slog.F("name", msg.Name))
+		_ = conn.Close()
+		return
+	}
+	server.serve(ctx, conn)
+}
+
+// languageServer is a language server process that's kept running and
+// shared by every client connected to it. The agent initializes the
+// server itself so indexing begins before an editor connects, and
+// answers the initialize request of each client with the result.
+//
+// Requests from clients are forwarded with rewritten IDs so responses
+// can be routed back to the client that sent them. Notifications from
+// the server are sent to every client, and requests from the server are
+// sent to a single client.
+type languageServer struct {
+	logger        slog.Logger
+	config        codersdk.WorkspaceAgentLanguageServer
+	createCommand func(ctx context.Context) (*exec.Cmd, error)
+	filesystem    afero.Fs
+	logFile       string
+
+	// stdinMutex serializes writes to the server. It must never be
+	// held with mutex, or a server blocked writing to a client would
+	// deadlock with a client blocked writing to the server.
+	stdinMutex sync.Mutex
+	stdin      io.WriteCloser
+
+	mutex sync.Mutex
+	// process is the running process of the server, if any.
+	process *os.Process
+	// ready is closed once the server has been initialized.
+	ready            chan struct{}
+	initializeResult json.RawMessage
+	nextID           int64
+	pending          map[int64]*languageServerRequest
+	clients          map[*languageServerClient]struct{}
+	// documents counts the clients that have each document open, so
+	// the server sees a document opened once and closed once.
+	documents map[string]int
+}
+
+// languageServerRequest is a request forwarded to the server that's
+// waiting on a response.
+type languageServerRequest struct {
+	// client is nil for requests made by the agent itself.
+	client *languageServerClient
+	id     json.RawMessage
+	// response receives the response to requests made by the agent.
+	response chan map[string]json.RawMessage
+}
+
+type languageServerClient struct {
+	conn      net.Conn
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	// documents are the URIs of the documents opened by the client.
+	documents map[string]struct{}
+}
+
+// send queues a message to the client. Clients that can't keep up are
+// disconnected rather than blocking the server.
+func (c *languageServerClient) send(msg []byte) {
+	select {
+	case <-c.closed:
+	case c.out <- msg:
+	default:
+		c.close()
+	}
+}
+
+func (c *languageServerClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		_ = c.conn.Close()
+	})
+}
+
+// run starts the language server, restarting it whenever it exits until
+// the context is canceled.
+func (s *languageServer) run(ctx context.Context) {
+	for retrier := retry.New(time.Second, time.Minute); retrier.Wait(ctx); {
+		err := s.start(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn(ctx, "language server exited", slog.Error(err))
+	}
+}
+
+// running returns whether the process of the language server runs.
+func (s *languageServer) running() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.process != nil
+}
+
+// restart kills the process of the language server, which run starts
+// again. It returns false if the server isn't running.
+func (s *languageServer) restart() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.process == nil {
+		return false
+	}
+	_ = s.process.Kill()
+	return true
+}
+
+// start runs the language server until it exits.
+func (s *languageServer) start(ctx context.Context) error {
+	cmd, err := s.createCommand(ctx)
+	if err != nil {
+		return xerrors.Errorf("create command: %w", err)
+	}
+	logFile, err := s.filesystem.OpenFile(s.logFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return xerrors.Errorf("open log file: %w", err)
+	}
+	defer logFile.Close()
+	cmd.Stderr = logFile
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return xerrors.Errorf("stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return xerrors.Errorf("stdout pipe: %w", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return xerrors.Errorf("start: %w", err)
+	}
+	s.logger.Info(ctx, "started language server", slog.F("command", s.config.Command))
+
+	s.stdinMutex.Lock()
+	s.stdin = stdin
+	s.stdinMutex.Unlock()
+	s.mutex.Lock()
+	s.process = cmd.Process
+	s.pending = map[int64]*languageServerRequest{}
+	s.documents = map[string]int{}
+	s.mutex.Unlock()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		reader := bufio.NewReader(stdout)
+		for {
+			msg, err := readLanguageServerMessage(reader)
+			if err != nil {
+				if !xerrors.Is(err, io.EOF) {
+					s.logger.Warn(ctx, "read language server message", slog.Error(err))
+				}
+				return
+			}
+			s.handleServerMessage(ctx, msg)
+		}
+	}()
+
+	initCtx, initCancel := context.WithTimeout(ctx, languageServerInitializeTimeout)
+	err = s.initialize(initCtx)
+	initCancel()
+	if err != nil {
+		s.logger.Warn(ctx, "initialize language server", slog.Error(err))
+		_ = cmd.Process.Kill()
+	}
+
+	<-readDone
+	err = cmd.Wait()
+
+	// Disconnect clients, since the state of the new
+	// server won't match what they expect.
+	s.stdinMutex.Lock()
+	s.stdin = nil
+	s.stdinMutex.Unlock()
+	s.mutex.Lock()
+	for client := range s.clients {
+		client.close()
+	}
+	s.clients = map[*languageServerClient]struct{}{}
+	s.process = nil
+	s.pending = nil
+	s.initializeResult = nil
+	select {
+	case <-s.ready:
+		s.ready = make(chan struct{})
+	default:
+	}
+	s.mutex.Unlock()
+	return err
+}
+
+// initialize sends the initialize request to the server on behalf of
+// every client that will connect to it.
+func (s *languageServer) initialize(ctx context.Context) error {
+	rootURI := (&url.URL{Scheme: "file", Path: filepath.ToSlash(s.config.Directory)}).String()
+	params, err := json.Marshal(map[string]interface{}{
+		"processId": os.Getpid(),
+		"clientInfo": map[string]string{
+			"name": "coder-agent",
+		},
+		"rootUri": rootURI,
+		"workspaceFolders": []map[string]string{{
+			"uri":  rootURI,
+			"name": filepath.Base(s.config.Directory),
+		}},
+		"capabilities": languageServerClientCapabilities,
+	})
+	if err != nil {
+		return err
+	}
+	response := make(chan map[string]json.RawMessage, 1)
+	s.mutex.Lock()
+	id := s.addPendingLocked(&languageServerRequest{response: response})
+	s.mutex.Unlock()
+	err = s.writeServer(map[string]json.RawMessage{
+		"jsonrpc": json.RawMessage(`"2.0"`),
+		"id":      id,
+		"method":  json.RawMessage(`"initialize"`),
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	var msg map[string]json.RawMessage
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case msg = <-response:
+	}
+	if rawErr, ok := msg["error"]; ok && !isJSONNull(rawErr) {
+		return xerrors.Errorf("initialize: %s", rawErr)
+	}
+	err = s.writeServer(map[string]json.RawMessage{
+		"jsonrpc": json.RawMessage(`"2.0"`),
+		"method":  json.RawMessage(`"initialized"`),
+		"params":  json.RawMessage(`{}`),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.initializeResult = msg["result"]
+	close(s.ready)
+	s.mutex.Unlock()
+	s.logger.Info(ctx, "initialized language server")
+	return nil
+}
+
+// languageServerClientCapabilities are advertised to the server on
+// behalf of every client. Features that editors commonly support are
+// included so the server enables them.
+var languageServerClientCapabilities = map[string]interface{}{
+	"workspace": map[string]interface{}{
+		"applyEdit":              true,
+		"configuration":          true,
+		"workspaceFolders":       true,
+		"didChangeConfiguration": map[string]bool{"dynamicRegistration": true},
+		"didChangeWatchedFiles":  map[string]bool{"dynamicRegistration": true},
+		"workspaceEdit":          map[string]bool{"documentChanges": true},
+	},
+	"textDocument": map[string]interface{}{
+		"synchronization": map[string]bool{"didSave": true, "dynamicRegistration": true},
+		"completion": map[string]interface{}{
+			"completionItem": map[string]bool{"snippetSupport": true},
+		},
+		"hover":              map[string][]string{"contentFormat": {"markdown", "plaintext"}},
+		"publishDiagnostics": map[string]bool{"relatedInformation": true},
+		"codeAction":         map[string]bool{"dynamicRegistration": true},
+	},
+	"window": map[string]bool{
+		"workDoneProgress": true,
+	},
+}
+
+// serve proxies messages between the client and the server until the
+// client disconnects.
+func (s *languageServer) serve(ctx context.Context, conn net.Conn) {
+	client := &languageServerClient{
+		conn:      conn,
+		out:       make(chan []byte, languageServerClientBuffer),
+		closed:    make(chan struct{}),
+		documents: map[string]struct{}{},
+	}
+	defer client.close()
+
+	s.mutex.Lock()
+	ready := s.ready
+	s.mutex.Unlock()
+	select {
+	case <-ctx.Done():
+		return
+	case <-ready:
+	}
+	s.mutex.Lock()
+	if s.ready != ready {
+		// The server restarted while waiting.
+		s.mutex.Unlock()
+		return
+	}
+	s.clients[client] = struct{}{}
+	s.mutex.Unlock()
+	defer s.removeClient(ctx, client)
+
+	go func() {
+		for {
+			select {
+			case <-client.closed:
+				return
+			case msg := <-client.out:
+				err := writeLanguageServerMessage(conn, msg)
+				if err != nil {
+					client.close()
+					return
+				}
+			}
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := readLanguageServerMessage(reader)
+		if err != nil {
+			return
+		}
+		var msg map[string]json.RawMessage
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			s.logger.Debug(ctx, "invalid message from client", slog.Error(err))
+			return
+		}
+		if !s.handleClientMessage(ctx, client, msg) {
+			return
+		}
+	}
+}
+
+// handleClientMessage handles a message from a client. It returns false
+// if the client should be disconnected.
+func (s *languageServer) handleClientMessage(ctx context.Context, client *languageServerClient, msg map[string]json.RawMessage) bool {
+	var method string
+	if rawMethod, ok := msg["method"]; ok {
+		_ = json.Unmarshal(rawMethod, &method)
+	}
+	id, hasID := msg["id"]
+
+	if method == "" {
+		// This is a response to a request from the server.
+		return s.writeServer(msg) == nil
+	}
+	if hasID {
+		switch method {
+		case "initialize":
+			s.mutex.Lock()
+			result := s.initializeResult
+			s.mutex.Unlock()
+			s.reply(client, id, result)
+			return true
+		case "shutdown":
+			// The server is shared, so it outlives the client.
+			s.reply(client, id, json.RawMessage(`null`))
+			return true
+		}
+		s.mutex.Lock()
+		if s.pending == nil {
+			s.mutex.Unlock()
+			return false
+		}
+		msg["id"] = s.addPendingLocked(&languageServerRequest{client: client, id: id})
+		s.mutex.Unlock()
+		return s.writeServer(msg) == nil
+	}
+
+	switch method {
+	case "initialized":
+		return true
+	case "exit":
+		return false
+	case "$/cancelRequest":
+		return s.cancelRequest(client, msg)
+	case "textDocument/didOpen":
+		return s.openDocument(client, msg)
+	case "textDocument/didClose":
+		return s.closeDocument(client, msg)
+	}
+	return s.writeServer(msg) == nil
+}
+
+// handleServerMessage routes a message from the server to clients.
+func (s *languageServer) handleServerMessage(ctx context.Context, data []byte) {
+	var msg map[string]json.RawMessage
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		s.logger.Debug(ctx, "invalid message from language server", slog.Error(err))
+		return
+	}
+	_, hasMethod := msg["method"]
+	rawID, hasID := msg["id"]
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case hasMethod && hasID:
+		// Requests from the server are answered by a single client.
+		for client := range s.clients {
+			client.send(data)
+			return
+		}
+		go func() {
+			_ = s.writeServer(map[string]json.RawMessage{
+				"jsonrpc": json.RawMessage(`"2.0"`),
+				"id":      rawID,
+				"result":  json.RawMessage(`null`),
+			})
+		}()
+	case hasMethod:
+		for client := range s.clients {
+			client.send(data)
+		}
+	case hasID:
+		id, err := strconv.ParseInt(string(rawID), 10, 64)
+		if err != nil {
+			return
+		}
+		request, ok := s.pending[id]
+		if !ok {
+			return
+		}
+		delete(s.pending, id)
+		if request.client == nil {
+			request.response <- msg
+			return
+		}
+		msg["id"] = request.id
+		data, err = json.Marshal(msg)
+		if err != nil {
+			return
+		}
+		request.client.send(data)
+	}
+}
+
+// cancelRequest rewrites the ID of a request being canceled by the
+// client to the ID it was forwarded to the server with.
+func (s *languageServer) cancelRequest(client *languageServerClient, msg map[string]json.RawMessage) bool {
+	var params struct {
+		ID json.RawMessage `json:"id"`
+	}
+	err := json.Unmarshal(msg["params"], &params)
+	if err != nil {
+		return true
+	}
+	s.mutex.Lock()
+	var serverID int64 = -1
+	for id, request := range s.pending {
+		if request.client == client && string(request.id) == string(params.ID) {
+			serverID = id
+			break
+		}
+	}
+	s.mutex.Unlock()
+	if serverID < 0 {
+		return true
+	}
+	msg["params"] = json.RawMessage(fmt.Sprintf(`{"id":%d}`, serverID))
+	return s.writeServer(msg) == nil
+}
+
+// openDocument forwards the first open of a document to the server. When
+// another client opens a document that's already open, its contents are
+// sent as a change instead so the server sees a single open document.
+func (s *languageServer) openDocument(client *languageServerClient, msg map[string]json.RawMessage) bool {
+	var params struct {
+		TextDocument struct {
+			URI     string `json:"uri"`
+			Version int    `json:"version"`
+			Text    string `json:"text"`
+		} `json:"textDocument"`
+	}
+	err := json.Unmarshal(msg["params"], &params)
+	if err != nil {
+		return s.writeServer(msg) == nil
+	}
+	uri := params.TextDocument.URI
+
+	s.mutex.Lock()
+	if _, ok := client.documents[uri]; ok {
+		s.mutex.Unlock()
+		return true
+	}
+	client.documents[uri] = struct{}{}
+	s.documents[uri]++
+	opened := s.documents[uri] == 1
+	s.mutex.Unlock()
+	if opened {
+		return s.writeServer(msg) == nil
+	}
+
+	change, err := json.Marshal(map[string]interface{}{
+		"textDocument": map[string]interface{}{
+			"uri":     uri,
+			"version": params.TextDocument.Version,
+		},
+		"contentChanges": []map[string]string{{
+			"text": params.TextDocument.Text,
+		}},
+	})
+	if err != nil {
+		return false
+	}
+	return s.writeServer(map[string]json.RawMessage{
+		"jsonrpc": json.RawMessage(`"2.0"`),
+		"method":  json.RawMessage(`"textDocument/didChange"`),
+		"params":  change,
+	}) == nil
+}
+
+// closeDocument forwards the close of a document once no clients have it
+// open.
+func (s *languageServer) closeDocument(client *languageServerClient, msg map[string]json.RawMessage) bool {
+	var params struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+	}
+	err := json.Unmarshal(msg["params"], &params)
+	if err != nil {
+		return s.writeServer(msg) == nil
+	}
+	s.mutex.Lock()
+	closed := s.releaseDocumentLocked(client, params.TextDocument.URI)
+	s.mutex.Unlock()
+	if !closed {
+		return true
+	}
+	return s.writeServer(msg) == nil
+}
+
+// releaseDocumentLocked removes the document from the client, and returns
+// whether no clients have it open anymore.
+func (s *languageServer) releaseDocumentLocked(client *languageServerClient, uri string) bool {
+	if _, ok := client.documents[uri]; !ok {
+		return false
+	}
+	delete(client.documents, uri)
+	s.documents[uri]--
+	if s.documents[uri] > 0 {
+		return false
+	}
+	delete(s.documents, uri)
+	return true
+}
+
+// removeClient disconnects the client, closing the documents that only
+// it had open and dropping its pending requests.
+func (s *languageServer) removeClient(ctx context.Context, client *languageServerClient) {
+	client.close()
+
+	s.mutex.Lock()
+	delete(s.clients, client)
+	for id, request := range s.pending {
+		if request.client == client {
+			delete(s.pending, id)
+		}
+	}
+	closed := make([]string, 0)
+	if s.documents != nil {
+		for uri := range client.documents {
+			if s.releaseDocumentLocked(client, uri) {
+				closed = append(closed, uri)
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, uri := range closed {
+		params, err := json.Marshal(map[string]interface{}{
+			"textDocument": map[string]string{"uri": uri},
+		})
+		if err != nil {
+			continue
+		}
+		err = s.writeServer(map[string]json.RawMessage{
+			"jsonrpc": json.RawMessage(`"2.0"`),
+			"method":  json.RawMessage(`"textDocument/didClose"`),
+			"params":  params,
+		})
+		if err != nil {
+			s.logger.Debug(ctx, "close document for disconnected client", slog.Error(err))
+			return
+		}
+	}
+}
+
+func (s *languageServer) addPendingLocked(request *languageServerRequest) json.RawMessage {
+	s.nextID++
+	s.pending[s.nextID] = request
+	return json.RawMessage(strconv.FormatInt(s.nextID, 10))
+}
+
+func (*languageServer) reply(client *languageServerClient, id, result json.RawMessage) {
+	if result == nil {
+		result = json.RawMessage(`null`)
+	}
+	data, err := json.Marshal(map[string]json.RawMessage{
+		"jsonrpc": json.RawMessage(`"2.0"`),
+		"id":      id,
+		"result":  result,
+	})
+	if err != nil {
+		return
+	}
+	client.send(data)
+}
+
+func (s *languageServer) writeServer(msg map[string]json.RawMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.stdinMutex.Lock()
+	defer s.stdinMutex.Unlock()
+	if s.stdin == nil {
+		return xerrors.New("language server is not running")
+	}
+	return writeLanguageServerMessage(s.stdin, data)
+}
+
+func isJSONNull(data json.RawMessage) bool {
+	return strings.TrimSpace(string(data)) == "null"
+}
+
+// readLanguageServerMessage reads a message framed with the base protocol
+// of the Language Server Protocol.
+//
+// https://microsoft.github.io/language-server-protocol/specifications/lsp/3.17/specification/#baseProtocol
+func readLanguageServerMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			continue
+		}
+		length, err = strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, xerrors.Errorf("parse content length: %w", err)
+		}
+	}
+	if length < 0 {
+		return nil, xerrors.New("missing content length")
+	}
+	if length > maxLanguageServerMessageSize {
+		return nil, xerrors.Errorf("message of %d bytes exceeds the maximum size", length)
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeLanguageServerMessage(w io.Writer, data []byte) error {
+	_, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
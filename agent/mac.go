@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/pty"
+)
+
+// macStatus is the mandatory access control that confines the agent.
+// Policies of hardened hosts commonly deny allocating PTYs and changing
+// the hostname, which fail with permission errors even as root.
+type macStatus struct {
+	// SELinux is "enforcing" or "permissive" when SELinux is enabled.
+	SELinux string
+	// AppArmor is the AppArmor profile of the agent when it's enforced,
+	// e.g. "docker-default".
+	AppArmor string
+}
+
+// detectMAC reads the SELinux mode and the AppArmor profile of the agent.
+func detectMAC(filesystem afero.Fs) macStatus {
+	var status macStatus
+	enforce, err := afero.ReadFile(filesystem, "/sys/fs/selinux/enforce")
+	if err == nil {
+		switch strings.TrimSpace(string(enforce)) {
+		case "1":
+			status.SELinux = "enforcing"
+		case "0":
+			status.SELinux = "permissive"
+		}
+	}
+	// The profile is formatted as "<name> (<mode>)", or "unconfined".
+	for _, path := range []string{"/proc/self/attr/apparmor/current", "/proc/self/attr/current"} {
+		current, err := afero.ReadFile(filesystem, path)
+		if err != nil {
+			continue
+		}
+		profile := strings.TrimRight(string(current), "\x00\n")
+		name, mode, ok := strings.Cut(profile, " (")
+		if ok && strings.TrimSuffix(mode, ")") == "enforce" {
+			status.AppArmor = name
+		}
+		break
+	}
+	return status
+}
+
+// enforced returns whether a policy that can deny operations is enforced.
+func (s macStatus) enforced() bool {
+	return s.SELinux == "enforcing" || s.AppArmor != ""
+}
+
+// hint explains where to find the denial of an operation, to be logged
+// when it fails with a permission error.
+func (s macStatus) hint() string {
+	switch {
+	case s.SELinux == "enforcing":
+		return "SELinux is enforcing, check the audit log for denials (e.g. ausearch -m avc) or run the agent with the hardened host option"
+	case s.AppArmor != "":
+		return "the AppArmor profile " + s.AppArmor + " is enforced, check the kernel log for denials (e.g. dmesg | grep apparmor) or run the agent with the hardened host option"
+	default:
+		return "no mandatory access control was detected, the agent may lack privileges"
+	}
+}
+
+// logMAC logs the mandatory access control of the agent at startup, so
+// denials can be attributed to it.
+func (a *agent) logMAC(ctx context.Context) {
+	if !a.mac.enforced() {
+		return
+	}
+	a.logger.Info(ctx, "mandatory access control is enforced",
+		slog.F("selinux", a.mac.SELinux),
+		slog.F("apparmor_profile", a.mac.AppArmor),
+		slog.F("hardened_host", a.hardenedHost))
+}
+
+// startSessionPTY starts a command with a PTY. PTYs are virtual on hardened
+// hosts, and after allocating a PTY was denied, since every later attempt
+// would be denied too.
+func (a *agent) startSessionPTY(ctx context.Context, cmd *exec.Cmd, opts ...pty.StartOption) (pty.PTY, pty.Process, error) {
+	if a.hardenedHost || a.ptyDenied.Load() {
+		return pty.StartVirtual(cmd, opts...)
+	}
+	ptty, process, err := a.startPTY(cmd, opts...)
+	var allocateErr *pty.AllocateError
+	if err == nil || !errors.As(err, &allocateErr) || !errors.Is(err, fs.ErrPermission) {
+		return ptty, process, err
+	}
+	if !a.ptyDenied.Swap(true) {
+		a.logger.Warn(ctx, "allocating a pty was denied, sessions use virtual ptys without line editing",
+			slog.F("hint", a.mac.hint()), slog.Error(err))
+	}
+	return pty.StartVirtual(cmd, opts...)
+}
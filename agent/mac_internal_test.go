@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/pty"
+)
+
+func TestDetectMAC(t *testing.T) {
+	t.Parallel()
+
+	t.Run("None", func(t *testing.T) {
+		t.Parallel()
+		status := detectMAC(afero.NewMemMapFs())
+		require.False(t, status.enforced())
+	})
+
+	t.Run("SELinux", func(t *testing.T) {
+		t.Parallel()
+		filesystem := afero.NewMemMapFs()
+		require.NoError(t, afero.WriteFile(filesystem, "/sys/fs/selinux/enforce", []byte("1"), 0o644))
+		status := detectMAC(filesystem)
+		require.Equal(t, "enforcing", status.SELinux)
+		require.True(t, status.enforced())
+		require.Contains(t, status.hint(), "SELinux")
+
+		require.NoError(t, afero.WriteFile(filesystem, "/sys/fs/selinux/enforce", []byte("0"), 0o644))
+		status = detectMAC(filesystem)
+		require.Equal(t, "permissive", status.SELinux)
+		require.False(t, status.enforced())
+	})
+
+	t.Run("AppArmor", func(t *testing.T) {
+		t.Parallel()
+		filesystem := afero.NewMemMapFs()
+		require.NoError(t, afero.WriteFile(filesystem, "/proc/self/attr/current", []byte("docker-default (enforce)\n"), 0o644))
+		status := detectMAC(filesystem)
+		require.Equal(t, "docker-default", status.AppArmor)
+		require.True(t, status.enforced())
+		require.Contains(t, status.hint(), "docker-default")
+	})
+
+	t.Run("AppArmorUnconfined", func(t *testing.T) {
+		t.Parallel()
+		filesystem := afero.NewMemMapFs()
+		require.NoError(t, afero.WriteFile(filesystem, "/proc/self/attr/current", []byte("unconfined\n"), 0o644))
+		require.False(t, detectMAC(filesystem).enforced())
+	})
+}
+
+func TestStartSessionPTY(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the test command requires a POSIX shell")
+	}
+
+	attempts := 0
+	a := &agent{
+		logger: slogtest.Make(t, nil),
+		startPTY: func(cmd *exec.Cmd, opt ...pty.StartOption) (pty.PTY, pty.Process, error) {
+			attempts++
+			return nil, nil, &pty.AllocateError{Err: &os.PathError{Op: "open", Path: "/dev/ptmx", Err: os.ErrPermission}}
+		},
+	}
+	for i := 0; i < 2; i++ {
+		ptty, process, err := a.startSessionPTY(context.Background(), exec.Command("sh", "-c", "echo hello"))
+		require.NoError(t, err)
+		require.Equal(t, "virtual", ptty.Name())
+		output := make([]byte, len("hello\n"))
+		_, err = io.ReadFull(ptty.Output().Reader, output)
+		require.NoError(t, err)
+		require.Equal(t, "hello\n", string(output))
+		require.NoError(t, process.Wait())
+		require.NoError(t, ptty.Close())
+	}
+	// PTYs aren't allocated again once they're denied.
+	require.Equal(t, 1, attempts)
+}
@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// validateMetadata checks metadata before it's applied. Metadata with
+// required fields the agent doesn't know is rejected, since ignoring them
+// could disable restrictions. Other unknown fields are logged and ignored,
+// and invalid values are replaced with the defaults.
+func (a *agent) validateMetadata(ctx context.Context, metadata codersdk.WorkspaceAgentMetadata) (codersdk.WorkspaceAgentMetadata, error) {
+	logger := a.logger.With(
+		slog.F("metadata_version", metadata.Version),
+		slog.F("supported_version", codersdk.WorkspaceAgentMetadataVersion),
+	)
+	if unsupported := metadata.UnsupportedRequiredFields(); len(unsupported) > 0 {
+		logger.Error(ctx, "metadata has required fields this agent doesn't support", slog.F("fields", unsupported))
+		return codersdk.WorkspaceAgentMetadata{}, codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorMetadataUnsupported,
+			xerrors.Errorf("unsupported required fields: %v", unsupported))
+	}
+	if len(metadata.UnknownFields) > 0 {
+		logger.Warn(ctx, "ignoring metadata fields this agent doesn't know", slog.F("fields", metadata.UnknownFields))
+	} else if metadata.Version > codersdk.WorkspaceAgentMetadataVersion {
+		logger.Info(ctx, "metadata is newer than this agent")
+	}
+
+	var invalid []string
+	clamp := func(name string, value *int32) {
+		if *value < 0 {
+			invalid = append(invalid, name)
+			*value = 0
+		}
+	}
+	clamp("keepalive_interval_seconds", &metadata.KeepAliveIntervalSeconds)
+	clamp("reconnecting_pty_timeout_seconds", &metadata.ReconnectingPTYTimeoutSeconds)
+	clamp("reconnect_max_interval_seconds", &metadata.ReconnectMaxIntervalSeconds)
+	if metadata.ReconnectingPTYBufferSize < 0 {
+		invalid = append(invalid, "reconnecting_pty_buffer_size")
+		metadata.ReconnectingPTYBufferSize = 0
+	}
+	if len(invalid) > 0 {
+		logger.Warn(ctx, "using defaults for invalid metadata fields", slog.F("fields", invalid))
+	}
+	return metadata, nil
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	t.Parallel()
+	a := &agent{
+		logger: slogtest.Make(t, &slogtest.Options{IgnoreErrors: true}),
+	}
+
+	t.Run("UnknownFields", func(t *testing.T) {
+		t.Parallel()
+		metadata, err := a.validateMetadata(context.Background(), codersdk.WorkspaceAgentMetadata{
+			Version:                       codersdk.WorkspaceAgentMetadataVersion + 1,
+			RequiredFields:                []string{"motd_file"},
+			UnknownFields:                 []string{"future_option"},
+			MOTDFile:                      "/etc/motd",
+			KeepAliveIntervalSeconds:      -1,
+			ReconnectingPTYTimeoutSeconds: 30,
+			ReconnectingPTYBufferSize:     -1,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "/etc/motd", metadata.MOTDFile)
+		require.Zero(t, metadata.KeepAliveIntervalSeconds)
+		require.EqualValues(t, 30, metadata.ReconnectingPTYTimeoutSeconds)
+		require.Zero(t, metadata.ReconnectingPTYBufferSize)
+	})
+
+	t.Run("UnsupportedRequiredFields", func(t *testing.T) {
+		t.Parallel()
+		_, err := a.validateMetadata(context.Background(), codersdk.WorkspaceAgentMetadata{
+			RequiredFields: []string{"ssh_public_key_auth", "future_restriction"},
+			UnknownFields:  []string{"future_restriction"},
+		})
+		require.Error(t, err)
+		require.Equal(t, codersdk.WorkspaceAgentErrorMetadataUnsupported, codersdk.WorkspaceAgentErrorCodeOf(err))
+		require.Contains(t, err.Error(), "future_restriction")
+		require.NotContains(t, err.Error(), "ssh_public_key_auth")
+	})
+}
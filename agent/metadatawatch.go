@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"cdr.dev/slog"
+)
+
+// metadataWatchRetryInterval is how long the agent waits to watch metadata
+// again after the watch ended, like when coderd restarted.
+const metadataWatchRetryInterval = 5 * time.Second
+
+// watchMetadata re-fetches metadata when coderd notifies that it changed,
+// like when the owner of the workspace sets environment variables, until
+// the context is canceled. Sessions started afterwards use the new
+// metadata.
+func (a *agent) watchMetadata(ctx context.Context) {
+	logger := a.logger.Named("metadata-watch")
+	for watched := false; ; watched = true {
+		changes, err := a.client.WatchWorkspaceAgentMetadata(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn(ctx, "watch metadata", slog.Error(err))
+		} else {
+			// Changes aren't notified while the agent isn't watching,
+			// so the metadata is fetched when it watches again.
+			if watched {
+				a.reloadWatchedMetadata(ctx, logger)
+			}
+			for range changes {
+				a.reloadWatchedMetadata(ctx, logger)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(metadataWatchRetryInterval):
+		}
+	}
+}
+
+func (a *agent) reloadWatchedMetadata(ctx context.Context, logger slog.Logger) {
+	err := a.reloadMetadata(ctx)
+	if err != nil && ctx.Err() == nil {
+		logger.Warn(ctx, "reload metadata", slog.Error(err))
+	}
+}
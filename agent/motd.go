@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	defaultMOTDCacheDuration = 5 * time.Minute
+	defaultMOTDTimeout       = 5 * time.Second
+	// maxMOTDBytes limits the size of the MOTD from a source.
+	maxMOTDBytes = 64 << 10
+)
+
+// cachedMOTD is the last MOTD fetched from a source.
+type cachedMOTD struct {
+	content []byte
+	fetched time.Time
+}
+
+// showMOTDSources writes the MOTD of each source to dest. Sources that fail
+// are logged instead, so they never prevent logging in.
+func (a *agent) showMOTDSources(ctx context.Context, dest io.Writer, sources []codersdk.WorkspaceAgentMOTDSource) {
+	for _, source := range sources {
+		content, err := a.fetchMOTD(ctx, source)
+		if err != nil {
+			a.logger.Warn(ctx, "fetch MOTD",
+				slog.F("url", source.URL),
+				slog.F("command", source.Command),
+				slog.Error(err))
+		}
+		err = writeMOTD(dest, bytes.NewReader(content))
+		if err != nil {
+			a.logger.Error(ctx, "show MOTD", slog.Error(err))
+			return
+		}
+	}
+}
+
+// fetchMOTD returns the MOTD of the source, which is cached so logins aren't
+// delayed by fetching it every time. When fetching fails, the previous MOTD
+// is returned with the error, and it isn't retried until the cache expires.
+func (a *agent) fetchMOTD(ctx context.Context, source codersdk.WorkspaceAgentMOTDSource) ([]byte, error) {
+	cacheDuration := defaultMOTDCacheDuration
+	if source.CacheSeconds > 0 {
+		cacheDuration = time.Duration(source.CacheSeconds) * time.Second
+	}
+	timeout := defaultMOTDTimeout
+	if source.TimeoutSeconds > 0 {
+		timeout = time.Duration(source.TimeoutSeconds) * time.Second
+	}
+	key := source.URL + "\x00" + source.Command
+
+	// Concurrent logins wait for the same fetch.
+	a.motdMutex.Lock()
+	defer a.motdMutex.Unlock()
+	cached, ok := a.motdCache[key]
+	if ok && time.Since(cached.fetched) < cacheDuration {
+		return cached.content, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var (
+		content []byte
+		err     error
+	)
+	switch {
+	case source.URL != "":
+		content, err = fetchMOTDURL(ctx, a.httpClient, source.URL)
+	case source.Command != "":
+		content, err = a.fetchMOTDCommand(ctx, source.Command)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		content = cached.content
+	}
+	a.motdCache[key] = cachedMOTD{
+		content: content,
+		fetched: time.Now(),
+	}
+	return content, err
+}
+
+func fetchMOTDURL(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("create request: %w", err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	content, err := io.ReadAll(io.LimitReader(res.Body, maxMOTDBytes))
+	if err != nil {
+		return nil, xerrors.Errorf("read body: %w", err)
+	}
+	return content, nil
+}
+
+func (a *agent) fetchMOTDCommand(ctx context.Context, command string) ([]byte, error) {
+	cmd, err := a.createCommand(ctx, command, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("create command: %w", err)
+	}
+	content, err := cmd.Output()
+	if err != nil {
+		return nil, xerrors.Errorf("run command: %w", err)
+	}
+	if len(content) > maxMOTDBytes {
+		content = content[:maxMOTDBytes]
+	}
+	return content, nil
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	defaultRequiredMountsTimeout = 5 * time.Minute
+	requiredMountsInterval       = time.Second
+)
+
+// waitForMounts waits until the required mounts are ready, so the startup
+// script doesn't write to the filesystem of the container before volumes
+// attach. The pending mounts are reported in the startup state.
+func (a *agent) waitForMounts(ctx context.Context, config *codersdk.WorkspaceAgentRequiredMounts) error {
+	if config == nil || len(config.Paths) == 0 {
+		return nil
+	}
+	timeout := defaultRequiredMountsTimeout
+	if config.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(requiredMountsInterval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	for {
+		pending := a.pendingMounts(config.Paths)
+		a.setStartup(func(startup *codersdk.WorkspaceAgentStartupResponse) {
+			startup.PendingMounts = pending
+		})
+		if len(pending) == 0 {
+			a.logger.Info(ctx, "required mounts are ready", slog.F("waited", time.Since(started)))
+			return nil
+		}
+		a.logger.Debug(ctx, "waiting for required mounts", slog.F("pending", pending))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return xerrors.Errorf("required mounts weren't ready after %s: %s", timeout, strings.Join(pending, ", "))
+		case <-ticker.C:
+		}
+	}
+}
+
+// pendingMounts returns the paths that aren't mounted or writable.
+func (a *agent) pendingMounts(paths []string) []string {
+	mountPoints, listed := readMountPoints(a.filesystem)
+	var pending []string
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if listed {
+			if _, ok := mountPoints[path]; !ok {
+				pending = append(pending, path)
+				continue
+			}
+		}
+		if !writable(a.filesystem, path) {
+			pending = append(pending, path)
+		}
+	}
+	return pending
+}
+
+// writable checks that a file can be created in the directory.
+func writable(filesystem afero.Fs, dir string) bool {
+	info, err := filesystem.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	file, err := afero.TempFile(filesystem, dir, ".coder-mount-check-*")
+	if err != nil {
+		return false
+	}
+	_ = file.Close()
+	_ = filesystem.Remove(file.Name())
+	return true
+}
+
+// readMountPoints returns the mount points of the agent, or false if they
+// can't be listed, e.g. on platforms other than Linux.
+func readMountPoints(filesystem afero.Fs) (map[string]struct{}, bool) {
+	file, err := filesystem.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+	mountPoints := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The mount point is the fifth field, e.g.
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoints[unescapeMountPoint(fields[4])] = struct{}{}
+	}
+	if scanner.Err() != nil {
+		return nil, false
+	}
+	return mountPoints, true
+}
+
+// unescapeMountPoint decodes the octal escapes of whitespace and
+// backslashes in mountinfo, e.g. "\040" for a space.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
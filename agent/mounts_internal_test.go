@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingMounts(t *testing.T) {
+	t.Parallel()
+
+	t.Run("MountInfo", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		mountInfo := "22 1 0:21 / / rw,relatime - overlay overlay rw\n" +
+			"36 22 98:0 / /mnt/data rw,noatime - ext4 /dev/sdb rw\n" +
+			"37 22 98:1 / /mnt/with\\040space rw,noatime - ext4 /dev/sdc rw\n"
+		require.NoError(t, afero.WriteFile(fs, "/proc/self/mountinfo", []byte(mountInfo), 0o444))
+		for _, dir := range []string{"/mnt/data", "/mnt/with space", "/mnt/cache"} {
+			require.NoError(t, fs.MkdirAll(dir, 0o755))
+		}
+		a := &agent{filesystem: fs}
+		// The cache directory exists, but the volume isn't mounted.
+		require.Equal(t, []string{"/mnt/cache"}, a.pendingMounts([]string{"/mnt/data/", "/mnt/with space", "/mnt/cache"}))
+
+		infos, err := afero.ReadDir(fs, "/mnt/data")
+		require.NoError(t, err)
+		require.Empty(t, infos, "writable checks must clean up")
+	})
+
+	t.Run("Unlisted", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		require.NoError(t, fs.MkdirAll("/mnt/data", 0o755))
+		a := &agent{filesystem: fs}
+		// Paths only have to be writable if mounts can't be listed.
+		require.Equal(t, []string{"/mnt/cache"}, a.pendingMounts([]string{"/mnt/data", "/mnt/cache"}))
+	})
+}
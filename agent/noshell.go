@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/codersdk"
+)
+
+// resolveShell returns the program and arguments that run a command with
+// the shell of the user. Minimal images, like distroless ones, may not
+// have the shell, or any shell at all. Then sh or a busybox binary run the
+// command instead, and without them the command is split into arguments
+// and executed directly, like "exec" would. Interactive shells need a
+// shell, but SFTP doesn't, since it's served by the agent.
+func resolveShell(lookPath func(file string) (string, error), shell string, args []string, rawCommand string) (name string, resolvedArgs []string, direct bool, err error) {
+	if _, err := lookPath(shell); err == nil {
+		return shell, args, false, nil
+	}
+	if sh, err := lookPath("sh"); err == nil {
+		return sh, args, false, nil
+	}
+	if busybox, err := lookPath("busybox"); err == nil {
+		return busybox, append([]string{"sh"}, args...), false, nil
+	}
+	if rawCommand == "" {
+		return "", nil, false, codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorShellLookupFailed,
+			xerrors.Errorf("shell %q doesn't exist and the image has no sh or busybox, only commands can be executed", shell))
+	}
+	argv, err := splitCommand(rawCommand)
+	if err != nil {
+		return "", nil, false, xerrors.Errorf("the image has no shell to run %q: %w", rawCommand, err)
+	}
+	path, err := lookPath(argv[0])
+	if err != nil {
+		return "", nil, false, xerrors.Errorf("look up %q: %w", argv[0], err)
+	}
+	return path, argv[1:], true, nil
+}
+
+// splitCommand splits a command into arguments like a POSIX shell, for
+// commands that are executed without one. Quotes and backslash escapes are
+// supported, but anything that needs a shell to interpret, like pipes,
+// redirects, variables and globs, is an error.
+func splitCommand(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range command {
+		switch {
+		case escaped:
+			// Double quotes only escape characters they'd interpret.
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				current.WriteRune('\\')
+			}
+			current.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			case '$', '`':
+				return nil, xerrors.Errorf("%q requires a shell", r)
+			default:
+				current.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inArg = true
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case strings.ContainsRune("|&;<>()$`*?[]{}~#", r):
+			return nil, xerrors.Errorf("%q requires a shell", r)
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, xerrors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return nil, xerrors.New("empty command")
+	}
+	return args, nil
+}
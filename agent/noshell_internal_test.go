@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/codersdk"
+)
+
+func TestResolveShell(t *testing.T) {
+	t.Parallel()
+
+	lookPath := func(files ...string) func(string) (string, error) {
+		return func(file string) (string, error) {
+			for _, f := range files {
+				if f == file {
+					return "/usr/bin/" + file, nil
+				}
+			}
+			return "", exec.ErrNotFound
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		files      []string
+		rawCommand string
+		program    string
+		args       []string
+		direct     bool
+		err        string
+	}{{
+		name:       "Shell",
+		files:      []string{"/bin/bash"},
+		rawCommand: "echo hi",
+		program:    "/bin/bash",
+		args:       []string{"-c", "echo hi"},
+	}, {
+		name:       "Sh",
+		files:      []string{"sh"},
+		rawCommand: "echo hi",
+		program:    "/usr/bin/sh",
+		args:       []string{"-c", "echo hi"},
+	}, {
+		name:    "Busybox",
+		files:   []string{"busybox"},
+		program: "/usr/bin/busybox",
+		args:    []string{"sh", "-l"},
+	}, {
+		name:       "Direct",
+		files:      []string{"echo"},
+		rawCommand: `echo "hello world"`,
+		program:    "/usr/bin/echo",
+		args:       []string{"hello world"},
+		direct:     true,
+	}, {
+		name: "NoShell",
+		err:  "only commands can be executed",
+	}, {
+		name:       "NotFound",
+		rawCommand: "missing",
+		err:        `look up "missing"`,
+	}, {
+		name:       "RequiresShell",
+		files:      []string{"echo"},
+		rawCommand: "echo hi | cat",
+		err:        "requires a shell",
+	}} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			args := []string{"-l"}
+			if tc.rawCommand != "" {
+				args = []string{"-c", tc.rawCommand}
+			}
+			program, args, direct, err := resolveShell(lookPath(tc.files...), "/bin/bash", args, tc.rawCommand)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.program, program)
+			require.Equal(t, tc.args, args)
+			require.Equal(t, tc.direct, direct)
+		})
+	}
+
+	t.Run("ErrorCode", func(t *testing.T) {
+		t.Parallel()
+		_, _, _, err := resolveShell(lookPath(), "/bin/bash", nil, "")
+		require.Equal(t, codersdk.WorkspaceAgentErrorShellLookupFailed, codersdk.WorkspaceAgentErrorCodeOf(err))
+	})
+}
+
+func TestSplitCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		command string
+		args    []string
+		err     bool
+	}{
+		{command: "ls -la", args: []string{"ls", "-la"}},
+		{command: "  ls\t-la  ", args: []string{"ls", "-la"}},
+		{command: `printf '%s\n' "a b" c\ d`, args: []string{"printf", `%s\n`, "a b", "c d"}},
+		{command: `echo "a\"b" "c\d"`, args: []string{"echo", `a"b`, `c\d`}},
+		{command: `echo ""`, args: []string{"echo", ""}},
+		{command: "echo $HOME", err: true},
+		{command: `echo "$HOME"`, err: true},
+		{command: "ls > out", err: true},
+		{command: "ls *.go", err: true},
+		{command: `echo "unterminated`, err: true},
+		{command: "", err: true},
+	} {
+		args, err := splitCommand(tc.command)
+		if tc.err {
+			require.Error(t, err, tc.command)
+			continue
+		}
+		require.NoError(t, err, tc.command)
+		require.Equal(t, tc.args, args, tc.command)
+	}
+}
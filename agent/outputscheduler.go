@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// outputQuantum is the most output a session writes per turn.
+	outputQuantum = 16 << 10
+	// outputTurnTimeout limits waiting for a turn, so a session writing
+	// to a stalled client can't block the output of every other session.
+	outputTurnTimeout = 100 * time.Millisecond
+)
+
+// outputScheduler takes turns writing the output of PTY sessions, so a
+// session with a lot of output can't monopolize the agent and interactive
+// sessions stay responsive under load. Turns rotate between users, and
+// between the sessions of each user in the order they're ready.
+type outputScheduler struct {
+	turnTimeout time.Duration
+
+	mutex sync.Mutex
+	busy  bool
+	// users have sessions waiting for a turn, in the order turns are
+	// given to them.
+	users   []string
+	waiting map[string][]chan struct{}
+}
+
+func newOutputScheduler() *outputScheduler {
+	return &outputScheduler{
+		turnTimeout: outputTurnTimeout,
+		waiting:     map[string][]chan struct{}{},
+	}
+}
+
+// acquire waits for a turn to write output for the user. The returned
+// function must be called when the write finishes. If the turn isn't given
+// within the turn timeout, the output is written anyway.
+func (s *outputScheduler) acquire(user string) (release func()) {
+	s.mutex.Lock()
+	if !s.busy {
+		s.busy = true
+		s.mutex.Unlock()
+		return s.release
+	}
+	turn := make(chan struct{})
+	if len(s.waiting[user]) == 0 {
+		s.users = append(s.users, user)
+	}
+	s.waiting[user] = append(s.waiting[user], turn)
+	s.mutex.Unlock()
+
+	timer := time.NewTimer(s.turnTimeout)
+	defer timer.Stop()
+	select {
+	case <-turn:
+		return s.release
+	case <-timer.C:
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-turn:
+		// The turn was given while the timer fired.
+		return s.release
+	default:
+	}
+	s.remove(user, turn)
+	return func() {}
+}
+
+// release gives the turn to the next user that's waiting.
+func (s *outputScheduler) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.users) == 0 {
+		s.busy = false
+		return
+	}
+	user := s.users[0]
+	s.users = s.users[1:]
+	queue := s.waiting[user]
+	turn := queue[0]
+	if len(queue) > 1 {
+		s.waiting[user] = queue[1:]
+		// The user waits for the others before its next turn.
+		s.users = append(s.users, user)
+	} else {
+		delete(s.waiting, user)
+	}
+	close(turn)
+}
+
+// remove stops a session from waiting for a turn. The mutex must be held.
+func (s *outputScheduler) remove(user string, turn chan struct{}) {
+	queue := s.waiting[user]
+	for i, waiting := range queue {
+		if waiting == turn {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		s.waiting[user] = queue
+		return
+	}
+	delete(s.waiting, user)
+	for i, waiting := range s.users {
+		if waiting == user {
+			s.users = append(s.users[:i:i], s.users[i+1:]...)
+			break
+		}
+	}
+}
+
+// writer returns a writer that takes a turn for each quantum of output.
+func (s *outputScheduler) writer(user string, w io.Writer) io.Writer {
+	return &scheduledWriter{
+		scheduler: s,
+		user:      user,
+		writer:    w,
+	}
+}
+
+type scheduledWriter struct {
+	scheduler *outputScheduler
+	user      string
+	writer    io.Writer
+}
+
+func (w *scheduledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > outputQuantum {
+			chunk = chunk[:outputQuantum]
+		}
+		release := w.scheduler.acquire(w.user)
+		n, err := w.writer.Write(chunk)
+		release()
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/testutil"
+)
+
+func TestOutputScheduler(t *testing.T) {
+	t.Parallel()
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		t.Parallel()
+		s := newOutputScheduler()
+		// Sessions must not give up on their turn while the test
+		// waits for them to be ready.
+		s.turnTimeout = testutil.WaitLong
+		release := s.acquire("alice")
+
+		var (
+			mutex sync.Mutex
+			order []string
+			wg    sync.WaitGroup
+		)
+		waiting := func() int {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			n := 0
+			for _, queue := range s.waiting {
+				n += len(queue)
+			}
+			return n
+		}
+		// Alice is ready twice before Bob, but Bob gets the second turn.
+		for i, session := range []struct{ user, name string }{
+			{"alice", "alice-1"},
+			{"alice", "alice-2"},
+			{"bob", "bob-1"},
+		} {
+			session := session
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release := s.acquire(session.user)
+				mutex.Lock()
+				order = append(order, session.name)
+				mutex.Unlock()
+				release()
+			}()
+			want := i + 1
+			require.Eventually(t, func() bool {
+				return waiting() == want
+			}, testutil.WaitShort, testutil.IntervalFast)
+		}
+		release()
+		wg.Wait()
+		require.Equal(t, []string{"alice-1", "bob-1", "alice-2"}, order)
+		require.False(t, s.busy)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		t.Parallel()
+		s := newOutputScheduler()
+		release := s.acquire("alice")
+		defer release()
+
+		// A stalled turn doesn't block other sessions forever.
+		var buf bytes.Buffer
+		n, err := s.writer("bob", &buf).Write([]byte("hello"))
+		require.NoError(t, err)
+		require.Equal(t, 5, n)
+		require.Equal(t, "hello", buf.String())
+		require.Empty(t, s.waiting)
+		require.Empty(t, s.users)
+	})
+}
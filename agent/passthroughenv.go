@@ -0,0 +1,32 @@
+package agent
+
+import "strings"
+
+// essentialEnvironmentPatterns are always inherited by sessions from the
+// environment of the agent, since shells and most programs need them.
+var essentialEnvironmentPatterns = []string{
+	"HOME",
+	"LANG",
+	"LC_*",
+	"LOGNAME",
+	"PATH",
+	"SHELL",
+	"TZ",
+}
+
+// passthroughEnv returns the variables of environ whose names match the
+// patterns or are essential. Every variable is passed through if patterns
+// is nil.
+func passthroughEnv(patterns []string, environ []string) []string {
+	if patterns == nil {
+		return environ
+	}
+	passed := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if acceptEnvName(essentialEnvironmentPatterns, name) || acceptEnvName(patterns, name) {
+			passed = append(passed, kv)
+		}
+	}
+	return passed
+}
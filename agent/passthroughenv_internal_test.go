@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassthroughEnv(t *testing.T) {
+	t.Parallel()
+
+	environ := []string{
+		"PATH=/usr/bin",
+		"AWS_REGION=us-east-1",
+		"KUBERNETES_SERVICE_HOST=10.0.0.1",
+		"CODER_AGENT_URL=https://coder.com",
+		"LC_ALL=C",
+	}
+	// Everything is passed through without patterns.
+	require.Equal(t, environ, passthroughEnv(nil, environ))
+
+	require.Equal(t, []string{
+		"PATH=/usr/bin",
+		"AWS_REGION=us-east-1",
+		"LC_ALL=C",
+	}, passthroughEnv([]string{"AWS_*"}, environ))
+
+	// Essential variables are passed through even without patterns.
+	require.Equal(t, []string{
+		"PATH=/usr/bin",
+		"LC_ALL=C",
+	}, passthroughEnv([]string{}, environ))
+}
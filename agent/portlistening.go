@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/tailnet"
+)
+
+// portListeningTimeout limits how long dialing a port takes to tell
+// whether something is listening on it. Dials of the loopback address are
+// refused right away, so it's only reached by processes that are stuck.
+const portListeningTimeout = time.Second
+
+// portListeningHandler returns whether something is listening on a port
+// right now, by dialing it like forwarded connections are. Proxies ask
+// before forwarding connections, so they can respond with why the port
+// isn't reachable rather than waiting for connections to fail.
+func (a *agent) portListeningHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	port, err := strconv.ParseUint(chi.URLParam(r, "port"), 10, 16)
+	if err != nil || port == 0 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: fmt.Sprintf("Invalid port %q.", chi.URLParam(r, "port")),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, a.portListening(ctx, uint16(port)))
+}
+
+func (a *agent) portListening(ctx context.Context, port uint16) codersdk.PortListeningResponse {
+	resp := codersdk.PortListeningResponse{
+		Port: port,
+	}
+	ctx, cancel := context.WithTimeout(ctx, portListeningTimeout)
+	defer cancel()
+	conn, err := tailnet.DialLoopback(ctx, port, false)
+	if err == nil {
+		_ = conn.Close()
+		resp.Listening = true
+		return resp
+	}
+
+	resp.Reason = fmt.Sprintf("Nothing is listening on port %d in the workspace.", port)
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	for _, app := range metadata.Apps {
+		appPort, scheme, ok := appLocalPort(app.URL)
+		if !ok || appPort != port {
+			continue
+		}
+		// Apps are expected to listen once they've started, so clients
+		// are told to retry.
+		resp.Reason = fmt.Sprintf("The app %q isn't listening on port %d yet. %s", appName(app), port, a.appHealthStatus(app))
+		resp.RetryAfterSeconds = int(appStartingRefresh.Seconds())
+		// Connections to the ports of HTTP apps are answered with a page
+		// that the app is starting, which refreshes until it has.
+		resp.AppStarting = scheme == "http"
+		break
+	}
+	return resp
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/go-chi/chi"
+)
+
+// pprofProfileSeconds is the duration of CPU profiles that clients don't
+// set one for, since the default of net/http/pprof exceeds the write
+// timeout of the statistics server.
+const pprofProfileSeconds = "10"
+
+// mountPprof serves the profiles of net/http/pprof under /debug/pprof, so
+// agents that use too much CPU or leak are profiled without rebuilding
+// them.
+func mountPprof(r chi.Router) {
+	// Index serves the named profiles, like heap and goroutine.
+	r.Get("/debug/pprof/*", pprof.Index)
+	r.Get("/debug/pprof/cmdline", pprof.Cmdline)
+	r.Get("/debug/pprof/profile", func(rw http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !query.Has("seconds") {
+			query.Set("seconds", pprofProfileSeconds)
+			r.URL.RawQuery = query.Encode()
+		}
+		pprof.Profile(rw, r)
+	})
+	r.Get("/debug/pprof/symbol", pprof.Symbol)
+	r.Post("/debug/pprof/symbol", pprof.Symbol)
+	r.Get("/debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+)
+
+const (
+	// pressureCheckInterval limits how often pressure is read, since
+	// it's checked by every periodic task.
+	pressureCheckInterval = 5 * time.Second
+	// cpuPressureThreshold and memoryPressureThreshold are the share of
+	// the last 10 seconds, in percent, that some tasks were stalled
+	// waiting for the resource before the agent backs off.
+	cpuPressureThreshold    = 50
+	memoryPressureThreshold = 10
+	// throttleFactor is how much less often non-essential periodic work
+	// runs while the workspace is under pressure.
+	throttleFactor = 4
+)
+
+var (
+	// Pressure of the cgroup of the agent is preferred, since containers
+	// may not be limited by the resources of the host.
+	cpuPressurePaths    = []string{"/sys/fs/cgroup/cpu.pressure", "/proc/pressure/cpu"}
+	memoryPressurePaths = []string{"/sys/fs/cgroup/memory.pressure", "/proc/pressure/memory"}
+)
+
+// pressureMonitor detects when the workspace is under heavy CPU or memory
+// load, so the agent can back off non-essential periodic work instead of
+// competing with the work of users. It reads the pressure stall information
+// of Linux, and never reports pressure where it's unavailable.
+type pressureMonitor struct {
+	logger     slog.Logger
+	filesystem afero.Fs
+
+	mutex     sync.Mutex
+	checkedAt time.Time
+	throttled bool
+}
+
+func newPressureMonitor(logger slog.Logger, filesystem afero.Fs) *pressureMonitor {
+	return &pressureMonitor{
+		logger:     logger,
+		filesystem: filesystem,
+	}
+}
+
+// Throttled returns whether non-essential work should back off. Pressure
+// has to fall below half of its threshold before work resumes, so the agent
+// doesn't flap at the threshold.
+func (m *pressureMonitor) Throttled() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if time.Since(m.checkedAt) < pressureCheckInterval {
+		return m.throttled
+	}
+	m.checkedAt = time.Now()
+
+	threshold := 1.0
+	if m.throttled {
+		threshold = 0.5
+	}
+	cpu, _ := readPressure(m.filesystem, cpuPressurePaths)
+	memory, _ := readPressure(m.filesystem, memoryPressurePaths)
+	throttled := cpu >= cpuPressureThreshold*threshold || memory >= memoryPressureThreshold*threshold
+	if throttled != m.throttled {
+		fields := []slog.Field{slog.F("cpu_pressure", cpu), slog.F("memory_pressure", memory)}
+		if throttled {
+			m.logger.Warn(context.Background(), "workspace is under pressure, throttling health probes and stats", fields...)
+		} else {
+			m.logger.Info(context.Background(), "workspace is no longer under pressure", fields...)
+		}
+	}
+	m.throttled = throttled
+	return throttled
+}
+
+// readPressure returns the "some" avg10 of the first pressure file that can
+// be read, e.g. 12.5 from:
+//
+//	some avg10=12.50 avg60=3.10 avg300=0.80 total=123456
+func readPressure(filesystem afero.Fs, paths []string) (float64, bool) {
+	for _, path := range paths {
+		file, err := filesystem.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != "some" {
+				continue
+			}
+			if !strings.HasPrefix(fields[1], "avg10=") {
+				continue
+			}
+			pressure, err := strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+			if err != nil {
+				continue
+			}
+			_ = file.Close()
+			return pressure, true
+		}
+		_ = file.Close()
+	}
+	return 0, false
+}
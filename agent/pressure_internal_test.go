@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func TestPressureMonitor(t *testing.T) {
+	t.Parallel()
+
+	writePressure := func(t *testing.T, fs afero.Fs, path string, avg10 string) {
+		t.Helper()
+		err := afero.WriteFile(fs, path, []byte("some avg10="+avg10+" avg60=0.00 avg300=0.00 total=0\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"), 0o600)
+		require.NoError(t, err)
+	}
+
+	t.Run("Unavailable", func(t *testing.T) {
+		t.Parallel()
+		m := newPressureMonitor(slogtest.Make(t, nil), afero.NewMemMapFs())
+		require.False(t, m.Throttled())
+	})
+
+	t.Run("Hysteresis", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		m := newPressureMonitor(slogtest.Make(t, nil), fs)
+		check := func() bool {
+			m.checkedAt = time.Time{}
+			return m.Throttled()
+		}
+
+		writePressure(t, fs, "/proc/pressure/cpu", "40.00")
+		require.False(t, check())
+		writePressure(t, fs, "/proc/pressure/cpu", "75.50")
+		require.True(t, check())
+		// Work doesn't resume until pressure falls below half of the
+		// threshold.
+		writePressure(t, fs, "/proc/pressure/cpu", "40.00")
+		require.True(t, check())
+		writePressure(t, fs, "/proc/pressure/cpu", "10.00")
+		require.False(t, check())
+
+		writePressure(t, fs, "/proc/pressure/memory", "12.00")
+		require.True(t, check())
+	})
+
+	t.Run("PreferCgroup", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		writePressure(t, fs, "/proc/pressure/cpu", "90.00")
+		writePressure(t, fs, "/sys/fs/cgroup/cpu.pressure", "1.25")
+		pressure, ok := readPressure(fs, cpuPressurePaths)
+		require.True(t, ok)
+		require.Equal(t, 1.25, pressure)
+	})
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"context"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// defaultPTYBufferSize is the size of the scrollback of reconnecting
+	// PTYs that clients replay when they reconnect.
+	defaultPTYBufferSize = 64 << 10
+	// minPTYBufferSize and maxPTYBufferSize bound the scrollback, since
+	// clients can request it for each session and every reconnecting PTY
+	// keeps its scrollback in memory.
+	minPTYBufferSize = 1 << 10
+	maxPTYBufferSize = 16 << 20
+)
+
+// newPTYBufferSize returns the size of the scrollback of a new reconnecting
+// PTY. The size requested by the client overrides the metadata, which
+// overrides the options. Sizes out of bounds are clamped, like the size
+// in the options is when the agent is created.
+func (a *agent) newPTYBufferSize(ctx context.Context, msg codersdk.ReconnectingPTYInit) int {
+	size := a.ptyBufferSize
+	metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if ok && metadata.ReconnectingPTYBufferSize > 0 {
+		size = int(metadata.ReconnectingPTYBufferSize)
+	}
+	if msg.BufferSize > 0 {
+		size = msg.BufferSize
+	}
+	clamped := clampPTYBufferSize(size)
+	if clamped != size {
+		a.logger.Warn(ctx, "reconnecting pty buffer size out of bounds",
+			slog.F("id", msg.ID),
+			slog.F("requested", size),
+			slog.F("size", clamped),
+		)
+	}
+	return clamped
+}
+
+func clampPTYBufferSize(size int) int {
+	if size < minPTYBufferSize {
+		return minPTYBufferSize
+	}
+	if size > maxPTYBufferSize {
+		return maxPTYBufferSize
+	}
+	return size
+}
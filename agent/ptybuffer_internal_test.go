@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+)
+
+func TestNewPTYBufferSize(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	a := &agent{
+		logger:        slogtest.Make(t, nil),
+		ptyBufferSize: defaultPTYBufferSize,
+	}
+	require.Equal(t, defaultPTYBufferSize, a.newPTYBufferSize(ctx, codersdk.ReconnectingPTYInit{}))
+
+	// The metadata overrides the options.
+	a.metadata.Store(codersdk.WorkspaceAgentMetadata{
+		ReconnectingPTYBufferSize: 1 << 20,
+	})
+	require.Equal(t, 1<<20, a.newPTYBufferSize(ctx, codersdk.ReconnectingPTYInit{}))
+
+	// Clients override the metadata, but can't exceed the bounds.
+	require.Equal(t, 4<<10, a.newPTYBufferSize(ctx, codersdk.ReconnectingPTYInit{BufferSize: 4 << 10}))
+	require.Equal(t, maxPTYBufferSize, a.newPTYBufferSize(ctx, codersdk.ReconnectingPTYInit{BufferSize: 1 << 30}))
+	require.Equal(t, minPTYBufferSize, a.newPTYBufferSize(ctx, codersdk.ReconnectingPTYInit{BufferSize: 1}))
+}
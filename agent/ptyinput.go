@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// maxPTYInputMessageSize is the largest ReconnectingPTYRequest the
+	// agent decodes, so a client can't make it buffer a paste of any size.
+	maxPTYInputMessageSize = 1 << 20
+	// ptyInputBytesPerSecond and ptyInputBurstBytes limit the input of a
+	// connection to a reconnecting PTY. Pastes are written in one burst,
+	// and larger ones at the rate, which terminals keep up with.
+	ptyInputBytesPerSecond = 256 << 10
+	ptyInputBurstBytes     = maxPTYInputMessageSize
+	// ptyInputMessagesPerSecond and ptyInputBurstMessages limit the
+	// messages of a connection, since every message is a write to the
+	// PTY. Typing sends a message per key.
+	ptyInputMessagesPerSecond = 500
+	ptyInputBurstMessages     = 2000
+)
+
+var errPTYInputTooLarge = xerrors.Errorf("reconnecting pty input message is larger than %d bytes", maxPTYInputMessageSize)
+
+// ptyInputLimiter limits the input of a connection to a reconnecting PTY,
+// so a client that floods it, e.g. by pasting megabytes, doesn't keep the
+// PTY busy and starve the other connections. Connections over the limit
+// are slowed down rather than dropped, which backs up the client.
+type ptyInputLimiter struct {
+	now      func() time.Time
+	bytes    tokenBucket
+	messages tokenBucket
+}
+
+func newPTYInputLimiter(now func() time.Time) *ptyInputLimiter {
+	start := now()
+	return &ptyInputLimiter{
+		now:      now,
+		bytes:    newTokenBucket(ptyInputBytesPerSecond, ptyInputBurstBytes, start),
+		messages: newTokenBucket(ptyInputMessagesPerSecond, ptyInputBurstMessages, start),
+	}
+}
+
+// take counts a message with the size, and returns how long the connection
+// waits before it's written to the PTY.
+func (l *ptyInputLimiter) take(size int) time.Duration {
+	now := l.now()
+	bytesDelay := l.bytes.take(now, float64(size))
+	messagesDelay := l.messages.take(now, 1)
+	if bytesDelay > messagesDelay {
+		return bytesDelay
+	}
+	return messagesDelay
+}
+
+// tokenBucket allows bursts up to a number of tokens, which refill at a
+// rate per second. Taking more tokens than are left is allowed, and
+// returns how long it takes until they're paid back.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) tokenBucket {
+	return tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) take(now time.Time, tokens float64) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	b.tokens -= tokens
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// ptyInputReader fails reads of the input of a reconnecting PTY when a
+// message is larger than maxPTYInputMessageSize. The decoder reads ahead,
+// so messages are counted from their offset in the input.
+type ptyInputReader struct {
+	r     io.Reader
+	read  int64
+	start int64
+}
+
+func (r *ptyInputReader) Read(p []byte) (int, error) {
+	remaining := r.start + maxPTYInputMessageSize - r.read
+	if remaining <= 0 {
+		return 0, errPTYInputTooLarge
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// reset starts counting the message at the offset, like the input offset
+// of the decoder.
+func (r *ptyInputReader) reset(offset int64) {
+	r.start = offset
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/codersdk"
+)
+
+func TestPTYInputLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Bytes", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		limiter := newPTYInputLimiter(func() time.Time { return now })
+		// A paste up to the burst is written right away.
+		require.Zero(t, limiter.take(ptyInputBurstBytes))
+		// More input waits until the bytes are paid back.
+		require.Equal(t, time.Second, limiter.take(ptyInputBytesPerSecond))
+		now = now.Add(time.Second)
+		require.Zero(t, limiter.take(0))
+	})
+
+	t.Run("Messages", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		limiter := newPTYInputLimiter(func() time.Time { return now })
+		for i := 0; i < ptyInputBurstMessages; i++ {
+			require.Zero(t, limiter.take(1))
+		}
+		require.Equal(t, time.Second/ptyInputMessagesPerSecond, limiter.take(1))
+		now = now.Add(time.Second)
+		require.Zero(t, limiter.take(1))
+	})
+}
+
+func TestPTYInputReader(t *testing.T) {
+	t.Parallel()
+
+	var stream bytes.Buffer
+	encoder := json.NewEncoder(&stream)
+	require.NoError(t, encoder.Encode(codersdk.ReconnectingPTYRequest{Data: "ls\r"}))
+	require.NoError(t, encoder.Encode(codersdk.ReconnectingPTYRequest{Data: strings.Repeat("a", maxPTYInputMessageSize/2)}))
+	require.NoError(t, encoder.Encode(codersdk.ReconnectingPTYRequest{Data: strings.Repeat("a", maxPTYInputMessageSize)}))
+
+	input := &ptyInputReader{r: &stream}
+	decoder := json.NewDecoder(input)
+	var req codersdk.ReconnectingPTYRequest
+	for i := 0; i < 2; i++ {
+		input.reset(decoder.InputOffset())
+		require.NoError(t, decoder.Decode(&req))
+	}
+	input.reset(decoder.InputOffset())
+	err := decoder.Decode(&req)
+	require.True(t, xerrors.Is(err, errPTYInputTooLarge), err)
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// namedPTYNamespace derives the IDs of named reconnecting PTYs, so a name
+// refers to the same PTY, including its output persisted across restarts
+// of the agent.
+var namedPTYNamespace = uuid.MustParse("6f0b6a4c-2f5e-4a86-9d4b-3c1e8f7a2d90")
+
+// ptyNeverTimeout keeps reconnecting PTYs without connections until their
+// process exits.
+const ptyNeverTimeout = time.Duration(math.MaxInt64)
+
+// namedPTYID returns the ID of the reconnecting PTY with the name.
+func namedPTYID(name string) uuid.UUID {
+	return uuid.NewSHA1(namedPTYNamespace, []byte(name))
+}
+
+// ptyTimeoutFor returns how long the reconnecting PTY is kept without
+// connections. Named PTYs are kept until their process exits, unless a
+// timeout for them is configured.
+func (a *agent) ptyTimeoutFor(rpty *reconnectingPTY) time.Duration {
+	if rpty.name == "" {
+		return a.ptyTimeout()
+	}
+	if a.namedPTYTimeout > 0 {
+		return a.namedPTYTimeout
+	}
+	return ptyNeverTimeout
+}
+
+// listReconnectingPTYs returns the reconnecting PTYs of the agent, ordered
+// by when they started.
+func (a *agent) listReconnectingPTYs() []codersdk.ReconnectingPTYInfo {
+	infos := []codersdk.ReconnectingPTYInfo{}
+	a.reconnectingPTYs.Range(func(key, value any) bool {
+		id, ok := key.(uuid.UUID)
+		if !ok {
+			return true
+		}
+		rpty, ok := value.(*reconnectingPTY)
+		if !ok {
+			return true
+		}
+		rpty.participantsMutex.Lock()
+		participants := len(rpty.participants)
+		rpty.participantsMutex.Unlock()
+		infos = append(infos, codersdk.ReconnectingPTYInfo{
+			ID:           id,
+			Name:         rpty.name,
+			Label:        rpty.session.label.Load(),
+			Command:      rpty.recorded.Command,
+			StartedAt:    rpty.recorded.StartedAt,
+			Participants: participants,
+		})
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+	return infos
+}
+
+func (a *agent) reconnectingPTYsHandler(rw http.ResponseWriter, r *http.Request) {
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.ReconnectingPTYsResponse{
+		ReconnectingPTYs: a.listReconnectingPTYs(),
+	})
+}
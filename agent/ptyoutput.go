@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxPTYOutputQueueSize is how much output of a reconnecting PTY is
+	// queued for a connection that doesn't keep up. The oldest output is
+	// dropped beyond it, since the scrollback of reconnecting is what's
+	// kept.
+	maxPTYOutputQueueSize = 1 << 20
+	// ptyOutputFlushTimeout limits how long the output that's queued is
+	// written to connections after the PTY closed.
+	ptyOutputFlushTimeout = 5 * time.Second
+	// ptyOutputDrainTimeout limits how long the output of a PTY is read
+	// after its process exited, since processes it started in the
+	// background can keep the PTY open.
+	ptyOutputDrainTimeout = time.Second
+)
+
+// ptyOutputQueue buffers the output of a reconnecting PTY for a connection,
+// which a goroutine of its own writes, so a slow connection, like a browser
+// in a background tab, doesn't stall the other connections.
+type ptyOutputQueue struct {
+	now    func() time.Time
+	notify chan struct{}
+
+	mutex  sync.Mutex
+	chunks []ptyOutputChunk
+	queued int
+	// writingSince is when the oldest chunk that's being written was
+	// queued, which the lag is measured from.
+	writingSince time.Time
+	dropped      int64
+	// ended queues no more output, but the queued output is still taken.
+	ended  bool
+	closed bool
+}
+
+type ptyOutputChunk struct {
+	data     []byte
+	queuedAt time.Time
+}
+
+func newPTYOutputQueue(now func() time.Time) *ptyOutputQueue {
+	return &ptyOutputQueue{
+		now:    now,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push queues a copy of the output, and drops the oldest output when more
+// than maxPTYOutputQueueSize is queued.
+func (q *ptyOutputQueue) push(p []byte) {
+	chunk := ptyOutputChunk{
+		data:     append([]byte(nil), p...),
+		queuedAt: q.now(),
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed || q.ended {
+		return
+	}
+	q.chunks = append(q.chunks, chunk)
+	q.queued += len(chunk.data)
+	for q.queued > maxPTYOutputQueueSize && len(q.chunks) > 1 {
+		q.queued -= len(q.chunks[0].data)
+		q.dropped += int64(len(q.chunks[0].data))
+		q.chunks[0] = ptyOutputChunk{}
+		q.chunks = q.chunks[1:]
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for queued output and returns it, or false when the queue is
+// closed, or ended and empty. The lag includes the output until done is
+// called.
+func (q *ptyOutputQueue) take() ([]ptyOutputChunk, bool) {
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return nil, false
+		}
+		if len(q.chunks) > 0 {
+			chunks := q.chunks
+			q.chunks = nil
+			q.queued = 0
+			q.writingSince = chunks[0].queuedAt
+			q.mutex.Unlock()
+			return chunks, true
+		}
+		if q.ended {
+			q.mutex.Unlock()
+			return nil, false
+		}
+		q.mutex.Unlock()
+		<-q.notify
+	}
+}
+
+// done marks the output that was taken as written.
+func (q *ptyOutputQueue) done() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.writingSince = time.Time{}
+}
+
+// end stops the writer after the queued output was taken.
+func (q *ptyOutputQueue) end() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.ended = true
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close discards the queued output, and stops the writer.
+func (q *ptyOutputQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.chunks = nil
+	q.queued = 0
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// stats returns the bytes that are queued and were dropped, and how long
+// the oldest output that wasn't written yet has waited.
+func (q *ptyOutputQueue) stats() (queued int, dropped int64, lag time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	oldest := q.writingSince
+	if oldest.IsZero() && len(q.chunks) > 0 {
+		oldest = q.chunks[0].queuedAt
+	}
+	if !oldest.IsZero() {
+		lag = q.now().Sub(oldest)
+	}
+	return q.queued, q.dropped, lag
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPTYOutputQueue(t *testing.T) {
+	t.Parallel()
+
+	t.Run("DropsOldest", func(t *testing.T) {
+		t.Parallel()
+		queue := newPTYOutputQueue(time.Now)
+		half := maxPTYOutputQueueSize / 2
+		queue.push(bytes.Repeat([]byte("a"), half))
+		queue.push(bytes.Repeat([]byte("b"), half))
+		queue.push([]byte("c"))
+		queued, dropped, _ := queue.stats()
+		require.Equal(t, half+1, queued)
+		require.Equal(t, int64(half), dropped)
+
+		chunks, ok := queue.take()
+		require.True(t, ok)
+		require.Len(t, chunks, 2)
+		require.Equal(t, byte('b'), chunks[0].data[0])
+		require.Equal(t, []byte("c"), chunks[1].data)
+	})
+
+	t.Run("KeepsLargeChunk", func(t *testing.T) {
+		t.Parallel()
+		queue := newPTYOutputQueue(time.Now)
+		// Output is never split, so the newest is queued even when it's
+		// larger than the limit.
+		queue.push(make([]byte, maxPTYOutputQueueSize+1))
+		queued, dropped, _ := queue.stats()
+		require.Equal(t, maxPTYOutputQueueSize+1, queued)
+		require.Zero(t, dropped)
+	})
+
+	t.Run("Copies", func(t *testing.T) {
+		t.Parallel()
+		queue := newPTYOutputQueue(time.Now)
+		buffer := []byte("hello")
+		queue.push(buffer)
+		copy(buffer, "world")
+		chunks, ok := queue.take()
+		require.True(t, ok)
+		require.Equal(t, []byte("hello"), chunks[0].data)
+	})
+
+	t.Run("Lag", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		queue := newPTYOutputQueue(func() time.Time { return now })
+		_, _, lag := queue.stats()
+		require.Zero(t, lag)
+
+		queue.push([]byte("a"))
+		now = now.Add(time.Second)
+		_, _, lag = queue.stats()
+		require.Equal(t, time.Second, lag)
+
+		// Output that's being written still lags.
+		_, ok := queue.take()
+		require.True(t, ok)
+		now = now.Add(time.Second)
+		queued, _, lag := queue.stats()
+		require.Zero(t, queued)
+		require.Equal(t, 2*time.Second, lag)
+
+		queue.done()
+		_, _, lag = queue.stats()
+		require.Zero(t, lag)
+	})
+
+	t.Run("End", func(t *testing.T) {
+		t.Parallel()
+		queue := newPTYOutputQueue(time.Now)
+		queue.push([]byte("a"))
+		queue.end()
+		// Output after the queue ended is discarded, but the output that
+		// was queued is still taken.
+		queue.push([]byte("b"))
+		chunks, ok := queue.take()
+		require.True(t, ok)
+		require.Len(t, chunks, 1)
+		require.Equal(t, []byte("a"), chunks[0].data)
+		queue.done()
+		_, ok = queue.take()
+		require.False(t, ok)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		t.Parallel()
+		queue := newPTYOutputQueue(time.Now)
+		taken := make(chan bool)
+		go func() {
+			_, ok := queue.take()
+			taken <- ok
+		}()
+		queue.close()
+		require.False(t, <-taken)
+
+		// Output after the queue closed is discarded.
+		queue.push([]byte("a"))
+		queued, _, _ := queue.stats()
+		require.Zero(t, queued)
+	})
+}
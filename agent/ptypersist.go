@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+const (
+	// ptyPersistFile is where the output of reconnecting PTYs is persisted
+	// while the agent runs, relative to the temporary directory of the
+	// agent.
+	ptyPersistFile = "coder-reconnecting-pty-buffers.json"
+	// ptyPersistInterval is how often the output of reconnecting PTYs is
+	// persisted when it changed.
+	ptyPersistInterval = 5 * time.Second
+	// defaultPTYRetention is how long persisted reconnecting PTYs are
+	// restored after the agent last saw them running.
+	defaultPTYRetention = time.Hour
+)
+
+type ptyPersistFileContent struct {
+	PersistedAt time.Time     `json:"persisted_at"`
+	PTYs        []ptySnapshot `json:"ptys"`
+}
+
+func (a *agent) ptyPersistPath() string {
+	return filepath.Join(a.tempDir, ptyPersistFile)
+}
+
+// persistPTYsLoop persists the output of reconnecting PTYs whenever it
+// changes, so clients that reconnect after the agent restarts see it
+// instead of an empty terminal. The agent persists them a last time when
+// it's closed.
+func (a *agent) persistPTYsLoop(ctx context.Context) {
+	defer a.connCloseWait.Done()
+	ticker := time.NewTicker(ptyPersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !a.ptysChanged.Swap(false) {
+			continue
+		}
+		err := a.persistPTYs(false)
+		if err != nil {
+			a.logger.Warn(ctx, "persist reconnecting ptys", slog.F("path", a.ptyPersistPath()), slog.Error(err))
+		}
+	}
+}
+
+// persistPTYs writes the running reconnecting PTYs, and the restored ones
+// that weren't reconnected to yet, to disk. Once the agent is closed, only
+// the final call persists them, since PTYs are removed as their processes
+// are killed.
+func (a *agent) persistPTYs(final bool) error {
+	a.ptyPersistMutex.Lock()
+	defer a.ptyPersistMutex.Unlock()
+	if a.isClosed() && !final {
+		return nil
+	}
+	content := ptyPersistFileContent{
+		PersistedAt: time.Now(),
+		PTYs:        a.snapshotReconnectingPTYs(),
+	}
+	a.ptySnapshotsMutex.Lock()
+	for id, snapshot := range a.ptySnapshots {
+		if time.Since(snapshot.UpdatedAt) > a.ptyRetention {
+			delete(a.ptySnapshots, id)
+			continue
+		}
+		content.PTYs = append(content.PTYs, snapshot)
+	}
+	a.ptySnapshotsMutex.Unlock()
+
+	path := a.ptyPersistPath()
+	if len(content.PTYs) == 0 {
+		err := a.filesystem.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return xerrors.Errorf("remove: %w", err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return xerrors.Errorf("marshal: %w", err)
+	}
+	// The file is replaced atomically, so the agent doesn't read a partial
+	// file if it was killed while writing it.
+	err = afero.WriteFile(a.filesystem, path+".tmp", data, 0o600)
+	if err == nil {
+		err = a.filesystem.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return xerrors.Errorf("write: %w", explainWriteError(err, "CODER_AGENT_TEMP_DIR"))
+	}
+	return nil
+}
+
+// restorePersistedPTYs reads the reconnecting PTYs that were persisted
+// before the agent restarted, unless they weren't seen running within the
+// retention window.
+func (a *agent) restorePersistedPTYs(ctx context.Context) {
+	path := a.ptyPersistPath()
+	data, err := afero.ReadFile(a.filesystem, path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			a.logger.Warn(ctx, "read persisted reconnecting ptys", slog.F("path", path), slog.Error(err))
+		}
+		return
+	}
+	var content ptyPersistFileContent
+	err = json.Unmarshal(data, &content)
+	if err != nil {
+		a.logger.Warn(ctx, "parse persisted reconnecting ptys", slog.F("path", path), slog.Error(err))
+		return
+	}
+	a.ptySnapshotsMutex.Lock()
+	defer a.ptySnapshotsMutex.Unlock()
+	restored := 0
+	for _, snapshot := range content.PTYs {
+		if time.Since(snapshot.UpdatedAt) > a.ptyRetention {
+			continue
+		}
+		a.ptySnapshots[snapshot.ID] = snapshot
+		restored++
+	}
+	a.logger.Info(ctx, "restored persisted reconnecting ptys",
+		slog.F("reconnecting_ptys", restored),
+		slog.F("expired", len(content.PTYs)-restored),
+		slog.F("persisted_at", content.PersistedAt),
+	)
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func TestPersistPTYs(t *testing.T) {
+	t.Parallel()
+
+	newAgent := func(t *testing.T, fs afero.Fs) *agent {
+		return &agent{
+			logger:       slogtest.Make(t, nil),
+			filesystem:   fs,
+			tempDir:      "/tmp",
+			closed:       make(chan struct{}),
+			ptySnapshots: map[uuid.UUID]ptySnapshot{},
+			ptyRetention: time.Hour,
+		}
+	}
+
+	t.Run("Retention", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		a := newAgent(t, fs)
+		recent := ptySnapshot{
+			ID:        uuid.New(),
+			Output:    []byte("recent"),
+			UpdatedAt: time.Now().Add(-time.Minute),
+		}
+		expired := ptySnapshot{
+			ID:        uuid.New(),
+			Output:    []byte("expired"),
+			UpdatedAt: time.Now().Add(-2 * time.Hour),
+		}
+		a.ptySnapshots[recent.ID] = recent
+		a.ptySnapshots[expired.ID] = expired
+		require.NoError(t, a.persistPTYs(false))
+		// Expired PTYs aren't persisted.
+		require.Len(t, a.ptySnapshots, 1)
+
+		restarted := newAgent(t, fs)
+		restarted.restorePersistedPTYs(context.Background())
+		snapshot, ok := restarted.takePTYSnapshot(recent.ID)
+		require.True(t, ok)
+		require.Equal(t, "recent", string(snapshot.Output))
+		require.Equal(t, ptyRestartedMessage, snapshot.restoredMessage())
+		_, ok = restarted.takePTYSnapshot(expired.ID)
+		require.False(t, ok)
+
+		// The file is removed once there's nothing to persist.
+		require.NoError(t, restarted.persistPTYs(false))
+		exists, err := afero.Exists(fs, restarted.ptyPersistPath())
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		a := newAgent(t, fs)
+		a.ptySnapshots[uuid.New()] = ptySnapshot{UpdatedAt: time.Now()}
+		close(a.closed)
+		// Only the final call persists PTYs once the agent is closed.
+		require.NoError(t, a.persistPTYs(false))
+		exists, err := afero.Exists(fs, a.ptyPersistPath())
+		require.NoError(t, err)
+		require.False(t, exists)
+		require.NoError(t, a.persistPTYs(true))
+		exists, err = afero.Exists(fs, a.ptyPersistPath())
+		require.NoError(t, err)
+		require.True(t, exists)
+	})
+}
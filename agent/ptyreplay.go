@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+)
+
+// screenResetSequence moves the cursor home and clears the screen of the
+// terminal that output is replayed to.
+const screenResetSequence = "\x1b[H\x1b[2J"
+
+// altScreenSwitch is how an escape sequence switches between the normal
+// screen and the alternate screen of full-screen programs.
+type altScreenSwitch int
+
+const (
+	altScreenUnchanged altScreenSwitch = iota
+	altScreenEnter
+	altScreenLeave
+)
+
+// screenSequence is an escape sequence that changes the whole screen.
+type screenSequence struct {
+	seq []byte
+	// clear is whether the screen is empty after the sequence, so output
+	// can be replayed from it onto a cleared screen.
+	clear     bool
+	altScreen altScreenSwitch
+}
+
+var (
+	screenSequences = []screenSequence{
+		{seq: []byte("\x1b[2J"), clear: true},
+		{seq: []byte("\x1b[3J"), clear: true},
+		{seq: []byte("\x1bc"), clear: true, altScreen: altScreenLeave},
+		{seq: []byte("\x1b[?1049h"), clear: true, altScreen: altScreenEnter},
+		{seq: []byte("\x1b[?1047h"), clear: true, altScreen: altScreenEnter},
+		{seq: []byte("\x1b[?47h"), clear: true, altScreen: altScreenEnter},
+		{seq: []byte("\x1b[?1049l"), altScreen: altScreenLeave},
+		{seq: []byte("\x1b[?1047l"), altScreen: altScreenLeave},
+		{seq: []byte("\x1b[?47l"), altScreen: altScreenLeave},
+	}
+	maxScreenSequenceLength = func() int {
+		var max int
+		for _, s := range screenSequences {
+			if len(s.seq) > max {
+				max = len(s.seq)
+			}
+		}
+		return max
+	}()
+)
+
+// screenTracker finds where the screen was last cleared in the output of a
+// PTY, as an offset into all the output that was written. Sequences can be
+// split across writes.
+type screenTracker struct {
+	// tail is the end of the previous write, which can hold the start of
+	// a sequence.
+	tail    []byte
+	written int64
+	// lastClear is the offset of the last sequence that cleared the screen,
+	// or -1 if none was written.
+	lastClear int64
+	// altScreen is whether output is written to the alternate screen, and
+	// clearAltScreen whether it was when the screen was last cleared.
+	altScreen      bool
+	clearAltScreen bool
+}
+
+func newScreenTracker() *screenTracker {
+	return &screenTracker{lastClear: -1}
+}
+
+func (t *screenTracker) Write(data []byte) (int, error) {
+	buf := append(t.tail, data...)
+	start := t.written - int64(len(t.tail))
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != 0x1b {
+			continue
+		}
+		for _, s := range screenSequences {
+			// Sequences that ended in the tail were found by the
+			// previous write.
+			if i+len(s.seq) <= len(t.tail) || !bytes.HasPrefix(buf[i:], s.seq) {
+				continue
+			}
+			switch s.altScreen {
+			case altScreenEnter:
+				t.altScreen = true
+			case altScreenLeave:
+				t.altScreen = false
+			}
+			if s.clear {
+				t.lastClear = start + int64(i)
+				t.clearAltScreen = t.altScreen
+			}
+			break
+		}
+	}
+	t.written += int64(len(data))
+	keep := maxScreenSequenceLength - 1
+	if keep > len(buf) {
+		keep = len(buf)
+	}
+	t.tail = append(t.tail[:0], buf[len(buf)-keep:]...)
+	return len(data), nil
+}
+
+// replay writes the output of the PTY to a terminal that connects with the
+// given size. Output that was wrapped and positioned for another size is
+// garbled when it's replayed as is, so if the size changed and snapshot is
+// set, only the output since the screen was last cleared is replayed onto a
+// cleared screen. Full-screen programs redraw when the PTY is resized after.
+func (r *reconnectingPTY) replay(w io.Writer, height, width uint16, snapshot bool) error {
+	// The output is written while it's locked, so it's consistent with
+	// the screen and size it was tracked for.
+	r.circularBufferMutex.RLock()
+	defer r.circularBufferMutex.RUnlock()
+	output := r.circularBuffer.Bytes()
+	if !snapshot || len(output) == 0 || height == 0 || width == 0 || (height == r.height && width == r.width) {
+		_, err := w.Write(output)
+		return err
+	}
+	reset := screenResetSequence
+	if r.screen.clearAltScreen {
+		reset = "\x1b[?1049h" + reset
+	}
+	// The offset of the first byte that's still in the buffer.
+	first := r.circularBuffer.TotalWritten() - int64(len(output))
+	if r.screen.lastClear >= first {
+		output = output[r.screen.lastClear-first:]
+	}
+	_, err := w.Write(append([]byte(reset), output...))
+	return err
+}
+
+// resize resizes the PTY and remembers the size, which the output that
+// follows is formatted for.
+func (r *reconnectingPTY) resize(height, width uint16) error {
+	r.circularBufferMutex.Lock()
+	r.height, r.width = height, width
+	r.circularBufferMutex.Unlock()
+	return r.ptty.Resize(height, width)
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScreenTracker(t *testing.T) {
+	t.Parallel()
+
+	track := func(writes ...string) *screenTracker {
+		tracker := newScreenTracker()
+		for _, write := range writes {
+			_, _ = tracker.Write([]byte(write))
+		}
+		return tracker
+	}
+
+	t.Run("None", func(t *testing.T) {
+		t.Parallel()
+		require.EqualValues(t, -1, track("hello\r\n", "\x1b[1mworld\x1b[0m").lastClear)
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		t.Parallel()
+		tracker := track("before", "\x1b[H\x1b[2Jafter\x1b[2J")
+		require.EqualValues(t, len("before\x1b[H\x1b[2Jafter"), tracker.lastClear)
+		require.False(t, tracker.clearAltScreen)
+	})
+
+	t.Run("SplitWrites", func(t *testing.T) {
+		t.Parallel()
+		tracker := track("ab", "\x1b", "[", "2", "Jcd", "ef")
+		require.EqualValues(t, 2, tracker.lastClear)
+	})
+
+	t.Run("AltScreen", func(t *testing.T) {
+		t.Parallel()
+		tracker := track("$ vim\r\n", "\x1b[?1049h", "\x1b[2Jfile")
+		require.EqualValues(t, len("$ vim\r\n\x1b[?1049h"), tracker.lastClear)
+		require.True(t, tracker.clearAltScreen)
+
+		// Leaving the alternate screen doesn't clear the screen.
+		_, _ = tracker.Write([]byte("\x1b[?1049l$ "))
+		require.EqualValues(t, len("$ vim\r\n\x1b[?1049h"), tracker.lastClear)
+		require.True(t, tracker.clearAltScreen)
+		_, _ = tracker.Write([]byte("\x1bc"))
+		require.False(t, tracker.clearAltScreen)
+	})
+}
+
+func TestReconnectingPTYReplay(t *testing.T) {
+	t.Parallel()
+
+	newRPTY := func(size int, writes ...string) *reconnectingPTY {
+		circularBuffer := newPTYScrollbackStore(defaultPTYScrollbackLimit).newBuffer(size)
+		rpty := &reconnectingPTY{
+			circularBuffer: circularBuffer,
+			screen:         newScreenTracker(),
+			height:         24,
+			width:          80,
+		}
+		for _, write := range writes {
+			_, _ = circularBuffer.Write([]byte(write))
+			_, _ = rpty.screen.Write([]byte(write))
+		}
+		return rpty
+	}
+	replay := func(rpty *reconnectingPTY, height, width uint16) string {
+		var output bytes.Buffer
+		require.NoError(t, rpty.replay(&output, height, width, true))
+		return output.String()
+	}
+
+	t.Run("SameSize", func(t *testing.T) {
+		t.Parallel()
+		rpty := newRPTY(1<<10, "before\x1b[2J", "after")
+		require.Equal(t, "before\x1b[2Jafter", replay(rpty, 24, 80))
+		// Clients that don't report their size get all of the output.
+		require.Equal(t, "before\x1b[2Jafter", replay(rpty, 0, 0))
+	})
+
+	t.Run("Resized", func(t *testing.T) {
+		t.Parallel()
+		rpty := newRPTY(1<<10, "before\x1b[2J", "after")
+		require.Equal(t, screenResetSequence+"\x1b[2Jafter", replay(rpty, 50, 120))
+	})
+
+	t.Run("ResizedWithoutSnapshot", func(t *testing.T) {
+		t.Parallel()
+		rpty := newRPTY(1<<10, "before\x1b[2J", "after")
+		var output bytes.Buffer
+		require.NoError(t, rpty.replay(&output, 50, 120, false))
+		require.Equal(t, "before\x1b[2Jafter", output.String())
+	})
+
+	t.Run("ResizedAltScreen", func(t *testing.T) {
+		t.Parallel()
+		rpty := newRPTY(1<<10, "$ top\r\n\x1b[?1049h\x1b[Hload")
+		require.Equal(t, "\x1b[?1049h"+screenResetSequence+"\x1b[?1049h\x1b[Hload", replay(rpty, 50, 120))
+	})
+
+	t.Run("ResizedWithoutClear", func(t *testing.T) {
+		t.Parallel()
+		rpty := newRPTY(1<<10, "one\r\n", "two\r\n")
+		require.Equal(t, screenResetSequence+"one\r\ntwo\r\n", replay(rpty, 50, 120))
+	})
+
+	t.Run("ClearOverwritten", func(t *testing.T) {
+		t.Parallel()
+		// The clear is no longer in the buffer, so all of it is replayed.
+		rpty := newRPTY(8, "\x1b[2Jold", "12345678")
+		require.Equal(t, screenResetSequence+"12345678", replay(rpty, 50, 120))
+	})
+}
@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"sync"
+)
+
+const (
+	// ptyScrollbackPageSize is the unit the scrollback of reconnecting PTYs
+	// is stored and evicted in.
+	ptyScrollbackPageSize = 16 << 10
+	// defaultPTYScrollbackLimit bounds the scrollback of all reconnecting
+	// PTYs together, since workspaces can have dozens of web terminals
+	// that each keep up to maxPTYBufferSize.
+	defaultPTYScrollbackLimit = 64 << 20
+	minPTYScrollbackLimit     = ptyScrollbackPageSize
+)
+
+// ptyScrollbackStore keeps the scrollback of reconnecting PTYs in an arena
+// of pages that's shared by them, up to a limit. Pages are only used as
+// output is written, rather than the size of the scrollback being allocated
+// for every PTY, and when the arena is full, the oldest output of the PTY
+// that was least recently used is evicted.
+type ptyScrollbackStore struct {
+	mutex sync.Mutex
+	limit int
+	// arena is mapped when the first page is used. Pages that are freed
+	// when PTYs close are released to the OS.
+	arena   []byte
+	release func(page []byte)
+	free    []int
+	// pages is how many pages of the arena were used, which are reused
+	// from free before the arena grows into new ones.
+	pages   int
+	buffers map[*ptyScrollback]struct{}
+	// clock orders the use of buffers, for evicting the least recently
+	// used.
+	clock uint64
+}
+
+func newPTYScrollbackStore(limit int) *ptyScrollbackStore {
+	return &ptyScrollbackStore{
+		limit:   clampPTYScrollbackLimit(limit),
+		buffers: map[*ptyScrollback]struct{}{},
+	}
+}
+
+func clampPTYScrollbackLimit(limit int) int {
+	if limit < minPTYScrollbackLimit {
+		return minPTYScrollbackLimit
+	}
+	// The arena is made of whole pages.
+	return limit - limit%ptyScrollbackPageSize
+}
+
+// newBuffer returns the scrollback of a PTY, which keeps up to size bytes
+// of its output while the store has room.
+func (s *ptyScrollbackStore) newBuffer(size int) *ptyScrollback {
+	return &ptyScrollback{
+		store: s,
+		size:  size,
+	}
+}
+
+func (s *ptyScrollbackStore) page(index int) []byte {
+	return s.arena[index*ptyScrollbackPageSize : (index+1)*ptyScrollbackPageSize]
+}
+
+// allocLocked returns a page for the buffer, which is evicted from the
+// least recently used buffer when there are no free pages.
+func (s *ptyScrollbackStore) allocLocked(buffer *ptyScrollback) int {
+	if s.arena == nil {
+		s.arena, s.release = mapPTYScrollbackArena(s.limit)
+	}
+	if len(s.free) > 0 {
+		index := s.free[len(s.free)-1]
+		s.free = s.free[:len(s.free)-1]
+		return index
+	}
+	if s.pages < s.limit/ptyScrollbackPageSize {
+		s.pages++
+		return s.pages - 1
+	}
+	// The buffer is only evicted itself when it's the only one with
+	// pages.
+	victim := buffer
+	for other := range s.buffers {
+		if other == buffer || len(other.pages) == 0 {
+			continue
+		}
+		if victim == buffer || other.used < victim.used {
+			victim = other
+		}
+	}
+	dropped := ptyScrollbackPageSize - victim.start
+	if dropped > victim.length {
+		dropped = victim.length
+	}
+	victim.dropLocked(dropped)
+	index := s.free[len(s.free)-1]
+	s.free = s.free[:len(s.free)-1]
+	return index
+}
+
+// ptyScrollback is the scrollback of a reconnecting PTY. It's written like
+// a circular buffer, but its pages are in the arena of the store.
+type ptyScrollback struct {
+	store *ptyScrollbackStore
+	size  int
+	// pages hold the output, which starts at start in the first page.
+	pages   []int
+	start   int
+	length  int
+	written int64
+	used    uint64
+}
+
+func (b *ptyScrollback) Write(p []byte) (int, error) {
+	s := b.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.buffers[b] = struct{}{}
+	b.touchLocked()
+	b.written += int64(len(p))
+	n := len(p)
+	if len(p) > b.size {
+		p = p[len(p)-b.size:]
+	}
+	if overflow := b.length + len(p) - b.size; overflow > 0 {
+		b.dropLocked(overflow)
+	}
+	for len(p) > 0 {
+		end := b.start + b.length
+		if end == len(b.pages)*ptyScrollbackPageSize {
+			index := s.allocLocked(b)
+			// Evicting the only page of the buffer resets it.
+			end = b.start + b.length
+			b.pages = append(b.pages, index)
+		}
+		page := s.page(b.pages[end/ptyScrollbackPageSize])
+		copied := copy(page[end%ptyScrollbackPageSize:], p)
+		p = p[copied:]
+		b.length += copied
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the output that's kept.
+func (b *ptyScrollback) Bytes() []byte {
+	s := b.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b.touchLocked()
+	output := make([]byte, 0, b.length)
+	offset := b.start
+	for _, index := range b.pages {
+		end := offset + b.length - len(output)
+		if end > ptyScrollbackPageSize {
+			end = ptyScrollbackPageSize
+		}
+		output = append(output, s.page(index)[offset:end]...)
+		offset = 0
+	}
+	return output
+}
+
+// TotalWritten returns how many bytes were written, including the ones
+// that aren't kept.
+func (b *ptyScrollback) TotalWritten() int64 {
+	b.store.mutex.Lock()
+	defer b.store.mutex.Unlock()
+	return b.written
+}
+
+// Reset discards the output, and releases its pages.
+func (b *ptyScrollback) Reset() {
+	s := b.store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, index := range b.pages {
+		s.release(s.page(index))
+	}
+	b.dropLocked(b.length)
+	b.written = 0
+	delete(s.buffers, b)
+}
+
+func (b *ptyScrollback) touchLocked() {
+	b.store.clock++
+	b.used = b.store.clock
+}
+
+// dropLocked discards the oldest bytes of the output, and frees the pages
+// that don't hold any output anymore.
+func (b *ptyScrollback) dropLocked(n int) {
+	b.start += n
+	b.length -= n
+	for len(b.pages) > 0 && (b.start >= ptyScrollbackPageSize || b.length == 0) {
+		b.store.free = append(b.store.free, b.pages[0])
+		b.pages = b.pages[1:]
+		if b.start >= ptyScrollbackPageSize {
+			b.start -= ptyScrollbackPageSize
+		}
+	}
+	if b.length == 0 {
+		b.start = 0
+	}
+}
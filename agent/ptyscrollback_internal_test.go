@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPTYScrollback(t *testing.T) {
+	t.Parallel()
+
+	t.Run("KeepsLatest", func(t *testing.T) {
+		t.Parallel()
+		store := newPTYScrollbackStore(defaultPTYScrollbackLimit)
+		size := 3*ptyScrollbackPageSize + 100
+		buffer := store.newBuffer(size)
+		// Writes of random sizes are kept like a circular buffer keeps
+		// them, across pages.
+		random := rand.New(rand.NewSource(0)) //nolint:gosec
+		var written []byte
+		for i := 0; i < 200; i++ {
+			data := make([]byte, random.Intn(2*ptyScrollbackPageSize))
+			_, _ = random.Read(data)
+			n, err := buffer.Write(data)
+			require.NoError(t, err)
+			require.Equal(t, len(data), n)
+			written = append(written, data...)
+
+			expected := written
+			if len(expected) > size {
+				expected = expected[len(expected)-size:]
+			}
+			require.True(t, bytes.Equal(expected, buffer.Bytes()))
+			require.EqualValues(t, len(written), buffer.TotalWritten())
+		}
+		// Only the pages that hold output are used.
+		require.LessOrEqual(t, len(buffer.pages), size/ptyScrollbackPageSize+2)
+	})
+
+	t.Run("EvictsLeastRecentlyUsed", func(t *testing.T) {
+		t.Parallel()
+		store := newPTYScrollbackStore(4 * ptyScrollbackPageSize)
+		first := store.newBuffer(maxPTYBufferSize)
+		second := store.newBuffer(maxPTYBufferSize)
+		third := store.newBuffer(maxPTYBufferSize)
+		page := func(b byte) []byte {
+			return bytes.Repeat([]byte{b}, ptyScrollbackPageSize)
+		}
+		_, _ = first.Write(page('a'))
+		_, _ = second.Write(page('b'))
+		_, _ = third.Write(page('c'))
+		_, _ = third.Write(page('c'))
+		// Replaying the first makes the second the least recently used.
+		_ = first.Bytes()
+
+		_, _ = third.Write([]byte("c"))
+		require.Equal(t, page('a'), first.Bytes())
+		require.Empty(t, second.Bytes())
+		require.EqualValues(t, ptyScrollbackPageSize, second.TotalWritten())
+		require.Len(t, third.Bytes(), 2*ptyScrollbackPageSize+1)
+
+		// The only buffer with pages evicts its own oldest output.
+		first.Reset()
+		_, _ = third.Write(page('d'))
+		_, _ = third.Write(page('d'))
+		output := third.Bytes()
+		require.Len(t, output, 3*ptyScrollbackPageSize+1)
+		require.Equal(t, byte('c'), output[0])
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		t.Parallel()
+		store := newPTYScrollbackStore(defaultPTYScrollbackLimit)
+		buffer := store.newBuffer(maxPTYBufferSize)
+		_, _ = buffer.Write(make([]byte, 2*ptyScrollbackPageSize))
+		buffer.Reset()
+		require.Empty(t, buffer.Bytes())
+		require.Zero(t, buffer.TotalWritten())
+		require.Len(t, store.free, 2)
+		require.Empty(t, store.buffers)
+
+		// Freed pages are reused.
+		_, _ = buffer.Write([]byte("hello"))
+		require.Equal(t, []byte("hello"), buffer.Bytes())
+		require.Equal(t, 2, store.pages)
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, minPTYScrollbackLimit, clampPTYScrollbackLimit(1))
+		require.Equal(t, 2*ptyScrollbackPageSize, clampPTYScrollbackLimit(2*ptyScrollbackPageSize+1))
+	})
+}
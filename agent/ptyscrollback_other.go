@@ -0,0 +1,18 @@
+//go:build !windows
+
+package agent
+
+import "golang.org/x/sys/unix"
+
+// mapPTYScrollbackArena maps anonymous memory for the scrollback of
+// reconnecting PTYs, which the OS only backs as pages are written. Pages
+// that are released are handed back to the OS, unlike memory of the heap.
+func mapPTYScrollbackArena(size int) ([]byte, func(page []byte)) {
+	arena, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return make([]byte, size), func([]byte) {}
+	}
+	return arena, func(page []byte) {
+		_ = unix.Madvise(page, unix.MADV_DONTNEED)
+	}
+}
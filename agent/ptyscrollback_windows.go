@@ -0,0 +1,7 @@
+package agent
+
+// mapPTYScrollbackArena allocates the scrollback of reconnecting PTYs on
+// the heap, so pages that are released stay with the agent.
+func mapPTYScrollbackArena(size int) ([]byte, func(page []byte)) {
+	return make([]byte, size), func([]byte) {}
+}
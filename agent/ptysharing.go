@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// ptyParticipant is a connection to a reconnecting PTY. Connections that
+// can receive control messages, like WebSockets, are sent the participants
+// whenever they change.
+type ptyParticipant struct {
+	conn    net.Conn
+	info    codersdk.ReconnectingPTYParticipant
+	updates chan codersdk.ReconnectingPTYControl
+	// output is written to the connection by a goroutine of its own.
+	output *ptyOutputQueue
+}
+
+func newPTYParticipant(msg codersdk.ReconnectingPTYInit, conn net.Conn, updates chan codersdk.ReconnectingPTYControl) *ptyParticipant {
+	role := msg.Role
+	if role == "" {
+		role = codersdk.ReconnectingPTYRoleReadWrite
+	}
+	return &ptyParticipant{
+		conn: conn,
+		info: codersdk.ReconnectingPTYParticipant{
+			ID:            uuid.NewString(),
+			Name:          sanitizeSessionLabel(msg.Participant),
+			Role:          role,
+			RemoteAddress: conn.RemoteAddr().String(),
+			ConnectedAt:   time.Now(),
+		},
+		updates: updates,
+		output:  newPTYOutputQueue(time.Now),
+	}
+}
+
+// readOnly returns whether the input and sizes of the participant are
+// ignored.
+func (p *ptyParticipant) readOnly() bool {
+	return p.info.Role == codersdk.ReconnectingPTYRoleReadOnly
+}
+
+// notify replaces the update the participant hasn't received yet, so slow
+// connections only get the latest participants. It's called with the
+// participants locked.
+func (p *ptyParticipant) notify(control codersdk.ReconnectingPTYControl) {
+	if p.updates == nil {
+		return
+	}
+	select {
+	case <-p.updates:
+	default:
+	}
+	select {
+	case p.updates <- control:
+	default:
+	}
+}
+
+// validPTYRole returns whether connections can join PTYs with the role.
+func validPTYRole(role codersdk.ReconnectingPTYRole) bool {
+	switch role {
+	case "", codersdk.ReconnectingPTYRoleReadWrite, codersdk.ReconnectingPTYRoleReadOnly:
+		return true
+	default:
+		return false
+	}
+}
+
+// join adds the participant to the PTY, tells the others, and starts
+// writing the output to it.
+func (r *reconnectingPTY) join(participant *ptyParticipant) {
+	r.participantsMutex.Lock()
+	defer r.participantsMutex.Unlock()
+	r.participants[participant.info.ID] = participant
+	r.broadcastParticipantsLocked()
+	go r.writeOutput(participant)
+}
+
+// leave removes the participant from the PTY, and tells the others.
+func (r *reconnectingPTY) leave(participant *ptyParticipant) {
+	r.participantsMutex.Lock()
+	defer r.participantsMutex.Unlock()
+	delete(r.participants, participant.info.ID)
+	participant.output.close()
+	r.broadcastParticipantsLocked()
+}
+
+// writeOutput writes the output queued for the participant until it
+// leaves, its connection fails, or the PTY closes. The connection is closed
+// afterwards, so it isn't left open without output.
+func (r *reconnectingPTY) writeOutput(participant *ptyParticipant) {
+	defer participant.conn.Close()
+	for {
+		chunks, ok := participant.output.take()
+		if !ok {
+			return
+		}
+		for _, chunk := range chunks {
+			written, err := participant.conn.Write(chunk.data)
+			r.session.bytesOut.Add(int64(written))
+			if err != nil {
+				participant.output.close()
+				return
+			}
+		}
+		participant.output.done()
+	}
+}
+
+// listParticipants returns the participants of the PTY, ordered by when
+// they connected.
+func (r *reconnectingPTY) listParticipants() []codersdk.ReconnectingPTYParticipant {
+	r.participantsMutex.Lock()
+	defer r.participantsMutex.Unlock()
+	return r.listParticipantsLocked()
+}
+
+func (r *reconnectingPTY) listParticipantsLocked() []codersdk.ReconnectingPTYParticipant {
+	participants := make([]codersdk.ReconnectingPTYParticipant, 0, len(r.participants))
+	for _, participant := range r.participants {
+		info := participant.info
+		queued, dropped, lag := participant.output.stats()
+		info.QueuedBytes = queued
+		info.DroppedBytes = dropped
+		info.LagMilliseconds = lag.Milliseconds()
+		participants = append(participants, info)
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		if participants[i].ConnectedAt.Equal(participants[j].ConnectedAt) {
+			return participants[i].ID < participants[j].ID
+		}
+		return participants[i].ConnectedAt.Before(participants[j].ConnectedAt)
+	})
+	return participants
+}
+
+func (r *reconnectingPTY) broadcastParticipantsLocked() {
+	participants := r.listParticipantsLocked()
+	for id, participant := range r.participants {
+		participant.notify(codersdk.ReconnectingPTYControl{
+			Type:          codersdk.ReconnectingPTYControlParticipants,
+			Participants:  participants,
+			ParticipantID: id,
+		})
+	}
+}
+
+func (a *agent) loadReconnectingPTY(rw http.ResponseWriter, r *http.Request) (*reconnectingPTY, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		httpapi.Write(r.Context(), rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid reconnecting PTY ID.",
+			Detail:  err.Error(),
+		})
+		return nil, false
+	}
+	rawRPTY, ok := a.reconnectingPTYs.Load(id)
+	if !ok {
+		httpapi.ResourceNotFound(rw)
+		return nil, false
+	}
+	rpty, ok := rawRPTY.(*reconnectingPTY)
+	if !ok {
+		httpapi.ResourceNotFound(rw)
+		return nil, false
+	}
+	return rpty, true
+}
+
+func (a *agent) reconnectingPTYParticipantsHandler(rw http.ResponseWriter, r *http.Request) {
+	rpty, ok := a.loadReconnectingPTY(rw, r)
+	if !ok {
+		return
+	}
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.ReconnectingPTYParticipantsResponse{
+		Participants: rpty.listParticipants(),
+	})
+}
+
+// revokeReconnectingPTYParticipantHandler disconnects an observer of a
+// reconnecting PTY. Participants that can write are trusted to leave on
+// their own.
+func (a *agent) revokeReconnectingPTYParticipantHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rpty, ok := a.loadReconnectingPTY(rw, r)
+	if !ok {
+		return
+	}
+	id := chi.URLParam(r, "participant")
+	rpty.participantsMutex.Lock()
+	participant, ok := rpty.participants[id]
+	rpty.participantsMutex.Unlock()
+	if !ok {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+	if !participant.readOnly() {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Only read-only participants can be revoked.",
+		})
+		return
+	}
+	a.logger.Info(ctx, "revoking reconnecting pty participant", slog.F("participant", participant.info))
+	// The connection leaves the PTY when it's closed.
+	_ = participant.conn.Close()
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Revoked the participant.",
+	})
+}
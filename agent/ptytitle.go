@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSessionLabelLength limits the labels and titles of sessions, since
+// they're set by clients and programs in the workspace.
+const maxSessionLabelLength = 256
+
+type titleParserState int
+
+const (
+	titleParserGround titleParserState = iota
+	titleParserEscape
+	titleParserParam
+	titleParserText
+	titleParserTextEscape
+	titleParserIgnore
+	titleParserIgnoreEscape
+)
+
+// titleParser finds the titles that programs set with the OSC 0 and OSC 2
+// escape sequences, like "\x1b]0;title\x07", in the output of a PTY.
+// Sequences can be split across writes. Other output is ignored.
+type titleParser struct {
+	state   titleParserState
+	param   []byte
+	text    []byte
+	onTitle func(title string)
+}
+
+func newTitleParser(onTitle func(title string)) *titleParser {
+	return &titleParser{onTitle: onTitle}
+}
+
+func (p *titleParser) Write(data []byte) (int, error) {
+	for _, b := range data {
+		p.next(b)
+	}
+	return len(data), nil
+}
+
+func (p *titleParser) next(b byte) {
+	const (
+		esc = 0x1b
+		bel = 0x07
+	)
+	switch p.state {
+	case titleParserGround:
+		if b == esc {
+			p.state = titleParserEscape
+		}
+	case titleParserEscape, titleParserTextEscape, titleParserIgnoreEscape:
+		switch {
+		case p.state == titleParserTextEscape && b == '\\':
+			// The string terminator ends the title.
+			p.emit()
+		case b == ']':
+			p.state = titleParserParam
+			p.param = p.param[:0]
+			p.text = p.text[:0]
+		case b == esc:
+			p.state = titleParserEscape
+		default:
+			p.state = titleParserGround
+		}
+	case titleParserParam:
+		switch {
+		case b >= '0' && b <= '9' && len(p.param) < 4:
+			p.param = append(p.param, b)
+		case b == ';' && (string(p.param) == "0" || string(p.param) == "2"):
+			p.state = titleParserText
+		case b == bel:
+			p.state = titleParserGround
+		case b == esc:
+			p.state = titleParserIgnoreEscape
+		default:
+			p.state = titleParserIgnore
+		}
+	case titleParserText:
+		switch {
+		case b == bel:
+			p.emit()
+		case b == esc:
+			p.state = titleParserTextEscape
+		case len(p.text) >= maxSessionLabelLength*utf8.UTFMax:
+			p.state = titleParserIgnore
+		default:
+			p.text = append(p.text, b)
+		}
+	case titleParserIgnore:
+		switch b {
+		case bel:
+			p.state = titleParserGround
+		case esc:
+			p.state = titleParserIgnoreEscape
+		}
+	}
+}
+
+func (p *titleParser) emit() {
+	p.state = titleParserGround
+	p.onTitle(sanitizeSessionLabel(string(p.text)))
+}
+
+// sanitizeSessionLabel removes control characters and invalid UTF-8 from
+// a label or title, and truncates it.
+func sanitizeSessionLabel(label string) string {
+	label = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(label, ""))
+	label = strings.TrimSpace(label)
+	if utf8.RuneCountInString(label) > maxSessionLabelLength {
+		label = string([]rune(label)[:maxSessionLabelLength])
+	}
+	return label
+}
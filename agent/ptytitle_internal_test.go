@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTitleParser(t *testing.T) {
+	t.Parallel()
+
+	parse := func(writes ...string) []string {
+		var titles []string
+		parser := newTitleParser(func(title string) {
+			titles = append(titles, title)
+		})
+		for _, write := range writes {
+			_, _ = parser.Write([]byte(write))
+		}
+		return titles
+	}
+
+	t.Run("Bell", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, []string{"vim main.go"}, parse("$ \x1b]0;vim main.go\x07output"))
+	})
+
+	t.Run("StringTerminator", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, []string{"htop"}, parse("\x1b]2;htop\x1b\\"))
+	})
+
+	t.Run("SplitWrites", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, []string{"make all"}, parse("\x1b", "]", "0;ma", "ke all", "\x1b", "\\"))
+	})
+
+	t.Run("OtherSequences", func(t *testing.T) {
+		t.Parallel()
+		// Hyperlinks and colors aren't titles.
+		require.Empty(t, parse("\x1b]8;;https://coder.com\x07link\x1b]8;;\x07", "\x1b[31mred\x1b[0m"))
+		require.Equal(t, []string{"after"}, parse("\x1b]8;;https://coder.com\x1b\\\x1b]0;after\x07"))
+	})
+
+	t.Run("Sanitized", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, []string{"tab"}, parse("\x1b]0; t\ta\x01b \x07"))
+		titles := parse("\x1b]0;" + strings.Repeat("x", 2*maxSessionLabelLength) + "\x07")
+		require.Len(t, titles, 1)
+		require.Len(t, titles[0], maxSessionLabelLength)
+		// Titles that are far too long are ignored.
+		require.Empty(t, parse("\x1b]0;"+strings.Repeat("x", 8*maxSessionLabelLength)+"\x07"))
+	})
+}
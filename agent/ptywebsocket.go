@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// reconnectingPTYWebSocketHandler serves reconnecting PTYs over WebSockets,
+// so web frontends and other tools don't implement the framing of the raw
+// protocol. Binary messages are the input and output of the terminal, and
+// text messages are codersdk.ReconnectingPTYControl messages, which include
+// the participants of the PTY when they change. PTYs outlive the request,
+// so they're started with the context of the agent.
+func (a *agent) reconnectingPTYWebSocketHandler(ctx context.Context) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !a.featureEnabled(codersdk.WorkspaceAgentFeaturePTYv2, true) {
+			httpapi.Write(r.Context(), rw, http.StatusNotFound, codersdk.Response{
+				Message: "Reconnecting PTYs over WebSockets are disabled by a feature flag.",
+			})
+			return
+		}
+		query := r.URL.Query()
+		// Named PTYs are attached to by name, and the ID is ignored.
+		name := query.Get("name")
+		id, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil && name == "" {
+			httpapi.Write(r.Context(), rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Invalid reconnecting PTY ID.",
+				Detail:  err.Error(),
+			})
+			return
+		}
+		height, _ := strconv.ParseUint(query.Get("height"), 10, 16)
+		width, _ := strconv.ParseUint(query.Get("width"), 10, 16)
+		// The agent bounds the size of the scrollback.
+		bufferSize, err := strconv.Atoi(query.Get("buffer_size"))
+		if err != nil || bufferSize < 0 {
+			bufferSize = 0
+		}
+		init := codersdk.ReconnectingPTYInit{
+			ID:          id,
+			Height:      uint16(height),
+			Width:       uint16(width),
+			Command:     query.Get("command"),
+			BufferSize:  bufferSize,
+			Label:       query.Get("label"),
+			Role:        codersdk.ReconnectingPTYRole(query.Get("role")),
+			Participant: query.Get("participant"),
+			Name:        name,
+		}
+		if !validPTYRole(init.Role) {
+			httpapi.Write(r.Context(), rw, http.StatusBadRequest, codersdk.Response{
+				Message: fmt.Sprintf("Unknown reconnecting PTY role %q.", init.Role),
+			})
+			return
+		}
+
+		conn, err := websocket.Accept(deadlineClearingWriter{rw}, r, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		})
+		if err != nil {
+			httpapi.Write(r.Context(), rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Failed to accept websocket.",
+				Detail:  err.Error(),
+			})
+			return
+		}
+		a.serveReconnectingPTYWebSocket(ctx, init, conn)
+	}
+}
+
+// serveReconnectingPTYWebSocket translates between the WebSocket and the raw
+// protocol of reconnecting PTYs, which the PTY is served with.
+func (a *agent) serveReconnectingPTYWebSocket(agentCtx context.Context, init codersdk.ReconnectingPTYInit, conn *websocket.Conn) {
+	ptyConn, bridge := net.Pipe()
+	defer bridge.Close()
+	updates := make(chan codersdk.ReconnectingPTYControl, 1)
+	go a.handleReconnectingPTY(agentCtx, init, ptyConn, updates)
+	ctx, cancel := context.WithCancel(agentCtx)
+	defer cancel()
+	defer func() {
+		_ = conn.Close(websocket.StatusNormalClosure, "")
+	}()
+	go httpapi.Heartbeat(ctx, conn)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case update := <-updates:
+				data, err := json.Marshal(update)
+				if err != nil {
+					continue
+				}
+				err = conn.Write(ctx, websocket.MessageText, data)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	// The output of the terminal is sent in binary messages until the PTY
+	// closes the connection.
+	go func() {
+		defer cancel()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := bridge.Read(buf)
+			if n > 0 {
+				err := conn.Write(ctx, websocket.MessageBinary, buf[:n])
+				if err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	encoder := json.NewEncoder(bridge)
+	for {
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		var req codersdk.ReconnectingPTYRequest
+		if typ == websocket.MessageBinary {
+			req.Data = string(data)
+		} else {
+			var control codersdk.ReconnectingPTYControl
+			err = json.Unmarshal(data, &control)
+			if err != nil {
+				_ = conn.Close(websocket.StatusUnsupportedData, httpapi.WebsocketCloseSprintf("decode control message: %s", err))
+				return
+			}
+			switch control.Type {
+			case codersdk.ReconnectingPTYControlResize:
+				req.Height, req.Width = control.Height, control.Width
+			case codersdk.ReconnectingPTYControlPing:
+				pong, _ := json.Marshal(codersdk.ReconnectingPTYControl{Type: codersdk.ReconnectingPTYControlPong})
+				err = conn.Write(ctx, websocket.MessageText, pong)
+				if err != nil {
+					return
+				}
+				continue
+			case codersdk.ReconnectingPTYControlList:
+				terminals, _ := json.Marshal(codersdk.ReconnectingPTYControl{
+					Type:      codersdk.ReconnectingPTYControlTerminals,
+					Terminals: a.listReconnectingPTYs(),
+				})
+				err = conn.Write(ctx, websocket.MessageText, terminals)
+				if err != nil {
+					return
+				}
+				continue
+			default:
+				_ = conn.Close(websocket.StatusUnsupportedData, httpapi.WebsocketCloseSprintf("unknown control message %q", control.Type))
+				return
+			}
+		}
+		err = encoder.Encode(req)
+		if err != nil {
+			a.logger.Debug(ctx, "write to reconnecting pty", slog.F("id", init.ID), slog.Error(err))
+			return
+		}
+	}
+}
+
+// deadlineClearingWriter clears the deadlines of hijacked connections,
+// which the timeouts of the statistics server set for the request.
+type deadlineClearingWriter struct {
+	http.ResponseWriter
+}
+
+func (w deadlineClearingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, xerrors.New("response writer can't be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, xerrors.Errorf("clear deadline: %w", err)
+	}
+	return conn, brw, nil
+}
@@ -0,0 +1,214 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/tailnet"
+)
+
+// startQUIC listens for QUIC connections from clients. UDP packets sent to
+// the agent on the tailnet are relayed to the same port on the loopback
+// address, so the listener is bound there on a random port that clients
+// request from the statistics server.
+func (a *agent) startQUIC(ctx context.Context) error {
+	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return xerrors.Errorf("listen udp: %w", err)
+	}
+	tlsConfig, err := quicTLSConfig()
+	if err != nil {
+		_ = udpConn.Close()
+		return xerrors.Errorf("create tls config: %w", err)
+	}
+	listener, err := quic.Listen(&quicPacketConn{conn: udpConn}, tlsConfig, codersdk.QUICConfig())
+	if err != nil {
+		_ = udpConn.Close()
+		return xerrors.Errorf("listen quic: %w", err)
+	}
+
+	a.closeMutex.Lock()
+	if a.isClosed() {
+		a.closeMutex.Unlock()
+		_ = listener.Close()
+		_ = udpConn.Close()
+		return xerrors.New("closed")
+	}
+	a.connCloseWait.Add(1)
+	a.closeMutex.Unlock()
+	a.quicPort.Store(uint32(udpConn.LocalAddr().(*net.UDPAddr).Port))
+	a.logger.Info(ctx, "listening for quic connections", slog.F("port", a.quicPort.Load()))
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	go func() {
+		defer a.connCloseWait.Done()
+		defer udpConn.Close()
+		for {
+			conn, err := listener.Accept(ctx)
+			if err != nil {
+				a.logger.Debug(ctx, "accept quic failed", slog.Error(err))
+				return
+			}
+			go a.handleQUICConn(ctx, conn)
+		}
+	}()
+	return nil
+}
+
+func (a *agent) handleQUICConn(ctx context.Context, conn quic.Connection) {
+	defer func() {
+		_ = conn.CloseWithError(0, "")
+	}()
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go a.handleQUICStream(ctx, codersdk.NewQUICStreamConn(conn, stream))
+	}
+}
+
+// handleQUICStream serves the stream like a TCP connection to the port on
+// the tailnet in its init message.
+func (a *agent) handleQUICStream(ctx context.Context, conn net.Conn) {
+	if a.draining.Load() {
+		_ = conn.Close()
+		return
+	}
+	init, err := codersdk.ReadQUICStreamInit(conn)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	switch int(init.Port) {
+	case codersdk.TailnetReconnectingPTYPort:
+		a.handleReconnectingPTYConn(ctx, conn)
+	case codersdk.TailnetSSHPort, codersdk.TailnetSpeedtestPort, codersdk.TailnetStatisticsPort, codersdk.TailnetLanguageServerPort, codersdk.TailnetSocksPort, codersdk.TailnetFileSyncPort, codersdk.TailnetExecPort:
+		// Other agent services are only served over TCP.
+		_ = conn.Close()
+	default:
+		local, err := tailnet.DialLoopback(ctx, init.Port, false)
+		if err != nil {
+			if !a.handleUnboundPort(conn, init.Port) {
+				a.logger.Debug(ctx, "dial local port for quic stream", slog.F("port", init.Port), slog.Error(err))
+			}
+			_ = conn.Close()
+			return
+		}
+		Bicopy(ctx, conn, local)
+	}
+}
+
+func (a *agent) quicHandler(rw http.ResponseWriter, r *http.Request) {
+	port := a.quicPort.Load()
+	if port == 0 {
+		httpapi.Write(r.Context(), rw, http.StatusNotFound, codersdk.Response{
+			Message: "QUIC is not enabled for this agent.",
+		})
+		return
+	}
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.QUICResponse{
+		Port: uint16(port),
+	})
+}
+
+// quicTLSConfig creates a TLS configuration with a self-signed certificate.
+// Clients don't verify it, because the tailnet authenticates the agent.
+func quicTLSConfig() (*tls.Config, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, xerrors.Errorf("generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, privateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("create certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{cert},
+			PrivateKey:  privateKey,
+		}},
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{codersdk.QUICProtocol},
+	}, nil
+}
+
+// quicPacketConn hides the address type of the loopback socket from QUIC.
+// Packets are relayed over the tailnet, where the MTU leaves less room than
+// QUIC assumes for IPv4 peers, so it must fall back to the minimum packet
+// size that's used for unknown address types.
+type quicPacketConn struct {
+	conn *net.UDPConn
+}
+
+type quicAddr struct {
+	*net.UDPAddr
+}
+
+func (c *quicPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.conn.ReadFromUDP(p)
+	if addr == nil {
+		return n, nil, err
+	}
+	return n, quicAddr{addr}, err
+}
+
+func (c *quicPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if a, ok := addr.(quicAddr); ok {
+		addr = a.UDPAddr
+	}
+	return c.conn.WriteTo(p, addr)
+}
+
+func (c *quicPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *quicPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *quicPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *quicPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// SetReadBuffer and SyscallConn allow QUIC to increase the receive buffer
+// of the socket.
+func (c *quicPacketConn) SetReadBuffer(bytes int) error {
+	return c.conn.SetReadBuffer(bytes)
+}
+
+func (c *quicPacketConn) SyscallConn() (syscall.RawConn, error) {
+	return c.conn.SyscallConn()
+}
@@ -0,0 +1,255 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/armon/circbuf"
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// defaultQuickActionTimeout is how long quick actions can run when
+	// they don't set a timeout.
+	defaultQuickActionTimeout = 10 * time.Minute
+	// quickActionOutputSize is how much of the end of the output of a
+	// quick action is kept.
+	quickActionOutputSize = 64 << 10
+)
+
+var errQuickActionRunning = xerrors.New("quick action is running")
+
+// quickActionRun is the output and state of a run of a quick action.
+type quickActionRun struct {
+	mutex  sync.Mutex
+	run    codersdk.WorkspaceAgentQuickActionRun
+	output *circbuf.Buffer
+}
+
+func (r *quickActionRun) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.output.Write(p)
+}
+
+// finish records the exit of the command.
+func (r *quickActionRun) finish(status codersdk.WorkspaceAgentQuickActionRunStatus, exitCode *int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	r.run.Status = status
+	r.run.FinishedAt = &now
+	r.run.ExitCode = exitCode
+}
+
+func (r *quickActionRun) running() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.run.Status == codersdk.WorkspaceAgentQuickActionRunRunning
+}
+
+func (r *quickActionRun) snapshot() codersdk.WorkspaceAgentQuickActionRun {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	run := r.run
+	run.Output = string(r.output.Bytes())
+	run.OutputTruncated = r.output.TotalWritten() > r.output.Size()
+	return run
+}
+
+// quickActions returns the quick actions of the current metadata.
+func (a *agent) quickActions() []codersdk.WorkspaceAgentQuickAction {
+	metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if !ok {
+		return nil
+	}
+	return metadata.QuickActions
+}
+
+func (a *agent) quickActionsHandler(rw http.ResponseWriter, r *http.Request) {
+	actions := a.quickActions()
+	states := make([]codersdk.WorkspaceAgentQuickActionState, 0, len(actions))
+	a.quickActionRunsMutex.Lock()
+	for _, action := range actions {
+		state := codersdk.WorkspaceAgentQuickActionState{
+			Name:        action.Name,
+			DisplayName: action.DisplayName,
+			Command:     action.Command,
+		}
+		if state.DisplayName == "" {
+			state.DisplayName = action.Name
+		}
+		if run, ok := a.quickActionRuns[action.Name]; ok {
+			snapshot := run.snapshot()
+			state.LastRun = &snapshot
+		}
+		states = append(states, state)
+	}
+	a.quickActionRunsMutex.Unlock()
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.WorkspaceAgentQuickActionsResponse{
+		QuickActions: states,
+	})
+}
+
+// runQuickActionHandler runs a quick action by its name. Only the commands
+// of the quick actions in the metadata can be run, so clients can't run
+// arbitrary commands.
+func (a *agent) runQuickActionHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := chi.URLParam(r, "name")
+	var (
+		action codersdk.WorkspaceAgentQuickAction
+		found  bool
+	)
+	for _, quickAction := range a.quickActions() {
+		if quickAction.Name == name {
+			action = quickAction
+			found = true
+			break
+		}
+	}
+	if !found || name == "" {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	run, err := a.runQuickAction(ctx, action)
+	if errors.Is(err, errQuickActionRunning) {
+		httpapi.Write(ctx, rw, http.StatusConflict, codersdk.Response{
+			Message: "The quick action is already running.",
+		})
+		return
+	}
+	if codersdk.WorkspaceAgentErrorCodeOf(err) == codersdk.WorkspaceAgentErrorSessionDenied {
+		httpapi.Write(ctx, rw, http.StatusForbidden, codersdk.Response{
+			Message: "The quick action was denied.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Failed to run the quick action.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, run)
+}
+
+// runQuickAction starts the command of a quick action, and records its
+// output and exit code until it runs again. An action only runs once at a
+// time.
+func (a *agent) runQuickAction(ctx context.Context, action codersdk.WorkspaceAgentQuickAction) (codersdk.WorkspaceAgentQuickActionRun, error) {
+	a.quickActionRunsMutex.Lock()
+	defer a.quickActionRunsMutex.Unlock()
+	if previous, ok := a.quickActionRuns[action.Name]; ok && previous.running() {
+		return codersdk.WorkspaceAgentQuickActionRun{}, errQuickActionRunning
+	}
+
+	recorded := RecordedSession{
+		ID:        uuid.NewString(),
+		Type:      codersdk.WorkspaceAgentSessionTypeQuickAction,
+		Command:   action.Command,
+		StartedAt: time.Now(),
+	}
+	var err error
+	recorded.ReasonCodes, err = a.checkSession(ctx, recorded)
+	if err != nil {
+		return codersdk.WorkspaceAgentQuickActionRun{}, err
+	}
+
+	timeout := defaultQuickActionTimeout
+	if action.TimeoutSeconds > 0 {
+		timeout = time.Duration(action.TimeoutSeconds) * time.Second
+	}
+	// The command outlives the request, and is killed when the agent
+	// closes.
+	runCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	cmd, err := a.createCommand(runCtx, action.Command, nil)
+	if err != nil {
+		cancel()
+		return codersdk.WorkspaceAgentQuickActionRun{}, xerrors.Errorf("create command: %w", err)
+	}
+	if action.Directory != "" {
+		cmd.Dir = action.Directory
+	}
+	output, err := circbuf.NewBuffer(quickActionOutputSize)
+	if err != nil {
+		cancel()
+		return codersdk.WorkspaceAgentQuickActionRun{}, xerrors.Errorf("create output buffer: %w", err)
+	}
+	run := &quickActionRun{
+		run: codersdk.WorkspaceAgentQuickActionRun{
+			ID:        uuid.MustParse(recorded.ID),
+			Status:    codersdk.WorkspaceAgentQuickActionRunRunning,
+			StartedAt: recorded.StartedAt,
+		},
+		output: output,
+	}
+	// Stdout and stderr are the same writer, so they're written from
+	// one goroutine.
+	writer := newANSIStripWriter(run)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+
+	a.closeMutex.Lock()
+	if a.isClosed() {
+		a.closeMutex.Unlock()
+		cancel()
+		return codersdk.WorkspaceAgentQuickActionRun{}, xerrors.New("agent is closed")
+	}
+	a.connCloseWait.Add(1)
+	a.closeMutex.Unlock()
+	err = cmd.Start()
+	if err != nil {
+		a.connCloseWait.Done()
+		cancel()
+		return codersdk.WorkspaceAgentQuickActionRun{}, xerrors.Errorf("start command: %w", err)
+	}
+	logger := a.logger.With(slog.F("name", action.Name), slog.F("run_id", run.run.ID))
+	logger.Info(ctx, "running quick action", slog.F("command", action.Command))
+	a.quickActionRuns[action.Name] = run
+	sessionID := recorded.ID
+	a.trackSession(recorded, cancel)
+
+	go func() {
+		select {
+		case <-a.closed:
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
+	go func() {
+		defer a.connCloseWait.Done()
+		defer cancel()
+		defer a.untrackSession(sessionID)
+		err := cmd.Wait()
+		status := codersdk.WorkspaceAgentQuickActionRunSucceeded
+		var exitCode *int
+		var exitErr *exec.ExitError
+		switch {
+		case errors.Is(runCtx.Err(), context.DeadlineExceeded):
+			status = codersdk.WorkspaceAgentQuickActionRunTimedOut
+		case err != nil:
+			status = codersdk.WorkspaceAgentQuickActionRunFailed
+		}
+		if err == nil || errors.As(err, &exitErr) {
+			code := cmd.ProcessState.ExitCode()
+			exitCode = &code
+		}
+		run.finish(status, exitCode)
+		logger.Info(context.Background(), "quick action finished", slog.F("status", status), slog.Error(err))
+	}()
+	return run.snapshot(), nil
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// Reload re-fetches metadata, re-reads the environment file, and reopens
+// log files without restarting the agent, like SIGHUP does for other
+// daemons. Sessions started after a reload use the new metadata and
+// environment. Changes to the DERP map, the apps and the startup script
+// are applied, but other subsystems that were started with the first
+// metadata, like language servers, aren't restarted.
+func (a *agent) Reload(ctx context.Context) error {
+	a.reloadMutex.Lock()
+	defer a.reloadMutex.Unlock()
+	a.logger.Info(ctx, "reloading")
+
+	if a.reopenLogs != nil {
+		err := a.reopenLogs()
+		if err != nil {
+			return xerrors.Errorf("reopen logs: %w", err)
+		}
+	}
+
+	err := a.loadEnvironmentFile()
+	if err != nil {
+		return xerrors.Errorf("load environment file: %w", err)
+	}
+	a.sessionEnvironmentChanged(ctx)
+
+	return a.reloadMetadataLocked(ctx)
+}
+
+// reloadMetadata re-fetches metadata, like when coderd notifies that it
+// changed.
+func (a *agent) reloadMetadata(ctx context.Context) error {
+	a.reloadMutex.Lock()
+	defer a.reloadMutex.Unlock()
+	return a.reloadMetadataLocked(ctx)
+}
+
+func (a *agent) reloadMetadataLocked(ctx context.Context) error {
+	// The first metadata is stored when the agent connects, which starts
+	// the subsystems that need it, so it isn't fetched early.
+	if a.metadata.Load() == nil {
+		return nil
+	}
+	metadata, err := a.client.WorkspaceAgentMetadata(ctx)
+	if err != nil {
+		return xerrors.Errorf("fetch metadata: %w", err)
+	}
+	metadata, err = a.validateMetadata(ctx, metadata)
+	if err != nil {
+		return xerrors.Errorf("validate metadata: %w", err)
+	}
+	fetchedAt := time.Now()
+	a.metadataFetchedAt.Store(&fetchedAt)
+	oldPTYTimeout := a.ptyTimeout()
+	oldMetadata, _ := a.metadata.Swap(metadata).(codersdk.WorkspaceAgentMetadata)
+	a.sessionEnvironmentChanged(ctx)
+	a.applyPTYTimeout(ctx, oldPTYTimeout)
+	err = a.applyMetadataChanges(ctx, oldMetadata, metadata)
+	if err != nil {
+		return err
+	}
+	a.logger.Info(ctx, "reloaded metadata")
+	return nil
+}
+
+// applyMetadataChanges updates the subsystems that were started with the
+// old metadata, when their part of the metadata changed.
+func (a *agent) applyMetadataChanges(ctx context.Context, old, metadata codersdk.WorkspaceAgentMetadata) error {
+	a.closeMutex.Lock()
+	network := a.network
+	a.closeMutex.Unlock()
+	if network != nil {
+		if !reflect.DeepEqual(old.DERPMap, metadata.DERPMap) || !reflect.DeepEqual(old.EmbeddedDERP, metadata.EmbeddedDERP) {
+			derpMap, err := a.resolveDERPMap(ctx, metadata)
+			if err != nil {
+				return xerrors.Errorf("derp map: %w", err)
+			}
+			a.logger.Info(ctx, "applying changed derp map")
+			network.SetDERPMap(derpMap)
+		}
+		network.SetKeepAlive(keepAliveInterval(metadata), metadata.DisableKeepAlive)
+		network.SetBlockEndpoints(metadata.DisableDirectConnections)
+	}
+	if !reflect.DeepEqual(old.Apps, metadata.Apps) {
+		select {
+		case a.appsChanged <- struct{}{}:
+		default:
+		}
+	}
+	if old.StartupScript != metadata.StartupScript {
+		// The script runs for the lifetime of the agent, rather than of
+		// the reload.
+		a.startStartupScript(a.closeCtx, true)
+	}
+	return nil
+}
+
+// reportAppHealth checks and reports the health of the apps until the
+// context is canceled. The health checks restart with the apps of the
+// metadata when they change.
+func (a *agent) reportAppHealth(ctx context.Context, apps []codersdk.WorkspaceApp) {
+	for {
+		reporterCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			NewWorkspaceAppHealthReporter(
+				a.logger, apps, a.client.PostWorkspaceAgentAppHealth, a.pressure.Throttled, a.appHealthProbes.observe)(reporterCtx)
+		}()
+		select {
+		case <-ctx.Done():
+		case <-a.appsChanged:
+		}
+		cancel()
+		<-done
+		if ctx.Err() != nil {
+			return
+		}
+		metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+		apps = metadata.Apps
+		a.logger.Info(ctx, "restarting app health checks for changed apps", slog.F("apps", len(apps)))
+	}
+}
+
+// loadEnvironmentFile reads the variables of the environment file, which
+// override the environment variables of the metadata in sessions.
+func (a *agent) loadEnvironmentFile() error {
+	if a.environmentFile == "" {
+		return nil
+	}
+	content, err := afero.ReadFile(a.filesystem, a.environmentFile)
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			a.environmentFileVars.Store(map[string]string{})
+			return nil
+		}
+		return err
+	}
+	vars, err := parseEnvironmentFile(content)
+	if err != nil {
+		return err
+	}
+	a.environmentFileVars.Store(vars)
+	return nil
+}
+
+// parseEnvironmentFile parses KEY=VALUE lines. Empty lines and lines
+// starting with # are ignored.
+func parseEnvironmentFile(content []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, xerrors.Errorf("line %d: expected KEY=VALUE", line)
+		}
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
+
+func (a *agent) reloadHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	err := a.Reload(ctx)
+	if err != nil {
+		a.logger.Warn(ctx, "reload", slog.Error(err))
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Failed to reload the agent.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Reloaded the agent.",
+	})
+}
@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/tailnet"
+)
+
+// remoteForwardRequest is the payload of "tcpip-forward" and
+// "cancel-tcpip-forward" requests.
+//
+// https://datatracker.ietf.org/doc/html/rfc4254#section-7.1
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+// reverseForward is a port bound in the workspace by a reverse port
+// forward ("ssh -R").
+type reverseForward struct {
+	codersdk.ReversePortForward
+	conn *gossh.ServerConn
+	// requestedHost is the host in the request, which differs from
+	// the bound host when the policy only allows loopback addresses.
+	requestedHost string
+	listener      net.Listener
+}
+
+// handleReverseForwardRequest replaces ssh.ForwardedTCPHandler to enforce
+// the reverse port forwarding policy from the metadata, and to track forwards
+// so they can be listed and reliably cleaned up when the connection ends.
+func (a *agent) handleReverseForwardRequest(ctx ssh.Context, _ *ssh.Server, req *gossh.Request) (bool, []byte) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok {
+		return false, nil
+	}
+	var payload remoteForwardRequest
+	err := gossh.Unmarshal(req.Payload, &payload)
+	if err != nil {
+		return false, nil
+	}
+	logger := a.logger.Named("ssh-server").With(
+		slog.F("bind_host", payload.BindAddr),
+		slog.F("bind_port", payload.BindPort),
+	)
+
+	switch req.Type {
+	case "tcpip-forward":
+		metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+		host, err := reverseForwardBindHost(metadata.ReversePortForwarding, payload.BindAddr, payload.BindPort)
+		if err != nil {
+			logger.Info(ctx, "reverse port forward denied", slog.Error(err))
+			return false, []byte(err.Error())
+		}
+		forward, err := a.startReverseForward(ctx, conn, payload.BindAddr, host, payload.BindPort)
+		if err != nil {
+			logger.Warn(ctx, "reverse port forward failed", slog.Error(err))
+			return false, nil
+		}
+		logger.Debug(ctx, "reverse port forward started", slog.F("id", forward.ID))
+		return true, gossh.Marshal(&remoteForwardSuccess{BindPort: uint32(forward.BindPort)})
+	case "cancel-tcpip-forward":
+		a.reverseForwardsMutex.Lock()
+		for _, forward := range a.reverseForwards {
+			// Dynamically allocated ports are canceled
+			// with the port that was allocated.
+			if forward.conn == conn && forward.requestedHost == payload.BindAddr && uint32(forward.BindPort) == payload.BindPort {
+				_ = forward.listener.Close()
+			}
+		}
+		a.reverseForwardsMutex.Unlock()
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// reverseForwardBindHost returns the host to bind for the reverse port
+// forward, or an error if the policy denies it.
+func reverseForwardBindHost(policy *codersdk.WorkspaceAgentReversePortForwarding, host string, port uint32) (string, error) {
+	if port > 65535 {
+		return "", xerrors.Errorf("invalid port %d", port)
+	}
+	if policy == nil {
+		return host, nil
+	}
+	if policy.Disabled {
+		return "", xerrors.New("reverse port forwarding is disabled")
+	}
+	if policy.LoopbackOnly {
+		switch host {
+		case "", "*", "0.0.0.0", "::":
+			host = "localhost"
+		}
+		if !tailnet.IsLoopbackHost(host) {
+			return "", xerrors.Errorf("only loopback addresses can be bound, not %q", host)
+		}
+	}
+	if len(policy.AllowedPorts) > 0 {
+		if port == 0 {
+			return "", xerrors.New("dynamically allocated ports are not allowed")
+		}
+		allowed := false
+		for _, r := range policy.AllowedPorts {
+			if r.Contains(uint16(port)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", xerrors.Errorf("port %d is not allowed", port)
+		}
+	}
+	return host, nil
+}
+
+func (a *agent) startReverseForward(ctx ssh.Context, conn *gossh.ServerConn, requestedHost, host string, port uint32) (*reverseForward, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, xerrors.Errorf("listen: %w", err)
+	}
+	addr, err := netip.ParseAddrPort(listener.Addr().String())
+	if err != nil {
+		_ = listener.Close()
+		return nil, xerrors.Errorf("parse listener address: %w", err)
+	}
+	forward := &reverseForward{
+		ReversePortForward: codersdk.ReversePortForward{
+			ID:        uuid.NewString(),
+			SessionID: ctx.SessionID(),
+			User:      ctx.User(),
+			BindHost:  host,
+			BindPort:  addr.Port(),
+			CreatedAt: time.Now(),
+		},
+		conn:          conn,
+		requestedHost: requestedHost,
+		listener:      listener,
+	}
+
+	a.closeMutex.Lock()
+	if a.isClosed() {
+		a.closeMutex.Unlock()
+		_ = listener.Close()
+		return nil, xerrors.New("closed")
+	}
+	a.connCloseWait.Add(1)
+	a.closeMutex.Unlock()
+	a.reverseForwardsMutex.Lock()
+	a.reverseForwards[forward.ID] = forward
+	a.reverseForwardsMutex.Unlock()
+	a.usage.reversePortForwards.Inc()
+
+	go func() {
+		// The context is canceled when the SSH connection ends.
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	go func() {
+		defer a.connCloseWait.Done()
+		defer func() {
+			a.reverseForwardsMutex.Lock()
+			delete(a.reverseForwards, forward.ID)
+			a.reverseForwardsMutex.Unlock()
+		}()
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			originAddr, originPortStr, _ := net.SplitHostPort(local.RemoteAddr().String())
+			originPort, _ := strconv.Atoi(originPortStr)
+			payload := gossh.Marshal(&tcpipChannelData{
+				DestAddr:   requestedHost,
+				DestPort:   uint32(forward.BindPort),
+				OriginAddr: originAddr,
+				OriginPort: uint32(originPort),
+			})
+			go func() {
+				ch, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+				if err != nil {
+					_ = local.Close()
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				Bicopy(ctx, local, ch)
+			}()
+		}
+	}()
+	return forward, nil
+}
+
+func (a *agent) reverseForwardsHandler(rw http.ResponseWriter, r *http.Request) {
+	a.reverseForwardsMutex.Lock()
+	forwards := make([]codersdk.ReversePortForward, 0, len(a.reverseForwards))
+	for _, forward := range a.reverseForwards {
+		forwards = append(forwards, forward.ReversePortForward)
+	}
+	a.reverseForwardsMutex.Unlock()
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].CreatedAt.Before(forwards[j].CreatedAt)
+	})
+
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.ReversePortForwardsResponse{
+		Forwards: forwards,
+	})
+}
+
+// closeReverseForwards closes the listeners of every reverse port forward.
+func (a *agent) closeReverseForwards() {
+	a.reverseForwardsMutex.Lock()
+	defer a.reverseForwardsMutex.Unlock()
+	for _, forward := range a.reverseForwards {
+		_ = forward.listener.Close()
+	}
+}
@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+
+	"github.com/coder/coder/agent/usershell"
+	"github.com/coder/coder/codersdk"
+)
+
+// sessionEnvironment is what commands of sessions are started with, apart
+// from the command and the variables of the client. Editors like VS Code
+// open many short-lived sessions, so it's computed once for every
+// generation of the metadata rather than for every session.
+type sessionEnvironment struct {
+	generation uint64
+	username   string
+	shell      string
+	dir        string
+	// environ is the environment of the agent that sessions inherit, which
+	// the variables of the client override.
+	environ []string
+	// env are the variables of the agent and the metadata, which
+	// override the variables of the client.
+	env []string
+}
+
+// sessionEnvironmentChanged discards the environment of sessions after
+// something it's computed from changed, like the metadata or the
+// environment file. It's computed again right away if sessions are
+// prewarmed, and shells of the pool are started again with it.
+func (a *agent) sessionEnvironmentChanged(ctx context.Context) {
+	a.shellPool.discard(a.sessionEnvGeneration.Add(1))
+	a.shellPool.refill()
+	if !a.prewarmSessions || a.metadata.Load() == nil {
+		return
+	}
+	_, err := a.sessionEnvironment()
+	if err != nil {
+		a.logger.Debug(ctx, "prewarm session environment", slog.Error(err))
+	}
+}
+
+// sessionEnvironment returns the environment of sessions for the current
+// generation of the metadata.
+func (a *agent) sessionEnvironment() (*sessionEnvironment, error) {
+	// The generation is loaded first, so an environment that's computed
+	// while the metadata changes is computed again by the next session.
+	generation := a.sessionEnvGeneration.Load()
+	cached := a.sessionEnv.Load()
+	if cached != nil && cached.generation == generation {
+		return cached, nil
+	}
+	env, err := a.newSessionEnvironment(generation)
+	if err != nil {
+		return nil, err
+	}
+	a.sessionEnv.Store(env)
+	return env, nil
+}
+
+func (a *agent) newSessionEnvironment(generation uint64) (*sessionEnvironment, error) {
+	currentUser, found := currentUser()
+	username := currentUser.Username
+
+	shell := fallbackShell()
+	if found {
+		var err error
+		shell, err = usershell.Get(username)
+		if err != nil {
+			return nil, xerrors.Errorf("get user shell: %w", codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorShellLookupFailed, err))
+		}
+	}
+
+	rawMetadata := a.metadata.Load()
+	if rawMetadata == nil {
+		return nil, codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorMetadataUnavailable, xerrors.New("no metadata was provided"))
+	}
+	metadata, valid := rawMetadata.(codersdk.WorkspaceAgentMetadata)
+	if !valid {
+		return nil, xerrors.Errorf("metadata is the wrong type: %T", metadata)
+	}
+
+	dir := metadata.Directory
+	if dir == "" {
+		// Default to user home if a directory is not set.
+		homedir, err := a.homeDir()
+		if err != nil {
+			return nil, xerrors.Errorf("get home dir: %w", err)
+		}
+		dir = homedir
+	}
+
+	executablePath, err := os.Executable()
+	if err != nil {
+		return nil, xerrors.Errorf("getting os executable: %w", err)
+	}
+	var env []string
+	// Set environment variables reliable detection of being inside a
+	// Coder workspace.
+	env = append(env, "CODER=true")
+	env = append(env, fmt.Sprintf("USER=%s", username))
+	// Git on Windows resolves with UNIX-style paths.
+	// If using backslashes, it's unable to find the executable.
+	unixExecutablePath := strings.ReplaceAll(executablePath, "\\", "/")
+	env = append(env, fmt.Sprintf(`GIT_SSH_COMMAND=%s gitssh --`, unixExecutablePath))
+
+	// Specific Coder subcommands require the agent token exposed!
+	env = append(env, fmt.Sprintf("CODER_AGENT_TOKEN=%s", *a.sessionToken.Load()))
+
+	// Set SSH connection environment variables (these are also set by OpenSSH
+	// and thus expected to be present by SSH clients). Since the agent does
+	// networking in-memory, trying to provide accurate values here would be
+	// nonsensical. For now, we hard code these values so that they're present.
+	srcAddr, srcPort := "0.0.0.0", "0"
+	dstAddr, dstPort := "0.0.0.0", "0"
+	env = append(env, fmt.Sprintf("SSH_CLIENT=%s %s %s", srcAddr, srcPort, dstPort))
+	env = append(env, fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", srcAddr, srcPort, dstAddr, dstPort))
+
+	// Editors served from the workspace, like code-server, read the URI
+	// that proxies ports. The metadata replaces the variables of
+	// code-server for other editors.
+	env = append(env, editorEnvironment(metadata)...)
+
+	// Apps validate that requests came through the app proxy of coderd
+	// with the tokens in this file.
+	env = append(env, fmt.Sprintf("CODER_APP_TOKEN_FILE=%s", a.appTokenFile()))
+
+	// Processes declare ports to list them without changing the template.
+	env = append(env, fmt.Sprintf("CODER_PORTS_FILE=%s", a.declaredPortsFile()))
+
+	// `coder agent` subcommands inspect the agent over its control socket.
+	if a.controlSocketPath != "" {
+		env = append(env, fmt.Sprintf("%s=%s", codersdk.AgentControlSocketEnv, a.controlSocketPath))
+	}
+
+	// Load environment variables passed via the agent.
+	// These should override all variables we manually specify.
+	for envKey, value := range metadata.EnvironmentVariables {
+		// Expanding environment variables allows for customization
+		// of the $PATH, among other variables. Customers can prepend
+		// or append to the $PATH, so allowing expand is required!
+		env = append(env, fmt.Sprintf("%s=%s", envKey, os.ExpandEnv(value)))
+	}
+
+	// The owner of the workspace sets personal variables through coderd,
+	// which override the template. They're expanded like the variables of
+	// the template, so the $PATH can be extended.
+	for envKey, value := range metadata.PersonalEnvironmentVariables {
+		env = append(env, fmt.Sprintf("%s=%s", envKey, os.ExpandEnv(value)))
+	}
+
+	// The environment file of the agent overrides the metadata, and is
+	// loaded on start and reload.
+	fileVars, _ := a.environmentFileVars.Load().(map[string]string)
+	for envKey, value := range fileVars {
+		env = append(env, fmt.Sprintf("%s=%s", envKey, value))
+	}
+
+	// Agent-level environment variables should take over all!
+	// This is used for setting agent-specific variables like "CODER_AGENT_TOKEN".
+	for envKey, value := range a.envVars {
+		env = append(env, fmt.Sprintf("%s=%s", envKey, value))
+	}
+
+	return &sessionEnvironment{
+		generation: generation,
+		username:   username,
+		shell:      shell,
+		dir:        dir,
+		environ:    passthroughEnv(a.envPassthrough, os.Environ()),
+		env:        env,
+	}, nil
+}
+
+// commandEnv returns the environment of a command, with the variables of
+// the client between the environment of the agent and the variables that
+// override them.
+func (e *sessionEnvironment) commandEnv(clientEnv []string) []string {
+	env := make([]string, 0, len(e.environ)+len(clientEnv)+len(e.env))
+	env = append(env, e.environ...)
+	env = append(env, clientEnv...)
+	return append(env, e.env...)
+}
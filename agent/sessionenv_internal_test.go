@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+)
+
+func TestSessionEnvironment(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	token := "token"
+	a := &agent{
+		logger: slogtest.Make(t, nil),
+	}
+	a.sessionToken.Store(&token)
+	_, err := a.sessionEnvironment()
+	require.Error(t, err, "no metadata")
+
+	a.metadata.Store(codersdk.WorkspaceAgentMetadata{
+		Directory: "/first",
+		EnvironmentVariables: map[string]string{
+			"FOO": "first",
+		},
+	})
+	first, err := a.sessionEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "/first", first.dir)
+	require.Contains(t, first.env, "FOO=first")
+	// The environment is computed once for every generation.
+	cached, err := a.sessionEnvironment()
+	require.NoError(t, err)
+	require.Same(t, first, cached)
+
+	// The variables of the client are overridden by the metadata.
+	env := first.commandEnv([]string{"FOO=client"})
+	require.Equal(t, "FOO=client", env[len(first.environ)])
+	require.Equal(t, "FOO=first", env[len(env)-1])
+
+	a.metadata.Store(codersdk.WorkspaceAgentMetadata{
+		Directory: "/second",
+	})
+	a.sessionEnvironmentChanged(ctx)
+	second, err := a.sessionEnvironment()
+	require.NoError(t, err)
+	require.Equal(t, "/second", second.dir)
+	require.NotContains(t, second.env, "FOO=first")
+
+	// Prewarming computes the environment when it changes.
+	a.prewarmSessions = true
+	a.sessionEnvironmentChanged(ctx)
+	prewarmed := a.sessionEnv.Load()
+	require.NotSame(t, second, prewarmed)
+	require.Equal(t, a.sessionEnvGeneration.Load(), prewarmed.generation)
+}
+
+// BenchmarkCreateCommand measures starting the commands of sessions, which
+// editors like VS Code do many times a second.
+func BenchmarkCreateCommand(b *testing.B) {
+	ctx := context.Background()
+	token := "token"
+	a := &agent{
+		logger: slogtest.Make(b, nil),
+	}
+	a.sessionToken.Store(&token)
+	a.metadata.Store(codersdk.WorkspaceAgentMetadata{
+		Directory: "/",
+		EnvironmentVariables: map[string]string{
+			"FOO": "$HOME/foo",
+		},
+	})
+	clientEnv := []string{"LANG=C.UTF-8"}
+
+	b.Run("Cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := a.createCommand(ctx, "true", clientEnv)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// The environment is computed again for every command, like when
+	// the metadata changes.
+	b.Run("Uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			a.sessionEnvironmentChanged(ctx)
+			_, err := a.createCommand(ctx, "true", clientEnv)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// preSessionHookTimeout limits how long sessions wait for the pre-session
+// hook, which fails the session when it's exceeded.
+const preSessionHookTimeout = 10 * time.Second
+
+// PreSessionHook decides whether sessions start, like SSH and SFTP
+// sessions, reconnecting PTYs, exec commands and quick actions, so
+// compliance agents like DLP scanners can be integrated without changing
+// the handlers of sessions.
+type PreSessionHook interface {
+	// BeforeSession is called before the process of a session starts.
+	// Errors deny the session, since a hook that failed can't vouch for
+	// it. The context is canceled after preSessionHookTimeout.
+	BeforeSession(ctx context.Context, session RecordedSession) (SessionDecision, error)
+}
+
+// PreSessionHookFunc is a function that's a PreSessionHook.
+type PreSessionHookFunc func(ctx context.Context, session RecordedSession) (SessionDecision, error)
+
+func (f PreSessionHookFunc) BeforeSession(ctx context.Context, session RecordedSession) (SessionDecision, error) {
+	return f(ctx, session)
+}
+
+// SessionDecision is whether a PreSessionHook allows a session.
+type SessionDecision struct {
+	// Deny vetoes the session, and Reason is shown to the client.
+	Deny   bool
+	Reason string
+	// ReasonCodes are attached to the session, like the policies that a
+	// scanner matched. They're logged, passed to the SessionRecorder and
+	// listed with the sessions of the agent.
+	ReasonCodes []string
+}
+
+// checkSession runs the pre-session hook for the session, and returns the
+// reason codes to attach to it. Sessions that are denied fail with a
+// SESSION_DENIED error.
+func (a *agent) checkSession(ctx context.Context, session RecordedSession) ([]string, error) {
+	if a.preSessionHook == nil {
+		return nil, nil
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, preSessionHookTimeout)
+	defer cancel()
+	decision, err := a.preSessionHook.BeforeSession(hookCtx, session)
+	if err != nil {
+		a.logger.Warn(ctx, "pre-session hook failed", slog.F("id", session.ID), slog.F("type", session.Type), slog.Error(err))
+		return nil, codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorSessionDenied, xerrors.Errorf("pre-session hook: %w", err))
+	}
+	if decision.Deny {
+		reason := decision.Reason
+		if reason == "" {
+			reason = "denied by the pre-session hook"
+		}
+		a.logger.Info(ctx, "pre-session hook denied session", slog.F("id", session.ID), slog.F("type", session.Type),
+			slog.F("reason", reason), slog.F("reason_codes", decision.ReasonCodes))
+		return decision.ReasonCodes, codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorSessionDenied, xerrors.New(reason))
+	}
+	if len(decision.ReasonCodes) > 0 {
+		a.logger.Info(ctx, "pre-session hook allowed session", slog.F("id", session.ID), slog.F("type", session.Type),
+			slog.F("reason_codes", decision.ReasonCodes))
+	}
+	return decision.ReasonCodes, nil
+}
@@ -0,0 +1,254 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// SessionRecorder records the sessions of the agent, like for compliance.
+// Hooks are called from the goroutines that copy the session, so they
+// must not block, and they can't interrupt the session they record.
+type SessionRecorder interface {
+	// SessionOpened is called when an SSH session or reconnecting PTY
+	// starts, before its process.
+	SessionOpened(ctx context.Context, session RecordedSession)
+	// SessionClosed is called when the process of a session exits and its
+	// output was copied, with the error the process exited with.
+	SessionClosed(ctx context.Context, session RecordedSession, err error)
+	// PTYInput is called with input written to the PTY of a session. The
+	// slice must not be retained.
+	PTYInput(session RecordedSession, p []byte)
+	// PTYOutput is called with output read from the PTY of a session. The
+	// slice must not be retained.
+	PTYOutput(session RecordedSession, p []byte)
+}
+
+// RecordedSession describes a session passed to a SessionRecorder.
+type RecordedSession struct {
+	ID   string
+	Type codersdk.WorkspaceAgentSessionType
+	// User is the SSH user. Reconnecting PTYs don't identify the user.
+	User    string
+	Command string
+	// PTY is whether the session has a PTY. The PTY hooks are only called
+	// for sessions with a PTY.
+	PTY       bool
+	Width     uint16
+	Height    uint16
+	Term      string
+	StartedAt time.Time
+	// Peer is the address of the client that started the session.
+	Peer string
+	// ReasonCodes were attached to the session by the PreSessionHook.
+	ReasonCodes []string
+}
+
+type nopSessionRecorder struct{}
+
+func (nopSessionRecorder) SessionOpened(context.Context, RecordedSession)        {}
+func (nopSessionRecorder) SessionClosed(context.Context, RecordedSession, error) {}
+func (nopSessionRecorder) PTYInput(RecordedSession, []byte)                      {}
+func (nopSessionRecorder) PTYOutput(RecordedSession, []byte)                     {}
+
+// recordWriter calls a hook of a SessionRecorder with every write.
+type recordWriter func(p []byte)
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	w(p)
+	return len(p), nil
+}
+
+const (
+	asciicastRecordingExtension = ".cast"
+	asciicastDigestExtension    = ".sha256"
+)
+
+// NewAsciicastRecorder returns a SessionRecorder that records the input
+// and output of PTY sessions to asciicast v2 files in dir, named by the
+// start time and ID of the session. Recordings are created exclusively
+// and made read-only when the session closes, and the SHA-256 digest of
+// each recording is written next to it and logged, so changes to it can
+// be detected. Recordings aren't limited in size or removed.
+func NewAsciicastRecorder(logger slog.Logger, fs afero.Fs, dir string) SessionRecorder {
+	return &asciicastRecorder{
+		logger:     logger,
+		fs:         fs,
+		dir:        dir,
+		recordings: map[string]*asciicastRecording{},
+	}
+}
+
+type asciicastRecorder struct {
+	logger slog.Logger
+	fs     afero.Fs
+	dir    string
+
+	mutex      sync.Mutex
+	recordings map[string]*asciicastRecording
+}
+
+type asciicastRecording struct {
+	mutex     sync.Mutex
+	name      string
+	file      afero.File
+	digest    hash.Hash
+	startedAt time.Time
+	// err is the first error writing the recording, after which events
+	// aren't recorded.
+	err error
+}
+
+func (r *asciicastRecorder) SessionOpened(ctx context.Context, session RecordedSession) {
+	if !session.PTY {
+		return
+	}
+	err := r.fs.MkdirAll(r.dir, 0o700)
+	if err != nil {
+		r.logger.Warn(ctx, "create session recording directory", slog.F("dir", r.dir), slog.Error(err))
+		return
+	}
+	name := fmt.Sprintf("%s-%s%s", session.StartedAt.UTC().Format("20060102T150405.000000000Z"), session.ID, asciicastRecordingExtension)
+	// Existing recordings are never overwritten.
+	file, err := r.fs.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		r.logger.Warn(ctx, "create session recording", slog.F("session_id", session.ID), slog.Error(err))
+		return
+	}
+	recording := &asciicastRecording{
+		name:      name,
+		file:      file,
+		digest:    sha256.New(),
+		startedAt: session.StartedAt,
+	}
+	env := map[string]string{}
+	if session.Term != "" {
+		env["TERM"] = session.Term
+	}
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     session.Width,
+		Height:    session.Height,
+		Timestamp: session.StartedAt.Unix(),
+		Title:     session.Command,
+		Env:       env,
+	})
+	if err == nil {
+		err = recording.writeLine(header)
+	}
+	if err != nil {
+		r.logger.Warn(ctx, "write session recording header", slog.F("session_id", session.ID), slog.Error(err))
+		_ = file.Close()
+		return
+	}
+	r.mutex.Lock()
+	r.recordings[session.ID] = recording
+	r.mutex.Unlock()
+}
+
+func (r *asciicastRecorder) SessionClosed(ctx context.Context, session RecordedSession, _ error) {
+	r.mutex.Lock()
+	recording, ok := r.recordings[session.ID]
+	delete(r.recordings, session.ID)
+	r.mutex.Unlock()
+	if !ok {
+		return
+	}
+	digest, err := recording.close()
+	if err == nil {
+		err = r.fs.Chmod(filepath.Join(r.dir, recording.name), 0o400)
+	}
+	if err == nil {
+		err = r.writeDigest(recording.name, digest)
+	}
+	if err != nil {
+		r.logger.Warn(ctx, "close session recording", slog.F("session_id", session.ID), slog.Error(err))
+		return
+	}
+	r.logger.Info(ctx, "recorded session",
+		slog.F("session_id", session.ID),
+		slog.F("file", filepath.Join(r.dir, recording.name)),
+		slog.F("sha256", digest),
+	)
+}
+
+func (r *asciicastRecorder) PTYInput(session RecordedSession, p []byte) {
+	r.record(session, "i", p)
+}
+
+func (r *asciicastRecorder) PTYOutput(session RecordedSession, p []byte) {
+	r.record(session, "o", p)
+}
+
+func (r *asciicastRecorder) record(session RecordedSession, code string, p []byte) {
+	r.mutex.Lock()
+	recording, ok := r.recordings[session.ID]
+	r.mutex.Unlock()
+	if !ok {
+		return
+	}
+	event, err := json.Marshal([]interface{}{
+		time.Since(recording.startedAt).Seconds(),
+		code,
+		string(p),
+	})
+	if err != nil {
+		return
+	}
+	_ = recording.writeLine(event)
+}
+
+// writeDigest writes the digest of a recording in the format of
+// sha256sum, so it can be checked with "sha256sum -c".
+func (r *asciicastRecorder) writeDigest(name, digest string) error {
+	path := filepath.Join(r.dir, name+asciicastDigestExtension)
+	err := afero.WriteFile(r.fs, path, []byte(fmt.Sprintf("%s  %s\n", digest, name)), 0o400)
+	if err != nil {
+		return xerrors.Errorf("write digest: %w", err)
+	}
+	return nil
+}
+
+func (r *asciicastRecording) writeLine(line []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	line = append(line, '\n')
+	_, r.err = io.MultiWriter(r.file, r.digest).Write(line)
+	return r.err
+}
+
+// close closes the recording and returns its digest.
+func (r *asciicastRecording) close() (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = xerrors.New("closed")
+	}
+	err := r.file.Sync()
+	if err != nil {
+		_ = r.file.Close()
+		return "", xerrors.Errorf("sync: %w", err)
+	}
+	err = r.file.Close()
+	if err != nil {
+		return "", xerrors.Errorf("close: %w", err)
+	}
+	return hex.EncodeToString(r.digest.Sum(nil)), nil
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+)
+
+func TestAsciicastRecorder(t *testing.T) {
+	t.Parallel()
+
+	t.Run("NoPTY", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		recorder := NewAsciicastRecorder(slogtest.Make(t, nil), fs, "/recordings")
+		session := RecordedSession{
+			ID:        "session",
+			Type:      codersdk.WorkspaceAgentSessionTypeSSH,
+			StartedAt: time.Now(),
+		}
+		recorder.SessionOpened(context.Background(), session)
+		recorder.SessionClosed(context.Background(), session, nil)
+		exists, err := afero.DirExists(fs, "/recordings")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		recorder := NewAsciicastRecorder(slogtest.Make(t, nil), fs, "/recordings")
+		session := RecordedSession{
+			ID:        "session",
+			Type:      codersdk.WorkspaceAgentSessionTypeReconnectingPTY,
+			PTY:       true,
+			Width:     80,
+			Height:    24,
+			StartedAt: time.Date(2023, 1, 2, 3, 4, 5, 6, time.UTC),
+		}
+		recorder.SessionOpened(context.Background(), session)
+		recorder.PTYOutput(session, []byte("before"))
+		recorder.SessionClosed(context.Background(), session, nil)
+		// Output after the session closed isn't recorded.
+		recorder.PTYOutput(session, []byte("after"))
+
+		name := "20230102T030405.000000006Z-session.cast"
+		recording, err := afero.ReadFile(fs, filepath.Join("/recordings", name))
+		require.NoError(t, err)
+		require.Equal(t, 2, bytes.Count(recording, []byte("\n")))
+		require.Contains(t, string(recording), `"o","before"`)
+		info, err := fs.Stat(filepath.Join("/recordings", name))
+		require.NoError(t, err)
+		require.EqualValues(t, 0o400, info.Mode().Perm())
+
+		// Recordings aren't overwritten by sessions with the same ID and
+		// start time.
+		recorder.SessionOpened(context.Background(), session)
+		recorder.PTYOutput(session, []byte("again"))
+		recorder.SessionClosed(context.Background(), session, nil)
+		overwritten, err := afero.ReadFile(fs, filepath.Join("/recordings", name))
+		require.NoError(t, err)
+		require.Equal(t, recording, overwritten)
+	})
+}
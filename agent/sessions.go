@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/atomic"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+// activeSession is an SSH or reconnecting PTY session that can be listed
+// and terminated through the API of the agent.
+type activeSession struct {
+	info     codersdk.WorkspaceAgentSession
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// label is set by clients of reconnecting PTYs, and title by the
+	// programs in them with escape sequences.
+	label atomic.String
+	title atomic.String
+	// terminate kills the process of the session and disconnects its
+	// clients.
+	terminate func()
+}
+
+// trackSession registers an active session until untrackSession is called.
+func (a *agent) trackSession(recorded RecordedSession, terminate func()) *activeSession {
+	session := &activeSession{
+		info: codersdk.WorkspaceAgentSession{
+			ID:          recorded.ID,
+			Type:        recorded.Type,
+			User:        recorded.User,
+			Command:     recorded.Command,
+			Peer:        recorded.Peer,
+			StartedAt:   time.Now(),
+			ReasonCodes: recorded.ReasonCodes,
+		},
+		terminate: terminate,
+	}
+	a.bootTimer.recordSince(bootPhaseFirstSession, a.bootTimer.startedAt)
+	a.activeSessionsMutex.Lock()
+	defer a.activeSessionsMutex.Unlock()
+	a.activeSessions[recorded.ID] = session
+	return session
+}
+
+func (a *agent) untrackSession(id string) {
+	a.activeSessionsMutex.Lock()
+	defer a.activeSessionsMutex.Unlock()
+	delete(a.activeSessions, id)
+}
+
+// listSessions returns the active sessions, oldest first.
+func (a *agent) listSessions() []codersdk.WorkspaceAgentSession {
+	a.activeSessionsMutex.Lock()
+	sessions := make([]codersdk.WorkspaceAgentSession, 0, len(a.activeSessions))
+	for _, session := range a.activeSessions {
+		info := session.info
+		info.BytesIn = session.bytesIn.Load()
+		info.BytesOut = session.bytesOut.Load()
+		info.Label = session.label.Load()
+		info.Title = session.title.Load()
+		sessions = append(sessions, info)
+	}
+	a.activeSessionsMutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	return sessions
+}
+
+// countIn counts the bytes read from the clients of the session.
+func (s *activeSession) countIn(r io.Reader) io.Reader {
+	return &countingReader{reader: r, count: &s.bytesIn}
+}
+
+// countOut counts the bytes written to the clients of the session.
+func (s *activeSession) countOut(w io.Writer) io.Writer {
+	return &countingWriter{writer: w, count: &s.bytesOut}
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count.Add(int64(n))
+	return n, err
+}
+
+func (a *agent) sessionsHandler(rw http.ResponseWriter, r *http.Request) {
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.WorkspaceAgentSessionsResponse{
+		Sessions: a.listSessions(),
+	})
+}
+
+func (a *agent) terminateSessionHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+	a.activeSessionsMutex.Lock()
+	session, ok := a.activeSessions[id]
+	a.activeSessionsMutex.Unlock()
+	if !ok {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+	a.logger.Info(ctx, "terminating session", slog.F("id", id), slog.F("type", session.info.Type))
+	session.terminate()
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Terminated the session.",
+	})
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+)
+
+// defaultSessionTempDirQuota limits the total size of the temporary
+// directories of sessions, unless configured otherwise.
+const defaultSessionTempDirQuota = 1 << 30
+
+// sessionTempRoot contains a temporary directory for each session.
+func (a *agent) sessionTempRoot() string {
+	return filepath.Join(a.tempDir, "coder-session-tmp")
+}
+
+// createSessionTempDir creates a temporary directory for a session, which
+// is exported as TMPDIR so sessions don't collide on temporary files, and
+// cleanup doesn't depend on the commands of the session. The returned
+// function removes it when the session ends.
+//
+// When the directories of other sessions already use the quota, or the
+// directory can't be created, the session uses the default temporary
+// directory and the returned path is empty.
+func (a *agent) createSessionTempDir(ctx context.Context, sessionID string) (string, func()) {
+	root := a.sessionTempRoot()
+	if a.sessionTempDirQuota > 0 {
+		used := dirSize(a.filesystem, root)
+		if used >= a.sessionTempDirQuota {
+			a.logger.Warn(ctx, "session temporary directories exceed their quota, using the default temporary directory",
+				slog.F("session_id", sessionID),
+				slog.F("used_bytes", used),
+				slog.F("quota_bytes", a.sessionTempDirQuota))
+			return "", func() {}
+		}
+	}
+	dir := filepath.Join(root, sessionID)
+	err := a.filesystem.MkdirAll(dir, 0o700)
+	if err != nil {
+		a.logger.Warn(ctx, "create session temporary directory", slog.F("session_id", sessionID), slog.Error(err))
+		return "", func() {}
+	}
+	return dir, func() {
+		err := a.filesystem.RemoveAll(dir)
+		if err != nil {
+			a.logger.Warn(ctx, "remove session temporary directory", slog.F("session_id", sessionID), slog.Error(err))
+		}
+	}
+}
+
+// dirSize returns the size of the regular files in dir. Files that can't be
+// read are skipped.
+func dirSize(filesystem afero.Fs, dir string) int64 {
+	var size int64
+	_ = afero.Walk(filesystem, dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+)
+
+func TestSessionTempDir(t *testing.T) {
+	t.Parallel()
+
+	a := &agent{
+		logger:              slogtest.Make(t, nil),
+		filesystem:          afero.NewMemMapFs(),
+		tempDir:             "/tmp",
+		sessionTempDirQuota: 10,
+	}
+	ctx := context.Background()
+
+	dir, remove := a.createSessionTempDir(ctx, "first")
+	require.Equal(t, filepath.Join("/tmp", "coder-session-tmp", "first"), dir)
+	require.NoError(t, afero.WriteFile(a.filesystem, filepath.Join(dir, "large"), make([]byte, 10), 0o600))
+
+	// The quota is used, so the next session uses the default temporary
+	// directory.
+	other, removeOther := a.createSessionTempDir(ctx, "second")
+	require.Empty(t, other)
+	removeOther()
+
+	remove()
+	exists, err := afero.DirExists(a.filesystem, dir)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	other, removeOther = a.createSessionTempDir(ctx, "second")
+	require.NotEmpty(t, other)
+	removeOther()
+}
@@ -0,0 +1,398 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// sftpServer is an *sftp.Server or *sftp.RequestServer.
+type sftpServer interface {
+	Serve() error
+	Close() error
+}
+
+// newSFTPServer creates the server of an SFTP session, which enforces the
+// SFTP policies of the options and the metadata.
+func (a *agent) newSFTPServer(ctx context.Context, session io.ReadWriteCloser) (sftpServer, error) {
+	// Change current working directory to the users home
+	// directory so that SFTP connections land there.
+	homedir, err := a.homeDir()
+	if err != nil {
+		a.logger.Warn(ctx, "get sftp working directory failed, unable to get home dir", slog.Error(err))
+		homedir = ""
+	}
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	policy, err := newSFTPPolicy(homedir, a.sftpPolicy, metadata.SFTP)
+	if err != nil {
+		return nil, xerrors.Errorf("sftp policy: %w", err)
+	}
+
+	// The server of the sftp package fails to set the owner of files in
+	// rootless containers, so the handler is used for them.
+	if len(policy.allowed) == 0 && !a.userNamespace.Rootless {
+		var opts []sftp.ServerOption
+		if homedir != "" {
+			opts = append(opts, sftp.WithServerWorkingDirectory(homedir))
+		}
+		if policy.readOnly {
+			opts = append(opts, sftp.ReadOnly())
+		}
+		return sftp.NewServer(session, opts...)
+	}
+
+	// Sessions land in the first allowed directory if the home
+	// directory isn't allowed.
+	start := homedir
+	if len(policy.allowed) > 0 && (start == "" || !policy.allows(start)) {
+		start = policy.allowed[0][0]
+	}
+	handler := &sftpHandler{
+		policy:   policy,
+		rootless: a.userNamespace.Rootless,
+		chown:    os.Chown,
+	}
+	var opts []sftp.RequestServerOption
+	if start != "" {
+		opts = append(opts, sftp.WithStartDirectory(filepath.ToSlash(start)))
+	}
+	return sftp.NewRequestServer(session, sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	}, opts...), nil
+}
+
+// sftpPolicy is the combined SFTP policy of the options and the metadata.
+type sftpPolicy struct {
+	readOnly bool
+	// allowed are lists of directories with symbolic links resolved. A
+	// path must be in a directory of every list.
+	allowed [][]string
+}
+
+func newSFTPPolicy(homedir string, policies ...*codersdk.WorkspaceAgentSFTP) (sftpPolicy, error) {
+	var policy sftpPolicy
+	for _, p := range policies {
+		if p == nil {
+			continue
+		}
+		policy.readOnly = policy.readOnly || p.ReadOnly
+		if len(p.AllowedPaths) == 0 {
+			continue
+		}
+		allowed := make([]string, 0, len(p.AllowedPaths))
+		for _, name := range p.AllowedPaths {
+			if name == "~" || strings.HasPrefix(name, "~/") {
+				if homedir == "" {
+					return sftpPolicy{}, xerrors.Errorf("allowed path %q requires the home directory", name)
+				}
+				name = filepath.Join(homedir, strings.TrimPrefix(strings.TrimPrefix(name, "~"), "/"))
+			}
+			if !filepath.IsAbs(name) {
+				return sftpPolicy{}, xerrors.Errorf("allowed path %q must be absolute", name)
+			}
+			resolved, err := resolveSFTPPath(filepath.Clean(name), true)
+			if err != nil {
+				return sftpPolicy{}, xerrors.Errorf("resolve allowed path %q: %w", name, err)
+			}
+			allowed = append(allowed, resolved)
+		}
+		policy.allowed = append(policy.allowed, allowed)
+	}
+	return policy, nil
+}
+
+// allows returns whether a resolved path is in the allowed directories.
+func (p sftpPolicy) allows(name string) bool {
+	for _, allowed := range p.allowed {
+		ok := false
+		for _, dir := range allowed {
+			if name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveSFTPPath resolves the symbolic links of a path. The last element
+// isn't resolved unless followLast is set, so links themselves can be
+// removed and renamed. Elements that don't exist yet are kept as they are.
+func resolveSFTPPath(name string, followLast bool) (string, error) {
+	dir, base := name, ""
+	if !followLast && filepath.Dir(name) != name {
+		dir, base = filepath.Dir(name), filepath.Base(name)
+	}
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			dir = resolved
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		// A link to a path that doesn't exist would be followed when
+		// it's created, so only elements that don't exist are kept.
+		_, err = os.Lstat(dir)
+		if err == nil {
+			return "", xerrors.Errorf("%q is a broken symbolic link", dir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		rest = append([]string{filepath.Base(dir)}, rest...)
+		dir = parent
+	}
+	return filepath.Join(append(append([]string{dir}, rest...), base)...), nil
+}
+
+// sftpLocalPath converts the path of a request, which is absolute and
+// separated by slashes, to a path of the OS. On Windows, paths start with
+// the drive, like /C:/Users.
+func sftpLocalPath(name string) string {
+	if runtime.GOOS == "windows" {
+		name = strings.TrimPrefix(name, "/")
+	}
+	return filepath.Clean(filepath.FromSlash(name))
+}
+
+// sftpHandler serves SFTP requests from the filesystem of the OS, but only
+// for the paths allowed by a policy.
+type sftpHandler struct {
+	policy sftpPolicy
+	// rootless is whether the agent runs as root of a rootless container,
+	// where files can't be given to users that aren't mapped.
+	rootless bool
+	chown    func(name string, uid, gid int) error
+}
+
+// path returns the resolved path of a request, or an error if the policy
+// doesn't allow it.
+func (h *sftpHandler) path(name string, followLast bool) (string, error) {
+	resolved, err := resolveSFTPPath(sftpLocalPath(name), followLast)
+	if err != nil {
+		return "", err
+	}
+	if !h.policy.allows(resolved) {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return resolved, nil
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	name, err := h.path(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.OpenFile(r)
+}
+
+func (h *sftpHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if h.policy.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	name, err := h.path(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	// O_APPEND isn't used, since writes are at offsets.
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return os.OpenFile(name, flags, 0o644)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if h.policy.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	switch r.Method {
+	case "Setstat":
+		name, err := h.path(r.Filepath, true)
+		if err != nil {
+			return err
+		}
+		return h.setstat(name, r.AttrFlags(), r.Attributes())
+	case "Rename":
+		return h.PosixRename(r)
+	case "Rmdir", "Remove":
+		name, err := h.path(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Remove(name)
+	case "Mkdir":
+		name, err := h.path(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Mkdir(name, 0o755)
+	case "Link":
+		oldname, err := h.path(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		newname, err := h.path(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return os.Link(oldname, newname)
+	case "Symlink":
+		// The target of the link is checked when the link is followed,
+		// so only the link has to be allowed.
+		name, err := h.path(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(r.Filepath, name)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *sftpHandler) PosixRename(r *sftp.Request) error {
+	if h.policy.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	oldname, err := h.path(r.Filepath, false)
+	if err != nil {
+		return err
+	}
+	newname, err := h.path(r.Target, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldname, newname)
+}
+
+func (h *sftpHandler) setstat(name string, flags sftp.FileAttrFlags, attrs *sftp.FileStat) error {
+	if flags.Size {
+		err := os.Truncate(name, int64(attrs.Size))
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		err := os.Chmod(name, attrs.FileMode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		err := os.Chtimes(name, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+		if err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		err := h.chown(name, int(attrs.UID), int(attrs.GID))
+		// Clients like rsync preserve the owner of files they upload,
+		// which fails for users that aren't mapped in rootless
+		// containers. The files are kept owned by the agent instead.
+		if err != nil && !(h.rootless && errors.Is(err, fs.ErrPermission)) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name, err := h.path(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		infos := make(sftpListerAt, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				// The entry was removed after it was listed.
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return infos, nil
+	case "Stat":
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *sftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	name, err := h.path(r.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return sftpListerAt{info}, nil
+}
+
+func (h *sftpHandler) Readlink(name string) (string, error) {
+	name, err := h.path(name, false)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(name)
+}
+
+type sftpListerAt []os.FileInfo
+
+func (l sftpListerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/codersdk"
+)
+
+func TestSFTPPolicy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Combined", func(t *testing.T) {
+		t.Parallel()
+		home := t.TempDir()
+		other := t.TempDir()
+		policy, err := newSFTPPolicy(home, &codersdk.WorkspaceAgentSFTP{
+			AllowedPaths: []string{"~/project", other},
+		}, &codersdk.WorkspaceAgentSFTP{
+			ReadOnly:     true,
+			AllowedPaths: []string{home},
+		})
+		require.NoError(t, err)
+		require.True(t, policy.readOnly)
+		resolvedHome, err := filepath.EvalSymlinks(home)
+		require.NoError(t, err)
+		// Paths must be allowed by both policies.
+		require.True(t, policy.allows(filepath.Join(resolvedHome, "project", "file")))
+		require.False(t, policy.allows(filepath.Join(resolvedHome, "file")))
+		require.False(t, policy.allows(filepath.Join(resolvedHome, "project-other")))
+	})
+
+	t.Run("Relative", func(t *testing.T) {
+		t.Parallel()
+		_, err := newSFTPPolicy(t.TempDir(), &codersdk.WorkspaceAgentSFTP{
+			AllowedPaths: []string{"project"},
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("SymbolicLinks", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("symbolic links require privileges on Windows")
+		}
+		allowed := t.TempDir()
+		outside := t.TempDir()
+		require.NoError(t, os.Symlink(outside, filepath.Join(allowed, "link")))
+		require.NoError(t, os.Symlink(filepath.Join(outside, "missing"), filepath.Join(allowed, "broken")))
+		handler := &sftpHandler{}
+		policy, err := newSFTPPolicy("", &codersdk.WorkspaceAgentSFTP{
+			AllowedPaths: []string{allowed},
+		})
+		require.NoError(t, err)
+		handler.policy = policy
+
+		// Paths through links are resolved before they're checked.
+		_, err = handler.path(filepath.ToSlash(filepath.Join(allowed, "link", "file")), true)
+		require.Error(t, err)
+		_, err = handler.path(filepath.ToSlash(filepath.Join(allowed, "link")), true)
+		require.Error(t, err)
+		// The links themselves can be removed.
+		_, err = handler.path(filepath.ToSlash(filepath.Join(allowed, "link")), false)
+		require.NoError(t, err)
+		// Creating a file through a broken link would create it outside.
+		_, err = handler.path(filepath.ToSlash(filepath.Join(allowed, "broken")), true)
+		require.Error(t, err)
+		_, err = handler.path(filepath.ToSlash(filepath.Join(allowed, "new", "file")), true)
+		require.NoError(t, err)
+	})
+}
+
+func TestSFTPSetstatRootless(t *testing.T) {
+	t.Parallel()
+
+	name := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(name, []byte("file"), 0o600))
+	// Root of a rootless container can't give files to users that
+	// aren't mapped.
+	chown := func(name string, _, _ int) error {
+		return &fs.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+	}
+	attrs := &sftp.FileStat{UID: 1000, GID: 1000, Mode: 0o640}
+	flags := sftp.FileAttrFlags{UidGid: true, Permissions: true}
+
+	handler := &sftpHandler{chown: chown}
+	require.ErrorIs(t, handler.setstat(name, flags, attrs), fs.ErrPermission)
+
+	// The owner is kept, but the other attributes are set.
+	handler.rootless = true
+	require.NoError(t, handler.setstat(name, flags, attrs))
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		require.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	}
+}
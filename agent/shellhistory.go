@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	defaultShellHistoryInterval = 5 * time.Minute
+	// shellHistoryShutdownTimeout limits how long the final upload delays
+	// the agent from closing.
+	shellHistoryShutdownTimeout = 5 * time.Second
+	// maxShellHistoryBytes limits the size of a history file that's
+	// synced. Only the end of larger files is uploaded.
+	maxShellHistoryBytes = 16 << 20
+)
+
+// shellHistoryFiles are the history files of supported shells relative to
+// the home directory, keyed by the name they're stored with.
+var shellHistoryFiles = map[string]string{
+	"bash_history": ".bash_history",
+	"zsh_history":  ".zsh_history",
+	"fish_history": filepath.Join(".local", "share", "fish", "fish_history"),
+}
+
+// shellHistorySync persists the history of shells to object storage, so
+// it's kept across ephemeral workspaces.
+type shellHistorySync struct {
+	logger     slog.Logger
+	config     codersdk.WorkspaceAgentShellHistory
+	filesystem afero.Fs
+	httpClient *http.Client
+	homedir    string
+	// synced is the state of each file when it was last restored or
+	// uploaded, so unchanged files aren't uploaded again.
+	synced map[string]shellHistoryState
+}
+
+type shellHistoryState struct {
+	size    int64
+	modTime time.Time
+}
+
+// startShellHistorySync restores shell history when the agent starts, and
+// uploads changes on an interval until it closes.
+func (a *agent) startShellHistorySync(ctx context.Context, config *codersdk.WorkspaceAgentShellHistory) {
+	if config == nil || config.URL == "" {
+		return
+	}
+	homedir, err := a.homeDir()
+	if err != nil {
+		a.logger.Warn(ctx, "get home directory for shell history", slog.Error(err))
+		return
+	}
+	interval := defaultShellHistoryInterval
+	if config.IntervalSeconds > 0 {
+		interval = time.Duration(config.IntervalSeconds) * time.Second
+	}
+	syncer := &shellHistorySync{
+		logger:     a.logger.Named("shell-history"),
+		config:     *config,
+		filesystem: a.filesystem,
+		httpClient: a.httpClient,
+		homedir:    homedir,
+		synced:     map[string]shellHistoryState{},
+	}
+
+	a.closeMutex.Lock()
+	if a.isClosed() {
+		a.closeMutex.Unlock()
+		return
+	}
+	a.connCloseWait.Add(1)
+	a.closeMutex.Unlock()
+	go func() {
+		defer a.connCloseWait.Done()
+		syncer.restore(ctx)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// History from the last interval would be
+				// lost without a final upload.
+				uploadCtx, cancel := context.WithTimeout(context.Background(), shellHistoryShutdownTimeout)
+				syncer.upload(uploadCtx)
+				cancel()
+				return
+			case <-ticker.C:
+				syncer.upload(ctx)
+			}
+		}
+	}()
+}
+
+// restore downloads the history of each shell that doesn't have history in
+// the workspace yet. Existing history is never overwritten.
+func (s *shellHistorySync) restore(ctx context.Context) {
+	for name, file := range shellHistoryFiles {
+		path := filepath.Join(s.homedir, file)
+		info, err := s.filesystem.Stat(path)
+		if err == nil && info.Size() > 0 {
+			s.synced[name] = shellHistoryState{size: info.Size(), modTime: info.ModTime()}
+			continue
+		}
+		content, err := s.download(ctx, name)
+		if err != nil {
+			s.logger.Warn(ctx, "download shell history", slog.F("name", name), slog.Error(err))
+			continue
+		}
+		if content == nil {
+			continue
+		}
+		err = s.filesystem.MkdirAll(filepath.Dir(path), 0o700)
+		if err == nil {
+			err = afero.WriteFile(s.filesystem, path, content, 0o600)
+		}
+		if err != nil {
+			s.logger.Warn(ctx, "write shell history", slog.F("path", path), slog.Error(err))
+			continue
+		}
+		info, err = s.filesystem.Stat(path)
+		if err == nil {
+			s.synced[name] = shellHistoryState{size: info.Size(), modTime: info.ModTime()}
+		}
+		s.logger.Info(ctx, "restored shell history", slog.F("path", path))
+	}
+}
+
+// upload uploads the history of each shell that changed since it was last
+// synced.
+func (s *shellHistorySync) upload(ctx context.Context) {
+	for name, file := range shellHistoryFiles {
+		path := filepath.Join(s.homedir, file)
+		info, err := s.filesystem.Stat(path)
+		if err != nil {
+			continue
+		}
+		state := shellHistoryState{size: info.Size(), modTime: info.ModTime()}
+		if s.synced[name] == state {
+			continue
+		}
+		content, err := s.readHistory(path, info.Size())
+		if err != nil {
+			s.logger.Warn(ctx, "read shell history", slog.F("path", path), slog.Error(err))
+			continue
+		}
+		err = s.put(ctx, name, content)
+		if err != nil {
+			s.logger.Warn(ctx, "upload shell history", slog.F("name", name), slog.Error(err))
+			continue
+		}
+		s.synced[name] = state
+		s.logger.Debug(ctx, "uploaded shell history", slog.F("name", name), slog.F("size", len(content)))
+	}
+}
+
+// readHistory reads the history file, skipping the start of files that are
+// too large. The first line is partial in that case, so it's dropped.
+func (s *shellHistorySync) readHistory(path string, size int64) ([]byte, error) {
+	f, err := s.filesystem.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if size <= maxShellHistoryBytes {
+		return io.ReadAll(f)
+	}
+	_, err = f.Seek(size-maxShellHistoryBytes, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(io.LimitReader(f, maxShellHistoryBytes))
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		content = content[i+1:]
+	}
+	return content, nil
+}
+
+// download returns the stored history, or nil if there isn't any.
+func (s *shellHistorySync) download(ctx context.Context, name string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	content, err := io.ReadAll(io.LimitReader(res.Body, maxShellHistoryBytes))
+	if err != nil {
+		return nil, xerrors.Errorf("read body: %w", err)
+	}
+	return content, nil
+}
+
+func (s *shellHistorySync) put(ctx context.Context, name string, content []byte) error {
+	res, err := s.do(ctx, http.MethodPut, name, content)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return xerrors.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (s *shellHistorySync) do(ctx context.Context, method, name string, body []byte) (*http.Response, error) {
+	url := strings.TrimSuffix(s.config.URL, "/") + "/" + name
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, xerrors.Errorf("create request: %w", err)
+	}
+	for key, value := range s.config.Headers {
+		req.Header.Set(key, value)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,446 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// pooledShellCommand is what shells of the pool run while they're idle.
+// They block reading the script of a session from file descriptor 3, and
+// source it once it's written and closed.
+const pooledShellCommand = ". /dev/fd/3"
+
+// pooledShells are the shells that are pooled, since the script of a
+// session is written for POSIX shells.
+var pooledShells = map[string]bool{
+	"ash":  true,
+	"bash": true,
+	"dash": true,
+	"ksh":  true,
+	"mksh": true,
+	"sh":   true,
+	"zsh":  true,
+}
+
+// shellStartupVariables are read by shells when they start, or are set by
+// them, so commands with values that differ from the ones of a pooled shell
+// start a shell instead.
+var shellStartupVariables = map[string]bool{
+	"BASHOPTS":        true,
+	"BASH_ENV":        true,
+	"ENV":             true,
+	"EUID":            true,
+	"IFS":             true,
+	"OLDPWD":          true,
+	"POSIXLY_CORRECT": true,
+	"PPID":            true,
+	"PS4":             true,
+	"PWD":             true,
+	"SHELLOPTS":       true,
+	"SHLVL":           true,
+	"UID":             true,
+}
+
+var shellVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// shellPool keeps shells of the user started ahead of sessions, which run
+// the commands of sessions without a PTY. Editors like VS Code run many
+// short commands, and for them starting the shell of the user takes most
+// of the time.
+type shellPool struct {
+	size int
+	// changed is signaled when the pool needs shells.
+	changed chan struct{}
+
+	mutex  sync.Mutex
+	closed bool
+	// generation is the generation of the environment of sessions that
+	// idle shells were started with.
+	generation uint64
+	idle       []*pooledShell
+}
+
+func newShellPool(size int) *shellPool {
+	if size < 0 {
+		size = 0
+	}
+	return &shellPool{
+		size:    size,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// refill signals that the pool needs shells.
+func (p *shellPool) refill() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// missing returns how many shells the pool needs to be full.
+func (p *shellPool) missing() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return 0
+	}
+	return p.size - len(p.idle)
+}
+
+// add adds an idle shell to the pool. It's discarded if the environment
+// of sessions changed since it started, or the pool is closed.
+func (p *shellPool) add(shell *pooledShell) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed || shell.generation != p.generation || len(p.idle) >= p.size {
+		shell.discard()
+		return false
+	}
+	p.idle = append(p.idle, shell)
+	return true
+}
+
+// take returns an idle shell and the script that runs the command with it,
+// or nil if no shell can run it. Shells only run commands with the same
+// shell, and variables they didn't read when they started.
+func (p *shellPool) take(cmd *exec.Cmd) (*pooledShell, string) {
+	if p == nil {
+		return nil, ""
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := 0; i < len(p.idle); i++ {
+		shell := p.idle[i]
+		select {
+		case <-shell.exited:
+			// Shells that exited while idle are discarded.
+			shell.discard()
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			i--
+			continue
+		default:
+		}
+		script, ok := shell.script(cmd)
+		if !ok {
+			continue
+		}
+		p.idle = append(p.idle[:i], p.idle[i+1:]...)
+		return shell, script
+	}
+	return nil, ""
+}
+
+// discard discards the idle shells after the environment of sessions
+// changed, since they were started with the previous one.
+func (p *shellPool) discard(generation uint64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.generation = generation
+	for _, shell := range p.idle {
+		shell.discard()
+	}
+	p.idle = nil
+}
+
+// close discards the idle shells, and stops adding shells.
+func (p *shellPool) close() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for _, shell := range p.idle {
+		shell.discard()
+	}
+	p.idle = nil
+}
+
+// pooledShell is a shell that waits for the script of a session.
+type pooledShell struct {
+	generation uint64
+	cmd        *exec.Cmd
+	// scriptWriter is read by the shell as file descriptor 3.
+	scriptWriter *os.File
+	stdin        *os.File
+	stdout       *os.File
+	stderr       *os.File
+	exited       chan struct{}
+	// err is what waiting for the shell returned, which is set once
+	// exited is closed.
+	err error
+}
+
+// startPooledShell starts a shell with the environment of sessions. Its
+// output is written to pipes rather than copied by exec, since the shell
+// is waited for while it's idle.
+func startPooledShell(name string, env *sessionEnvironment) (*pooledShell, error) {
+	var (
+		parentFiles []*os.File
+		childFiles  []*os.File
+	)
+	closeFiles := func(files []*os.File) {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}
+	pipe := func(childReads bool) (*os.File, error) {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		if childReads {
+			childFiles = append(childFiles, reader)
+			parentFiles = append(parentFiles, writer)
+			return writer, nil
+		}
+		childFiles = append(childFiles, writer)
+		parentFiles = append(parentFiles, reader)
+		return reader, nil
+	}
+	shell := &pooledShell{
+		generation: env.generation,
+		exited:     make(chan struct{}),
+	}
+	var err error
+	for _, p := range []struct {
+		file       **os.File
+		childReads bool
+	}{
+		{&shell.scriptWriter, true},
+		{&shell.stdin, true},
+		{&shell.stdout, false},
+		{&shell.stderr, false},
+	} {
+		*p.file, err = pipe(p.childReads)
+		if err != nil {
+			closeFiles(childFiles)
+			closeFiles(parentFiles)
+			return nil, xerrors.Errorf("create pipe: %w", err)
+		}
+	}
+
+	shell.cmd = exec.Command(name, "-c", pooledShellCommand)
+	shell.cmd.Dir = env.dir
+	shell.cmd.Env = env.commandEnv(nil)
+	shell.cmd.ExtraFiles = []*os.File{childFiles[0]}
+	shell.cmd.Stdin = childFiles[1]
+	shell.cmd.Stdout = childFiles[2]
+	shell.cmd.Stderr = childFiles[3]
+	err = shell.cmd.Start()
+	closeFiles(childFiles)
+	if err != nil {
+		closeFiles(parentFiles)
+		return nil, xerrors.Errorf("start shell: %w", err)
+	}
+	go func() {
+		shell.err = shell.cmd.Wait()
+		close(shell.exited)
+	}()
+	return shell, nil
+}
+
+// script returns the script that runs the command like the shell would
+// when started for it. It sets the variables of the command that differ
+// from the ones of the shell, and changes to the directory of the command.
+func (s *pooledShell) script(cmd *exec.Cmd) (string, bool) {
+	if cmd.Path != s.cmd.Path || len(cmd.Args) != 3 || cmd.Args[0] != s.cmd.Args[0] || cmd.Args[1] != "-c" {
+		return "", false
+	}
+	if cmd.Env == nil || cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil || len(cmd.ExtraFiles) > 0 || cmd.SysProcAttr != nil {
+		return "", false
+	}
+	var script strings.Builder
+	// The shell reads the script from another descriptor, so commands
+	// don't inherit it.
+	script.WriteString("exec 3<&-\n")
+
+	shellEnv := environMap(s.cmd.Env)
+	commandEnv := environMap(cmd.Env)
+	names := make([]string, 0, len(shellEnv)+len(commandEnv))
+	for name := range shellEnv {
+		names = append(names, name)
+	}
+	for name := range commandEnv {
+		if _, ok := shellEnv[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		shellValue, inShell := shellEnv[name]
+		commandValue, inCommand := commandEnv[name]
+		if inShell == inCommand && shellValue == commandValue {
+			continue
+		}
+		if shellStartupVariables[name] || !shellVariableName.MatchString(name) {
+			return "", false
+		}
+		if !inCommand {
+			script.WriteString("unset " + name + "\n")
+			continue
+		}
+		script.WriteString("export " + name + "=" + shellQuote(commandValue) + "\n")
+	}
+
+	if cmd.Dir != "" && cmd.Dir != s.cmd.Dir {
+		// Starting a command in a directory that doesn't exist fails
+		// before the shell runs, which only a started shell reports.
+		info, err := os.Stat(cmd.Dir)
+		if err != nil || !info.IsDir() {
+			return "", false
+		}
+		script.WriteString("cd -- " + shellQuote(cmd.Dir) + " || exit\n")
+	}
+	script.WriteString(cmd.Args[2])
+	script.WriteString("\n")
+	return script.String(), true
+}
+
+// run runs the script with the shell, and waits for the shell to exit and
+// its output to be copied.
+func (s *pooledShell) run(ctx context.Context, script string, stdin io.Reader, stdout, stderr io.Writer) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.cmd.Process.Kill()
+		case <-s.exited:
+		}
+	}()
+	go func() {
+		_, _ = io.Copy(s.stdin, stdin)
+		_ = s.stdin.Close()
+	}()
+	var output sync.WaitGroup
+	for _, o := range []struct {
+		writer io.Writer
+		reader *os.File
+	}{{stdout, s.stdout}, {stderr, s.stderr}} {
+		o := o
+		output.Add(1)
+		go func() {
+			defer output.Done()
+			_, _ = io.Copy(o.writer, o.reader)
+			_ = o.reader.Close()
+		}()
+	}
+	_, writeErr := io.WriteString(s.scriptWriter, script)
+	_ = s.scriptWriter.Close()
+	<-s.exited
+	if ctx.Err() != nil || shellKilled(s.cmd.ProcessState) {
+		// The command isn't executed in place of the shell like it is
+		// when a shell starts for it, so its processes may still hold the
+		// output open after the shell is killed.
+		_ = s.stdout.Close()
+		_ = s.stderr.Close()
+	}
+	output.Wait()
+	if s.err == nil && writeErr != nil {
+		return xerrors.Errorf("write script: %w", writeErr)
+	}
+	return s.err
+}
+
+// shellKilled returns whether a shell exited because of a signal.
+func shellKilled(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled()
+}
+
+// discard stops an idle shell.
+func (s *pooledShell) discard() {
+	_ = s.scriptWriter.Close()
+	_ = s.cmd.Process.Kill()
+	_ = s.stdin.Close()
+	_ = s.stdout.Close()
+	_ = s.stderr.Close()
+}
+
+// environMap returns the variables of an environment, where later ones
+// override earlier ones like exec does.
+func environMap(environ []string) map[string]string {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		env[name] = value
+	}
+	return env
+}
+
+// shellQuote quotes a value for POSIX shells.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// runShellPool keeps the pool of shells full until the agent closes.
+func (a *agent) runShellPool(ctx context.Context) {
+	defer a.shellPool.close()
+	for {
+		a.fillShellPool(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.shellPool.changed:
+		}
+	}
+}
+
+// fillShellPool starts shells until the pool is full. Shells are only
+// pooled once the metadata is available, and for POSIX shells.
+func (a *agent) fillShellPool(ctx context.Context) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	for a.shellPool.missing() > 0 && ctx.Err() == nil {
+		if a.metadata.Load() == nil {
+			return
+		}
+		env, err := a.sessionEnvironment()
+		if err != nil {
+			a.logger.Debug(ctx, "prewarm shells", slog.Error(err))
+			return
+		}
+		name, args, _, err := resolveShell(exec.LookPath, env.shell, []string{"-c", pooledShellCommand}, pooledShellCommand)
+		if err != nil {
+			a.logger.Debug(ctx, "prewarm shells", slog.Error(err))
+			return
+		}
+		if len(args) != 2 || !pooledShells[filepath.Base(name)] {
+			a.logger.Debug(ctx, "shell isn't prewarmed, since it isn't a POSIX shell", slog.F("shell", name))
+			return
+		}
+		// Shells read the script through /dev/fd, which minimal
+		// containers may not have.
+		_, err = os.Stat("/dev/fd")
+		if err != nil {
+			a.logger.Debug(ctx, "shells aren't prewarmed without /dev/fd", slog.Error(err))
+			return
+		}
+		shell, err := startPooledShell(name, env)
+		if err != nil {
+			a.logger.Warn(ctx, "prewarm shell", slog.F("shell", name), slog.Error(err))
+			return
+		}
+		a.shellPool.add(shell)
+	}
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestPooledShellScript(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	shell := &pooledShell{
+		cmd: exec.Command("/bin/sh", "-c", pooledShellCommand),
+	}
+	shell.cmd.Dir = "/"
+	shell.cmd.Env = []string{"KEEP=same", "CHANGE=old", "REMOVE=gone", "SHLVL=1"}
+	command := func(env ...string) *exec.Cmd {
+		cmd := exec.Command("/bin/sh", "-c", "echo hello")
+		cmd.Dir = "/"
+		cmd.Env = env
+		return cmd
+	}
+
+	script, ok := shell.script(command("KEEP=same", "CHANGE=old", "CHANGE=it's new", "SHLVL=1", "ADD=added"))
+	require.True(t, ok)
+	require.Equal(t, "exec 3<&-\n"+
+		"export ADD='added'\n"+
+		`export CHANGE='it'\''s new'`+"\n"+
+		"unset REMOVE\n"+
+		"echo hello\n", script)
+
+	cmd := command(shell.cmd.Env...)
+	cmd.Dir = dir
+	script, ok = shell.script(cmd)
+	require.True(t, ok)
+	require.Contains(t, script, "cd -- '"+dir+"' || exit\n")
+
+	// Commands that a pooled shell can't run like a started one start a
+	// shell instead.
+	for name, cmd := range map[string]*exec.Cmd{
+		"StartupVariable": command("KEEP=same", "CHANGE=old", "REMOVE=gone", "SHLVL=2"),
+		"InvalidName":     command("KEEP=same", "CHANGE=old", "REMOVE=gone", "SHLVL=1", "BASH_FUNC_f%%=() { :; }"),
+		"OtherShell":      exec.Command("/bin/bash", "-c", "echo hello"),
+		"LoginShell":      exec.Command("/bin/sh", "-l"),
+	} {
+		_, ok := shell.script(cmd)
+		require.False(t, ok, name)
+	}
+	cmd = command(shell.cmd.Env...)
+	cmd.Dir = dir + "/missing"
+	_, ok = shell.script(cmd)
+	require.False(t, ok, "missing directory")
+}
+
+func TestShellPool(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("Shells are only pooled on Unix.")
+	}
+
+	ctx := context.Background()
+	env := &sessionEnvironment{
+		shell:   "/bin/sh",
+		dir:     t.TempDir(),
+		environ: []string{"PATH=/usr/bin:/bin"},
+		env:     []string{"FOO=pooled"},
+	}
+	pool := newShellPool(1)
+	require.Equal(t, 1, pool.missing())
+	start := func() *pooledShell {
+		shell, err := startPooledShell("/bin/sh", env)
+		require.NoError(t, err)
+		return shell
+	}
+	require.True(t, pool.add(start()))
+	require.Zero(t, pool.missing())
+	require.False(t, pool.add(start()), "full")
+
+	cmd := exec.Command("/bin/sh", "-c", `echo "$FOO $BAR $(pwd)"; cat; test -e /dev/fd/3 && echo leaked; echo error >&2; exit 3`)
+	cmd.Dir = t.TempDir()
+	cmd.Env = env.commandEnv([]string{"BAR=client"})
+	shell, script := pool.take(cmd)
+	require.NotNil(t, shell)
+	require.Equal(t, 1, pool.missing())
+	var stdout, stderr bytes.Buffer
+	err := shell.run(ctx, script, strings.NewReader("input\n"), &stdout, &stderr)
+	var exitErr *exec.ExitError
+	require.True(t, xerrors.As(err, &exitErr))
+	require.Equal(t, 3, exitErr.ExitCode())
+	require.Equal(t, "pooled client "+cmd.Dir+"\ninput\n", stdout.String())
+	require.Equal(t, "error\n", stderr.String())
+
+	// Shells started with a previous environment are discarded.
+	require.True(t, pool.add(start()))
+	pool.discard(1)
+	require.Equal(t, 1, pool.missing())
+	require.False(t, pool.add(start()), "previous generation")
+	env.generation = 1
+	require.True(t, pool.add(start()))
+
+	// Canceling the session kills the shell.
+	canceled, cancel := context.WithCancel(ctx)
+	cmd = exec.Command("/bin/sh", "-c", "sleep 60")
+	cmd.Env = env.commandEnv(nil)
+	shell, script = pool.take(cmd)
+	require.NotNil(t, shell)
+	cancel()
+	err = shell.run(canceled, script, strings.NewReader(""), &stdout, &stderr)
+	require.Error(t, err)
+
+	pool.close()
+	require.Zero(t, pool.missing())
+	require.False(t, pool.add(start()), "closed")
+}
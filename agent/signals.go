@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+
+	"cdr.dev/slog"
+)
+
+// sshSignals are the signals of RFC 4254 that every platform has. Windows
+// doesn't have the user-defined signals.
+var sshSignals = map[ssh.Signal]os.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  os.Interrupt,
+	ssh.SIGKILL: os.Kill,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+}
+
+// forwardSignals delivers the signals a client sends in a session with
+// signal until the returned function is called. Clients send them for
+// Ctrl+C when they don't have a terminal, and `ssh -O` sends them too.
+func (a *agent) forwardSignals(ctx context.Context, session ssh.Session, signal func(os.Signal) error) func() {
+	signals := make(chan ssh.Signal, 1)
+	done := make(chan struct{})
+	session.Signals(signals)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case name := <-signals:
+				sig, ok := sshSignals[name]
+				if !ok {
+					a.logger.Debug(ctx, "ignoring unsupported signal", slog.F("signal", name))
+					continue
+				}
+				err := signal(sig)
+				if err != nil {
+					a.logger.Debug(ctx, "deliver signal", slog.F("signal", name), slog.Error(err))
+				}
+			}
+		}
+	}()
+	return func() {
+		// The session sends signals while it's locked, so they must
+		// still be received until it stops sending them.
+		session.Signals(nil)
+		close(done)
+	}
+}
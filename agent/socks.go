@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"golang.org/x/xerrors"
+	"tailscale.com/net/socks5"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/tailnet"
+)
+
+// serveSOCKS serves a SOCKS5 proxy that dials connections from the
+// workspace, so clients can route browsers and tools through the network of
+// the workspace without forwarding each port. Hostnames are resolved with
+// the resolver of the workspace.
+func (a *agent) serveSOCKS(ctx context.Context, listener net.Listener) {
+	logger := a.logger.Named("socks")
+	server := &socks5.Server{
+		Logf: tailnet.Logger(logger),
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			a.usage.socksConnections.Inc()
+			logger.Debug(ctx, "dial socks connection", slog.F("network", network), slog.F("addr", addr))
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	err := server.Serve(listener)
+	if err != nil && !xerrors.Is(err, net.ErrClosed) && !strings.Contains(err.Error(), "use of closed network connection") {
+		logger.Debug(ctx, "socks listener failed", slog.Error(err))
+	}
+}
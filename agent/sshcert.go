@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"bytes"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+// sshUserCertificateAuthority returns the certificate authority from the
+// metadata, or nil if SSH connections are only authenticated by the tailnet.
+func (a *agent) sshUserCertificateAuthority() *codersdk.WorkspaceAgentSSHUserCertificateAuthority {
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	return metadata.SSHUserCertificateAuthority
+}
+
+// handleSSHPublicKey accepts user certificates issued by the certificate
+// authority in the metadata, and public keys of the owner of the workspace
+// when the metadata requires public key authentication. Any key is accepted
+// without either, since client authentication is disabled.
+func (a *agent) handleSSHPublicKey(ctx ssh.Context, key ssh.PublicKey) bool {
+	authority := a.sshUserCertificateAuthority()
+	publicKeyAuth := a.sshPublicKeyAuth()
+	if authority == nil && !publicKeyAuth {
+		return true
+	}
+	var err error
+	_, isCertificate := key.(*gossh.Certificate)
+	switch {
+	case publicKeyAuth && !isCertificate:
+		err = a.checkAuthorizedSSHKey(ctx, key)
+	case authority != nil:
+		err = checkSSHUserCertificate(authority, key)
+	default:
+		err = xerrors.New("a public key is required, not a certificate")
+	}
+	if err != nil {
+		a.logger.Named("ssh-server").Info(ctx, "ssh public key rejected",
+			slog.F("user", ctx.User()),
+			slog.F("remote_addr", ctx.RemoteAddr()),
+			slog.F("fingerprint", gossh.FingerprintSHA256(key)),
+			slog.Error(err),
+		)
+		return false
+	}
+	return true
+}
+
+// checkSSHUserCertificate returns an error unless the key is a valid user
+// certificate signed by the authority for its principal.
+func checkSSHUserCertificate(authority *codersdk.WorkspaceAgentSSHUserCertificateAuthority, key gossh.PublicKey) error {
+	authorityKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(authority.PublicKey))
+	if err != nil {
+		return xerrors.Errorf("parse certificate authority: %w", err)
+	}
+	cert, ok := key.(*gossh.Certificate)
+	if !ok {
+		return xerrors.New("a certificate is required")
+	}
+	if cert.CertType != gossh.UserCert {
+		return xerrors.Errorf("certificate has type %d, not a user certificate", cert.CertType)
+	}
+	// Certificates without principals are valid for every principal.
+	// coderd always sets them, so anything else isn't trusted.
+	if len(cert.ValidPrincipals) == 0 {
+		return xerrors.New("certificate has no principals")
+	}
+	if len(cert.CriticalOptions) > 0 {
+		return xerrors.New("certificate critical options aren't supported")
+	}
+	// CheckCert doesn't check the authority, only the signature.
+	if !bytes.Equal(cert.SignatureKey.Marshal(), authorityKey.Marshal()) {
+		return xerrors.New("certificate isn't signed by the certificate authority")
+	}
+	checker := &gossh.CertChecker{}
+	err = checker.CheckCert(authority.Principal, cert)
+	if err != nil {
+		return xerrors.Errorf("check certificate %q: %w", cert.KeyId, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// authorizedKeysTTL is how long the authorized keys fetched from
+	// coderd are used, so removed keys stop being accepted.
+	authorizedKeysTTL = time.Minute
+	// authorizedKeysRefreshInterval limits how often unknown keys fetch
+	// the authorized keys again, so added keys are accepted quickly.
+	authorizedKeysRefreshInterval = 5 * time.Second
+)
+
+// authorizedKeys caches the SSH public keys of the owner of the workspace.
+type authorizedKeys struct {
+	mutex sync.Mutex
+	// keys are the marshaled keys, or nil if they weren't fetched.
+	keys      map[string]struct{}
+	fetchedAt time.Time
+}
+
+// sshPublicKeyAuth returns whether the metadata requires SSH connections
+// to authenticate with a public key of the owner of the workspace.
+func (a *agent) sshPublicKeyAuth() bool {
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	return metadata.SSHPublicKeyAuth
+}
+
+// checkAuthorizedSSHKey returns an error unless the key is one of the
+// public keys of the owner of the workspace. The keys that were fetched
+// before are used while coderd is unreachable.
+func (a *agent) checkAuthorizedSSHKey(ctx context.Context, key gossh.PublicKey) error {
+	a.authorizedKeys.mutex.Lock()
+	defer a.authorizedKeys.mutex.Unlock()
+
+	_, ok := a.authorizedKeys.keys[string(key.Marshal())]
+	age := time.Since(a.authorizedKeys.fetchedAt)
+	if a.authorizedKeys.keys == nil || (ok && age >= authorizedKeysTTL) || (!ok && age >= authorizedKeysRefreshInterval) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		keys, err := a.fetchAuthorizedSSHKeys(ctx)
+		switch {
+		case err == nil:
+			a.authorizedKeys.keys = keys
+			a.authorizedKeys.fetchedAt = time.Now()
+			_, ok = keys[string(key.Marshal())]
+		case a.authorizedKeys.keys == nil:
+			return xerrors.Errorf("fetch authorized keys: %w", err)
+		default:
+			a.logger.Warn(ctx, "fetch authorized ssh keys", slog.Error(err))
+		}
+	}
+	if !ok {
+		return xerrors.New("the key isn't one of the ssh public keys of the workspace owner")
+	}
+	return nil
+}
+
+func (a *agent) fetchAuthorizedSSHKeys(ctx context.Context) (map[string]struct{}, error) {
+	resp, err := a.client.WorkspaceAgentAuthorizedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]struct{}, len(resp.PublicKeys))
+	for _, publicKey := range resp.PublicKeys {
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(publicKey))
+		if err != nil {
+			a.logger.Warn(ctx, "parse authorized ssh key", slog.F("key", publicKey), slog.Error(err))
+			continue
+		}
+		keys[string(key.Marshal())] = struct{}{}
+	}
+	return keys, nil
+}
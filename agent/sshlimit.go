@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// sshLimitWindow is the window connections and failures of a peer are
+	// counted in.
+	sshLimitWindow = time.Minute
+	// sshMaxConnections is the number of SSH connections a peer can open
+	// per window. Editors open a connection per terminal and port
+	// forward, so it's well above what a client needs.
+	sshMaxConnections = 600
+	// sshMaxFailures is the number of failed SSH handshakes per window
+	// after which a peer is banned. Clients don't fail handshakes, so
+	// failures are malformed or abusive connections.
+	sshMaxFailures = 20
+	// sshBanDuration is how long connections from a banned peer are
+	// rejected.
+	sshBanDuration = 5 * time.Minute
+)
+
+// sshLimiter rate limits SSH connections per peer and temporarily bans
+// peers that repeatedly fail handshakes. SSH authentication is usually
+// disabled since the tailnet authenticates connections, so this protects
+// the agent from connection floods of a compromised peer.
+type sshLimiter struct {
+	now func() time.Time
+
+	mutex     sync.Mutex
+	peers     map[string]*sshPeer
+	lastPrune time.Time
+	rejected  int64
+	bans      int64
+}
+
+type sshPeer struct {
+	windowStart time.Time
+	connections int
+	failures    int
+	bannedUntil time.Time
+}
+
+func newSSHLimiter() *sshLimiter {
+	return &sshLimiter{
+		now:   time.Now,
+		peers: map[string]*sshPeer{},
+	}
+}
+
+// sshPeerKey returns the IP of a connection, since the port differs for
+// every connection of a peer.
+func sshPeerKey(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// peer returns the state of a peer in the current window. The caller must
+// hold the mutex.
+func (l *sshLimiter) peer(key string, now time.Time) *sshPeer {
+	if now.Sub(l.lastPrune) >= sshLimitWindow {
+		l.lastPrune = now
+		for k, p := range l.peers {
+			if now.Sub(p.windowStart) >= sshLimitWindow && now.After(p.bannedUntil) {
+				delete(l.peers, k)
+			}
+		}
+	}
+	p, ok := l.peers[key]
+	if !ok {
+		p = &sshPeer{windowStart: now}
+		l.peers[key] = p
+	}
+	if now.Sub(p.windowStart) >= sshLimitWindow {
+		p.windowStart = now
+		p.connections = 0
+		p.failures = 0
+	}
+	return p
+}
+
+// allow returns whether a connection from a peer is accepted.
+func (l *sshLimiter) allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	p := l.peer(key, now)
+	if now.Before(p.bannedUntil) || p.connections >= sshMaxConnections {
+		l.rejected++
+		return false
+	}
+	p.connections++
+	return true
+}
+
+// fail records a failed handshake of a peer, and returns whether the peer
+// was banned by it.
+func (l *sshLimiter) fail(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	p := l.peer(key, now)
+	p.failures++
+	if p.failures < sshMaxFailures || now.Before(p.bannedUntil) {
+		return false
+	}
+	p.bannedUntil = now.Add(sshBanDuration)
+	l.bans++
+	return true
+}
+
+// stats returns the number of rejected connections and bans since the
+// agent started.
+func (l *sshLimiter) stats() (rejected, bans int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rejected, l.bans
+}
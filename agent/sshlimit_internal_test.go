@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("RateLimit", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		limiter := newSSHLimiter()
+		limiter.now = func() time.Time { return now }
+		for i := 0; i < sshMaxConnections; i++ {
+			require.True(t, limiter.allow("fd7a:115c:a1e0::1"))
+		}
+		require.False(t, limiter.allow("fd7a:115c:a1e0::1"))
+		// Other peers aren't limited.
+		require.True(t, limiter.allow("fd7a:115c:a1e0::2"))
+
+		now = now.Add(sshLimitWindow)
+		require.True(t, limiter.allow("fd7a:115c:a1e0::1"))
+		rejected, bans := limiter.stats()
+		require.EqualValues(t, 1, rejected)
+		require.Zero(t, bans)
+	})
+
+	t.Run("Ban", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		limiter := newSSHLimiter()
+		limiter.now = func() time.Time { return now }
+		for i := 0; i < sshMaxFailures-1; i++ {
+			require.False(t, limiter.fail("fd7a:115c:a1e0::1"))
+		}
+		require.True(t, limiter.allow("fd7a:115c:a1e0::1"))
+		require.True(t, limiter.fail("fd7a:115c:a1e0::1"))
+		require.False(t, limiter.allow("fd7a:115c:a1e0::1"))
+		// Failures while banned don't extend the ban.
+		require.False(t, limiter.fail("fd7a:115c:a1e0::1"))
+
+		now = now.Add(sshLimitWindow)
+		require.False(t, limiter.allow("fd7a:115c:a1e0::1"))
+		now = now.Add(sshBanDuration)
+		require.True(t, limiter.allow("fd7a:115c:a1e0::1"))
+		rejected, bans := limiter.stats()
+		require.EqualValues(t, 2, rejected)
+		require.EqualValues(t, 1, bans)
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		t.Parallel()
+		now := time.Now()
+		limiter := newSSHLimiter()
+		limiter.now = func() time.Time { return now }
+		require.True(t, limiter.allow("fd7a:115c:a1e0::1"))
+		now = now.Add(sshLimitWindow)
+		require.True(t, limiter.allow("fd7a:115c:a1e0::2"))
+		require.Len(t, limiter.peers, 1)
+	})
+}
+
+func TestSSHPeerKey(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "fd7a:115c:a1e0::1", sshPeerKey(&net.TCPAddr{IP: net.ParseIP("fd7a:115c:a1e0::1"), Port: 1234}))
+	require.Equal(t, "127.0.0.1", sshPeerKey(&net.UnixAddr{Name: "127.0.0.1:1234", Net: "unix"}))
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// startupLogsFlushInterval is how often lines of the startup script
+	// are sent to coderd.
+	startupLogsFlushInterval = 250 * time.Millisecond
+	// startupLogsBatchSize is the number of lines that are sent at once.
+	startupLogsBatchSize = 100
+	// startupLogsMaxLineSize splits lines that are longer, like progress
+	// bars that only move the cursor, so they're sent while they grow.
+	startupLogsMaxLineSize = 16 << 10
+)
+
+// startupLogSender streams the output of the startup script to coderd line
+// by line, so it can be watched while the workspace starts. Like the log
+// file, the logs are limited to the head and tail of the output. The head
+// is streamed, and the tail is sent when the script exits, after a line
+// that marks the truncation.
+type startupLogSender struct {
+	logger slog.Logger
+	patch  func(ctx context.Context, req codersdk.PatchStartupLogs) error
+
+	headSize int64
+	tailSize int64
+
+	mutex   sync.Mutex
+	partial []byte
+	queue   []codersdk.StartupLog
+	// written is the size of the head that was queued.
+	written   int64
+	truncated bool
+	tail      []codersdk.StartupLog
+	tailBytes int64
+	// failing is set while sending fails, so failures are logged once.
+	failing bool
+
+	flush  chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func newStartupLogSender(ctx context.Context, logger slog.Logger, patch func(ctx context.Context, req codersdk.PatchStartupLogs) error, maxSize int64) *startupLogSender {
+	// The sizes match the log file, where the marker counts towards the
+	// limit.
+	headSize := (maxSize - int64(len(logTruncatedMarker))) / 2
+	if headSize < 0 {
+		headSize = 0
+	}
+	s := &startupLogSender{
+		logger:   logger,
+		patch:    patch,
+		headSize: headSize,
+		tailSize: headSize,
+		flush:    make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run(ctx)
+	return s
+}
+
+func (s *startupLogSender) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.partial = append(s.partial, p...)
+	for {
+		index := bytes.IndexByte(s.partial, '\n')
+		if index < 0 {
+			if len(s.partial) < startupLogsMaxLineSize {
+				break
+			}
+			index = startupLogsMaxLineSize
+		}
+		line := strings.TrimSuffix(string(s.partial[:index]), "\r")
+		if index < len(s.partial) && s.partial[index] == '\n' {
+			index++
+		}
+		s.partial = s.partial[index:]
+		s.queueLocked(line)
+	}
+	if len(s.queue) >= startupLogsBatchSize {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// queueLocked queues a line if it fits in the head, and otherwise keeps
+// it in the tail. The caller must hold the mutex.
+func (s *startupLogSender) queueLocked(output string) {
+	line := codersdk.StartupLog{
+		CreatedAt: time.Now(),
+		Output:    output,
+	}
+	if !s.truncated && s.written+int64(len(output)) <= s.headSize {
+		s.written += int64(len(output))
+		s.queue = append(s.queue, line)
+		return
+	}
+	if !s.truncated {
+		s.truncated = true
+		s.queue = append(s.queue, codersdk.StartupLog{
+			CreatedAt: line.CreatedAt,
+			Output:    strings.TrimSpace(logTruncatedMarker),
+		})
+	}
+	s.tail = append(s.tail, line)
+	s.tailBytes += int64(len(output))
+	for len(s.tail) > 0 && s.tailBytes > s.tailSize {
+		s.tailBytes -= int64(len(s.tail[0].Output))
+		s.tail = s.tail[1:]
+	}
+}
+
+// Close queues the last partial line and the tail, and waits for the
+// queued lines to be sent.
+func (s *startupLogSender) Close() error {
+	s.mutex.Lock()
+	if len(s.partial) > 0 {
+		s.queueLocked(strings.TrimSuffix(string(s.partial), "\r"))
+		s.partial = nil
+	}
+	s.queue = append(s.queue, s.tail...)
+	s.tail = nil
+	s.mutex.Unlock()
+	close(s.closed)
+	<-s.done
+	return nil
+}
+
+func (s *startupLogSender) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(startupLogsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.closed:
+			s.send(ctx)
+			return
+		case <-ticker.C:
+		case <-s.flush:
+		}
+		s.send(ctx)
+	}
+}
+
+// send sends the queued lines in batches. Lines that fail to send are
+// retried with the next batch, and are bounded by the log limit.
+func (s *startupLogSender) send(ctx context.Context) {
+	for {
+		s.mutex.Lock()
+		batch := s.queue
+		if len(batch) > startupLogsBatchSize {
+			batch = batch[:startupLogsBatchSize]
+		}
+		s.mutex.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		err := s.patch(ctx, codersdk.PatchStartupLogs{Logs: batch})
+		if err != nil {
+			if ctx.Err() == nil && !s.failing {
+				s.logger.Warn(ctx, "send startup logs, retrying", slog.Error(err))
+			}
+			s.failing = true
+			return
+		}
+		s.failing = false
+		s.mutex.Lock()
+		s.queue = s.queue[len(batch):]
+		s.mutex.Unlock()
+	}
+}
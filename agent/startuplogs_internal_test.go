@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/testutil"
+)
+
+type fakeStartupLogs struct {
+	mutex    sync.Mutex
+	fail     bool
+	attempts int
+	logs     []string
+}
+
+func (f *fakeStartupLogs) patch(_ context.Context, req codersdk.PatchStartupLogs) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.attempts++
+	if f.fail {
+		return xerrors.New("unavailable")
+	}
+	for _, log := range req.Logs {
+		f.logs = append(f.logs, log.Output)
+	}
+	return nil
+}
+
+func TestStartupLogSender(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Lines", func(t *testing.T) {
+		t.Parallel()
+		fake := &fakeStartupLogs{}
+		sender := newStartupLogSender(context.Background(), slogtest.Make(t, nil), fake.patch, defaultStartupLogMaxSize)
+		_, err := sender.Write([]byte("one\r\ntw"))
+		require.NoError(t, err)
+		_, err = sender.Write([]byte("o\n\nthree"))
+		require.NoError(t, err)
+		require.NoError(t, sender.Close())
+		require.Equal(t, []string{"one", "two", "", "three"}, fake.logs)
+	})
+
+	t.Run("LongLine", func(t *testing.T) {
+		t.Parallel()
+		fake := &fakeStartupLogs{}
+		sender := newStartupLogSender(context.Background(), slogtest.Make(t, nil), fake.patch, defaultStartupLogMaxSize)
+		_, err := sender.Write([]byte(strings.Repeat("a", startupLogsMaxLineSize+1)))
+		require.NoError(t, err)
+		require.NoError(t, sender.Close())
+		require.Len(t, fake.logs, 2)
+		require.Len(t, fake.logs[0], startupLogsMaxLineSize)
+		require.Equal(t, "a", fake.logs[1])
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		t.Parallel()
+		fake := &fakeStartupLogs{}
+		// The head and tail are 10 bytes each.
+		sender := newStartupLogSender(context.Background(), slogtest.Make(t, nil), fake.patch, int64(len(logTruncatedMarker))+20)
+		_, err := sender.Write([]byte("aaaa\nbbbb\ncccc\ndddd\neeee\n"))
+		require.NoError(t, err)
+		require.NoError(t, sender.Close())
+		require.Equal(t, []string{"aaaa", "bbbb", strings.TrimSpace(logTruncatedMarker), "dddd", "eeee"}, fake.logs)
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		t.Parallel()
+		fake := &fakeStartupLogs{fail: true}
+		sender := newStartupLogSender(context.Background(), slogtest.Make(t, nil), fake.patch, defaultStartupLogMaxSize)
+		_, err := sender.Write([]byte("one\n"))
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			fake.mutex.Lock()
+			defer fake.mutex.Unlock()
+			if fake.attempts == 0 {
+				return false
+			}
+			fake.fail = false
+			return true
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.NoError(t, sender.Close())
+		require.Equal(t, []string{"one"}, fake.logs)
+	})
+}
@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// startupScriptRetryDelay is how long the agent waits before running
+	// a failed startup script again.
+	startupScriptRetryDelay = time.Second
+	// startupScriptWaitDelay is how long the agent waits for the output of
+	// a startup script that timed out. Processes the script started can
+	// keep the output open after the script is killed.
+	startupScriptWaitDelay = 5 * time.Second
+	// startupScriptReportRetryInterval is how often the result of the
+	// startup script is sent again after sending it failed.
+	startupScriptReportRetryInterval = 10 * time.Second
+)
+
+var errStartupScriptTimedOut = xerrors.New("startup script timed out")
+
+// startupScriptPolicy returns the policy of the metadata, with the
+// defaults applied.
+func startupScriptPolicy(metadata codersdk.WorkspaceAgentMetadata) codersdk.WorkspaceAgentStartupScriptPolicy {
+	var policy codersdk.WorkspaceAgentStartupScriptPolicy
+	if metadata.StartupScriptPolicy != nil {
+		policy = *metadata.StartupScriptPolicy
+	}
+	if policy.TimeoutSeconds < 0 {
+		policy.TimeoutSeconds = 0
+	}
+	if policy.Retries < 0 {
+		policy.Retries = 0
+	}
+	if policy.FailurePolicy != codersdk.WorkspaceAgentStartupScriptFailurePolicyBlock {
+		policy.FailurePolicy = codersdk.WorkspaceAgentStartupScriptFailurePolicyWarn
+	}
+	return policy
+}
+
+// runStartupScriptAttempt runs the startup script once with its output
+// written to output.
+func (a *agent) runStartupScriptAttempt(ctx context.Context, script string, timeout time.Duration, output io.Writer) error {
+	attemptCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd, err := a.createCommand(attemptCtx, script, nil)
+	if err != nil {
+		return xerrors.Errorf("create command: %w", err)
+	}
+	// The output is detached when the agent stops waiting for it, so
+	// processes that outlive the script don't write to closed logs.
+	writer := &detachableWriter{writer: output}
+	defer writer.detach()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	err = cmd.Start()
+	if err != nil {
+		return xerrors.Errorf("start: %w", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- cmd.Wait()
+	}()
+	select {
+	case err = <-waitErr:
+	case <-attemptCtx.Done():
+		// The script is killed by the context, but waiting for it also
+		// waits for its output to be closed.
+		timer := time.NewTimer(startupScriptWaitDelay)
+		select {
+		case err = <-waitErr:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	// cmd.Wait does not return a context error, it returns "signal: killed".
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if attemptCtx.Err() != nil {
+		return xerrors.Errorf("killed after %s: %w", timeout, errStartupScriptTimedOut)
+	}
+	if err != nil {
+		return xerrors.Errorf("run: %w", err)
+	}
+	return nil
+}
+
+// detachableWriter writes to a writer until it's detached, and discards
+// writes afterwards.
+type detachableWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (w *detachableWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.writer == nil {
+		return len(p), nil
+	}
+	return w.writer.Write(p)
+}
+
+func (w *detachableWriter) detach() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writer = nil
+}
+
+// startupScriptState returns the state of a startup script that ended with
+// err.
+func startupScriptState(err error) codersdk.WorkspaceAgentStartupScriptState {
+	switch {
+	case err == nil:
+		return codersdk.WorkspaceAgentStartupScriptOK
+	case xerrors.Is(err, errStartupScriptTimedOut):
+		return codersdk.WorkspaceAgentStartupScriptTimedOut
+	default:
+		return codersdk.WorkspaceAgentStartupScriptFailed
+	}
+}
+
+// finishStartupScript stores how the startup script ended, and lets
+// sessions that wait for it start. The result of a rerun is sent to coderd
+// again once the first was sent.
+func (a *agent) finishStartupScript(ctx context.Context, result codersdk.WorkspaceAgentStartupScriptResult) {
+	a.setStartup(func(startup *codersdk.WorkspaceAgentStartupResponse) {
+		startup.Attempts = result.Attempts
+		startup.Result = result.State
+	})
+	a.startupScriptResult.Store(&result)
+	select {
+	case <-a.startupScriptDone:
+		if a.startupScriptReported.CompareAndSwap(true, false) {
+			a.goRun(ctx, "startup-script-result", func() {
+				a.reportStartupScriptResult(ctx)
+			})
+		}
+	default:
+		close(a.startupScriptDone)
+	}
+}
+
+// waitForStartupScript waits for the startup script to end when the
+// failure policy blocks sessions, and returns an error if it failed.
+func (a *agent) waitForStartupScript(ctx context.Context, progress io.Writer) error {
+	metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if startupScriptPolicy(metadata).FailurePolicy != codersdk.WorkspaceAgentStartupScriptFailurePolicyBlock {
+		return nil
+	}
+	select {
+	case <-a.startupScriptDone:
+	default:
+		_, _ = io.WriteString(progress, terminalMessage("Waiting for the startup script to finish..."))
+		select {
+		case <-a.startupScriptDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	result := a.startupScriptResult.Load()
+	if result.State == codersdk.WorkspaceAgentStartupScriptOK {
+		return nil
+	}
+	return codersdk.NewWorkspaceAgentError(codersdk.WorkspaceAgentErrorStartupScriptFailed,
+		xerrors.Errorf("startup script %s after %d attempts: %s", result.State, result.Attempts, result.Error))
+}
+
+// reportStartupScriptResult sends how the startup script ended to coderd
+// once, retrying until it's sent or the context is canceled.
+func (a *agent) reportStartupScriptResult(ctx context.Context) {
+	logger := a.logger.Named("startup-script")
+	select {
+	case <-ctx.Done():
+		return
+	case <-a.startupScriptDone:
+	}
+	for !a.startupScriptReported.Load() {
+		err := a.client.PostWorkspaceAgentStartupScriptResult(ctx, *a.startupScriptResult.Load())
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			a.startupScriptReported.Store(true)
+			return
+		}
+		logger.Warn(ctx, "send startup script result", slog.Error(err))
+		timer := time.NewTimer(startupScriptReportRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// startupScriptRetryMessage is written to the logs of the startup script
+// before it's run again.
+func startupScriptRetryMessage(attempt, attempts int, err error) string {
+	return fmt.Sprintf("\nStartup script attempt %d of %d failed: %s. Retrying...\n", attempt, attempts, err)
+}
+
+// startStartupScript runs the startup script of the metadata in the
+// background. Reruns run after the script changed in the metadata, and
+// wait for the previous run to end. They're skipped if the script didn't
+// change since it last ran.
+func (a *agent) startStartupScript(ctx context.Context, rerun bool) {
+	go func() {
+		defer a.recoverPanic(ctx, "startup-script")
+		a.startupScriptMutex.Lock()
+		defer a.startupScriptMutex.Unlock()
+		metadata, _ := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+		if rerun && metadata.StartupScript == a.lastStartupScript {
+			return
+		}
+		a.lastStartupScript = metadata.StartupScript
+		startedAt := time.Now()
+		a.setStartup(func(startup *codersdk.WorkspaceAgentStartupResponse) {
+			startup.State = codersdk.WorkspaceAgentStartupRunning
+			startup.StartedAt = &startedAt
+			startup.CompletedAt = nil
+			startup.Error = ""
+			startup.Diagnostics = nil
+		})
+		if rerun {
+			a.logger.Info(ctx, "running changed startup script")
+		}
+		var attempts int
+		err := a.waitForMounts(ctx, metadata.RequiredMounts)
+		if err == nil {
+			attempts, err = a.runStartupScript(ctx, metadata.StartupScript, startupScriptPolicy(metadata))
+		}
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		result := codersdk.WorkspaceAgentStartupScriptResult{
+			State:       startupScriptState(err),
+			Attempts:    int32(attempts),
+			StartedAt:   startedAt,
+			CompletedAt: time.Now(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		a.finishStartupScript(ctx, result)
+		if err != nil {
+			a.logger.Warn(ctx, "agent script failed", slog.Error(err))
+			a.timeline.record(codersdk.AgentEventStartupFailed, "Startup script failed: %s", err)
+			report := a.diagnose(ctx, metadata)
+			for _, diagnostic := range report.Diagnostics {
+				if diagnostic.Status == codersdk.WorkspaceAgentDiagnosticOK {
+					continue
+				}
+				a.logger.Warn(ctx, "startup diagnostic",
+					slog.F("name", diagnostic.Name),
+					slog.F("status", diagnostic.Status),
+					slog.F("message", diagnostic.Message),
+					slog.F("details", diagnostic.Details))
+			}
+			completedAt := time.Now()
+			if !rerun {
+				a.bootTimer.record(bootPhaseStartupScript, completedAt.Sub(startedAt))
+			}
+			a.setStartup(func(startup *codersdk.WorkspaceAgentStartupResponse) {
+				startup.State = codersdk.WorkspaceAgentStartupError
+				startup.CompletedAt = &completedAt
+				startup.Error = err.Error()
+				startup.Diagnostics = report
+			})
+			return
+		}
+		completedAt := time.Now()
+		if !rerun {
+			a.bootTimer.record(bootPhaseStartupScript, completedAt.Sub(startedAt))
+		}
+		a.setStartup(func(startup *codersdk.WorkspaceAgentStartupResponse) {
+			startup.State = codersdk.WorkspaceAgentStartupReady
+			startup.CompletedAt = &completedAt
+		})
+	}()
+}
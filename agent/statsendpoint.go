@@ -1,17 +1,19 @@
 package agent
 
 import (
+	"context"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/go-chi/chi"
+	"golang.org/x/crypto/ssh/knownhosts"
 
 	"github.com/coder/coder/coderd/httpapi"
 	"github.com/coder/coder/codersdk"
 )
 
-func (*agent) statisticsHandler() http.Handler {
+func (a *agent) statisticsHandler(ctx context.Context) http.Handler {
 	r := chi.NewRouter()
 	r.Get("/", func(rw http.ResponseWriter, r *http.Request) {
 		httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.Response{
@@ -19,8 +21,36 @@ func (*agent) statisticsHandler() http.Handler {
 		})
 	})
 
+	r.Get("/healthz", a.healthHandler)
+	r.Get("/debug/ready", a.readyHandler)
+	if a.pprof {
+		mountPprof(r)
+	}
+
 	lp := &listeningPortsHandler{}
 	r.Get("/api/v0/listening-ports", lp.handler)
+	r.Get("/api/v0/listening-ports/{port}", a.portListeningHandler)
+	r.Get("/api/v0/ssh-host-keys", a.sshHostKeysHandler)
+	r.Post("/api/v0/broadcast", a.broadcastHandler)
+	r.Get("/api/v0/transcripts", a.transcriptsHandler)
+	r.Get("/api/v0/transcripts/{id}", a.transcriptHandler)
+	r.Get("/api/v0/reverse-port-forwards", a.reverseForwardsHandler)
+	r.Get("/api/v0/quic", a.quicHandler)
+	r.Get("/api/v0/startup", a.startupHandler)
+	r.Post("/api/v0/reload", a.reloadHandler)
+	r.Get("/api/v0/sessions", a.sessionsHandler)
+	r.Delete("/api/v0/sessions/{id}", a.terminateSessionHandler)
+	r.Get("/api/v0/quick-actions", a.quickActionsHandler)
+	r.Post("/api/v0/quick-actions/{name}", a.runQuickActionHandler)
+	r.Post("/api/v0/app-token", a.appTokenHandler)
+	r.Get("/api/v0/reconnect", a.reconnectHandler)
+	r.Get("/api/v0/reconnecting-pty", a.reconnectingPTYsHandler)
+	r.Get("/api/v0/reconnecting-pty/{id}", a.reconnectingPTYWebSocketHandler(ctx))
+	r.Get("/api/v0/reconnecting-pty/{id}/participants", a.reconnectingPTYParticipantsHandler)
+	r.Delete("/api/v0/reconnecting-pty/{id}/participants/{participant}", a.revokeReconnectingPTYParticipantHandler)
+	r.Get("/api/v0/app-health-probes", a.appHealthProbes.handler)
+	r.Post("/api/v0/identity", a.identityHandler)
+	r.Post("/api/v0/quiesce", a.quiesceHandler)
 
 	return r
 }
@@ -47,3 +77,19 @@ func (lp *listeningPortsHandler) handler(rw http.ResponseWriter, r *http.Request
 		Ports: ports,
 	})
 }
+
+// sshHostKeysHandler returns the SSH host keys of the agent in known_hosts
+// format, so clients can enable strict host key checking.
+func (a *agent) sshHostKeysHandler(rw http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		host = codersdk.TailnetIP.String()
+	}
+	knownHosts := make([]string, 0, len(a.sshServer.HostSigners))
+	for _, signer := range a.sshServer.HostSigners {
+		knownHosts = append(knownHosts, knownhosts.Line([]string{host}, signer.PublicKey()))
+	}
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.SSHHostKeysResponse{
+		KnownHosts: knownHosts,
+	})
+}
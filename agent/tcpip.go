@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/coder/coder/tailnet"
+)
+
+// tcpipChannelData is the payload of "direct-tcpip" and "forwarded-tcpip"
+// channels.
+//
+// https://datatracker.ietf.org/doc/html/rfc4254#section-7.2
+type tcpipChannelData struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// directTCPIPHandler is a replacement for ssh.DirectTCPIPHandler that
+// dials both the IPv4 and IPv6 loopback addresses when forwarding to
+// localhost, since applications increasingly bind to only one of them.
+// Addresses are dialed as given, since other loopback addresses, like
+// 127.0.0.53, can be bound by other services. forwarded is called with the
+// destination when the channel is accepted, and the function it returns
+// when the forward closes.
+func directTCPIPHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context, forwarded func(destination string) func()) {
+	d := tcpipChannelData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	if srv.LocalPortForwardingCallback == nil || !srv.LocalPortForwardingCallback(ctx, d.DestAddr, d.DestPort) {
+		_ = newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	var (
+		dconn net.Conn
+		err   error
+	)
+	if d.DestAddr == "localhost" && d.DestPort <= 65535 {
+		dconn, err = tailnet.DialLoopback(ctx, uint16(d.DestPort), false)
+	} else {
+		var dialer net.Dialer
+		dconn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.DestAddr, strconv.FormatInt(int64(d.DestPort), 10)))
+	}
+	if err != nil {
+		_ = newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		_ = dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+	closed := forwarded(net.JoinHostPort(d.DestAddr, strconv.FormatInt(int64(d.DestPort), 10)))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer ch.Close()
+		defer dconn.Close()
+		_, _ = io.Copy(ch, dconn)
+	}()
+	go func() {
+		defer wg.Done()
+		defer ch.Close()
+		defer dconn.Close()
+		_, _ = io.Copy(dconn, ch)
+	}()
+	go func() {
+		wg.Wait()
+		closed()
+	}()
+}
@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"go.uber.org/atomic"
+
+	"github.com/coder/coder/codersdk"
+)
+
+// usageCounter counts the features of the agent that are used between
+// stats reports. Only counts are kept, so the report can't identify the
+// users, addresses or files involved.
+type usageCounter struct {
+	sftpSessions        atomic.Int64
+	portForwards        atomic.Int64
+	reversePortForwards atomic.Int64
+	speedtests          atomic.Int64
+	socksConnections    atomic.Int64
+}
+
+// collect returns the usage since the last call and resets the counts.
+func (u *usageCounter) collect() *codersdk.AgentUsage {
+	return &codersdk.AgentUsage{
+		SFTPSessions:        u.sftpSessions.Swap(0),
+		PortForwards:        u.portForwards.Swap(0),
+		ReversePortForwards: u.reversePortForwards.Swap(0),
+		Speedtests:          u.speedtests.Swap(0),
+		SOCKSConnections:    u.socksConnections.Swap(0),
+	}
+}
+
+// usageStats returns the feature usage to send with stats, or nil if telemetry
+// is disabled for the deployment. Counts are reset either way, so usage
+// from before telemetry was enabled isn't reported.
+func (a *agent) usageStats() *codersdk.AgentUsage {
+	usage := a.usage.collect()
+	metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if !ok || !metadata.TelemetryEnabled {
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// eventTimelineFile is where the events of the agent are kept in its
+	// temporary directory, one JSON object per line, so they survive
+	// restarts of the agent.
+	eventTimelineFile = "coder-agent-events.jsonl"
+	// maxTimelineEvents is how many of the latest events are kept.
+	maxTimelineEvents = 1000
+	// maxTimelineMessageSize limits the message of an event, like the
+	// value of a panic.
+	maxTimelineMessageSize = 4 << 10
+)
+
+// eventTimeline records the significant events of the agent to disk, so
+// what the agent experienced can be reconstructed after an incident even
+// when its logs didn't reach a central store. Events are appended to the
+// file, which is compacted to the latest events when it holds twice as
+// many, so it stays bounded without rewriting it for every event.
+type eventTimeline struct {
+	fs     afero.Fs
+	path   string
+	logger slog.Logger
+
+	mutex  sync.Mutex
+	events []codersdk.AgentEvent
+	// lines is the number of events in the file.
+	lines int
+	// cutOff is whether the last line of the file was cut off, so the
+	// next event starts on a new line.
+	cutOff bool
+}
+
+// newEventTimeline loads the events of previous agents from the file.
+func newEventTimeline(fs afero.Fs, path string, logger slog.Logger) *eventTimeline {
+	t := &eventTimeline{
+		fs:     fs,
+		path:   path,
+		logger: logger,
+	}
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn(context.Background(), "read event timeline", slog.F("path", path), slog.Error(err))
+		}
+		return t
+	}
+	t.cutOff = len(data) > 0 && data[len(data)-1] != '\n'
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		t.lines++
+		var event codersdk.AgentEvent
+		// A line that the agent was writing when it stopped can be cut
+		// off, and is skipped.
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		t.events = append(t.events, event)
+	}
+	if len(t.events) > maxTimelineEvents {
+		t.events = t.events[len(t.events)-maxTimelineEvents:]
+	}
+	return t
+}
+
+// last returns the latest event, or false if there are none.
+func (t *eventTimeline) last() (codersdk.AgentEvent, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.events) == 0 {
+		return codersdk.AgentEvent{}, false
+	}
+	return t.events[len(t.events)-1], true
+}
+
+// record adds an event to the timeline. Failing to write it is logged,
+// since the event is still kept in memory.
+func (t *eventTimeline) record(eventType codersdk.AgentEventType, format string, args ...any) {
+	event := codersdk.AgentEvent{
+		Time:    time.Now(),
+		Type:    eventType,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if len(event.Message) > maxTimelineMessageSize {
+		event.Message = event.Message[:maxTimelineMessageSize]
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.events = append(t.events, event)
+	if len(t.events) > maxTimelineEvents {
+		t.events = t.events[len(t.events)-maxTimelineEvents:]
+	}
+
+	var err error
+	if t.lines+1 > 2*maxTimelineEvents {
+		err = t.compactLocked()
+	} else {
+		err = t.appendLocked(event)
+	}
+	if err != nil {
+		t.logger.Warn(context.Background(), "write event timeline", slog.F("path", t.path), slog.Error(err))
+	}
+}
+
+func (t *eventTimeline) appendLocked(event codersdk.AgentEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if t.cutOff {
+		line = append([]byte{'\n'}, line...)
+	}
+	file, err := t.fs.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(line)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	t.cutOff = false
+	t.lines++
+	return nil
+}
+
+// compactLocked replaces the file with the events that are kept.
+func (t *eventTimeline) compactLocked() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range t.events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+	err := afero.WriteFile(t.fs, t.path+".tmp", buf.Bytes(), 0o600)
+	if err != nil {
+		return err
+	}
+	err = t.fs.Rename(t.path+".tmp", t.path)
+	if err != nil {
+		return err
+	}
+	t.lines = len(t.events)
+	t.cutOff = false
+	return nil
+}
+
+// list returns the latest events, oldest first. When limit is positive,
+// only that many are returned.
+func (t *eventTimeline) list(limit int) []codersdk.AgentEvent {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	events := t.events
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return append([]codersdk.AgentEvent{}, events...)
+}
+
+// recordStarted records that the agent started, and whether the previous
+// agent stopped without recording it, like when it crashed or was killed.
+func (t *eventTimeline) recordStarted(version string) {
+	last, ok := t.last()
+	if ok && last.Type != codersdk.AgentEventStopped {
+		t.record(codersdk.AgentEventStarted, "Agent %s started. The previous agent stopped unexpectedly after its last event at %s.",
+			version, last.Time.Format(time.RFC3339))
+		return
+	}
+	t.record(codersdk.AgentEventStarted, "Agent %s started.", version)
+}
+
+func (a *agent) eventsHandler(rw http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 0 {
+		limit = 0
+	}
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.AgentEventsResponse{
+		Events: a.timeline.list(limit),
+	})
+}
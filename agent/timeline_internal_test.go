@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+)
+
+func TestEventTimeline(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Restarts", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		logger := slogtest.Make(t, nil)
+
+		timeline := newEventTimeline(fs, "/tmp/events.jsonl", logger)
+		timeline.recordStarted("v1")
+		timeline.record(codersdk.AgentEventConnected, "Connected to Coder.")
+		timeline.record(codersdk.AgentEventStopped, "Agent stopped.")
+
+		// The next agent loads the events, and starts cleanly.
+		timeline = newEventTimeline(fs, "/tmp/events.jsonl", logger)
+		require.Len(t, timeline.list(0), 3)
+		timeline.recordStarted("v2")
+		events := timeline.list(1)
+		require.Len(t, events, 1)
+		require.Equal(t, "Agent v2 started.", events[0].Message)
+
+		// An agent that didn't record stopping stopped unexpectedly.
+		timeline = newEventTimeline(fs, "/tmp/events.jsonl", logger)
+		timeline.recordStarted("v3")
+		events = timeline.list(0)
+		require.Len(t, events, 5)
+		require.Equal(t, codersdk.AgentEventStarted, events[4].Type)
+		require.Contains(t, events[4].Message, "The previous agent stopped unexpectedly")
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		logger := slogtest.Make(t, nil)
+
+		timeline := newEventTimeline(fs, "/tmp/events.jsonl", logger)
+		for i := 0; i < 3*maxTimelineEvents; i++ {
+			timeline.record(codersdk.AgentEventConnected, "Connected %d.", i)
+		}
+		events := timeline.list(0)
+		require.Len(t, events, maxTimelineEvents)
+		require.Equal(t, "Connected 2999.", events[len(events)-1].Message)
+
+		data, err := afero.ReadFile(fs, "/tmp/events.jsonl")
+		require.NoError(t, err)
+		require.LessOrEqual(t, strings.Count(string(data), "\n"), 2*maxTimelineEvents)
+	})
+
+	t.Run("CutOff", func(t *testing.T) {
+		t.Parallel()
+		fs := afero.NewMemMapFs()
+		logger := slogtest.Make(t, nil)
+
+		timeline := newEventTimeline(fs, "/tmp/events.jsonl", logger)
+		timeline.record(codersdk.AgentEventConnected, "Connected to Coder.")
+		// The agent stopped while writing an event.
+		file, err := fs.OpenFile("/tmp/events.jsonl", os.O_APPEND|os.O_WRONLY, 0o600)
+		require.NoError(t, err)
+		_, err = file.WriteString(`{"time":"2023-`)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		timeline = newEventTimeline(fs, "/tmp/events.jsonl", logger)
+		require.Len(t, timeline.list(0), 1)
+
+		// Events after the line that was cut off are kept.
+		timeline.record(codersdk.AgentEventDisconnected, "Disconnected from Coder.")
+		timeline = newEventTimeline(fs, "/tmp/events.jsonl", logger)
+		events := timeline.list(0)
+		require.Len(t, events, 2)
+		require.Equal(t, codersdk.AgentEventConnected, events[0].Type)
+		require.Equal(t, codersdk.AgentEventDisconnected, events[1].Type)
+	})
+}
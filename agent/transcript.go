@@ -0,0 +1,280 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	defaultMaxTranscriptBytes  = 10 << 20
+	defaultMaxTranscripts      = 100
+	defaultTranscriptRetention = 7 * 24 * time.Hour
+
+	transcriptExtension = ".cast"
+)
+
+// asciicastHeader is the first line of an asciicast v2 file.
+//
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// transcriptRecorder records terminal output to a transcript in asciicast
+// format. All methods are safe to call on a nil recorder, which is returned
+// when session recording is disabled.
+type transcriptRecorder struct {
+	mutex     sync.Mutex
+	file      afero.File
+	startedAt time.Time
+	size      int64
+	maxSize   int64
+	closed    bool
+}
+
+func (a *agent) transcriptDir() string {
+	return filepath.Join(a.tempDir, "coder-transcripts")
+}
+
+// recordSession starts recording a transcript for the session if session
+// recording is enabled, and removes transcripts past their retention.
+func (a *agent) recordSession(ctx context.Context, id string, width, height uint16, term string) *transcriptRecorder {
+	metadata, ok := a.metadata.Load().(codersdk.WorkspaceAgentMetadata)
+	if !ok || metadata.SessionRecording == nil {
+		return nil
+	}
+	options := *metadata.SessionRecording
+	if options.MaxTranscriptBytes <= 0 {
+		options.MaxTranscriptBytes = defaultMaxTranscriptBytes
+	}
+
+	err := a.filesystem.MkdirAll(a.transcriptDir(), 0o700)
+	if err != nil {
+		a.logger.Warn(ctx, "create transcript directory", slog.Error(err))
+		return nil
+	}
+	err = a.pruneTranscripts(options)
+	if err != nil {
+		a.logger.Warn(ctx, "prune transcripts", slog.Error(err))
+	}
+
+	// Reconnecting PTYs that are created again keep their ID, and their
+	// transcript starts over, since a file only holds one recording.
+	file, err := a.filesystem.OpenFile(filepath.Join(a.transcriptDir(), id+transcriptExtension), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		a.logger.Warn(ctx, "create transcript", slog.F("id", id), slog.Error(err))
+		return nil
+	}
+	recorder := &transcriptRecorder{
+		file:      file,
+		startedAt: time.Now(),
+		maxSize:   options.MaxTranscriptBytes,
+	}
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: recorder.startedAt.Unix(),
+		Env: map[string]string{
+			"TERM": term,
+		},
+	})
+	if err == nil {
+		err = recorder.writeLine(header)
+	}
+	if err != nil {
+		a.logger.Warn(ctx, "write transcript header", slog.F("id", id), slog.Error(err))
+		_ = recorder.Close()
+		return nil
+	}
+	return recorder
+}
+
+// Write records output from the terminal. It never returns an error, so
+// a failing transcript doesn't interrupt the session it's recording.
+func (r *transcriptRecorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	event, err := json.Marshal([]interface{}{
+		time.Since(r.startedAt).Seconds(),
+		"o",
+		string(p),
+	})
+	if err != nil {
+		return len(p), nil
+	}
+	_ = r.writeLine(event)
+	return len(p), nil
+}
+
+func (r *transcriptRecorder) writeLine(line []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return xerrors.New("closed")
+	}
+	// Output past the cap isn't recorded.
+	if r.size+int64(len(line))+1 > r.maxSize {
+		return xerrors.New("transcript size limit reached")
+	}
+	n, err := r.file.Write(append(line, '\n'))
+	r.size += int64(n)
+	return err
+}
+
+func (r *transcriptRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.file.Close()
+}
+
+// pruneTranscripts removes transcripts that are past their retention, and
+// the oldest transcripts beyond the maximum number retained.
+func (a *agent) pruneTranscripts(options codersdk.WorkspaceAgentSessionRecording) error {
+	retention := time.Duration(options.RetentionSeconds) * time.Second
+	if retention <= 0 {
+		retention = defaultTranscriptRetention
+	}
+	maxTranscripts := options.MaxTranscripts
+	if maxTranscripts <= 0 {
+		maxTranscripts = defaultMaxTranscripts
+	}
+
+	transcripts, err := a.listTranscripts()
+	if err != nil {
+		return err
+	}
+	for i, transcript := range transcripts {
+		// Leave room for the transcript that's about to be created.
+		if time.Since(transcript.UpdatedAt) < retention && len(transcripts)-i < maxTranscripts {
+			continue
+		}
+		err = a.filesystem.Remove(filepath.Join(a.transcriptDir(), transcript.ID+transcriptExtension))
+		if err != nil {
+			return xerrors.Errorf("remove transcript %q: %w", transcript.ID, err)
+		}
+	}
+	return nil
+}
+
+// listTranscripts returns the recorded transcripts from oldest to newest.
+func (a *agent) listTranscripts() ([]codersdk.SessionTranscript, error) {
+	infos, err := afero.ReadDir(a.filesystem, a.transcriptDir())
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			return []codersdk.SessionTranscript{}, nil
+		}
+		return nil, xerrors.Errorf("read transcript directory: %w", err)
+	}
+	transcripts := make([]codersdk.SessionTranscript, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), transcriptExtension) {
+			continue
+		}
+		id := strings.TrimSuffix(info.Name(), transcriptExtension)
+		transcript := codersdk.SessionTranscript{
+			ID:        id,
+			CreatedAt: info.ModTime(),
+			UpdatedAt: info.ModTime(),
+			Size:      info.Size(),
+		}
+		header, err := a.readTranscriptHeader(id)
+		if err == nil {
+			transcript.CreatedAt = time.Unix(header.Timestamp, 0)
+		}
+		transcripts = append(transcripts, transcript)
+	}
+	sort.Slice(transcripts, func(i, j int) bool {
+		return transcripts[i].UpdatedAt.Before(transcripts[j].UpdatedAt)
+	})
+	return transcripts, nil
+}
+
+func (a *agent) readTranscriptHeader(id string) (asciicastHeader, error) {
+	file, err := a.filesystem.Open(filepath.Join(a.transcriptDir(), id+transcriptExtension))
+	if err != nil {
+		return asciicastHeader{}, err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return asciicastHeader{}, err
+	}
+	var header asciicastHeader
+	return header, json.Unmarshal(line, &header)
+}
+
+func (a *agent) transcriptsHandler(rw http.ResponseWriter, r *http.Request) {
+	transcripts, err := a.listTranscripts()
+	if err != nil {
+		httpapi.Write(r.Context(), rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Could not list transcripts.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(r.Context(), rw, http.StatusOK, codersdk.SessionTranscriptsResponse{
+		Transcripts: transcripts,
+	})
+}
+
+func (a *agent) transcriptHandler(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	// Transcripts are always named by a UUID, which prevents
+	// reading arbitrary files with the ID.
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid transcript ID.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	file, err := a.filesystem.Open(filepath.Join(a.transcriptDir(), id.String()+transcriptExtension))
+	if err != nil {
+		if xerrors.Is(err, os.ErrNotExist) {
+			httpapi.ResourceNotFound(rw)
+			return
+		}
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Could not open transcript.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	defer file.Close()
+	rw.Header().Set("Content-Type", codersdk.ContentTypeAsciicast)
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(rw, file)
+}
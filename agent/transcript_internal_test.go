@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/codersdk"
+)
+
+func TestRecordSessionAgain(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	a := &agent{
+		logger:     slogtest.Make(t, nil),
+		filesystem: afero.NewMemMapFs(),
+		tempDir:    "/tmp",
+	}
+	a.metadata.Store(codersdk.WorkspaceAgentMetadata{
+		SessionRecording: &codersdk.WorkspaceAgentSessionRecording{
+			MaxTranscriptBytes: 1 << 10,
+		},
+	})
+	id := uuid.NewString()
+	for _, output := range []string{"first", "second"} {
+		recorder := a.recordSession(ctx, id, 80, 24, "xterm")
+		require.NotNil(t, recorder)
+		_, _ = recorder.Write([]byte(output))
+		require.NoError(t, recorder.Close())
+	}
+
+	// A PTY that's created again with the same ID starts its transcript
+	// over, so the file is a single valid recording.
+	transcript, err := afero.ReadFile(a.filesystem, filepath.Join(a.transcriptDir(), id+transcriptExtension))
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(transcript, []byte("\n")))
+	require.NotContains(t, string(transcript), "first")
+	require.Contains(t, string(transcript), "second")
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// sessionUsage is the resources consumed by the process tree of a session.
+// It includes descendants of the session process that were waited for,
+// which is every descendant of a shell that exits cleanly.
+type sessionUsage struct {
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSS is the peak resident set size of the largest process in
+	// the tree in bytes, or zero if it's unsupported on the platform.
+	MaxRSS int64
+}
+
+// processUsage returns the resource usage of an exited process. It
+// returns false if the process hasn't been waited for.
+func processUsage(state *os.ProcessState) (sessionUsage, bool) {
+	if state == nil {
+		return sessionUsage{}, false
+	}
+	return sessionUsage{
+		UserTime:   state.UserTime(),
+		SystemTime: state.SystemTime(),
+		MaxRSS:     maxRSS(state),
+	}, true
+}
+
+// logSessionEnd records the end of a session with a summary of the
+// resources it consumed, so usage can be attributed to users and
+// automations.
+func (a *agent) logSessionEnd(ctx context.Context, sessionType, id string, cmd *exec.Cmd, started time.Time, err error, fields ...slog.Field) {
+	fields = append(fields,
+		slog.F("session_type", sessionType),
+		slog.F("session_id", id),
+		slog.F("duration", time.Since(started)),
+	)
+	if cmd != nil && len(cmd.Args) > 0 {
+		fields = append(fields, slog.F("command", cmd.Args[len(cmd.Args)-1]))
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		fields = append(fields, slog.F("exit_code", 0))
+	case xerrors.As(err, &exitErr):
+		fields = append(fields, slog.F("exit_code", exitErr.ExitCode()))
+	default:
+		fields = append(fields, slog.Error(err))
+	}
+	if cmd != nil {
+		if usage, ok := processUsage(cmd.ProcessState); ok {
+			fields = append(fields,
+				slog.F("cpu_user", usage.UserTime),
+				slog.F("cpu_system", usage.SystemTime),
+				slog.F("max_rss_bytes", usage.MaxRSS),
+			)
+		}
+	}
+	a.logger.Named("audit").Info(ctx, "session ended", fields...)
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+func maxRSS(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// macOS reports bytes, while other platforms report kilobytes.
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss)
+	}
+	return int64(rusage.Maxrss) * 1024
+}
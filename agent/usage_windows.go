@@ -0,0 +1,9 @@
+package agent
+
+import "os"
+
+// maxRSS is unsupported on Windows, since the peak working set
+// isn't included in the usage of a process.
+func maxRSS(*os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"cdr.dev/slog"
+)
+
+// userNamespace describes the user namespace the agent runs in.
+type userNamespace struct {
+	// Nested is whether the agent runs in a user namespace other than the
+	// initial one, like in rootless containers.
+	Nested bool
+	// Rootless is whether root in the namespace is an unprivileged user of
+	// the host. Operations that require root on the host, like changing
+	// the owner of files to unmapped users, fail even though the agent
+	// appears to run as root.
+	Rootless bool
+}
+
+// detectUserNamespace reads the UID mapping of the agent's user namespace.
+// It's only available on Linux, so other platforms are never nested.
+func detectUserNamespace(filesystem afero.Fs) userNamespace {
+	content, err := afero.ReadFile(filesystem, "/proc/self/uid_map")
+	if err != nil {
+		return userNamespace{}
+	}
+	return parseUIDMap(string(content))
+}
+
+// parseUIDMap parses /proc/self/uid_map, where each line maps a range of
+// UIDs in the namespace to the parent namespace, as "<inside> <outside>
+// <count>". The initial namespace maps every UID to itself.
+func parseUIDMap(content string) userNamespace {
+	var ns userNamespace
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	lines := 0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		inside, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		outside, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		lines++
+		if inside != 0 || outside != 0 || count != 4294967295 {
+			ns.Nested = true
+		}
+		if inside == 0 && outside != 0 {
+			ns.Rootless = true
+		}
+	}
+	if lines == 0 {
+		return userNamespace{}
+	}
+	return ns
+}
+
+// logUserNamespace logs the user namespace of the agent at startup, so
+// permission errors of root in rootless containers can be explained.
+func (a *agent) logUserNamespace(ctx context.Context) {
+	if !a.userNamespace.Nested {
+		return
+	}
+	a.logger.Info(ctx, "running in a user namespace", slog.F("rootless", a.userNamespace.Rootless))
+}
+
+// currentUser returns the user the agent runs as. Containers often run as
+// a UID that isn't in /etc/passwd, like rootless containers with arbitrary
+// UIDs, where user.Current fails. The user is then described by the
+// environment, like OpenSSH does, and found is false.
+func currentUser() (u *user.User, found bool) {
+	u, err := user.Current()
+	if err == nil {
+		return u, true
+	}
+	uid := strconv.Itoa(os.Getuid())
+	u = &user.User{
+		Uid:      uid,
+		Gid:      strconv.Itoa(os.Getgid()),
+		Username: os.Getenv("USER"),
+		HomeDir:  os.Getenv("HOME"),
+	}
+	if u.Username == "" {
+		u.Username = uid
+	}
+	if u.HomeDir == "" {
+		u.HomeDir = "/"
+	}
+	return u, false
+}
+
+// fallbackShell is the shell of a user that isn't in /etc/passwd.
+func fallbackShell() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return shell
+}
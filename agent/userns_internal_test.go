@@ -0,0 +1,46 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUIDMap(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		content string
+		ns      userNamespace
+	}{{
+		name:    "Initial",
+		content: "         0          0 4294967295\n",
+		ns:      userNamespace{},
+	}, {
+		name:    "Rootless",
+		content: "         0       1000          1\n         1     100000      65536\n",
+		ns:      userNamespace{Nested: true, Rootless: true},
+	}, {
+		// Root of the host is mapped, e.g. by a privileged container
+		// runtime that remaps the other UIDs.
+		name:    "RootMapped",
+		content: "         0          0          1\n",
+		ns:      userNamespace{Nested: true},
+	}, {
+		name:    "RootUnmapped",
+		content: "      1000       1000          1\n",
+		ns:      userNamespace{Nested: true},
+	}, {
+		name:    "Empty",
+		content: "",
+		ns:      userNamespace{},
+	}}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, c.ns, parseUIDMap(c.content))
+		})
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserNamespace(t *testing.T) {
+	t.Parallel()
+
+	// The UID map is read in a new user namespace where the current
+	// user is root, like in a rootless container.
+	cmd := exec.Command("cat", "/proc/self/uid_map")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{
+			ContainerID: 0,
+			HostID:      os.Getuid(),
+			Size:        1,
+		}},
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		t.Skipf("user namespaces aren't available: %s", err)
+	}
+	ns := parseUIDMap(string(output))
+	require.True(t, ns.Nested)
+	require.Equal(t, os.Getuid() != 0, ns.Rootless)
+
+	// The namespace of the agent is detected the same way.
+	content, err := os.ReadFile("/proc/self/uid_map")
+	require.NoError(t, err)
+	require.Equal(t, parseUIDMap(string(content)), detectUserNamespace(afero.NewOsFs()))
+}
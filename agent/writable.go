@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+)
+
+// checkWritable returns an error if files can't be created in a directory,
+// which is the case for containers with a read-only root filesystem.
+func checkWritable(filesystem afero.Fs, dir string) error {
+	file, err := afero.TempFile(filesystem, dir, ".coder-write-check")
+	if err != nil {
+		return xerrors.Errorf("create file in %q: %w", dir, err)
+	}
+	_ = file.Close()
+	_ = filesystem.Remove(file.Name())
+	return nil
+}
+
+// explainWriteError adds how to redirect a write to an error, if the write
+// failed because the file system is read-only.
+func explainWriteError(err error, env string) error {
+	if errors.Is(err, syscall.EROFS) {
+		return xerrors.Errorf("%w (the file system is read-only, set %s to a writable directory, e.g. an emptyDir volume)", err, env)
+	}
+	return err
+}
+
+// checkTempDir logs how to redirect the files of the agent when its
+// temporary directory isn't writable. The agent still runs, but startup
+// script logs, app tokens and session recordings can't be written.
+func (a *agent) checkTempDir(ctx context.Context) {
+	// A configured directory may be a subdirectory of a volume.
+	err := a.filesystem.MkdirAll(a.tempDir, 0o700)
+	if err == nil {
+		err = checkWritable(a.filesystem, a.tempDir)
+	}
+	if err != nil {
+		a.logger.Warn(ctx, "temporary directory isn't writable, set CODER_AGENT_TEMP_DIR to a writable directory",
+			slog.F("temp_dir", a.tempDir), slog.Error(err))
+	}
+}
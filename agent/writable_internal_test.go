@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestCheckWritable(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Writable", func(t *testing.T) {
+		t.Parallel()
+		filesystem := afero.NewMemMapFs()
+		require.NoError(t, filesystem.MkdirAll("/tmp", 0o700))
+		require.NoError(t, checkWritable(filesystem, "/tmp"))
+		// The file created by the check is removed.
+		entries, err := afero.ReadDir(filesystem, "/tmp")
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		t.Parallel()
+		filesystem := afero.NewMemMapFs()
+		require.NoError(t, filesystem.MkdirAll("/tmp", 0o700))
+		require.Error(t, checkWritable(afero.NewReadOnlyFs(filesystem), "/tmp"))
+	})
+}
+
+func TestExplainWriteError(t *testing.T) {
+	t.Parallel()
+
+	err := explainWriteError(&os.PathError{Op: "open", Path: "/tmp/coder-app-tokens", Err: syscall.EROFS}, "CODER_AGENT_TEMP_DIR")
+	require.ErrorIs(t, err, syscall.EROFS)
+	require.ErrorContains(t, err, "set CODER_AGENT_TEMP_DIR to a writable directory")
+
+	err = xerrors.New("disk full")
+	require.Equal(t, err, explainWriteError(err, "CODER_AGENT_TEMP_DIR"))
+}
@@ -3,15 +3,18 @@ package cli
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"golang.org/x/xerrors"
 	"gopkg.in/natefinch/lumberjack.v2"
@@ -19,6 +22,7 @@ import (
 	"cdr.dev/slog"
 	"cdr.dev/slog/sloggers/sloghuman"
 	"github.com/coder/coder/agent"
+	"github.com/coder/coder/agent/agentdns"
 	"github.com/coder/coder/agent/reaper"
 	"github.com/coder/coder/buildinfo"
 	"github.com/coder/coder/cli/cliflag"
@@ -27,9 +31,38 @@ import (
 
 func workspaceAgent() *cobra.Command {
 	var (
-		auth         string
-		pprofAddress string
-		noReap       bool
+		auth              string
+		pprofAddress      string
+		noReap            bool
+		setHostname       bool
+		startupLogMaxSize int
+		provisionHomeDir  bool
+		homeSkeletonDir   string
+		environmentFile   string
+		envPassthrough    []string
+		sessionTmpQuota   int
+		reconnectMin      time.Duration
+		reconnectMax      time.Duration
+		tempDir           string
+		logDir            string
+		noVSCodeGitAuth   bool
+		hardenedHost      bool
+		prewarmSessions   bool
+		prewarmShells     int
+		tailnetPprof      bool
+		dnsServers        []string
+		sftpReadOnly      bool
+		sftpAllowedPaths  []string
+		sshHostKeyFile    string
+		recordingDir      string
+		ptyRetention      time.Duration
+		ptyBufferSize     int
+		ptyScrollback     int
+		namedPTYTimeout   time.Duration
+		drainTimeout      time.Duration
+		maxListenerConns  int
+		controlSocket     string
+		embeddedDERP      codersdk.WorkspaceAgentEmbeddedDERP
 	)
 	cmd := &cobra.Command{
 		Use: "agent",
@@ -48,12 +81,28 @@ func workspaceAgent() *cobra.Command {
 				return xerrors.Errorf("parse %q: %w", rawURL, err)
 			}
 
+			if logDir == "" {
+				logDir = os.TempDir()
+			}
 			logWriter := &lumberjack.Logger{
-				Filename: filepath.Join(os.TempDir(), "coder-agent.log"),
+				Filename: filepath.Join(logDir, "coder-agent.log"),
 				MaxSize:  5, // MB
 			}
 			defer logWriter.Close()
-			logger := slog.Make(sloghuman.Sink(cmd.ErrOrStderr()), sloghuman.Sink(logWriter)).Leveled(slog.LevelDebug)
+			sinks := []slog.Sink{sloghuman.Sink(cmd.ErrOrStderr())}
+			// The log file is optional, so the agent can run with a
+			// read-only root filesystem and log to stderr only.
+			logFileErr := checkLogDir(logDir)
+			var agentLogFile string
+			if logFileErr == nil {
+				sinks = append(sinks, sloghuman.Sink(logWriter))
+				agentLogFile = logWriter.Filename
+			}
+			logger := slog.Make(sinks...).Leveled(slog.LevelDebug)
+			if logFileErr != nil {
+				logger.Warn(ctx, "log directory isn't writable, set CODER_AGENT_LOG_DIR to a writable directory to keep a log file",
+					slog.F("log_dir", logDir), slog.Error(logFileErr))
+			}
 
 			isLinux := runtime.GOOS == "linux"
 
@@ -83,6 +132,33 @@ func workspaceAgent() *cobra.Command {
 			client := codersdk.New(coderURL)
 			// Set a reasonable timeout so requests can't hang forever!
 			client.HTTPClient.Timeout = 10 * time.Second
+			// The workspace resolver may be broken while Coder is still
+			// reachable, so it can be bypassed for the agent's requests.
+			var resolver *net.Resolver
+			if len(dnsServers) > 0 {
+				resolver, err = agentdns.NewResolver(dnsServers)
+				if err != nil {
+					return xerrors.Errorf("create dns resolver: %w", err)
+				}
+				client.HTTPClient.Transport = agentdns.Transport(resolver)
+				logger.Info(ctx, "resolving hostnames with dns servers", slog.F("servers", dnsServers))
+			}
+
+			var embeddedDERPOptions *codersdk.WorkspaceAgentEmbeddedDERP
+			if embeddedDERP.ListenAddress != "" {
+				if embeddedDERP.HostName == "" || embeddedDERP.RegionID <= 0 {
+					return xerrors.New("CODER_AGENT_EMBEDDED_DERP_HOSTNAME and CODER_AGENT_EMBEDDED_DERP_REGION_ID must be set with CODER_AGENT_EMBEDDED_DERP_ADDRESS")
+				}
+				embeddedDERPOptions = &embeddedDERP
+			}
+
+			var sftpPolicy *codersdk.WorkspaceAgentSFTP
+			if sftpReadOnly || len(sftpAllowedPaths) > 0 {
+				sftpPolicy = &codersdk.WorkspaceAgentSFTP{
+					ReadOnly:     sftpReadOnly,
+					AllowedPaths: sftpAllowedPaths,
+				}
+			}
 
 			// Enable pprof handler
 			// This prevents the pprof import from being accidentally deleted.
@@ -151,7 +227,18 @@ func workspaceAgent() *cobra.Command {
 				return xerrors.Errorf("add executable to $PATH: %w", err)
 			}
 
-			closer := agent.New(agent.Options{
+			var sessionRecorder agent.SessionRecorder
+			if recordingDir != "" {
+				sessionRecorder = agent.NewAsciicastRecorder(logger.Named("recorder"), afero.NewOsFs(), recordingDir)
+			}
+
+			// The agent defaults a zero retention, but the flag disables
+			// persisting reconnecting PTYs with it.
+			if ptyRetention == 0 {
+				ptyRetention = -1
+			}
+
+			agnt := agent.New(agent.Options{
 				Client: client,
 				Logger: logger,
 				ExchangeToken: func(ctx context.Context) (string, error) {
@@ -168,14 +255,115 @@ func workspaceAgent() *cobra.Command {
 				EnvironmentVariables: map[string]string{
 					"GIT_ASKPASS": executablePath,
 				},
+				SetHostname:          setHostname,
+				CoderURL:             client.URL,
+				StartupLogMaxSize:    int64(startupLogMaxSize),
+				ProvisionHomeDir:     provisionHomeDir,
+				HomeSkeletonDir:      homeSkeletonDir,
+				EnvironmentFile:      environmentFile,
+				SessionTempDirQuota:  int64(sessionTmpQuota),
+				ReconnectMinInterval: reconnectMin,
+				ReconnectMaxInterval: reconnectMax,
+				TempDir:              tempDir,
+				DisableVSCodeGitAuth: noVSCodeGitAuth,
+				HardenedHost:         hardenedHost,
+				PrewarmSessions:      prewarmSessions,
+				PrewarmShells:        prewarmShells,
+				Pprof:                tailnetPprof,
+				Resolver:             resolver,
+				SSHHostKeyFile:       sshHostKeyFile,
+				SessionRecorder:      sessionRecorder,
+				PTYRetention:         ptyRetention,
+				// Closing the log file makes the next write reopen it,
+				// in case it was moved by logrotate.
+				ReopenLogs:                     logWriter.Close,
+				ReconnectingPTYBufferSize:      ptyBufferSize,
+				ReconnectingPTYScrollbackLimit: ptyScrollback,
+				NamedReconnectingPTYTimeout:    namedPTYTimeout,
+				SFTP:                           sftpPolicy,
+				MaxListenerConnections:         maxListenerConns,
+				ControlSocketPath:              controlSocket,
+				AgentLogFile:                   agentLogFile,
+				EnvironmentPassthrough:         envPassthrough,
+				EmbeddedDERP:                   embeddedDERPOptions,
 			})
-			<-ctx.Done()
-			return closer.Close()
+
+			// The agent reloads on SIGHUP, like other daemons.
+			reload := make(chan os.Signal, 1)
+			if len(ReloadSignals) > 0 {
+				signal.Notify(reload, ReloadSignals...)
+				defer signal.Stop(reload)
+			}
+			for {
+				select {
+				case <-ctx.Done():
+					if drainTimeout <= 0 {
+						return agnt.Close()
+					}
+					// The context is canceled, so draining gets its own.
+					drainCtx, drainCancel := context.WithTimeout(context.Background(), drainTimeout)
+					defer drainCancel()
+					return agnt.CloseWithTimeout(drainCtx)
+				case <-reload:
+					err := agnt.Reload(ctx)
+					if err != nil {
+						logger.Error(ctx, "reload agent", slog.Error(err))
+					}
+				}
+			}
 		},
 	}
 
 	cliflag.StringVarP(cmd.Flags(), &auth, "auth", "", "CODER_AGENT_AUTH", "token", "Specify the authentication type to use for the agent")
 	cliflag.BoolVarP(cmd.Flags(), &noReap, "no-reap", "", "", false, "Do not start a process reaper.")
+	cliflag.BoolVarP(cmd.Flags(), &setHostname, "set-hostname", "", "CODER_AGENT_SET_HOSTNAME", false, "Set the hostname of the workspace to \"<workspace>-<agent>\" on startup.")
 	cliflag.StringVarP(cmd.Flags(), &pprofAddress, "pprof-address", "", "CODER_AGENT_PPROF_ADDRESS", "127.0.0.1:6060", "The address to serve pprof.")
+	cliflag.BoolVarP(cmd.Flags(), &tailnetPprof, "tailnet-pprof", "", "CODER_AGENT_TAILNET_PPROF", false, "Serve the profiles of pprof under /debug/pprof on the statistics server of the agent, which is reachable over tailnet, to profile agents that use too much CPU or leak memory.")
+	cliflag.BoolVarP(cmd.Flags(), &provisionHomeDir, "provision-home-dir", "", "CODER_AGENT_PROVISION_HOME_DIR", false, "Create the home directory if it doesn't exist, and copy skeleton files into it if it's empty, before sessions and the startup script run.")
+	cliflag.StringVarP(cmd.Flags(), &homeSkeletonDir, "home-skeleton-dir", "", "CODER_AGENT_HOME_SKELETON_DIR", "/etc/skel", "The directory of skeleton files copied into a provisioned home directory.")
+	cliflag.StringVarP(cmd.Flags(), &environmentFile, "env-file", "", "CODER_AGENT_ENV_FILE", "", "A file of KEY=VALUE lines that override the environment variables of sessions. It's read again when the agent receives SIGHUP.")
+	cliflag.StringArrayVarP(cmd.Flags(), &envPassthrough, "env-passthrough", "", "CODER_AGENT_ENV_PASSTHROUGH", nil, "Patterns of the environment variables of the agent that sessions inherit, like AWS_*. PATH, HOME, SHELL, LOGNAME, LANG, LC_* and TZ are always inherited. Sessions inherit every variable if none are set.")
+	cliflag.IntVarP(cmd.Flags(), &sessionTmpQuota, "session-tmp-quota", "", "CODER_AGENT_SESSION_TMP_QUOTA", 1<<30, "The maximum total size of the per-session temporary directories in bytes. Sessions started while it's exceeded use the default temporary directory. Set to a negative value to disable the quota.")
+	cliflag.DurationVarP(cmd.Flags(), &reconnectMin, "reconnect-min-interval", "", "CODER_AGENT_RECONNECT_MIN_INTERVAL", 100*time.Millisecond, "The minimum interval between attempts to reconnect to Coder.")
+	cliflag.DurationVarP(cmd.Flags(), &reconnectMax, "reconnect-max-interval", "", "CODER_AGENT_RECONNECT_MAX_INTERVAL", 10*time.Second, "The maximum interval between attempts to reconnect to Coder. Attempts are randomized up to an exponentially increasing interval. The interval configured by the deployment overrides it.")
+	cliflag.StringVarP(cmd.Flags(), &tempDir, "temp-dir", "", "CODER_AGENT_TEMP_DIR", "", "The directory the agent writes startup script logs, app tokens and session files to. Defaults to the system temporary directory. Set it to a writable volume when the root filesystem is read-only.")
+	cliflag.StringVarP(cmd.Flags(), &logDir, "log-dir", "", "CODER_AGENT_LOG_DIR", "", "The directory of the agent log file. Defaults to the system temporary directory. The agent only logs to stderr if it isn't writable.")
+	cliflag.BoolVarP(cmd.Flags(), &hardenedHost, "hardened-host", "", "CODER_AGENT_HARDENED_HOST", false, "Avoid operations that SELinux and AppArmor policies commonly deny, like allocating PTYs and setting the hostname. Sessions use virtual PTYs without line editing.")
+	cliflag.BoolVarP(cmd.Flags(), &prewarmSessions, "prewarm-sessions", "", "CODER_AGENT_PREWARM_SESSIONS", false, "Compute the shell and environment of sessions when the metadata changes, rather than when the next session starts, so editors like VS Code that open many sessions start them faster.")
+	cliflag.IntVarP(cmd.Flags(), &prewarmShells, "prewarm-shells", "", "CODER_AGENT_PREWARM_SHELLS", 0, "How many shells of the user to keep running ahead of sessions, which run the commands of sessions without a terminal so they start faster. Only POSIX shells are prewarmed.")
+	cliflag.BoolVarP(cmd.Flags(), &noVSCodeGitAuth, "disable-vscode-git-auth", "", "CODER_AGENT_DISABLE_VSCODE_GIT_AUTH", false, "Don't write the VS Code settings that make it use Git authentication from Coder, e.g. when the home directory is read-only.")
+	cliflag.StringVarP(cmd.Flags(), &sshHostKeyFile, "ssh-host-key-file", "", "CODER_AGENT_SSH_HOST_KEY_FILE", "", "A file with the SSH host key of the agent, so it's stable across restarts. An Ed25519 key is generated and written to it if it doesn't exist. Defaults to a random key on every start.")
+	cliflag.StringVarP(cmd.Flags(), &recordingDir, "session-recording-dir", "", "CODER_AGENT_SESSION_RECORDING_DIR", "", "A directory that the input and output of SSH sessions and web terminals with a PTY are recorded to, as asciicast v2 files with SHA-256 digests next to them.")
+	cliflag.DurationVarP(cmd.Flags(), &ptyRetention, "reconnecting-pty-retention", "", "CODER_AGENT_RECONNECTING_PTY_RETENTION", time.Hour, "How long the output of web terminals is kept in the temporary directory after the agent stops, so terminals that reconnect after it restarts show their previous output. Set to 0 to disable.")
+	cliflag.DurationVarP(cmd.Flags(), &drainTimeout, "drain-timeout", "", "CODER_AGENT_DRAIN_TIMEOUT", 0, "How long the agent waits for open connections to end when it stops. It refuses new connections and tells terminal sessions it's shutting down in the meantime. Set to 0 to close connections immediately.")
+	cliflag.IntVarP(cmd.Flags(), &maxListenerConns, "max-listener-connections", "", "CODER_AGENT_MAX_LISTENER_CONNECTIONS", 1024, "How many connections each service of the agent, like SSH and web terminals, handles at once. More connections wait until one ends.")
+	cliflag.IntVarP(cmd.Flags(), &ptyBufferSize, "reconnecting-pty-buffer-size", "", "CODER_AGENT_RECONNECTING_PTY_BUFFER_SIZE", 64<<10, "The size of the scrollback of web terminals in bytes, which is shown when they reconnect. It's bounded between 1KiB and 16MiB.")
+	cliflag.IntVarP(cmd.Flags(), &ptyScrollback, "reconnecting-pty-scrollback-limit", "", "CODER_AGENT_RECONNECTING_PTY_SCROLLBACK_LIMIT", 64<<20, "The size of the scrollback of all web terminals together in bytes. When it's reached, the oldest output of the terminal that was least recently used is evicted.")
+	cliflag.DurationVarP(cmd.Flags(), &namedPTYTimeout, "named-reconnecting-pty-timeout", "", "CODER_AGENT_NAMED_RECONNECTING_PTY_TIMEOUT", 0, "How long named web terminals are kept when no one is connected to them. Set to 0 to keep them until their shell exits.")
+	cliflag.StringArrayVarP(cmd.Flags(), &dnsServers, "dns-server", "", "CODER_AGENT_DNS_SERVERS", nil, "DNS servers that resolve the hostnames of requests the agent makes itself, like to Coder, instead of the resolver of the workspace. Servers are IP addresses with an optional port, or DNS-over-HTTPS URLs like https://1.1.1.1/dns-query, and are tried in order.")
+	cliflag.BoolVarP(cmd.Flags(), &sftpReadOnly, "sftp-read-only", "", "CODER_AGENT_SFTP_READ_ONLY", false, "Deny SFTP requests that write, like uploads, removals and renames.")
+	cliflag.StringArrayVarP(cmd.Flags(), &sftpAllowedPaths, "sftp-allowed-path", "", "CODER_AGENT_SFTP_ALLOWED_PATHS", nil, "Directories that SFTP sessions can access with their contents. Every path is allowed if none are set. Paths starting with ~/ are relative to the home directory. The policy of the template applies too.")
+	cliflag.StringVarP(cmd.Flags(), &embeddedDERP.ListenAddress, "embedded-derp-address", "", "CODER_AGENT_EMBEDDED_DERP_ADDRESS", "", "The address a DERP server inside the agent listens on, e.g. :3478, to relay connections in air-gapped workspaces. Embedded DERP settings sent by Coder override it.")
+	cliflag.StringVarP(cmd.Flags(), &embeddedDERP.HostName, "embedded-derp-hostname", "", "CODER_AGENT_EMBEDDED_DERP_HOSTNAME", "", "The address that clients reach the embedded DERP server with.")
+	cliflag.IntVarP(cmd.Flags(), &embeddedDERP.RegionID, "embedded-derp-region-id", "", "CODER_AGENT_EMBEDDED_DERP_REGION_ID", 0, "The ID of the DERP region of the embedded DERP server. The DERP map of the deployment must have the same region.")
+	cliflag.StringVarP(cmd.Flags(), &embeddedDERP.RegionCode, "embedded-derp-region-code", "", "CODER_AGENT_EMBEDDED_DERP_REGION_CODE", "agent", "The code of the DERP region of the embedded DERP server.")
+	cliflag.StringVarP(cmd.Flags(), &embeddedDERP.RegionName, "embedded-derp-region-name", "", "CODER_AGENT_EMBEDDED_DERP_REGION_NAME", "Agent", "The name of the DERP region of the embedded DERP server.")
+	// The subcommands use the flag too, to find the socket of the agent.
+	cliflag.StringVarP(cmd.PersistentFlags(), &controlSocket, "control-socket", "", codersdk.AgentControlSocketEnv, filepath.Join(os.TempDir(), "coder-agent.sock"), "The Unix socket that `coder agent` subcommands in the workspace use to inspect the agent. Set to an empty string to disable it.")
+	cmd.AddCommand(agentControlCommands(&controlSocket)...)
+	cliflag.IntVarP(cmd.Flags(), &startupLogMaxSize, "startup-log-max-size", "", "CODER_AGENT_STARTUP_LOG_MAX_SIZE", 10<<20, "The maximum size of the startup script log in bytes. The head and tail of the output are kept when it's exceeded.")
 	return cmd
 }
+
+// checkLogDir returns an error if the log file can't be written.
+func checkLogDir(dir string) error {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return xerrors.Errorf("create log directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "coder-agent.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return xerrors.Errorf("open log file: %w", err)
+	}
+	return file.Close()
+}
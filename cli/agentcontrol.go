@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/cli/cliflag"
+	"github.com/coder/coder/cli/cliui"
+	"github.com/coder/coder/codersdk"
+)
+
+// agentControlCommands are the subcommands of `coder agent` that inspect
+// the agent running in the workspace over its control socket.
+func agentControlCommands(socketPath *string) []*cobra.Command {
+	return []*cobra.Command{
+		agentStatus(socketPath),
+		agentSessions(socketPath),
+		agentRestartService(socketPath),
+		agentLogs(socketPath),
+		agentEvents(socketPath),
+	}
+}
+
+type agentServiceRow struct {
+	Name    string                           `table:"name"`
+	Type    codersdk.AgentControlServiceType `table:"type"`
+	Running bool                             `table:"running"`
+	LogFile string                           `table:"log file"`
+}
+
+func agentStatus(socketPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Show the state of the agent running in this workspace",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			status, err := codersdk.NewAgentControlClient(*socketPath).Status(cmd.Context())
+			if err != nil {
+				return xerrors.Errorf("get agent status: %w", err)
+			}
+			out := cmd.OutOrStdout()
+			_, _ = fmt.Fprintf(out, "Version:    %s\n", status.Version)
+			_, _ = fmt.Fprintf(out, "Uptime:     %s\n", time.Since(status.StartedAt).Round(time.Second))
+			connection := "connected"
+			if !status.Reconnect.Connected {
+				connection = fmt.Sprintf("reconnecting (attempt %d)", status.Reconnect.Attempt)
+				if status.Reconnect.LastError != "" {
+					connection += ": " + status.Reconnect.LastError
+				}
+			}
+			_, _ = fmt.Fprintf(out, "Coder:      %s\n", connection)
+			startup := string(status.Startup.State)
+			if status.Startup.Error != "" {
+				startup += ": " + status.Startup.Error
+			}
+			_, _ = fmt.Fprintf(out, "Startup:    %s\n", startup)
+			_, _ = fmt.Fprintf(out, "Sessions:   %d\n", status.Sessions)
+			tailnet := "down"
+			if status.Health.Tailnet.Up {
+				tailnet = fmt.Sprintf("up, %d peers", status.Health.Tailnet.Peers)
+				if status.Health.Tailnet.DERPRegion != "" {
+					tailnet += fmt.Sprintf(", DERP region %s", status.Health.Tailnet.DERPRegion)
+				}
+				if status.Health.Tailnet.DERPDegraded {
+					tailnet += " (degraded)"
+				}
+			}
+			_, _ = fmt.Fprintf(out, "Tailnet:    %s\n", tailnet)
+			if status.Draining {
+				_, _ = fmt.Fprintln(out, "The agent is shutting down.")
+			}
+			for _, problem := range status.Health.Problems {
+				_, _ = fmt.Fprintf(out, "Problem:    %s\n", problem)
+			}
+			if len(status.Services) == 0 {
+				return nil
+			}
+			rows := make([]agentServiceRow, 0, len(status.Services))
+			for _, service := range status.Services {
+				rows = append(rows, agentServiceRow{
+					Name:    service.Name,
+					Type:    service.Type,
+					Running: service.Running,
+					LogFile: service.LogFile,
+				})
+			}
+			table, err := cliui.DisplayTable(rows, "", nil)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(out, "\n%s\n", table)
+			return err
+		},
+	}
+}
+
+type agentSessionRow struct {
+	ID        string                             `table:"id"`
+	Type      codersdk.WorkspaceAgentSessionType `table:"type"`
+	Command   string                             `table:"command"`
+	Peer      string                             `table:"peer"`
+	StartedAt time.Time                          `table:"started at"`
+}
+
+func agentSessions(socketPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "sessions",
+		Short: "List the active sessions of the agent running in this workspace",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resp, err := codersdk.NewAgentControlClient(*socketPath).Sessions(cmd.Context())
+			if err != nil {
+				return xerrors.Errorf("list agent sessions: %w", err)
+			}
+			if len(resp.Sessions) == 0 {
+				cmd.Println(cliui.Styles.Wrap.Render("No active sessions."))
+				return nil
+			}
+			rows := make([]agentSessionRow, 0, len(resp.Sessions))
+			for _, session := range resp.Sessions {
+				command := session.Command
+				if command == "" {
+					command = session.Label
+				}
+				rows = append(rows, agentSessionRow{
+					ID:        session.ID,
+					Type:      session.Type,
+					Command:   command,
+					Peer:      session.Peer,
+					StartedAt: session.StartedAt,
+				})
+			}
+			table, err := cliui.DisplayTable(rows, "", nil)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), table)
+			return err
+		},
+	}
+}
+
+func agentRestartService(socketPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "restart-service <name>",
+		Short: "Restart a service of the agent running in this workspace, like a language server",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := codersdk.NewAgentControlClient(*socketPath).RestartService(cmd.Context(), args[0])
+			if err != nil {
+				return xerrors.Errorf("restart service %q: %w", args[0], err)
+			}
+			_, err = fmt.Fprintf(cmd.OutOrStdout(), "Restarting %s.\n", args[0])
+			return err
+		},
+	}
+}
+
+func agentLogs(socketPath *string) *cobra.Command {
+	var lines int
+	cmd := &cobra.Command{
+		Use:   "logs [agent|startup-script|<service>]",
+		Short: "Print the logs of the agent running in this workspace, its startup script or a service",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := "agent"
+			if len(args) > 0 {
+				name = args[0]
+			}
+			err := codersdk.NewAgentControlClient(*socketPath).Logs(cmd.Context(), name, lines, cmd.OutOrStdout())
+			if err != nil {
+				return xerrors.Errorf("get logs of %q: %w", name, err)
+			}
+			return nil
+		},
+	}
+	cliflag.IntVarP(cmd.Flags(), &lines, "lines", "n", "", 100, "The number of lines from the end of the log to print. Set to 0 to print the whole log.")
+	return cmd
+}
+
+type agentEventRow struct {
+	Time    time.Time               `table:"time"`
+	Type    codersdk.AgentEventType `table:"type"`
+	Message string                  `table:"message"`
+}
+
+func agentEvents(socketPath *string) *cobra.Command {
+	var limit int
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "Print the timeline of the agent running in this workspace, like when it connected to Coder, across restarts",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resp, err := codersdk.NewAgentControlClient(*socketPath).Events(cmd.Context(), limit)
+			if err != nil {
+				return xerrors.Errorf("get agent events: %w", err)
+			}
+			rows := make([]agentEventRow, 0, len(resp.Events))
+			for _, event := range resp.Events {
+				rows = append(rows, agentEventRow{
+					Time:    event.Time,
+					Type:    event.Type,
+					Message: event.Message,
+				})
+			}
+			table, err := cliui.DisplayTable(rows, "", nil)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), table)
+			return err
+		},
+	}
+	cliflag.IntVarP(cmd.Flags(), &limit, "limit", "n", "", 100, "The number of the latest events to print. Set to 0 to print every event that's kept.")
+	return cmd
+}
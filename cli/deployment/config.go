@@ -334,6 +334,22 @@ func newConfig() *codersdk.DeploymentConfig {
 			Flag:    "ssh-keygen-algorithm",
 			Default: "ed25519",
 		},
+		SSHUserCAKeyFile: &codersdk.DeploymentConfigField[string]{
+			Name:  "SSH User CA Key File",
+			Usage: "Path to the private key of an SSH certificate authority. When set, workspace agents only accept SSH connections authenticated with short-lived user certificates signed by this key, rather than trusting every connection over the tailnet.",
+			Flag:  "ssh-user-ca-key-file",
+		},
+		SSHUserCertificateTTL: &codersdk.DeploymentConfigField[time.Duration]{
+			Name:    "SSH User Certificate TTL",
+			Usage:   "How long SSH user certificates are valid for after being issued.",
+			Flag:    "ssh-user-certificate-ttl",
+			Default: 5 * time.Minute,
+		},
+		SSHPublicKeyAuth: &codersdk.DeploymentConfigField[bool]{
+			Name:  "SSH Public Key Auth",
+			Usage: "Require SSH connections to workspace agents to authenticate with one of the SSH public keys that the owner of the workspace added to their account, rather than trusting every connection over the tailnet.",
+			Flag:  "ssh-public-key-auth",
+		},
 		AutoImportTemplates: &codersdk.DeploymentConfigField[[]string]{
 			Name:   "Auto Import Templates",
 			Usage:  "Templates to auto-import. Available auto-importable templates are: kubernetes",
@@ -361,6 +377,12 @@ func newConfig() *codersdk.DeploymentConfig {
 			Hidden:  true,
 			Default: "https://coder.com/docs/coder-oss/latest/templates#troubleshooting-templates",
 		},
+		AgentReconnectMaxInterval: &codersdk.DeploymentConfigField[time.Duration]{
+			Name:   "Agent Reconnect Max Interval",
+			Usage:  "The maximum interval between attempts of agents to reconnect to Coder. Attempts are randomized up to the interval, so raising it spreads the load of large fleets reconnecting at once. Agents use their own default when unset.",
+			Flag:   "agent-reconnect-max-interval",
+			Hidden: true,
+		},
 		AuditLogging: &codersdk.DeploymentConfigField[bool]{
 			Name:       "Audit Logging",
 			Usage:      "Specifies whether audit logging is enabled.",
@@ -424,6 +446,11 @@ func newConfig() *codersdk.DeploymentConfig {
 			Flag:    "update-check",
 			Default: flag.Lookup("test.v") == nil && !buildinfo.IsDev(),
 		},
+		Tunnels: &codersdk.DeploymentConfigField[bool]{
+			Name:  "Tunnels",
+			Usage: "Allow workspaces to expose ports at public URLs with \"coder expose\", e.g. for receiving webhooks. Tunnels are served on subdomains of the wildcard access URL, which is required.",
+			Flag:  "tunnels",
+		},
 	}
 }
 
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/signal"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/cli/cliflag"
+	"github.com/coder/coder/codersdk"
+)
+
+// expose opens a public URL to a port of the workspace it runs in, e.g. for
+// receiving webhooks. It authenticates with the token of the agent, so it
+// only works in workspaces.
+func expose() *cobra.Command {
+	var (
+		ttl  time.Duration
+		auth string
+	)
+	cmd := &cobra.Command{
+		Use:   "expose <port>",
+		Short: "Open a public URL to a port of this workspace, e.g. for receiving webhooks",
+		Args:  cobra.ExactArgs(1),
+		Example: formatExamples(
+			example{
+				Description: "Receive webhooks on port 3000 for an hour, authenticated with a token in the URL",
+				Command:     "coder expose 3000",
+			},
+			example{
+				Description: "Allow anyone with the URL to send requests to port 8080 for 15 minutes",
+				Command:     "coder expose 8080 --auth public --ttl 15m",
+			},
+		),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(cmd.Context(), InterruptSignals...)
+			defer stop()
+
+			port, err := parsePort(args[0])
+			if err != nil {
+				return err
+			}
+			client, err := createAgentClient(cmd)
+			if err != nil {
+				return xerrors.Errorf("create agent client: %w", err)
+			}
+
+			tunnel, err := client.PostWorkspaceAgentTunnel(ctx, codersdk.CreateWorkspaceAgentTunnelRequest{
+				Port:       port,
+				TTLSeconds: int64(ttl.Seconds()),
+				Auth:       codersdk.WorkspaceAgentTunnelAuth(auth),
+			})
+			if err != nil {
+				return xerrors.Errorf("open tunnel: %w", err)
+			}
+			cmd.Printf("Forwarding requests to port %d until %s:\n\n", tunnel.Port, tunnel.ExpiresAt.Local().Format(time.Kitchen))
+			if tunnel.Token == "" {
+				cmd.Printf("\t%s\n\n", tunnel.URL)
+			} else {
+				cmd.Printf("\t%s?%s=%s\n\n", tunnel.URL, codersdk.WorkspaceAgentTunnelTokenQueryParam, tunnel.Token)
+				cmd.Printf("Requests can also send the token in the %q header instead.\n", codersdk.WorkspaceAgentTunnelTokenHeader)
+			}
+			cmd.Println("Press Ctrl+C to close the tunnel.")
+
+			timer := time.NewTimer(time.Until(tunnel.ExpiresAt))
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+				cmd.Println("The tunnel expired.")
+				return nil
+			}
+
+			closeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			closed, err := client.DeleteWorkspaceAgentTunnel(closeCtx, tunnel.ID)
+			if err != nil {
+				var apiErr *codersdk.Error
+				if errors.As(err, &apiErr) && apiErr.StatusCode() == http.StatusNotFound {
+					cmd.Println("The tunnel expired.")
+					return nil
+				}
+				return xerrors.Errorf("close tunnel: %w", err)
+			}
+			cmd.Printf("Closed the tunnel after proxying %d requests, which sent %d bytes and received %d bytes. %d requests were rejected.\n",
+				closed.Traffic.Requests, closed.Traffic.BytesReceived, closed.Traffic.BytesSent, closed.Traffic.Rejected)
+			return nil
+		},
+	}
+	cliflag.DurationVarP(cmd.Flags(), &ttl, "ttl", "", "CODER_EXPOSE_TTL", time.Hour, "How long the URL is open, up to 24 hours.")
+	cliflag.StringVarP(cmd.Flags(), &auth, "auth", "", "CODER_EXPOSE_AUTH", string(codersdk.WorkspaceAgentTunnelAuthToken), `How requests are authenticated: "token" requires the token of the tunnel, and "public" allows anyone with the URL.`)
+	return cmd
+}
@@ -0,0 +1,83 @@
+package cli_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/cli/clitest"
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/provisioner/echo"
+	"github.com/coder/coder/provisionersdk/proto"
+	"github.com/coder/coder/pty/ptytest"
+	"github.com/coder/coder/testutil"
+)
+
+func TestExpose(t *testing.T) {
+	t.Parallel()
+
+	deploymentConfig := coderdtest.DeploymentConfig(t)
+	deploymentConfig.Tunnels.Value = true
+	client := coderdtest.New(t, &coderdtest.Options{
+		AppHostname:              "*.test.coder.com",
+		DeploymentConfig:         deploymentConfig,
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "dev",
+						Type: "google_compute_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	build := coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+	agentID := build.Resources[0].Agents[0].ID
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+	cmdCtx, cancelCmd := context.WithCancel(ctx)
+	defer cancelCmd()
+
+	cmd, _ := clitest.New(t, "expose", "8080", "--ttl", "10m", "--agent-url", client.URL.String(), "--agent-token", authToken)
+	pty := ptytest.New(t)
+	cmd.SetOut(pty.Output())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.ExecuteContext(cmdCtx)
+	}()
+	pty.ExpectMatch(codersdk.WorkspaceAgentTunnelTokenQueryParam + "=")
+
+	tunnels, err := client.WorkspaceAgentTunnels(ctx, agentID)
+	require.NoError(t, err)
+	require.Len(t, tunnels, 1)
+	require.Equal(t, uint16(8080), tunnels[0].Port)
+	require.Equal(t, codersdk.WorkspaceAgentTunnelAuthToken, tunnels[0].Auth)
+
+	cancelCmd()
+	pty.ExpectMatch("Closed the tunnel")
+	require.NoError(t, <-done)
+	tunnels, err = client.WorkspaceAgentTunnels(ctx, agentID)
+	require.NoError(t, err)
+	require.Empty(t, tunnels)
+}
@@ -25,6 +25,7 @@ func portForward() *cobra.Command {
 	var (
 		tcpForwards []string // <port>:<port>
 		udpForwards []string // <port>:<port>
+		socksListen string   // <port> or <ip>:<port>
 	)
 	cmd := &cobra.Command{
 		Use:     "port-forward <workspace>",
@@ -48,6 +49,10 @@ func portForward() *cobra.Command {
 				Description: "Port forward multiple ports (TCP or UDP) in condensed syntax",
 				Command:     "coder port-forward <workspace> --tcp 8080,9000:3000,9090-9092,10000-10002:10010-10012",
 			},
+			example{
+				Description: "Proxy connections from your local machine through the workspace with a SOCKS5 proxy on port 1080",
+				Command:     "coder port-forward <workspace> --socks5 1080",
+			},
 		),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx, cancel := context.WithCancel(cmd.Context())
@@ -57,6 +62,13 @@ func portForward() *cobra.Command {
 			if err != nil {
 				return xerrors.Errorf("parse port-forward specs: %w", err)
 			}
+			if socksListen != "" {
+				spec, err := parseSocksForward(socksListen)
+				if err != nil {
+					return xerrors.Errorf("parse socks5 address: %w", err)
+				}
+				specs = append(specs, spec)
+			}
 			if len(specs) == 0 {
 				err = cmd.Help()
 				if err != nil {
@@ -153,11 +165,16 @@ func portForward() *cobra.Command {
 
 	cliflag.StringArrayVarP(cmd.Flags(), &tcpForwards, "tcp", "p", "CODER_PORT_FORWARD_TCP", nil, "Forward TCP port(s) from the workspace to the local machine")
 	cliflag.StringArrayVarP(cmd.Flags(), &udpForwards, "udp", "", "CODER_PORT_FORWARD_UDP", nil, "Forward UDP port(s) from the workspace to the local machine. The UDP connection has TCP-like semantics to support stateful UDP protocols")
+	cliflag.StringVarP(cmd.Flags(), &socksListen, "socks5", "", "CODER_PORT_FORWARD_SOCKS5", "", "Listen on a local port, or <ip>:<port>, with a SOCKS5 proxy that dials connections from the workspace")
 	return cmd
 }
 
 func listenAndPortForward(ctx context.Context, cmd *cobra.Command, conn *codersdk.AgentConn, wg *sync.WaitGroup, spec portForwardSpec) (net.Listener, error) {
-	_, _ = fmt.Fprintf(cmd.OutOrStderr(), "Forwarding '%v://%v' locally to '%v://%v' in the workspace\n", spec.listenNetwork, spec.listenAddress, spec.dialNetwork, spec.dialAddress)
+	if spec.dialNetwork == "socks5" {
+		_, _ = fmt.Fprintf(cmd.OutOrStderr(), "Serving a SOCKS5 proxy on '%v' locally that dials connections from the workspace\n", spec.listenAddress)
+	} else {
+		_, _ = fmt.Fprintf(cmd.OutOrStderr(), "Forwarding '%v://%v' locally to '%v://%v' in the workspace\n", spec.listenNetwork, spec.listenAddress, spec.dialNetwork, spec.dialAddress)
+	}
 
 	var (
 		l   net.Listener
@@ -207,7 +224,15 @@ func listenAndPortForward(ctx context.Context, cmd *cobra.Command, conn *codersd
 
 			go func(netConn net.Conn) {
 				defer netConn.Close()
-				remoteConn, err := conn.DialContext(ctx, spec.dialNetwork, spec.dialAddress)
+				var (
+					remoteConn net.Conn
+					err        error
+				)
+				if spec.dialNetwork == "socks5" {
+					remoteConn, err = conn.DialSocks(ctx)
+				} else {
+					remoteConn, err = conn.DialContext(ctx, spec.dialNetwork, spec.dialAddress)
+				}
 				if err != nil {
 					_, _ = fmt.Fprintf(cmd.OutOrStderr(), "Failed to dial '%v://%v' in workspace: %s\n", spec.dialNetwork, spec.dialAddress, err)
 					return
@@ -226,10 +251,32 @@ type portForwardSpec struct {
 	listenNetwork string // tcp, udp
 	listenAddress string // <ip>:<port> or path
 
-	dialNetwork string // tcp, udp
+	dialNetwork string // tcp, udp, socks5
 	dialAddress string // <ip>:<port> or path
 }
 
+// parseSocksForward parses the local address of the SOCKS5 proxy, which is
+// a port on the loopback address or <ip>:<port>.
+func parseSocksForward(in string) (portForwardSpec, error) {
+	host, portStr := "127.0.0.1", in
+	if strings.Contains(in, ":") {
+		var err error
+		host, portStr, err = net.SplitHostPort(in)
+		if err != nil {
+			return portForwardSpec{}, xerrors.Errorf("split %q: %w", in, err)
+		}
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return portForwardSpec{}, err
+	}
+	return portForwardSpec{
+		listenNetwork: "tcp",
+		listenAddress: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		dialNetwork:   "socks5",
+	}, nil
+}
+
 func parsePortForwards(tcpSpecs, udpSpecs []string) ([]portForwardSpec, error) {
 	specs := []portForwardSpec{}
 
@@ -88,3 +88,20 @@ func Test_parsePortForwards(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseSocksForward(t *testing.T) {
+	t.Parallel()
+
+	spec, err := parseSocksForward("1080")
+	require.NoError(t, err)
+	require.Equal(t, portForwardSpec{listenNetwork: "tcp", listenAddress: "127.0.0.1:1080", dialNetwork: "socks5"}, spec)
+
+	spec, err = parseSocksForward("0.0.0.0:1081")
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0.0:1081", spec.listenAddress)
+
+	_, err = parseSocksForward("0")
+	require.Error(t, err)
+	_, err = parseSocksForward("localhost")
+	require.Error(t, err)
+}
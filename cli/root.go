@@ -74,6 +74,7 @@ func Core() []*cobra.Command {
 		create(),
 		deleteWorkspace(),
 		dotfiles(),
+		expose(),
 		gitssh(),
 		list(),
 		loadtest(),
@@ -88,9 +89,11 @@ func Core() []*cobra.Command {
 		show(),
 		speedtest(),
 		ssh(),
+		sshKeys(),
 		start(),
 		state(),
 		stop(),
+		syncFiles(),
 		templates(),
 		tokens(),
 		update(),
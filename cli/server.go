@@ -35,6 +35,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/otel/trace"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/mod/semver"
 	"golang.org/x/oauth2"
 	xgithub "golang.org/x/oauth2/github"
@@ -285,6 +286,18 @@ func Server(vip *viper.Viper, newAPI func(context.Context, *coderd.Options) (*co
 				return xerrors.Errorf("parse ssh keygen algorithm %s: %w", cfg.SSHKeygenAlgorithm.Value, err)
 			}
 
+			var sshUserCertificateAuthority gossh.Signer
+			if cfg.SSHUserCAKeyFile.Value != "" {
+				data, err := os.ReadFile(cfg.SSHUserCAKeyFile.Value)
+				if err != nil {
+					return xerrors.Errorf("read ssh user ca key file: %w", err)
+				}
+				sshUserCertificateAuthority, err = gossh.ParsePrivateKey(data)
+				if err != nil {
+					return xerrors.Errorf("parse ssh user ca key file: %w", err)
+				}
+			}
+
 			// Validate provided auto-import templates.
 			var (
 				validatedAutoImportTemplates     = make([]coderd.AutoImportTemplate, len(cfg.AutoImportTemplates.Value))
@@ -336,6 +349,9 @@ func Server(vip *viper.Viper, newAPI func(context.Context, *coderd.Options) (*co
 					return xerrors.Errorf("parse wildcard access URL %q: %w", appHostname, err)
 				}
 			}
+			if cfg.Tunnels.Value && appHostname == "" {
+				return xerrors.New("--tunnels requires --wildcard-access-url, since tunnels are served on its subdomains")
+			}
 
 			gitAuthConfigs, err := gitauth.ConvertConfig(cfg.GitAuth.Value, accessURLParsed)
 			if err != nil {
@@ -361,6 +377,8 @@ func Server(vip *viper.Viper, newAPI func(context.Context, *coderd.Options) (*co
 				RealIPConfig:                realIPConfig,
 				SecureAuthCookie:            cfg.SecureAuthCookie.Value,
 				SSHKeygenAlgorithm:          sshKeygenAlgorithm,
+				SSHUserCertificateAuthority: sshUserCertificateAuthority,
+				SSHUserCertificateTTL:       cfg.SSHUserCertificateTTL.Value,
 				TracerProvider:              tracerProvider,
 				Telemetry:                   telemetry.NewNoop(),
 				AutoImportTemplates:         validatedAutoImportTemplates,
@@ -12,3 +12,8 @@ var InterruptSignals = []os.Signal{
 	syscall.SIGTERM,
 	syscall.SIGHUP,
 }
+
+// ReloadSignals make daemons reload their configuration.
+var ReloadSignals = []os.Signal{
+	syscall.SIGHUP,
+}
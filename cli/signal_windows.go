@@ -7,3 +7,6 @@ import (
 )
 
 var InterruptSignals = []os.Signal{os.Interrupt}
+
+// ReloadSignals is empty, since Windows doesn't have SIGHUP.
+var ReloadSignals = []os.Signal{}
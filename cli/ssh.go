@@ -2,9 +2,13 @@ package cli
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -21,6 +25,7 @@ import (
 	"golang.org/x/term"
 	"golang.org/x/xerrors"
 
+	"github.com/coder/coder/agent"
 	"github.com/coder/coder/cli/cliflag"
 	"github.com/coder/coder/cli/cliui"
 	"github.com/coder/coder/coderd/autobuild/notify"
@@ -113,7 +118,28 @@ func ssh() *cobra.Command {
 				return nil
 			}
 
-			sshClient, err := conn.SSHClient(ctx)
+			auth, err := sshCertificateAuth(ctx, client, workspaceAgent.ID)
+			if err != nil {
+				return xerrors.Errorf("issue ssh certificate: %w", err)
+			}
+			if identityAgent == "" {
+				identityAgent = os.Getenv("SSH_AUTH_SOCK")
+			}
+			// The keys of the identity agent authenticate connections
+			// when the deployment requires SSH public keys. They're
+			// optional otherwise, so an unreachable agent is ignored.
+			var keyring net.Conn
+			if identityAgent != "" {
+				keyring, err = net.Dial("unix", identityAgent)
+				if err == nil {
+					auth = append(auth, gossh.PublicKeysCallback(gosshagent.NewClient(keyring).Signers))
+				}
+			}
+			sshClient, err := conn.SSHClient(ctx, auth...)
+			if keyring != nil {
+				// The keys are only used to authenticate.
+				_ = keyring.Close()
+			}
 			if err != nil {
 				return err
 			}
@@ -132,9 +158,6 @@ func ssh() *cobra.Command {
 				_ = sshSession.Close()
 			}()
 
-			if identityAgent == "" {
-				identityAgent = os.Getenv("SSH_AUTH_SOCK")
-			}
 			if forwardAgent && identityAgent != "" {
 				err = gosshagent.ForwardToRemote(sshClient, identityAgent)
 				if err != nil {
@@ -206,6 +229,13 @@ func ssh() *cobra.Command {
 				if errors.Is(err, &gossh.ExitMissingError{}) {
 					return xerrors.New("SSH connection ended unexpectedly")
 				}
+				// The agent sends the cause when it fails to run the
+				// session, which is clearer than the exit code.
+				var exitErr *gossh.ExitError
+				if errors.As(err, &exitErr) && exitErr.ExitStatus() == agent.MagicSessionErrorCode &&
+					exitErr.Signal() == agent.MagicSessionErrorSignal && exitErr.Msg() != "" {
+					return xerrors.Errorf("agent failed to run the session: %s", exitErr.Msg())
+				}
 				return err
 			}
 
@@ -216,7 +246,7 @@ func ssh() *cobra.Command {
 	cliflag.BoolVarP(cmd.Flags(), &shuffle, "shuffle", "", "CODER_SSH_SHUFFLE", false, "Specifies whether to choose a random workspace")
 	_ = cmd.Flags().MarkHidden("shuffle")
 	cliflag.BoolVarP(cmd.Flags(), &forwardAgent, "forward-agent", "A", "CODER_SSH_FORWARD_AGENT", false, "Specifies whether to forward the SSH agent specified in $SSH_AUTH_SOCK")
-	cliflag.StringVarP(cmd.Flags(), &identityAgent, "identity-agent", "", "CODER_SSH_IDENTITY_AGENT", "", "Specifies which identity agent to use (overrides $SSH_AUTH_SOCK), forward agent must also be enabled")
+	cliflag.StringVarP(cmd.Flags(), &identityAgent, "identity-agent", "", "CODER_SSH_IDENTITY_AGENT", "", "Specifies which identity agent to use (overrides $SSH_AUTH_SOCK). Its keys authenticate to workspaces that require SSH public keys, and it's forwarded if forward agent is enabled.")
 	cliflag.DurationVarP(cmd.Flags(), &wsPollInterval, "workspace-poll-interval", "", "CODER_WORKSPACE_POLL_INTERVAL", workspacePollInterval, "Specifies how often to poll for workspace automated shutdown.")
 	return cmd
 }
@@ -307,6 +337,43 @@ func getWorkspaceAndAgent(ctx context.Context, cmd *cobra.Command, client *coder
 // Attempt to poll workspace autostop. We write a per-workspace lockfile to
 // avoid spamming the user with notifications in case of multiple instances
 // of the CLI running simultaneously.
+// sshCertificateAuth returns authentication with a short-lived certificate
+// for an ephemeral key when the deployment issues SSH user certificates. No
+// authentication is required otherwise.
+func sshCertificateAuth(ctx context.Context, client *codersdk.Client, agentID uuid.UUID) ([]gossh.AuthMethod, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, xerrors.Errorf("generate key: %w", err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, xerrors.Errorf("create signer: %w", err)
+	}
+	resp, err := client.WorkspaceAgentSSHCertificate(ctx, agentID, codersdk.SSHCertificateRequest{
+		PublicKey: string(gossh.MarshalAuthorizedKey(signer.PublicKey())),
+	})
+	if err != nil {
+		var sdkErr *codersdk.Error
+		if xerrors.As(err, &sdkErr) && sdkErr.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(resp.Certificate))
+	if err != nil {
+		return nil, xerrors.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := publicKey.(*gossh.Certificate)
+	if !ok {
+		return nil, xerrors.Errorf("expected a certificate, got %q", publicKey.Type())
+	}
+	certSigner, err := gossh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, xerrors.Errorf("create certificate signer: %w", err)
+	}
+	return []gossh.AuthMethod{gossh.PublicKeys(certSigner)}, nil
+}
+
 func tryPollWorkspaceAutostop(ctx context.Context, client *codersdk.Client, workspace codersdk.Workspace) (stop func()) {
 	lock := flock.New(filepath.Join(os.TempDir(), "coder-autostop-notify-"+workspace.ID.String()))
 	condition := notifyCondition(ctx, client, workspace.ID, lock)
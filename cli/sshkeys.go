@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/cli/cliflag"
+	"github.com/coder/coder/cli/cliui"
+	"github.com/coder/coder/codersdk"
+)
+
+func sshKeys() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "ssh-keys",
+		Short:   "Manage the SSH public keys that authenticate you to workspaces",
+		Long:    "SSH public keys are only required when the deployment enables SSH public key authentication, rather than trusting every connection over the tailnet.",
+		Aliases: []string{"ssh-key"},
+		Example: formatExamples(
+			example{
+				Description: "Add your SSH public key",
+				Command:     "coder ssh-keys add ~/.ssh/id_ed25519.pub --name laptop",
+			},
+			example{
+				Description: "List your SSH public keys",
+				Command:     "coder ssh-keys ls",
+			},
+			example{
+				Description: "Remove an SSH public key by ID",
+				Command:     "coder ssh-keys rm 0b5cd2b1-6e3c-4c5a-bc2e-5f4c1d1e8a9f",
+			},
+		),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return cmd.Help()
+		},
+	}
+	cmd.AddCommand(
+		addSSHKey(),
+		listSSHKeys(),
+		removeSSHKey(),
+	)
+
+	return cmd
+}
+
+func addSSHKey() *cobra.Command {
+	var name string
+	cmd := &cobra.Command{
+		Use:   "add <file>",
+		Short: `Add an SSH public key from a file, or from stdin with "-"`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := CreateClient(cmd)
+			if err != nil {
+				return xerrors.Errorf("create codersdk client: %w", err)
+			}
+
+			var publicKey []byte
+			if args[0] == "-" {
+				publicKey, err = io.ReadAll(cmd.InOrStdin())
+			} else {
+				publicKey, err = os.ReadFile(args[0])
+			}
+			if err != nil {
+				return xerrors.Errorf("read public key: %w", err)
+			}
+
+			key, err := client.CreateUserSSHPublicKey(cmd.Context(), codersdk.Me, codersdk.CreateUserSSHPublicKeyRequest{
+				Name:      name,
+				PublicKey: string(publicKey),
+			})
+			if err != nil {
+				return xerrors.Errorf("add ssh public key: %w", err)
+			}
+
+			cmd.Println(cliui.Styles.Wrap.Render(
+				fmt.Sprintf("Added the SSH public key %s with the ID %s.", key.Fingerprint, key.ID),
+			))
+			return nil
+		},
+	}
+	cliflag.StringVarP(cmd.Flags(), &name, "name", "n", "", "", "A name for the key, e.g. the machine it's on. Defaults to the comment of the key.")
+
+	return cmd
+}
+
+type sshKeyRow struct {
+	ID          string    `table:"ID"`
+	Name        string    `table:"Name"`
+	Fingerprint string    `table:"Fingerprint"`
+	CreatedAt   time.Time `table:"Created At"`
+}
+
+func listSSHKeys() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List your SSH public keys",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := CreateClient(cmd)
+			if err != nil {
+				return xerrors.Errorf("create codersdk client: %w", err)
+			}
+
+			keys, err := client.UserSSHPublicKeys(cmd.Context(), codersdk.Me)
+			if err != nil {
+				return xerrors.Errorf("list ssh public keys: %w", err)
+			}
+
+			if len(keys) == 0 {
+				cmd.Println(cliui.Styles.Wrap.Render(
+					"No SSH public keys found.",
+				))
+				return nil
+			}
+
+			rows := make([]sshKeyRow, 0, len(keys))
+			for _, key := range keys {
+				rows = append(rows, sshKeyRow{
+					ID:          key.ID.String(),
+					Name:        key.Name,
+					Fingerprint: key.Fingerprint,
+					CreatedAt:   key.CreatedAt,
+				})
+			}
+
+			out, err := cliui.DisplayTable(rows, "", nil)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), out)
+			return err
+		},
+	}
+
+	return cmd
+}
+
+func removeSSHKey() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "remove <id|fingerprint>",
+		Aliases: []string{"rm"},
+		Short:   "Remove an SSH public key",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := CreateClient(cmd)
+			if err != nil {
+				return xerrors.Errorf("create codersdk client: %w", err)
+			}
+
+			keys, err := client.UserSSHPublicKeys(cmd.Context(), codersdk.Me)
+			if err != nil {
+				return xerrors.Errorf("list ssh public keys: %w", err)
+			}
+			for _, key := range keys {
+				if key.ID.String() != args[0] && key.Fingerprint != args[0] {
+					continue
+				}
+				err = client.DeleteUserSSHPublicKey(cmd.Context(), codersdk.Me, key.ID)
+				if err != nil {
+					return xerrors.Errorf("remove ssh public key: %w", err)
+				}
+				cmd.Println(cliui.Styles.Wrap.Render(
+					"SSH public key has been removed.",
+				))
+				return nil
+			}
+			return xerrors.Errorf("no SSH public key matches %q", args[0])
+		},
+	}
+
+	return cmd
+}
@@ -0,0 +1,67 @@
+package cli_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/coder/coder/cli/clitest"
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/testutil"
+)
+
+func TestSSHKeys(t *testing.T) {
+	t.Parallel()
+	client := coderdtest.New(t, nil)
+	_ = coderdtest.CreateFirstUser(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := gossh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	cmd, root := clitest.New(t, "ssh-keys", "ls")
+	clitest.SetupConfig(t, client, root)
+	buf := new(bytes.Buffer)
+	cmd.SetOut(buf)
+	require.NoError(t, cmd.ExecuteContext(ctx))
+	require.Contains(t, buf.String(), "No SSH public keys found")
+
+	cmd, root = clitest.New(t, "ssh-keys", "add", "-", "--name", "laptop")
+	clitest.SetupConfig(t, client, root)
+	cmd.SetIn(strings.NewReader(string(gossh.MarshalAuthorizedKey(key))))
+	buf = new(bytes.Buffer)
+	cmd.SetOut(buf)
+	require.NoError(t, cmd.ExecuteContext(ctx))
+	require.Contains(t, buf.String(), fingerprint)
+
+	cmd, root = clitest.New(t, "ssh-keys", "ls")
+	clitest.SetupConfig(t, client, root)
+	buf = new(bytes.Buffer)
+	cmd.SetOut(buf)
+	require.NoError(t, cmd.ExecuteContext(ctx))
+	require.Contains(t, buf.String(), "laptop")
+	require.Contains(t, buf.String(), fingerprint)
+
+	cmd, root = clitest.New(t, "ssh-keys", "rm", fingerprint)
+	clitest.SetupConfig(t, client, root)
+	buf = new(bytes.Buffer)
+	cmd.SetOut(buf)
+	require.NoError(t, cmd.ExecuteContext(ctx))
+	require.Contains(t, buf.String(), "removed")
+
+	keys, err := client.UserSSHPublicKeys(ctx, codersdk.Me)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
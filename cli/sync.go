@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"cdr.dev/slog/sloggers/sloghuman"
+	"github.com/coder/coder/cli/cliflag"
+	"github.com/coder/coder/cli/cliui"
+	"github.com/coder/coder/codersdk"
+)
+
+func syncFiles() *cobra.Command {
+	var deleteExtraneous bool
+	cmd := &cobra.Command{
+		Annotations: workspaceCommand,
+		Use:         "sync <source> <destination>",
+		Args:        cobra.ExactArgs(2),
+		Short:       "Sync a directory to or from a workspace",
+		Long: "Sync a directory to or from a workspace. Only the files that changed are sent, " +
+			"as the differences to the files at the destination, so syncing large trees " +
+			"that mostly match is much faster than copying them. Exactly one of the source " +
+			"and destination must be a directory of a workspace, written as " +
+			"<workspace>[.<agent>]:<path>. Paths in the workspace are relative to the home directory.",
+		Example: formatExamples(
+			example{
+				Description: "Upload a project to a workspace",
+				Command:     "coder sync ./project my-workspace:project",
+			},
+			example{
+				Description: "Download a directory from a workspace, removing local files that were deleted in the workspace",
+				Command:     "coder sync --delete my-workspace:project/dist ./dist",
+			},
+		),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithCancel(cmd.Context())
+			defer cancel()
+
+			source, destination := parseSyncPath(args[0]), parseSyncPath(args[1])
+			if (source.workspace == "") == (destination.workspace == "") {
+				return xerrors.New("exactly one of the source and destination must be in a workspace, e.g. my-workspace:path")
+			}
+			options := codersdk.SyncFilesOptions{
+				Direction:  codersdk.FileSyncDirectionUpload,
+				LocalPath:  source.path,
+				RemotePath: destination.path,
+				Delete:     deleteExtraneous,
+			}
+			remote := destination
+			if source.workspace != "" {
+				options.Direction = codersdk.FileSyncDirectionDownload
+				options.LocalPath = destination.path
+				options.RemotePath = source.path
+				remote = source
+			}
+			localPath, err := filepath.Abs(options.LocalPath)
+			if err != nil {
+				return xerrors.Errorf("resolve %q: %w", options.LocalPath, err)
+			}
+			options.LocalPath = localPath
+
+			client, err := CreateClient(cmd)
+			if err != nil {
+				return xerrors.Errorf("create codersdk client: %w", err)
+			}
+			workspace, workspaceAgent, err := getWorkspaceAndAgent(ctx, cmd, client, codersdk.Me, remote.workspace, false)
+			if err != nil {
+				return err
+			}
+			err = cliui.Agent(ctx, cmd.ErrOrStderr(), cliui.AgentOptions{
+				WorkspaceName: workspace.Name,
+				Fetch: func(ctx context.Context) (codersdk.WorkspaceAgent, error) {
+					return client.WorkspaceAgent(ctx, workspaceAgent.ID)
+				},
+			})
+			if err != nil {
+				return xerrors.Errorf("await agent: %w", err)
+			}
+			logger := slog.Make(sloghuman.Sink(cmd.ErrOrStderr()))
+			if cliflag.IsSetBool(cmd, varVerbose) {
+				logger = logger.Leveled(slog.LevelDebug)
+			}
+			conn, err := client.DialWorkspaceAgent(ctx, workspaceAgent.ID, &codersdk.DialWorkspaceAgentOptions{
+				Logger: logger,
+			})
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conn.AwaitReachable(ctx)
+
+			stats, err := conn.SyncFiles(ctx, options)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Synced %s of %d files, sent %d bytes and reused %d bytes",
+				cliui.Styles.Keyword.Render(fmt.Sprint(stats.Transferred)), stats.Files, stats.LiteralBytes, stats.MatchedBytes)
+			if deleteExtraneous {
+				_, _ = fmt.Fprintf(cmd.OutOrStdout(), ", deleted %d", stats.Deleted)
+			}
+			_, _ = fmt.Fprintln(cmd.OutOrStdout())
+			return nil
+		},
+	}
+	cliflag.BoolVarP(cmd.Flags(), &deleteExtraneous, "delete", "", "CODER_SYNC_DELETE", false,
+		"Delete files from the destination that aren't in the source.")
+	return cmd
+}
+
+type syncPath struct {
+	// workspace is the workspace and agent of a path in a workspace, and
+	// empty for a local path.
+	workspace string
+	path      string
+}
+
+// parseSyncPath parses a local path or a path in a workspace, which is
+// written as <workspace>[.<agent>]:<path>.
+func parseSyncPath(arg string) syncPath {
+	// Local paths can contain colons, like C:\project on Windows or
+	// ./a:b, so only a prefix without separators is a workspace.
+	if filepath.VolumeName(arg) != "" {
+		return syncPath{path: arg}
+	}
+	index := strings.Index(arg, ":")
+	if index <= 0 || strings.ContainsAny(arg[:index], `/\`) {
+		return syncPath{path: arg}
+	}
+	return syncPath{
+		workspace: arg[:index],
+		path:      arg[index+1:],
+	}
+}
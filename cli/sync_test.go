@@ -0,0 +1,65 @@
+package cli_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"cdr.dev/slog/sloggers/slogtest"
+	"github.com/coder/coder/agent"
+	"github.com/coder/coder/cli/clitest"
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/pty/ptytest"
+	"github.com/coder/coder/testutil"
+)
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Upload", func(t *testing.T) {
+		t.Parallel()
+		client, workspace, agentToken := setupWorkspaceForAgent(t, nil)
+		agentClient := codersdk.New(client.URL)
+		agentClient.SetSessionToken(agentToken)
+		agentCloser := agent.New(agent.Options{
+			Client: agentClient,
+			Logger: slogtest.Make(t, nil).Named("agent"),
+		})
+		defer agentCloser.Close()
+		coderdtest.AwaitWorkspaceAgents(t, client, workspace.ID)
+
+		source := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(source, "file"), []byte("hello"), 0o600))
+		destination := filepath.Join(t.TempDir(), "destination")
+
+		cmd, root := clitest.New(t, "sync", source, workspace.Name+":"+destination)
+		clitest.SetupConfig(t, client, root)
+		pty := ptytest.New(t)
+		cmd.SetOut(pty.Output())
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+		err := cmd.ExecuteContext(ctx)
+		require.NoError(t, err)
+		pty.ExpectMatch("of 1 files")
+
+		data, err := os.ReadFile(filepath.Join(destination, "file"))
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+	})
+
+	t.Run("NoWorkspace", func(t *testing.T) {
+		t.Parallel()
+		client := coderdtest.New(t, nil)
+		_ = coderdtest.CreateFirstUser(t, client)
+
+		cmd, root := clitest.New(t, "sync", t.TempDir(), t.TempDir())
+		clitest.SetupConfig(t, client, root)
+		err := cmd.Execute()
+		require.ErrorContains(t, err, "exactly one of the source and destination")
+	})
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/moby/moby/pkg/namesgenerator"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/trace"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/xerrors"
 	"google.golang.org/api/idtoken"
 	"storj.io/drpc/drpcmux"
@@ -96,6 +97,10 @@ type Options struct {
 	GitAuthConfigs       []*gitauth.Config
 	RealIPConfig         *httpmw.RealIPConfig
 	TrialGenerator       func(ctx context.Context, email string) error
+	// SSHUserCertificateAuthority signs short-lived SSH user certificates.
+	// When set, workspace agents require a certificate to connect over SSH.
+	SSHUserCertificateAuthority gossh.Signer
+	SSHUserCertificateTTL       time.Duration
 	// TLSCertificates is used to mesh DERP servers securely.
 	TLSCertificates    []tls.Certificate
 	TailnetCoordinator tailnet.Coordinator
@@ -133,6 +138,9 @@ func New(options *Options) *API {
 	if options.APIRateLimit == 0 {
 		options.APIRateLimit = 512
 	}
+	if options.SSHUserCertificateTTL == 0 {
+		options.SSHUserCertificateTTL = 5 * time.Minute
+	}
 	if options.Authorizer == nil {
 		options.Authorizer = rbac.NewAuthorizer()
 	}
@@ -186,6 +194,32 @@ func New(options *Options) *API {
 	}
 	api.Auditor.Store(&options.Auditor)
 	api.workspaceAgentCache = wsconncache.New(api.dialWorkspaceAgentTailnet, 0)
+	api.appTokens = newAppTokens()
+	api.appPorts = newAppPorts()
+	api.agentStartupLogs = newAgentStartupLogs()
+	cancelAgentStartupLogs, err := api.subscribeAgentStartupLogs()
+	if err != nil {
+		api.Logger.Warn(context.Background(), "subscribe to workspace agent startup logs", slog.Error(err))
+		cancelAgentStartupLogs = func() {}
+	}
+	api.cancelAgentStartupLogs = cancelAgentStartupLogs
+	api.agentBootTimings = newAgentBootTimings(options.PrometheusRegistry)
+	api.agentConnectionPaths = newAgentConnectionPaths(options.PrometheusRegistry)
+	api.agentStartupScriptResults = newAgentStartupScriptResults(options.PrometheusRegistry)
+	api.agentCrashes = newAgentCrashes(options.PrometheusRegistry)
+	cancelAgentBootTimings, err := api.subscribeAgentBootTimings()
+	if err != nil {
+		api.Logger.Warn(context.Background(), "subscribe to workspace agent boot timings", slog.Error(err))
+		cancelAgentBootTimings = func() {}
+	}
+	api.cancelAgentBootTimings = cancelAgentBootTimings
+	api.agentTunnels = newAgentTunnels()
+	cancelAgentTunnels, err := api.subscribeAgentTunnels()
+	if err != nil {
+		api.Logger.Warn(context.Background(), "subscribe to workspace agent tunnels", slog.Error(err))
+		cancelAgentTunnels = func() {}
+	}
+	api.cancelAgentTunnels = cancelAgentTunnels
 	api.TailnetCoordinator.Store(&options.TailnetCoordinator)
 	oauthConfigs := &httpmw.OAuth2Configs{
 		Github: options.GithubOAuth2Config,
@@ -214,6 +248,9 @@ func New(options *Options) *API {
 		httpmw.ExtractRealIP(api.RealIPConfig),
 		httpmw.Logger(api.Logger),
 		httpmw.Prometheus(options.PrometheusRegistry),
+		// handleSubdomainTunnels serves tunnels on subdomains of the app
+		// hostname, so they never share an origin with the dashboard.
+		api.handleSubdomainTunnels,
 		// handleSubdomainApplications checks if the first subdomain is a valid
 		// app URL. If it is, it will serve that application.
 		api.handleSubdomainApplications(
@@ -382,6 +419,11 @@ func New(options *Options) *API {
 				httpmw.ExtractTemplateParam(options.Database),
 			)
 			r.Get("/daus", api.templateDAUs)
+			r.Get("/drift", api.templateDriftReports)
+			r.Route("/agent-settings", func(r chi.Router) {
+				r.Get("/", api.templateAgentSettings)
+				r.Put("/", api.putTemplateAgentSettings)
+			})
 			r.Get("/", api.template)
 			r.Delete("/", api.deleteTemplate)
 			r.Patch("/", api.patchTemplateMeta)
@@ -483,6 +525,11 @@ func New(options *Options) *API {
 					})
 					r.Get("/gitsshkey", api.gitSSHKey)
 					r.Put("/gitsshkey", api.regenerateGitSSHKey)
+					r.Route("/ssh-public-keys", func(r chi.Router) {
+						r.Get("/", api.userSSHPublicKeys)
+						r.Post("/", api.postUserSSHPublicKey)
+						r.Delete("/{sshpublickey}", api.deleteUserSSHPublicKey)
+					})
 				})
 			})
 		})
@@ -493,10 +540,22 @@ func New(options *Options) *API {
 			r.Route("/me", func(r chi.Router) {
 				r.Use(httpmw.ExtractWorkspaceAgent(options.Database))
 				r.Get("/metadata", api.workspaceAgentMetadata)
+				r.Get("/metadata/watch", api.watchWorkspaceAgentMetadata)
 				r.Post("/version", api.postWorkspaceAgentVersion)
+				r.Post("/handshake", api.postWorkspaceAgentHandshake)
 				r.Post("/app-health", api.postWorkspaceAppHealth)
+				r.Patch("/startup-logs", api.patchWorkspaceAgentStartupLogs)
+				r.Post("/boot-timing", api.postWorkspaceAgentBootTiming)
+				r.Post("/connection-events", api.postWorkspaceAgentConnectionEvents)
+				r.Post("/drift", api.postWorkspaceAgentDriftReport)
+				r.Post("/declared-ports", api.postWorkspaceAgentDeclaredPorts)
+				r.Post("/startup-script-result", api.postWorkspaceAgentStartupScriptResult)
+				r.Post("/crash-report", api.postWorkspaceAgentCrashReport)
+				r.Post("/tunnels", api.postWorkspaceAgentTunnel)
+				r.Delete("/tunnels/{tunnel}", api.deleteWorkspaceAgentTunnel)
 				r.Get("/gitauth", api.workspaceAgentsGitAuth)
 				r.Get("/gitsshkey", api.agentGitSSHKey)
+				r.Get("/authorized-keys", api.workspaceAgentAuthorizedKeys)
 				r.Get("/coordinate", api.workspaceAgentCoordinate)
 				r.Post("/report-stats", api.workspaceAgentReportStats)
 				// DEPRECATED in favor of the POST endpoint above.
@@ -512,6 +571,23 @@ func New(options *Options) *API {
 				r.Get("/", api.workspaceAgent)
 				r.Get("/pty", api.workspaceAgentPTY)
 				r.Get("/listening-ports", api.workspaceAgentListeningPorts)
+				r.Get("/ssh-host-keys", api.workspaceAgentSSHHostKeys)
+				r.Get("/identity-key", api.workspaceAgentIdentityKey)
+				r.Post("/ssh-certificate", api.postWorkspaceAgentSSHCertificate)
+				r.Post("/broadcast", api.postWorkspaceAgentBroadcast)
+				r.Post("/quiesce", api.postWorkspaceAgentQuiesce)
+				r.Get("/transcripts", api.workspaceAgentSessionTranscripts)
+				r.Get("/transcripts/{transcript}", api.workspaceAgentSessionTranscript)
+				r.Get("/reverse-port-forwards", api.workspaceAgentReversePortForwards)
+				r.Get("/startup", api.workspaceAgentStartup)
+				r.Get("/startup-logs", api.workspaceAgentStartupLogs)
+				r.Get("/boot-timing", api.workspaceAgentBootTiming)
+				r.Get("/drift", api.workspaceAgentDriftReport)
+				r.Get("/tunnels", api.workspaceAgentTunnels)
+				r.Get("/sessions", api.workspaceAgentSessions)
+				r.Delete("/sessions/{session}", api.deleteWorkspaceAgentSession)
+				r.Get("/quick-actions", api.workspaceAgentQuickActions)
+				r.Post("/quick-actions/{quickaction}", api.postWorkspaceAgentQuickAction)
 				r.Get("/connection", api.workspaceAgentConnection)
 				r.Get("/coordinate", api.workspaceAgentClientCoordinate)
 			})
@@ -539,6 +615,11 @@ func New(options *Options) *API {
 				})
 				r.Get("/watch", api.watchWorkspace)
 				r.Put("/extend", api.putExtendWorkspace)
+				r.Get("/connection-events", api.workspaceConnectionEvents)
+				r.Route("/environment-variables", func(r chi.Router) {
+					r.Get("/", api.workspaceEnvironmentVariables)
+					r.Put("/", api.putWorkspaceEnvironmentVariables)
+				})
 			})
 		})
 		r.Route("/workspacebuilds/{workspacebuild}", func(r chi.Router) {
@@ -603,7 +684,29 @@ type API struct {
 
 	metricsCache        *metricscache.Cache
 	workspaceAgentCache *wsconncache.Cache
+	appTokens           *appTokens
+	appPorts            *appPorts
 	updateChecker       *updatecheck.Checker
+	// agentStartupLogs are the startup script logs agents streamed,
+	// which are published to every replica.
+	agentStartupLogs       *agentStartupLogs
+	cancelAgentStartupLogs func()
+	// agentBootTimings are the boot timings agents reported, which are
+	// published to every replica.
+	agentBootTimings       *agentBootTimings
+	cancelAgentBootTimings func()
+	// agentConnectionPaths counts the time peers of agents spent on
+	// direct and relayed connections.
+	agentConnectionPaths *agentConnectionPaths
+	// agentStartupScriptResults counts how the startup scripts of agents
+	// ended.
+	agentStartupScriptResults *agentStartupScriptResults
+	// agentCrashes counts the panics that agents recovered from.
+	agentCrashes *agentCrashes
+	// agentTunnels are the open tunnels of agents, which are published to
+	// every replica.
+	agentTunnels       *agentTunnels
+	cancelAgentTunnels func()
 }
 
 // Close waits for all WebSocket connections to drain before returning.
@@ -613,6 +716,9 @@ func (api *API) Close() error {
 	api.WebsocketWaitMutex.Unlock()
 
 	api.metricsCache.Close()
+	api.cancelAgentStartupLogs()
+	api.cancelAgentBootTimings()
+	api.cancelAgentTunnels()
 	if api.updateChecker != nil {
 		api.updateChecker.Close()
 	}
@@ -67,10 +67,22 @@ func AGPLRoutes(a *AuthTester) (map[string]string, map[string]RouteCheck) {
 		"POST:/api/v2/workspaceagents/google-instance-identity": {NoAuthorize: true},
 		"GET:/api/v2/workspaceagents/me/gitauth":                {NoAuthorize: true},
 		"GET:/api/v2/workspaceagents/me/gitsshkey":              {NoAuthorize: true},
+		"GET:/api/v2/workspaceagents/me/authorized-keys":        {NoAuthorize: true},
 		"GET:/api/v2/workspaceagents/me/metadata":               {NoAuthorize: true},
+		"GET:/api/v2/workspaceagents/me/metadata/watch":         {NoAuthorize: true},
 		"GET:/api/v2/workspaceagents/me/coordinate":             {NoAuthorize: true},
 		"POST:/api/v2/workspaceagents/me/version":               {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/handshake":             {NoAuthorize: true},
 		"POST:/api/v2/workspaceagents/me/app-health":            {NoAuthorize: true},
+		"PATCH:/api/v2/workspaceagents/me/startup-logs":         {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/boot-timing":           {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/connection-events":     {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/drift":                 {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/declared-ports":        {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/startup-script-result": {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/crash-report":          {NoAuthorize: true},
+		"POST:/api/v2/workspaceagents/me/tunnels":               {NoAuthorize: true},
+		"DELETE:/api/v2/workspaceagents/me/tunnels/{tunnel}":    {NoAuthorize: true},
 		"GET:/api/v2/workspaceagents/me/report-stats":           {NoAuthorize: true},
 		"POST:/api/v2/workspaceagents/me/report-stats":          {NoAuthorize: true},
 
@@ -109,6 +121,14 @@ func AGPLRoutes(a *AuthTester) (map[string]string, map[string]RouteCheck) {
 			AssertAction: rbac.ActionUpdate,
 			AssertObject: workspaceRBACObj,
 		},
+		"GET:/api/v2/workspaces/{workspace}/environment-variables": {
+			AssertAction: rbac.ActionRead,
+			AssertObject: workspaceRBACObj,
+		},
+		"PUT:/api/v2/workspaces/{workspace}/environment-variables": {
+			AssertAction: rbac.ActionUpdate,
+			AssertObject: workspaceRBACObj,
+		},
 		"PATCH:/api/v2/workspacebuilds/{workspacebuild}/cancel": {
 			AssertAction: rbac.ActionUpdate,
 			AssertObject: workspaceRBACObj,
@@ -133,6 +153,10 @@ func AGPLRoutes(a *AuthTester) (map[string]string, map[string]RouteCheck) {
 			AssertAction: rbac.ActionCreate,
 			AssertObject: workspaceExecObj,
 		},
+		"POST:/api/v2/workspaceagents/{workspaceagent}/quick-actions/{quickaction}": {
+			AssertAction: rbac.ActionCreate,
+			AssertObject: workspaceExecObj,
+		},
 		"POST:/api/v2/organizations/{organization}/templates": {
 			AssertAction: rbac.ActionCreate,
 			AssertObject: rbac.ResourceTemplate.InOrg(a.Organization.ID),
@@ -145,6 +169,18 @@ func AGPLRoutes(a *AuthTester) (map[string]string, map[string]RouteCheck) {
 			AssertAction: rbac.ActionRead,
 			AssertObject: rbac.ResourceTemplate.InOrg(a.Template.OrganizationID),
 		},
+		"GET:/api/v2/templates/{template}/drift": {
+			AssertAction: rbac.ActionUpdate,
+			AssertObject: rbac.ResourceTemplate.InOrg(a.Template.OrganizationID),
+		},
+		"GET:/api/v2/templates/{template}/agent-settings": {
+			AssertAction: rbac.ActionRead,
+			AssertObject: rbac.ResourceTemplate.InOrg(a.Template.OrganizationID),
+		},
+		"PUT:/api/v2/templates/{template}/agent-settings": {
+			AssertAction: rbac.ActionUpdate,
+			AssertObject: rbac.ResourceTemplate.InOrg(a.Template.OrganizationID),
+		},
 		"POST:/api/v2/files": {AssertAction: rbac.ActionCreate, AssertObject: rbac.ResourceFile},
 		"GET:/api/v2/files/{fileID}": {
 			AssertAction: rbac.ActionRead,
@@ -232,6 +268,10 @@ func AGPLRoutes(a *AuthTester) (map[string]string, map[string]RouteCheck) {
 			AssertAction: rbac.ActionRead,
 			AssertObject: workspaceRBACObj,
 		},
+		"GET:/api/v2/workspaces/{workspace}/connection-events": {
+			AssertAction: rbac.ActionRead,
+			AssertObject: rbac.ResourceAuditLog,
+		},
 		"GET:/api/v2/users":                      {StatusCode: http.StatusOK, AssertObject: rbac.ResourceUser},
 		"GET:/api/v2/applications/auth-redirect": {AssertAction: rbac.ActionCreate, AssertObject: rbac.ResourceAPIKey},
 
@@ -38,6 +38,7 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/oauth2"
 	"golang.org/x/xerrors"
 	"google.golang.org/api/idtoken"
@@ -96,6 +97,9 @@ type Options struct {
 	TLSCertificates      []tls.Certificate
 	GitAuthConfigs       []*gitauth.Config
 	TrialGenerator       func(context.Context, string) error
+	// SSHUserCertificateAuthority requires workspace agents to
+	// authenticate SSH connections with certificates it signs.
+	SSHUserCertificateAuthority gossh.Signer
 
 	// IncludeProvisionerDaemon when true means to start an in-memory provisionerD
 	IncludeProvisionerDaemon    bool
@@ -264,6 +268,8 @@ func NewOptions(t *testing.T, options *Options) (func(http.Handler), context.Can
 			Telemetry:            telemetry.NewNoop(),
 			TLSCertificates:      options.TLSCertificates,
 			TrialGenerator:       options.TrialGenerator,
+
+			SSHUserCertificateAuthority: options.SSHUserCertificateAuthority,
 			DERPMap: &tailcfg.DERPMap{
 				Regions: map[int]*tailcfg.DERPRegion{
 					1: {
@@ -96,28 +96,34 @@ type data struct {
 	userLinks           []database.UserLink
 
 	// New tables
-	agentStats                []database.AgentStat
-	auditLogs                 []database.AuditLog
-	files                     []database.File
-	gitAuthLinks              []database.GitAuthLink
-	gitSSHKey                 []database.GitSSHKey
-	groupMembers              []database.GroupMember
-	groups                    []database.Group
-	licenses                  []database.License
-	parameterSchemas          []database.ParameterSchema
-	parameterValues           []database.ParameterValue
-	provisionerDaemons        []database.ProvisionerDaemon
-	provisionerJobLogs        []database.ProvisionerJobLog
-	provisionerJobs           []database.ProvisionerJob
-	replicas                  []database.Replica
-	templateVersions          []database.TemplateVersion
-	templates                 []database.Template
-	workspaceAgents           []database.WorkspaceAgent
-	workspaceApps             []database.WorkspaceApp
-	workspaceBuilds           []database.WorkspaceBuild
-	workspaceResourceMetadata []database.WorkspaceResourceMetadatum
-	workspaceResources        []database.WorkspaceResource
-	workspaces                []database.Workspace
+	agentStats                     []database.AgentStat
+	auditLogs                      []database.AuditLog
+	files                          []database.File
+	gitAuthLinks                   []database.GitAuthLink
+	gitSSHKey                      []database.GitSSHKey
+	groupMembers                   []database.GroupMember
+	groups                         []database.Group
+	licenses                       []database.License
+	parameterSchemas               []database.ParameterSchema
+	parameterValues                []database.ParameterValue
+	provisionerDaemons             []database.ProvisionerDaemon
+	provisionerJobLogs             []database.ProvisionerJobLog
+	provisionerJobs                []database.ProvisionerJob
+	replicas                       []database.Replica
+	templateAgentSettings          []database.TemplateAgentSetting
+	templateVersions               []database.TemplateVersion
+	templates                      []database.Template
+	userSSHPublicKeys              []database.UserSSHPublicKey
+	workspaceAgents                []database.WorkspaceAgent
+	workspaceAgentConnectionEvents []database.WorkspaceAgentConnectionEvent
+	workspaceAgentDeclaredPorts    []database.WorkspaceAgentDeclaredPort
+	workspaceAgentDriftReports     []database.WorkspaceAgentDriftReport
+	workspaceApps                  []database.WorkspaceApp
+	workspaceBuilds                []database.WorkspaceBuild
+	workspaceEnvironmentVariables  []database.WorkspaceEnvironmentVariable
+	workspaceResourceMetadata      []database.WorkspaceResourceMetadatum
+	workspaceResources             []database.WorkspaceResource
+	workspaces                     []database.Workspace
 
 	deploymentID    string
 	derpMeshKey     string
@@ -2677,6 +2683,287 @@ func (q *fakeQuerier) InsertWorkspaceBuild(_ context.Context, arg database.Inser
 	return workspaceBuild, nil
 }
 
+func (q *fakeQuerier) InsertWorkspaceAgentConnectionEvents(_ context.Context, arg database.InsertWorkspaceAgentConnectionEventsParams) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for index, id := range arg.ID {
+		duplicate := false
+		for _, event := range q.workspaceAgentConnectionEvents {
+			if event.ID == id {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		q.workspaceAgentConnectionEvents = append(q.workspaceAgentConnectionEvents, database.WorkspaceAgentConnectionEvent{
+			ID:           id,
+			WorkspaceID:  arg.WorkspaceID,
+			AgentID:      arg.AgentID,
+			ConnectionID: arg.ConnectionID[index],
+			SessionID:    arg.SessionID[index],
+			Type:         arg.Type[index],
+			Action:       arg.Action[index],
+			CreatedAt:    arg.CreatedAt[index],
+			Peer:         arg.Peer[index],
+			SSHUser:      arg.SSHUser[index],
+			Command:      arg.Command[index],
+			Destination:  arg.Destination[index],
+		})
+	}
+	return nil
+}
+
+func (q *fakeQuerier) GetWorkspaceAgentConnectionEventsByWorkspaceID(_ context.Context, arg database.GetWorkspaceAgentConnectionEventsByWorkspaceIDParams) ([]database.WorkspaceAgentConnectionEvent, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	events := make([]database.WorkspaceAgentConnectionEvent, 0)
+	for _, event := range q.workspaceAgentConnectionEvents {
+		if event.WorkspaceID == arg.WorkspaceID {
+			events = append(events, event)
+		}
+	}
+	// The most recent events come first.
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.After(events[j].CreatedAt)
+		}
+		return events[i].ID.String() > events[j].ID.String()
+	})
+
+	if arg.OffsetOpt > 0 {
+		if int(arg.OffsetOpt) >= len(events) {
+			return nil, nil
+		}
+		events = events[arg.OffsetOpt:]
+	}
+	if arg.LimitOpt > 0 && int(arg.LimitOpt) < len(events) {
+		events = events[:arg.LimitOpt]
+	}
+	return events, nil
+}
+
+func (q *fakeQuerier) InsertOrUpdateWorkspaceAgentDriftReport(_ context.Context, arg database.InsertOrUpdateWorkspaceAgentDriftReportParams) (database.WorkspaceAgentDriftReport, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	report := database.WorkspaceAgentDriftReport{
+		AgentID:     arg.AgentID,
+		WorkspaceID: arg.WorkspaceID,
+		CheckedAt:   arg.CheckedAt,
+		Checks:      arg.Checks,
+		Drifted:     arg.Drifted,
+		Drifts:      arg.Drifts,
+	}
+	for index, existing := range q.workspaceAgentDriftReports {
+		if existing.AgentID == arg.AgentID {
+			// The workspace of an agent doesn't change.
+			report.WorkspaceID = existing.WorkspaceID
+			q.workspaceAgentDriftReports[index] = report
+			return report, nil
+		}
+	}
+	q.workspaceAgentDriftReports = append(q.workspaceAgentDriftReports, report)
+	return report, nil
+}
+
+func (q *fakeQuerier) GetWorkspaceAgentDriftReportByAgentID(_ context.Context, agentID uuid.UUID) (database.WorkspaceAgentDriftReport, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	for _, report := range q.workspaceAgentDriftReports {
+		if report.AgentID == agentID {
+			return report, nil
+		}
+	}
+	return database.WorkspaceAgentDriftReport{}, sql.ErrNoRows
+}
+
+func (q *fakeQuerier) GetWorkspaceAgentDriftReportsByTemplateID(_ context.Context, templateID uuid.UUID) ([]database.WorkspaceAgentDriftReport, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	// The agents of the latest builds of the workspaces of the template.
+	agents := map[uuid.UUID]struct{}{}
+	for _, workspace := range q.workspaces {
+		if workspace.TemplateID != templateID || workspace.Deleted {
+			continue
+		}
+		var latest database.WorkspaceBuild
+		var buildNum int32 = -1
+		for _, build := range q.workspaceBuilds {
+			if build.WorkspaceID == workspace.ID && build.BuildNumber > buildNum {
+				latest = build
+				buildNum = build.BuildNumber
+			}
+		}
+		if buildNum == -1 {
+			continue
+		}
+		for _, resource := range q.workspaceResources {
+			if resource.JobID != latest.JobID {
+				continue
+			}
+			for _, agent := range q.workspaceAgents {
+				if agent.ResourceID == resource.ID {
+					agents[agent.ID] = struct{}{}
+				}
+			}
+		}
+	}
+
+	reports := make([]database.WorkspaceAgentDriftReport, 0)
+	for _, report := range q.workspaceAgentDriftReports {
+		if _, ok := agents[report.AgentID]; ok {
+			reports = append(reports, report)
+		}
+	}
+	// Drifted agents come first.
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Drifted != reports[j].Drifted {
+			return reports[i].Drifted
+		}
+		return reports[i].CheckedAt.After(reports[j].CheckedAt)
+	})
+	return reports, nil
+}
+
+func (q *fakeQuerier) GetWorkspaceAgentDeclaredPortsByAgentID(_ context.Context, agentID uuid.UUID) ([]database.WorkspaceAgentDeclaredPort, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	ports := make([]database.WorkspaceAgentDeclaredPort, 0)
+	for _, port := range q.workspaceAgentDeclaredPorts {
+		if port.AgentID == agentID {
+			ports = append(ports, port)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Port < ports[j].Port
+	})
+	return ports, nil
+}
+
+func (q *fakeQuerier) DeleteWorkspaceAgentDeclaredPortsByAgentID(_ context.Context, agentID uuid.UUID) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	ports := make([]database.WorkspaceAgentDeclaredPort, 0, len(q.workspaceAgentDeclaredPorts))
+	for _, port := range q.workspaceAgentDeclaredPorts {
+		if port.AgentID != agentID {
+			ports = append(ports, port)
+		}
+	}
+	q.workspaceAgentDeclaredPorts = ports
+	return nil
+}
+
+func (q *fakeQuerier) InsertWorkspaceAgentDeclaredPort(_ context.Context, arg database.InsertWorkspaceAgentDeclaredPortParams) (database.WorkspaceAgentDeclaredPort, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, port := range q.workspaceAgentDeclaredPorts {
+		if port.AgentID == arg.AgentID && port.Port == arg.Port {
+			return database.WorkspaceAgentDeclaredPort{}, errDuplicateKey
+		}
+	}
+	port := database.WorkspaceAgentDeclaredPort{
+		AgentID:   arg.AgentID,
+		Port:      arg.Port,
+		Name:      arg.Name,
+		CreatedAt: arg.CreatedAt,
+	}
+	q.workspaceAgentDeclaredPorts = append(q.workspaceAgentDeclaredPorts, port)
+	return port, nil
+}
+
+func (q *fakeQuerier) GetWorkspaceEnvironmentVariablesByWorkspaceID(_ context.Context, workspaceID uuid.UUID) ([]database.WorkspaceEnvironmentVariable, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	variables := make([]database.WorkspaceEnvironmentVariable, 0)
+	for _, variable := range q.workspaceEnvironmentVariables {
+		if variable.WorkspaceID == workspaceID {
+			variables = append(variables, variable)
+		}
+	}
+	sort.Slice(variables, func(i, j int) bool {
+		return variables[i].Name < variables[j].Name
+	})
+	return variables, nil
+}
+
+func (q *fakeQuerier) DeleteWorkspaceEnvironmentVariablesByWorkspaceID(_ context.Context, workspaceID uuid.UUID) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	variables := make([]database.WorkspaceEnvironmentVariable, 0, len(q.workspaceEnvironmentVariables))
+	for _, variable := range q.workspaceEnvironmentVariables {
+		if variable.WorkspaceID != workspaceID {
+			variables = append(variables, variable)
+		}
+	}
+	q.workspaceEnvironmentVariables = variables
+	return nil
+}
+
+func (q *fakeQuerier) InsertWorkspaceEnvironmentVariable(_ context.Context, arg database.InsertWorkspaceEnvironmentVariableParams) (database.WorkspaceEnvironmentVariable, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, variable := range q.workspaceEnvironmentVariables {
+		if variable.WorkspaceID == arg.WorkspaceID && variable.Name == arg.Name {
+			return database.WorkspaceEnvironmentVariable{}, errDuplicateKey
+		}
+	}
+	variable := database.WorkspaceEnvironmentVariable{
+		WorkspaceID: arg.WorkspaceID,
+		Name:        arg.Name,
+		Value:       arg.Value,
+		CreatedAt:   arg.CreatedAt,
+	}
+	q.workspaceEnvironmentVariables = append(q.workspaceEnvironmentVariables, variable)
+	return variable, nil
+}
+
+func (q *fakeQuerier) GetTemplateAgentSettingsByTemplateID(_ context.Context, templateID uuid.UUID) (database.TemplateAgentSetting, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	for _, settings := range q.templateAgentSettings {
+		if settings.TemplateID == templateID {
+			return settings, nil
+		}
+	}
+	return database.TemplateAgentSetting{}, sql.ErrNoRows
+}
+
+func (q *fakeQuerier) InsertOrUpdateTemplateAgentSettings(_ context.Context, arg database.InsertOrUpdateTemplateAgentSettingsParams) (database.TemplateAgentSetting, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	settings := database.TemplateAgentSetting{
+		TemplateID:                    arg.TemplateID,
+		DisableDirectConnections:      arg.DisableDirectConnections,
+		UpdatedAt:                     arg.UpdatedAt,
+		QuickActions:                  arg.QuickActions,
+		FeatureFlags:                  arg.FeatureFlags,
+		ReconnectingPTYTimeoutSeconds: arg.ReconnectingPTYTimeoutSeconds,
+		LanguageServers:               arg.LanguageServers,
+	}
+	for index, existing := range q.templateAgentSettings {
+		if existing.TemplateID == arg.TemplateID {
+			q.templateAgentSettings[index] = settings
+			return settings, nil
+		}
+	}
+	q.templateAgentSettings = append(q.templateAgentSettings, settings)
+	return settings, nil
+}
+
 func (q *fakeQuerier) InsertWorkspaceApp(_ context.Context, arg database.InsertWorkspaceAppParams) (database.WorkspaceApp, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -2853,6 +3140,22 @@ func (q *fakeQuerier) UpdateWorkspaceAgentConnectionByID(_ context.Context, arg
 	return sql.ErrNoRows
 }
 
+func (q *fakeQuerier) UpdateWorkspaceAgentIdentityPublicKeyByID(_ context.Context, arg database.UpdateWorkspaceAgentIdentityPublicKeyByIDParams) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for index, agent := range q.workspaceAgents {
+		if agent.ID != arg.ID {
+			continue
+		}
+
+		agent.IdentityPublicKey = arg.IdentityPublicKey
+		q.workspaceAgents[index] = agent
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
 func (q *fakeQuerier) UpdateWorkspaceAgentVersionByID(_ context.Context, arg database.UpdateWorkspaceAgentVersionByIDParams) error {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -3146,6 +3449,71 @@ func (q *fakeQuerier) DeleteGitSSHKey(_ context.Context, userID uuid.UUID) error
 	return sql.ErrNoRows
 }
 
+func (q *fakeQuerier) InsertUserSSHPublicKey(_ context.Context, arg database.InsertUserSSHPublicKeyParams) (database.UserSSHPublicKey, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, key := range q.userSSHPublicKeys {
+		if key.UserID == arg.UserID && key.Fingerprint == arg.Fingerprint {
+			return database.UserSSHPublicKey{}, errDuplicateKey
+		}
+	}
+
+	//nolint:gosimple
+	key := database.UserSSHPublicKey{
+		ID:          arg.ID,
+		UserID:      arg.UserID,
+		CreatedAt:   arg.CreatedAt,
+		Name:        arg.Name,
+		PublicKey:   arg.PublicKey,
+		Fingerprint: arg.Fingerprint,
+	}
+	q.userSSHPublicKeys = append(q.userSSHPublicKeys, key)
+	return key, nil
+}
+
+func (q *fakeQuerier) GetUserSSHPublicKeyByID(_ context.Context, id uuid.UUID) (database.UserSSHPublicKey, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	for _, key := range q.userSSHPublicKeys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return database.UserSSHPublicKey{}, sql.ErrNoRows
+}
+
+func (q *fakeQuerier) GetUserSSHPublicKeysByUserID(_ context.Context, userID uuid.UUID) ([]database.UserSSHPublicKey, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	keys := make([]database.UserSSHPublicKey, 0)
+	for _, key := range q.userSSHPublicKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (q *fakeQuerier) DeleteUserSSHPublicKey(_ context.Context, id uuid.UUID) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for index, key := range q.userSSHPublicKeys {
+		if key.ID != id {
+			continue
+		}
+		q.userSSHPublicKeys = append(q.userSSHPublicKeys[:index], q.userSSHPublicKeys[index+1:]...)
+		return nil
+	}
+	return nil
+}
+
 func (q *fakeQuerier) GetAuditLogsOffset(ctx context.Context, arg database.GetAuditLogsOffsetParams) ([]database.GetAuditLogsOffsetRow, error) {
 	q.mutex.RLock()
 	defer q.mutex.RUnlock()
@@ -99,6 +99,20 @@ CREATE TYPE user_status AS ENUM (
     'suspended'
 );
 
+CREATE TYPE workspace_agent_connection_action AS ENUM (
+    'connect',
+    'disconnect'
+);
+
+CREATE TYPE workspace_agent_connection_type AS ENUM (
+    'ssh',
+    'sftp',
+    'port_forward',
+    'reconnecting_pty',
+    'file_sync',
+    'exec'
+);
+
 CREATE TYPE workspace_app_health AS ENUM (
     'disabled',
     'initializing',
@@ -331,6 +345,16 @@ CREATE TABLE site_configs (
     value character varying(8192) NOT NULL
 );
 
+CREATE TABLE template_agent_settings (
+    template_id uuid NOT NULL,
+    disable_direct_connections boolean DEFAULT false NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    quick_actions jsonb DEFAULT '[]'::jsonb NOT NULL,
+    feature_flags jsonb DEFAULT '{}'::jsonb NOT NULL,
+    reconnecting_pty_timeout_seconds integer DEFAULT 0 NOT NULL,
+    language_servers jsonb DEFAULT '[]'::jsonb NOT NULL
+);
+
 CREATE TABLE template_versions (
     id uuid NOT NULL,
     template_id uuid,
@@ -377,6 +401,15 @@ CREATE TABLE user_links (
     oauth_expiry timestamp with time zone DEFAULT '0001-01-01 00:00:00+00'::timestamp with time zone NOT NULL
 );
 
+CREATE TABLE user_ssh_public_keys (
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    name text NOT NULL,
+    public_key text NOT NULL,
+    fingerprint text NOT NULL
+);
+
 CREATE TABLE users (
     id uuid NOT NULL,
     email text NOT NULL,
@@ -392,6 +425,37 @@ CREATE TABLE users (
     last_seen_at timestamp without time zone DEFAULT '0001-01-01 00:00:00'::timestamp without time zone NOT NULL
 );
 
+CREATE TABLE workspace_agent_connection_events (
+    id uuid NOT NULL,
+    workspace_id uuid NOT NULL,
+    agent_id uuid NOT NULL,
+    connection_id uuid NOT NULL,
+    session_id text NOT NULL,
+    type workspace_agent_connection_type NOT NULL,
+    action workspace_agent_connection_action NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    peer text NOT NULL,
+    ssh_user text NOT NULL,
+    command text NOT NULL,
+    destination text NOT NULL
+);
+
+CREATE TABLE workspace_agent_declared_ports (
+    agent_id uuid NOT NULL,
+    port integer NOT NULL,
+    name text NOT NULL,
+    created_at timestamp with time zone NOT NULL
+);
+
+CREATE TABLE workspace_agent_drift_reports (
+    agent_id uuid NOT NULL,
+    workspace_id uuid NOT NULL,
+    checked_at timestamp with time zone NOT NULL,
+    checks integer NOT NULL,
+    drifted boolean NOT NULL,
+    drifts jsonb NOT NULL
+);
+
 CREATE TABLE workspace_agents (
     id uuid NOT NULL,
     created_at timestamp with time zone NOT NULL,
@@ -414,7 +478,8 @@ CREATE TABLE workspace_agents (
     last_connected_replica_id uuid,
     connection_timeout_seconds integer DEFAULT 0 NOT NULL,
     troubleshooting_url text DEFAULT ''::text NOT NULL,
-    motd_file text DEFAULT ''::text NOT NULL
+    motd_file text DEFAULT ''::text NOT NULL,
+    identity_public_key bytea
 );
 
 COMMENT ON COLUMN workspace_agents.version IS 'Version tracks the version of the currently running workspace agent. Workspace agents register their version upon start.';
@@ -425,6 +490,8 @@ COMMENT ON COLUMN workspace_agents.troubleshooting_url IS 'URL for troubleshooti
 
 COMMENT ON COLUMN workspace_agents.motd_file IS 'Path to file inside workspace containing the message of the day (MOTD) to show to the user when logging in via SSH.';
 
+COMMENT ON COLUMN workspace_agents.identity_public_key IS 'Ed25519 public key the agent registered in its handshake, which clients verify the agent with.';
+
 CREATE TABLE workspace_apps (
     id uuid NOT NULL,
     created_at timestamp with time zone NOT NULL,
@@ -458,6 +525,13 @@ CREATE TABLE workspace_builds (
     daily_cost integer DEFAULT 0 NOT NULL
 );
 
+CREATE TABLE workspace_environment_variables (
+    workspace_id uuid NOT NULL,
+    name text NOT NULL,
+    value text NOT NULL,
+    created_at timestamp with time zone NOT NULL
+);
+
 CREATE TABLE workspace_resource_metadata (
     workspace_resource_id uuid NOT NULL,
     key character varying(1024) NOT NULL,
@@ -565,6 +639,9 @@ ALTER TABLE ONLY provisioner_jobs
 ALTER TABLE ONLY site_configs
     ADD CONSTRAINT site_configs_key_key UNIQUE (key);
 
+ALTER TABLE ONLY template_agent_settings
+    ADD CONSTRAINT template_agent_settings_pkey PRIMARY KEY (template_id);
+
 ALTER TABLE ONLY template_versions
     ADD CONSTRAINT template_versions_pkey PRIMARY KEY (id);
 
@@ -577,9 +654,24 @@ ALTER TABLE ONLY templates
 ALTER TABLE ONLY user_links
     ADD CONSTRAINT user_links_pkey PRIMARY KEY (user_id, login_type);
 
+ALTER TABLE ONLY user_ssh_public_keys
+    ADD CONSTRAINT user_ssh_public_keys_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY user_ssh_public_keys
+    ADD CONSTRAINT user_ssh_public_keys_user_id_fingerprint_key UNIQUE (user_id, fingerprint);
+
 ALTER TABLE ONLY users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
+ALTER TABLE ONLY workspace_agent_connection_events
+    ADD CONSTRAINT workspace_agent_connection_events_pkey PRIMARY KEY (id);
+
+ALTER TABLE ONLY workspace_agent_declared_ports
+    ADD CONSTRAINT workspace_agent_declared_ports_pkey PRIMARY KEY (agent_id, port);
+
+ALTER TABLE ONLY workspace_agent_drift_reports
+    ADD CONSTRAINT workspace_agent_drift_reports_pkey PRIMARY KEY (agent_id);
+
 ALTER TABLE ONLY workspace_agents
     ADD CONSTRAINT workspace_agents_pkey PRIMARY KEY (id);
 
@@ -598,6 +690,9 @@ ALTER TABLE ONLY workspace_builds
 ALTER TABLE ONLY workspace_builds
     ADD CONSTRAINT workspace_builds_workspace_id_build_number_key UNIQUE (workspace_id, build_number);
 
+ALTER TABLE ONLY workspace_environment_variables
+    ADD CONSTRAINT workspace_environment_variables_pkey PRIMARY KEY (workspace_id, name);
+
 ALTER TABLE ONLY workspace_resource_metadata
     ADD CONSTRAINT workspace_resource_metadata_pkey PRIMARY KEY (workspace_resource_id, key);
 
@@ -643,6 +738,10 @@ CREATE UNIQUE INDEX users_email_lower_idx ON users USING btree (lower(email)) WH
 
 CREATE UNIQUE INDEX users_username_lower_idx ON users USING btree (lower(username)) WHERE (deleted = false);
 
+CREATE INDEX workspace_agent_connection_events_workspace_id_created_at_idx ON workspace_agent_connection_events USING btree (workspace_id, created_at);
+
+CREATE INDEX workspace_agent_drift_reports_workspace_id_idx ON workspace_agent_drift_reports USING btree (workspace_id);
+
 CREATE INDEX workspace_agents_auth_token_idx ON workspace_agents USING btree (auth_token);
 
 CREATE INDEX workspace_agents_resource_id_idx ON workspace_agents USING btree (resource_id);
@@ -681,6 +780,9 @@ ALTER TABLE ONLY provisioner_job_logs
 ALTER TABLE ONLY provisioner_jobs
     ADD CONSTRAINT provisioner_jobs_organization_id_fkey FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE;
 
+ALTER TABLE ONLY template_agent_settings
+    ADD CONSTRAINT template_agent_settings_template_id_fkey FOREIGN KEY (template_id) REFERENCES templates(id) ON DELETE CASCADE;
+
 ALTER TABLE ONLY template_versions
     ADD CONSTRAINT template_versions_created_by_fkey FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE RESTRICT;
 
@@ -699,6 +801,24 @@ ALTER TABLE ONLY templates
 ALTER TABLE ONLY user_links
     ADD CONSTRAINT user_links_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
 
+ALTER TABLE ONLY user_ssh_public_keys
+    ADD CONSTRAINT user_ssh_public_keys_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+ALTER TABLE ONLY workspace_agent_connection_events
+    ADD CONSTRAINT workspace_agent_connection_events_agent_id_fkey FOREIGN KEY (agent_id) REFERENCES workspace_agents(id) ON DELETE CASCADE;
+
+ALTER TABLE ONLY workspace_agent_connection_events
+    ADD CONSTRAINT workspace_agent_connection_events_workspace_id_fkey FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
+
+ALTER TABLE ONLY workspace_agent_declared_ports
+    ADD CONSTRAINT workspace_agent_declared_ports_agent_id_fkey FOREIGN KEY (agent_id) REFERENCES workspace_agents(id) ON DELETE CASCADE;
+
+ALTER TABLE ONLY workspace_agent_drift_reports
+    ADD CONSTRAINT workspace_agent_drift_reports_agent_id_fkey FOREIGN KEY (agent_id) REFERENCES workspace_agents(id) ON DELETE CASCADE;
+
+ALTER TABLE ONLY workspace_agent_drift_reports
+    ADD CONSTRAINT workspace_agent_drift_reports_workspace_id_fkey FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
+
 ALTER TABLE ONLY workspace_agents
     ADD CONSTRAINT workspace_agents_resource_id_fkey FOREIGN KEY (resource_id) REFERENCES workspace_resources(id) ON DELETE CASCADE;
 
@@ -714,6 +834,9 @@ ALTER TABLE ONLY workspace_builds
 ALTER TABLE ONLY workspace_builds
     ADD CONSTRAINT workspace_builds_workspace_id_fkey FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
 
+ALTER TABLE ONLY workspace_environment_variables
+    ADD CONSTRAINT workspace_environment_variables_workspace_id_fkey FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
+
 ALTER TABLE ONLY workspace_resource_metadata
     ADD CONSTRAINT workspace_resource_metadata_workspace_resource_id_fkey FOREIGN KEY (workspace_resource_id) REFERENCES workspace_resources(id) ON DELETE CASCADE;
 
@@ -0,0 +1 @@
+DROP TABLE user_ssh_public_keys;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS user_ssh_public_keys (
+    id uuid NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at timestamp with time zone NOT NULL,
+    -- Name describes the key for the user, e.g. the machine it's on.
+    name text NOT NULL,
+    -- The public key in the authorized_keys format.
+    public_key text NOT NULL,
+    -- The SHA256 fingerprint of the public key, so keys are only added once.
+    fingerprint text NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE (user_id, fingerprint)
+);
@@ -0,0 +1,3 @@
+DROP TABLE workspace_agent_connection_events;
+DROP TYPE workspace_agent_connection_action;
+DROP TYPE workspace_agent_connection_type;
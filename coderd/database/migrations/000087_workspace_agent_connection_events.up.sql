@@ -0,0 +1,36 @@
+CREATE TYPE workspace_agent_connection_type AS ENUM (
+    'ssh',
+    'sftp',
+    'port_forward',
+    'reconnecting_pty'
+);
+
+CREATE TYPE workspace_agent_connection_action AS ENUM (
+    'connect',
+    'disconnect'
+);
+
+CREATE TABLE IF NOT EXISTS workspace_agent_connection_events (
+    -- Agents retry events that failed to send, so the ID they generate
+    -- deduplicates them.
+    id uuid NOT NULL,
+    workspace_id uuid NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    agent_id uuid NOT NULL REFERENCES workspace_agents (id) ON DELETE CASCADE,
+    -- The connect and disconnect events of a connection share its ID.
+    connection_id uuid NOT NULL,
+    -- The ID of the SSH session or reconnecting PTY, if any.
+    session_id text NOT NULL,
+    type workspace_agent_connection_type NOT NULL,
+    action workspace_agent_connection_action NOT NULL,
+    -- When the agent recorded the event.
+    created_at timestamp with time zone NOT NULL,
+    -- The tailnet address of the client.
+    peer text NOT NULL,
+    ssh_user text NOT NULL,
+    command text NOT NULL,
+    -- The address that port forwards connect to.
+    destination text NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX workspace_agent_connection_events_workspace_id_created_at_idx ON workspace_agent_connection_events USING btree (workspace_id, created_at);
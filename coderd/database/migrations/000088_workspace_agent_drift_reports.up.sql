@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS workspace_agent_drift_reports (
+    agent_id uuid NOT NULL REFERENCES workspace_agents (id) ON DELETE CASCADE,
+    workspace_id uuid NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    -- When the agent compared the workspace to the drift manifest.
+    checked_at timestamp with time zone NOT NULL,
+    -- The number of tools, environment variables and files compared.
+    checks integer NOT NULL,
+    drifted boolean NOT NULL,
+    -- The aspects of the workspace that differ from the manifest.
+    drifts jsonb NOT NULL,
+    -- Only the most recent report of an agent is kept.
+    PRIMARY KEY (agent_id)
+);
+
+CREATE INDEX workspace_agent_drift_reports_workspace_id_idx ON workspace_agent_drift_reports USING btree (workspace_id);
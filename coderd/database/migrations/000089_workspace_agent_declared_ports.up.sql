@@ -0,0 +1,9 @@
+-- Ports declared by processes in workspaces, like startup scripts, so they're
+-- listed without changing the template.
+CREATE TABLE IF NOT EXISTS workspace_agent_declared_ports (
+    agent_id uuid NOT NULL REFERENCES workspace_agents (id) ON DELETE CASCADE,
+    port integer NOT NULL,
+    name text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (agent_id, port)
+);
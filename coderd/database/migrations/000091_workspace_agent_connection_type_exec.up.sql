@@ -0,0 +1 @@
+ALTER TYPE workspace_agent_connection_type ADD VALUE IF NOT EXISTS 'exec';
@@ -0,0 +1 @@
+DROP TABLE workspace_environment_variables;
@@ -0,0 +1,9 @@
+-- Environment variables that owners set for their workspaces, which agents
+-- add to new sessions without changing the template.
+CREATE TABLE IF NOT EXISTS workspace_environment_variables (
+    workspace_id uuid NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    name text NOT NULL,
+    value text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (workspace_id, name)
+);
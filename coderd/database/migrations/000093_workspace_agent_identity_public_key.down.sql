@@ -0,0 +1,2 @@
+ALTER TABLE workspace_agents
+	DROP COLUMN identity_public_key;
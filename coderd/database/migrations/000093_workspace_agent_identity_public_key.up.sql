@@ -0,0 +1,4 @@
+ALTER TABLE workspace_agents
+	ADD COLUMN identity_public_key bytea;
+
+COMMENT ON COLUMN workspace_agents.identity_public_key IS 'Ed25519 public key the agent registered in its handshake, which clients verify the agent with.';
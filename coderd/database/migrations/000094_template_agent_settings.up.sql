@@ -0,0 +1,7 @@
+-- Settings that template admins apply to the agents of every workspace of a
+-- template, which the provisioner protocol doesn't carry.
+CREATE TABLE IF NOT EXISTS template_agent_settings (
+    template_id uuid NOT NULL PRIMARY KEY REFERENCES templates (id) ON DELETE CASCADE,
+    disable_direct_connections boolean NOT NULL DEFAULT false,
+    updated_at timestamp with time zone NOT NULL
+);
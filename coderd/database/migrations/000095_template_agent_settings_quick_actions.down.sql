@@ -0,0 +1,2 @@
+ALTER TABLE template_agent_settings
+	DROP COLUMN quick_actions;
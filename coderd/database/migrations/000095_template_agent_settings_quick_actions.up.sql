@@ -0,0 +1,2 @@
+ALTER TABLE template_agent_settings
+	ADD COLUMN quick_actions jsonb NOT NULL DEFAULT '[]'::jsonb;
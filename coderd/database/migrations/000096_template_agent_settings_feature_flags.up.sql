@@ -0,0 +1,2 @@
+ALTER TABLE template_agent_settings
+	ADD COLUMN feature_flags jsonb NOT NULL DEFAULT '{}'::jsonb;
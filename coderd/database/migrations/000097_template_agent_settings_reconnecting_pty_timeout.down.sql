@@ -0,0 +1,2 @@
+ALTER TABLE template_agent_settings
+	DROP COLUMN reconnecting_pty_timeout_seconds;
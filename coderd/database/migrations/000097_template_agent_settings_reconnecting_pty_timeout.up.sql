@@ -0,0 +1,2 @@
+ALTER TABLE template_agent_settings
+	ADD COLUMN reconnecting_pty_timeout_seconds integer NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE template_agent_settings
+	ADD COLUMN language_servers jsonb NOT NULL DEFAULT '[]'::jsonb;
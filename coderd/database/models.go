@@ -339,6 +339,48 @@ func (e *UserStatus) Scan(src interface{}) error {
 	return nil
 }
 
+type WorkspaceAgentConnectionAction string
+
+const (
+	WorkspaceAgentConnectionActionConnect    WorkspaceAgentConnectionAction = "connect"
+	WorkspaceAgentConnectionActionDisconnect WorkspaceAgentConnectionAction = "disconnect"
+)
+
+func (e *WorkspaceAgentConnectionAction) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = WorkspaceAgentConnectionAction(s)
+	case string:
+		*e = WorkspaceAgentConnectionAction(s)
+	default:
+		return fmt.Errorf("unsupported scan type for WorkspaceAgentConnectionAction: %T", src)
+	}
+	return nil
+}
+
+type WorkspaceAgentConnectionType string
+
+const (
+	WorkspaceAgentConnectionTypeSSH             WorkspaceAgentConnectionType = "ssh"
+	WorkspaceAgentConnectionTypeSFTP            WorkspaceAgentConnectionType = "sftp"
+	WorkspaceAgentConnectionTypePortForward     WorkspaceAgentConnectionType = "port_forward"
+	WorkspaceAgentConnectionTypeReconnectingPTY WorkspaceAgentConnectionType = "reconnecting_pty"
+	WorkspaceAgentConnectionTypeFileSync        WorkspaceAgentConnectionType = "file_sync"
+	WorkspaceAgentConnectionTypeExec            WorkspaceAgentConnectionType = "exec"
+)
+
+func (e *WorkspaceAgentConnectionType) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = WorkspaceAgentConnectionType(s)
+	case string:
+		*e = WorkspaceAgentConnectionType(s)
+	default:
+		return fmt.Errorf("unsupported scan type for WorkspaceAgentConnectionType: %T", src)
+	}
+	return nil
+}
+
 type WorkspaceAppHealth string
 
 const (
@@ -600,6 +642,16 @@ type Template struct {
 	AllowUserCancelWorkspaceJobs bool `db:"allow_user_cancel_workspace_jobs" json:"allow_user_cancel_workspace_jobs"`
 }
 
+type TemplateAgentSetting struct {
+	TemplateID                    uuid.UUID       `db:"template_id" json:"template_id"`
+	DisableDirectConnections      bool            `db:"disable_direct_connections" json:"disable_direct_connections"`
+	UpdatedAt                     time.Time       `db:"updated_at" json:"updated_at"`
+	QuickActions                  json.RawMessage `db:"quick_actions" json:"quick_actions"`
+	FeatureFlags                  json.RawMessage `db:"feature_flags" json:"feature_flags"`
+	ReconnectingPTYTimeoutSeconds int32           `db:"reconnecting_pty_timeout_seconds" json:"reconnecting_pty_timeout_seconds"`
+	LanguageServers               json.RawMessage `db:"language_servers" json:"language_servers"`
+}
+
 type TemplateVersion struct {
 	ID             uuid.UUID     `db:"id" json:"id"`
 	TemplateID     uuid.NullUUID `db:"template_id" json:"template_id"`
@@ -636,6 +688,15 @@ type UserLink struct {
 	OAuthExpiry       time.Time `db:"oauth_expiry" json:"oauth_expiry"`
 }
 
+type UserSSHPublicKey struct {
+	ID          uuid.UUID `db:"id" json:"id"`
+	UserID      uuid.UUID `db:"user_id" json:"user_id"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	Name        string    `db:"name" json:"name"`
+	PublicKey   string    `db:"public_key" json:"public_key"`
+	Fingerprint string    `db:"fingerprint" json:"fingerprint"`
+}
+
 type Workspace struct {
 	ID                uuid.UUID      `db:"id" json:"id"`
 	CreatedAt         time.Time      `db:"created_at" json:"created_at"`
@@ -677,6 +738,39 @@ type WorkspaceAgent struct {
 	TroubleshootingURL string `db:"troubleshooting_url" json:"troubleshooting_url"`
 	// Path to file inside workspace containing the message of the day (MOTD) to show to the user when logging in via SSH.
 	MOTDFile string `db:"motd_file" json:"motd_file"`
+	// Ed25519 public key the agent registered in its handshake, which clients verify the agent with.
+	IdentityPublicKey []byte `db:"identity_public_key" json:"identity_public_key"`
+}
+
+type WorkspaceAgentConnectionEvent struct {
+	ID           uuid.UUID                      `db:"id" json:"id"`
+	WorkspaceID  uuid.UUID                      `db:"workspace_id" json:"workspace_id"`
+	AgentID      uuid.UUID                      `db:"agent_id" json:"agent_id"`
+	ConnectionID uuid.UUID                      `db:"connection_id" json:"connection_id"`
+	SessionID    string                         `db:"session_id" json:"session_id"`
+	Type         WorkspaceAgentConnectionType   `db:"type" json:"type"`
+	Action       WorkspaceAgentConnectionAction `db:"action" json:"action"`
+	CreatedAt    time.Time                      `db:"created_at" json:"created_at"`
+	Peer         string                         `db:"peer" json:"peer"`
+	SSHUser      string                         `db:"ssh_user" json:"ssh_user"`
+	Command      string                         `db:"command" json:"command"`
+	Destination  string                         `db:"destination" json:"destination"`
+}
+
+type WorkspaceAgentDeclaredPort struct {
+	AgentID   uuid.UUID `db:"agent_id" json:"agent_id"`
+	Port      int32     `db:"port" json:"port"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type WorkspaceAgentDriftReport struct {
+	AgentID     uuid.UUID       `db:"agent_id" json:"agent_id"`
+	WorkspaceID uuid.UUID       `db:"workspace_id" json:"workspace_id"`
+	CheckedAt   time.Time       `db:"checked_at" json:"checked_at"`
+	Checks      int32           `db:"checks" json:"checks"`
+	Drifted     bool            `db:"drifted" json:"drifted"`
+	Drifts      json.RawMessage `db:"drifts" json:"drifts"`
 }
 
 type WorkspaceApp struct {
@@ -712,6 +806,13 @@ type WorkspaceBuild struct {
 	DailyCost         int32               `db:"daily_cost" json:"daily_cost"`
 }
 
+type WorkspaceEnvironmentVariable struct {
+	WorkspaceID uuid.UUID `db:"workspace_id" json:"workspace_id"`
+	Name        string    `db:"name" json:"name"`
+	Value       string    `db:"value" json:"value"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
 type WorkspaceResource struct {
 	ID           uuid.UUID           `db:"id" json:"id"`
 	CreatedAt    time.Time           `db:"created_at" json:"created_at"`
@@ -28,6 +28,9 @@ type sqlcQuerier interface {
 	DeleteOldAgentStats(ctx context.Context) error
 	DeleteParameterValueByID(ctx context.Context, id uuid.UUID) error
 	DeleteReplicasUpdatedBefore(ctx context.Context, updatedAt time.Time) error
+	DeleteUserSSHPublicKey(ctx context.Context, id uuid.UUID) error
+	DeleteWorkspaceAgentDeclaredPortsByAgentID(ctx context.Context, agentID uuid.UUID) error
+	DeleteWorkspaceEnvironmentVariablesByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) error
 	GetAPIKeyByID(ctx context.Context, id string) (APIKey, error)
 	GetAPIKeysByLoginType(ctx context.Context, loginType LoginType) ([]APIKey, error)
 	GetAPIKeysLastUsedAfter(ctx context.Context, lastUsed time.Time) ([]APIKey, error)
@@ -75,6 +78,7 @@ type sqlcQuerier interface {
 	GetQuotaAllowanceForUser(ctx context.Context, userID uuid.UUID) (int64, error)
 	GetQuotaConsumedForUser(ctx context.Context, ownerID uuid.UUID) (int64, error)
 	GetReplicasUpdatedAfter(ctx context.Context, updatedAt time.Time) ([]Replica, error)
+	GetTemplateAgentSettingsByTemplateID(ctx context.Context, templateID uuid.UUID) (TemplateAgentSetting, error)
 	GetTemplateAverageBuildTime(ctx context.Context, arg GetTemplateAverageBuildTimeParams) (GetTemplateAverageBuildTimeRow, error)
 	GetTemplateByID(ctx context.Context, id uuid.UUID) (Template, error)
 	GetTemplateByOrganizationAndName(ctx context.Context, arg GetTemplateByOrganizationAndNameParams) (Template, error)
@@ -95,6 +99,8 @@ type sqlcQuerier interface {
 	GetUserGroups(ctx context.Context, userID uuid.UUID) ([]Group, error)
 	GetUserLinkByLinkedID(ctx context.Context, linkedID string) (UserLink, error)
 	GetUserLinkByUserIDLoginType(ctx context.Context, arg GetUserLinkByUserIDLoginTypeParams) (UserLink, error)
+	GetUserSSHPublicKeyByID(ctx context.Context, id uuid.UUID) (UserSSHPublicKey, error)
+	GetUserSSHPublicKeysByUserID(ctx context.Context, userID uuid.UUID) ([]UserSSHPublicKey, error)
 	GetUsers(ctx context.Context, arg GetUsersParams) ([]GetUsersRow, error)
 	// This shouldn't check for deleted, because it's frequently used
 	// to look up references to actions. eg. a user could build a workspace
@@ -103,6 +109,12 @@ type sqlcQuerier interface {
 	GetWorkspaceAgentByAuthToken(ctx context.Context, authToken uuid.UUID) (WorkspaceAgent, error)
 	GetWorkspaceAgentByID(ctx context.Context, id uuid.UUID) (WorkspaceAgent, error)
 	GetWorkspaceAgentByInstanceID(ctx context.Context, authInstanceID string) (WorkspaceAgent, error)
+	GetWorkspaceAgentConnectionEventsByWorkspaceID(ctx context.Context, arg GetWorkspaceAgentConnectionEventsByWorkspaceIDParams) ([]WorkspaceAgentConnectionEvent, error)
+	GetWorkspaceAgentDeclaredPortsByAgentID(ctx context.Context, agentID uuid.UUID) ([]WorkspaceAgentDeclaredPort, error)
+	GetWorkspaceAgentDriftReportByAgentID(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentDriftReport, error)
+	// Only the agents of the latest builds of workspaces are included, since
+	// the agents of previous builds no longer run.
+	GetWorkspaceAgentDriftReportsByTemplateID(ctx context.Context, templateID uuid.UUID) ([]WorkspaceAgentDriftReport, error)
 	GetWorkspaceAgentsByResourceIDs(ctx context.Context, ids []uuid.UUID) ([]WorkspaceAgent, error)
 	GetWorkspaceAgentsCreatedAfter(ctx context.Context, createdAt time.Time) ([]WorkspaceAgent, error)
 	GetWorkspaceAppByAgentIDAndSlug(ctx context.Context, arg GetWorkspaceAppByAgentIDAndSlugParams) (WorkspaceApp, error)
@@ -118,6 +130,7 @@ type sqlcQuerier interface {
 	GetWorkspaceByID(ctx context.Context, id uuid.UUID) (Workspace, error)
 	GetWorkspaceByOwnerIDAndName(ctx context.Context, arg GetWorkspaceByOwnerIDAndNameParams) (Workspace, error)
 	GetWorkspaceCountByUserID(ctx context.Context, ownerID uuid.UUID) (int64, error)
+	GetWorkspaceEnvironmentVariablesByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]WorkspaceEnvironmentVariable, error)
 	GetWorkspaceOwnerCountsByTemplateIDs(ctx context.Context, ids []uuid.UUID) ([]GetWorkspaceOwnerCountsByTemplateIDsRow, error)
 	GetWorkspaceResourceByID(ctx context.Context, id uuid.UUID) (WorkspaceResource, error)
 	GetWorkspaceResourceMetadataByResourceID(ctx context.Context, workspaceResourceID uuid.UUID) ([]WorkspaceResourceMetadatum, error)
@@ -143,6 +156,8 @@ type sqlcQuerier interface {
 	InsertGroupMember(ctx context.Context, arg InsertGroupMemberParams) error
 	InsertLicense(ctx context.Context, arg InsertLicenseParams) (License, error)
 	InsertOrUpdateLastUpdateCheck(ctx context.Context, value string) error
+	InsertOrUpdateTemplateAgentSettings(ctx context.Context, arg InsertOrUpdateTemplateAgentSettingsParams) (TemplateAgentSetting, error)
+	InsertOrUpdateWorkspaceAgentDriftReport(ctx context.Context, arg InsertOrUpdateWorkspaceAgentDriftReportParams) (WorkspaceAgentDriftReport, error)
 	InsertOrganization(ctx context.Context, arg InsertOrganizationParams) (Organization, error)
 	InsertOrganizationMember(ctx context.Context, arg InsertOrganizationMemberParams) (OrganizationMember, error)
 	InsertParameterSchema(ctx context.Context, arg InsertParameterSchemaParams) (ParameterSchema, error)
@@ -155,10 +170,16 @@ type sqlcQuerier interface {
 	InsertTemplateVersion(ctx context.Context, arg InsertTemplateVersionParams) (TemplateVersion, error)
 	InsertUser(ctx context.Context, arg InsertUserParams) (User, error)
 	InsertUserLink(ctx context.Context, arg InsertUserLinkParams) (UserLink, error)
+	InsertUserSSHPublicKey(ctx context.Context, arg InsertUserSSHPublicKeyParams) (UserSSHPublicKey, error)
 	InsertWorkspace(ctx context.Context, arg InsertWorkspaceParams) (Workspace, error)
 	InsertWorkspaceAgent(ctx context.Context, arg InsertWorkspaceAgentParams) (WorkspaceAgent, error)
+	// Agents retry batches that failed to send, so events that were already
+	// inserted are ignored.
+	InsertWorkspaceAgentConnectionEvents(ctx context.Context, arg InsertWorkspaceAgentConnectionEventsParams) error
+	InsertWorkspaceAgentDeclaredPort(ctx context.Context, arg InsertWorkspaceAgentDeclaredPortParams) (WorkspaceAgentDeclaredPort, error)
 	InsertWorkspaceApp(ctx context.Context, arg InsertWorkspaceAppParams) (WorkspaceApp, error)
 	InsertWorkspaceBuild(ctx context.Context, arg InsertWorkspaceBuildParams) (WorkspaceBuild, error)
+	InsertWorkspaceEnvironmentVariable(ctx context.Context, arg InsertWorkspaceEnvironmentVariableParams) (WorkspaceEnvironmentVariable, error)
 	InsertWorkspaceResource(ctx context.Context, arg InsertWorkspaceResourceParams) (WorkspaceResource, error)
 	InsertWorkspaceResourceMetadata(ctx context.Context, arg InsertWorkspaceResourceMetadataParams) (WorkspaceResourceMetadatum, error)
 	ParameterValue(ctx context.Context, id uuid.UUID) (ParameterValue, error)
@@ -189,6 +210,7 @@ type sqlcQuerier interface {
 	UpdateUserStatus(ctx context.Context, arg UpdateUserStatusParams) (User, error)
 	UpdateWorkspace(ctx context.Context, arg UpdateWorkspaceParams) (Workspace, error)
 	UpdateWorkspaceAgentConnectionByID(ctx context.Context, arg UpdateWorkspaceAgentConnectionByIDParams) error
+	UpdateWorkspaceAgentIdentityPublicKeyByID(ctx context.Context, arg UpdateWorkspaceAgentIdentityPublicKeyByIDParams) error
 	UpdateWorkspaceAgentVersionByID(ctx context.Context, arg UpdateWorkspaceAgentVersionByIDParams) error
 	UpdateWorkspaceAppHealthByID(ctx context.Context, arg UpdateWorkspaceAppHealthByIDParams) error
 	UpdateWorkspaceAutostart(ctx context.Context, arg UpdateWorkspaceAutostartParams) error
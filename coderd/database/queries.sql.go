@@ -3009,6 +3009,86 @@ func (q *sqlQuerier) InsertOrUpdateLastUpdateCheck(ctx context.Context, value st
 	return err
 }
 
+const getTemplateAgentSettingsByTemplateID = `-- name: GetTemplateAgentSettingsByTemplateID :one
+SELECT
+	template_id, disable_direct_connections, updated_at, quick_actions, feature_flags, reconnecting_pty_timeout_seconds, language_servers
+FROM
+	template_agent_settings
+WHERE
+	template_id = $1
+`
+
+func (q *sqlQuerier) GetTemplateAgentSettingsByTemplateID(ctx context.Context, templateID uuid.UUID) (TemplateAgentSetting, error) {
+	row := q.db.QueryRowContext(ctx, getTemplateAgentSettingsByTemplateID, templateID)
+	var i TemplateAgentSetting
+	err := row.Scan(
+		&i.TemplateID,
+		&i.DisableDirectConnections,
+		&i.UpdatedAt,
+		&i.QuickActions,
+		&i.FeatureFlags,
+		&i.ReconnectingPTYTimeoutSeconds,
+		&i.LanguageServers,
+	)
+	return i, err
+}
+
+const insertOrUpdateTemplateAgentSettings = `-- name: InsertOrUpdateTemplateAgentSettings :one
+INSERT INTO
+	template_agent_settings (
+		template_id,
+		disable_direct_connections,
+		quick_actions,
+		feature_flags,
+		reconnecting_pty_timeout_seconds,
+		language_servers,
+		updated_at
+	)
+VALUES
+	($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (template_id) DO UPDATE SET
+	disable_direct_connections = $2,
+	quick_actions = $3,
+	feature_flags = $4,
+	reconnecting_pty_timeout_seconds = $5,
+	language_servers = $6,
+	updated_at = $7
+RETURNING template_id, disable_direct_connections, updated_at, quick_actions, feature_flags, reconnecting_pty_timeout_seconds, language_servers
+`
+
+type InsertOrUpdateTemplateAgentSettingsParams struct {
+	TemplateID                    uuid.UUID       `db:"template_id" json:"template_id"`
+	DisableDirectConnections      bool            `db:"disable_direct_connections" json:"disable_direct_connections"`
+	QuickActions                  json.RawMessage `db:"quick_actions" json:"quick_actions"`
+	FeatureFlags                  json.RawMessage `db:"feature_flags" json:"feature_flags"`
+	ReconnectingPTYTimeoutSeconds int32           `db:"reconnecting_pty_timeout_seconds" json:"reconnecting_pty_timeout_seconds"`
+	LanguageServers               json.RawMessage `db:"language_servers" json:"language_servers"`
+	UpdatedAt                     time.Time       `db:"updated_at" json:"updated_at"`
+}
+
+func (q *sqlQuerier) InsertOrUpdateTemplateAgentSettings(ctx context.Context, arg InsertOrUpdateTemplateAgentSettingsParams) (TemplateAgentSetting, error) {
+	row := q.db.QueryRowContext(ctx, insertOrUpdateTemplateAgentSettings,
+		arg.TemplateID,
+		arg.DisableDirectConnections,
+		arg.QuickActions,
+		arg.FeatureFlags,
+		arg.ReconnectingPTYTimeoutSeconds,
+		arg.LanguageServers,
+		arg.UpdatedAt,
+	)
+	var i TemplateAgentSetting
+	err := row.Scan(
+		&i.TemplateID,
+		&i.DisableDirectConnections,
+		&i.UpdatedAt,
+		&i.QuickActions,
+		&i.FeatureFlags,
+		&i.ReconnectingPTYTimeoutSeconds,
+		&i.LanguageServers,
+	)
+	return i, err
+}
+
 const getTemplateAverageBuildTime = `-- name: GetTemplateAverageBuildTime :one
 WITH build_times AS (
 SELECT
@@ -4037,6 +4117,126 @@ func (q *sqlQuerier) UpdateUserLinkedID(ctx context.Context, arg UpdateUserLinke
 	return i, err
 }
 
+const deleteUserSSHPublicKey = `-- name: DeleteUserSSHPublicKey :exec
+DELETE FROM
+	user_ssh_public_keys
+WHERE
+	id = $1
+`
+
+func (q *sqlQuerier) DeleteUserSSHPublicKey(ctx context.Context, id uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, deleteUserSSHPublicKey, id)
+	return err
+}
+
+const getUserSSHPublicKeyByID = `-- name: GetUserSSHPublicKeyByID :one
+SELECT
+	id, user_id, created_at, name, public_key, fingerprint
+FROM
+	user_ssh_public_keys
+WHERE
+	id = $1
+`
+
+func (q *sqlQuerier) GetUserSSHPublicKeyByID(ctx context.Context, id uuid.UUID) (UserSSHPublicKey, error) {
+	row := q.db.QueryRowContext(ctx, getUserSSHPublicKeyByID, id)
+	var i UserSSHPublicKey
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CreatedAt,
+		&i.Name,
+		&i.PublicKey,
+		&i.Fingerprint,
+	)
+	return i, err
+}
+
+const getUserSSHPublicKeysByUserID = `-- name: GetUserSSHPublicKeysByUserID :many
+SELECT
+	id, user_id, created_at, name, public_key, fingerprint
+FROM
+	user_ssh_public_keys
+WHERE
+	user_id = $1
+ORDER BY
+	created_at ASC
+`
+
+func (q *sqlQuerier) GetUserSSHPublicKeysByUserID(ctx context.Context, userID uuid.UUID) ([]UserSSHPublicKey, error) {
+	rows, err := q.db.QueryContext(ctx, getUserSSHPublicKeysByUserID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []UserSSHPublicKey
+	for rows.Next() {
+		var i UserSSHPublicKey
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.CreatedAt,
+			&i.Name,
+			&i.PublicKey,
+			&i.Fingerprint,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertUserSSHPublicKey = `-- name: InsertUserSSHPublicKey :one
+INSERT INTO
+	user_ssh_public_keys (
+		id,
+		user_id,
+		created_at,
+		name,
+		public_key,
+		fingerprint
+	)
+VALUES
+	($1, $2, $3, $4, $5, $6) RETURNING id, user_id, created_at, name, public_key, fingerprint
+`
+
+type InsertUserSSHPublicKeyParams struct {
+	ID          uuid.UUID `db:"id" json:"id"`
+	UserID      uuid.UUID `db:"user_id" json:"user_id"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	Name        string    `db:"name" json:"name"`
+	PublicKey   string    `db:"public_key" json:"public_key"`
+	Fingerprint string    `db:"fingerprint" json:"fingerprint"`
+}
+
+func (q *sqlQuerier) InsertUserSSHPublicKey(ctx context.Context, arg InsertUserSSHPublicKeyParams) (UserSSHPublicKey, error) {
+	row := q.db.QueryRowContext(ctx, insertUserSSHPublicKey,
+		arg.ID,
+		arg.UserID,
+		arg.CreatedAt,
+		arg.Name,
+		arg.PublicKey,
+		arg.Fingerprint,
+	)
+	var i UserSSHPublicKey
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.CreatedAt,
+		&i.Name,
+		&i.PublicKey,
+		&i.Fingerprint,
+	)
+	return i, err
+}
+
 const getActiveUserCount = `-- name: GetActiveUserCount :one
 SELECT
 	COUNT(*)
@@ -4676,9 +4876,352 @@ func (q *sqlQuerier) UpdateUserStatus(ctx context.Context, arg UpdateUserStatusP
 	return i, err
 }
 
+const getWorkspaceAgentConnectionEventsByWorkspaceID = `-- name: GetWorkspaceAgentConnectionEventsByWorkspaceID :many
+SELECT
+	id, workspace_id, agent_id, connection_id, session_id, type, action, created_at, peer, ssh_user, command, destination
+FROM
+	workspace_agent_connection_events
+WHERE
+	workspace_id = $1
+ORDER BY
+	-- The most recent events come first, and events that share a
+	-- timestamp are ordered consistently for pagination.
+	(created_at, id) DESC OFFSET $2
+LIMIT
+	-- A null limit means "no limit", so 0 means return all
+	NULLIF($3 :: int, 0)
+`
+
+type GetWorkspaceAgentConnectionEventsByWorkspaceIDParams struct {
+	WorkspaceID uuid.UUID `db:"workspace_id" json:"workspace_id"`
+	OffsetOpt   int32     `db:"offset_opt" json:"offset_opt"`
+	LimitOpt    int32     `db:"limit_opt" json:"limit_opt"`
+}
+
+func (q *sqlQuerier) GetWorkspaceAgentConnectionEventsByWorkspaceID(ctx context.Context, arg GetWorkspaceAgentConnectionEventsByWorkspaceIDParams) ([]WorkspaceAgentConnectionEvent, error) {
+	rows, err := q.db.QueryContext(ctx, getWorkspaceAgentConnectionEventsByWorkspaceID, arg.WorkspaceID, arg.OffsetOpt, arg.LimitOpt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WorkspaceAgentConnectionEvent
+	for rows.Next() {
+		var i WorkspaceAgentConnectionEvent
+		if err := rows.Scan(
+			&i.ID,
+			&i.WorkspaceID,
+			&i.AgentID,
+			&i.ConnectionID,
+			&i.SessionID,
+			&i.Type,
+			&i.Action,
+			&i.CreatedAt,
+			&i.Peer,
+			&i.SSHUser,
+			&i.Command,
+			&i.Destination,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertWorkspaceAgentConnectionEvents = `-- name: InsertWorkspaceAgentConnectionEvents :exec
+INSERT INTO
+	workspace_agent_connection_events (
+		id,
+		workspace_id,
+		agent_id,
+		connection_id,
+		session_id,
+		type,
+		action,
+		created_at,
+		peer,
+		ssh_user,
+		command,
+		destination
+	)
+SELECT
+	unnest($1 :: uuid [ ]) AS id,
+	$2 :: uuid AS workspace_id,
+	$3 :: uuid AS agent_id,
+	unnest($4 :: uuid [ ]) AS connection_id,
+	unnest($5 :: text [ ]) AS session_id,
+	unnest($6 :: workspace_agent_connection_type [ ]) AS type,
+	unnest($7 :: workspace_agent_connection_action [ ]) AS action,
+	unnest($8 :: timestamptz [ ]) AS created_at,
+	unnest($9 :: text [ ]) AS peer,
+	unnest($10 :: text [ ]) AS ssh_user,
+	unnest($11 :: text [ ]) AS command,
+	unnest($12 :: text [ ]) AS destination
+ON CONFLICT (id) DO NOTHING
+`
+
+type InsertWorkspaceAgentConnectionEventsParams struct {
+	ID           []uuid.UUID                      `db:"id" json:"id"`
+	WorkspaceID  uuid.UUID                        `db:"workspace_id" json:"workspace_id"`
+	AgentID      uuid.UUID                        `db:"agent_id" json:"agent_id"`
+	ConnectionID []uuid.UUID                      `db:"connection_id" json:"connection_id"`
+	SessionID    []string                         `db:"session_id" json:"session_id"`
+	Type         []WorkspaceAgentConnectionType   `db:"type" json:"type"`
+	Action       []WorkspaceAgentConnectionAction `db:"action" json:"action"`
+	CreatedAt    []time.Time                      `db:"created_at" json:"created_at"`
+	Peer         []string                         `db:"peer" json:"peer"`
+	SSHUser      []string                         `db:"ssh_user" json:"ssh_user"`
+	Command      []string                         `db:"command" json:"command"`
+	Destination  []string                         `db:"destination" json:"destination"`
+}
+
+// Agents retry batches that failed to send, so events that were already
+// inserted are ignored.
+func (q *sqlQuerier) InsertWorkspaceAgentConnectionEvents(ctx context.Context, arg InsertWorkspaceAgentConnectionEventsParams) error {
+	_, err := q.db.ExecContext(ctx, insertWorkspaceAgentConnectionEvents,
+		pq.Array(arg.ID),
+		arg.WorkspaceID,
+		arg.AgentID,
+		pq.Array(arg.ConnectionID),
+		pq.Array(arg.SessionID),
+		pq.Array(arg.Type),
+		pq.Array(arg.Action),
+		pq.Array(arg.CreatedAt),
+		pq.Array(arg.Peer),
+		pq.Array(arg.SSHUser),
+		pq.Array(arg.Command),
+		pq.Array(arg.Destination),
+	)
+	return err
+}
+
+const deleteWorkspaceAgentDeclaredPortsByAgentID = `-- name: DeleteWorkspaceAgentDeclaredPortsByAgentID :exec
+DELETE FROM
+	workspace_agent_declared_ports
+WHERE
+	agent_id = $1
+`
+
+func (q *sqlQuerier) DeleteWorkspaceAgentDeclaredPortsByAgentID(ctx context.Context, agentID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, deleteWorkspaceAgentDeclaredPortsByAgentID, agentID)
+	return err
+}
+
+const getWorkspaceAgentDeclaredPortsByAgentID = `-- name: GetWorkspaceAgentDeclaredPortsByAgentID :many
+SELECT
+	agent_id, port, name, created_at
+FROM
+	workspace_agent_declared_ports
+WHERE
+	agent_id = $1
+ORDER BY
+	port ASC
+`
+
+func (q *sqlQuerier) GetWorkspaceAgentDeclaredPortsByAgentID(ctx context.Context, agentID uuid.UUID) ([]WorkspaceAgentDeclaredPort, error) {
+	rows, err := q.db.QueryContext(ctx, getWorkspaceAgentDeclaredPortsByAgentID, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WorkspaceAgentDeclaredPort
+	for rows.Next() {
+		var i WorkspaceAgentDeclaredPort
+		if err := rows.Scan(
+			&i.AgentID,
+			&i.Port,
+			&i.Name,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertWorkspaceAgentDeclaredPort = `-- name: InsertWorkspaceAgentDeclaredPort :one
+INSERT INTO
+	workspace_agent_declared_ports (
+		agent_id,
+		port,
+		name,
+		created_at
+	)
+VALUES
+	($1, $2, $3, $4) RETURNING agent_id, port, name, created_at
+`
+
+type InsertWorkspaceAgentDeclaredPortParams struct {
+	AgentID   uuid.UUID `db:"agent_id" json:"agent_id"`
+	Port      int32     `db:"port" json:"port"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+func (q *sqlQuerier) InsertWorkspaceAgentDeclaredPort(ctx context.Context, arg InsertWorkspaceAgentDeclaredPortParams) (WorkspaceAgentDeclaredPort, error) {
+	row := q.db.QueryRowContext(ctx, insertWorkspaceAgentDeclaredPort,
+		arg.AgentID,
+		arg.Port,
+		arg.Name,
+		arg.CreatedAt,
+	)
+	var i WorkspaceAgentDeclaredPort
+	err := row.Scan(
+		&i.AgentID,
+		&i.Port,
+		&i.Name,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getWorkspaceAgentDriftReportByAgentID = `-- name: GetWorkspaceAgentDriftReportByAgentID :one
+SELECT
+	agent_id, workspace_id, checked_at, checks, drifted, drifts
+FROM
+	workspace_agent_drift_reports
+WHERE
+	agent_id = $1
+`
+
+func (q *sqlQuerier) GetWorkspaceAgentDriftReportByAgentID(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentDriftReport, error) {
+	row := q.db.QueryRowContext(ctx, getWorkspaceAgentDriftReportByAgentID, agentID)
+	var i WorkspaceAgentDriftReport
+	err := row.Scan(
+		&i.AgentID,
+		&i.WorkspaceID,
+		&i.CheckedAt,
+		&i.Checks,
+		&i.Drifted,
+		&i.Drifts,
+	)
+	return i, err
+}
+
+const getWorkspaceAgentDriftReportsByTemplateID = `-- name: GetWorkspaceAgentDriftReportsByTemplateID :many
+SELECT
+	workspace_agent_drift_reports.agent_id, workspace_agent_drift_reports.workspace_id, workspace_agent_drift_reports.checked_at, workspace_agent_drift_reports.checks, workspace_agent_drift_reports.drifted, workspace_agent_drift_reports.drifts
+FROM
+	workspace_agent_drift_reports
+	INNER JOIN workspaces ON workspaces.id = workspace_agent_drift_reports.workspace_id
+	INNER JOIN workspace_agents ON workspace_agents.id = workspace_agent_drift_reports.agent_id
+	INNER JOIN workspace_resources ON workspace_resources.id = workspace_agents.resource_id
+	INNER JOIN workspace_builds ON workspace_builds.job_id = workspace_resources.job_id
+WHERE
+	workspaces.template_id = $1
+	AND workspaces.deleted = false
+	AND workspace_builds.build_number = (
+		SELECT
+			max(latest_builds.build_number)
+		FROM
+			workspace_builds AS latest_builds
+		WHERE
+			latest_builds.workspace_id = workspaces.id
+	)
+ORDER BY
+	-- Drifted agents come first.
+	workspace_agent_drift_reports.drifted DESC,
+	workspace_agent_drift_reports.checked_at DESC
+`
+
+// Only the agents of the latest builds of workspaces are included, since
+// the agents of previous builds no longer run.
+func (q *sqlQuerier) GetWorkspaceAgentDriftReportsByTemplateID(ctx context.Context, templateID uuid.UUID) ([]WorkspaceAgentDriftReport, error) {
+	rows, err := q.db.QueryContext(ctx, getWorkspaceAgentDriftReportsByTemplateID, templateID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WorkspaceAgentDriftReport
+	for rows.Next() {
+		var i WorkspaceAgentDriftReport
+		if err := rows.Scan(
+			&i.AgentID,
+			&i.WorkspaceID,
+			&i.CheckedAt,
+			&i.Checks,
+			&i.Drifted,
+			&i.Drifts,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertOrUpdateWorkspaceAgentDriftReport = `-- name: InsertOrUpdateWorkspaceAgentDriftReport :one
+INSERT INTO
+	workspace_agent_drift_reports (
+		agent_id,
+		workspace_id,
+		checked_at,
+		checks,
+		drifted,
+		drifts
+	)
+VALUES
+	($1, $2, $3, $4, $5, $6)
+ON CONFLICT (agent_id) DO UPDATE SET
+	checked_at = $3,
+	checks = $4,
+	drifted = $5,
+	drifts = $6
+RETURNING agent_id, workspace_id, checked_at, checks, drifted, drifts
+`
+
+type InsertOrUpdateWorkspaceAgentDriftReportParams struct {
+	AgentID     uuid.UUID       `db:"agent_id" json:"agent_id"`
+	WorkspaceID uuid.UUID       `db:"workspace_id" json:"workspace_id"`
+	CheckedAt   time.Time       `db:"checked_at" json:"checked_at"`
+	Checks      int32           `db:"checks" json:"checks"`
+	Drifted     bool            `db:"drifted" json:"drifted"`
+	Drifts      json.RawMessage `db:"drifts" json:"drifts"`
+}
+
+func (q *sqlQuerier) InsertOrUpdateWorkspaceAgentDriftReport(ctx context.Context, arg InsertOrUpdateWorkspaceAgentDriftReportParams) (WorkspaceAgentDriftReport, error) {
+	row := q.db.QueryRowContext(ctx, insertOrUpdateWorkspaceAgentDriftReport,
+		arg.AgentID,
+		arg.WorkspaceID,
+		arg.CheckedAt,
+		arg.Checks,
+		arg.Drifted,
+		arg.Drifts,
+	)
+	var i WorkspaceAgentDriftReport
+	err := row.Scan(
+		&i.AgentID,
+		&i.WorkspaceID,
+		&i.CheckedAt,
+		&i.Checks,
+		&i.Drifted,
+		&i.Drifts,
+	)
+	return i, err
+}
+
 const getWorkspaceAgentByAuthToken = `-- name: GetWorkspaceAgentByAuthToken :one
 SELECT
-	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file
+	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file, identity_public_key
 FROM
 	workspace_agents
 WHERE
@@ -4713,13 +5256,14 @@ func (q *sqlQuerier) GetWorkspaceAgentByAuthToken(ctx context.Context, authToken
 		&i.ConnectionTimeoutSeconds,
 		&i.TroubleshootingURL,
 		&i.MOTDFile,
+		&i.IdentityPublicKey,
 	)
 	return i, err
 }
 
 const getWorkspaceAgentByID = `-- name: GetWorkspaceAgentByID :one
 SELECT
-	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file
+	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file, identity_public_key
 FROM
 	workspace_agents
 WHERE
@@ -4752,13 +5296,14 @@ func (q *sqlQuerier) GetWorkspaceAgentByID(ctx context.Context, id uuid.UUID) (W
 		&i.ConnectionTimeoutSeconds,
 		&i.TroubleshootingURL,
 		&i.MOTDFile,
+		&i.IdentityPublicKey,
 	)
 	return i, err
 }
 
 const getWorkspaceAgentByInstanceID = `-- name: GetWorkspaceAgentByInstanceID :one
 SELECT
-	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file
+	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file, identity_public_key
 FROM
 	workspace_agents
 WHERE
@@ -4793,13 +5338,14 @@ func (q *sqlQuerier) GetWorkspaceAgentByInstanceID(ctx context.Context, authInst
 		&i.ConnectionTimeoutSeconds,
 		&i.TroubleshootingURL,
 		&i.MOTDFile,
+		&i.IdentityPublicKey,
 	)
 	return i, err
 }
 
 const getWorkspaceAgentsByResourceIDs = `-- name: GetWorkspaceAgentsByResourceIDs :many
 SELECT
-	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file
+	id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file, identity_public_key
 FROM
 	workspace_agents
 WHERE
@@ -4838,6 +5384,7 @@ func (q *sqlQuerier) GetWorkspaceAgentsByResourceIDs(ctx context.Context, ids []
 			&i.ConnectionTimeoutSeconds,
 			&i.TroubleshootingURL,
 			&i.MOTDFile,
+			&i.IdentityPublicKey,
 		); err != nil {
 			return nil, err
 		}
@@ -4853,7 +5400,7 @@ func (q *sqlQuerier) GetWorkspaceAgentsByResourceIDs(ctx context.Context, ids []
 }
 
 const getWorkspaceAgentsCreatedAfter = `-- name: GetWorkspaceAgentsCreatedAfter :many
-SELECT id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file FROM workspace_agents WHERE created_at > $1
+SELECT id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file, identity_public_key FROM workspace_agents WHERE created_at > $1
 `
 
 func (q *sqlQuerier) GetWorkspaceAgentsCreatedAfter(ctx context.Context, createdAt time.Time) ([]WorkspaceAgent, error) {
@@ -4888,6 +5435,7 @@ func (q *sqlQuerier) GetWorkspaceAgentsCreatedAfter(ctx context.Context, created
 			&i.ConnectionTimeoutSeconds,
 			&i.TroubleshootingURL,
 			&i.MOTDFile,
+			&i.IdentityPublicKey,
 		); err != nil {
 			return nil, err
 		}
@@ -4924,7 +5472,7 @@ INSERT INTO
 		motd_file
 	)
 VALUES
-	($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file
+	($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id, created_at, updated_at, name, first_connected_at, last_connected_at, disconnected_at, resource_id, auth_token, auth_instance_id, architecture, environment_variables, operating_system, startup_script, instance_metadata, resource_metadata, directory, version, last_connected_replica_id, connection_timeout_seconds, troubleshooting_url, motd_file, identity_public_key
 `
 
 type InsertWorkspaceAgentParams struct {
@@ -4991,6 +5539,7 @@ func (q *sqlQuerier) InsertWorkspaceAgent(ctx context.Context, arg InsertWorkspa
 		&i.ConnectionTimeoutSeconds,
 		&i.TroubleshootingURL,
 		&i.MOTDFile,
+		&i.IdentityPublicKey,
 	)
 	return i, err
 }
@@ -5029,6 +5578,25 @@ func (q *sqlQuerier) UpdateWorkspaceAgentConnectionByID(ctx context.Context, arg
 	return err
 }
 
+const updateWorkspaceAgentIdentityPublicKeyByID = `-- name: UpdateWorkspaceAgentIdentityPublicKeyByID :exec
+UPDATE
+	workspace_agents
+SET
+	identity_public_key = $2
+WHERE
+	id = $1
+`
+
+type UpdateWorkspaceAgentIdentityPublicKeyByIDParams struct {
+	ID                uuid.UUID `db:"id" json:"id"`
+	IdentityPublicKey []byte    `db:"identity_public_key" json:"identity_public_key"`
+}
+
+func (q *sqlQuerier) UpdateWorkspaceAgentIdentityPublicKeyByID(ctx context.Context, arg UpdateWorkspaceAgentIdentityPublicKeyByIDParams) error {
+	_, err := q.db.ExecContext(ctx, updateWorkspaceAgentIdentityPublicKeyByID, arg.ID, arg.IdentityPublicKey)
+	return err
+}
+
 const updateWorkspaceAgentVersionByID = `-- name: UpdateWorkspaceAgentVersionByID :exec
 UPDATE
 	workspace_agents
@@ -5814,6 +6382,93 @@ func (q *sqlQuerier) UpdateWorkspaceBuildCostByID(ctx context.Context, arg Updat
 	return i, err
 }
 
+const deleteWorkspaceEnvironmentVariablesByWorkspaceID = `-- name: DeleteWorkspaceEnvironmentVariablesByWorkspaceID :exec
+DELETE FROM
+	workspace_environment_variables
+WHERE
+	workspace_id = $1
+`
+
+func (q *sqlQuerier) DeleteWorkspaceEnvironmentVariablesByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, deleteWorkspaceEnvironmentVariablesByWorkspaceID, workspaceID)
+	return err
+}
+
+const getWorkspaceEnvironmentVariablesByWorkspaceID = `-- name: GetWorkspaceEnvironmentVariablesByWorkspaceID :many
+SELECT
+	workspace_id, name, value, created_at
+FROM
+	workspace_environment_variables
+WHERE
+	workspace_id = $1
+ORDER BY
+	name ASC
+`
+
+func (q *sqlQuerier) GetWorkspaceEnvironmentVariablesByWorkspaceID(ctx context.Context, workspaceID uuid.UUID) ([]WorkspaceEnvironmentVariable, error) {
+	rows, err := q.db.QueryContext(ctx, getWorkspaceEnvironmentVariablesByWorkspaceID, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WorkspaceEnvironmentVariable
+	for rows.Next() {
+		var i WorkspaceEnvironmentVariable
+		if err := rows.Scan(
+			&i.WorkspaceID,
+			&i.Name,
+			&i.Value,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const insertWorkspaceEnvironmentVariable = `-- name: InsertWorkspaceEnvironmentVariable :one
+INSERT INTO
+	workspace_environment_variables (
+		workspace_id,
+		name,
+		value,
+		created_at
+	)
+VALUES
+	($1, $2, $3, $4) RETURNING workspace_id, name, value, created_at
+`
+
+type InsertWorkspaceEnvironmentVariableParams struct {
+	WorkspaceID uuid.UUID `db:"workspace_id" json:"workspace_id"`
+	Name        string    `db:"name" json:"name"`
+	Value       string    `db:"value" json:"value"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+func (q *sqlQuerier) InsertWorkspaceEnvironmentVariable(ctx context.Context, arg InsertWorkspaceEnvironmentVariableParams) (WorkspaceEnvironmentVariable, error) {
+	row := q.db.QueryRowContext(ctx, insertWorkspaceEnvironmentVariable,
+		arg.WorkspaceID,
+		arg.Name,
+		arg.Value,
+		arg.CreatedAt,
+	)
+	var i WorkspaceEnvironmentVariable
+	err := row.Scan(
+		&i.WorkspaceID,
+		&i.Name,
+		&i.Value,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const getWorkspaceResourceByID = `-- name: GetWorkspaceResourceByID :one
 SELECT
 	id, created_at, job_id, transition, type, name, hide, icon, instance_type, daily_cost
@@ -0,0 +1,29 @@
+-- name: GetTemplateAgentSettingsByTemplateID :one
+SELECT
+	*
+FROM
+	template_agent_settings
+WHERE
+	template_id = $1;
+
+-- name: InsertOrUpdateTemplateAgentSettings :one
+INSERT INTO
+	template_agent_settings (
+		template_id,
+		disable_direct_connections,
+		quick_actions,
+		feature_flags,
+		reconnecting_pty_timeout_seconds,
+		language_servers,
+		updated_at
+	)
+VALUES
+	($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (template_id) DO UPDATE SET
+	disable_direct_connections = $2,
+	quick_actions = $3,
+	feature_flags = $4,
+	reconnecting_pty_timeout_seconds = $5,
+	language_servers = $6,
+	updated_at = $7
+RETURNING *;
@@ -0,0 +1,36 @@
+-- name: InsertUserSSHPublicKey :one
+INSERT INTO
+	user_ssh_public_keys (
+		id,
+		user_id,
+		created_at,
+		name,
+		public_key,
+		fingerprint
+	)
+VALUES
+	($1, $2, $3, $4, $5, $6) RETURNING *;
+
+-- name: GetUserSSHPublicKeyByID :one
+SELECT
+	*
+FROM
+	user_ssh_public_keys
+WHERE
+	id = $1;
+
+-- name: GetUserSSHPublicKeysByUserID :many
+SELECT
+	*
+FROM
+	user_ssh_public_keys
+WHERE
+	user_id = $1
+ORDER BY
+	created_at ASC;
+
+-- name: DeleteUserSSHPublicKey :exec
+DELETE FROM
+	user_ssh_public_keys
+WHERE
+	id = $1;
@@ -0,0 +1,47 @@
+-- name: InsertWorkspaceAgentConnectionEvents :exec
+-- Agents retry batches that failed to send, so events that were already
+-- inserted are ignored.
+INSERT INTO
+	workspace_agent_connection_events (
+		id,
+		workspace_id,
+		agent_id,
+		connection_id,
+		session_id,
+		type,
+		action,
+		created_at,
+		peer,
+		ssh_user,
+		command,
+		destination
+	)
+SELECT
+	unnest(@id :: uuid [ ]) AS id,
+	@workspace_id :: uuid AS workspace_id,
+	@agent_id :: uuid AS agent_id,
+	unnest(@connection_id :: uuid [ ]) AS connection_id,
+	unnest(@session_id :: text [ ]) AS session_id,
+	unnest(@type :: workspace_agent_connection_type [ ]) AS type,
+	unnest(@action :: workspace_agent_connection_action [ ]) AS action,
+	unnest(@created_at :: timestamptz [ ]) AS created_at,
+	unnest(@peer :: text [ ]) AS peer,
+	unnest(@ssh_user :: text [ ]) AS ssh_user,
+	unnest(@command :: text [ ]) AS command,
+	unnest(@destination :: text [ ]) AS destination
+ON CONFLICT (id) DO NOTHING;
+
+-- name: GetWorkspaceAgentConnectionEventsByWorkspaceID :many
+SELECT
+	*
+FROM
+	workspace_agent_connection_events
+WHERE
+	workspace_id = @workspace_id
+ORDER BY
+	-- The most recent events come first, and events that share a
+	-- timestamp are ordered consistently for pagination.
+	(created_at, id) DESC OFFSET @offset_opt
+LIMIT
+	-- A null limit means "no limit", so 0 means return all
+	NULLIF(@limit_opt :: int, 0);
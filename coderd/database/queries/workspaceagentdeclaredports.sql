@@ -0,0 +1,26 @@
+-- name: GetWorkspaceAgentDeclaredPortsByAgentID :many
+SELECT
+	*
+FROM
+	workspace_agent_declared_ports
+WHERE
+	agent_id = $1
+ORDER BY
+	port ASC;
+
+-- name: DeleteWorkspaceAgentDeclaredPortsByAgentID :exec
+DELETE FROM
+	workspace_agent_declared_ports
+WHERE
+	agent_id = $1;
+
+-- name: InsertWorkspaceAgentDeclaredPort :one
+INSERT INTO
+	workspace_agent_declared_ports (
+		agent_id,
+		port,
+		name,
+		created_at
+	)
+VALUES
+	($1, $2, $3, $4) RETURNING *;
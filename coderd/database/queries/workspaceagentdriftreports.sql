@@ -0,0 +1,53 @@
+-- name: InsertOrUpdateWorkspaceAgentDriftReport :one
+INSERT INTO
+	workspace_agent_drift_reports (
+		agent_id,
+		workspace_id,
+		checked_at,
+		checks,
+		drifted,
+		drifts
+	)
+VALUES
+	($1, $2, $3, $4, $5, $6)
+ON CONFLICT (agent_id) DO UPDATE SET
+	checked_at = $3,
+	checks = $4,
+	drifted = $5,
+	drifts = $6
+RETURNING *;
+
+-- name: GetWorkspaceAgentDriftReportByAgentID :one
+SELECT
+	*
+FROM
+	workspace_agent_drift_reports
+WHERE
+	agent_id = $1;
+
+-- name: GetWorkspaceAgentDriftReportsByTemplateID :many
+-- Only the agents of the latest builds of workspaces are included, since
+-- the agents of previous builds no longer run.
+SELECT
+	workspace_agent_drift_reports.*
+FROM
+	workspace_agent_drift_reports
+	INNER JOIN workspaces ON workspaces.id = workspace_agent_drift_reports.workspace_id
+	INNER JOIN workspace_agents ON workspace_agents.id = workspace_agent_drift_reports.agent_id
+	INNER JOIN workspace_resources ON workspace_resources.id = workspace_agents.resource_id
+	INNER JOIN workspace_builds ON workspace_builds.job_id = workspace_resources.job_id
+WHERE
+	workspaces.template_id = $1
+	AND workspaces.deleted = false
+	AND workspace_builds.build_number = (
+		SELECT
+			max(latest_builds.build_number)
+		FROM
+			workspace_builds AS latest_builds
+		WHERE
+			latest_builds.workspace_id = workspaces.id
+	)
+ORDER BY
+	-- Drifted agents come first.
+	workspace_agent_drift_reports.drifted DESC,
+	workspace_agent_drift_reports.checked_at DESC;
@@ -73,6 +73,14 @@ SET
 WHERE
 	id = $1;
 
+-- name: UpdateWorkspaceAgentIdentityPublicKeyByID :exec
+UPDATE
+	workspace_agents
+SET
+	identity_public_key = $2
+WHERE
+	id = $1;
+
 -- name: UpdateWorkspaceAgentVersionByID :exec
 UPDATE
 	workspace_agents
@@ -0,0 +1,26 @@
+-- name: GetWorkspaceEnvironmentVariablesByWorkspaceID :many
+SELECT
+	*
+FROM
+	workspace_environment_variables
+WHERE
+	workspace_id = $1
+ORDER BY
+	name ASC;
+
+-- name: DeleteWorkspaceEnvironmentVariablesByWorkspaceID :exec
+DELETE FROM
+	workspace_environment_variables
+WHERE
+	workspace_id = $1;
+
+-- name: InsertWorkspaceEnvironmentVariable :one
+INSERT INTO
+	workspace_environment_variables (
+		workspace_id,
+		name,
+		value,
+		created_at
+	)
+VALUES
+	($1, $2, $3, $4) RETURNING *;
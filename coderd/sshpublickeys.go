@@ -0,0 +1,201 @@
+package coderd
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/coder/coder/coderd/database"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+// maxSSHPublicKeyNameLength limits the names of SSH public keys, which
+// default to the comment of the key.
+const maxSSHPublicKeyNameLength = 128
+
+func (api *API) userSSHPublicKeys(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := httpmw.UserParam(r)
+
+	if !api.Authorize(r, rbac.ActionRead, rbac.ResourceUserData.WithOwner(user.ID.String())) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	keys, err := api.Database.GetUserSSHPublicKeysByUserID(ctx, user.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching SSH public keys.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	apiKeys := make([]codersdk.UserSSHPublicKey, 0, len(keys))
+	for _, key := range keys {
+		apiKeys = append(apiKeys, convertUserSSHPublicKey(key))
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, apiKeys)
+}
+
+func (api *API) postUserSSHPublicKey(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := httpmw.UserParam(r)
+
+	if !api.Authorize(r, rbac.ActionUpdate, rbac.ResourceUserData.WithOwner(user.ID.String())) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	var req codersdk.CreateUserSSHPublicKeyRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	publicKey, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid public key.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if _, ok := publicKey.(*gossh.Certificate); ok {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "A public key is required, not a certificate.",
+		})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = strings.TrimSpace(comment)
+	}
+	if len(name) > maxSSHPublicKeyNameLength {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid name for the public key.",
+			Validations: []codersdk.ValidationError{{
+				Field:  "name",
+				Detail: "Name must be at most 128 characters.",
+			}},
+		})
+		return
+	}
+
+	key, err := api.Database.InsertUserSSHPublicKey(ctx, database.InsertUserSSHPublicKeyParams{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		CreatedAt: database.Now(),
+		Name:      name,
+		// The comment is dropped, since the key has a name.
+		PublicKey:   strings.TrimSpace(string(gossh.MarshalAuthorizedKey(publicKey))),
+		Fingerprint: gossh.FingerprintSHA256(publicKey),
+	})
+	if database.IsUniqueViolation(err) {
+		httpapi.Write(ctx, rw, http.StatusConflict, codersdk.Response{
+			Message: "This public key was already added.",
+		})
+		return
+	}
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error adding SSH public key.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusCreated, convertUserSSHPublicKey(key))
+}
+
+func (api *API) deleteUserSSHPublicKey(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := httpmw.UserParam(r)
+
+	if !api.Authorize(r, rbac.ActionUpdate, rbac.ResourceUserData.WithOwner(user.ID.String())) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	keyID, err := uuid.Parse(chi.URLParam(r, "sshpublickey"))
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid SSH public key ID.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	key, err := api.Database.GetUserSSHPublicKeyByID(ctx, keyID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && key.UserID != user.ID) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching SSH public key.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	err = api.Database.DeleteUserSSHPublicKey(ctx, key.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error deleting SSH public key.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusNoContent, nil)
+}
+
+// workspaceAgentAuthorizedKeys returns the SSH public keys of the owner of
+// the workspace, which the agent requires when the deployment enables
+// public key authentication.
+func (api *API) workspaceAgentAuthorizedKeys(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	workspace, err := api.Database.GetWorkspaceByAgentID(ctx, workspaceAgent.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching workspace.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	keys, err := api.Database.GetUserSSHPublicKeysByUserID(ctx, workspace.OwnerID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching SSH public keys.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	publicKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		publicKeys = append(publicKeys, key.PublicKey)
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.WorkspaceAgentAuthorizedKeys{
+		PublicKeys: publicKeys,
+	})
+}
+
+func convertUserSSHPublicKey(key database.UserSSHPublicKey) codersdk.UserSSHPublicKey {
+	return codersdk.UserSSHPublicKey{
+		ID:          key.ID,
+		UserID:      key.UserID,
+		CreatedAt:   key.CreatedAt,
+		Name:        key.Name,
+		PublicKey:   key.PublicKey,
+		Fingerprint: key.Fingerprint,
+	}
+}
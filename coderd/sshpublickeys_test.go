@@ -0,0 +1,154 @@
+package coderd_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/provisioner/echo"
+	"github.com/coder/coder/provisionersdk/proto"
+	"github.com/coder/coder/testutil"
+)
+
+func newSSHPublicKey(t *testing.T) gossh.PublicKey {
+	t.Helper()
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := gossh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+	return key
+}
+
+func TestUserSSHPublicKeys(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, nil)
+	user := coderdtest.CreateFirstUser(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	keys, err := client.UserSSHPublicKeys(ctx, codersdk.Me)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	publicKey := newSSHPublicKey(t)
+	key, err := client.CreateUserSSHPublicKey(ctx, codersdk.Me, codersdk.CreateUserSSHPublicKeyRequest{
+		PublicKey: strings.TrimSpace(string(gossh.MarshalAuthorizedKey(publicKey))) + " me@laptop",
+	})
+	require.NoError(t, err)
+	// The comment names the key, and is dropped from the key.
+	require.Equal(t, "me@laptop", key.Name)
+	require.Equal(t, gossh.FingerprintSHA256(publicKey), key.Fingerprint)
+	parsed, comment, _, _, err := gossh.ParseAuthorizedKey([]byte(key.PublicKey))
+	require.NoError(t, err)
+	require.Empty(t, comment)
+	require.Equal(t, publicKey.Marshal(), parsed.Marshal())
+
+	// Keys can only be added once.
+	_, err = client.CreateUserSSHPublicKey(ctx, codersdk.Me, codersdk.CreateUserSSHPublicKeyRequest{
+		Name:      "again",
+		PublicKey: string(gossh.MarshalAuthorizedKey(publicKey)),
+	})
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusConflict, apiErr.StatusCode())
+
+	_, err = client.CreateUserSSHPublicKey(ctx, codersdk.Me, codersdk.CreateUserSSHPublicKeyRequest{
+		PublicKey: "ssh-ed25519 invalid",
+	})
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+
+	keys, err = client.UserSSHPublicKeys(ctx, codersdk.Me)
+	require.NoError(t, err)
+	require.Equal(t, []codersdk.UserSSHPublicKey{key}, keys)
+
+	// Other users can't remove the key.
+	otherUser := coderdtest.CreateAnotherUser(t, client, user.OrganizationID)
+	err = otherUser.DeleteUserSSHPublicKey(ctx, codersdk.Me, key.ID)
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode())
+
+	err = client.DeleteUserSSHPublicKey(ctx, codersdk.Me, key.ID)
+	require.NoError(t, err)
+	keys, err = client.UserSSHPublicKeys(ctx, codersdk.Me)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func TestWorkspaceAgentAuthorizedKeys(t *testing.T) {
+	t.Parallel()
+
+	deploymentConfig := coderdtest.DeploymentConfig(t)
+	deploymentConfig.SSHPublicKeyAuth.Value = true
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+		DeploymentConfig:         deploymentConfig,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	metadata, err := agentClient.WorkspaceAgentMetadata(ctx)
+	require.NoError(t, err)
+	require.True(t, metadata.SSHPublicKeyAuth)
+
+	authorized, err := agentClient.WorkspaceAgentAuthorizedKeys(ctx)
+	require.NoError(t, err)
+	require.Empty(t, authorized.PublicKeys)
+
+	key, err := client.CreateUserSSHPublicKey(ctx, codersdk.Me, codersdk.CreateUserSSHPublicKeyRequest{
+		Name:      "laptop",
+		PublicKey: string(gossh.MarshalAuthorizedKey(newSSHPublicKey(t))),
+	})
+	require.NoError(t, err)
+	// Keys of other users don't authenticate to the workspace.
+	otherUser := coderdtest.CreateAnotherUser(t, client, user.OrganizationID)
+	_, err = otherUser.CreateUserSSHPublicKey(ctx, codersdk.Me, codersdk.CreateUserSSHPublicKeyRequest{
+		PublicKey: string(gossh.MarshalAuthorizedKey(newSSHPublicKey(t))),
+	})
+	require.NoError(t, err)
+
+	authorized, err = agentClient.WorkspaceAgentAuthorizedKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{key.PublicKey}, authorized.PublicKeys)
+}
@@ -25,6 +25,7 @@ import (
 
 	"github.com/coder/coder/buildinfo"
 	"github.com/coder/coder/coderd/database"
+	"github.com/coder/coder/codersdk"
 )
 
 const (
@@ -555,6 +556,19 @@ func ConvertWorkspaceAgent(agent database.WorkspaceAgent) WorkspaceAgent {
 	return snapAgent
 }
 
+// ConvertWorkspaceAgentUsage anonymizes the feature usage reported by a
+// workspace agent.
+func ConvertWorkspaceAgentUsage(usage codersdk.AgentUsage) WorkspaceAgentUsage {
+	return WorkspaceAgentUsage{
+		CreatedAt:           time.Now(),
+		SFTPSessions:        usage.SFTPSessions,
+		PortForwards:        usage.PortForwards,
+		ReversePortForwards: usage.ReversePortForwards,
+		Speedtests:          usage.Speedtests,
+		SOCKSConnections:    usage.SOCKSConnections,
+	}
+}
+
 // ConvertWorkspaceApp anonymizes a workspace app.
 func ConvertWorkspaceApp(app database.WorkspaceApp) WorkspaceApp {
 	return WorkspaceApp{
@@ -657,6 +671,7 @@ type Snapshot struct {
 	Workspaces                []Workspace                 `json:"workspaces"`
 	WorkspaceApps             []WorkspaceApp              `json:"workspace_apps"`
 	WorkspaceAgents           []WorkspaceAgent            `json:"workspace_agents"`
+	WorkspaceAgentUsages      []WorkspaceAgentUsage       `json:"workspace_agent_usages"`
 	WorkspaceBuilds           []WorkspaceBuild            `json:"workspace_build"`
 	WorkspaceResources        []WorkspaceResource         `json:"workspace_resources"`
 	WorkspaceResourceMetadata []WorkspaceResourceMetadata `json:"workspace_resource_metadata"`
@@ -743,6 +758,17 @@ type WorkspaceAgent struct {
 	ConnectionTimeoutSeconds int32      `json:"connection_timeout_seconds"`
 }
 
+// WorkspaceAgentUsage counts the features of an agent used in a stats
+// interval. It isn't associated with the agent.
+type WorkspaceAgentUsage struct {
+	CreatedAt           time.Time `json:"created_at"`
+	SFTPSessions        int64     `json:"sftp_sessions"`
+	PortForwards        int64     `json:"port_forwards"`
+	ReversePortForwards int64     `json:"reverse_port_forwards"`
+	Speedtests          int64     `json:"speedtests"`
+	SOCKSConnections    int64     `json:"socks_connections"`
+}
+
 type WorkspaceApp struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
@@ -0,0 +1,253 @@
+package coderd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/database"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+// languageServerName matches the names of language servers that agents
+// start.
+var languageServerName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+func (api *API) templateAgentSettings(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	template := httpmw.TemplateParam(r)
+	if !api.Authorize(r, rbac.ActionRead, template) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	settings, err := api.agentSettingsOfTemplate(ctx, template.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching template agent settings.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, settings)
+}
+
+// putTemplateAgentSettings replaces the agent settings of a template, and
+// notifies the agents of its workspaces.
+func (api *API) putTemplateAgentSettings(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	template := httpmw.TemplateParam(r)
+	if !api.Authorize(r, rbac.ActionUpdate, template) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	var req codersdk.TemplateAgentSettings
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	validations := validateTemplateAgentSettings(req)
+	if len(validations) > 0 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message:     "Invalid template agent settings.",
+			Validations: validations,
+		})
+		return
+	}
+	if req.QuickActions == nil {
+		req.QuickActions = []codersdk.WorkspaceAgentQuickAction{}
+	}
+	quickActions, err := json.Marshal(req.QuickActions)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error encoding quick actions.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if req.LanguageServers == nil {
+		req.LanguageServers = []codersdk.WorkspaceAgentLanguageServer{}
+	}
+	languageServers, err := json.Marshal(req.LanguageServers)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error encoding language servers.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if req.FeatureFlags == nil {
+		req.FeatureFlags = map[codersdk.WorkspaceAgentFeatureFlag]bool{}
+	}
+	featureFlags, err := json.Marshal(req.FeatureFlags)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error encoding feature flags.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	_, err = api.Database.InsertOrUpdateTemplateAgentSettings(ctx, database.InsertOrUpdateTemplateAgentSettingsParams{
+		TemplateID:                    template.ID,
+		DisableDirectConnections:      req.DisableDirectConnections,
+		QuickActions:                  quickActions,
+		FeatureFlags:                  featureFlags,
+		ReconnectingPTYTimeoutSeconds: req.ReconnectingPTYTimeoutSeconds,
+		LanguageServers:               languageServers,
+		UpdatedAt:                     database.Now(),
+	})
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error updating template agent settings.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	workspaces, err := api.Database.GetWorkspaces(ctx, database.GetWorkspacesParams{
+		TemplateIds: []uuid.UUID{template.ID},
+	})
+	if err != nil && !xerrors.Is(err, sql.ErrNoRows) {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching workspaces.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	// Agents that miss the notification get the settings when they
+	// reconnect.
+	for _, workspace := range workspaces {
+		err = api.Pubsub.Publish(workspaceAgentMetadataChannel(workspace.ID), []byte{})
+		if err != nil {
+			api.Logger.Warn(ctx, "publish workspace agent metadata change", slog.F("workspace_id", workspace.ID), slog.Error(err))
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// validateTemplateAgentSettings checks the settings that agents would
+// reject or misapply.
+func validateTemplateAgentSettings(settings codersdk.TemplateAgentSettings) []codersdk.ValidationError {
+	var validations []codersdk.ValidationError
+	if len(settings.QuickActions) > codersdk.MaxTemplateQuickActions {
+		validations = append(validations, codersdk.ValidationError{
+			Field:  "quick_actions",
+			Detail: fmt.Sprintf("must have at most %d quick actions", codersdk.MaxTemplateQuickActions),
+		})
+	}
+	names := map[string]struct{}{}
+	for index, action := range settings.QuickActions {
+		field := fmt.Sprintf("quick_actions[%d]", index)
+		if err := httpapi.NameValid(action.Name); err != nil {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".name",
+				Detail: err.Error(),
+			})
+		} else if _, ok := names[action.Name]; ok {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".name",
+				Detail: "must be unique",
+			})
+		}
+		names[action.Name] = struct{}{}
+		if strings.TrimSpace(action.Command) == "" {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".command",
+				Detail: "must not be empty",
+			})
+		}
+		if action.TimeoutSeconds < 0 {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".timeout_seconds",
+				Detail: "must not be negative",
+			})
+		}
+	}
+	languageServers := map[string]struct{}{}
+	for index, server := range settings.LanguageServers {
+		field := fmt.Sprintf("language_servers[%d]", index)
+		if !languageServerName.MatchString(server.Name) {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".name",
+				Detail: "must contain only letters, digits, dots, underscores and hyphens",
+			})
+		} else if _, ok := languageServers[server.Name]; ok {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".name",
+				Detail: "must be unique",
+			})
+		}
+		languageServers[server.Name] = struct{}{}
+		if strings.TrimSpace(server.Command) == "" {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".command",
+				Detail: "must not be empty",
+			})
+		}
+	}
+	if settings.ReconnectingPTYTimeoutSeconds < 0 {
+		validations = append(validations, codersdk.ValidationError{
+			Field:  "reconnecting_pty_timeout_seconds",
+			Detail: "must not be negative",
+		})
+	}
+	for flag := range settings.FeatureFlags {
+		if !slices.Contains(codersdk.WorkspaceAgentFeatureFlags, flag) {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  fmt.Sprintf("feature_flags.%s", flag),
+				Detail: "is not a feature flag of agents",
+			})
+		}
+	}
+	return validations
+}
+
+// agentSettingsOfTemplate returns the agent settings of a template, which
+// are the defaults if they were never set.
+func (api *API) agentSettingsOfTemplate(ctx context.Context, templateID uuid.UUID) (codersdk.TemplateAgentSettings, error) {
+	settings, err := api.Database.GetTemplateAgentSettingsByTemplateID(ctx, templateID)
+	if xerrors.Is(err, sql.ErrNoRows) {
+		return codersdk.TemplateAgentSettings{
+			QuickActions:    []codersdk.WorkspaceAgentQuickAction{},
+			FeatureFlags:    map[codersdk.WorkspaceAgentFeatureFlag]bool{},
+			LanguageServers: []codersdk.WorkspaceAgentLanguageServer{},
+		}, nil
+	}
+	if err != nil {
+		return codersdk.TemplateAgentSettings{}, err
+	}
+	return convertTemplateAgentSettings(settings)
+}
+
+func convertTemplateAgentSettings(settings database.TemplateAgentSetting) (codersdk.TemplateAgentSettings, error) {
+	converted := codersdk.TemplateAgentSettings{
+		DisableDirectConnections:      settings.DisableDirectConnections,
+		ReconnectingPTYTimeoutSeconds: settings.ReconnectingPTYTimeoutSeconds,
+	}
+	err := json.Unmarshal(settings.QuickActions, &converted.QuickActions)
+	if err != nil {
+		return codersdk.TemplateAgentSettings{}, xerrors.Errorf("unmarshal quick actions: %w", err)
+	}
+	err = json.Unmarshal(settings.FeatureFlags, &converted.FeatureFlags)
+	if err != nil {
+		return codersdk.TemplateAgentSettings{}, xerrors.Errorf("unmarshal feature flags: %w", err)
+	}
+	err = json.Unmarshal(settings.LanguageServers, &converted.LanguageServers)
+	if err != nil {
+		return codersdk.TemplateAgentSettings{}, xerrors.Errorf("unmarshal language servers: %w", err)
+	}
+	return converted, nil
+}
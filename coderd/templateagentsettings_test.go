@@ -0,0 +1,127 @@
+package coderd_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/provisioner/echo"
+	"github.com/coder/coder/provisionersdk/proto"
+	"github.com/coder/coder/testutil"
+)
+
+func TestTemplateAgentSettings(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	settings, err := client.TemplateAgentSettings(ctx, template.ID)
+	require.NoError(t, err)
+	require.Equal(t, codersdk.TemplateAgentSettings{
+		QuickActions:    []codersdk.WorkspaceAgentQuickAction{},
+		FeatureFlags:    map[codersdk.WorkspaceAgentFeatureFlag]bool{},
+		LanguageServers: []codersdk.WorkspaceAgentLanguageServer{},
+	}, settings)
+	metadata, err := agentClient.WorkspaceAgentMetadata(ctx)
+	require.NoError(t, err)
+	require.False(t, metadata.DisableDirectConnections)
+
+	changes, err := agentClient.WatchWorkspaceAgentMetadata(ctx)
+	require.NoError(t, err)
+
+	settings = codersdk.TemplateAgentSettings{
+		DisableDirectConnections: true,
+		QuickActions: []codersdk.WorkspaceAgentQuickAction{{
+			Name:           "restart-dev-server",
+			DisplayName:    "Restart dev server",
+			Command:        "systemctl --user restart dev",
+			TimeoutSeconds: 30,
+		}},
+		FeatureFlags: map[codersdk.WorkspaceAgentFeatureFlag]bool{
+			codersdk.WorkspaceAgentFeaturePTYv2:                   false,
+			codersdk.WorkspaceAgentFeatureScreenSnapshotReconnect: true,
+		},
+		ReconnectingPTYTimeoutSeconds: 600,
+		LanguageServers: []codersdk.WorkspaceAgentLanguageServer{{
+			Name:    "gopls",
+			Command: "gopls serve",
+		}},
+	}
+	err = client.UpdateTemplateAgentSettings(ctx, template.ID, settings)
+	require.NoError(t, err)
+	select {
+	case <-ctx.Done():
+		t.Fatal("agent wasn't notified of the change")
+	case <-changes:
+	}
+	got, err := client.TemplateAgentSettings(ctx, template.ID)
+	require.NoError(t, err)
+	require.Equal(t, settings, got)
+	metadata, err = agentClient.WorkspaceAgentMetadata(ctx)
+	require.NoError(t, err)
+	require.True(t, metadata.DisableDirectConnections)
+	require.Equal(t, settings.QuickActions, metadata.QuickActions)
+	require.Equal(t, settings.FeatureFlags, metadata.FeatureFlags)
+	require.False(t, metadata.FeatureEnabled(codersdk.WorkspaceAgentFeaturePTYv2, true))
+	require.EqualValues(t, 600, metadata.ReconnectingPTYTimeoutSeconds)
+	require.Equal(t, settings.LanguageServers, metadata.LanguageServers)
+
+	err = client.UpdateTemplateAgentSettings(ctx, template.ID, codersdk.TemplateAgentSettings{
+		QuickActions: []codersdk.WorkspaceAgentQuickAction{
+			{Name: "build", Command: "make"},
+			{Name: "build", Command: "make all"},
+			{Name: "Not Valid", Command: ""},
+		},
+		FeatureFlags: map[codersdk.WorkspaceAgentFeatureFlag]bool{
+			"unknown": true,
+		},
+		ReconnectingPTYTimeoutSeconds: -1,
+		LanguageServers: []codersdk.WorkspaceAgentLanguageServer{
+			{Name: "gopls", Command: ""},
+			{Name: "go pls", Command: "gopls"},
+		},
+	})
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+	require.Len(t, apiErr.Validations, 7)
+}
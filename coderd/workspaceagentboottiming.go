@@ -0,0 +1,187 @@
+package coderd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// agentBootTimingChannel is where replicas publish the boot timing
+	// they receive, since agents and clients can use different replicas.
+	agentBootTimingChannel = "workspace_agent_boot_timing"
+	// agentBootTimingTTL is how long the timing of an agent is kept after
+	// it last reported it.
+	agentBootTimingTTL = 24 * time.Hour
+)
+
+// agentBootTimingMessage is published when a replica receives a timing.
+type agentBootTimingMessage struct {
+	AgentID uuid.UUID                         `json:"agent_id"`
+	Timing  codersdk.WorkspaceAgentBootTiming `json:"timing"`
+}
+
+// agentBootTimings are the timings of the phases of starting agents,
+// keyed by agent ID. Timings are only kept in memory, and the phases are
+// observed in a histogram for optimizing the start latency of workspaces.
+type agentBootTimings struct {
+	mutex     sync.RWMutex
+	agents    map[uuid.UUID]agentBootTiming
+	lastPrune time.Time
+
+	phases *prometheus.HistogramVec
+}
+
+type agentBootTiming struct {
+	timing    codersdk.WorkspaceAgentBootTiming
+	updatedAt time.Time
+}
+
+func newAgentBootTimings(registerer prometheus.Registerer) *agentBootTimings {
+	return &agentBootTimings{
+		agents: map[uuid.UUID]agentBootTiming{},
+		phases: promauto.With(registerer).NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "coderd",
+			Subsystem: "agents",
+			Name:      "boot_phase_seconds",
+			Help:      "How long the phases of starting workspace agents took.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+		}, []string{"phase"}),
+	}
+}
+
+// bootPhases returns the phases of a timing by the label of the histogram.
+func bootPhases(timing codersdk.WorkspaceAgentBootTiming) map[string]*int64 {
+	return map[string]*int64{
+		"token_exchange":        timing.TokenExchangeMillis,
+		"metadata_fetch":        timing.MetadataFetchMillis,
+		"tailnet_up":            timing.TailnetUpMillis,
+		"coordinator_connected": timing.CoordinatorConnectedMillis,
+		"startup_script":        timing.StartupScriptMillis,
+		"first_session":         timing.FirstSessionMillis,
+	}
+}
+
+// store stores the timing of an agent. When observe is set, the phases
+// that weren't stored before are observed in the histogram.
+func (t *agentBootTimings) store(agentID uuid.UUID, timing codersdk.WorkspaceAgentBootTiming, observe bool) {
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now.Sub(t.lastPrune) >= time.Hour {
+		t.lastPrune = now
+		for id, stored := range t.agents {
+			if now.Sub(stored.updatedAt) >= agentBootTimingTTL {
+				delete(t.agents, id)
+			}
+		}
+	}
+	previous, ok := t.agents[agentID]
+	// A timing that started at a different time is of a restarted agent.
+	if !ok || !previous.timing.StartedAt.Equal(timing.StartedAt) {
+		previous = agentBootTiming{}
+	}
+	t.agents[agentID] = agentBootTiming{
+		timing:    timing,
+		updatedAt: now,
+	}
+	if !observe {
+		return
+	}
+	previousPhases := bootPhases(previous.timing)
+	for phase, millis := range bootPhases(timing) {
+		if millis == nil || previousPhases[phase] != nil {
+			continue
+		}
+		t.phases.WithLabelValues(phase).Observe(time.Duration(*millis * int64(time.Millisecond)).Seconds())
+	}
+}
+
+// get returns the timing of an agent.
+func (t *agentBootTimings) get(agentID uuid.UUID) (codersdk.WorkspaceAgentBootTiming, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	stored, ok := t.agents[agentID]
+	return stored.timing, ok
+}
+
+// subscribeAgentBootTimings stores the boot timings that agents reported
+// to other replicas.
+func (api *API) subscribeAgentBootTimings() (func(), error) {
+	return api.Pubsub.Subscribe(agentBootTimingChannel, func(ctx context.Context, message []byte) {
+		var msg agentBootTimingMessage
+		err := json.Unmarshal(message, &msg)
+		if err != nil {
+			return
+		}
+		api.agentBootTimings.store(msg.AgentID, msg.Timing, false)
+	})
+}
+
+func (api *API) postWorkspaceAgentBootTiming(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.WorkspaceAgentBootTiming
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	for phase, millis := range bootPhases(req) {
+		if millis != nil && *millis < 0 {
+			httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Boot phases can't have a negative duration.",
+				Validations: []codersdk.ValidationError{{
+					Field:  phase + "_ms",
+					Detail: "must not be negative",
+				}},
+			})
+			return
+		}
+	}
+
+	api.agentBootTimings.store(workspaceAgent.ID, req, true)
+	message, err := json.Marshal(agentBootTimingMessage{
+		AgentID: workspaceAgent.ID,
+		Timing:  req,
+	})
+	if err == nil {
+		err = api.Pubsub.Publish(agentBootTimingChannel, message)
+	}
+	if err != nil {
+		api.Logger.Warn(ctx, "publish workspace agent boot timing", slog.F("agent_id", workspaceAgent.ID), slog.Error(err))
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Stored boot timing.",
+	})
+}
+
+func (api *API) workspaceAgentBootTiming(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	timing, ok := api.agentBootTimings.get(workspaceAgent.ID)
+	if !ok {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "The workspace agent hasn't reported its boot timing.",
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, timing)
+}
@@ -0,0 +1,163 @@
+package coderd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/coder/coder/coderd/database"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+func (api *API) postWorkspaceAgentConnectionEvents(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.PostAgentConnectionEventsRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if len(req.Events) > codersdk.MaxAgentConnectionEventsBatchSize {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Too many connection events.",
+			Detail:  fmt.Sprintf("At most %d events can be sent at once.", codersdk.MaxAgentConnectionEventsBatchSize),
+		})
+		return
+	}
+	workspace, err := api.Database.GetWorkspaceByAgentID(ctx, workspaceAgent.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching workspace.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	params := database.InsertWorkspaceAgentConnectionEventsParams{
+		WorkspaceID: workspace.ID,
+		AgentID:     workspaceAgent.ID,
+	}
+	for index, event := range req.Events {
+		connectionType := database.WorkspaceAgentConnectionType(event.Type)
+		switch connectionType {
+		case database.WorkspaceAgentConnectionTypeSSH,
+			database.WorkspaceAgentConnectionTypeSFTP,
+			database.WorkspaceAgentConnectionTypePortForward,
+			database.WorkspaceAgentConnectionTypeReconnectingPTY,
+			database.WorkspaceAgentConnectionTypeFileSync,
+			database.WorkspaceAgentConnectionTypeExec:
+		default:
+			httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Invalid connection event.",
+				Validations: []codersdk.ValidationError{{
+					Field:  fmt.Sprintf("events[%d].type", index),
+					Detail: fmt.Sprintf("unknown connection type %q", event.Type),
+				}},
+			})
+			return
+		}
+		action := database.WorkspaceAgentConnectionAction(event.Action)
+		switch action {
+		case database.WorkspaceAgentConnectionActionConnect,
+			database.WorkspaceAgentConnectionActionDisconnect:
+		default:
+			httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Invalid connection event.",
+				Validations: []codersdk.ValidationError{{
+					Field:  fmt.Sprintf("events[%d].action", index),
+					Detail: fmt.Sprintf("unknown connection action %q", event.Action),
+				}},
+			})
+			return
+		}
+		if event.ID == uuid.Nil {
+			httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Invalid connection event.",
+				Validations: []codersdk.ValidationError{{
+					Field:  fmt.Sprintf("events[%d].id", index),
+					Detail: "must be set",
+				}},
+			})
+			return
+		}
+		params.ID = append(params.ID, event.ID)
+		params.ConnectionID = append(params.ConnectionID, event.ConnectionID)
+		params.SessionID = append(params.SessionID, event.SessionID)
+		params.Type = append(params.Type, connectionType)
+		params.Action = append(params.Action, action)
+		params.CreatedAt = append(params.CreatedAt, event.Time)
+		params.Peer = append(params.Peer, event.Peer)
+		params.SSHUser = append(params.SSHUser, event.User)
+		params.Command = append(params.Command, event.Command)
+		params.Destination = append(params.Destination, event.Destination)
+	}
+
+	if len(params.ID) > 0 {
+		err = api.Database.InsertWorkspaceAgentConnectionEvents(ctx, params)
+		if err != nil {
+			httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+				Message: "Internal error storing connection events.",
+				Detail:  err.Error(),
+			})
+			return
+		}
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Stored connection events.",
+	})
+}
+
+// workspaceConnectionEvents lists the connection events of the agents of a
+// workspace. They're part of the audit trail, so they require permission to
+// read the audit log.
+func (api *API) workspaceConnectionEvents(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	if !api.Authorize(r, rbac.ActionRead, rbac.ResourceAuditLog) {
+		httpapi.Forbidden(rw)
+		return
+	}
+
+	page, ok := parsePagination(rw, r)
+	if !ok {
+		return
+	}
+	events, err := api.Database.GetWorkspaceAgentConnectionEventsByWorkspaceID(ctx, database.GetWorkspaceAgentConnectionEventsByWorkspaceIDParams{
+		WorkspaceID: workspace.ID,
+		OffsetOpt:   int32(page.Offset),
+		LimitOpt:    int32(page.Limit),
+	})
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching connection events.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	apiEvents := make([]codersdk.AgentConnectionEvent, 0, len(events))
+	for _, event := range events {
+		apiEvents = append(apiEvents, convertAgentConnectionEvent(event))
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, apiEvents)
+}
+
+func convertAgentConnectionEvent(event database.WorkspaceAgentConnectionEvent) codersdk.AgentConnectionEvent {
+	return codersdk.AgentConnectionEvent{
+		ID:           event.ID,
+		AgentID:      event.AgentID,
+		ConnectionID: event.ConnectionID,
+		SessionID:    event.SessionID,
+		Type:         codersdk.AgentConnectionType(event.Type),
+		Action:       codersdk.AgentConnectionAction(event.Action),
+		Time:         event.CreatedAt,
+		Peer:         event.Peer,
+		User:         event.SSHUser,
+		Command:      event.Command,
+		Destination:  event.Destination,
+	}
+}
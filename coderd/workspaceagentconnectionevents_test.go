@@ -0,0 +1,133 @@
+package coderd_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/provisioner/echo"
+	"github.com/coder/coder/provisionersdk/proto"
+	"github.com/coder/coder/testutil"
+)
+
+func TestWorkspaceAgentConnectionEvents(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	build := coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+	agentID := build.Resources[0].Agents[0].ID
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	connectionID := uuid.New()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	connect := codersdk.AgentConnectionEvent{
+		ID:           uuid.New(),
+		ConnectionID: connectionID,
+		SessionID:    uuid.NewString(),
+		Type:         codersdk.AgentConnectionTypeSSH,
+		Action:       codersdk.AgentConnectionActionConnect,
+		Time:         now,
+		Peer:         "[fd7a:115c:a1e0::1]:40000",
+		User:         "coder",
+		Command:      "echo test",
+	}
+	disconnect := connect
+	disconnect.ID = uuid.New()
+	disconnect.Action = codersdk.AgentConnectionActionDisconnect
+	disconnect.Time = now.Add(time.Second)
+	err := agentClient.PostAgentConnectionEvents(ctx, codersdk.PostAgentConnectionEventsRequest{
+		Events: []codersdk.AgentConnectionEvent{connect},
+	})
+	require.NoError(t, err)
+	// Batches are retried, so events that were stored are ignored.
+	err = agentClient.PostAgentConnectionEvents(ctx, codersdk.PostAgentConnectionEventsRequest{
+		Events: []codersdk.AgentConnectionEvent{connect, disconnect},
+	})
+	require.NoError(t, err)
+
+	events, err := client.WorkspaceConnectionEvents(ctx, workspace.ID, codersdk.Pagination{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	// The most recent events come first.
+	disconnect.AgentID = agentID
+	connect.AgentID = agentID
+	require.Equal(t, disconnect.ID, events[0].ID)
+	require.Equal(t, connect.ID, events[1].ID)
+	events[0].Time = events[0].Time.UTC()
+	events[1].Time = events[1].Time.UTC()
+	require.Equal(t, []codersdk.AgentConnectionEvent{disconnect, connect}, events)
+
+	events, err = client.WorkspaceConnectionEvents(ctx, workspace.ID, codersdk.Pagination{
+		Limit:  1,
+		Offset: 1,
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, connect.ID, events[0].ID)
+
+	t.Run("InvalidType", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		event := connect
+		event.ID = uuid.New()
+		event.Type = "telnet"
+		err := agentClient.PostAgentConnectionEvents(ctx, codersdk.PostAgentConnectionEventsRequest{
+			Events: []codersdk.AgentConnectionEvent{event},
+		})
+		var apiErr *codersdk.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+	})
+
+	t.Run("RequiresAuditor", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		member := coderdtest.CreateAnotherUser(t, client, user.OrganizationID)
+		_, err := member.WorkspaceConnectionEvents(ctx, workspace.ID, codersdk.Pagination{})
+		var apiErr *codersdk.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusForbidden, apiErr.StatusCode())
+	})
+}
@@ -0,0 +1,73 @@
+package coderd
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/codersdk"
+)
+
+// agentCrashes counts the panics that agents recovered from, so operators
+// notice agents that keep crashing.
+type agentCrashes struct {
+	crashes *prometheus.CounterVec
+}
+
+func newAgentCrashes(registerer prometheus.Registerer) *agentCrashes {
+	return &agentCrashes{
+		crashes: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "coderd",
+			Subsystem: "agents",
+			Name:      "crashes_total",
+			Help:      "The panics that workspace agents recovered from, by the component of the agent that panicked.",
+		}, []string{"component"}),
+	}
+}
+
+func (api *API) postWorkspaceAgentCrashReport(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.AgentCrashReport
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	var validations []codersdk.ValidationError
+	if req.Component == "" {
+		validations = append(validations, codersdk.ValidationError{
+			Field:  "component",
+			Detail: "is required",
+		})
+	}
+	if req.Panic == "" {
+		validations = append(validations, codersdk.ValidationError{
+			Field:  "panic",
+			Detail: "is required",
+		})
+	}
+	if len(validations) > 0 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message:     "Invalid crash report.",
+			Validations: validations,
+		})
+		return
+	}
+
+	api.agentCrashes.crashes.WithLabelValues(req.Component).Inc()
+	api.Logger.Warn(ctx, "workspace agent panicked",
+		slog.F("agent_id", workspaceAgent.ID),
+		slog.F("component", req.Component),
+		slog.F("panic", req.Panic),
+		slog.F("agent_version", req.Version),
+		slog.F("occurred_at", req.OccurredAt),
+		slog.F("stack", req.Stack),
+		slog.F("recent_logs", req.RecentLogs))
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Recorded crash report.",
+	})
+}
@@ -0,0 +1,185 @@
+package coderd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/coder/coder/coderd/database"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+func (api *API) postWorkspaceAgentDriftReport(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.WorkspaceAgentDriftReport
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if len(req.Drifts) > codersdk.MaxWorkspaceAgentDrifts {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Too many drifts.",
+			Detail:  fmt.Sprintf("At most %d drifts can be reported at once.", codersdk.MaxWorkspaceAgentDrifts),
+		})
+		return
+	}
+	if req.Checks < len(req.Drifts) {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid drift report.",
+			Validations: []codersdk.ValidationError{{
+				Field:  "checks",
+				Detail: "must be at least the number of drifts",
+			}},
+		})
+		return
+	}
+	for index, drift := range req.Drifts {
+		switch drift.Type {
+		case codersdk.WorkspaceAgentDriftTypeTool,
+			codersdk.WorkspaceAgentDriftTypeEnvironmentVariable,
+			codersdk.WorkspaceAgentDriftTypeFile:
+		default:
+			httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Invalid drift report.",
+				Validations: []codersdk.ValidationError{{
+					Field:  fmt.Sprintf("drifts[%d].type", index),
+					Detail: fmt.Sprintf("unknown drift type %q", drift.Type),
+				}},
+			})
+			return
+		}
+	}
+	workspace, err := api.Database.GetWorkspaceByAgentID(ctx, workspaceAgent.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching workspace.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	drifts := req.Drifts
+	if drifts == nil {
+		drifts = []codersdk.WorkspaceAgentDrift{}
+	}
+	rawDrifts, err := json.Marshal(drifts)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error encoding drifts.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	checkedAt := req.CheckedAt
+	if checkedAt.IsZero() {
+		checkedAt = database.Now()
+	}
+	_, err = api.Database.InsertOrUpdateWorkspaceAgentDriftReport(ctx, database.InsertOrUpdateWorkspaceAgentDriftReportParams{
+		AgentID:     workspaceAgent.ID,
+		WorkspaceID: workspace.ID,
+		CheckedAt:   checkedAt,
+		Checks:      int32(req.Checks),
+		Drifted:     len(drifts) > 0,
+		Drifts:      rawDrifts,
+	})
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error storing drift report.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Stored drift report.",
+	})
+}
+
+func (api *API) workspaceAgentDriftReport(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	report, err := api.Database.GetWorkspaceAgentDriftReportByAgentID(ctx, workspaceAgent.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "The workspace agent hasn't reported drift.",
+		})
+		return
+	}
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching drift report.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	apiReport, err := convertWorkspaceAgentDriftReport(report)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error reading drift report.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, apiReport)
+}
+
+// templateDriftReports lists the drift reports of the workspaces of a
+// template, so template admins can find workspaces that were changed by
+// hand. Reports can contain the environment of workspaces, so they require
+// permission to update the template.
+func (api *API) templateDriftReports(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	template := httpmw.TemplateParam(r)
+	if !api.Authorize(r, rbac.ActionUpdate, template) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	reports, err := api.Database.GetWorkspaceAgentDriftReportsByTemplateID(ctx, template.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching drift reports.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	apiReports := make([]codersdk.WorkspaceAgentDriftReport, 0, len(reports))
+	for _, report := range reports {
+		apiReport, err := convertWorkspaceAgentDriftReport(report)
+		if err != nil {
+			httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+				Message: "Internal error reading drift report.",
+				Detail:  err.Error(),
+			})
+			return
+		}
+		apiReports = append(apiReports, apiReport)
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, apiReports)
+}
+
+func convertWorkspaceAgentDriftReport(report database.WorkspaceAgentDriftReport) (codersdk.WorkspaceAgentDriftReport, error) {
+	apiReport := codersdk.WorkspaceAgentDriftReport{
+		AgentID:     report.AgentID,
+		WorkspaceID: report.WorkspaceID,
+		CheckedAt:   report.CheckedAt,
+		Checks:      int(report.Checks),
+		Drifted:     report.Drifted,
+	}
+	err := json.Unmarshal(report.Drifts, &apiReport.Drifts)
+	if err != nil {
+		return codersdk.WorkspaceAgentDriftReport{}, err
+	}
+	return apiReport, nil
+}
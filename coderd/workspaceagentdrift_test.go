@@ -0,0 +1,129 @@
+package coderd_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/provisioner/echo"
+	"github.com/coder/coder/provisionersdk/proto"
+	"github.com/coder/coder/testutil"
+)
+
+func TestWorkspaceAgentDrift(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	build := coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+	agentID := build.Resources[0].Agents[0].ID
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	_, err := client.WorkspaceAgentDriftReport(ctx, agentID)
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode())
+
+	drift := codersdk.WorkspaceAgentDrift{
+		Type:     codersdk.WorkspaceAgentDriftTypeTool,
+		Name:     "node",
+		Expected: "v20",
+		Actual:   "v18.12.0",
+	}
+	err = agentClient.PostWorkspaceAgentDriftReport(ctx, codersdk.WorkspaceAgentDriftReport{
+		CheckedAt: time.Now(),
+		Checks:    3,
+		Drifts:    []codersdk.WorkspaceAgentDrift{drift},
+	})
+	require.NoError(t, err)
+
+	report, err := client.WorkspaceAgentDriftReport(ctx, agentID)
+	require.NoError(t, err)
+	require.Equal(t, agentID, report.AgentID)
+	require.Equal(t, workspace.ID, report.WorkspaceID)
+	require.Equal(t, 3, report.Checks)
+	require.True(t, report.Drifted)
+	require.Equal(t, []codersdk.WorkspaceAgentDrift{drift}, report.Drifts)
+
+	reports, err := client.TemplateDriftReports(ctx, template.ID)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, agentID, reports[0].AgentID)
+
+	// Only the most recent report is kept.
+	err = agentClient.PostWorkspaceAgentDriftReport(ctx, codersdk.WorkspaceAgentDriftReport{
+		CheckedAt: time.Now(),
+		Checks:    3,
+	})
+	require.NoError(t, err)
+	report, err = client.WorkspaceAgentDriftReport(ctx, agentID)
+	require.NoError(t, err)
+	require.False(t, report.Drifted)
+	require.Empty(t, report.Drifts)
+
+	t.Run("InvalidType", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		err := agentClient.PostWorkspaceAgentDriftReport(ctx, codersdk.WorkspaceAgentDriftReport{
+			Checks: 1,
+			Drifts: []codersdk.WorkspaceAgentDrift{{
+				Type: "kernel",
+				Name: "linux",
+			}},
+		})
+		var apiErr *codersdk.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+	})
+
+	t.Run("RequiresTemplateAdmin", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		member := coderdtest.CreateAnotherUser(t, client, user.OrganizationID)
+		_, err := member.TemplateDriftReports(ctx, template.ID)
+		var apiErr *codersdk.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusNotFound, apiErr.StatusCode())
+	})
+}
@@ -0,0 +1,34 @@
+package coderd
+
+import (
+	"net/http"
+
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+// workspaceAgentIdentityKey returns the identity key the agent registered in
+// its last handshake, which is stored with the agent so every replica can
+// return it.
+func (api *API) workspaceAgentIdentityKey(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	if len(workspaceAgent.IdentityPublicKey) == 0 {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "The workspace agent hasn't registered an identity key.",
+			Detail:  "Agents register a key when they connect, if they support it.",
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.WorkspaceAgentIdentityKeyResponse{
+		PublicKey: workspaceAgent.IdentityPublicKey,
+	})
+}
@@ -0,0 +1,46 @@
+package coderd
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/coder/coder/codersdk"
+)
+
+// agentConnectionPaths counts how long peers were connected to agents
+// directly and relayed through DERP, so dashboards can show how much
+// connections depend on relays in each region.
+type agentConnectionPaths struct {
+	seconds *prometheus.CounterVec
+}
+
+func newAgentConnectionPaths(registerer prometheus.Registerer) *agentConnectionPaths {
+	return &agentConnectionPaths{
+		seconds: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "coderd",
+			Subsystem: "agents",
+			Name:      "connection_seconds_total",
+			Help:      "How long peers were connected to workspace agents, by whether the connection was direct or relayed through a DERP region.",
+		}, []string{"path", "derp_region"}),
+	}
+}
+
+// observe adds the time on each path that an agent reported.
+func (p *agentConnectionPaths) observe(stats codersdk.AgentStats) {
+	if stats.DirectSeconds > 0 {
+		p.seconds.WithLabelValues("direct", "").Add(float64(stats.DirectSeconds))
+	}
+	var regions int64
+	for region, seconds := range stats.DERPSecondsByRegion {
+		if seconds <= 0 {
+			continue
+		}
+		regions += seconds
+		p.seconds.WithLabelValues("derp", region).Add(float64(seconds))
+	}
+	// Agents don't know the region of every relayed connection, so the
+	// rest is counted without one.
+	if rest := stats.DERPSeconds - regions; rest > 0 {
+		p.seconds.WithLabelValues("derp", "").Add(float64(rest))
+	}
+}
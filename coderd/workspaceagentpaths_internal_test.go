@@ -0,0 +1,30 @@
+package coderd
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/codersdk"
+)
+
+func TestAgentConnectionPaths(t *testing.T) {
+	t.Parallel()
+
+	paths := newAgentConnectionPaths(prometheus.NewRegistry())
+	paths.observe(codersdk.AgentStats{
+		DirectSeconds:       30,
+		DERPSeconds:         25,
+		DERPSecondsByRegion: map[string]int64{"nyc": 15},
+	})
+	paths.observe(codersdk.AgentStats{
+		DirectSeconds: 10,
+	})
+
+	require.Equal(t, float64(40), testutil.ToFloat64(paths.seconds.WithLabelValues("direct", "")))
+	require.Equal(t, float64(15), testutil.ToFloat64(paths.seconds.WithLabelValues("derp", "nyc")))
+	// Relayed time without a region is counted separately.
+	require.Equal(t, float64(10), testutil.ToFloat64(paths.seconds.WithLabelValues("derp", "")))
+}
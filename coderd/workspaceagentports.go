@@ -0,0 +1,97 @@
+package coderd
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/coderd/database"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/codersdk"
+)
+
+// maxDeclaredPortNameLength bounds the names of declared ports, since they're
+// shown next to the port in the dashboard.
+const maxDeclaredPortNameLength = 64
+
+// postWorkspaceAgentDeclaredPorts replaces the ports that processes in the
+// workspace of the agent declared.
+func (api *API) postWorkspaceAgentDeclaredPorts(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.PostWorkspaceAgentDeclaredPortsRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if len(req.Ports) > codersdk.MaxWorkspaceAgentDeclaredPorts {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Too many declared ports.",
+			Detail:  fmt.Sprintf("At most %d ports can be declared.", codersdk.MaxWorkspaceAgentDeclaredPorts),
+		})
+		return
+	}
+	seen := make(map[uint16]struct{}, len(req.Ports))
+	var validations []codersdk.ValidationError
+	for index, port := range req.Ports {
+		field := fmt.Sprintf("ports[%d]", index)
+		if port.Port < uint16(codersdk.MinimumListeningPort) {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".port",
+				Detail: fmt.Sprintf("must be at least %d", codersdk.MinimumListeningPort),
+			})
+		}
+		if _, ok := seen[port.Port]; ok {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".port",
+				Detail: fmt.Sprintf("port %d is declared more than once", port.Port),
+			})
+		}
+		seen[port.Port] = struct{}{}
+		if len(port.Name) > maxDeclaredPortNameLength {
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field + ".name",
+				Detail: fmt.Sprintf("must be at most %d characters", maxDeclaredPortNameLength),
+			})
+		}
+	}
+	if len(validations) > 0 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message:     "Invalid declared ports.",
+			Validations: validations,
+		})
+		return
+	}
+
+	err := api.Database.InTx(func(tx database.Store) error {
+		err := tx.DeleteWorkspaceAgentDeclaredPortsByAgentID(ctx, workspaceAgent.ID)
+		if err != nil {
+			return xerrors.Errorf("delete declared ports: %w", err)
+		}
+		now := database.Now()
+		for _, port := range req.Ports {
+			_, err = tx.InsertWorkspaceAgentDeclaredPort(ctx, database.InsertWorkspaceAgentDeclaredPortParams{
+				AgentID:   workspaceAgent.ID,
+				Port:      int32(port.Port),
+				Name:      port.Name,
+				CreatedAt: now,
+			})
+			if err != nil {
+				return xerrors.Errorf("insert declared port %d: %w", port.Port, err)
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error storing declared ports.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Stored declared ports.",
+	})
+}
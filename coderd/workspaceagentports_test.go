@@ -0,0 +1,87 @@
+package coderd_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/provisioner/echo"
+	"github.com/coder/coder/provisionersdk/proto"
+	"github.com/coder/coder/testutil"
+)
+
+func TestPostWorkspaceAgentDeclaredPorts(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	err := agentClient.PostWorkspaceAgentDeclaredPorts(ctx, codersdk.PostWorkspaceAgentDeclaredPortsRequest{
+		Ports: []codersdk.WorkspaceAgentDeclaredPort{{
+			Port: 3000,
+			Name: "frontend",
+		}},
+	})
+	require.NoError(t, err)
+
+	// Declaring the same ports again replaces them.
+	err = agentClient.PostWorkspaceAgentDeclaredPorts(ctx, codersdk.PostWorkspaceAgentDeclaredPortsRequest{
+		Ports: []codersdk.WorkspaceAgentDeclaredPort{{
+			Port: 3000,
+			Name: "web",
+		}},
+	})
+	require.NoError(t, err)
+
+	err = agentClient.PostWorkspaceAgentDeclaredPorts(ctx, codersdk.PostWorkspaceAgentDeclaredPortsRequest{
+		Ports: []codersdk.WorkspaceAgentDeclaredPort{{
+			Port: 3000,
+		}, {
+			Port: 3000,
+		}, {
+			Port: 1,
+		}},
+	})
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+	require.Len(t, apiErr.Validations, 2)
+}
@@ -2,6 +2,8 @@ package coderd
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -16,8 +18,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"go.opentelemetry.io/otel/trace"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/mod/semver"
 	"golang.org/x/oauth2"
 	"golang.org/x/xerrors"
@@ -32,8 +36,11 @@ import (
 	"github.com/coder/coder/coderd/httpapi"
 	"github.com/coder/coder/coderd/httpmw"
 	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/coderd/telemetry"
 	"github.com/coder/coder/coderd/tracing"
+	"github.com/coder/coder/coderd/wsconncache"
 	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/cryptorand"
 	"github.com/coder/coder/tailnet"
 )
 
@@ -116,6 +123,22 @@ func (api *API) workspaceAgentMetadata(rw http.ResponseWriter, r *http.Request)
 		})
 		return
 	}
+	personalEnvironmentVariables, err := api.environmentVariablesOfWorkspace(ctx, workspace.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching workspace environment variables.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	templateAgentSettings, err := api.agentSettingsOfTemplate(ctx, workspace.TemplateID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching template agent settings.",
+			Detail:  err.Error(),
+		})
+		return
+	}
 
 	vscodeProxyURI := strings.ReplaceAll(api.AppHostname, "*",
 		fmt.Sprintf("%s://{{port}}--%s--%s--%s",
@@ -128,15 +151,47 @@ func (api *API) workspaceAgentMetadata(rw http.ResponseWriter, r *http.Request)
 		vscodeProxyURI += fmt.Sprintf(":%s", api.AccessURL.Port())
 	}
 
+	var sshUserCertificateAuthority *codersdk.WorkspaceAgentSSHUserCertificateAuthority
+	if api.SSHUserCertificateAuthority != nil {
+		sshUserCertificateAuthority = &codersdk.WorkspaceAgentSSHUserCertificateAuthority{
+			PublicKey: strings.TrimSpace(string(gossh.MarshalAuthorizedKey(api.SSHUserCertificateAuthority.PublicKey()))),
+			Principal: workspaceAgent.ID.String(),
+		}
+	}
+
+	// Agents that don't know the fields of restrictions would ignore them,
+	// so they're required.
+	var requiredFields []string
+	if sshUserCertificateAuthority != nil {
+		requiredFields = append(requiredFields, "ssh_user_certificate_authority")
+	}
+	if api.DeploymentConfig.SSHPublicKeyAuth.Value {
+		requiredFields = append(requiredFields, "ssh_public_key_auth")
+	}
+
 	httpapi.Write(ctx, rw, http.StatusOK, codersdk.WorkspaceAgentMetadata{
-		Apps:                 convertApps(dbApps),
-		DERPMap:              api.DERPMap,
-		GitAuthConfigs:       len(api.GitAuthConfigs),
-		EnvironmentVariables: apiAgent.EnvironmentVariables,
-		StartupScript:        apiAgent.StartupScript,
-		Directory:            apiAgent.Directory,
-		VSCodePortProxyURI:   vscodeProxyURI,
-		MOTDFile:             workspaceAgent.MOTDFile,
+		Version:                       codersdk.WorkspaceAgentMetadataVersion,
+		RequiredFields:                requiredFields,
+		Apps:                          convertApps(dbApps),
+		DERPMap:                       api.DERPMap,
+		GitAuthConfigs:                len(api.GitAuthConfigs),
+		EnvironmentVariables:          apiAgent.EnvironmentVariables,
+		PersonalEnvironmentVariables:  personalEnvironmentVariables,
+		StartupScript:                 apiAgent.StartupScript,
+		Directory:                     apiAgent.Directory,
+		VSCodePortProxyURI:            vscodeProxyURI,
+		MOTDFile:                      workspaceAgent.MOTDFile,
+		Hostname:                      codersdk.WorkspaceAgentHostname(workspace.Name, workspaceAgent.Name),
+		SSHUserCertificateAuthority:   sshUserCertificateAuthority,
+		SSHPublicKeyAuth:              api.DeploymentConfig.SSHPublicKeyAuth.Value,
+		ExperimentalQUIC:              api.DeploymentConfig.Experimental.Value,
+		TelemetryEnabled:              api.DeploymentConfig.Telemetry.Enable.Value,
+		ReconnectMaxIntervalSeconds:   int32(api.DeploymentConfig.AgentReconnectMaxInterval.Value.Seconds()),
+		DisableDirectConnections:      templateAgentSettings.DisableDirectConnections,
+		QuickActions:                  templateAgentSettings.QuickActions,
+		FeatureFlags:                  templateAgentSettings.FeatureFlags,
+		ReconnectingPTYTimeoutSeconds: templateAgentSettings.ReconnectingPTYTimeoutSeconds,
+		LanguageServers:               templateAgentSettings.LanguageServers,
 	})
 }
 
@@ -181,6 +236,56 @@ func (api *API) postWorkspaceAgentVersion(rw http.ResponseWriter, r *http.Reques
 	httpapi.Write(ctx, rw, http.StatusOK, nil)
 }
 
+func (api *API) postWorkspaceAgentHandshake(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.WorkspaceAgentHandshakeRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if req.ProtocolVersion < 1 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid workspace agent protocol version provided.",
+			Detail:  fmt.Sprintf("protocol version must be at least 1, got %d", req.ProtocolVersion),
+		})
+		return
+	}
+
+	if len(req.IdentityKey) != 0 && len(req.IdentityKey) != ed25519.PublicKeySize {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid workspace agent identity key provided.",
+			Detail:  fmt.Sprintf("identity key must be %d bytes, got %d", ed25519.PublicKeySize, len(req.IdentityKey)),
+		})
+		return
+	}
+	// Agents generate a new key when they restart, so the key is replaced
+	// every handshake.
+	if len(req.IdentityKey) != 0 {
+		err := api.Database.UpdateWorkspaceAgentIdentityPublicKeyByID(ctx, database.UpdateWorkspaceAgentIdentityPublicKeyByIDParams{
+			ID:                workspaceAgent.ID,
+			IdentityPublicKey: req.IdentityKey,
+		})
+		if err != nil {
+			httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+				Message: "Internal error setting workspace agent identity key.",
+				Detail:  err.Error(),
+			})
+			return
+		}
+	}
+
+	resp := codersdk.NegotiateWorkspaceAgentHandshake(req, codersdk.WorkspaceAgentProtocolVersion, codersdk.WorkspaceAgentCapabilities)
+	api.Logger.Info(ctx, "workspace agent handshake",
+		slog.F("agent_id", workspaceAgent.ID),
+		slog.F("agent_version", req.Version),
+		slog.F("protocol_version", resp.ProtocolVersion),
+		slog.F("capabilities", resp.Capabilities),
+	)
+
+	httpapi.Write(ctx, rw, http.StatusOK, resp)
+}
+
 // workspaceAgentPTY spawns a PTY and pipes it over a WebSocket.
 // This is used for the web terminal.
 func (api *API) workspaceAgentPTY(rw http.ResponseWriter, r *http.Request) {
@@ -212,8 +317,10 @@ func (api *API) workspaceAgentPTY(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Named terminals are attached to by name instead of by ID.
+	name := r.URL.Query().Get("name")
 	reconnect, err := uuid.Parse(r.URL.Query().Get("reconnect"))
-	if err != nil {
+	if err != nil && name == "" {
 		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
 			Message: "Query param 'reconnect' must be a valid UUID.",
 			Validations: []codersdk.ValidationError{
@@ -230,6 +337,32 @@ func (api *API) workspaceAgentPTY(rw http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		width = 80
 	}
+	// The agent bounds the size of the scrollback.
+	bufferSize, err := strconv.Atoi(r.URL.Query().Get("buffer_size"))
+	if err != nil || bufferSize < 0 {
+		bufferSize = 0
+	}
+	role := codersdk.ReconnectingPTYRole(r.URL.Query().Get("role"))
+	switch role {
+	case "", codersdk.ReconnectingPTYRoleReadWrite, codersdk.ReconnectingPTYRoleReadOnly:
+	default:
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: fmt.Sprintf("Query param 'role' must be %q or %q.", codersdk.ReconnectingPTYRoleReadWrite, codersdk.ReconnectingPTYRoleReadOnly),
+			Validations: []codersdk.ValidationError{
+				{Field: "role", Detail: "unknown role"},
+			},
+		})
+		return
+	}
+	// Participants of shared terminals are named by the user.
+	user, err := api.Database.GetUserByID(ctx, httpmw.APIKey(r).UserID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching user.",
+			Detail:  err.Error(),
+		})
+		return
+	}
 
 	conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{
 		CompressionMode: websocket.CompressionDisabled,
@@ -252,7 +385,17 @@ func (api *API) workspaceAgentPTY(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer release()
-	ptNetConn, err := agentConn.ReconnectingPTY(ctx, reconnect, uint16(height), uint16(width), r.URL.Query().Get("command"))
+	ptNetConn, err := agentConn.DialReconnectingPTY(ctx, codersdk.ReconnectingPTYInit{
+		ID:          reconnect,
+		Height:      uint16(height),
+		Width:       uint16(width),
+		Command:     r.URL.Query().Get("command"),
+		BufferSize:  bufferSize,
+		Label:       r.URL.Query().Get("label"),
+		Role:        role,
+		Participant: user.Username,
+		Name:        name,
+	})
 	if err != nil {
 		_ = conn.Close(websocket.StatusInternalError, httpapi.WebsocketCloseSprintf("dial: %s", err))
 		return
@@ -261,6 +404,482 @@ func (api *API) workspaceAgentPTY(rw http.ResponseWriter, r *http.Request) {
 	agent.Bicopy(ctx, wsNetConn, ptNetConn)
 }
 
+// acquireConnectedAgent returns a connection to the workspace agent from the
+// cache, and the func to release it. If the agent isn't connected, or it
+// can't be dialed, a response is written and false is returned.
+func (api *API) acquireConnectedAgent(rw http.ResponseWriter, r *http.Request, workspaceAgent database.WorkspaceAgent) (*wsconncache.Conn, func(), bool) {
+	ctx := r.Context()
+	apiAgent, err := convertWorkspaceAgent(api.DERPMap, *api.TailnetCoordinator.Load(), workspaceAgent, nil, api.AgentInactiveDisconnectTimeout, api.DeploymentConfig.AgentFallbackTroubleshootingURL.Value)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error reading workspace agent.",
+			Detail:  err.Error(),
+		})
+		return nil, nil, false
+	}
+	if apiAgent.Status != codersdk.WorkspaceAgentConnected {
+		httpapi.Write(ctx, rw, http.StatusPreconditionRequired, codersdk.Response{
+			Message: fmt.Sprintf("Agent state is %q, it must be in the %q state.", apiAgent.Status, codersdk.WorkspaceAgentConnected),
+		})
+		return nil, nil, false
+	}
+
+	agentConn, release, err := api.workspaceAgentCache.Acquire(r, workspaceAgent.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error dialing workspace agent.",
+			Detail:  err.Error(),
+		})
+		return nil, nil, false
+	}
+	return agentConn, release, true
+}
+
+func (api *API) workspaceAgentSSHHostKeys(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	hostKeys, err := agentConn.SSHHostKeys(ctx, r.URL.Query().Get("host"))
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching SSH host keys.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, hostKeys)
+}
+
+// postWorkspaceAgentSSHCertificate issues a short-lived SSH user certificate
+// for the workspace agent, when the deployment has an SSH certificate
+// authority.
+func (api *API) postWorkspaceAgentSSHCertificate(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	apiKey := httpmw.APIKey(r)
+	if !api.Authorize(r, rbac.ActionCreate, workspace.ExecutionRBAC()) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+	if api.SSHUserCertificateAuthority == nil {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "SSH user certificates are not enabled for this deployment.",
+		})
+		return
+	}
+
+	var req codersdk.SSHCertificateRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid public key.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if _, ok := publicKey.(*gossh.Certificate); ok {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "A public key is required, not a certificate.",
+		})
+		return
+	}
+
+	user, err := api.Database.GetUserByID(ctx, apiKey.UserID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching user.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	serial, err := cryptorand.Uint64()
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error generating certificate serial.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	now := database.Now()
+	expiresAt := now.Add(api.SSHUserCertificateTTL)
+	cert := &gossh.Certificate{
+		Key:      publicKey,
+		Serial:   serial,
+		CertType: gossh.UserCert,
+		// The key ID is logged by the agent, so it identifies the user.
+		KeyId: fmt.Sprintf("%s (%s)", user.Username, user.ID),
+		// Certificates are only valid for the agent they were issued for.
+		ValidPrincipals: []string{workspaceAgent.ID.String()},
+		// Allow for clock skew between coderd and the workspace.
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(expiresAt.Unix()),
+		Permissions: gossh.Permissions{
+			Extensions: map[string]string{
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+				"permit-X11-forwarding":   "",
+			},
+		},
+	}
+	err = cert.SignCert(rand.Reader, api.SSHUserCertificateAuthority)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error signing certificate.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusCreated, codersdk.SSHCertificateResponse{
+		Certificate: strings.TrimSpace(string(gossh.MarshalAuthorizedKey(cert))),
+		ExpiresAt:   expiresAt,
+	})
+}
+
+func (api *API) postWorkspaceAgentBroadcast(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionUpdate, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	var req codersdk.BroadcastMessageRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if req.Message == "" {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "A message is required.",
+		})
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	resp, err := agentConn.BroadcastMessage(ctx, req.Message)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error broadcasting message.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, resp)
+}
+
+// postWorkspaceAgentQuiesce prepares the agent for a snapshot of the VM of
+// the workspace, for infrastructure that hibernates workspaces.
+func (api *API) postWorkspaceAgentQuiesce(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionUpdate, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	resp, err := agentConn.Quiesce(ctx)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error quiescing workspace agent.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, resp)
+}
+
+func (api *API) workspaceAgentSessions(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	sessions, err := agentConn.Sessions(ctx)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching sessions.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, sessions)
+}
+
+func (api *API) deleteWorkspaceAgentSession(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	// Terminating a session changes the workspace, so it requires the
+	// same permission as connecting to it.
+	if !api.Authorize(r, rbac.ActionUpdate, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+	sessionID := chi.URLParam(r, "session")
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	err := agentConn.TerminateSession(ctx, sessionID)
+	if err != nil {
+		var sdkErr *codersdk.Error
+		if xerrors.As(err, &sdkErr) && sdkErr.StatusCode() == http.StatusNotFound {
+			httpapi.ResourceNotFound(rw)
+			return
+		}
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error terminating session.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Terminated the session.",
+	})
+}
+
+func (api *API) workspaceAgentQuickActions(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	quickActions, err := agentConn.QuickActions(ctx)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching quick actions.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, quickActions)
+}
+
+func (api *API) postWorkspaceAgentQuickAction(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	// Quick actions run commands in the workspace, so they require the
+	// same permission as a terminal.
+	if !api.Authorize(r, rbac.ActionCreate, workspace.ExecutionRBAC()) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+	name := chi.URLParam(r, "quickaction")
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	run, err := agentConn.RunQuickAction(ctx, name)
+	if err != nil {
+		var sdkErr *codersdk.Error
+		if xerrors.As(err, &sdkErr) {
+			switch sdkErr.StatusCode() {
+			case http.StatusNotFound:
+				httpapi.ResourceNotFound(rw)
+				return
+			case http.StatusConflict:
+				httpapi.Write(ctx, rw, http.StatusConflict, sdkErr.Response)
+				return
+			}
+		}
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error running quick action.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, run)
+}
+
+func (api *API) workspaceAgentReversePortForwards(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	forwards, err := agentConn.ReversePortForwards(ctx)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error listing reverse port forwards.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, forwards)
+}
+
+func (api *API) workspaceAgentStartup(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	startup, err := agentConn.Startup(ctx)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error reading startup state.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, startup)
+}
+
+func (api *API) workspaceAgentSessionTranscripts(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	transcripts, err := agentConn.SessionTranscripts(ctx)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error listing session transcripts.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, transcripts)
+}
+
+func (api *API) workspaceAgentSessionTranscript(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	transcriptID, err := uuid.Parse(chi.URLParam(r, "transcript"))
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid transcript ID.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	agentConn, release, ok := api.acquireConnectedAgent(rw, r, workspaceAgent)
+	if !ok {
+		return
+	}
+	defer release()
+
+	transcript, err := agentConn.SessionTranscript(ctx, transcriptID.String())
+	if err != nil {
+		var sdkErr *codersdk.Error
+		if xerrors.As(err, &sdkErr) && sdkErr.StatusCode() == http.StatusNotFound {
+			httpapi.ResourceNotFound(rw)
+			return
+		}
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching session transcript.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	defer transcript.Close()
+
+	rw.Header().Set("Content-Type", codersdk.ContentTypeAsciicast)
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", transcriptID.String()+".cast"))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = io.Copy(rw, transcript)
+}
+
 func (api *API) workspaceAgentListeningPorts(rw http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	workspace := httpmw.WorkspaceParam(r)
@@ -342,8 +961,39 @@ func (api *API) workspaceAgentListeningPorts(rw http.ResponseWriter, r *http.Req
 
 	// Filter out ports that are globally blocked, in-use by applications, or
 	// common non-HTTP ports such as databases, FTP, SSH, etc.
-	filteredPorts := make([]codersdk.ListeningPort, 0, len(portsResponse.Ports))
+	// Ports that were declared in the workspace are listed first, even if
+	// they'd be filtered or nothing listens on them yet.
+	declaredPorts, err := api.Database.GetWorkspaceAgentDeclaredPortsByAgentID(ctx, workspaceAgent.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching declared ports.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	listening := make(map[uint16]codersdk.ListeningPort, len(portsResponse.Ports))
+	for _, port := range portsResponse.Ports {
+		listening[port.Port] = port
+	}
+	filteredPorts := make([]codersdk.ListeningPort, 0, len(declaredPorts)+len(portsResponse.Ports))
+	declared := make(map[uint16]struct{}, len(declaredPorts))
+	for _, declaredPort := range declaredPorts {
+		port, ok := listening[uint16(declaredPort.Port)]
+		if !ok {
+			port = codersdk.ListeningPort{
+				Network: codersdk.ListeningPortNetworkTCP,
+				Port:    uint16(declaredPort.Port),
+			}
+		}
+		port.Name = declaredPort.Name
+		port.Declared = true
+		filteredPorts = append(filteredPorts, port)
+		declared[port.Port] = struct{}{}
+	}
 	for _, port := range portsResponse.Ports {
+		if _, ok := declared[port.Port]; ok {
+			continue
+		}
 		if port.Port < uint16(codersdk.MinimumListeningPort) {
 			continue
 		}
@@ -424,7 +1074,8 @@ func (api *API) dialWorkspaceAgentTailnet(r *http.Request, agentID uuid.UUID) (*
 		}
 	}()
 	return &codersdk.AgentConn{
-		Conn: conn,
+		Conn:             conn,
+		ExperimentalQUIC: api.DeploymentConfig.Experimental.Value,
 	}, nil
 }
 
@@ -647,6 +1298,7 @@ func convertApps(dbApps []database.WorkspaceApp) []codersdk.WorkspaceApp {
 			Slug:         dbApp.Slug,
 			DisplayName:  dbApp.DisplayName,
 			Command:      dbApp.Command.String,
+			URL:          dbApp.Url.String,
 			Icon:         dbApp.Icon,
 			Subdomain:    dbApp.Subdomain,
 			SharingLevel: codersdk.WorkspaceAppSharingLevel(dbApp.SharingLevel),
@@ -775,7 +1427,19 @@ func (api *API) workspaceAgentReportStats(rw http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if req.RxBytes == 0 && req.TxBytes == 0 {
+	if req.Usage != nil && api.DeploymentConfig.Telemetry.Enable.Value {
+		api.Telemetry.Report(&telemetry.Snapshot{
+			WorkspaceAgentUsages: []telemetry.WorkspaceAgentUsage{telemetry.ConvertWorkspaceAgentUsage(*req.Usage)},
+		})
+	}
+
+	api.agentConnectionPaths.observe(req)
+
+	// Traffic doesn't mean the workspace was used, since it can come from
+	// background requests like health checks. Agents that report being idle
+	// since before the last report don't bump the workspace.
+	idle := time.Duration(req.IdleSeconds) * time.Second
+	if (req.RxBytes == 0 && req.TxBytes == 0) || idle >= api.AgentStatsRefreshInterval {
 		httpapi.Write(ctx, rw, http.StatusOK, codersdk.AgentStatsResponse{
 			ReportInterval: api.AgentStatsRefreshInterval,
 		})
@@ -3,11 +3,16 @@ package coderd_test
 import (
 	"bufio"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -18,6 +23,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/oauth2"
 
 	"cdr.dev/slog"
@@ -367,6 +373,101 @@ func TestWorkspaceAgentTailnet(t *testing.T) {
 	require.Equal(t, "test", strings.TrimSpace(string(output)))
 }
 
+func TestWorkspaceAgentSSHCertificate(t *testing.T) {
+	t.Parallel()
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authority, err := gossh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	client, daemonCloser := coderdtest.NewWithProvisionerCloser(t, &coderdtest.Options{
+		SSHUserCertificateAuthority: authority,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+	daemonCloser.Close()
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+	agentCloser := agent.New(agent.Options{
+		Client: agentClient,
+		Logger: slogtest.Make(t, nil).Named("agent").Leveled(slog.LevelDebug),
+	})
+	defer agentCloser.Close()
+	resources := coderdtest.AwaitWorkspaceAgents(t, client, workspace.ID)
+	agentID := resources[0].Agents[0].ID
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancelFunc()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+	resp, err := client.WorkspaceAgentSSHCertificate(ctx, agentID, codersdk.SSHCertificateRequest{
+		PublicKey: string(gossh.MarshalAuthorizedKey(signer.PublicKey())),
+	})
+	require.NoError(t, err)
+	publicKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(resp.Certificate))
+	require.NoError(t, err)
+	cert, ok := publicKey.(*gossh.Certificate)
+	require.True(t, ok)
+	require.Equal(t, []string{agentID.String()}, cert.ValidPrincipals)
+	require.Equal(t, authority.PublicKey().Marshal(), cert.SignatureKey.Marshal())
+	require.WithinDuration(t, time.Now().Add(5*time.Minute), resp.ExpiresAt, time.Minute)
+	certSigner, err := gossh.NewCertSigner(cert, signer)
+	require.NoError(t, err)
+
+	conn, err := client.DialWorkspaceAgent(ctx, agentID, &codersdk.DialWorkspaceAgentOptions{
+		Logger: slogtest.Make(t, nil).Named("client").Leveled(slog.LevelDebug),
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The agent requires a certificate once it has the metadata.
+	require.Eventually(t, func() bool {
+		sshClient, err := conn.SSHClient(ctx)
+		if err != nil {
+			return true
+		}
+		_ = sshClient.Close()
+		return false
+	}, testutil.WaitShort, testutil.IntervalFast)
+
+	sshClient, err := conn.SSHClient(ctx, gossh.PublicKeys(certSigner))
+	require.NoError(t, err)
+	defer sshClient.Close()
+	session, err := sshClient.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+	output, err := session.CombinedOutput("echo test")
+	require.NoError(t, err)
+	require.Equal(t, "test", strings.TrimSpace(string(output)))
+}
+
 func TestWorkspaceAgentPTY(t *testing.T) {
 	t.Parallel()
 	if runtime.GOOS == "windows" {
@@ -467,7 +568,7 @@ func TestWorkspaceAgentPTY(t *testing.T) {
 func TestWorkspaceAgentListeningPorts(t *testing.T) {
 	t.Parallel()
 
-	setup := func(t *testing.T, apps []*proto.App) (*codersdk.Client, uint16, uuid.UUID) {
+	setup := func(t *testing.T, apps []*proto.App, opts ...func(*agent.Options)) (*codersdk.Client, uint16, uuid.UUID) {
 		client := coderdtest.New(t, &coderdtest.Options{
 			IncludeProvisionerDaemon: true,
 		})
@@ -504,10 +605,15 @@ func TestWorkspaceAgentListeningPorts(t *testing.T) {
 
 		agentClient := codersdk.New(client.URL)
 		agentClient.SetSessionToken(authToken)
-		agentCloser := agent.New(agent.Options{
-			Client: agentClient,
-			Logger: slogtest.Make(t, nil).Named("agent").Leveled(slog.LevelDebug),
-		})
+		options := agent.Options{
+			Client:  agentClient,
+			Logger:  slogtest.Make(t, nil).Named("agent").Leveled(slog.LevelDebug),
+			TempDir: t.TempDir(),
+		}
+		for _, opt := range opts {
+			opt(&options)
+		}
+		agentCloser := agent.New(options)
 		t.Cleanup(func() {
 			_ = agentCloser.Close()
 		})
@@ -707,6 +813,37 @@ func TestWorkspaceAgentListeningPorts(t *testing.T) {
 		require.NoError(t, err)
 		require.Len(t, res.Ports, 0)
 	})
+
+	t.Run("Declared", func(t *testing.T) {
+		t.Parallel()
+
+		tempDir := t.TempDir()
+		// Declared ports are listed even if they'd be filtered, or nothing
+		// listens on them.
+		err := os.WriteFile(filepath.Join(tempDir, "coder-ports.json"), []byte(`[
+			{"port": 5432, "name": "database"},
+			{"port": 3000, "name": "frontend"}
+		]`), 0o600)
+		require.NoError(t, err)
+		client, _, agentID := setup(t, nil, func(o *agent.Options) {
+			o.TempDir = tempDir
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		var res codersdk.ListeningPortsResponse
+		require.Eventually(t, func() bool {
+			res, err = client.WorkspaceAgentListeningPorts(ctx, agentID)
+			return err == nil && len(res.Ports) >= 2 && res.Ports[0].Declared
+		}, testutil.WaitLong, testutil.IntervalFast)
+		require.Equal(t, uint16(3000), res.Ports[0].Port)
+		require.Equal(t, "frontend", res.Ports[0].Name)
+		require.True(t, res.Ports[0].Declared)
+		require.Equal(t, uint16(5432), res.Ports[1].Port)
+		require.Equal(t, "database", res.Ports[1].Name)
+		require.True(t, res.Ports[1].Declared)
+	})
 }
 
 func TestWorkspaceAgentAppHealth(t *testing.T) {
@@ -1194,6 +1331,189 @@ func TestWorkspaceAgentReportStats(t *testing.T) {
 			"%s is not after %s", newWorkspace.LastUsedAt, workspace.LastUsedAt,
 		)
 	})
+
+	t.Run("Idle", func(t *testing.T) {
+		t.Parallel()
+
+		client := coderdtest.New(t, &coderdtest.Options{
+			IncludeProvisionerDaemon: true,
+		})
+		user := coderdtest.CreateFirstUser(t, client)
+		authToken := uuid.NewString()
+		version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+			Parse:         echo.ParseComplete,
+			ProvisionPlan: echo.ProvisionComplete,
+			ProvisionApply: []*proto.Provision_Response{{
+				Type: &proto.Provision_Response_Complete{
+					Complete: &proto.Provision_Complete{
+						Resources: []*proto.Resource{{
+							Name: "example",
+							Type: "aws_instance",
+							Agents: []*proto.Agent{{
+								Id: uuid.NewString(),
+								Auth: &proto.Agent_Token{
+									Token: authToken,
+								},
+							}},
+						}},
+					},
+				},
+			}},
+		})
+		template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+		coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+		workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+		coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+		agentClient := codersdk.New(client.URL)
+		agentClient.SetSessionToken(authToken)
+
+		// Traffic from an agent that's been idle since before the last
+		// report doesn't count as use.
+		_, err := agentClient.PostAgentStats(context.Background(), &codersdk.AgentStats{
+			ConnsByProto: map[string]int64{"TCP": 1},
+			NumConns:     1,
+			RxPackets:    1,
+			RxBytes:      1,
+			TxPackets:    1,
+			TxBytes:      1,
+			IdleSeconds:  int64(time.Hour / time.Second),
+		})
+		require.NoError(t, err)
+
+		newWorkspace, err := client.Workspace(context.Background(), workspace.ID)
+		require.NoError(t, err)
+		require.Equal(t, workspace.LastUsedAt, newWorkspace.LastUsedAt)
+	})
+}
+
+func TestWorkspaceAgentHandshake(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	resp, err := agentClient.PostWorkspaceAgentHandshake(ctx, codersdk.WorkspaceAgentHandshakeRequest{
+		Version:         "v0.0.0",
+		ProtocolVersion: codersdk.WorkspaceAgentProtocolVersion + 1,
+		Capabilities: []codersdk.WorkspaceAgentCapability{
+			codersdk.WorkspaceAgentCapabilityAppHealth,
+			"from-the-future",
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, codersdk.WorkspaceAgentProtocolVersion, resp.ProtocolVersion)
+	require.Equal(t, []codersdk.WorkspaceAgentCapability{codersdk.WorkspaceAgentCapabilityAppHealth}, resp.Capabilities)
+
+	_, err = agentClient.PostWorkspaceAgentHandshake(ctx, codersdk.WorkspaceAgentHandshakeRequest{})
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+
+	_, err = agentClient.PostWorkspaceAgentHandshake(ctx, codersdk.WorkspaceAgentHandshakeRequest{
+		ProtocolVersion: codersdk.WorkspaceAgentProtocolVersion,
+		IdentityKey:     []byte("too short"),
+	})
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+}
+
+func TestWorkspaceAgentIdentity(t *testing.T) {
+	t.Parallel()
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+	agentCloser := agent.New(agent.Options{
+		Client: agentClient,
+		Logger: slogtest.Make(t, nil).Named("agent").Leveled(slog.LevelDebug),
+	})
+	defer agentCloser.Close()
+	resources := coderdtest.AwaitWorkspaceAgents(t, client, workspace.ID)
+	agentID := resources[0].Agents[0].ID
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	// The key is registered with the handshake, before the agent
+	// connects.
+	key, err := client.WorkspaceAgentIdentityKey(ctx, agentID)
+	require.NoError(t, err)
+	require.Len(t, key.PublicKey, ed25519.PublicKeySize)
+
+	conn, err := client.DialWorkspaceAgent(ctx, agentID, &codersdk.DialWorkspaceAgentOptions{
+		Logger: slogtest.Make(t, nil).Named("client").Leveled(slog.LevelDebug),
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.True(t, conn.AwaitReachable(ctx))
+	require.NoError(t, conn.VerifyIdentity(ctx, key.PublicKey))
+
+	// A connection to another agent doesn't hold the registered key.
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.Error(t, conn.VerifyIdentity(ctx, otherKey))
 }
 
 func gitAuthCallback(t *testing.T, id string, client *codersdk.Client) *http.Response {
@@ -1220,3 +1540,294 @@ func gitAuthCallback(t *testing.T, id string, client *codersdk.Client) *http.Res
 	})
 	return res
 }
+
+func TestWorkspaceAgentStartupLogs(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	build := coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+	agentID := build.Resources[0].Agents[0].ID
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	logs, err := client.WorkspaceAgentStartupLogs(ctx, agentID, 0)
+	require.NoError(t, err)
+	require.Empty(t, logs)
+
+	err = agentClient.PatchStartupLogs(ctx, codersdk.PatchStartupLogs{
+		Logs: []codersdk.StartupLog{{
+			CreatedAt: database.Now(),
+			Output:    "first",
+		}, {
+			CreatedAt: database.Now(),
+			Output:    "second",
+		}},
+	})
+	require.NoError(t, err)
+
+	logs, err = client.WorkspaceAgentStartupLogs(ctx, agentID, 0)
+	require.NoError(t, err)
+	require.Len(t, logs, 2)
+	require.EqualValues(t, 1, logs[0].ID)
+	require.Equal(t, "first", logs[0].Output)
+	require.Equal(t, "second", logs[1].Output)
+
+	// Clients poll for the lines after the last one they received.
+	logs, err = client.WorkspaceAgentStartupLogs(ctx, agentID, 1)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	require.Equal(t, "second", logs[0].Output)
+
+	err = agentClient.PatchStartupLogs(ctx, codersdk.PatchStartupLogs{})
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+}
+
+func TestWorkspaceAgentBootTiming(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	build := coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+	agentID := build.Resources[0].Agents[0].ID
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	_, err := client.WorkspaceAgentBootTiming(ctx, agentID)
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.StatusCode())
+
+	tokenExchange := int64(150)
+	startedAt := database.Now()
+	err = agentClient.PostWorkspaceAgentBootTiming(ctx, codersdk.WorkspaceAgentBootTiming{
+		StartedAt:           startedAt,
+		TokenExchangeMillis: &tokenExchange,
+	})
+	require.NoError(t, err)
+
+	timing, err := client.WorkspaceAgentBootTiming(ctx, agentID)
+	require.NoError(t, err)
+	require.True(t, startedAt.Equal(timing.StartedAt))
+	require.NotNil(t, timing.TokenExchangeMillis)
+	require.Equal(t, tokenExchange, *timing.TokenExchangeMillis)
+	require.Nil(t, timing.StartupScriptMillis)
+
+	negative := int64(-1)
+	err = agentClient.PostWorkspaceAgentBootTiming(ctx, codersdk.WorkspaceAgentBootTiming{
+		StartedAt:          startedAt,
+		FirstSessionMillis: &negative,
+	})
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+}
+
+func TestWorkspaceAgentTunnels(t *testing.T) {
+	t.Parallel()
+
+	setup := func(t *testing.T, tunnels bool) (*codersdk.Client, *codersdk.Client, uuid.UUID) {
+		deploymentConfig := coderdtest.DeploymentConfig(t)
+		deploymentConfig.Tunnels.Value = tunnels
+		client := coderdtest.New(t, &coderdtest.Options{
+			AppHostname:              proxyTestSubdomainRaw,
+			DeploymentConfig:         deploymentConfig,
+			IncludeProvisionerDaemon: true,
+		})
+		user := coderdtest.CreateFirstUser(t, client)
+		authToken := uuid.NewString()
+		version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+			Parse:         echo.ParseComplete,
+			ProvisionPlan: echo.ProvisionComplete,
+			ProvisionApply: []*proto.Provision_Response{{
+				Type: &proto.Provision_Response_Complete{
+					Complete: &proto.Provision_Complete{
+						Resources: []*proto.Resource{{
+							Name: "example",
+							Type: "aws_instance",
+							Agents: []*proto.Agent{{
+								Id: uuid.NewString(),
+								Auth: &proto.Agent_Token{
+									Token: authToken,
+								},
+							}},
+						}},
+					},
+				},
+			}},
+		})
+		template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+		coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+		workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+		build := coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+		agentClient := codersdk.New(client.URL)
+		agentClient.SetSessionToken(authToken)
+		return client, agentClient, build.Resources[0].Agents[0].ID
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+		_, agentClient, _ := setup(t, false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		_, err := agentClient.PostWorkspaceAgentTunnel(ctx, codersdk.CreateWorkspaceAgentTunnelRequest{
+			Port: 8080,
+			Auth: codersdk.WorkspaceAgentTunnelAuthPublic,
+		})
+		var apiErr *codersdk.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusForbidden, apiErr.StatusCode())
+	})
+
+	t.Run("Proxy", func(t *testing.T) {
+		t.Parallel()
+		client, agentClient, agentID := setup(t, true)
+		agentCloser := agent.New(agent.Options{
+			Client: agentClient,
+			Logger: slogtest.Make(t, nil).Named("agent").Leveled(slog.LevelDebug),
+		})
+		defer agentCloser.Close()
+
+		// The webhook receiver in the workspace.
+		received := make(chan *http.Request, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- r
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte("received"))
+		}))
+		defer srv.Close()
+		port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		_, err := agentClient.PostWorkspaceAgentTunnel(ctx, codersdk.CreateWorkspaceAgentTunnelRequest{
+			Port: 1,
+			Auth: codersdk.WorkspaceAgentTunnelAuthToken,
+		})
+		var apiErr *codersdk.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+
+		tunnel, err := agentClient.PostWorkspaceAgentTunnel(ctx, codersdk.CreateWorkspaceAgentTunnelRequest{
+			Port:       uint16(port),
+			TTLSeconds: 600,
+			Auth:       codersdk.WorkspaceAgentTunnelAuthToken,
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, tunnel.Token)
+		require.Equal(t, agentID, tunnel.AgentID)
+		require.WithinDuration(t, time.Now().Add(10*time.Minute), tunnel.ExpiresAt, time.Minute)
+		tunnelURL, err := url.Parse(tunnel.URL)
+		require.NoError(t, err)
+		require.Equal(t, "tunnel--"+tunnel.ID+"."+proxyTestSubdomain, tunnelURL.Hostname())
+
+		// Requests to the hostname of the tunnel are sent to Coder.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, client.URL.Host)
+		}
+		defer transport.CloseIdleConnections()
+		httpClient := &http.Client{Transport: transport}
+		post := func(url string) *http.Response {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader("payload"))
+			require.NoError(t, err)
+			res, err := httpClient.Do(req)
+			require.NoError(t, err)
+			_ = res.Body.Close()
+			return res
+		}
+		res := post(tunnel.URL + "hook")
+		require.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+		res = post(tunnel.URL + "hook?event=push&" + codersdk.WorkspaceAgentTunnelTokenQueryParam + "=" + tunnel.Token)
+		require.Equal(t, http.StatusAccepted, res.StatusCode)
+		req := <-received
+		require.Equal(t, "/hook", req.URL.Path)
+		require.Equal(t, "event=push", req.URL.RawQuery)
+
+		// Tunnels aren't served on the dashboard origin.
+		_ = post(client.URL.String() + "/tunnels/" + tunnel.ID + "/hook?" + codersdk.WorkspaceAgentTunnelTokenQueryParam + "=" + tunnel.Token)
+		require.Empty(t, received)
+
+		tunnels, err := client.WorkspaceAgentTunnels(ctx, agentID)
+		require.NoError(t, err)
+		require.Len(t, tunnels, 1)
+		require.Empty(t, tunnels[0].Token)
+		require.Equal(t, int64(1), tunnels[0].Traffic.Requests)
+		require.Equal(t, int64(1), tunnels[0].Traffic.Rejected)
+		require.Equal(t, int64(len("payload")), tunnels[0].Traffic.BytesReceived)
+		require.Equal(t, int64(len("received")), tunnels[0].Traffic.BytesSent)
+		require.NotNil(t, tunnels[0].Traffic.LastRequestAt)
+
+		closed, err := agentClient.DeleteWorkspaceAgentTunnel(ctx, tunnel.ID)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), closed.Traffic.Requests)
+		res = post(tunnel.URL + "hook?" + codersdk.WorkspaceAgentTunnelTokenQueryParam + "=" + tunnel.Token)
+		require.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+}
@@ -0,0 +1,210 @@
+package coderd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// agentStartupLogsChannel is where replicas publish the startup logs
+	// they receive, since agents and clients can use different replicas.
+	agentStartupLogsChannel = "workspace_agent_startup_logs"
+	// agentStartupLogsMaxSize is the size of the output kept per agent.
+	// Agents limit the logs they send too, but the limit of coderd holds
+	// regardless of how agents are configured.
+	agentStartupLogsMaxSize = 1 << 20
+	// agentStartupLogsTTL is how long the logs of an agent are kept after
+	// it last sent any.
+	agentStartupLogsTTL = 24 * time.Hour
+)
+
+// agentStartupLogsMessage is published when a replica receives logs.
+type agentStartupLogsMessage struct {
+	AgentID uuid.UUID                           `json:"agent_id"`
+	Logs    []codersdk.WorkspaceAgentStartupLog `json:"logs"`
+}
+
+// agentStartupLogs are the startup script logs that agents streamed,
+// keyed by agent ID. Logs are only kept in memory, since they're meant
+// for watching a workspace start. The full logs stay in the workspace.
+type agentStartupLogs struct {
+	mutex     sync.RWMutex
+	agents    map[uuid.UUID]*agentStartupLogBuffer
+	lastPrune time.Time
+}
+
+type agentStartupLogBuffer struct {
+	logs      []codersdk.WorkspaceAgentStartupLog
+	size      int
+	truncated bool
+	updatedAt time.Time
+}
+
+func newAgentStartupLogs() *agentStartupLogs {
+	return &agentStartupLogs{
+		agents: map[uuid.UUID]*agentStartupLogBuffer{},
+	}
+}
+
+// buffer returns the logs of an agent. The caller must hold the mutex.
+func (l *agentStartupLogs) buffer(agentID uuid.UUID, now time.Time) *agentStartupLogBuffer {
+	if now.Sub(l.lastPrune) >= time.Hour {
+		l.lastPrune = now
+		for id, buffer := range l.agents {
+			if now.Sub(buffer.updatedAt) >= agentStartupLogsTTL {
+				delete(l.agents, id)
+			}
+		}
+	}
+	buffer, ok := l.agents[agentID]
+	if !ok {
+		buffer = &agentStartupLogBuffer{}
+		l.agents[agentID] = buffer
+	}
+	buffer.updatedAt = now
+	return buffer
+}
+
+// append assigns IDs to the lines of an agent and stores them, and returns
+// the stored lines. Lines beyond the size limit are dropped, with a line
+// that notes the truncation in their place.
+func (l *agentStartupLogs) append(agentID uuid.UUID, logs []codersdk.StartupLog) []codersdk.WorkspaceAgentStartupLog {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	buffer := l.buffer(agentID, time.Now())
+	var stored []codersdk.WorkspaceAgentStartupLog
+	for _, line := range logs {
+		if buffer.truncated {
+			break
+		}
+		output := line.Output
+		if buffer.size+len(output) > agentStartupLogsMaxSize {
+			buffer.truncated = true
+			output = "[... output truncated by Coder ...]"
+		}
+		entry := codersdk.WorkspaceAgentStartupLog{
+			ID:        int64(len(buffer.logs)) + 1,
+			CreatedAt: line.CreatedAt,
+			Output:    output,
+		}
+		buffer.logs = append(buffer.logs, entry)
+		buffer.size += len(output)
+		stored = append(stored, entry)
+	}
+	return stored
+}
+
+// merge stores lines that another replica received, skipping the ones
+// that are already stored.
+func (l *agentStartupLogs) merge(agentID uuid.UUID, logs []codersdk.WorkspaceAgentStartupLog) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	buffer := l.buffer(agentID, time.Now())
+	for _, line := range logs {
+		if line.ID != int64(len(buffer.logs))+1 {
+			continue
+		}
+		buffer.logs = append(buffer.logs, line)
+		buffer.size += len(line.Output)
+	}
+	buffer.truncated = buffer.size >= agentStartupLogsMaxSize
+}
+
+// after returns the lines of an agent with an ID greater than after.
+func (l *agentStartupLogs) after(agentID uuid.UUID, after int64) []codersdk.WorkspaceAgentStartupLog {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	buffer, ok := l.agents[agentID]
+	if !ok || after < 0 || after >= int64(len(buffer.logs)) {
+		return []codersdk.WorkspaceAgentStartupLog{}
+	}
+	// IDs start at one and have no gaps.
+	logs := make([]codersdk.WorkspaceAgentStartupLog, len(buffer.logs)-int(after))
+	copy(logs, buffer.logs[after:])
+	return logs
+}
+
+// subscribeAgentStartupLogs stores the startup logs that agents streamed
+// to other replicas.
+func (api *API) subscribeAgentStartupLogs() (func(), error) {
+	return api.Pubsub.Subscribe(agentStartupLogsChannel, func(ctx context.Context, message []byte) {
+		var msg agentStartupLogsMessage
+		err := json.Unmarshal(message, &msg)
+		if err != nil {
+			return
+		}
+		api.agentStartupLogs.merge(msg.AgentID, msg.Logs)
+	})
+}
+
+func (api *API) patchWorkspaceAgentStartupLogs(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.PatchStartupLogs
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if len(req.Logs) == 0 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "No logs were provided.",
+		})
+		return
+	}
+
+	stored := api.agentStartupLogs.append(workspaceAgent.ID, req.Logs)
+	if len(stored) > 0 {
+		message, err := json.Marshal(agentStartupLogsMessage{
+			AgentID: workspaceAgent.ID,
+			Logs:    stored,
+		})
+		if err == nil {
+			err = api.Pubsub.Publish(agentStartupLogsChannel, message)
+		}
+		if err != nil {
+			api.Logger.Warn(ctx, "publish workspace agent startup logs", slog.F("agent_id", workspaceAgent.ID), slog.Error(err))
+		}
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Appended startup logs.",
+	})
+}
+
+func (api *API) workspaceAgentStartupLogs(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	var after int64
+	if raw := r.URL.Query().Get("after"); raw != "" {
+		var err error
+		after, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+				Message: "Query param \"after\" must be an integer.",
+				Validations: []codersdk.ValidationError{{
+					Field:  "after",
+					Detail: err.Error(),
+				}},
+			})
+			return
+		}
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, api.agentStartupLogs.after(workspaceAgent.ID, after))
+}
@@ -0,0 +1,67 @@
+package coderd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/codersdk"
+)
+
+// agentStartupScriptResults counts how the startup scripts of agents
+// ended, so templates with hanging or failing scripts can be found.
+type agentStartupScriptResults struct {
+	results *prometheus.CounterVec
+}
+
+func newAgentStartupScriptResults(registerer prometheus.Registerer) *agentStartupScriptResults {
+	return &agentStartupScriptResults{
+		results: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "coderd",
+			Subsystem: "agents",
+			Name:      "startup_script_results_total",
+			Help:      "How the startup scripts of workspace agents ended, by whether they succeeded, timed out or failed.",
+		}, []string{"state"}),
+	}
+}
+
+func (api *API) postWorkspaceAgentStartupScriptResult(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	var req codersdk.WorkspaceAgentStartupScriptResult
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	switch req.State {
+	case codersdk.WorkspaceAgentStartupScriptOK,
+		codersdk.WorkspaceAgentStartupScriptTimedOut,
+		codersdk.WorkspaceAgentStartupScriptFailed:
+	default:
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Invalid startup script result.",
+			Validations: []codersdk.ValidationError{{
+				Field:  "state",
+				Detail: fmt.Sprintf("unknown state %q", req.State),
+			}},
+		})
+		return
+	}
+
+	api.agentStartupScriptResults.results.WithLabelValues(string(req.State)).Inc()
+	if req.State != codersdk.WorkspaceAgentStartupScriptOK {
+		api.Logger.Info(ctx, "workspace agent startup script didn't succeed",
+			slog.F("agent_id", workspaceAgent.ID),
+			slog.F("state", req.State),
+			slog.F("attempts", req.Attempts),
+			slog.F("error", req.Error))
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.Response{
+		Message: "Recorded startup script result.",
+	})
+}
@@ -0,0 +1,474 @@
+package coderd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/cryptorand"
+)
+
+const (
+	// agentTunnelChannel is where replicas publish the tunnels that are
+	// opened and closed, since requests to a tunnel can reach any replica.
+	agentTunnelChannel = "workspace_agent_tunnels"
+	// defaultAgentTunnelTTL is how long tunnels are open when the agent
+	// doesn't request a TTL.
+	defaultAgentTunnelTTL = time.Hour
+	// maxAgentTunnelTTL limits how long a tunnel can be open, since it
+	// exposes the workspace to the internet.
+	maxAgentTunnelTTL = 24 * time.Hour
+	// maxAgentTunnels limits the open tunnels of an agent.
+	maxAgentTunnels = 10
+	// agentTunnelSubdomainPrefix prefixes the IDs of tunnels in the
+	// subdomains of the app hostname they are served on. Subdomains of apps
+	// always have four parts separated by "--", so they can't collide.
+	agentTunnelSubdomainPrefix = "tunnel--"
+)
+
+// agentTunnelMessage is published when a tunnel is opened or closed.
+type agentTunnelMessage struct {
+	Tunnel    codersdk.WorkspaceAgentTunnel `json:"tunnel"`
+	TokenHash []byte                        `json:"token_hash,omitempty"`
+	Closed    bool                          `json:"closed,omitempty"`
+}
+
+// agentTunnels are the open tunnels of agents, keyed by ID. Tunnels are
+// only kept in memory, since they are ephemeral.
+type agentTunnels struct {
+	mutex   sync.RWMutex
+	tunnels map[string]*agentTunnel
+}
+
+type agentTunnel struct {
+	tunnel codersdk.WorkspaceAgentTunnel
+	// tokenHash is the SHA-256 hash of the token of tunnels with token
+	// auth.
+	tokenHash []byte
+
+	requests      atomic.Int64
+	rejected      atomic.Int64
+	bytesReceived atomic.Int64
+	bytesSent     atomic.Int64
+	lastRequestAt atomic.Pointer[time.Time]
+}
+
+func newAgentTunnels() *agentTunnels {
+	return &agentTunnels{
+		tunnels: map[string]*agentTunnel{},
+	}
+}
+
+// open stores a tunnel and removes the tunnels that expired.
+func (t *agentTunnels) open(tunnel codersdk.WorkspaceAgentTunnel, tokenHash []byte) {
+	now := time.Now()
+	tunnel.Token = ""
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for id, stored := range t.tunnels {
+		if now.After(stored.tunnel.ExpiresAt) {
+			delete(t.tunnels, id)
+		}
+	}
+	t.tunnels[tunnel.ID] = &agentTunnel{
+		tunnel:    tunnel,
+		tokenHash: tokenHash,
+	}
+}
+
+// close removes a tunnel.
+func (t *agentTunnels) close(id string) (*agentTunnel, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tunnel, ok := t.tunnels[id]
+	delete(t.tunnels, id)
+	return tunnel, ok
+}
+
+// get returns a tunnel unless it expired.
+func (t *agentTunnels) get(id string) (*agentTunnel, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	tunnel, ok := t.tunnels[id]
+	if !ok || time.Now().After(tunnel.tunnel.ExpiresAt) {
+		return nil, false
+	}
+	return tunnel, true
+}
+
+// agent returns the tunnels of an agent that didn't expire, oldest first.
+func (t *agentTunnels) agent(agentID uuid.UUID) []codersdk.WorkspaceAgentTunnel {
+	now := time.Now()
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	tunnels := []codersdk.WorkspaceAgentTunnel{}
+	for _, tunnel := range t.tunnels {
+		if tunnel.tunnel.AgentID == agentID && !now.After(tunnel.tunnel.ExpiresAt) {
+			tunnels = append(tunnels, tunnel.sdk())
+		}
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].CreatedAt.Before(tunnels[j].CreatedAt)
+	})
+	return tunnels
+}
+
+// sdk returns the tunnel with its traffic.
+func (t *agentTunnel) sdk() codersdk.WorkspaceAgentTunnel {
+	tunnel := t.tunnel
+	tunnel.Traffic = codersdk.WorkspaceAgentTunnelTraffic{
+		Requests:      t.requests.Load(),
+		Rejected:      t.rejected.Load(),
+		BytesReceived: t.bytesReceived.Load(),
+		BytesSent:     t.bytesSent.Load(),
+		LastRequestAt: t.lastRequestAt.Load(),
+	}
+	return tunnel
+}
+
+// authorize returns whether the request has the token of the tunnel.
+func (t *agentTunnel) authorize(r *http.Request) bool {
+	if t.tunnel.Auth == codersdk.WorkspaceAgentTunnelAuthPublic {
+		return true
+	}
+	token := r.Header.Get(codersdk.WorkspaceAgentTunnelTokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get(codersdk.WorkspaceAgentTunnelTokenQueryParam)
+	}
+	if token == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(hash[:], t.tokenHash) == 1
+}
+
+// subscribeAgentTunnels stores the tunnels that are opened and closed on
+// other replicas.
+func (api *API) subscribeAgentTunnels() (func(), error) {
+	return api.Pubsub.Subscribe(agentTunnelChannel, func(ctx context.Context, message []byte) {
+		var msg agentTunnelMessage
+		err := json.Unmarshal(message, &msg)
+		if err != nil {
+			return
+		}
+		if msg.Closed {
+			api.agentTunnels.close(msg.Tunnel.ID)
+			return
+		}
+		api.agentTunnels.open(msg.Tunnel, msg.TokenHash)
+	})
+}
+
+func (api *API) publishAgentTunnel(ctx context.Context, msg agentTunnelMessage) {
+	message, err := json.Marshal(msg)
+	if err == nil {
+		err = api.Pubsub.Publish(agentTunnelChannel, message)
+	}
+	if err != nil {
+		api.Logger.Warn(ctx, "publish workspace agent tunnel", slog.F("tunnel_id", msg.Tunnel.ID), slog.Error(err))
+	}
+}
+
+func (api *API) postWorkspaceAgentTunnel(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+	// Tunnels are served on subdomains of the app hostname, since they
+	// proxy content of workspaces that must not share an origin with the
+	// dashboard.
+	if !api.DeploymentConfig.Tunnels.Value || api.AppHostname == "" {
+		httpapi.Write(ctx, rw, http.StatusForbidden, codersdk.Response{
+			Message: "Tunnels are disabled on this deployment.",
+			Detail:  "Tunnels require the --tunnels and --wildcard-access-url flags of the server.",
+		})
+		return
+	}
+
+	var req codersdk.CreateWorkspaceAgentTunnelRequest
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	var validations []codersdk.ValidationError
+	if int(req.Port) < codersdk.MinimumListeningPort {
+		validations = append(validations, codersdk.ValidationError{
+			Field:  "port",
+			Detail: fmt.Sprintf("Coder reserves ports less than %d for internal use", codersdk.MinimumListeningPort),
+		})
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl == 0 {
+		ttl = defaultAgentTunnelTTL
+	}
+	if ttl < 0 || ttl > maxAgentTunnelTTL {
+		validations = append(validations, codersdk.ValidationError{
+			Field:  "ttl_seconds",
+			Detail: fmt.Sprintf("must be between 1 and %d", int64(maxAgentTunnelTTL.Seconds())),
+		})
+	}
+	switch req.Auth {
+	case codersdk.WorkspaceAgentTunnelAuthPublic, codersdk.WorkspaceAgentTunnelAuthToken:
+	default:
+		validations = append(validations, codersdk.ValidationError{
+			Field:  "auth",
+			Detail: fmt.Sprintf("must be %q or %q", codersdk.WorkspaceAgentTunnelAuthPublic, codersdk.WorkspaceAgentTunnelAuthToken),
+		})
+	}
+	if len(validations) > 0 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message:     "Invalid tunnel request.",
+			Validations: validations,
+		})
+		return
+	}
+	if len(api.agentTunnels.agent(workspaceAgent.ID)) >= maxAgentTunnels {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: fmt.Sprintf("The workspace agent can't have more than %d open tunnels.", maxAgentTunnels),
+		})
+		return
+	}
+
+	id, err := cryptorand.HexString(32)
+	if err != nil {
+		httpapi.InternalServerError(rw, err)
+		return
+	}
+	host := strings.Replace(api.AppHostname, "*", agentTunnelSubdomainPrefix+id, 1)
+	if api.AccessURL.Port() != "" {
+		host += ":" + api.AccessURL.Port()
+	}
+	tunnelURL := url.URL{
+		Scheme: api.AccessURL.Scheme,
+		Host:   host,
+		Path:   "/",
+	}
+	now := time.Now()
+	tunnel := codersdk.WorkspaceAgentTunnel{
+		ID:        id,
+		AgentID:   workspaceAgent.ID,
+		Port:      req.Port,
+		URL:       tunnelURL.String(),
+		Auth:      req.Auth,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	var tokenHash []byte
+	if req.Auth == codersdk.WorkspaceAgentTunnelAuthToken {
+		tunnel.Token, err = cryptorand.String(32)
+		if err != nil {
+			httpapi.InternalServerError(rw, err)
+			return
+		}
+		hash := sha256.Sum256([]byte(tunnel.Token))
+		tokenHash = hash[:]
+	}
+
+	api.agentTunnels.open(tunnel, tokenHash)
+	// Only the hash of the token is published.
+	published := tunnel
+	published.Token = ""
+	api.publishAgentTunnel(ctx, agentTunnelMessage{
+		Tunnel:    published,
+		TokenHash: tokenHash,
+	})
+	api.Logger.Info(ctx, "opened workspace agent tunnel",
+		slog.F("agent_id", workspaceAgent.ID),
+		slog.F("tunnel_id", tunnel.ID),
+		slog.F("port", tunnel.Port),
+		slog.F("auth", tunnel.Auth),
+		slog.F("expires_at", tunnel.ExpiresAt),
+	)
+	httpapi.Write(ctx, rw, http.StatusCreated, tunnel)
+}
+
+func (api *API) deleteWorkspaceAgentTunnel(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+
+	id := chi.URLParam(r, "tunnel")
+	tunnel, ok := api.agentTunnels.get(id)
+	if !ok || tunnel.tunnel.AgentID != workspaceAgent.ID {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+	api.agentTunnels.close(id)
+	api.publishAgentTunnel(ctx, agentTunnelMessage{
+		Tunnel: codersdk.WorkspaceAgentTunnel{ID: id, AgentID: workspaceAgent.ID},
+		Closed: true,
+	})
+	closed := tunnel.sdk()
+	api.Logger.Info(ctx, "closed workspace agent tunnel",
+		slog.F("agent_id", workspaceAgent.ID),
+		slog.F("tunnel_id", id),
+		slog.F("requests", closed.Traffic.Requests),
+		slog.F("bytes_received", closed.Traffic.BytesReceived),
+		slog.F("bytes_sent", closed.Traffic.BytesSent),
+	)
+	httpapi.Write(ctx, rw, http.StatusOK, closed)
+}
+
+func (api *API) workspaceAgentTunnels(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	workspaceAgent := httpmw.WorkspaceAgentParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	httpapi.Write(ctx, rw, http.StatusOK, api.agentTunnels.agent(workspaceAgent.ID))
+}
+
+// handleSubdomainTunnels proxies requests to subdomains of the app hostname
+// that start with agentTunnelSubdomainPrefix to their tunnel. Other
+// requests are passed on.
+func (api *API) handleSubdomainTunnels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !api.DeploymentConfig.Tunnels.Value || api.AppHostname == "" || api.AppHostnameRegex == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		host := httpapi.RequestHost(r)
+		if httpapi.HostnamesMatch(api.AccessURL.Hostname(), host) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		subdomain, ok := httpapi.ExecuteHostnamePattern(api.AppHostnameRegex, host)
+		if !ok || !strings.HasPrefix(subdomain, agentTunnelSubdomainPrefix) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		api.workspaceAgentTunnelProxy(rw, r, strings.TrimPrefix(subdomain, agentTunnelSubdomainPrefix))
+	})
+}
+
+// workspaceAgentTunnelProxy proxies requests to the public URL of a tunnel
+// to the port of the tunnel in the workspace. Requests aren't
+// authenticated with Coder, since they come from outside of it.
+func (api *API) workspaceAgentTunnelProxy(rw http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+
+	tunnel, ok := api.agentTunnels.get(id)
+	if !ok {
+		httpapi.Write(ctx, rw, http.StatusNotFound, codersdk.Response{
+			Message: "The tunnel doesn't exist or expired.",
+		})
+		return
+	}
+	if !tunnel.authorize(r) {
+		tunnel.rejected.Add(1)
+		httpapi.Write(ctx, rw, http.StatusUnauthorized, codersdk.Response{
+			Message: fmt.Sprintf("The tunnel requires its token in the %q header or the %q query parameter.", codersdk.WorkspaceAgentTunnelTokenHeader, codersdk.WorkspaceAgentTunnelTokenQueryParam),
+		})
+		return
+	}
+	now := time.Now()
+	tunnel.requests.Add(1)
+	tunnel.lastRequestAt.Store(&now)
+
+	// Filter IP headers from untrusted origins!
+	httpmw.FilterUntrustedOriginHeaders(api.RealIPConfig, r)
+	err := httpmw.EnsureXForwardedForHeader(r)
+	if err != nil {
+		httpapi.InternalServerError(rw, err)
+		return
+	}
+	// The token and the credentials of Coder are never forwarded to the
+	// workspace.
+	r.Header.Del(codersdk.WorkspaceAgentTunnelTokenHeader)
+	r.Header.Del(codersdk.WorkspaceAppTokenHeader)
+	query := r.URL.Query()
+	if query.Has(codersdk.WorkspaceAgentTunnelTokenQueryParam) {
+		query.Del(codersdk.WorkspaceAgentTunnelTokenQueryParam)
+		r.URL.RawQuery = query.Encode()
+	}
+	cookieHeaders := r.Header.Values("Cookie")[:]
+	r.Header.Del("Cookie")
+	for _, cookieHeader := range cookieHeaders {
+		r.Header.Add("Cookie", httpapi.StripCoderCookies(cookieHeader))
+	}
+	conn, release, err := api.workspaceAgentCache.Acquire(r, tunnel.tunnel.AgentID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusBadGateway, codersdk.Response{
+			Message: "Could not connect to the workspace agent.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	defer release()
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("127.0.0.1:%d", tunnel.tunnel.Port),
+	})
+	proxy.Transport = conn.HTTPTransport()
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		httpapi.Write(ctx, w, http.StatusBadGateway, codersdk.Response{
+			Message: fmt.Sprintf("Failed to proxy the request to port %d in the workspace.", tunnel.tunnel.Port),
+			Detail:  err.Error(),
+		})
+	}
+	if r.Body != nil {
+		r.Body = &countingReadCloser{ReadCloser: r.Body, count: &tunnel.bytesReceived}
+	}
+	proxy.ServeHTTP(&countingResponseWriter{ResponseWriter: rw, count: &tunnel.bytesSent}, r)
+}
+
+// countingReadCloser counts the bytes read from a request body.
+type countingReadCloser struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to a response. Bytes of
+// hijacked connections aren't counted.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count *atomic.Int64
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+func (c *countingResponseWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, xerrors.Errorf("%T is not a http.Hijacker", c.ResponseWriter)
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,91 @@
+package coderd
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/coder/coder/codersdk"
+)
+
+const (
+	// appPortListeningCacheDuration is how long a port that something was
+	// listening on isn't checked again, so requests to apps that are up
+	// don't wait for the agent.
+	appPortListeningCacheDuration = 10 * time.Second
+	// appPortCheckTimeout limits how long proxied requests wait for the
+	// agent to tell whether something is listening on the port of an app.
+	appPortCheckTimeout = 2 * time.Second
+)
+
+// appPorts asks agents whether something is listening on the ports of
+// apps before requests are proxied to them, so requests to apps that
+// aren't listening fail with the reason right away.
+type appPorts struct {
+	mutex sync.Mutex
+	// listening are when ports were last found listening, by agent.
+	listening map[appPort]time.Time
+}
+
+type appPort struct {
+	agentID uuid.UUID
+	port    uint16
+}
+
+func newAppPorts() *appPorts {
+	return &appPorts{
+		listening: map[appPort]time.Time{},
+	}
+}
+
+// check returns whether something is listening on the port of the agent.
+// Ports that were found listening recently are assumed to still be.
+func (p *appPorts) check(ctx context.Context, agentID uuid.UUID, conn *codersdk.AgentConn, port uint16) (codersdk.PortListeningResponse, error) {
+	key := appPort{agentID: agentID, port: port}
+	p.mutex.Lock()
+	checkedAt, ok := p.listening[key]
+	p.mutex.Unlock()
+	if ok && time.Since(checkedAt) < appPortListeningCacheDuration {
+		return codersdk.PortListeningResponse{Port: port, Listening: true}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, appPortCheckTimeout)
+	defer cancel()
+	resp, err := conn.PortListening(ctx, port)
+	if err != nil {
+		return codersdk.PortListeningResponse{}, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !resp.Listening {
+		delete(p.listening, key)
+		return resp, nil
+	}
+	p.listening[key] = time.Now()
+	// Ports of agents that are gone are left behind, which are removed
+	// once they'd be checked again.
+	for existing, checkedAt := range p.listening {
+		if time.Since(checkedAt) >= appPortListeningCacheDuration {
+			delete(p.listening, existing)
+		}
+	}
+	return resp, nil
+}
+
+// appURLPort returns the port of the URL of an app, which defaults to the
+// port of its scheme.
+func appURLPort(u *url.URL) uint16 {
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err == nil {
+		return uint16(port)
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
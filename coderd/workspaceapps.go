@@ -709,6 +709,26 @@ func (api *API) proxyWorkspaceApplication(proxyApp proxyApplication, rw http.Res
 	}
 	defer release()
 
+	// Dialing ports that nothing listens on fails only after the dial
+	// times out, so the agent is asked first. Older agents can't tell,
+	// and requests to them are proxied anyway.
+	listening, err := api.appPorts.check(ctx, proxyApp.Agent.ID, conn.AgentConn, appURLPort(appURL))
+	if err != nil {
+		api.Logger.Debug(ctx, "check workspace app port", slog.F("agent_id", proxyApp.Agent.ID), slog.Error(err))
+	} else if !listening.Listening && !listening.AppStarting {
+		if listening.RetryAfterSeconds > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(listening.RetryAfterSeconds))
+		}
+		site.RenderStaticErrorPage(rw, r, site.ErrorPageData{
+			Status:       http.StatusBadGateway,
+			Title:        "Bad Gateway",
+			Description:  listening.Reason,
+			RetryEnabled: true,
+			DashboardURL: api.AccessURL.String(),
+		})
+		return
+	}
+
 	// This strips the session token from a workspace app request.
 	cookieHeaders := r.Header.Values("Cookie")[:]
 	r.Header.Del("Cookie")
@@ -717,6 +737,16 @@ func (api *API) proxyWorkspaceApplication(proxyApp proxyApplication, rw http.Res
 	}
 	proxy.Transport = conn.HTTPTransport()
 
+	// Apps validate that requests came through the proxy with this
+	// header, so it's never forwarded from clients.
+	r.Header.Del(codersdk.WorkspaceAppTokenHeader)
+	appToken, err := api.appTokens.token(ctx, proxyApp.Agent.ID, conn.AgentConn)
+	if err != nil {
+		api.Logger.Warn(ctx, "get workspace app token", slog.F("agent_id", proxyApp.Agent.ID), slog.Error(err))
+	} else {
+		r.Header.Set(codersdk.WorkspaceAppTokenHeader, appToken)
+	}
+
 	// end span so we don't get long lived trace data
 	tracing.EndHTTPSpan(r, http.StatusOK, trace.SpanFromContext(ctx))
 
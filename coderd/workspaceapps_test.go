@@ -88,6 +88,7 @@ func setupProxyTest(t *testing.T, customAppHost ...string) (*codersdk.Client, co
 			_, err := r.Cookie(codersdk.SessionTokenKey)
 			assert.ErrorIs(t, err, http.ErrNoCookie)
 			w.Header().Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+			w.Header().Set(codersdk.WorkspaceAppTokenHeader, r.Header.Get(codersdk.WorkspaceAppTokenHeader))
 			w.WriteHeader(http.StatusOK)
 			_, _ = w.Write([]byte(proxyTestAppBody))
 		}),
@@ -330,6 +331,29 @@ func TestWorkspaceAppsProxyPath(t *testing.T) {
 		require.Equal(t, "1.1.1.1,127.0.0.1", resp.Header.Get("X-Forwarded-For"))
 	})
 
+	t.Run("SetsAppToken", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+		defer cancel()
+
+		request := func() string {
+			resp, err := client.Request(ctx, http.MethodGet, fmt.Sprintf("/@me/%s/apps/%s/?%s", workspace.Name, proxyTestAppNameOwner, proxyTestAppQuery), nil, func(r *http.Request) {
+				// Clients can't forge the token.
+				r.Header.Set(codersdk.WorkspaceAppTokenHeader, "forged")
+			})
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			return resp.Header.Get(codersdk.WorkspaceAppTokenHeader)
+		}
+		token := request()
+		require.NotEmpty(t, token)
+		require.NotEqual(t, "forged", token)
+		// The token is reused until it's rotated.
+		require.Equal(t, token, request())
+	})
+
 	t.Run("ProxyError", func(t *testing.T) {
 		t.Parallel()
 
@@ -340,6 +364,10 @@ func TestWorkspaceAppsProxyPath(t *testing.T) {
 		require.NoError(t, err)
 		defer resp.Body.Close()
 		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		// The agent tells why before the port is dialed.
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "Nothing is listening on port 65535")
 	})
 }
 
@@ -0,0 +1,92 @@
+package coderd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/cryptorand"
+)
+
+const (
+	// appTokenLifetime is how long a token sent with proxied app requests
+	// is valid for.
+	appTokenLifetime = 10 * time.Minute
+	// appTokenRotateBefore is how long before expiry a token is replaced.
+	// Agents keep the previous token until it expires, so requests that
+	// are in flight during a rotation are still valid.
+	appTokenRotateBefore = appTokenLifetime / 2
+)
+
+// appTokens are the short-lived tokens that coderd sends to apps with
+// proxied requests, keyed by agent ID. Tokens are only kept in memory, so
+// each replica gives agents its own tokens.
+type appTokens struct {
+	mutex  sync.Mutex
+	agents map[uuid.UUID]*agentAppToken
+}
+
+type agentAppToken struct {
+	mutex     sync.Mutex
+	token     string
+	expiresAt time.Time
+	// conn is the connection the token was last given to the agent
+	// through. The token is given again when the connection changes,
+	// since the agent may have restarted.
+	conn *codersdk.AgentConn
+}
+
+func newAppTokens() *appTokens {
+	return &appTokens{
+		agents: map[uuid.UUID]*agentAppToken{},
+	}
+}
+
+// token returns the current token of the agent, rotating it if it expires
+// soon, and gives it to the agent if it doesn't have it yet.
+func (t *appTokens) token(ctx context.Context, agentID uuid.UUID, conn *codersdk.AgentConn) (string, error) {
+	t.mutex.Lock()
+	entry, ok := t.agents[agentID]
+	if !ok {
+		entry = &agentAppToken{}
+		t.agents[agentID] = entry
+		// Agents that are gone leave tokens behind, which are
+		// removed once they expire.
+		for id, existing := range t.agents {
+			existing.mutex.Lock()
+			expired := existing.token != "" && time.Now().After(existing.expiresAt)
+			existing.mutex.Unlock()
+			if expired {
+				delete(t.agents, id)
+			}
+		}
+	}
+	t.mutex.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if time.Until(entry.expiresAt) < appTokenRotateBefore {
+		token, err := cryptorand.String(32)
+		if err != nil {
+			return "", xerrors.Errorf("generate token: %w", err)
+		}
+		entry.token = token
+		entry.expiresAt = time.Now().Add(appTokenLifetime)
+		entry.conn = nil
+	}
+	if entry.conn != conn {
+		err := conn.SetAppToken(ctx, codersdk.AppTokenRequest{
+			Token:     entry.token,
+			ExpiresAt: entry.expiresAt,
+		})
+		if err != nil {
+			return "", xerrors.Errorf("give token to agent: %w", err)
+		}
+		entry.conn = conn
+	}
+	return entry.token, nil
+}
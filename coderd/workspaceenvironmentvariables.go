@@ -0,0 +1,218 @@
+package coderd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+
+	"cdr.dev/slog"
+	"github.com/coder/coder/coderd/database"
+	"github.com/coder/coder/coderd/httpapi"
+	"github.com/coder/coder/coderd/httpmw"
+	"github.com/coder/coder/coderd/rbac"
+	"github.com/coder/coder/codersdk"
+)
+
+// maxWorkspaceEnvironmentVariableSize bounds the values of environment
+// variables, since agents keep them in memory and add them to every session.
+const maxWorkspaceEnvironmentVariableSize = 8 << 10
+
+// workspaceEnvironmentVariableName matches the names that shells accept.
+var workspaceEnvironmentVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// workspaceAgentMetadataChannel is where changes to the metadata of the
+// agents of a workspace are published, so agents watching it on any replica
+// fetch it again.
+func workspaceAgentMetadataChannel(workspaceID uuid.UUID) string {
+	return fmt.Sprintf("workspace_agent_metadata:%s", workspaceID)
+}
+
+func (api *API) workspaceEnvironmentVariables(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	if !api.Authorize(r, rbac.ActionRead, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	variables, err := api.environmentVariablesOfWorkspace(ctx, workspace.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching workspace environment variables.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	httpapi.Write(ctx, rw, http.StatusOK, codersdk.WorkspaceEnvironmentVariables{
+		Variables: variables,
+	})
+}
+
+// putWorkspaceEnvironmentVariables replaces the environment variables of a
+// workspace, and notifies its agents.
+func (api *API) putWorkspaceEnvironmentVariables(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspace := httpmw.WorkspaceParam(r)
+	if !api.Authorize(r, rbac.ActionUpdate, workspace) {
+		httpapi.ResourceNotFound(rw)
+		return
+	}
+
+	var req codersdk.WorkspaceEnvironmentVariables
+	if !httpapi.Read(ctx, rw, r, &req) {
+		return
+	}
+	if len(req.Variables) > codersdk.MaxWorkspaceEnvironmentVariables {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message: "Too many environment variables.",
+			Detail:  fmt.Sprintf("At most %d environment variables can be set.", codersdk.MaxWorkspaceEnvironmentVariables),
+		})
+		return
+	}
+	names := make([]string, 0, len(req.Variables))
+	for name := range req.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var validations []codersdk.ValidationError
+	for _, name := range names {
+		field := fmt.Sprintf("variables.%s", name)
+		switch {
+		case !workspaceEnvironmentVariableName.MatchString(name):
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field,
+				Detail: "must start with a letter or underscore, and contain only letters, digits and underscores",
+			})
+		case strings.HasPrefix(strings.ToUpper(name), "CODER_"):
+			// The agent sets these for itself and its tools.
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field,
+				Detail: "must not start with CODER_",
+			})
+		case len(req.Variables[name]) > maxWorkspaceEnvironmentVariableSize:
+			validations = append(validations, codersdk.ValidationError{
+				Field:  field,
+				Detail: fmt.Sprintf("must be at most %d bytes", maxWorkspaceEnvironmentVariableSize),
+			})
+		}
+	}
+	if len(validations) > 0 {
+		httpapi.Write(ctx, rw, http.StatusBadRequest, codersdk.Response{
+			Message:     "Invalid environment variables.",
+			Validations: validations,
+		})
+		return
+	}
+
+	err := api.Database.InTx(func(tx database.Store) error {
+		err := tx.DeleteWorkspaceEnvironmentVariablesByWorkspaceID(ctx, workspace.ID)
+		if err != nil {
+			return xerrors.Errorf("delete environment variables: %w", err)
+		}
+		now := database.Now()
+		for _, name := range names {
+			_, err = tx.InsertWorkspaceEnvironmentVariable(ctx, database.InsertWorkspaceEnvironmentVariableParams{
+				WorkspaceID: workspace.ID,
+				Name:        name,
+				Value:       req.Variables[name],
+				CreatedAt:   now,
+			})
+			if err != nil {
+				return xerrors.Errorf("insert environment variable %q: %w", name, err)
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error updating workspace environment variables.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	// Agents that miss the notification get the variables when they
+	// reconnect.
+	err = api.Pubsub.Publish(workspaceAgentMetadataChannel(workspace.ID), []byte{})
+	if err != nil {
+		api.Logger.Warn(ctx, "publish workspace agent metadata change", slog.F("workspace_id", workspace.ID), slog.Error(err))
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// environmentVariablesOfWorkspace returns the environment variables that
+// the owner set for a workspace.
+func (api *API) environmentVariablesOfWorkspace(ctx context.Context, workspaceID uuid.UUID) (map[string]string, error) {
+	rows, err := api.Database.GetWorkspaceEnvironmentVariablesByWorkspaceID(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	variables := make(map[string]string, len(rows))
+	for _, row := range rows {
+		variables[row.Name] = row.Value
+	}
+	return variables, nil
+}
+
+// watchWorkspaceAgentMetadata sends an event to the agent whenever its
+// metadata changes, so it's fetched again.
+func (api *API) watchWorkspaceAgentMetadata(rw http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	workspaceAgent := httpmw.WorkspaceAgent(r)
+	workspace, err := api.Database.GetWorkspaceByAgentID(ctx, workspaceAgent.ID)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error fetching workspace.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+
+	sendEvent, senderClosed, err := httpapi.ServerSentEventSender(rw, r)
+	if err != nil {
+		httpapi.Write(ctx, rw, http.StatusInternalServerError, codersdk.Response{
+			Message: "Internal error setting up server-sent events.",
+			Detail:  err.Error(),
+		})
+		return
+	}
+	// Prevent handler from returning until the sender is closed.
+	defer func() {
+		<-senderClosed
+	}()
+
+	cancelSubscribe, err := api.Pubsub.Subscribe(workspaceAgentMetadataChannel(workspace.ID), func(ctx context.Context, _ []byte) {
+		// The agent fetches the metadata itself, so the event is empty.
+		_ = sendEvent(ctx, codersdk.ServerSentEvent{
+			Type: codersdk.ServerSentEventTypeData,
+			Data: struct{}{},
+		})
+	})
+	if err != nil {
+		_ = sendEvent(ctx, codersdk.ServerSentEvent{
+			Type: codersdk.ServerSentEventTypeError,
+			Data: codersdk.Response{
+				Message: "Internal error subscribing to workspace agent metadata.",
+				Detail:  err.Error(),
+			},
+		})
+		return
+	}
+	defer cancelSubscribe()
+
+	// An initial ping signals to the agent that it's subscribed.
+	_ = sendEvent(ctx, codersdk.ServerSentEvent{
+		Type: codersdk.ServerSentEventTypePing,
+	})
+
+	select {
+	case <-ctx.Done():
+	case <-senderClosed:
+	}
+}
@@ -0,0 +1,105 @@
+package coderd_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/coderd/coderdtest"
+	"github.com/coder/coder/codersdk"
+	"github.com/coder/coder/provisioner/echo"
+	"github.com/coder/coder/provisionersdk/proto"
+	"github.com/coder/coder/testutil"
+)
+
+func TestWorkspaceEnvironmentVariables(t *testing.T) {
+	t.Parallel()
+
+	client := coderdtest.New(t, &coderdtest.Options{
+		IncludeProvisionerDaemon: true,
+	})
+	user := coderdtest.CreateFirstUser(t, client)
+	authToken := uuid.NewString()
+	version := coderdtest.CreateTemplateVersion(t, client, user.OrganizationID, &echo.Responses{
+		Parse:         echo.ParseComplete,
+		ProvisionPlan: echo.ProvisionComplete,
+		ProvisionApply: []*proto.Provision_Response{{
+			Type: &proto.Provision_Response_Complete{
+				Complete: &proto.Provision_Complete{
+					Resources: []*proto.Resource{{
+						Name: "example",
+						Type: "aws_instance",
+						Agents: []*proto.Agent{{
+							Id: uuid.NewString(),
+							Auth: &proto.Agent_Token{
+								Token: authToken,
+							},
+						}},
+					}},
+				},
+			},
+		}},
+	})
+	template := coderdtest.CreateTemplate(t, client, user.OrganizationID, version.ID)
+	coderdtest.AwaitTemplateVersionJob(t, client, version.ID)
+	workspace := coderdtest.CreateWorkspace(t, client, user.OrganizationID, template.ID)
+	coderdtest.AwaitWorkspaceBuildJob(t, client, workspace.LatestBuild.ID)
+
+	agentClient := codersdk.New(client.URL)
+	agentClient.SetSessionToken(authToken)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+
+	variables, err := client.WorkspaceEnvironmentVariables(ctx, workspace.ID)
+	require.NoError(t, err)
+	require.Empty(t, variables.Variables)
+
+	changes, err := agentClient.WatchWorkspaceAgentMetadata(ctx)
+	require.NoError(t, err)
+
+	err = client.UpdateWorkspaceEnvironmentVariables(ctx, workspace.ID, codersdk.WorkspaceEnvironmentVariables{
+		Variables: map[string]string{
+			"EDITOR":     "vim",
+			"GIT_AUTHOR": "Jane",
+		},
+	})
+	require.NoError(t, err)
+	select {
+	case <-ctx.Done():
+		t.Fatal("agent wasn't notified of the change")
+	case <-changes:
+	}
+	metadata, err := agentClient.WorkspaceAgentMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"EDITOR":     "vim",
+		"GIT_AUTHOR": "Jane",
+	}, metadata.PersonalEnvironmentVariables)
+
+	// Updating the variables replaces them.
+	err = client.UpdateWorkspaceEnvironmentVariables(ctx, workspace.ID, codersdk.WorkspaceEnvironmentVariables{
+		Variables: map[string]string{
+			"EDITOR": "nano",
+		},
+	})
+	require.NoError(t, err)
+	variables, err = client.WorkspaceEnvironmentVariables(ctx, workspace.ID)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"EDITOR": "nano"}, variables.Variables)
+
+	err = client.UpdateWorkspaceEnvironmentVariables(ctx, workspace.ID, codersdk.WorkspaceEnvironmentVariables{
+		Variables: map[string]string{
+			"1INVALID":          "value",
+			"CODER_AGENT_TOKEN": "value",
+			"VALID":             "value",
+		},
+	})
+	var apiErr *codersdk.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.StatusCode())
+	require.Len(t, apiErr.Validations, 2)
+}
@@ -221,3 +221,48 @@ func (*client) PostWorkspaceAgentAppHealth(_ context.Context, _ codersdk.PostWor
 func (*client) PostWorkspaceAgentVersion(_ context.Context, _ string) error {
 	return nil
 }
+
+func (*client) PatchStartupLogs(_ context.Context, _ codersdk.PatchStartupLogs) error {
+	return nil
+}
+
+func (*client) PostWorkspaceAgentBootTiming(_ context.Context, _ codersdk.WorkspaceAgentBootTiming) error {
+	return nil
+}
+
+func (*client) WorkspaceAgentAuthorizedKeys(_ context.Context) (codersdk.WorkspaceAgentAuthorizedKeys, error) {
+	return codersdk.WorkspaceAgentAuthorizedKeys{}, nil
+}
+
+func (*client) PostAgentConnectionEvents(_ context.Context, _ codersdk.PostAgentConnectionEventsRequest) error {
+	return nil
+}
+
+func (*client) PostWorkspaceAgentDriftReport(_ context.Context, _ codersdk.WorkspaceAgentDriftReport) error {
+	return nil
+}
+
+func (*client) PostWorkspaceAgentDeclaredPorts(_ context.Context, _ codersdk.PostWorkspaceAgentDeclaredPortsRequest) error {
+	return nil
+}
+
+func (*client) PostWorkspaceAgentStartupScriptResult(_ context.Context, _ codersdk.WorkspaceAgentStartupScriptResult) error {
+	return nil
+}
+
+func (*client) PostAgentCrashReport(_ context.Context, _ codersdk.AgentCrashReport) error {
+	return nil
+}
+
+func (*client) WatchWorkspaceAgentMetadata(ctx context.Context) (<-chan struct{}, error) {
+	changes := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(changes)
+	}()
+	return changes, nil
+}
+
+func (*client) PostWorkspaceAgentHandshake(_ context.Context, req codersdk.WorkspaceAgentHandshakeRequest) (codersdk.WorkspaceAgentHandshakeResponse, error) {
+	return codersdk.NegotiateWorkspaceAgentHandshake(req, codersdk.WorkspaceAgentProtocolVersion, codersdk.WorkspaceAgentCapabilities), nil
+}
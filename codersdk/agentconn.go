@@ -1,7 +1,10 @@
 package codersdk
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -9,14 +12,18 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
 	"tailscale.com/net/speedtest"
 
 	"github.com/coder/coder/coderd/tracing"
@@ -34,10 +41,21 @@ var (
 	// TailnetStatisticsPort serves a HTTP server with endpoints for gathering
 	// agent statistics.
 	TailnetStatisticsPort = 4
+	// TailnetLanguageServerPort multiplexes connections to the language
+	// servers kept warm by the agent.
+	TailnetLanguageServerPort = 5
+	// TailnetSocksPort serves a SOCKS5 proxy that dials connections from
+	// the workspace.
+	TailnetSocksPort = 6
+	// TailnetFileSyncPort syncs directories to and from the workspace,
+	// see AgentConn.SyncFiles.
+	TailnetFileSyncPort = 7
+	// TailnetExecPort runs one-shot commands, see AgentConn.Exec.
+	TailnetExecPort = 8
 
 	// MinimumListeningPort is the minimum port that the listening-ports
 	// endpoint will return to the client, and the minimum port that is accepted
-	// by the proxy applications endpoint. Coder consumes ports 1-4 at the
+	// by the proxy applications endpoint. Coder consumes ports 1-8 at the
 	// moment, and we reserve some extra ports for future use. Port 9 and up are
 	// available for the user.
 	//
@@ -130,6 +148,14 @@ type ReconnectingPTYRequest struct {
 type AgentConn struct {
 	*tailnet.Conn
 	CloseFunc func()
+	// ExperimentalQUIC sends reconnecting PTY and TCP port forward traffic
+	// over QUIC streams when the agent offers it, so packet loss on one
+	// connection doesn't block the others.
+	ExperimentalQUIC bool
+
+	quicMutex       sync.Mutex
+	quic            quic.Connection
+	quicUnavailable bool
 }
 
 func (c *AgentConn) AwaitReachable(ctx context.Context) bool {
@@ -154,30 +180,279 @@ func (c *AgentConn) Close() error {
 	if c.CloseFunc != nil {
 		c.CloseFunc()
 	}
+	c.quicMutex.Lock()
+	if c.quic != nil {
+		_ = c.quic.CloseWithError(0, "")
+	}
+	c.quicMutex.Unlock()
 	return c.Conn.Close()
 }
 
+const (
+	// MaxReconnectingPTYInitSize is the largest encoded ReconnectingPTYInit
+	// that agents accept.
+	MaxReconnectingPTYInitSize = 16 << 10
+	// ReconnectingPTYInitTimeout is how long agents wait for the
+	// ReconnectingPTYInit of a connection, and clients for sending it.
+	ReconnectingPTYInitTimeout = 10 * time.Second
+)
+
 // @typescript-ignore ReconnectingPTYInit
 type ReconnectingPTYInit struct {
 	ID      uuid.UUID
 	Height  uint16
 	Width   uint16
 	Command string
+	// BufferSize overrides the size of the scrollback of the PTY in bytes
+	// when it's created. Zero uses the default of the agent.
+	BufferSize int `json:",omitempty"`
+	// Label names the PTY in the sessions of the agent. Clients that
+	// reconnect with a label rename it.
+	Label string `json:",omitempty"`
+	// Role is the role of the connection in the PTY, which is read-write
+	// when empty. Read-only connections can only join PTYs that exist.
+	Role ReconnectingPTYRole `json:",omitempty"`
+	// Participant names the connection in the participants of the PTY,
+	// like the user who connected.
+	Participant string `json:",omitempty"`
+	// Name attaches to the named PTY instead of the PTY with the ID, and
+	// creates it if it doesn't exist. Named PTYs aren't closed when no
+	// one is connected to them, unless the agent is configured to.
+	Name string `json:",omitempty"`
+}
+
+// ReconnectingPTYInfo is a reconnecting PTY of an agent.
+type ReconnectingPTYInfo struct {
+	ID           uuid.UUID `json:"id" format:"uuid"`
+	Name         string    `json:"name,omitempty"`
+	Label        string    `json:"label,omitempty"`
+	Command      string    `json:"command"`
+	StartedAt    time.Time `json:"started_at" format:"date-time"`
+	Participants int       `json:"participants"`
+}
+
+// @typescript-ignore ReconnectingPTYsResponse
+type ReconnectingPTYsResponse struct {
+	ReconnectingPTYs []ReconnectingPTYInfo `json:"reconnecting_ptys"`
+}
+
+// ReconnectingPTYRole is the role of a connection to a reconnecting PTY,
+// which is shared by all of the connections to it.
+type ReconnectingPTYRole string
+
+const (
+	ReconnectingPTYRoleReadWrite ReconnectingPTYRole = "read_write"
+	// ReconnectingPTYRoleReadOnly observes the terminal. The input and
+	// sizes of read-only connections are ignored.
+	ReconnectingPTYRoleReadOnly ReconnectingPTYRole = "read_only"
+)
+
+// ReconnectingPTYParticipant is a connection to a reconnecting PTY.
+type ReconnectingPTYParticipant struct {
+	ID            string              `json:"id"`
+	Name          string              `json:"name,omitempty"`
+	Role          ReconnectingPTYRole `json:"role"`
+	RemoteAddress string              `json:"remote_address"`
+	ConnectedAt   time.Time           `json:"connected_at" format:"date-time"`
+	// QueuedBytes is the output that wasn't written to the connection
+	// yet, and DroppedBytes the output that was dropped because it didn't
+	// keep up. LagMilliseconds is how long the oldest output that wasn't
+	// written has waited.
+	QueuedBytes     int   `json:"queued_bytes"`
+	DroppedBytes    int64 `json:"dropped_bytes"`
+	LagMilliseconds int64 `json:"lag_milliseconds"`
+}
+
+// @typescript-ignore ReconnectingPTYParticipantsResponse
+type ReconnectingPTYParticipantsResponse struct {
+	Participants []ReconnectingPTYParticipant `json:"participants"`
 }
 
 func (c *AgentConn) ReconnectingPTY(ctx context.Context, id uuid.UUID, height, width uint16, command string) (net.Conn, error) {
+	return c.DialReconnectingPTY(ctx, ReconnectingPTYInit{
+		ID:      id,
+		Height:  height,
+		Width:   width,
+		Command: command,
+	})
+}
+
+// DialReconnectingPTY connects to a reconnecting PTY with the options of
+// init, creating it if it doesn't exist.
+func (c *AgentConn) DialReconnectingPTY(ctx context.Context, init ReconnectingPTYInit) (net.Conn, error) {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
 
-	conn, err := c.DialContextTCP(ctx, netip.AddrPortFrom(TailnetIP, uint16(TailnetReconnectingPTYPort)))
+	conn, err := c.dialTCP(ctx, uint16(TailnetReconnectingPTYPort))
 	if err != nil {
 		return nil, err
 	}
-	data, err := json.Marshal(ReconnectingPTYInit{
-		ID:      id,
-		Height:  height,
-		Width:   width,
-		Command: command,
+	data, err := json.Marshal(init)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if len(data) > MaxReconnectingPTYInitSize {
+		_ = conn.Close()
+		return nil, xerrors.Errorf("reconnecting pty init is %d bytes, the limit is %d", len(data), MaxReconnectingPTYInitSize)
+	}
+	data = append(make([]byte, 2), data...)
+	binary.LittleEndian.PutUint16(data, uint16(len(data)-2))
+
+	_ = conn.SetWriteDeadline(time.Now().Add(ReconnectingPTYInitTimeout))
+	_, err = conn.Write(data)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+	return conn, nil
+}
+
+// ReconnectingPTYControlType is the type of a control message of the
+// WebSocket protocol of reconnecting PTYs.
+type ReconnectingPTYControlType string
+
+const (
+	// ReconnectingPTYControlResize resizes the terminal.
+	ReconnectingPTYControlResize ReconnectingPTYControlType = "resize"
+	// ReconnectingPTYControlPing is answered with a pong, for clients like
+	// browsers that can't send WebSocket pings.
+	ReconnectingPTYControlPing ReconnectingPTYControlType = "ping"
+	ReconnectingPTYControlPong ReconnectingPTYControlType = "pong"
+	// ReconnectingPTYControlParticipants is sent by the agent when a
+	// connection joins or leaves the PTY.
+	ReconnectingPTYControlParticipants ReconnectingPTYControlType = "participants"
+	// ReconnectingPTYControlList is answered with the reconnecting PTYs
+	// of the agent, in a message of the terminals type.
+	ReconnectingPTYControlList      ReconnectingPTYControlType = "list"
+	ReconnectingPTYControlTerminals ReconnectingPTYControlType = "terminals"
+)
+
+// ReconnectingPTYControl is sent in the text messages of the WebSocket
+// protocol of reconnecting PTYs. Binary messages carry the input and output
+// of the terminal.
+type ReconnectingPTYControl struct {
+	Type   ReconnectingPTYControlType `json:"type"`
+	Height uint16                     `json:"height,omitempty"`
+	Width  uint16                     `json:"width,omitempty"`
+	// Participants are the connections to the PTY, and ParticipantID is
+	// the one that the message was sent to.
+	Participants  []ReconnectingPTYParticipant `json:"participants,omitempty"`
+	ParticipantID string                       `json:"participant_id,omitempty"`
+	Terminals     []ReconnectingPTYInfo        `json:"terminals,omitempty"`
+}
+
+// ReconnectingPTYWebSocket connects to a reconnecting PTY over a WebSocket,
+// creating it if it doesn't exist. Unlike DialReconnectingPTY, the input
+// and output of the terminal are sent in binary messages, and the terminal
+// is resized with ReconnectingPTYControl messages.
+func (c *AgentConn) ReconnectingPTYWebSocket(ctx context.Context, init ReconnectingPTYInit) (*websocket.Conn, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	query := url.Values{}
+	query.Set("height", strconv.Itoa(int(init.Height)))
+	query.Set("width", strconv.Itoa(int(init.Width)))
+	query.Set("command", init.Command)
+	query.Set("buffer_size", strconv.Itoa(init.BufferSize))
+	query.Set("label", init.Label)
+	query.Set("role", string(init.Role))
+	query.Set("participant", init.Participant)
+	query.Set("name", init.Name)
+	host := net.JoinHostPort(TailnetIP.String(), strconv.Itoa(TailnetStatisticsPort))
+	wsURL := fmt.Sprintf("ws://%s/api/v0/reconnecting-pty/%s?%s", host, init.ID, query.Encode())
+	// nolint:bodyclose
+	conn, res, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+		HTTPClient:      c.statisticsClient(),
+		CompressionMode: websocket.CompressionDisabled,
+	})
+	if err != nil {
+		if res == nil {
+			return nil, xerrors.Errorf("dial: %w", err)
+		}
+		return nil, readBodyAsError(res)
+	}
+	return conn, nil
+}
+
+// ReconnectingPTYs returns the reconnecting PTYs of the agent, like named
+// PTYs to attach to.
+func (c *AgentConn) ReconnectingPTYs(ctx context.Context) ([]ReconnectingPTYInfo, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/reconnecting-pty", nil)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var resp ReconnectingPTYsResponse
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		return nil, xerrors.Errorf("decode response body: %w", err)
+	}
+	return resp.ReconnectingPTYs, nil
+}
+
+// ReconnectingPTYParticipants returns the connections to a reconnecting PTY.
+func (c *AgentConn) ReconnectingPTYParticipants(ctx context.Context, id uuid.UUID) ([]ReconnectingPTYParticipant, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, fmt.Sprintf("/api/v0/reconnecting-pty/%s/participants", id), nil)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var resp ReconnectingPTYParticipantsResponse
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		return nil, xerrors.Errorf("decode response body: %w", err)
+	}
+	return resp.Participants, nil
+}
+
+// RevokeReconnectingPTYParticipant disconnects a read-only participant from
+// a reconnecting PTY.
+func (c *AgentConn) RevokeReconnectingPTYParticipant(ctx context.Context, id uuid.UUID, participantID string) error {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodDelete, fmt.Sprintf("/api/v0/reconnecting-pty/%s/participants/%s", id, url.PathEscape(participantID)), nil)
+	if err != nil {
+		return xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// LanguageServerInit selects the language server to connect to.
+// @typescript-ignore LanguageServerInit
+type LanguageServerInit struct {
+	Name string
+}
+
+// LanguageServer connects to a language server kept warm by the agent.
+// The connection speaks the Language Server Protocol with its standard
+// base protocol framing. The server is shared with every other client
+// connected to it, so the initialize result is the one negotiated when
+// the agent started the server.
+func (c *AgentConn) LanguageServer(ctx context.Context, name string) (net.Conn, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+
+	conn, err := c.DialContextTCP(ctx, netip.AddrPortFrom(TailnetIP, uint16(TailnetLanguageServerPort)))
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(LanguageServerInit{
+		Name: name,
 	})
 	if err != nil {
 		_ = conn.Close()
@@ -202,7 +477,10 @@ func (c *AgentConn) SSH(ctx context.Context) (net.Conn, error) {
 
 // SSHClient calls SSH to create a client that uses a weak cipher
 // for high throughput.
-func (c *AgentConn) SSHClient(ctx context.Context) (*ssh.Client, error) {
+//
+// Authentication methods are only required when the agent requires SSH user
+// certificates, see Client.WorkspaceAgentSSHCertificate.
+func (c *AgentConn) SSHClient(ctx context.Context, auth ...ssh.AuthMethod) (*ssh.Client, error) {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
 	netConn, err := c.SSH(ctx)
@@ -214,6 +492,7 @@ func (c *AgentConn) SSHClient(ctx context.Context) (*ssh.Client, error) {
 		// connection already signifies user-intent to dial a workspace.
 		// #nosec
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            auth,
 	})
 	if err != nil {
 		return nil, xerrors.Errorf("ssh conn: %w", err)
@@ -221,6 +500,14 @@ func (c *AgentConn) SSHClient(ctx context.Context) (*ssh.Client, error) {
 	return ssh.NewClient(sshConn, channels, requests), nil
 }
 
+// DialSocks connects to the SOCKS5 proxy of the agent, which dials the
+// connections that are requested over it from the workspace.
+func (c *AgentConn) DialSocks(ctx context.Context) (net.Conn, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	return c.DialContextTCP(ctx, netip.AddrPortFrom(TailnetIP, uint16(TailnetSocksPort)))
+}
+
 func (c *AgentConn) Speedtest(ctx context.Context, direction speedtest.Direction, duration time.Duration) ([]speedtest.Result, error) {
 	ctx, span := tracing.StartSpan(ctx)
 	defer span.End()
@@ -247,7 +534,7 @@ func (c *AgentConn) DialContext(ctx context.Context, network string, addr string
 	if network == "udp" {
 		return c.Conn.DialContextUDP(ctx, ipp)
 	}
-	return c.Conn.DialContextTCP(ctx, ipp)
+	return c.dialTCP(ctx, ipp.Port())
 }
 
 func (c *AgentConn) statisticsClient() *http.Client {
@@ -313,6 +600,12 @@ type ListeningPort struct {
 	ProcessName string               `json:"process_name"` // may be empty
 	Network     ListeningPortNetwork `json:"network"`      // only "tcp" at the moment
 	Port        uint16               `json:"port"`
+	// Name is the name that a process in the workspace declared for the
+	// port.
+	Name string `json:"name,omitempty"`
+	// Declared is whether a process in the workspace declared the port.
+	// Declared ports are listed even if nothing listens on them yet.
+	Declared bool `json:"declared,omitempty"`
 }
 
 func (c *AgentConn) ListeningPorts(ctx context.Context) (ListeningPortsResponse, error) {
@@ -330,3 +623,727 @@ func (c *AgentConn) ListeningPorts(ctx context.Context) (ListeningPortsResponse,
 	var resp ListeningPortsResponse
 	return resp, json.NewDecoder(res.Body).Decode(&resp)
 }
+
+// PortListeningResponse is whether something is listening on a port in the
+// workspace right now.
+// @typescript-ignore PortListeningResponse
+type PortListeningResponse struct {
+	Port      uint16 `json:"port"`
+	Listening bool   `json:"listening"`
+	// Reason is why connections to the port would fail, when nothing is
+	// listening on it.
+	Reason string `json:"reason,omitempty"`
+	// RetryAfterSeconds is how long clients should wait before trying
+	// again, for the ports of apps that are expected to start listening.
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+	// AppStarting is whether the agent answers connections to the port
+	// with a page that the app is starting, so proxies should forward
+	// them anyway.
+	AppStarting bool `json:"app_starting,omitempty"`
+}
+
+// PortListening returns whether something is listening on the port in the
+// workspace. It's cheaper than dialing ports that nothing listens on, which
+// only fail once the connection times out.
+func (c *AgentConn) PortListening(ctx context.Context, port uint16) (PortListeningResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, fmt.Sprintf("/api/v0/listening-ports/%d", port), nil)
+	if err != nil {
+		return PortListeningResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return PortListeningResponse{}, readBodyAsError(res)
+	}
+
+	var resp PortListeningResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// SSHHostKeysResponse contains the SSH host keys of an agent.
+// @typescript-ignore SSHHostKeysResponse
+type SSHHostKeysResponse struct {
+	// KnownHosts contains a line in known_hosts format for
+	// each SSH host key of the agent.
+	KnownHosts []string `json:"known_hosts"`
+}
+
+// SSHHostKeys returns the SSH host keys of the agent in known_hosts format
+// for the host pattern provided. If host is empty, the Tailnet IP of the
+// agent is used.
+func (c *AgentConn) SSHHostKeys(ctx context.Context, host string) (SSHHostKeysResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/ssh-host-keys?host="+url.QueryEscape(host), nil)
+	if err != nil {
+		return SSHHostKeysResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return SSHHostKeysResponse{}, readBodyAsError(res)
+	}
+
+	var resp SSHHostKeysResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// BroadcastMessageRequest is a message written to the terminal
+// of every active session in a workspace.
+// @typescript-ignore BroadcastMessageRequest
+type BroadcastMessageRequest struct {
+	Message string `json:"message"`
+}
+
+// BroadcastMessageResponse contains the number of sessions
+// a message was written to.
+// @typescript-ignore BroadcastMessageResponse
+type BroadcastMessageResponse struct {
+	Sessions int `json:"sessions"`
+}
+
+// BroadcastMessage writes a message to the terminal of every active
+// PTY session of the agent, similar to wall(1).
+func (c *AgentConn) BroadcastMessage(ctx context.Context, message string) (BroadcastMessageResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	data, err := json.Marshal(BroadcastMessageRequest{
+		Message: message,
+	})
+	if err != nil {
+		return BroadcastMessageResponse{}, xerrors.Errorf("marshal request: %w", err)
+	}
+	res, err := c.doStatisticsRequest(ctx, http.MethodPost, "/api/v0/broadcast", bytes.NewReader(data))
+	if err != nil {
+		return BroadcastMessageResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return BroadcastMessageResponse{}, readBodyAsError(res)
+	}
+
+	var resp BroadcastMessageResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// ReversePortForward is a port bound in the workspace by a reverse port
+// forward, with connections forwarded to the SSH client.
+// @typescript-ignore ReversePortForward
+type ReversePortForward struct {
+	ID string `json:"id"`
+	// SessionID identifies the SSH connection that owns the forward.
+	SessionID string    `json:"session_id"`
+	User      string    `json:"user"`
+	BindHost  string    `json:"bind_host"`
+	BindPort  uint16    `json:"bind_port"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReversePortForwardsResponse contains the active reverse port forwards
+// of an agent.
+// @typescript-ignore ReversePortForwardsResponse
+type ReversePortForwardsResponse struct {
+	Forwards []ReversePortForward `json:"forwards"`
+}
+
+// ReversePortForwards lists the active reverse port forwards of the agent.
+func (c *AgentConn) ReversePortForwards(ctx context.Context) (ReversePortForwardsResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/reverse-port-forwards", nil)
+	if err != nil {
+		return ReversePortForwardsResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ReversePortForwardsResponse{}, readBodyAsError(res)
+	}
+
+	var resp ReversePortForwardsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentStartupState is the state of the startup script.
+type WorkspaceAgentStartupState string
+
+const (
+	WorkspaceAgentStartupRunning WorkspaceAgentStartupState = "running"
+	WorkspaceAgentStartupReady   WorkspaceAgentStartupState = "ready"
+	WorkspaceAgentStartupError   WorkspaceAgentStartupState = "error"
+)
+
+// WorkspaceAgentStartupResponse is the state of the startup script. When
+// the script fails, the agent diagnoses common problems with the workspace.
+// @typescript-ignore WorkspaceAgentStartupResponse
+type WorkspaceAgentStartupResponse struct {
+	State       WorkspaceAgentStartupState `json:"state"`
+	StartedAt   *time.Time                 `json:"started_at,omitempty"`
+	CompletedAt *time.Time                 `json:"completed_at,omitempty"`
+	// PendingMounts are the required mounts the startup script is
+	// waiting for.
+	PendingMounts []string `json:"pending_mounts,omitempty"`
+	// Attempts is how often the startup script ran, including retries.
+	Attempts int32 `json:"attempts,omitempty"`
+	// Result is how the startup script ended, once it has.
+	Result WorkspaceAgentStartupScriptState `json:"result,omitempty"`
+	// Error is why the startup script failed.
+	Error       string                           `json:"error,omitempty"`
+	Diagnostics *WorkspaceAgentDiagnosticsReport `json:"diagnostics,omitempty"`
+}
+
+// WorkspaceAgentDiagnosticStatus is the result of a diagnostic.
+type WorkspaceAgentDiagnosticStatus string
+
+const (
+	WorkspaceAgentDiagnosticOK      WorkspaceAgentDiagnosticStatus = "ok"
+	WorkspaceAgentDiagnosticWarning WorkspaceAgentDiagnosticStatus = "warning"
+	WorkspaceAgentDiagnosticFailed  WorkspaceAgentDiagnosticStatus = "failed"
+)
+
+// WorkspaceAgentDiagnosticsReport contains the diagnostics of a workspace,
+// which help troubleshoot why the startup script failed.
+// @typescript-ignore WorkspaceAgentDiagnosticsReport
+type WorkspaceAgentDiagnosticsReport struct {
+	CreatedAt   time.Time                  `json:"created_at"`
+	Diagnostics []WorkspaceAgentDiagnostic `json:"diagnostics"`
+}
+
+// WorkspaceAgentDiagnostic is a check of the workspace, e.g. "disk" or
+// "dns".
+// @typescript-ignore WorkspaceAgentDiagnostic
+type WorkspaceAgentDiagnostic struct {
+	Name    string                         `json:"name"`
+	Status  WorkspaceAgentDiagnosticStatus `json:"status"`
+	Message string                         `json:"message"`
+	// Details are the results of each item checked, e.g. each host
+	// resolved.
+	Details []string `json:"details,omitempty"`
+}
+
+// Startup returns the state of the startup script of the agent.
+func (c *AgentConn) Startup(ctx context.Context) (WorkspaceAgentStartupResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/startup", nil)
+	if err != nil {
+		return WorkspaceAgentStartupResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentStartupResponse{}, readBodyAsError(res)
+	}
+
+	var resp WorkspaceAgentStartupResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// QuiesceResponse describes the reconnecting PTYs the agent serialized
+// before a VM snapshot.
+// @typescript-ignore QuiesceResponse
+type QuiesceResponse struct {
+	ReconnectingPTYs int `json:"reconnecting_ptys"`
+	// Path is the file the reconnecting PTYs were serialized to.
+	Path string `json:"path"`
+}
+
+// Quiesce prepares the agent for a snapshot of the VM of the workspace,
+// by serializing its reconnecting PTYs to disk. When the agent restarts
+// after the workspace resumes, clients that reconnect to them get their
+// previous output and a new process.
+func (c *AgentConn) Quiesce(ctx context.Context) (QuiesceResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodPost, "/api/v0/quiesce", nil)
+	if err != nil {
+		return QuiesceResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return QuiesceResponse{}, readBodyAsError(res)
+	}
+
+	var resp QuiesceResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// Reload makes the agent re-fetch its metadata, re-read its environment
+// file and reopen its log files, like sending it SIGHUP.
+func (c *AgentConn) Reload(ctx context.Context) error {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodPost, "/api/v0/reload", nil)
+	if err != nil {
+		return xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// AppTokenRequest gives the agent a token that coderd sends with proxied
+// app requests.
+// @typescript-ignore AppTokenRequest
+type AppTokenRequest struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SetAppToken gives the agent a token that coderd sends to apps in the
+// WorkspaceAppTokenHeader header, so they can validate that requests came
+// through the app proxy.
+func (c *AgentConn) SetAppToken(ctx context.Context, req AppTokenRequest) error {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	data, err := json.Marshal(req)
+	if err != nil {
+		return xerrors.Errorf("marshal request: %w", err)
+	}
+	res, err := c.doStatisticsRequest(ctx, http.MethodPost, "/api/v0/app-token", bytes.NewReader(data))
+	if err != nil {
+		return xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceAgentAppHealthProbe is the record of the health probes of an app.
+// @typescript-ignore WorkspaceAgentAppHealthProbe
+type WorkspaceAgentAppHealthProbe struct {
+	AppID    uuid.UUID `json:"app_id" format:"uuid"`
+	Probes   int64     `json:"probes"`
+	Failures int64     `json:"failures"`
+	// LastDurationMS and MaxDurationMS are the durations of the last
+	// and slowest probes in milliseconds.
+	LastDurationMS float64   `json:"last_duration_ms"`
+	MaxDurationMS  float64   `json:"max_duration_ms"`
+	LastProbedAt   time.Time `json:"last_probed_at" format:"date-time"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// WorkspaceAgentAppHealthProbesResponse lists the records of the health
+// probes of apps.
+// @typescript-ignore WorkspaceAgentAppHealthProbesResponse
+type WorkspaceAgentAppHealthProbesResponse struct {
+	Probes []WorkspaceAgentAppHealthProbe `json:"probes"`
+}
+
+// AppHealthProbes returns the records of the health probes of apps, which
+// show whether probes are slow or failing.
+func (c *AgentConn) AppHealthProbes(ctx context.Context) (WorkspaceAgentAppHealthProbesResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/app-health-probes", nil)
+	if err != nil {
+		return WorkspaceAgentAppHealthProbesResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentAppHealthProbesResponse{}, readBodyAsError(res)
+	}
+
+	var resp WorkspaceAgentAppHealthProbesResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentReconnectState is the state of the backoff between attempts
+// of the agent to connect to coderd.
+// @typescript-ignore WorkspaceAgentReconnectState
+type WorkspaceAgentReconnectState struct {
+	Connected bool `json:"connected"`
+	// Attempt is the number of attempts since the agent was last
+	// connected.
+	Attempt         int        `json:"attempt"`
+	LastError       string     `json:"last_error,omitempty"`
+	LastConnectedAt *time.Time `json:"last_connected_at,omitempty"`
+	NextAttemptAt   *time.Time `json:"next_attempt_at,omitempty"`
+	// MaxIntervalSeconds is the maximum interval between attempts.
+	MaxIntervalSeconds float64 `json:"max_interval_seconds"`
+}
+
+// ReconnectState returns the state of the backoff between attempts of the
+// agent to connect to coderd.
+func (c *AgentConn) ReconnectState(ctx context.Context) (WorkspaceAgentReconnectState, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/reconnect", nil)
+	if err != nil {
+		return WorkspaceAgentReconnectState{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentReconnectState{}, readBodyAsError(res)
+	}
+
+	var resp WorkspaceAgentReconnectState
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentHealth is the health of the agent. It's reported by the
+// /healthz and /debug/ready routes of the statistics server, which respond
+// with 503 Service Unavailable while there are problems.
+// @typescript-ignore WorkspaceAgentHealth
+type WorkspaceAgentHealth struct {
+	// Healthy is whether the agent is reachable through coderd. Ready
+	// also requires the workspace to be ready for users.
+	Healthy bool `json:"healthy"`
+	Ready   bool `json:"ready"`
+	// Problems explain why the agent isn't healthy or ready.
+	Problems    []string                        `json:"problems,omitempty"`
+	Tailnet     WorkspaceAgentTailnetHealth     `json:"tailnet"`
+	Coordinator WorkspaceAgentCoordinatorHealth `json:"coordinator"`
+	// MetadataFetchedAt is when the agent last fetched its metadata.
+	MetadataFetchedAt *time.Time                    `json:"metadata_fetched_at,omitempty"`
+	Startup           WorkspaceAgentStartupResponse `json:"startup"`
+}
+
+// WorkspaceAgentTailnetHealth is the state of the tailnet of the agent.
+// @typescript-ignore WorkspaceAgentTailnetHealth
+type WorkspaceAgentTailnetHealth struct {
+	Up bool `json:"up"`
+	// DERPRegion is the DERP region that peers reach the agent through
+	// when a direct connection isn't possible.
+	DERPRegion   string `json:"derp_region,omitempty"`
+	DERPDegraded bool   `json:"derp_degraded"`
+	Peers        int    `json:"peers"`
+}
+
+// WorkspaceAgentCoordinatorHealth is the state of the connection of the
+// agent to the coordinator of coderd, which clients need to reach it.
+// @typescript-ignore WorkspaceAgentCoordinatorHealth
+type WorkspaceAgentCoordinatorHealth struct {
+	Connected   bool       `json:"connected"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	// LastError is why the agent last failed to connect to coderd.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Health returns the health of the agent. Unlike other requests, an
+// unhealthy agent isn't an error.
+func (c *AgentConn) Health(ctx context.Context) (WorkspaceAgentHealth, error) {
+	return c.health(ctx, "/healthz")
+}
+
+// Ready returns whether the workspace of the agent is ready for users,
+// with the health of the agent.
+func (c *AgentConn) Ready(ctx context.Context) (WorkspaceAgentHealth, error) {
+	return c.health(ctx, "/debug/ready")
+}
+
+func (c *AgentConn) health(ctx context.Context, path string) (WorkspaceAgentHealth, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return WorkspaceAgentHealth{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusServiceUnavailable {
+		return WorkspaceAgentHealth{}, readBodyAsError(res)
+	}
+
+	var resp WorkspaceAgentHealth
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// Profile returns a profile of net/http/pprof from the agent, like "heap"
+// or "goroutine", when the agent serves them. CPU profiles ("profile") and
+// traces ("trace") last for the duration, or the default of the agent if
+// it's zero.
+func (c *AgentConn) Profile(ctx context.Context, name string, duration time.Duration) (io.ReadCloser, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	path := "/debug/pprof/" + url.PathEscape(name)
+	if duration > 0 {
+		path += fmt.Sprintf("?seconds=%d", int(duration.Seconds()))
+	}
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, readBodyAsError(res)
+	}
+	return res.Body, nil
+}
+
+// WorkspaceAgentSessionType is the kind of a session of the agent.
+type WorkspaceAgentSessionType string
+
+const (
+	WorkspaceAgentSessionTypeSSH             WorkspaceAgentSessionType = "ssh"
+	WorkspaceAgentSessionTypeReconnectingPTY WorkspaceAgentSessionType = "reconnecting_pty"
+	WorkspaceAgentSessionTypeExec            WorkspaceAgentSessionType = "exec"
+	WorkspaceAgentSessionTypeQuickAction     WorkspaceAgentSessionType = "quick_action"
+	// WorkspaceAgentSessionTypeSFTP is only passed to the pre-session
+	// hook of the agent, since SFTP sessions aren't listed.
+	WorkspaceAgentSessionTypeSFTP WorkspaceAgentSessionType = "sftp"
+)
+
+// WorkspaceAgentSession is an active session of the agent, like an SSH
+// session, a reconnecting PTY or a command that runs.
+type WorkspaceAgentSession struct {
+	ID   string                    `json:"id"`
+	Type WorkspaceAgentSessionType `json:"type"`
+	// User is the SSH user of the session. Other sessions don't have
+	// one.
+	User    string `json:"user,omitempty"`
+	Command string `json:"command,omitempty"`
+	// Peer is the address of the client. Reconnecting PTYs can have
+	// several clients, and it's the address of the first.
+	Peer      string    `json:"peer"`
+	StartedAt time.Time `json:"started_at" format:"date-time"`
+	// BytesIn and BytesOut are the bytes of input received from clients,
+	// and output sent to them.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Label is a name for a reconnecting PTY that its clients set, so
+	// users can tell their terminals apart. Title is the title that the
+	// program in the PTY last set with an escape sequence.
+	Label string `json:"label,omitempty"`
+	Title string `json:"title,omitempty"`
+	// ReasonCodes were attached to the session by the pre-session hook
+	// of the agent, like the policies of a compliance scanner.
+	ReasonCodes []string `json:"reason_codes,omitempty"`
+}
+
+// WorkspaceAgentSessionsResponse lists the active sessions of the agent.
+type WorkspaceAgentSessionsResponse struct {
+	Sessions []WorkspaceAgentSession `json:"sessions"`
+}
+
+// Sessions lists the active sessions of the agent.
+func (c *AgentConn) Sessions(ctx context.Context) (WorkspaceAgentSessionsResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/sessions", nil)
+	if err != nil {
+		return WorkspaceAgentSessionsResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentSessionsResponse{}, readBodyAsError(res)
+	}
+
+	var resp WorkspaceAgentSessionsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// TerminateSession ends an active session of the agent, killing its
+// process.
+func (c *AgentConn) TerminateSession(ctx context.Context, id string) error {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodDelete, "/api/v0/sessions/"+url.PathEscape(id), nil)
+	if err != nil {
+		return xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceAgentQuickActionRunStatus is the state of a run of a quick
+// action.
+type WorkspaceAgentQuickActionRunStatus string
+
+const (
+	WorkspaceAgentQuickActionRunRunning   WorkspaceAgentQuickActionRunStatus = "running"
+	WorkspaceAgentQuickActionRunSucceeded WorkspaceAgentQuickActionRunStatus = "succeeded"
+	WorkspaceAgentQuickActionRunFailed    WorkspaceAgentQuickActionRunStatus = "failed"
+	WorkspaceAgentQuickActionRunTimedOut  WorkspaceAgentQuickActionRunStatus = "timed_out"
+)
+
+// WorkspaceAgentQuickActionRun is a run of a quick action.
+type WorkspaceAgentQuickActionRun struct {
+	ID         uuid.UUID                          `json:"id" format:"uuid"`
+	Status     WorkspaceAgentQuickActionRunStatus `json:"status"`
+	StartedAt  time.Time                          `json:"started_at" format:"date-time"`
+	FinishedAt *time.Time                         `json:"finished_at,omitempty" format:"date-time"`
+	// ExitCode is set when the command exited. It's -1 if the command was
+	// killed.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Output is the end of the output of the command, with stdout and
+	// stderr interleaved and escape sequences removed.
+	Output string `json:"output"`
+	// OutputTruncated is set when the start of the output was dropped.
+	OutputTruncated bool `json:"output_truncated"`
+}
+
+// WorkspaceAgentQuickActionState is a quick action of the agent, with its
+// most recent run.
+type WorkspaceAgentQuickActionState struct {
+	Name        string                        `json:"name"`
+	DisplayName string                        `json:"display_name"`
+	Command     string                        `json:"command"`
+	LastRun     *WorkspaceAgentQuickActionRun `json:"last_run,omitempty"`
+}
+
+// WorkspaceAgentQuickActionsResponse lists the quick actions of the agent.
+type WorkspaceAgentQuickActionsResponse struct {
+	QuickActions []WorkspaceAgentQuickActionState `json:"quick_actions"`
+}
+
+// QuickActions lists the quick actions of the agent.
+func (c *AgentConn) QuickActions(ctx context.Context) (WorkspaceAgentQuickActionsResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/quick-actions", nil)
+	if err != nil {
+		return WorkspaceAgentQuickActionsResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentQuickActionsResponse{}, readBodyAsError(res)
+	}
+
+	var resp WorkspaceAgentQuickActionsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// RunQuickAction starts the quick action with the name, and returns the
+// run without waiting for it to finish. The run is listed with the quick
+// actions until the action runs again.
+func (c *AgentConn) RunQuickAction(ctx context.Context, name string) (WorkspaceAgentQuickActionRun, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodPost, "/api/v0/quick-actions/"+url.PathEscape(name), nil)
+	if err != nil {
+		return WorkspaceAgentQuickActionRun{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentQuickActionRun{}, readBodyAsError(res)
+	}
+
+	var run WorkspaceAgentQuickActionRun
+	return run, json.NewDecoder(res.Body).Decode(&run)
+}
+
+// ContentTypeAsciicast is the content type of session transcripts.
+const ContentTypeAsciicast = "application/x-asciicast"
+
+// SessionTranscript is a recording of a PTY session in asciicast format.
+// @typescript-ignore SessionTranscript
+type SessionTranscript struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Size      int64     `json:"size"`
+}
+
+// SessionTranscriptsResponse contains the session transcripts
+// recorded by an agent.
+// @typescript-ignore SessionTranscriptsResponse
+type SessionTranscriptsResponse struct {
+	Transcripts []SessionTranscript `json:"transcripts"`
+}
+
+// SessionTranscripts lists the session transcripts recorded by the agent,
+// from oldest to newest.
+func (c *AgentConn) SessionTranscripts(ctx context.Context) (SessionTranscriptsResponse, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/transcripts", nil)
+	if err != nil {
+		return SessionTranscriptsResponse{}, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return SessionTranscriptsResponse{}, readBodyAsError(res)
+	}
+
+	var resp SessionTranscriptsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// SessionTranscript downloads a session transcript in asciicast format.
+// The caller must close the returned reader.
+func (c *AgentConn) SessionTranscript(ctx context.Context, id string) (io.ReadCloser, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/transcripts/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, readBodyAsError(res)
+	}
+	return res.Body, nil
+}
+
+// workspaceAgentIdentityContext is prepended to nonces before they're
+// signed, so identity signatures can't be reused for anything else.
+const workspaceAgentIdentityContext = "coder-workspace-agent-identity-v1:"
+
+// WorkspaceAgentIdentityMessage returns the message an agent signs with its
+// identity key to prove it's the agent the key was registered for.
+func WorkspaceAgentIdentityMessage(nonce []byte) []byte {
+	return append([]byte(workspaceAgentIdentityContext), nonce...)
+}
+
+// WorkspaceAgentIdentityRequest asks the agent to sign a nonce with its
+// identity key.
+// @typescript-ignore WorkspaceAgentIdentityRequest
+type WorkspaceAgentIdentityRequest struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// WorkspaceAgentIdentityResponse is the signature of the identity message
+// of the nonce.
+// @typescript-ignore WorkspaceAgentIdentityResponse
+type WorkspaceAgentIdentityResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// SignIdentity asks the agent to sign the identity message of a nonce.
+func (c *AgentConn) SignIdentity(ctx context.Context, nonce []byte) ([]byte, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	data, err := json.Marshal(WorkspaceAgentIdentityRequest{Nonce: nonce})
+	if err != nil {
+		return nil, xerrors.Errorf("marshal request: %w", err)
+	}
+	res, err := c.doStatisticsRequest(ctx, http.MethodPost, "/api/v0/identity", bytes.NewReader(data))
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var resp WorkspaceAgentIdentityResponse
+	return resp.Signature, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// VerifyIdentity checks that the agent on the other end of the connection
+// holds the identity key that its agent registered at coderd, which is
+// returned by Client.WorkspaceAgentIdentityKey. A random nonce is signed, so
+// responses can't be replayed. It fails if the coordinator routed the
+// connection to another agent.
+func (c *AgentConn) VerifyIdentity(ctx context.Context, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return xerrors.Errorf("identity key must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return xerrors.Errorf("generate nonce: %w", err)
+	}
+	signature, err := c.SignIdentity(ctx, nonce)
+	if err != nil {
+		return xerrors.Errorf("sign identity: %w", err)
+	}
+	if !ed25519.Verify(key, WorkspaceAgentIdentityMessage(nonce), signature) {
+		return xerrors.New("the agent didn't prove it holds the identity key registered for the workspace agent, the connection may have been routed to another workspace")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// AgentConnectionType is the kind of a connection to a workspace agent.
+type AgentConnectionType string
+
+const (
+	AgentConnectionTypeSSH             AgentConnectionType = "ssh"
+	AgentConnectionTypeSFTP            AgentConnectionType = "sftp"
+	AgentConnectionTypePortForward     AgentConnectionType = "port_forward"
+	AgentConnectionTypeReconnectingPTY AgentConnectionType = "reconnecting_pty"
+	AgentConnectionTypeFileSync        AgentConnectionType = "file_sync"
+	AgentConnectionTypeExec            AgentConnectionType = "exec"
+)
+
+// AgentConnectionAction is whether a client connected or disconnected.
+type AgentConnectionAction string
+
+const (
+	AgentConnectionActionConnect    AgentConnectionAction = "connect"
+	AgentConnectionActionDisconnect AgentConnectionAction = "disconnect"
+)
+
+// MaxAgentConnectionEventsBatchSize is the number of connection events an
+// agent can send at once.
+const MaxAgentConnectionEventsBatchSize = 1000
+
+// AgentConnectionEvent is a client connecting to or disconnecting from a
+// workspace agent, which the agent records so connections to workspaces
+// can be audited.
+type AgentConnectionEvent struct {
+	// ID is generated by the agent, so events it retries are only stored
+	// once.
+	ID uuid.UUID `json:"id" format:"uuid"`
+	// AgentID is set by coderd when events are listed.
+	AgentID uuid.UUID `json:"agent_id,omitempty" format:"uuid"`
+	// ConnectionID is shared by the connect and disconnect events of a
+	// connection.
+	ConnectionID uuid.UUID `json:"connection_id" format:"uuid"`
+	// SessionID is the ID of the SSH session or reconnecting PTY in the
+	// sessions of the agent. Clients attach to a reconnecting PTY with
+	// many connections.
+	SessionID string                `json:"session_id,omitempty"`
+	Type      AgentConnectionType   `json:"type"`
+	Action    AgentConnectionAction `json:"action"`
+	Time      time.Time             `json:"time" format:"date-time"`
+	// Peer is the tailnet address of the client.
+	Peer string `json:"peer"`
+	// User is the SSH user. Reconnecting PTYs and port forwards over the
+	// tailnet don't have one.
+	User    string `json:"user,omitempty"`
+	Command string `json:"command,omitempty"`
+	// Destination is the address a port forward connects to.
+	Destination string `json:"destination,omitempty"`
+}
+
+// PostAgentConnectionEventsRequest is a batch of connection events that a
+// workspace agent recorded.
+// @typescript-ignore PostAgentConnectionEventsRequest
+type PostAgentConnectionEventsRequest struct {
+	Events []AgentConnectionEvent `json:"events"`
+}
+
+// PostAgentConnectionEvents sends connection events that the agent recorded
+// to coderd.
+func (c *Client) PostAgentConnectionEvents(ctx context.Context, req PostAgentConnectionEventsRequest) error {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/connection-events", req)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceConnectionEvents returns the connection events of the agents of
+// a workspace, most recent first.
+func (c *Client) WorkspaceConnectionEvents(ctx context.Context, workspaceID uuid.UUID, page Pagination) ([]AgentConnectionEvent, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaces/%s/connection-events", workspaceID), nil, page.asRequestOption())
+	if err != nil {
+		return nil, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var events []AgentConnectionEvent
+	return events, json.NewDecoder(res.Body).Decode(&events)
+}
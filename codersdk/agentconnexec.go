@@ -0,0 +1,125 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net/netip"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/coderd/tracing"
+)
+
+// ExecRequest runs a command in the workspace, see AgentConn.Exec.
+// @typescript-ignore ExecRequest
+type ExecRequest struct {
+	// Command is run with the shell of the user, like commands of SSH
+	// sessions.
+	Command string `json:"command"`
+	// Env are environment variables set for the command.
+	Env map[string]string `json:"env,omitempty"`
+	// Dir is the working directory of the command. Relative paths are
+	// relative to the directory of the agent, which defaults to the home
+	// directory.
+	Dir string `json:"dir,omitempty"`
+	// Timeout kills the command after the duration. Zero never kills it.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// ExecStream is the output stream of a command.
+type ExecStream string
+
+const (
+	ExecStreamStdout ExecStream = "stdout"
+	ExecStreamStderr ExecStream = "stderr"
+)
+
+// ExecMessage is streamed by the agent while a command runs. The last
+// message has the exit code or the error that ended the command.
+// @typescript-ignore ExecMessage
+type ExecMessage struct {
+	Stream ExecStream `json:"stream,omitempty"`
+	Data   []byte     `json:"data,omitempty"`
+	// ExitCode is set on the last message once the command exits.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Error is set on the last message if the command couldn't start or
+	// timed out.
+	Error string `json:"error,omitempty"`
+}
+
+// Exec runs a command in the workspace without the overhead of an SSH
+// session, and copies its output to stdout and stderr, which can be nil to
+// discard it. It returns the exit code of the command.
+func (c *AgentConn) Exec(ctx context.Context, req ExecRequest, stdout, stderr io.Writer) (int, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	conn, err := c.DialContextTCP(ctx, netip.AddrPortFrom(TailnetIP, uint16(TailnetExecPort)))
+	if err != nil {
+		return 0, xerrors.Errorf("dial exec: %w", err)
+	}
+	defer conn.Close()
+	// Closing the connection stops the command.
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-closed:
+		}
+	}()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > math.MaxUint16 {
+		return 0, xerrors.Errorf("exec request is %d bytes, the limit is %d", len(data), math.MaxUint16)
+	}
+	data = append(make([]byte, 2), data...)
+	binary.LittleEndian.PutUint16(data, uint16(len(data)-2))
+	_, err = conn.Write(data)
+	if err != nil {
+		return 0, xerrors.Errorf("write request: %w", err)
+	}
+
+	decoder := json.NewDecoder(conn)
+	for {
+		var msg ExecMessage
+		err = decoder.Decode(&msg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			return 0, xerrors.Errorf("read message: %w", err)
+		}
+		switch {
+		case msg.Error != "":
+			exitCode := -1
+			if msg.ExitCode != nil {
+				exitCode = *msg.ExitCode
+			}
+			return exitCode, xerrors.New(msg.Error)
+		case msg.ExitCode != nil:
+			return *msg.ExitCode, nil
+		case msg.Stream == ExecStreamStderr:
+			_, err = stderr.Write(msg.Data)
+		default:
+			_, err = stdout.Write(msg.Data)
+		}
+		if err != nil {
+			return 0, xerrors.Errorf("write output: %w", err)
+		}
+	}
+}
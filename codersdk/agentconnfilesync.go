@@ -0,0 +1,113 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/coderd/tracing"
+	"github.com/coder/coder/filesync"
+)
+
+// FileSyncDirection is whether files are synced to or from the workspace.
+type FileSyncDirection string
+
+const (
+	// FileSyncDirectionUpload syncs a local directory to the workspace.
+	FileSyncDirectionUpload FileSyncDirection = "upload"
+	// FileSyncDirectionDownload syncs a directory of the workspace to the
+	// local machine.
+	FileSyncDirectionDownload FileSyncDirection = "download"
+)
+
+// FileSyncInit starts a sync with the agent.
+// @typescript-ignore FileSyncInit
+type FileSyncInit struct {
+	Direction FileSyncDirection
+	// Path is the directory in the workspace. Relative paths and paths
+	// starting with ~ are relative to the home directory of the agent.
+	Path string
+	// Delete removes the files from the directory in the workspace that
+	// aren't uploaded.
+	Delete bool
+}
+
+// SyncFilesOptions configure AgentConn.SyncFiles.
+// @typescript-ignore SyncFilesOptions
+type SyncFilesOptions struct {
+	Direction  FileSyncDirection
+	LocalPath  string
+	RemotePath string
+	// Delete removes files from the destination that aren't in the
+	// source.
+	Delete bool
+	// Filesystem is the local filesystem, which defaults to the OS.
+	Filesystem afero.Fs
+}
+
+// SyncFiles syncs a local directory with a directory of the workspace. Only
+// the files that differ are sent, as the differences to the blocks of the
+// file at the destination, so it's much faster than SFTP for large trees
+// that mostly match.
+func (c *AgentConn) SyncFiles(ctx context.Context, options SyncFilesOptions) (filesync.Stats, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+
+	if options.Direction != FileSyncDirectionUpload && options.Direction != FileSyncDirectionDownload {
+		return filesync.Stats{}, xerrors.Errorf("invalid direction %q", options.Direction)
+	}
+	fs := options.Filesystem
+	if fs == nil {
+		fs = afero.NewOsFs()
+	}
+	conn, err := c.DialContextTCP(ctx, netip.AddrPortFrom(TailnetIP, uint16(TailnetFileSyncPort)))
+	if err != nil {
+		return filesync.Stats{}, xerrors.Errorf("dial file sync: %w", err)
+	}
+	defer conn.Close()
+	// Closing the connection stops a sync that's blocked on it.
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-closed:
+		}
+	}()
+
+	data, err := json.Marshal(FileSyncInit{
+		Direction: options.Direction,
+		Path:      options.RemotePath,
+		Delete:    options.Delete,
+	})
+	if err != nil {
+		return filesync.Stats{}, err
+	}
+	data = append(make([]byte, 2), data...)
+	binary.LittleEndian.PutUint16(data, uint16(len(data)-2))
+	_, err = conn.Write(data)
+	if err != nil {
+		return filesync.Stats{}, xerrors.Errorf("write init: %w", err)
+	}
+
+	var stats filesync.Stats
+	if options.Direction == FileSyncDirectionUpload {
+		stats, err = filesync.Send(ctx, conn, fs, options.LocalPath)
+	} else {
+		stats, err = filesync.Receive(ctx, conn, fs, options.LocalPath, filesync.Options{
+			Delete: options.Delete,
+		})
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return filesync.Stats{}, ctx.Err()
+		}
+		return filesync.Stats{}, xerrors.Errorf("sync files: %w", err)
+	}
+	return stats, nil
+}
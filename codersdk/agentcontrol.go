@@ -0,0 +1,191 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// AgentControlSocketEnv is the environment variable that sessions of the
+// agent are started with, which is the path of its control socket.
+const AgentControlSocketEnv = "CODER_AGENT_CONTROL_SOCKET"
+
+// AgentControlServiceType is the type of a service run by the agent.
+type AgentControlServiceType string
+
+const (
+	AgentControlServiceTypeLanguageServer AgentControlServiceType = "language_server"
+)
+
+// AgentControlService is a long-running process of the agent that can be
+// restarted.
+// @typescript-ignore AgentControlService
+type AgentControlService struct {
+	Name    string                  `json:"name"`
+	Type    AgentControlServiceType `json:"type"`
+	Running bool                    `json:"running"`
+	LogFile string                  `json:"log_file,omitempty"`
+}
+
+// AgentControlStatus is the state of the agent running in the workspace.
+// @typescript-ignore AgentControlStatus
+type AgentControlStatus struct {
+	Version   string                        `json:"version"`
+	StartedAt time.Time                     `json:"started_at"`
+	Draining  bool                          `json:"draining"`
+	Reconnect WorkspaceAgentReconnectState  `json:"reconnect"`
+	Startup   WorkspaceAgentStartupResponse `json:"startup"`
+	Sessions  int                           `json:"sessions"`
+	Services  []AgentControlService         `json:"services"`
+	Health    WorkspaceAgentHealth          `json:"health"`
+}
+
+// AgentEventType is the type of an event in the timeline of the agent.
+type AgentEventType string
+
+const (
+	AgentEventStarted       AgentEventType = "started"
+	AgentEventStopped       AgentEventType = "stopped"
+	AgentEventConnected     AgentEventType = "connected"
+	AgentEventDisconnected  AgentEventType = "disconnected"
+	AgentEventPanic         AgentEventType = "panic"
+	AgentEventStartupFailed AgentEventType = "startup_failed"
+)
+
+// AgentEvent is a significant event of the agent, like connecting to or
+// disconnecting from coderd, which the agent keeps on disk so incidents
+// can be reconstructed when central logs are unavailable.
+// @typescript-ignore AgentEvent
+type AgentEvent struct {
+	Time    time.Time      `json:"time"`
+	Type    AgentEventType `json:"type"`
+	Message string         `json:"message"`
+}
+
+// AgentEventsResponse are the events of the agent, oldest first.
+// @typescript-ignore AgentEventsResponse
+type AgentEventsResponse struct {
+	Events []AgentEvent `json:"events"`
+}
+
+// AgentControlClient talks to the agent running in the workspace over its
+// control socket, so users in the workspace can inspect the agent without
+// access to coderd.
+// @typescript-ignore AgentControlClient
+type AgentControlClient struct {
+	httpClient *http.Client
+}
+
+// NewAgentControlClient returns a client for the control socket at path.
+func NewAgentControlClient(path string) *AgentControlClient {
+	return &AgentControlClient{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+func (c *AgentControlClient) request(ctx context.Context, method, path string) (*http.Response, error) {
+	// The host is ignored, since requests are sent to the socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://agent"+path, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("new control request: %w", err)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("do control request: %w", err)
+	}
+	return res, nil
+}
+
+// Status returns the state of the agent.
+func (c *AgentControlClient) Status(ctx context.Context) (AgentControlStatus, error) {
+	res, err := c.request(ctx, http.MethodGet, "/api/v0/status")
+	if err != nil {
+		return AgentControlStatus{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return AgentControlStatus{}, readBodyAsError(res)
+	}
+	var status AgentControlStatus
+	return status, json.NewDecoder(res.Body).Decode(&status)
+}
+
+// Sessions returns the active sessions of the agent.
+func (c *AgentControlClient) Sessions(ctx context.Context) (WorkspaceAgentSessionsResponse, error) {
+	res, err := c.request(ctx, http.MethodGet, "/api/v0/sessions")
+	if err != nil {
+		return WorkspaceAgentSessionsResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentSessionsResponse{}, readBodyAsError(res)
+	}
+	var resp WorkspaceAgentSessionsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// RestartService restarts a service of the agent by name.
+func (c *AgentControlClient) RestartService(ctx context.Context, name string) error {
+	res, err := c.request(ctx, http.MethodPost, fmt.Sprintf("/api/v0/services/%s/restart", url.PathEscape(name)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// Logs copies the log of the agent, the startup script or a service by
+// name to w. When lines is positive, only the last lines are copied.
+func (c *AgentControlClient) Logs(ctx context.Context, name string, lines int, w io.Writer) error {
+	path := fmt.Sprintf("/api/v0/logs/%s", url.PathEscape(name))
+	if lines > 0 {
+		path += "?lines=" + strconv.Itoa(lines)
+	}
+	res, err := c.request(ctx, http.MethodGet, path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// Events returns the events of the agent, oldest first. When limit is
+// positive, only the last events are returned.
+func (c *AgentControlClient) Events(ctx context.Context, limit int) (AgentEventsResponse, error) {
+	path := "/api/v0/events"
+	if limit > 0 {
+		path += "?limit=" + strconv.Itoa(limit)
+	}
+	res, err := c.request(ctx, http.MethodGet, path)
+	if err != nil {
+		return AgentEventsResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return AgentEventsResponse{}, readBodyAsError(res)
+	}
+	var resp AgentEventsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
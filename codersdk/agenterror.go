@@ -0,0 +1,121 @@
+package codersdk
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// WorkspaceAgentErrorCode classifies failures of the workspace agent, so
+// clients can show guidance instead of a bare exit code.
+type WorkspaceAgentErrorCode string
+
+const (
+	WorkspaceAgentErrorTokenInvalid        WorkspaceAgentErrorCode = "TOKEN_INVALID"
+	WorkspaceAgentErrorTokenExchangeFailed WorkspaceAgentErrorCode = "TOKEN_EXCHANGE_FAILED"
+	WorkspaceAgentErrorMetadataFetchFailed WorkspaceAgentErrorCode = "METADATA_FETCH_FAILED"
+	WorkspaceAgentErrorMetadataUnavailable WorkspaceAgentErrorCode = "METADATA_UNAVAILABLE"
+	WorkspaceAgentErrorMetadataUnsupported WorkspaceAgentErrorCode = "METADATA_UNSUPPORTED"
+	WorkspaceAgentErrorCoordinatorFailed   WorkspaceAgentErrorCode = "COORDINATOR_FAILED"
+	WorkspaceAgentErrorTailnetInitFailed   WorkspaceAgentErrorCode = "TAILNET_INIT_FAILED"
+	WorkspaceAgentErrorUserLookupFailed    WorkspaceAgentErrorCode = "USER_LOOKUP_FAILED"
+	WorkspaceAgentErrorShellLookupFailed   WorkspaceAgentErrorCode = "SHELL_LOOKUP_FAILED"
+	WorkspaceAgentErrorPTYFailed           WorkspaceAgentErrorCode = "PTY_FAILED"
+	WorkspaceAgentErrorCommandStartFailed  WorkspaceAgentErrorCode = "COMMAND_START_FAILED"
+	WorkspaceAgentErrorFileDescriptors     WorkspaceAgentErrorCode = "FILE_DESCRIPTORS_EXHAUSTED"
+	WorkspaceAgentErrorStartupScriptFailed WorkspaceAgentErrorCode = "STARTUP_SCRIPT_FAILED"
+	WorkspaceAgentErrorPTYInputTooLarge    WorkspaceAgentErrorCode = "PTY_INPUT_TOO_LARGE"
+	WorkspaceAgentErrorSessionDenied       WorkspaceAgentErrorCode = "SESSION_DENIED"
+	WorkspaceAgentErrorUnknown             WorkspaceAgentErrorCode = "UNKNOWN"
+)
+
+var workspaceAgentErrorGuidance = map[WorkspaceAgentErrorCode]string{
+	WorkspaceAgentErrorTokenInvalid:        "The agent token was rejected by Coder. Restart the workspace to issue a new token.",
+	WorkspaceAgentErrorTokenExchangeFailed: "The agent couldn't authenticate with the instance identity of the workspace. Check that the template's agent auth matches the cloud the workspace runs in.",
+	WorkspaceAgentErrorMetadataFetchFailed: "The agent couldn't fetch its metadata from Coder. Check that the workspace can reach the access URL of Coder.",
+	WorkspaceAgentErrorMetadataUnavailable: "The agent hasn't fetched its metadata from Coder yet. Wait for the agent to connect and try again.",
+	WorkspaceAgentErrorMetadataUnsupported: "Coder sent metadata that this version of the agent can't apply safely. Update the agent in the workspace image, or restart the workspace so it downloads the agent of Coder.",
+	WorkspaceAgentErrorCoordinatorFailed:   "The agent couldn't connect to the coordinator of Coder. Check that the workspace can reach the access URL of Coder and that proxies allow websockets.",
+	WorkspaceAgentErrorTailnetInitFailed:   "The agent couldn't start networking. Check the agent logs in the workspace.",
+	WorkspaceAgentErrorUserLookupFailed:    "The agent couldn't look up the user it runs as. Check that the user exists in the workspace image.",
+	WorkspaceAgentErrorShellLookupFailed:   "The agent couldn't find the shell of the user. Check that the shell in /etc/passwd is installed.",
+	WorkspaceAgentErrorPTYFailed:           "The agent couldn't start the command in a PTY. Check that /dev/pts is mounted and the shell of the user is installed.",
+	WorkspaceAgentErrorCommandStartFailed:  "The agent couldn't start the command. Check that the shell and working directory of the agent exist.",
+	WorkspaceAgentErrorFileDescriptors:     "The workspace ran out of file descriptors. Stop processes that leak open files, or raise the limit of the agent with ulimit -n.",
+	WorkspaceAgentErrorStartupScriptFailed: "The startup script of the workspace failed, and the template blocks sessions until it succeeds. Check the startup script logs, and restart the workspace.",
+	WorkspaceAgentErrorPTYInputTooLarge:    "The terminal was sent more input at once than the agent accepts, and was disconnected. Paste large content in parts, or copy it into the workspace as a file.",
+	WorkspaceAgentErrorSessionDenied:       "A compliance hook of the agent denied the session. Contact the administrator of the workspace if it shouldn't have.",
+}
+
+// Guidance returns how to resolve the failure, or an empty string for
+// unknown codes.
+func (c WorkspaceAgentErrorCode) Guidance() string {
+	return workspaceAgentErrorGuidance[c]
+}
+
+// WorkspaceAgentError is a failure of the workspace agent with a code.
+// @typescript-ignore WorkspaceAgentError
+type WorkspaceAgentError struct {
+	Code WorkspaceAgentErrorCode
+	Err  error
+}
+
+// NewWorkspaceAgentError classifies err with the code.
+func NewWorkspaceAgentError(code WorkspaceAgentErrorCode, err error) *WorkspaceAgentError {
+	return &WorkspaceAgentError{
+		Code: code,
+		Err:  err,
+	}
+}
+
+func (e *WorkspaceAgentError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Err)
+}
+
+func (e *WorkspaceAgentError) Unwrap() error {
+	return e.Err
+}
+
+// WorkspaceAgentErrorCodeOf returns the code of the outermost
+// WorkspaceAgentError wrapped by err, or WorkspaceAgentErrorUnknown.
+func WorkspaceAgentErrorCodeOf(err error) WorkspaceAgentErrorCode {
+	var agentErr *WorkspaceAgentError
+	if xerrors.As(err, &agentErr) {
+		return agentErr.Code
+	}
+	return WorkspaceAgentErrorUnknown
+}
+
+// ParseWorkspaceAgentErrorCode finds the code in the message of a failure,
+// e.g. the output of an SSH session that the agent failed to start.
+func ParseWorkspaceAgentErrorCode(message string) (WorkspaceAgentErrorCode, bool) {
+	for code := range workspaceAgentErrorGuidance {
+		if strings.Contains(message, string(code)+": ") {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+// FormatWorkspaceAgentError returns the message that clients are sent when
+// the agent fails to start a session, with guidance if the failure has a
+// known code.
+func FormatWorkspaceAgentError(err error) string {
+	message := "Coder agent error: " + err.Error()
+	if guidance := WorkspaceAgentErrorCodeOf(err).Guidance(); guidance != "" {
+		message += "\n" + guidance
+	}
+	return message
+}
+
+// workspaceAgentRequestError classifies the error of a request made by the
+// agent, since rejected tokens need to be told apart from other failures.
+func workspaceAgentRequestError(code WorkspaceAgentErrorCode, err error) error {
+	var apiErr *Error
+	if xerrors.As(err, &apiErr) && apiErr.StatusCode() == http.StatusUnauthorized {
+		code = WorkspaceAgentErrorTokenInvalid
+	}
+	return NewWorkspaceAgentError(code, err)
+}
@@ -0,0 +1,215 @@
+package codersdk
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/coderd/tracing"
+)
+
+// QUICProtocol is negotiated with ALPN by QUIC connections to the agent.
+const QUICProtocol = "coder-agent"
+
+// QUICResponse describes the QUIC listener of the agent.
+// @typescript-ignore QUICResponse
+type QUICResponse struct {
+	// Port is the UDP port of the listener on the tailnet.
+	Port uint16 `json:"port"`
+}
+
+// QUICStreamInit is sent at the start of every QUIC stream to select the
+// tailnet port the stream connects to, as if it was a TCP connection.
+// @typescript-ignore QUICStreamInit
+type QUICStreamInit struct {
+	Port uint16 `json:"port"`
+}
+
+var errQUICUnavailable = xerrors.New("quic is unavailable")
+
+// QUICConfig returns the QUIC configuration shared by the agent and clients.
+func QUICConfig() *quic.Config {
+	return &quic.Config{
+		// UDP sessions relayed by the tailnet are closed after two
+		// minutes without traffic.
+		KeepAlivePeriod: 15 * time.Second,
+		// The tailnet MTU is fixed, so probing only wastes packets.
+		DisablePathMTUDiscovery: true,
+		// Each reconnecting PTY and port forward is a stream.
+		MaxIncomingStreams: 1024,
+	}
+}
+
+// quicConnection returns the QUIC connection to the agent, dialing one if
+// it doesn't exist yet.
+func (c *AgentConn) quicConnection(ctx context.Context) (quic.Connection, error) {
+	c.quicMutex.Lock()
+	defer c.quicMutex.Unlock()
+	if c.quicUnavailable {
+		return nil, errQUICUnavailable
+	}
+	if c.quic != nil && c.quic.Context().Err() == nil {
+		return c.quic, nil
+	}
+
+	res, err := c.doStatisticsRequest(ctx, http.MethodGet, "/api/v0/quic", nil)
+	if err != nil {
+		return nil, xerrors.Errorf("do request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		// The agent is outdated or QUIC is disabled.
+		c.quicUnavailable = true
+		return nil, errQUICUnavailable
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var resp QUICResponse
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	if err != nil {
+		return nil, xerrors.Errorf("decode response: %w", err)
+	}
+
+	packetConn, err := c.Conn.DialContextUDP(ctx, netip.AddrPortFrom(TailnetIP, resp.Port))
+	if err != nil {
+		return nil, xerrors.Errorf("dial udp: %w", err)
+	}
+	conn, err := quic.DialContext(ctx, packetConn, packetConn.RemoteAddr(), "localhost", &tls.Config{
+		// The certificate of the agent isn't helpful, because the
+		// tailnet already authenticates the agent.
+		// #nosec
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{QUICProtocol},
+	}, QUICConfig())
+	if err != nil {
+		_ = packetConn.Close()
+		return nil, xerrors.Errorf("dial quic: %w", err)
+	}
+	go func() {
+		// The packet conn isn't closed with the connection when
+		// it's passed to quic.
+		<-conn.Context().Done()
+		_ = packetConn.Close()
+	}()
+	c.quic = conn
+	return conn, nil
+}
+
+// DialQUIC opens a QUIC stream to the port on the tailnet, which behaves
+// like a TCP connection. Streams are multiplexed on a single connection,
+// so a lost packet only delays the stream it belongs to.
+func (c *AgentConn) DialQUIC(ctx context.Context, port uint16) (net.Conn, error) {
+	ctx, span := tracing.StartSpan(ctx)
+	defer span.End()
+	conn, err := c.quicConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("open stream: %w", err)
+	}
+	data, err := json.Marshal(QUICStreamInit{
+		Port: port,
+	})
+	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, err
+	}
+	data = append(make([]byte, 2), data...)
+	binary.LittleEndian.PutUint16(data, uint16(len(data)-2))
+	_, err = stream.Write(data)
+	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, xerrors.Errorf("write stream init: %w", err)
+	}
+	return NewQUICStreamConn(conn, stream), nil
+}
+
+// dialTCP connects to the port on the tailnet over QUIC when it's enabled
+// and offered by the agent, or TCP otherwise.
+func (c *AgentConn) dialTCP(ctx context.Context, port uint16) (net.Conn, error) {
+	if c.ExperimentalQUIC {
+		conn, err := c.DialQUIC(ctx, port)
+		if err == nil {
+			return conn, nil
+		}
+		if !xerrors.Is(err, errQUICUnavailable) {
+			return nil, err
+		}
+	}
+	return c.DialContextTCP(ctx, netip.AddrPortFrom(TailnetIP, port))
+}
+
+// ReadQUICStreamInit reads the QUICStreamInit at the start of a stream.
+func ReadQUICStreamInit(r io.Reader) (QUICStreamInit, error) {
+	rawLen := make([]byte, 2)
+	_, err := io.ReadFull(r, rawLen)
+	if err != nil {
+		return QUICStreamInit{}, xerrors.Errorf("read length: %w", err)
+	}
+	data := make([]byte, binary.LittleEndian.Uint16(rawLen))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return QUICStreamInit{}, xerrors.Errorf("read init: %w", err)
+	}
+	var init QUICStreamInit
+	err = json.Unmarshal(data, &init)
+	if err != nil {
+		return QUICStreamInit{}, xerrors.Errorf("unmarshal init: %w", err)
+	}
+	return init, nil
+}
+
+// NewQUICStreamConn adapts a QUIC stream to a net.Conn.
+func NewQUICStreamConn(conn quic.Connection, stream quic.Stream) net.Conn {
+	return &quicStreamConn{
+		Stream: stream,
+		conn:   conn,
+	}
+}
+
+// quicStreamConn is a QUIC stream with the addresses of its connection.
+// @typescript-ignore quicStreamConn
+type quicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+// Read defers io.EOF to the next call when it's returned with data, like
+// TCP connections do. Streams return both when the final frame is read.
+func (s *quicStreamConn) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 && xerrors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+// Close closes both directions of the stream, since closing a stream only
+// closes the write direction.
+func (s *quicStreamConn) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func (s *quicStreamConn) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStreamConn) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
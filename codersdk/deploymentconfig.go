@@ -31,10 +31,14 @@ type DeploymentConfig struct {
 	Trace                           *TraceConfig                            `json:"trace" typescript:",notnull"`
 	SecureAuthCookie                *DeploymentConfigField[bool]            `json:"secure_auth_cookie" typescript:",notnull"`
 	SSHKeygenAlgorithm              *DeploymentConfigField[string]          `json:"ssh_keygen_algorithm" typescript:",notnull"`
+	SSHUserCAKeyFile                *DeploymentConfigField[string]          `json:"ssh_user_ca_key_file" typescript:",notnull"`
+	SSHUserCertificateTTL           *DeploymentConfigField[time.Duration]   `json:"ssh_user_certificate_ttl" typescript:",notnull"`
+	SSHPublicKeyAuth                *DeploymentConfigField[bool]            `json:"ssh_public_key_auth" typescript:",notnull"`
 	AutoImportTemplates             *DeploymentConfigField[[]string]        `json:"auto_import_templates" typescript:",notnull"`
 	MetricsCacheRefreshInterval     *DeploymentConfigField[time.Duration]   `json:"metrics_cache_refresh_interval" typescript:",notnull"`
 	AgentStatRefreshInterval        *DeploymentConfigField[time.Duration]   `json:"agent_stat_refresh_interval" typescript:",notnull"`
 	AgentFallbackTroubleshootingURL *DeploymentConfigField[string]          `json:"agent_fallback_troubleshooting_url" typescript:",notnull"`
+	AgentReconnectMaxInterval       *DeploymentConfigField[time.Duration]   `json:"agent_reconnect_max_interval" typescript:",notnull"`
 	AuditLogging                    *DeploymentConfigField[bool]            `json:"audit_logging" typescript:",notnull"`
 	BrowserOnly                     *DeploymentConfigField[bool]            `json:"browser_only" typescript:",notnull"`
 	SCIMAPIKey                      *DeploymentConfigField[string]          `json:"scim_api_key" typescript:",notnull"`
@@ -42,6 +46,7 @@ type DeploymentConfig struct {
 	APIRateLimit                    *DeploymentConfigField[int]             `json:"api_rate_limit" typescript:",notnull"`
 	Experimental                    *DeploymentConfigField[bool]            `json:"experimental" typescript:",notnull"`
 	UpdateCheck                     *DeploymentConfigField[bool]            `json:"update_check" typescript:",notnull"`
+	Tunnels                         *DeploymentConfigField[bool]            `json:"tunnels" typescript:",notnull"`
 }
 
 type DERP struct {
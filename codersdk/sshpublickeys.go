@@ -0,0 +1,104 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// UserSSHPublicKey is a public key that authenticates the user to the SSH
+// servers of their workspaces, when the deployment requires public key
+// authentication.
+type UserSSHPublicKey struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	// PublicKey is in the authorized_keys format.
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type CreateUserSSHPublicKeyRequest struct {
+	// Name describes the key, e.g. the machine it's on. The comment of the
+	// key is used if it's empty.
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key" validate:"required"`
+}
+
+// WorkspaceAgentAuthorizedKeys are the public keys that authenticate SSH
+// connections to a workspace agent.
+// @typescript-ignore WorkspaceAgentAuthorizedKeys
+type WorkspaceAgentAuthorizedKeys struct {
+	// PublicKeys are the keys of the owner of the workspace in the
+	// authorized_keys format.
+	PublicKeys []string `json:"public_keys"`
+}
+
+// UserSSHPublicKeys returns the SSH public keys of the user.
+func (c *Client) UserSSHPublicKeys(ctx context.Context, user string) ([]UserSSHPublicKey, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/users/%s/ssh-public-keys", user), nil)
+	if err != nil {
+		return nil, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+
+	var keys []UserSSHPublicKey
+	return keys, json.NewDecoder(res.Body).Decode(&keys)
+}
+
+// CreateUserSSHPublicKey adds an SSH public key to the user.
+func (c *Client) CreateUserSSHPublicKey(ctx context.Context, user string, req CreateUserSSHPublicKeyRequest) (UserSSHPublicKey, error) {
+	res, err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/api/v2/users/%s/ssh-public-keys", user), req)
+	if err != nil {
+		return UserSSHPublicKey{}, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return UserSSHPublicKey{}, readBodyAsError(res)
+	}
+
+	var key UserSSHPublicKey
+	return key, json.NewDecoder(res.Body).Decode(&key)
+}
+
+// DeleteUserSSHPublicKey removes an SSH public key from the user.
+func (c *Client) DeleteUserSSHPublicKey(ctx context.Context, user string, id uuid.UUID) error {
+	res, err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/api/v2/users/%s/ssh-public-keys/%s", user, id), nil)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceAgentAuthorizedKeys returns the public keys that authenticate
+// SSH connections to the agent.
+func (c *Client) WorkspaceAgentAuthorizedKeys(ctx context.Context) (WorkspaceAgentAuthorizedKeys, error) {
+	res, err := c.Request(ctx, http.MethodGet, "/api/v2/workspaceagents/me/authorized-keys", nil)
+	if err != nil {
+		return WorkspaceAgentAuthorizedKeys{}, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentAuthorizedKeys{}, readBodyAsError(res)
+	}
+
+	var keys WorkspaceAgentAuthorizedKeys
+	return keys, json.NewDecoder(res.Body).Decode(&keys)
+}
@@ -0,0 +1,63 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// MaxTemplateQuickActions limits the quick actions of a template.
+const MaxTemplateQuickActions = 50
+
+// TemplateAgentSettings are applied to the agents of every workspace of a
+// template. They're sent with the metadata of agents, since the provisioner
+// protocol doesn't carry them.
+type TemplateAgentSettings struct {
+	// DisableDirectConnections relays all connections to agents through
+	// DERP.
+	DisableDirectConnections bool `json:"disable_direct_connections"`
+	// QuickActions are the only commands that clients can run with the
+	// quick actions API of agents.
+	QuickActions []WorkspaceAgentQuickAction `json:"quick_actions"`
+	// FeatureFlags toggle experimental subsystems of agents, so they can
+	// be rolled out to the workspaces of some templates at a time.
+	FeatureFlags map[WorkspaceAgentFeatureFlag]bool `json:"feature_flags"`
+	// ReconnectingPTYTimeoutSeconds is how long reconnecting PTYs are kept
+	// without connections. Zero uses the default of agents.
+	ReconnectingPTYTimeoutSeconds int32 `json:"reconnecting_pty_timeout_seconds"`
+	// LanguageServers are started by agents and shared by the editors
+	// connected to workspaces. Agents start them when they start.
+	LanguageServers []WorkspaceAgentLanguageServer `json:"language_servers"`
+}
+
+// TemplateAgentSettings returns the agent settings of a template.
+func (c *Client) TemplateAgentSettings(ctx context.Context, templateID uuid.UUID) (TemplateAgentSettings, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/templates/%s/agent-settings", templateID), nil)
+	if err != nil {
+		return TemplateAgentSettings{}, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return TemplateAgentSettings{}, readBodyAsError(res)
+	}
+	var settings TemplateAgentSettings
+	return settings, json.NewDecoder(res.Body).Decode(&settings)
+}
+
+// UpdateTemplateAgentSettings replaces the agent settings of a template.
+// Running agents apply them when they fetch their metadata again.
+func (c *Client) UpdateTemplateAgentSettings(ctx context.Context, templateID uuid.UUID, req TemplateAgentSettings) error {
+	res, err := c.Request(ctx, http.MethodPut, fmt.Sprintf("/api/v2/templates/%s/agent-settings", templateID), req)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return readBodyAsError(res)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package codersdk
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// AgentCrashReport is reported by the agent when a component of it
+// panicked. The agent recovers from the panic, and restarts the component
+// if it can.
+// @typescript-ignore AgentCrashReport
+type AgentCrashReport struct {
+	// Component is the part of the agent that panicked, like "run" or
+	// "ssh".
+	Component string `json:"component"`
+	// Panic is the value the component panicked with.
+	Panic string `json:"panic"`
+	Stack string `json:"stack"`
+	// RecentLogs are the last lines the agent logged before the panic.
+	RecentLogs []string  `json:"recent_logs,omitempty"`
+	Version    string    `json:"version"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// PostAgentCrashReport reports a panic of the agent.
+func (c *Client) PostAgentCrashReport(ctx context.Context, req AgentCrashReport) error {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/crash-report", req)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
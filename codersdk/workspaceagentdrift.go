@@ -0,0 +1,136 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// WorkspaceAgentDriftManifest is what the template expects of the running
+// workspace. The agent periodically compares the workspace to it, and
+// reports what differs, so workspaces that were changed by hand can be
+// found.
+// @typescript-ignore WorkspaceAgentDriftManifest
+type WorkspaceAgentDriftManifest struct {
+	// IntervalSeconds is how often the workspace is compared. Zero uses
+	// the default of an hour.
+	IntervalSeconds int32 `json:"interval_seconds,omitempty"`
+	// Tools are compared by the output of a command that prints their
+	// version.
+	Tools []WorkspaceAgentDriftTool `json:"tools,omitempty"`
+	// EnvironmentVariables are compared to the environment of sessions.
+	EnvironmentVariables map[string]string `json:"environment_variables,omitempty"`
+	// Files are compared by their checksum, like dotfiles.
+	Files []WorkspaceAgentDriftFile `json:"files,omitempty"`
+}
+
+// WorkspaceAgentDriftTool is a tool that's expected to be installed.
+// @typescript-ignore WorkspaceAgentDriftTool
+type WorkspaceAgentDriftTool struct {
+	Name string `json:"name"`
+	// Command prints the version of the tool, e.g. "go version". It's run
+	// with the user's shell.
+	Command string `json:"command"`
+	// Version must be in the output of the command. The tool only has to
+	// be installed if it's empty.
+	Version string `json:"version,omitempty"`
+}
+
+// WorkspaceAgentDriftFile is a file that's expected to have a checksum.
+// @typescript-ignore WorkspaceAgentDriftFile
+type WorkspaceAgentDriftFile struct {
+	// Path is relative to the home directory if it starts with "~/".
+	Path string `json:"path"`
+	// SHA256 is the hex-encoded checksum of the contents of the file.
+	SHA256 string `json:"sha256"`
+}
+
+// WorkspaceAgentDriftType is the kind of aspect of a workspace that drifted.
+type WorkspaceAgentDriftType string
+
+const (
+	WorkspaceAgentDriftTypeTool                WorkspaceAgentDriftType = "tool"
+	WorkspaceAgentDriftTypeEnvironmentVariable WorkspaceAgentDriftType = "environment_variable"
+	WorkspaceAgentDriftTypeFile                WorkspaceAgentDriftType = "file"
+)
+
+// MaxWorkspaceAgentDrifts is the number of drifts an agent can report at
+// once.
+const MaxWorkspaceAgentDrifts = 1000
+
+// WorkspaceAgentDrift is an aspect of a workspace that differs from the
+// drift manifest of the template.
+type WorkspaceAgentDrift struct {
+	Type WorkspaceAgentDriftType `json:"type"`
+	// Name is the name of the tool or environment variable, or the path
+	// of the file.
+	Name     string `json:"name"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	// Error is why the actual value couldn't be determined, like a tool
+	// or file that doesn't exist.
+	Error string `json:"error,omitempty"`
+}
+
+// WorkspaceAgentDriftReport is the result of comparing a workspace to the
+// drift manifest of the template.
+type WorkspaceAgentDriftReport struct {
+	// AgentID and WorkspaceID are set by coderd.
+	AgentID     uuid.UUID `json:"agent_id,omitempty" format:"uuid"`
+	WorkspaceID uuid.UUID `json:"workspace_id,omitempty" format:"uuid"`
+	CheckedAt   time.Time `json:"checked_at" format:"date-time"`
+	// Checks is the number of tools, environment variables and files
+	// that were compared.
+	Checks  int                   `json:"checks"`
+	Drifted bool                  `json:"drifted"`
+	Drifts  []WorkspaceAgentDrift `json:"drifts"`
+}
+
+// PostWorkspaceAgentDriftReport sends the result of comparing the workspace
+// to the drift manifest to coderd, which keeps the most recent report.
+func (c *Client) PostWorkspaceAgentDriftReport(ctx context.Context, req WorkspaceAgentDriftReport) error {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/drift", req)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceAgentDriftReport returns the most recent drift report of the
+// workspace agent.
+func (c *Client) WorkspaceAgentDriftReport(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentDriftReport, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/drift", agentID), nil)
+	if err != nil {
+		return WorkspaceAgentDriftReport{}, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentDriftReport{}, readBodyAsError(res)
+	}
+	var report WorkspaceAgentDriftReport
+	return report, json.NewDecoder(res.Body).Decode(&report)
+}
+
+// TemplateDriftReports returns the most recent drift reports of the agents
+// of the workspaces of a template, drifted agents first.
+func (c *Client) TemplateDriftReports(ctx context.Context, templateID uuid.UUID) ([]WorkspaceAgentDriftReport, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/templates/%s/drift", templateID), nil)
+	if err != nil {
+		return nil, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var reports []WorkspaceAgentDriftReport
+	return reports, json.NewDecoder(res.Body).Decode(&reports)
+}
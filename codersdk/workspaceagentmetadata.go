@@ -0,0 +1,68 @@
+package codersdk
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// WorkspaceAgentMetadataVersion is the version of WorkspaceAgentMetadata
+// known to this build. It should be incremented when fields are added, so
+// agents can tell that metadata was sent by a newer coderd.
+const WorkspaceAgentMetadataVersion = 1
+
+// workspaceAgentMetadataFields are the JSON names of the fields of
+// WorkspaceAgentMetadata.
+var workspaceAgentMetadataFields = jsonFieldNames(reflect.TypeOf(WorkspaceAgentMetadata{}))
+
+// jsonFieldNames returns the names of the fields of a struct type in JSON.
+func jsonFieldNames(typ reflect.Type) map[string]struct{} {
+	names := map[string]struct{}{}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// UnknownWorkspaceAgentMetadataFields returns the sorted names of the
+// fields of raw metadata that this build doesn't know.
+func UnknownWorkspaceAgentMetadataFields(raw []byte) ([]string, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(raw, &fields)
+	if err != nil {
+		return nil, err
+	}
+	var unknown []string
+	for name := range fields {
+		if _, ok := workspaceAgentMetadataFields[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// UnsupportedRequiredFields returns the required fields of the metadata
+// that this build doesn't know. Agents must not apply metadata with
+// unsupported required fields.
+func (m WorkspaceAgentMetadata) UnsupportedRequiredFields() []string {
+	var unsupported []string
+	for _, name := range m.RequiredFields {
+		if _, ok := workspaceAgentMetadataFields[name]; !ok {
+			unsupported = append(unsupported, name)
+		}
+	}
+	return unsupported
+}
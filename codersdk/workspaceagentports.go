@@ -0,0 +1,42 @@
+package codersdk
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/xerrors"
+)
+
+// MaxWorkspaceAgentDeclaredPorts is the maximum number of ports that can be
+// declared for an agent.
+const MaxWorkspaceAgentDeclaredPorts = 100
+
+// WorkspaceAgentDeclaredPort is a port that a process in the workspace, like
+// the startup script, declared by writing it to the file at
+// CODER_PORTS_FILE, so it's listed without changing the template.
+// @typescript-ignore WorkspaceAgentDeclaredPort
+type WorkspaceAgentDeclaredPort struct {
+	Port uint16 `json:"port"`
+	Name string `json:"name,omitempty"`
+}
+
+// PostWorkspaceAgentDeclaredPortsRequest replaces the declared ports of the
+// agent.
+// @typescript-ignore PostWorkspaceAgentDeclaredPortsRequest
+type PostWorkspaceAgentDeclaredPortsRequest struct {
+	Ports []WorkspaceAgentDeclaredPort `json:"ports"`
+}
+
+// PostWorkspaceAgentDeclaredPorts replaces the ports that were declared in
+// the workspace of the agent.
+func (c *Client) PostWorkspaceAgentDeclaredPorts(ctx context.Context, req PostWorkspaceAgentDeclaredPortsRequest) error {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/declared-ports", req)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"net/netip"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
@@ -119,8 +120,134 @@ type PostWorkspaceAgentVersionRequest struct {
 	Version string `json:"version"`
 }
 
+// WorkspaceAgentProtocolVersion is the version of the protocol spoken
+// between the workspace agent and coderd. It should only be incremented
+// for changes that can't be negotiated with a capability.
+const WorkspaceAgentProtocolVersion = 1
+
+// WorkspaceAgentCapability is an optional feature that the workspace
+// agent and coderd agree on when the agent connects.
+type WorkspaceAgentCapability string
+
+const (
+	// WorkspaceAgentCapabilityStatsReport indicates that stats are
+	// reported with POST requests rather than over a WebSocket.
+	WorkspaceAgentCapabilityStatsReport WorkspaceAgentCapability = "stats-report"
+	// WorkspaceAgentCapabilityAppHealth indicates that app health is
+	// reported by the agent.
+	WorkspaceAgentCapabilityAppHealth WorkspaceAgentCapability = "app-health"
+	// WorkspaceAgentCapabilityListeningPorts indicates that the agent
+	// serves listening ports on the statistics server.
+	WorkspaceAgentCapabilityListeningPorts WorkspaceAgentCapability = "listening-ports"
+	// WorkspaceAgentCapabilityStartupLogs indicates that coderd accepts
+	// the output of the startup script streamed by the agent.
+	WorkspaceAgentCapabilityStartupLogs WorkspaceAgentCapability = "startup-logs"
+	// WorkspaceAgentCapabilityBootTiming indicates that coderd accepts the
+	// timing of the phases of starting the agent.
+	WorkspaceAgentCapabilityBootTiming WorkspaceAgentCapability = "boot-timing"
+	// WorkspaceAgentCapabilityConnectionEvents indicates that coderd
+	// accepts the connection events that the agent records.
+	WorkspaceAgentCapabilityConnectionEvents WorkspaceAgentCapability = "connection-events"
+	// WorkspaceAgentCapabilityDrift indicates that coderd accepts the
+	// reports of comparing the workspace to the drift manifest.
+	WorkspaceAgentCapabilityDrift WorkspaceAgentCapability = "drift"
+	// WorkspaceAgentCapabilityDeclaredPorts indicates that coderd accepts
+	// the ports that processes in the workspace declare.
+	WorkspaceAgentCapabilityDeclaredPorts WorkspaceAgentCapability = "declared-ports"
+	// WorkspaceAgentCapabilityStartupScriptResult indicates that coderd
+	// accepts how the startup script ended.
+	WorkspaceAgentCapabilityStartupScriptResult WorkspaceAgentCapability = "startup-script-result"
+	// WorkspaceAgentCapabilityCrashReport indicates that coderd accepts
+	// the panics that the agent recovered from.
+	WorkspaceAgentCapabilityCrashReport WorkspaceAgentCapability = "crash-report"
+	// WorkspaceAgentCapabilityMetadataWatch indicates that coderd notifies
+	// agents when their metadata changes.
+	WorkspaceAgentCapabilityMetadataWatch WorkspaceAgentCapability = "metadata-watch"
+)
+
+// WorkspaceAgentCapabilities are the capabilities supported by this
+// build of the agent and coderd.
+var WorkspaceAgentCapabilities = []WorkspaceAgentCapability{
+	WorkspaceAgentCapabilityStatsReport,
+	WorkspaceAgentCapabilityAppHealth,
+	WorkspaceAgentCapabilityListeningPorts,
+	WorkspaceAgentCapabilityStartupLogs,
+	WorkspaceAgentCapabilityBootTiming,
+	WorkspaceAgentCapabilityConnectionEvents,
+	WorkspaceAgentCapabilityDrift,
+	WorkspaceAgentCapabilityDeclaredPorts,
+	WorkspaceAgentCapabilityStartupScriptResult,
+	WorkspaceAgentCapabilityCrashReport,
+	WorkspaceAgentCapabilityMetadataWatch,
+}
+
+// WorkspaceAgentHandshakeRequest is sent by the agent when it connects
+// to advertise the protocol version and capabilities it supports.
+// @typescript-ignore WorkspaceAgentHandshakeRequest
+type WorkspaceAgentHandshakeRequest struct {
+	Version         string                     `json:"version"`
+	ProtocolVersion int                        `json:"protocol_version"`
+	Capabilities    []WorkspaceAgentCapability `json:"capabilities"`
+	// IdentityKey is the Ed25519 public key the agent signs nonces with,
+	// so clients can verify they're connected to this agent.
+	IdentityKey []byte `json:"identity_key,omitempty"`
+}
+
+// WorkspaceAgentHandshakeResponse contains the protocol version and
+// capabilities that both the agent and coderd support.
+// @typescript-ignore WorkspaceAgentHandshakeResponse
+type WorkspaceAgentHandshakeResponse struct {
+	ProtocolVersion int                        `json:"protocol_version"`
+	Capabilities    []WorkspaceAgentCapability `json:"capabilities"`
+}
+
+// Has returns whether the capability was negotiated.
+func (r WorkspaceAgentHandshakeResponse) Has(capability WorkspaceAgentCapability) bool {
+	for _, c := range r.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateWorkspaceAgentHandshake returns the highest protocol version and
+// the capabilities supported by both sides of the handshake.
+func NegotiateWorkspaceAgentHandshake(req WorkspaceAgentHandshakeRequest, protocolVersion int, capabilities []WorkspaceAgentCapability) WorkspaceAgentHandshakeResponse {
+	resp := WorkspaceAgentHandshakeResponse{
+		ProtocolVersion: protocolVersion,
+		Capabilities:    []WorkspaceAgentCapability{},
+	}
+	if req.ProtocolVersion < resp.ProtocolVersion {
+		resp.ProtocolVersion = req.ProtocolVersion
+	}
+	supported := make(map[WorkspaceAgentCapability]struct{}, len(capabilities))
+	for _, c := range capabilities {
+		supported[c] = struct{}{}
+	}
+	for _, c := range req.Capabilities {
+		if _, ok := supported[c]; !ok {
+			continue
+		}
+		// Prevent duplicates from being returned.
+		delete(supported, c)
+		resp.Capabilities = append(resp.Capabilities, c)
+	}
+	return resp
+}
+
 // @typescript-ignore WorkspaceAgentMetadata
 type WorkspaceAgentMetadata struct {
+	// Version is the WorkspaceAgentMetadataVersion of coderd. Metadata
+	// without a version was sent by a coderd that predates versioning.
+	Version int `json:"version,omitempty"`
+	// RequiredFields are fields that agents must know to apply the
+	// metadata, like restrictions that would be ignored otherwise. Agents
+	// reject metadata with required fields they don't know.
+	RequiredFields []string `json:"required_fields,omitempty"`
+	// UnknownFields are the fields of the metadata that this build doesn't
+	// know. They're set when the metadata is fetched, and are ignored.
+	UnknownFields []string `json:"-"`
 	// GitAuthConfigs stores the number of Git configurations
 	// the Coder deployment has. If this number is >0, we
 	// set up special configuration in the workspace.
@@ -129,9 +256,354 @@ type WorkspaceAgentMetadata struct {
 	Apps                 []WorkspaceApp    `json:"apps"`
 	DERPMap              *tailcfg.DERPMap  `json:"derpmap"`
 	EnvironmentVariables map[string]string `json:"environment_variables"`
-	StartupScript        string            `json:"startup_script"`
-	Directory            string            `json:"directory"`
-	MOTDFile             string            `json:"motd_file"`
+	// PersonalEnvironmentVariables are set by the owner of the workspace
+	// through coderd, and override EnvironmentVariables in sessions.
+	PersonalEnvironmentVariables map[string]string `json:"personal_environment_variables,omitempty"`
+	StartupScript                string            `json:"startup_script"`
+	Directory                    string            `json:"directory"`
+	MOTDFile                     string            `json:"motd_file"`
+	// MOTDSources are shown after the MOTD file at login, so notices
+	// can be managed centrally.
+	MOTDSources []WorkspaceAgentMOTDSource `json:"motd_sources,omitempty"`
+	// EmbeddedDERP runs a DERP server inside the agent when set.
+	EmbeddedDERP *WorkspaceAgentEmbeddedDERP `json:"embedded_derp,omitempty"`
+	// KeepAliveIntervalSeconds overrides the WireGuard persistent
+	// keepalive interval for active peers. Zero uses the default.
+	KeepAliveIntervalSeconds int32 `json:"keepalive_interval_seconds"`
+	// DisableKeepAlive disables WireGuard persistent keepalives.
+	DisableKeepAlive bool `json:"disable_keepalive"`
+	// DisableDirectConnections stops the agent from advertising its P2P
+	// endpoints and using the endpoints of peers, so all traffic is
+	// relayed through DERP, like for organizations that audit relays.
+	DisableDirectConnections bool `json:"disable_direct_connections,omitempty"`
+	// ReconnectingPTYTimeoutSeconds overrides how long reconnecting PTYs
+	// are kept without connections. Zero uses the default of the agent.
+	// Changes apply to existing PTYs when the agent fetches metadata.
+	ReconnectingPTYTimeoutSeconds int32 `json:"reconnecting_pty_timeout_seconds"`
+	// ReconnectingPTYBufferSize overrides the size of the scrollback of
+	// new reconnecting PTYs in bytes. Zero uses the default of the agent.
+	ReconnectingPTYBufferSize int64 `json:"reconnecting_pty_buffer_size,omitempty"`
+	// Hostname is the suggested hostname of the workspace, in the
+	// form "<workspace>-<agent>".
+	Hostname string `json:"hostname"`
+	// ForcePTYCommands are patterns of programs that are always run with
+	// a PTY over SSH, even when the client doesn't request one. Patterns
+	// are matched against the name of the program with path.Match.
+	ForcePTYCommands []string `json:"force_pty_commands,omitempty"`
+	// SessionRecording records PTY sessions to transcripts when set.
+	SessionRecording *WorkspaceAgentSessionRecording `json:"session_recording,omitempty"`
+	// LanguageServers are started with the agent and kept warm, so every
+	// editor connected to the workspace shares one indexed instance.
+	LanguageServers []WorkspaceAgentLanguageServer `json:"language_servers,omitempty"`
+	// QuickActions are the only commands that clients can run with the
+	// quick actions API of the agent.
+	QuickActions []WorkspaceAgentQuickAction `json:"quick_actions,omitempty"`
+	// DriftManifest is compared to the workspace periodically, and the
+	// differences are reported to coderd.
+	DriftManifest *WorkspaceAgentDriftManifest `json:"drift_manifest,omitempty"`
+	// ShellHistory syncs the history of shells to object storage when set,
+	// so it's kept across ephemeral workspaces.
+	ShellHistory *WorkspaceAgentShellHistory `json:"shell_history,omitempty"`
+	// RequiredMounts delays the startup script until paths are mounted
+	// and writable, since persistent volumes may attach after the agent
+	// starts.
+	RequiredMounts *WorkspaceAgentRequiredMounts `json:"required_mounts,omitempty"`
+	// StartupScriptPolicy bounds the startup script with a timeout and
+	// retries, and decides whether sessions wait for it.
+	StartupScriptPolicy *WorkspaceAgentStartupScriptPolicy `json:"startup_script_policy,omitempty"`
+	// ReversePortForwarding restricts the addresses bound by reverse
+	// port forwards. Every address is allowed if unset.
+	ReversePortForwarding *WorkspaceAgentReversePortForwarding `json:"reverse_port_forwarding,omitempty"`
+	// SFTP restricts SFTP sessions. Every request is allowed if unset.
+	SFTP *WorkspaceAgentSFTP `json:"sftp,omitempty"`
+	// SSHUserCertificateAuthority requires SSH connections to authenticate
+	// with a user certificate issued by coderd when set. Otherwise, SSH
+	// connections are only authenticated by the tailnet.
+	SSHUserCertificateAuthority *WorkspaceAgentSSHUserCertificateAuthority `json:"ssh_user_certificate_authority,omitempty"`
+	// SSHPublicKeyAuth requires SSH connections to authenticate with one
+	// of the public keys of the owner of the workspace, which the agent
+	// fetches from coderd.
+	SSHPublicKeyAuth bool `json:"ssh_public_key_auth,omitempty"`
+	// SSHAcceptEnv restricts the environment variables that SSH clients
+	// can set, like AcceptEnv of OpenSSH. Every variable is accepted if
+	// unset.
+	SSHAcceptEnv *WorkspaceAgentSSHAcceptEnv `json:"ssh_accept_env,omitempty"`
+	// ExperimentalQUIC listens for QUIC connections on the tailnet, which
+	// clients can use for reconnecting PTY and port forward traffic.
+	ExperimentalQUIC bool `json:"experimental_quic,omitempty"`
+	// FeatureFlags toggle experimental subsystems of the agent, so they
+	// can be rolled out to some workspaces at a time. Flags that aren't
+	// set use the default of the agent, and flags the agent doesn't
+	// support are ignored.
+	FeatureFlags map[WorkspaceAgentFeatureFlag]bool `json:"feature_flags,omitempty"`
+	// TelemetryEnabled reports anonymized counts of feature usage with
+	// the stats of the agent. It follows the telemetry setting of the
+	// deployment.
+	TelemetryEnabled bool `json:"telemetry_enabled,omitempty"`
+	// ReconnectMaxIntervalSeconds caps the backoff between attempts of
+	// the agent to connect to coderd. Zero uses the default of the agent.
+	ReconnectMaxIntervalSeconds int32 `json:"reconnect_max_interval_seconds,omitempty"`
+	// EditorIntegration replaces the environment variables that
+	// integrate sessions with code-server. They're set if unset.
+	EditorIntegration *WorkspaceAgentEditorIntegration `json:"editor_integration,omitempty"`
+	// AppConnectionLimits limit the connections to apps served on the
+	// loopback address of the workspace, keyed by the slug of the app.
+	AppConnectionLimits map[string]WorkspaceAgentAppConnectionLimit `json:"app_connection_limits,omitempty"`
+}
+
+// WorkspaceAgentFeatureFlag is an experimental subsystem of the agent.
+type WorkspaceAgentFeatureFlag string
+
+const (
+	// WorkspaceAgentFeatureQUIC overrides ExperimentalQUIC.
+	WorkspaceAgentFeatureQUIC WorkspaceAgentFeatureFlag = "quic"
+	// WorkspaceAgentFeaturePTYv2 serves reconnecting PTYs over WebSockets,
+	// the second protocol of reconnecting PTYs. It's enabled by default.
+	WorkspaceAgentFeaturePTYv2 WorkspaceAgentFeatureFlag = "pty_v2"
+	// WorkspaceAgentFeatureScreenSnapshotReconnect replays only the output
+	// since the screen was last cleared to terminals that reconnect with
+	// another size. It's enabled by default.
+	WorkspaceAgentFeatureScreenSnapshotReconnect WorkspaceAgentFeatureFlag = "screen_snapshot_reconnect"
+)
+
+// WorkspaceAgentFeatureFlags are the feature flags supported by this
+// version of the agent.
+var WorkspaceAgentFeatureFlags = []WorkspaceAgentFeatureFlag{
+	WorkspaceAgentFeatureQUIC,
+	WorkspaceAgentFeaturePTYv2,
+	WorkspaceAgentFeatureScreenSnapshotReconnect,
+}
+
+// FeatureEnabled evaluates the feature flag, returning fallback if it isn't
+// set.
+func (m WorkspaceAgentMetadata) FeatureEnabled(flag WorkspaceAgentFeatureFlag, fallback bool) bool {
+	enabled, ok := m.FeatureFlags[flag]
+	if !ok {
+		return fallback
+	}
+	return enabled
+}
+
+// WorkspaceAgentSSHUserCertificateAuthority is the SSH certificate authority
+// that signs user certificates for the workspace agent.
+// @typescript-ignore WorkspaceAgentSSHUserCertificateAuthority
+type WorkspaceAgentSSHUserCertificateAuthority struct {
+	// PublicKey is the public key of the certificate authority in the
+	// authorized_keys format.
+	PublicKey string `json:"public_key"`
+	// Principal must be one of the principals of a certificate. It's the
+	// ID of the workspace agent, so certificates can't be used for other
+	// workspaces.
+	Principal string `json:"principal"`
+}
+
+// WorkspaceAgentReversePortForwarding is the policy for reverse port
+// forwards ("ssh -R"), which bind ports in the workspace.
+// @typescript-ignore WorkspaceAgentReversePortForwarding
+type WorkspaceAgentReversePortForwarding struct {
+	// Disabled denies every reverse port forward.
+	Disabled bool `json:"disabled"`
+	// LoopbackOnly only allows binding loopback addresses. Binds to
+	// the wildcard address are bound to the loopback address instead,
+	// like sshd with GatewayPorts disabled.
+	LoopbackOnly bool `json:"loopback_only"`
+	// AllowedPorts are the ranges of ports that can be bound. Every
+	// port is allowed if empty. Dynamically allocated ports are denied
+	// when ranges are set, since the port can't be known in advance.
+	AllowedPorts []WorkspaceAgentPortRange `json:"allowed_ports,omitempty"`
+}
+
+// WorkspaceAgentSFTP is the policy for SFTP sessions, so templates can
+// expose file browsing without allowing writes anywhere in the workspace.
+// @typescript-ignore WorkspaceAgentSFTP
+type WorkspaceAgentSFTP struct {
+	// ReadOnly denies every request that writes, like uploads, removals
+	// and renames.
+	ReadOnly bool `json:"read_only"`
+	// AllowedPaths are the directories that can be accessed with their
+	// contents. Every path is allowed if empty. Paths starting with ~/
+	// are relative to the home directory, and symbolic links are
+	// resolved before paths are checked.
+	AllowedPaths []string `json:"allowed_paths,omitempty"`
+}
+
+// WorkspaceAgentSSHAcceptEnv is the allowlist of environment variables
+// that clients can send with SSH sessions and exec requests.
+// @typescript-ignore WorkspaceAgentSSHAcceptEnv
+type WorkspaceAgentSSHAcceptEnv struct {
+	// Patterns are matched against the names of variables with
+	// path.Match, e.g. "LC_*". No variables are accepted if empty.
+	Patterns []string `json:"patterns"`
+}
+
+// WorkspaceAgentEditorIntegration configures the environment variables that
+// editors served from the workspace read in sessions, like the URI that
+// proxies ports.
+// @typescript-ignore WorkspaceAgentEditorIntegration
+type WorkspaceAgentEditorIntegration struct {
+	// DisableCodeServer stops the agent from setting VSCODE_PROXY_URI and
+	// CS_DISABLE_GETTING_STARTED_OVERRIDE for code-server.
+	DisableCodeServer bool `json:"disable_code_server,omitempty"`
+	// Editors contribute environment variables to sessions.
+	Editors []WorkspaceAgentEditor `json:"editors,omitempty"`
+}
+
+// WorkspaceAgentEditor is an editor, like openvscode-server or Theia, and
+// the environment variables it reads.
+// @typescript-ignore WorkspaceAgentEditor
+type WorkspaceAgentEditor struct {
+	Name string `json:"name"`
+	// EnvironmentVariables are expanded like the environment variables
+	// of the metadata, and $CODER_PORT_PROXY_URI is the URI that proxies
+	// ports of the workspace, e.g.
+	// "https://{{port}}--main--dev--alice.coder.com".
+	EnvironmentVariables map[string]string `json:"environment_variables"`
+}
+
+// WorkspaceAgentAppConnectionLimit protects an app from more connections
+// than it can handle, like from dashboards that poll it.
+// @typescript-ignore WorkspaceAgentAppConnectionLimit
+type WorkspaceAgentAppConnectionLimit struct {
+	// MaxConnections is how many connections to the app are open at once.
+	// More connections are refused, with a 503 for HTTP apps. It's
+	// unlimited if zero.
+	MaxConnections int32 `json:"max_connections,omitempty"`
+	// IdleTimeoutSeconds closes connections to the app that didn't send or
+	// receive data for the duration. They're kept open if it's zero.
+	IdleTimeoutSeconds int32 `json:"idle_timeout_seconds,omitempty"`
+}
+
+// WorkspaceAgentPortRange is an inclusive range of ports.
+// @typescript-ignore WorkspaceAgentPortRange
+type WorkspaceAgentPortRange struct {
+	Start uint16 `json:"start"`
+	End   uint16 `json:"end"`
+}
+
+// Contains returns whether the port is in the range.
+func (r WorkspaceAgentPortRange) Contains(port uint16) bool {
+	return port >= r.Start && port <= r.End
+}
+
+// WorkspaceAgentLanguageServer is a language server kept warm by the agent.
+type WorkspaceAgentLanguageServer struct {
+	// Name identifies the language server to clients, e.g. "gopls".
+	Name string `json:"name"`
+	// Command starts the language server speaking LSP over stdio,
+	// e.g. "gopls serve". It's run with the user's shell.
+	Command string `json:"command"`
+	// Directory is the root of the workspace indexed by the language
+	// server. The agent directory is used if empty.
+	Directory string `json:"directory,omitempty"`
+}
+
+// WorkspaceAgentQuickAction is a command that clients can run in the
+// workspace by its name, like restarting a dev server, without being able
+// to run other commands.
+type WorkspaceAgentQuickAction struct {
+	// Name identifies the action to clients, e.g. "restart-dev-server".
+	Name string `json:"name"`
+	// DisplayName is shown in the dashboard. The name is shown if empty.
+	DisplayName string `json:"display_name,omitempty"`
+	// Command is run with the user's shell.
+	Command string `json:"command"`
+	// Directory is where the command runs. The agent directory is used
+	// if empty.
+	Directory string `json:"directory,omitempty"`
+	// TimeoutSeconds is how long the command can run before it's killed.
+	// Zero uses the default of 10 minutes.
+	TimeoutSeconds int32 `json:"timeout_seconds,omitempty"`
+}
+
+// WorkspaceAgentMOTDSource is a source of the message of the day, which is
+// either a URL or a command. Zero values use the defaults.
+// @typescript-ignore WorkspaceAgentMOTDSource
+type WorkspaceAgentMOTDSource struct {
+	// URL is fetched with a GET request, and the body is shown.
+	URL string `json:"url,omitempty"`
+	// Command is run with the user's shell, and its output is shown.
+	Command string `json:"command,omitempty"`
+	// CacheSeconds is how long the MOTD is shown before it's fetched
+	// again. The previous MOTD is shown if fetching fails.
+	CacheSeconds int32 `json:"cache_seconds,omitempty"`
+	// TimeoutSeconds limits how long fetching the MOTD delays logins.
+	TimeoutSeconds int32 `json:"timeout_seconds,omitempty"`
+}
+
+// WorkspaceAgentShellHistory configures syncing the history of bash, zsh and
+// fish. History is restored when the agent starts, unless the workspace
+// already has history.
+// @typescript-ignore WorkspaceAgentShellHistory
+type WorkspaceAgentShellHistory struct {
+	// URL is the location the history files are stored under. Each file
+	// is uploaded with a PUT request to "<url>/<shell>_history", and
+	// downloaded with a GET request.
+	URL string `json:"url"`
+	// Headers are sent with every request, e.g. for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+	// IntervalSeconds is how often changed history is uploaded.
+	IntervalSeconds int32 `json:"interval_seconds,omitempty"`
+}
+
+// WorkspaceAgentRequiredMounts are paths that must be mounted and writable
+// before the startup script runs. Where mounts can't be listed, paths only
+// have to be writable.
+// @typescript-ignore WorkspaceAgentRequiredMounts
+type WorkspaceAgentRequiredMounts struct {
+	Paths []string `json:"paths"`
+	// TimeoutSeconds limits waiting for the paths, after which the
+	// startup script fails without running. It defaults to 5 minutes.
+	TimeoutSeconds int32 `json:"timeout_seconds,omitempty"`
+}
+
+// WorkspaceAgentSessionRecording configures the recording of PTY sessions
+// to transcripts in asciicast format. Zero values use the defaults.
+// @typescript-ignore WorkspaceAgentSessionRecording
+type WorkspaceAgentSessionRecording struct {
+	// MaxTranscriptBytes caps the size of a single transcript. Output
+	// past the cap is not recorded.
+	MaxTranscriptBytes int64 `json:"max_transcript_bytes"`
+	// MaxTranscripts is the number of transcripts that are retained.
+	// The oldest transcripts are removed first.
+	MaxTranscripts int `json:"max_transcripts"`
+	// RetentionSeconds is how long transcripts are retained for.
+	RetentionSeconds int64 `json:"retention_seconds"`
+}
+
+// WorkspaceAgentHostname returns a valid hostname in the form
+// "<workspace>-<agent>". Invalid characters are replaced with hyphens
+// and the result is truncated to the maximum DNS label length.
+func WorkspaceAgentHostname(workspaceName, agentName string) string {
+	raw := strings.ToLower(workspaceName + "-" + agentName)
+	hostname := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			hostname = append(hostname, c)
+			continue
+		}
+		hostname = append(hostname, '-')
+	}
+	if len(hostname) > 63 {
+		hostname = hostname[:63]
+	}
+	return strings.Trim(string(hostname), "-")
+}
+
+// WorkspaceAgentEmbeddedDERP configures a DERP server that runs inside
+// the workspace agent. This allows air-gapped deployments without access
+// to a public DERP map to relay connections. The same region must be
+// present in the DERP map served to clients.
+// @typescript-ignore WorkspaceAgentEmbeddedDERP
+type WorkspaceAgentEmbeddedDERP struct {
+	// ListenAddress is the address the DERP server listens on,
+	// e.g. ":3478".
+	ListenAddress string `json:"listen_address"`
+	// HostName is the address clients use to reach the DERP server.
+	HostName   string `json:"hostname"`
+	RegionID   int    `json:"region_id"`
+	RegionCode string `json:"region_code"`
+	RegionName string `json:"region_name"`
 }
 
 // AuthWorkspaceGoogleInstanceIdentity uses the Google Compute Engine Metadata API to
@@ -266,16 +738,24 @@ func (c *Client) AuthWorkspaceAzureInstanceIdentity(ctx context.Context) (Worksp
 func (c *Client) WorkspaceAgentMetadata(ctx context.Context) (WorkspaceAgentMetadata, error) {
 	res, err := c.Request(ctx, http.MethodGet, "/api/v2/workspaceagents/me/metadata", nil)
 	if err != nil {
-		return WorkspaceAgentMetadata{}, err
+		return WorkspaceAgentMetadata{}, workspaceAgentRequestError(WorkspaceAgentErrorMetadataFetchFailed, err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return WorkspaceAgentMetadata{}, readBodyAsError(res)
+		return WorkspaceAgentMetadata{}, workspaceAgentRequestError(WorkspaceAgentErrorMetadataFetchFailed, readBodyAsError(res))
+	}
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return WorkspaceAgentMetadata{}, workspaceAgentRequestError(WorkspaceAgentErrorMetadataFetchFailed, err)
 	}
 	var agentMetadata WorkspaceAgentMetadata
-	err = json.NewDecoder(res.Body).Decode(&agentMetadata)
+	err = json.Unmarshal(raw, &agentMetadata)
 	if err != nil {
-		return WorkspaceAgentMetadata{}, err
+		return WorkspaceAgentMetadata{}, NewWorkspaceAgentError(WorkspaceAgentErrorMetadataFetchFailed, err)
+	}
+	agentMetadata.UnknownFields, err = UnknownWorkspaceAgentMetadataFields(raw)
+	if err != nil {
+		return WorkspaceAgentMetadata{}, NewWorkspaceAgentError(WorkspaceAgentErrorMetadataFetchFailed, err)
 	}
 	accessingPort := c.URL.Port()
 	if accessingPort == "" {
@@ -334,9 +814,9 @@ func (c *Client) ListenWorkspaceAgent(ctx context.Context) (net.Conn, error) {
 	})
 	if err != nil {
 		if res == nil {
-			return nil, err
+			return nil, NewWorkspaceAgentError(WorkspaceAgentErrorCoordinatorFailed, err)
 		}
-		return nil, readBodyAsError(res)
+		return nil, workspaceAgentRequestError(WorkspaceAgentErrorCoordinatorFailed, readBodyAsError(res))
 	}
 
 	return websocket.NetConn(ctx, conn, websocket.MessageBinary), nil
@@ -347,6 +827,9 @@ type DialWorkspaceAgentOptions struct {
 	Logger slog.Logger
 	// BlockEndpoints forced a direct connection through DERP.
 	BlockEndpoints bool
+	// ExperimentalQUIC sends reconnecting PTY and TCP port forward
+	// traffic over QUIC when the agent offers it.
+	ExperimentalQUIC bool
 }
 
 func (c *Client) DialWorkspaceAgent(ctx context.Context, agentID uuid.UUID, options *DialWorkspaceAgentOptions) (*AgentConn, error) {
@@ -454,6 +937,7 @@ func (c *Client) DialWorkspaceAgent(ctx context.Context, agentID uuid.UUID, opti
 			cancelFunc()
 			<-closed
 		},
+		ExperimentalQUIC: options.ExperimentalQUIC,
 	}, nil
 }
 
@@ -498,6 +982,21 @@ func (c *Client) PostWorkspaceAgentVersion(ctx context.Context, version string)
 	return nil
 }
 
+// PostWorkspaceAgentHandshake negotiates the protocol version and
+// capabilities used between the agent and coderd.
+func (c *Client) PostWorkspaceAgentHandshake(ctx context.Context, req WorkspaceAgentHandshakeRequest) (WorkspaceAgentHandshakeResponse, error) {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/handshake", req)
+	if err != nil {
+		return WorkspaceAgentHandshakeResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentHandshakeResponse{}, readBodyAsError(res)
+	}
+	var resp WorkspaceAgentHandshakeResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
 // WorkspaceAgentReconnectingPTY spawns a PTY that reconnects using the token provided.
 // It communicates using `agent.ReconnectingPTYRequest` marshaled as JSON.
 // Responses are PTY output that can be rendered.
@@ -551,6 +1050,426 @@ func (c *Client) WorkspaceAgentListeningPorts(ctx context.Context, agentID uuid.
 	return listeningPorts, json.NewDecoder(res.Body).Decode(&listeningPorts)
 }
 
+// WorkspaceAgentSSHHostKeys returns the SSH host keys of the workspace agent
+// in known_hosts format for the host pattern provided.
+func (c *Client) WorkspaceAgentSSHHostKeys(ctx context.Context, agentID uuid.UUID, host string) (SSHHostKeysResponse, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/ssh-host-keys?host=%s", agentID, url.QueryEscape(host)), nil)
+	if err != nil {
+		return SSHHostKeysResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return SSHHostKeysResponse{}, readBodyAsError(res)
+	}
+	var hostKeys SSHHostKeysResponse
+	return hostKeys, json.NewDecoder(res.Body).Decode(&hostKeys)
+}
+
+// WorkspaceAgentIdentityKeyResponse contains the identity key that the
+// agent registered with its handshake.
+// @typescript-ignore WorkspaceAgentIdentityKeyResponse
+type WorkspaceAgentIdentityKeyResponse struct {
+	PublicKey []byte `json:"public_key"`
+}
+
+// WorkspaceAgentIdentityKey returns the identity key of the workspace agent,
+// which AgentConn.VerifyIdentity checks the agent holds.
+func (c *Client) WorkspaceAgentIdentityKey(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentIdentityKeyResponse, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/identity-key", agentID), nil)
+	if err != nil {
+		return WorkspaceAgentIdentityKeyResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentIdentityKeyResponse{}, readBodyAsError(res)
+	}
+	var key WorkspaceAgentIdentityKeyResponse
+	return key, json.NewDecoder(res.Body).Decode(&key)
+}
+
+// StartupLog is a line of output of the startup script.
+type StartupLog struct {
+	CreatedAt time.Time `json:"created_at"`
+	Output    string    `json:"output"`
+}
+
+// PatchStartupLogs appends lines of output of the startup script.
+type PatchStartupLogs struct {
+	Logs []StartupLog `json:"logs"`
+}
+
+// WorkspaceAgentStartupLog is a line of output of the startup script that
+// coderd received from the agent. IDs increase, so clients can ask for the
+// lines after the last one they received.
+type WorkspaceAgentStartupLog struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Output    string    `json:"output"`
+}
+
+// PatchStartupLogs streams output of the startup script to coderd, so it
+// can be watched while the workspace starts.
+func (c *Client) PatchStartupLogs(ctx context.Context, req PatchStartupLogs) error {
+	res, err := c.Request(ctx, http.MethodPatch, "/api/v2/workspaceagents/me/startup-logs", req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceAgentStartupLogs returns the lines of output of the startup
+// script with an ID greater than after.
+func (c *Client) WorkspaceAgentStartupLogs(ctx context.Context, agentID uuid.UUID, after int64) ([]WorkspaceAgentStartupLog, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/startup-logs?after=%d", agentID, after), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var logs []WorkspaceAgentStartupLog
+	return logs, json.NewDecoder(res.Body).Decode(&logs)
+}
+
+// WorkspaceAgentBootTiming is how long the phases of starting the agent
+// took, for optimizing the start latency of workspaces. Phases are
+// measured the first time they complete, and are omitted until then.
+type WorkspaceAgentBootTiming struct {
+	// StartedAt is when the agent process started.
+	StartedAt                  time.Time `json:"started_at"`
+	TokenExchangeMillis        *int64    `json:"token_exchange_ms,omitempty"`
+	MetadataFetchMillis        *int64    `json:"metadata_fetch_ms,omitempty"`
+	TailnetUpMillis            *int64    `json:"tailnet_up_ms,omitempty"`
+	CoordinatorConnectedMillis *int64    `json:"coordinator_connected_ms,omitempty"`
+	StartupScriptMillis        *int64    `json:"startup_script_ms,omitempty"`
+	// FirstSessionMillis is the time from the start of the agent until
+	// the first SSH session or reconnecting PTY.
+	FirstSessionMillis *int64 `json:"first_session_ms,omitempty"`
+}
+
+// PostWorkspaceAgentBootTiming reports the timing of the phases of
+// starting the agent to coderd. The agent reports the whole timing every
+// time a phase completes.
+func (c *Client) PostWorkspaceAgentBootTiming(ctx context.Context, req WorkspaceAgentBootTiming) error {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/boot-timing", req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceAgentBootTiming returns the timing of the phases of starting
+// the workspace agent that it reported.
+func (c *Client) WorkspaceAgentBootTiming(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentBootTiming, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/boot-timing", agentID), nil)
+	if err != nil {
+		return WorkspaceAgentBootTiming{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentBootTiming{}, readBodyAsError(res)
+	}
+	var timing WorkspaceAgentBootTiming
+	return timing, json.NewDecoder(res.Body).Decode(&timing)
+}
+
+// WorkspaceAgentTunnelAuth is how requests to the public URL of a tunnel
+// are authenticated.
+type WorkspaceAgentTunnelAuth string
+
+const (
+	// WorkspaceAgentTunnelAuthPublic allows anyone with the URL of the
+	// tunnel to send requests.
+	WorkspaceAgentTunnelAuthPublic WorkspaceAgentTunnelAuth = "public"
+	// WorkspaceAgentTunnelAuthToken requires the token of the tunnel in the
+	// WorkspaceAgentTunnelTokenHeader header or the
+	// WorkspaceAgentTunnelTokenQueryParam query parameter.
+	WorkspaceAgentTunnelAuthToken WorkspaceAgentTunnelAuth = "token"
+)
+
+const (
+	// WorkspaceAgentTunnelTokenHeader authenticates requests to tunnels with
+	// token auth.
+	WorkspaceAgentTunnelTokenHeader = "Coder-Tunnel-Token"
+	// WorkspaceAgentTunnelTokenQueryParam authenticates requests to tunnels
+	// with token auth, for senders of webhooks that only allow configuring
+	// a URL.
+	WorkspaceAgentTunnelTokenQueryParam = "coder_tunnel_token"
+)
+
+// CreateWorkspaceAgentTunnelRequest requests a public URL that forwards to
+// a port in the workspace.
+// @typescript-ignore CreateWorkspaceAgentTunnelRequest
+type CreateWorkspaceAgentTunnelRequest struct {
+	Port uint16 `json:"port"`
+	// TTLSeconds is how long the tunnel is open. Zero uses the default of
+	// coderd.
+	TTLSeconds int64                    `json:"ttl_seconds,omitempty"`
+	Auth       WorkspaceAgentTunnelAuth `json:"auth"`
+}
+
+// WorkspaceAgentTunnel is an ephemeral public URL that forwards HTTP
+// requests to a port in the workspace through coderd, e.g. for testing
+// webhooks.
+type WorkspaceAgentTunnel struct {
+	ID        string                   `json:"id"`
+	AgentID   uuid.UUID                `json:"agent_id"`
+	Port      uint16                   `json:"port"`
+	URL       string                   `json:"url"`
+	Auth      WorkspaceAgentTunnelAuth `json:"auth"`
+	CreatedAt time.Time                `json:"created_at"`
+	ExpiresAt time.Time                `json:"expires_at"`
+	// Token is only returned when the tunnel is created.
+	Token string `json:"token,omitempty"`
+	// Traffic is what the replica of coderd that returned the tunnel
+	// proxied through it.
+	Traffic WorkspaceAgentTunnelTraffic `json:"traffic"`
+}
+
+// WorkspaceAgentTunnelTraffic accounts for the requests proxied through a
+// tunnel.
+type WorkspaceAgentTunnelTraffic struct {
+	Requests int64 `json:"requests"`
+	// Rejected is the number of requests that failed to authenticate.
+	Rejected      int64      `json:"rejected"`
+	BytesReceived int64      `json:"bytes_received"`
+	BytesSent     int64      `json:"bytes_sent"`
+	LastRequestAt *time.Time `json:"last_request_at,omitempty"`
+}
+
+// PostWorkspaceAgentTunnel opens a tunnel to a port in the workspace of
+// the agent.
+func (c *Client) PostWorkspaceAgentTunnel(ctx context.Context, req CreateWorkspaceAgentTunnelRequest) (WorkspaceAgentTunnel, error) {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/tunnels", req)
+	if err != nil {
+		return WorkspaceAgentTunnel{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return WorkspaceAgentTunnel{}, readBodyAsError(res)
+	}
+	var tunnel WorkspaceAgentTunnel
+	return tunnel, json.NewDecoder(res.Body).Decode(&tunnel)
+}
+
+// DeleteWorkspaceAgentTunnel closes a tunnel of the agent and returns it
+// with its traffic.
+func (c *Client) DeleteWorkspaceAgentTunnel(ctx context.Context, id string) (WorkspaceAgentTunnel, error) {
+	res, err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/api/v2/workspaceagents/me/tunnels/%s", id), nil)
+	if err != nil {
+		return WorkspaceAgentTunnel{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentTunnel{}, readBodyAsError(res)
+	}
+	var tunnel WorkspaceAgentTunnel
+	return tunnel, json.NewDecoder(res.Body).Decode(&tunnel)
+}
+
+// WorkspaceAgentTunnels lists the open tunnels of the workspace agent.
+func (c *Client) WorkspaceAgentTunnels(ctx context.Context, agentID uuid.UUID) ([]WorkspaceAgentTunnel, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/tunnels", agentID), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, readBodyAsError(res)
+	}
+	var tunnels []WorkspaceAgentTunnel
+	return tunnels, json.NewDecoder(res.Body).Decode(&tunnels)
+}
+
+// WorkspaceAgentQuiesce prepares the workspace agent for a snapshot of the
+// VM of the workspace.
+func (c *Client) WorkspaceAgentQuiesce(ctx context.Context, agentID uuid.UUID) (QuiesceResponse, error) {
+	res, err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/api/v2/workspaceagents/%s/quiesce", agentID), nil)
+	if err != nil {
+		return QuiesceResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return QuiesceResponse{}, readBodyAsError(res)
+	}
+	var resp QuiesceResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentBroadcastMessage writes a message to the terminal of every
+// active session of the workspace agent.
+func (c *Client) WorkspaceAgentBroadcastMessage(ctx context.Context, agentID uuid.UUID, req BroadcastMessageRequest) (BroadcastMessageResponse, error) {
+	res, err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/api/v2/workspaceagents/%s/broadcast", agentID), req)
+	if err != nil {
+		return BroadcastMessageResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return BroadcastMessageResponse{}, readBodyAsError(res)
+	}
+	var resp BroadcastMessageResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// SSHCertificateRequest is a public key to issue an SSH user
+// certificate for.
+// @typescript-ignore SSHCertificateRequest
+type SSHCertificateRequest struct {
+	// PublicKey is in the authorized_keys format.
+	PublicKey string `json:"public_key" validate:"required"`
+}
+
+// SSHCertificateResponse contains an SSH user certificate.
+// @typescript-ignore SSHCertificateResponse
+type SSHCertificateResponse struct {
+	// Certificate is in the authorized_keys format.
+	Certificate string    `json:"certificate"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// WorkspaceAgentSSHCertificate issues a short-lived SSH user certificate for
+// the public key that's accepted by the workspace agent.
+func (c *Client) WorkspaceAgentSSHCertificate(ctx context.Context, agentID uuid.UUID, req SSHCertificateRequest) (SSHCertificateResponse, error) {
+	res, err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/api/v2/workspaceagents/%s/ssh-certificate", agentID), req)
+	if err != nil {
+		return SSHCertificateResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return SSHCertificateResponse{}, readBodyAsError(res)
+	}
+	var resp SSHCertificateResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentReversePortForwards lists the active reverse port forwards
+// of the workspace agent.
+func (c *Client) WorkspaceAgentReversePortForwards(ctx context.Context, agentID uuid.UUID) (ReversePortForwardsResponse, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/reverse-port-forwards", agentID), nil)
+	if err != nil {
+		return ReversePortForwardsResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return ReversePortForwardsResponse{}, readBodyAsError(res)
+	}
+	var resp ReversePortForwardsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentStartup returns the state of the startup script of the
+// workspace agent, with diagnostics if it failed.
+func (c *Client) WorkspaceAgentStartup(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentStartupResponse, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/startup", agentID), nil)
+	if err != nil {
+		return WorkspaceAgentStartupResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentStartupResponse{}, readBodyAsError(res)
+	}
+	var resp WorkspaceAgentStartupResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentSessions lists the active SSH and reconnecting PTY sessions
+// of the workspace agent.
+func (c *Client) WorkspaceAgentSessions(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentSessionsResponse, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/sessions", agentID), nil)
+	if err != nil {
+		return WorkspaceAgentSessionsResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentSessionsResponse{}, readBodyAsError(res)
+	}
+	var resp WorkspaceAgentSessionsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// TerminateWorkspaceAgentSession ends an active session of the workspace
+// agent, killing its process and disconnecting its clients.
+func (c *Client) TerminateWorkspaceAgentSession(ctx context.Context, agentID uuid.UUID, id string) error {
+	res, err := c.Request(ctx, http.MethodDelete, fmt.Sprintf("/api/v2/workspaceagents/%s/sessions/%s", agentID, url.PathEscape(id)), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WorkspaceAgentQuickActions lists the quick actions of the workspace
+// agent, with their most recent runs.
+func (c *Client) WorkspaceAgentQuickActions(ctx context.Context, agentID uuid.UUID) (WorkspaceAgentQuickActionsResponse, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/quick-actions", agentID), nil)
+	if err != nil {
+		return WorkspaceAgentQuickActionsResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentQuickActionsResponse{}, readBodyAsError(res)
+	}
+	var resp WorkspaceAgentQuickActionsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// RunWorkspaceAgentQuickAction starts a quick action of the workspace
+// agent by its name.
+func (c *Client) RunWorkspaceAgentQuickAction(ctx context.Context, agentID uuid.UUID, name string) (WorkspaceAgentQuickActionRun, error) {
+	res, err := c.Request(ctx, http.MethodPost, fmt.Sprintf("/api/v2/workspaceagents/%s/quick-actions/%s", agentID, url.PathEscape(name)), nil)
+	if err != nil {
+		return WorkspaceAgentQuickActionRun{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceAgentQuickActionRun{}, readBodyAsError(res)
+	}
+	var run WorkspaceAgentQuickActionRun
+	return run, json.NewDecoder(res.Body).Decode(&run)
+}
+
+// WorkspaceAgentSessionTranscripts lists the session transcripts recorded
+// by the workspace agent.
+func (c *Client) WorkspaceAgentSessionTranscripts(ctx context.Context, agentID uuid.UUID) (SessionTranscriptsResponse, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/transcripts", agentID), nil)
+	if err != nil {
+		return SessionTranscriptsResponse{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return SessionTranscriptsResponse{}, readBodyAsError(res)
+	}
+	var resp SessionTranscriptsResponse
+	return resp, json.NewDecoder(res.Body).Decode(&resp)
+}
+
+// WorkspaceAgentSessionTranscript downloads a session transcript from the
+// workspace agent in asciicast format. The caller must close the returned
+// reader.
+func (c *Client) WorkspaceAgentSessionTranscript(ctx context.Context, agentID uuid.UUID, id string) (io.ReadCloser, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaceagents/%s/transcripts/%s", agentID, url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, readBodyAsError(res)
+	}
+	return res.Body, nil
+}
+
 // Stats records the Agent's network connection statistics for use in
 // user-facing metrics and debugging.
 // @typescript-ignore AgentStats
@@ -567,6 +1486,95 @@ type AgentStats struct {
 	TxPackets int64 `json:"tx_packets"`
 	// TxBytes is the number of transmitted bytes.
 	TxBytes int64 `json:"tx_bytes"`
+	// CGNAT is whether the agent is behind a carrier-grade NAT.
+	CGNAT bool `json:"cgnat"`
+	// NAT64 is whether IPv4 traffic of the agent is translated by NAT64.
+	NAT64 bool `json:"nat64"`
+	// IPv4 and IPv6 are whether the agent reached DERP regions over the
+	// IP family, so IPv6-only and dual-stack networks can be told apart.
+	IPv4 bool `json:"ipv4,omitempty"`
+	IPv6 bool `json:"ipv6,omitempty"`
+	// DERPDegraded is whether the preferred DERP region of the agent is
+	// failing health probes.
+	DERPDegraded bool `json:"derp_degraded,omitempty"`
+	// DERPFailovers is the number of times the agent moved to another
+	// DERP region because its preferred region was degraded.
+	DERPFailovers int64 `json:"derp_failovers,omitempty"`
+	// DERPRegion is the code of the DERP region the agent is homed in,
+	// which peers relay through when they can't connect directly.
+	DERPRegion string `json:"derp_region,omitempty"`
+	// DirectConnectionsDisabled is whether the metadata disabled direct
+	// connections, so peers only connect through DERP.
+	DirectConnectionsDisabled bool `json:"direct_connections_disabled,omitempty"`
+	// DirectSeconds and DERPSeconds are how long peers were connected to
+	// the agent directly and relayed through DERP since the last report,
+	// summed over peers. DERPSecondsByRegion breaks DERPSeconds down by the
+	// code of the DERP region.
+	DirectSeconds       int64            `json:"direct_seconds,omitempty"`
+	DERPSeconds         int64            `json:"derp_seconds,omitempty"`
+	DERPSecondsByRegion map[string]int64 `json:"derp_seconds_by_region,omitempty"`
+	// UserNamespace is whether the agent runs in a user namespace, and
+	// Rootless is whether root in it is unprivileged on the host.
+	UserNamespace bool `json:"user_namespace,omitempty"`
+	Rootless      bool `json:"rootless,omitempty"`
+	// SSHRejectedConnections is the number of SSH connections rejected
+	// because their peer exceeded the rate limit or was banned, and
+	// SSHBans is the number of times a peer was banned for repeatedly
+	// failing SSH handshakes.
+	SSHRejectedConnections int64 `json:"ssh_rejected_connections,omitempty"`
+	SSHBans                int64 `json:"ssh_bans,omitempty"`
+	// MalformedReconnectingPTYInits is the number of reconnecting PTY
+	// connections closed because their init message didn't arrive in
+	// time, was too large or couldn't be decoded.
+	MalformedReconnectingPTYInits int64 `json:"malformed_reconnecting_pty_inits,omitempty"`
+	// FileDescriptorExhaustions is the number of times the agent ran out
+	// of file descriptors.
+	FileDescriptorExhaustions int64 `json:"file_descriptor_exhaustions,omitempty"`
+	// Throttled is whether the agent is backing off periodic work, like
+	// app health checks and extracting these stats, because the workspace
+	// is under heavy CPU or memory load.
+	Throttled bool `json:"throttled,omitempty"`
+	// IdleSeconds is how long no client has been connected to the agent
+	// through SSH, a reconnecting PTY or a port forward. It's zero while a
+	// client is connected.
+	IdleSeconds int64 `json:"idle_seconds,omitempty"`
+	// Usage counts the features used since the last report. It's only
+	// sent when telemetry is enabled for the deployment.
+	Usage *AgentUsage `json:"usage,omitempty"`
+	// Apps are the connections to apps served on the loopback address of
+	// the workspace, keyed by the slug of the app.
+	Apps map[string]AgentAppStats `json:"apps,omitempty"`
+}
+
+// AgentAppStats counts the connections to an app since the agent started.
+// @typescript-ignore AgentAppStats
+type AgentAppStats struct {
+	// OpenConnections is the number of connections that are open.
+	OpenConnections int64 `json:"open_connections"`
+	// Connections is the number of connections that were accepted.
+	Connections int64 `json:"connections"`
+	// RejectedConnections is the number of connections that were refused
+	// because the app had its maximum connections open.
+	RejectedConnections int64 `json:"rejected_connections"`
+	// IdleTimeouts is the number of connections that were closed because
+	// they were idle.
+	IdleTimeouts int64 `json:"idle_timeouts"`
+}
+
+// AgentUsage is an anonymized count of the features of an agent that were
+// used. It doesn't identify the users, addresses or files involved.
+type AgentUsage struct {
+	// SFTPSessions is the number of SFTP sessions started.
+	SFTPSessions int64 `json:"sftp_sessions"`
+	// PortForwards is the number of local port forwards opened.
+	PortForwards int64 `json:"port_forwards"`
+	// ReversePortForwards is the number of reverse port forwards bound.
+	ReversePortForwards int64 `json:"reverse_port_forwards"`
+	// Speedtests is the number of speedtests run against the agent.
+	Speedtests int64 `json:"speedtests"`
+	// SOCKSConnections is the number of connections dialed through the
+	// SOCKS5 proxy.
+	SOCKSConnections int64 `json:"socks_connections"`
 }
 
 // @typescript-ignore AgentStatsResponse
@@ -6,11 +6,13 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 	"tailscale.com/tailcfg"
 
 	"cdr.dev/slog/sloggers/slogtest"
@@ -52,6 +54,63 @@ func TestWorkspaceAgentMetadata(t *testing.T) {
 	require.Equal(t, parsed.Port(), strconv.Itoa(node.DERPPort))
 }
 
+func TestWorkspaceAgentMetadataUnknownFields(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"version":99,"derpmap":{"Regions":{}},"required_fields":["motd_file","future_restriction"],"motd_file":"/etc/motd","future_restriction":true,"future_option":1}`))
+	}))
+	defer srv.Close()
+	parsed, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	client := codersdk.New(parsed)
+	metadata, err := client.WorkspaceAgentMetadata(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 99, metadata.Version)
+	require.Equal(t, "/etc/motd", metadata.MOTDFile)
+	require.Equal(t, []string{"future_option", "future_restriction"}, metadata.UnknownFields)
+	require.Equal(t, []string{"future_restriction"}, metadata.UnsupportedRequiredFields())
+}
+
+func TestWorkspaceAgentErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		status int
+		code   codersdk.WorkspaceAgentErrorCode
+	}{
+		{status: http.StatusUnauthorized, code: codersdk.WorkspaceAgentErrorTokenInvalid},
+		{status: http.StatusInternalServerError, code: codersdk.WorkspaceAgentErrorMetadataFetchFailed},
+	} {
+		c := c
+		t.Run(strconv.Itoa(c.status), func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				httpapi.Write(context.Background(), w, c.status, codersdk.Response{
+					Message: "Failed.",
+				})
+			}))
+			defer srv.Close()
+			parsed, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+			client := codersdk.New(parsed)
+			_, err = client.WorkspaceAgentMetadata(context.Background())
+			require.Error(t, err)
+			require.Equal(t, c.code, codersdk.WorkspaceAgentErrorCodeOf(err))
+
+			// Clients recover the code from the message sent by the agent.
+			message := codersdk.FormatWorkspaceAgentError(xerrors.Errorf("fetch metadata: %w", err))
+			require.Contains(t, message, c.code.Guidance())
+			code, ok := codersdk.ParseWorkspaceAgentErrorCode(message)
+			require.True(t, ok)
+			require.Equal(t, c.code, code)
+		})
+	}
+
+	require.Equal(t, codersdk.WorkspaceAgentErrorUnknown, codersdk.WorkspaceAgentErrorCodeOf(xerrors.New("failed")))
+	_, ok := codersdk.ParseWorkspaceAgentErrorCode("exit status 1")
+	require.False(t, ok)
+}
+
 func TestAgentReportStats(t *testing.T) {
 	t.Parallel()
 
@@ -78,3 +137,41 @@ func TestAgentReportStats(t *testing.T) {
 		testutil.WaitMedium, testutil.IntervalFast,
 	)
 }
+
+func TestNegotiateWorkspaceAgentHandshake(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Intersection", func(t *testing.T) {
+		t.Parallel()
+		resp := codersdk.NegotiateWorkspaceAgentHandshake(codersdk.WorkspaceAgentHandshakeRequest{
+			ProtocolVersion: 3,
+			Capabilities: []codersdk.WorkspaceAgentCapability{
+				codersdk.WorkspaceAgentCapabilityAppHealth,
+				"unknown",
+				codersdk.WorkspaceAgentCapabilityAppHealth,
+			},
+		}, 2, codersdk.WorkspaceAgentCapabilities)
+		require.Equal(t, 2, resp.ProtocolVersion)
+		require.Equal(t, []codersdk.WorkspaceAgentCapability{codersdk.WorkspaceAgentCapabilityAppHealth}, resp.Capabilities)
+		require.True(t, resp.Has(codersdk.WorkspaceAgentCapabilityAppHealth))
+		require.False(t, resp.Has(codersdk.WorkspaceAgentCapabilityListeningPorts))
+	})
+
+	t.Run("OlderAgent", func(t *testing.T) {
+		t.Parallel()
+		resp := codersdk.NegotiateWorkspaceAgentHandshake(codersdk.WorkspaceAgentHandshakeRequest{
+			ProtocolVersion: 1,
+		}, 2, codersdk.WorkspaceAgentCapabilities)
+		require.Equal(t, 1, resp.ProtocolVersion)
+		require.Empty(t, resp.Capabilities)
+	})
+}
+
+func TestWorkspaceAgentHostname(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "dev-main", codersdk.WorkspaceAgentHostname("dev", "main"))
+	require.Equal(t, "my-dev-main-agent", codersdk.WorkspaceAgentHostname("My_Dev", "main.agent"))
+	require.Equal(t, "dev", codersdk.WorkspaceAgentHostname("dev", ""))
+	long := codersdk.WorkspaceAgentHostname(strings.Repeat("a", 60), "agent")
+	require.Len(t, long, 63)
+}
@@ -0,0 +1,72 @@
+package codersdk
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// WorkspaceAgentStartupScriptFailurePolicy is what happens to sessions
+// when the startup script fails.
+type WorkspaceAgentStartupScriptFailurePolicy string
+
+const (
+	// WorkspaceAgentStartupScriptFailurePolicyWarn lets sessions start
+	// while the startup script runs and after it fails. The failure is
+	// shown in the startup state.
+	WorkspaceAgentStartupScriptFailurePolicyWarn WorkspaceAgentStartupScriptFailurePolicy = "warn"
+	// WorkspaceAgentStartupScriptFailurePolicyBlock makes sessions wait
+	// for the startup script, and refuses them if it failed, so users
+	// don't work in a half-initialized workspace.
+	WorkspaceAgentStartupScriptFailurePolicyBlock WorkspaceAgentStartupScriptFailurePolicy = "block"
+)
+
+// WorkspaceAgentStartupScriptPolicy bounds how long the startup script
+// runs, and how often it's retried. Zero values run the script once
+// without a timeout, and warn when it fails.
+// @typescript-ignore WorkspaceAgentStartupScriptPolicy
+type WorkspaceAgentStartupScriptPolicy struct {
+	// TimeoutSeconds kills each attempt of the script after the duration.
+	TimeoutSeconds int32 `json:"timeout_seconds,omitempty"`
+	// Retries is how often the script is run again after it failed or
+	// timed out.
+	Retries       int32                                    `json:"retries,omitempty"`
+	FailurePolicy WorkspaceAgentStartupScriptFailurePolicy `json:"failure_policy,omitempty"`
+}
+
+// WorkspaceAgentStartupScriptState is how the startup script ended.
+type WorkspaceAgentStartupScriptState string
+
+const (
+	WorkspaceAgentStartupScriptOK       WorkspaceAgentStartupScriptState = "ok"
+	WorkspaceAgentStartupScriptTimedOut WorkspaceAgentStartupScriptState = "timed_out"
+	WorkspaceAgentStartupScriptFailed   WorkspaceAgentStartupScriptState = "failed"
+)
+
+// WorkspaceAgentStartupScriptResult is reported by the agent once the
+// startup script ended, after all of its attempts.
+// @typescript-ignore WorkspaceAgentStartupScriptResult
+type WorkspaceAgentStartupScriptResult struct {
+	State       WorkspaceAgentStartupScriptState `json:"state"`
+	Attempts    int32                            `json:"attempts"`
+	StartedAt   time.Time                        `json:"started_at"`
+	CompletedAt time.Time                        `json:"completed_at"`
+	// Error is why the last attempt failed.
+	Error string `json:"error,omitempty"`
+}
+
+// PostWorkspaceAgentStartupScriptResult reports how the startup script of
+// the agent ended.
+func (c *Client) PostWorkspaceAgentStartupScriptResult(ctx context.Context, req WorkspaceAgentStartupScriptResult) error {
+	res, err := c.Request(ctx, http.MethodPost, "/api/v2/workspaceagents/me/startup-script-result", req)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readBodyAsError(res)
+	}
+	return nil
+}
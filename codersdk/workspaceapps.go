@@ -4,6 +4,12 @@ import (
 	"github.com/google/uuid"
 )
 
+// WorkspaceAppTokenHeader is set by coderd on requests proxied to apps. Its
+// value is one of the tokens in the file of the CODER_APP_TOKEN_FILE
+// environment variable, which apps can check to validate that requests
+// came through the app proxy.
+const WorkspaceAppTokenHeader = "Coder-App-Token"
+
 type WorkspaceAppHealth string
 
 const (
@@ -28,6 +34,9 @@ type WorkspaceApp struct {
 	// DisplayName is a friendly name for the app.
 	DisplayName string `json:"display_name"`
 	Command     string `json:"command,omitempty"`
+	// URL is the address the app is proxied to in the workspace, like
+	// http://localhost:8080. It's empty for apps that run a command.
+	URL string `json:"url,omitempty"`
 	// Icon is a relative path or external URL that specifies
 	// an icon to be displayed in the dashboard.
 	Icon string `json:"icon,omitempty"`
@@ -42,13 +51,63 @@ type WorkspaceApp struct {
 	Health      WorkspaceAppHealth `json:"health"`
 }
 
+// HealthcheckType is the protocol of the health checks of an app.
+type HealthcheckType string
+
+const (
+	HealthcheckTypeHTTP HealthcheckType = "http"
+	// HealthcheckTypeGRPC calls grpc.health.v1.Health/Check, and the app
+	// is healthy while it's SERVING.
+	HealthcheckTypeGRPC HealthcheckType = "grpc"
+)
+
 type Healthcheck struct {
-	// URL specifies the url to check for the app health.
+	// Type is the protocol of health checks. Defaults to HTTP.
+	Type HealthcheckType `json:"type,omitempty"`
+	// URL specifies the url to check for the app health. gRPC health
+	// checks use grpc://localhost:<port>, or grpcs:// for TLS.
 	URL string `json:"url"`
 	// Interval specifies the seconds between each health check.
 	Interval int32 `json:"interval"`
 	// Threshold specifies the number of consecutive failed health checks before returning "unhealthy".
 	Threshold int32 `json:"threshold"`
+	// HealthyThreshold is the number of consecutive successful health
+	// checks before returning "healthy". Defaults to 1.
+	HealthyThreshold int32 `json:"healthy_threshold,omitempty"`
+	// Method is the HTTP method of health checks. Defaults to GET.
+	Method string `json:"method,omitempty"`
+	// Headers are set on the requests of health checks, like the
+	// Content-Type of a GraphQL query.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is sent with the requests of health checks.
+	Body string `json:"body,omitempty"`
+	// ExpectedStatuses are the status codes of healthy responses.
+	// Responses without a 5XX status code are healthy if it's empty.
+	ExpectedStatuses []HealthcheckStatusRange `json:"expected_statuses,omitempty"`
+	// BodyRegex must match the body of healthy responses if it's set. Only
+	// the first HealthcheckMaxBodySize bytes of the body are matched.
+	BodyRegex string `json:"body_regex,omitempty"`
+	// InsecureSkipVerify skips verifying the TLS certificate of the app,
+	// which is often self-signed.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// GRPCService is the service that gRPC health checks check. The
+	// health of the server is checked if it's empty.
+	GRPCService string `json:"grpc_service,omitempty"`
+}
+
+// HealthcheckMaxBodySize limits how much of the body of responses to
+// health checks is matched against BodyRegex.
+const HealthcheckMaxBodySize = 1 << 20
+
+// HealthcheckStatusRange is an inclusive range of HTTP status codes.
+type HealthcheckStatusRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Contains returns whether the status code is in the range.
+func (r HealthcheckStatusRange) Contains(status int) bool {
+	return status >= r.Min && status <= r.Max
 }
 
 // @typescript-ignore PostWorkspaceAppHealthsRequest
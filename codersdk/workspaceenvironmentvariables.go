@@ -0,0 +1,96 @@
+package codersdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"golang.org/x/xerrors"
+)
+
+// MaxWorkspaceEnvironmentVariables limits the environment variables of a
+// workspace.
+const MaxWorkspaceEnvironmentVariables = 100
+
+// WorkspaceEnvironmentVariables are environment variables that the owner of
+// a workspace sets without changing the template. Agents add them to new
+// sessions, overriding the environment variables of the template.
+type WorkspaceEnvironmentVariables struct {
+	Variables map[string]string `json:"variables"`
+}
+
+// WorkspaceEnvironmentVariables returns the environment variables that are
+// set for a workspace.
+func (c *Client) WorkspaceEnvironmentVariables(ctx context.Context, workspaceID uuid.UUID) (WorkspaceEnvironmentVariables, error) {
+	res, err := c.Request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/workspaces/%s/environment-variables", workspaceID), nil)
+	if err != nil {
+		return WorkspaceEnvironmentVariables{}, xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return WorkspaceEnvironmentVariables{}, readBodyAsError(res)
+	}
+	var variables WorkspaceEnvironmentVariables
+	return variables, json.NewDecoder(res.Body).Decode(&variables)
+}
+
+// UpdateWorkspaceEnvironmentVariables replaces the environment variables
+// of a workspace. Running agents apply them to sessions started afterwards.
+func (c *Client) UpdateWorkspaceEnvironmentVariables(ctx context.Context, workspaceID uuid.UUID, req WorkspaceEnvironmentVariables) error {
+	res, err := c.Request(ctx, http.MethodPut, fmt.Sprintf("/api/v2/workspaces/%s/environment-variables", workspaceID), req)
+	if err != nil {
+		return xerrors.Errorf("execute request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return readBodyAsError(res)
+	}
+	return nil
+}
+
+// WatchWorkspaceAgentMetadata notifies the agent when its metadata changes,
+// so it's fetched again. The channel is closed when the watch ends, and
+// changes made while it isn't watched aren't notified.
+func (c *Client) WatchWorkspaceAgentMetadata(ctx context.Context) (<-chan struct{}, error) {
+	//nolint:bodyclose
+	res, err := c.Request(ctx, http.MethodGet, "/api/v2/workspaceagents/me/metadata/watch", nil)
+	if err != nil {
+		return nil, xerrors.Errorf("execute request: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, readBodyAsError(res)
+	}
+	nextEvent := ServerSentEventReader(ctx, res.Body)
+	// coderd pings when it's subscribed, so changes made after this
+	// returns aren't missed.
+	_, err = nextEvent()
+	if err != nil {
+		_ = res.Body.Close()
+		return nil, xerrors.Errorf("wait for watch: %w", err)
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		defer res.Body.Close()
+		for {
+			sse, err := nextEvent()
+			if err != nil {
+				return
+			}
+			if sse.Type != ServerSentEventTypeData {
+				continue
+			}
+			// Changes are coalesced, since the metadata is fetched
+			// whole.
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,265 @@
+package filesync
+
+import (
+	"crypto/sha256"
+	"io"
+	"math"
+)
+
+const (
+	// minBlockSize and maxBlockSize bound the size of the blocks that files
+	// on the receiver are split into. Larger files use larger blocks, so
+	// their signatures stay small.
+	minBlockSize = 1 << 10
+	maxBlockSize = 128 << 10
+	// maxLiteralSize bounds the data of a single literal operation, and the
+	// data of the operations in a single message.
+	maxLiteralSize = 64 << 10
+	// maxOperations bounds the operations in a single message.
+	maxOperations = 4096
+	// readSize is how much of a file is read at once.
+	readSize = 256 << 10
+)
+
+// blockSize returns the size of the blocks of a file, which is about the
+// square root of its size like rsync.
+func blockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size))) &^ 7
+	if blockSize < minBlockSize {
+		return minBlockSize
+	}
+	if blockSize > maxBlockSize {
+		return maxBlockSize
+	}
+	return blockSize
+}
+
+// weakChecksum is the rolling checksum of rsync. It's cheap to update when
+// the window moves by a byte, so blocks are found at any offset.
+func weakChecksum(data []byte) (a, b uint32) {
+	for i, c := range data {
+		a += uint32(c)
+		b += uint32(len(data)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// rollChecksum moves the window of a weak checksum of size bytes by one byte.
+func rollChecksum(a, b uint32, size int, out, in byte) (uint32, uint32) {
+	a = (a - uint32(out) + uint32(in)) & 0xffff
+	b = (b - uint32(size)*uint32(out) + a) & 0xffff
+	return a, b
+}
+
+// computeSignature returns the checksums of the blocks of a file of size
+// bytes.
+func computeSignature(reader io.Reader, size int64) ([]block, int, error) {
+	length := blockSize(size)
+	blocks := make([]block, 0, (size+int64(length)-1)/int64(length))
+	buf := make([]byte, length)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			a, b := weakChecksum(buf[:n])
+			blocks = append(blocks, block{
+				Weak:   a | b<<16,
+				Strong: sha256.Sum256(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, length, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// deltaEncoder finds the blocks of a signature in a file, and emits
+// operations that copy them or send the data between them.
+type deltaEncoder struct {
+	sig    signature
+	index  map[uint32][]int
+	emit   func(op operation) error
+	reader io.Reader
+
+	buf      []byte
+	pos      int
+	litStart int
+	eof      bool
+
+	literalBytes int64
+	matchedBytes int64
+}
+
+func newDeltaEncoder(sig signature, reader io.Reader, emit func(op operation) error) *deltaEncoder {
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		index[b.Weak] = append(index[b.Weak], i)
+	}
+	return &deltaEncoder{
+		sig:    sig,
+		index:  index,
+		emit:   emit,
+		reader: reader,
+		buf:    make([]byte, 0, readSize+maxBlockSize),
+	}
+}
+
+// blockLength returns the length of a block of the signature. Only the last
+// block can be shorter than the block size.
+func (d *deltaEncoder) blockLength(index int) int {
+	if index == len(d.sig.Blocks)-1 {
+		return int(d.sig.Size - int64(index)*int64(d.sig.BlockSize))
+	}
+	return d.sig.BlockSize
+}
+
+// match returns the block with the checksums of data, if any.
+func (d *deltaEncoder) match(weak uint32, data []byte) (int, bool) {
+	candidates, ok := d.index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := sha256.Sum256(data)
+	for _, index := range candidates {
+		if d.blockLength(index) == len(data) && d.sig.Blocks[index].Strong == strong {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// fill reads until need bytes after the position are buffered, or the file
+// ends. Data before the pending literal is dropped.
+func (d *deltaEncoder) fill(need int) error {
+	for !d.eof && len(d.buf)-d.pos < need {
+		if d.litStart > 0 {
+			n := copy(d.buf, d.buf[d.litStart:])
+			d.buf = d.buf[:n]
+			d.pos -= d.litStart
+			d.litStart = 0
+		}
+		if cap(d.buf)-len(d.buf) < readSize {
+			grown := make([]byte, len(d.buf), 2*cap(d.buf))
+			copy(grown, d.buf)
+			d.buf = grown
+		}
+		n, err := d.reader.Read(d.buf[len(d.buf):cap(d.buf)])
+		d.buf = d.buf[:len(d.buf)+n]
+		if err == io.EOF {
+			d.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushLiteral emits the data between the last operation and the position.
+func (d *deltaEncoder) flushLiteral() error {
+	if d.pos == d.litStart {
+		return nil
+	}
+	data := append([]byte(nil), d.buf[d.litStart:d.pos]...)
+	d.literalBytes += int64(len(data))
+	d.litStart = d.pos
+	return d.emit(operation{Block: -1, Data: data})
+}
+
+func (d *deltaEncoder) copyBlock(index int) error {
+	err := d.flushLiteral()
+	if err != nil {
+		return err
+	}
+	length := d.blockLength(index)
+	d.matchedBytes += int64(length)
+	d.pos += length
+	d.litStart = d.pos
+	return d.emit(operation{Block: index})
+}
+
+func (d *deltaEncoder) encode() error {
+	size := d.sig.BlockSize
+	if len(d.sig.Blocks) == 0 {
+		// There's nothing to match, so the whole file is sent.
+		for {
+			err := d.fill(maxLiteralSize)
+			if err != nil {
+				return err
+			}
+			d.pos = len(d.buf)
+			if d.pos-d.litStart > maxLiteralSize {
+				d.pos = d.litStart + maxLiteralSize
+			}
+			if d.pos == d.litStart {
+				return nil
+			}
+			err = d.flushLiteral()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var a, b uint32
+	rolling := false
+	for {
+		if !rolling {
+			err := d.fill(size)
+			if err != nil {
+				return err
+			}
+			if len(d.buf)-d.pos < size {
+				break
+			}
+			a, b = weakChecksum(d.buf[d.pos : d.pos+size])
+			rolling = true
+		}
+		if index, ok := d.match(a|b<<16, d.buf[d.pos:d.pos+size]); ok {
+			err := d.copyBlock(index)
+			if err != nil {
+				return err
+			}
+			rolling = false
+			continue
+		}
+		err := d.fill(size + 1)
+		if err != nil {
+			return err
+		}
+		if len(d.buf)-d.pos < size+1 {
+			break
+		}
+		a, b = rollChecksum(a, b, size, d.buf[d.pos], d.buf[d.pos+size])
+		d.pos++
+		if d.pos-d.litStart >= maxLiteralSize {
+			err = d.flushLiteral()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The end of the file can match the last block, which is usually
+	// shorter than the others.
+	rest := d.buf[d.pos:]
+	last := len(d.sig.Blocks) - 1
+	if len(rest) > 0 && len(rest) == d.blockLength(last) {
+		a, b := weakChecksum(rest)
+		if index, ok := d.match(a|b<<16, rest); ok {
+			return d.copyBlock(index)
+		}
+	}
+	d.pos = len(d.buf)
+	for d.pos-d.litStart > maxLiteralSize {
+		end := d.pos
+		d.pos = d.litStart + maxLiteralSize
+		err := d.flushLiteral()
+		if err != nil {
+			return err
+		}
+		d.pos = end
+	}
+	return d.flushLiteral()
+}
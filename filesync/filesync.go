@@ -0,0 +1,803 @@
+// Package filesync syncs directory trees over a connection like rsync.
+// Files whose size and modification time match on both sides are skipped,
+// and the files that changed are sent as the differences to the blocks of
+// the file on the receiving side, so syncing large trees that mostly match,
+// like node_modules, transfers little data.
+package filesync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+	"golang.org/x/xerrors"
+)
+
+// Options configure the receiver of a sync.
+type Options struct {
+	// Delete removes files from the receiver that the sender doesn't
+	// have.
+	Delete bool
+}
+
+// Stats summarize a sync. Both sides return the stats of the receiver.
+type Stats struct {
+	// Files is the number of regular files of the sender.
+	Files int `json:"files"`
+	// Transferred is the number of files that were created or updated.
+	Transferred int `json:"transferred"`
+	// Deleted is the number of files and directories that were removed.
+	Deleted int `json:"deleted"`
+	// LiteralBytes is the number of bytes of files that were sent.
+	LiteralBytes int64 `json:"literal_bytes"`
+	// MatchedBytes is the number of bytes of files that were copied from
+	// the files of the receiver instead of being sent.
+	MatchedBytes int64 `json:"matched_bytes"`
+}
+
+// message is the envelope of everything sent over a connection. Exactly one
+// field is set.
+type message struct {
+	// Entry is sent by the sender for each file, directory and symbolic
+	// link, and EndEntries after the last one.
+	Entry      *entry
+	EndEntries bool
+	// Signature is sent by the receiver for each file that differs, and
+	// EndSignatures after the last one.
+	Signature     *signature
+	EndSignatures bool
+	// Delta is sent by the sender for each signature, and EndDeltas after
+	// the last one.
+	Delta     *delta
+	EndDeltas bool
+	// Stats is sent by the receiver when it's done.
+	Stats *Stats
+	// Error is sent by either side when it fails.
+	Error string
+}
+
+type entry struct {
+	// Path is relative to the root, and separated by slashes.
+	Path       string
+	Mode       fs.FileMode
+	Size       int64
+	ModTime    time.Time
+	LinkTarget string
+}
+
+// signature is the checksums of the blocks of a file on the receiver. It's
+// empty if the receiver doesn't have the file.
+type signature struct {
+	Path      string
+	Size      int64
+	BlockSize int
+	Blocks    []block
+}
+
+type block struct {
+	Weak   uint32
+	Strong [sha256.Size]byte
+}
+
+// delta is part of the operations that build a file from the blocks of the
+// file on the receiver. The last part has the checksum of the file.
+type delta struct {
+	Path       string
+	Operations []operation
+	Final      bool
+	SHA256     []byte
+}
+
+// operation copies a block of the file on the receiver, or writes data if
+// Block is negative.
+type operation struct {
+	Block int
+	Data  []byte
+}
+
+type conn struct {
+	rw      io.ReadWriter
+	reader  *gob.Decoder
+	mutex   sync.Mutex
+	buffer  *bufio.Writer
+	encoder *gob.Encoder
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	buffer := bufio.NewWriter(rw)
+	return &conn{
+		rw:      rw,
+		reader:  gob.NewDecoder(bufio.NewReader(rw)),
+		buffer:  buffer,
+		encoder: gob.NewEncoder(buffer),
+	}
+}
+
+func (c *conn) read() (message, error) {
+	var msg message
+	err := c.reader.Decode(&msg)
+	if err != nil {
+		return message{}, xerrors.Errorf("read message: %w", err)
+	}
+	if msg.Error != "" {
+		return message{}, xerrors.Errorf("remote: %s", msg.Error)
+	}
+	return msg, nil
+}
+
+// write sends a message. Messages are buffered until flush is set, so
+// streams of small messages are sent together.
+func (c *conn) write(msg message, flush bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := c.encoder.Encode(msg)
+	if err != nil {
+		return xerrors.Errorf("write message: %w", err)
+	}
+	if flush {
+		err = c.buffer.Flush()
+		if err != nil {
+			return xerrors.Errorf("flush: %w", err)
+		}
+	}
+	return nil
+}
+
+// failTimeout bounds how long telling the other side about a failure can
+// take, since it might be blocked writing rather than reading.
+const failTimeout = 5 * time.Second
+
+// fail tells the other side why the sync failed, and returns err.
+func (c *conn) fail(err error) error {
+	if conn, ok := c.rw.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		_ = conn.SetWriteDeadline(time.Now().Add(failTimeout))
+	}
+	_ = c.write(message{Error: err.Error()}, true)
+	return err
+}
+
+// Reject tells the other side of a connection that the sync can't start,
+// e.g. because its request was invalid.
+func Reject(rw io.ReadWriter, err error) error {
+	return newConn(rw).fail(err)
+}
+
+// Send sends the directory at root to the receiver on the other side of rw.
+func Send(ctx context.Context, rw io.ReadWriter, fsys afero.Fs, root string) (Stats, error) {
+	c := newConn(rw)
+	entries, err := walk(fsys, root)
+	if err != nil {
+		return Stats{}, c.fail(err)
+	}
+	for i := range entries {
+		err = c.write(message{Entry: &entries[i]}, false)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+	err = c.write(message{EndEntries: true}, true)
+	if err != nil {
+		return Stats{}, err
+	}
+	files := map[string]struct{}{}
+	for _, e := range entries {
+		if e.Mode.IsRegular() {
+			files[e.Path] = struct{}{}
+		}
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return Stats{}, c.fail(ctx.Err())
+		}
+		msg, err := c.read()
+		if err != nil {
+			return Stats{}, err
+		}
+		switch {
+		case msg.Signature != nil:
+			// Only the files that were listed can be read.
+			if _, ok := files[msg.Signature.Path]; !ok {
+				return Stats{}, c.fail(xerrors.Errorf("unexpected signature for %q", msg.Signature.Path))
+			}
+			err = sendDelta(c, fsys, root, *msg.Signature)
+			if err != nil {
+				return Stats{}, c.fail(err)
+			}
+		case msg.EndSignatures:
+			err = c.write(message{EndDeltas: true}, true)
+			if err != nil {
+				return Stats{}, err
+			}
+		case msg.Stats != nil:
+			return *msg.Stats, nil
+		default:
+			return Stats{}, c.fail(xerrors.New("unexpected message"))
+		}
+	}
+}
+
+// walk lists the regular files, directories and symbolic links under root
+// in lexical order, so directories come before their contents.
+func walk(fsys afero.Fs, root string) ([]entry, error) {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		return nil, xerrors.Errorf("stat %q: %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, xerrors.Errorf("%q isn't a directory", root)
+	}
+	var entries []entry
+	err = afero.Walk(fsys, root, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		e := entry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.Mode().IsRegular():
+			e.Size = info.Size()
+		case info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			reader, ok := fsys.(afero.LinkReader)
+			if !ok {
+				return nil
+			}
+			e.LinkTarget, err = reader.ReadlinkIfPossible(name)
+			if err != nil {
+				return xerrors.Errorf("read link %q: %w", name, err)
+			}
+		default:
+			// Devices, sockets and pipes aren't synced.
+			return nil
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("walk %q: %w", root, err)
+	}
+	return entries, nil
+}
+
+// sendDelta sends the operations that build a file from the blocks of its
+// signature.
+func sendDelta(c *conn, fsys afero.Fs, root string, sig signature) error {
+	file, err := fsys.Open(filepath.Join(root, filepath.FromSlash(sig.Path)))
+	if err != nil {
+		return xerrors.Errorf("open %q: %w", sig.Path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	var (
+		operations []operation
+		pending    int
+	)
+	encoder := newDeltaEncoder(sig, io.TeeReader(file, hash), func(op operation) error {
+		operations = append(operations, op)
+		pending += len(op.Data)
+		if pending < maxLiteralSize && len(operations) < maxOperations {
+			return nil
+		}
+		err := c.write(message{Delta: &delta{Path: sig.Path, Operations: operations}}, false)
+		operations = nil
+		pending = 0
+		return err
+	})
+	err = encoder.encode()
+	if err != nil {
+		return xerrors.Errorf("encode %q: %w", sig.Path, err)
+	}
+	return c.write(message{Delta: &delta{
+		Path:       sig.Path,
+		Operations: operations,
+		Final:      true,
+		SHA256:     hash.Sum(nil),
+	}}, true)
+}
+
+// receiver applies the entries of a sender to the directory at root.
+type receiver struct {
+	fs      afero.Fs
+	root    string
+	options Options
+	conn    *conn
+	stats   Stats
+
+	// checkedDirs are the directories that were checked to not be
+	// symbolic links.
+	checkedDirs map[string]struct{}
+
+	// signaturesMutex guards signatures, which are written while deltas
+	// are applied.
+	signaturesMutex sync.Mutex
+	signatures      map[string]signature
+
+	// current is the file that deltas are being applied to.
+	current *pendingFile
+}
+
+type pendingFile struct {
+	entry entry
+	sig   signature
+	base  afero.File
+	temp  afero.File
+	hash  io.Writer
+	sum   func() []byte
+}
+
+// Receive updates the directory at root to match the sender on the other side
+// of rw.
+func Receive(ctx context.Context, rw io.ReadWriter, fsys afero.Fs, root string, options Options) (Stats, error) {
+	r := &receiver{
+		fs:          fsys,
+		root:        root,
+		options:     options,
+		conn:        newConn(rw),
+		checkedDirs: map[string]struct{}{},
+		signatures:  map[string]signature{},
+	}
+	stats, err := r.receive(ctx)
+	if r.current != nil {
+		r.current.close(fsys)
+	}
+	if err != nil {
+		return Stats{}, r.conn.fail(err)
+	}
+	return stats, nil
+}
+
+func (r *receiver) receive(ctx context.Context) (Stats, error) {
+	var entries []entry
+	for {
+		msg, err := r.conn.read()
+		if err != nil {
+			return Stats{}, err
+		}
+		if msg.EndEntries {
+			break
+		}
+		if msg.Entry == nil {
+			return Stats{}, xerrors.New("unexpected message")
+		}
+		entries = append(entries, *msg.Entry)
+	}
+	// Entries are validated once they're all read, so the sender is
+	// reading when it's told they're invalid.
+	for _, e := range entries {
+		if !validPath(e.Path) {
+			return Stats{}, xerrors.Errorf("invalid path %q", e.Path)
+		}
+	}
+
+	err := r.fs.MkdirAll(r.root, 0o755)
+	if err != nil {
+		return Stats{}, xerrors.Errorf("create %q: %w", r.root, err)
+	}
+	files := map[string]entry{}
+	var pending []entry
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return Stats{}, ctx.Err()
+		}
+		update, err := r.prepare(e)
+		if err != nil {
+			return Stats{}, err
+		}
+		if e.Mode.IsRegular() {
+			r.stats.Files++
+			files[e.Path] = e
+			if update {
+				pending = append(pending, e)
+			}
+		}
+	}
+
+	err = r.receiveDeltas(ctx, files, pending)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if r.options.Delete {
+		err = r.deleteExtraneous(entries)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+	err = r.conn.write(message{Stats: &r.stats}, true)
+	if err != nil {
+		return Stats{}, err
+	}
+	return r.stats, nil
+}
+
+// receiveDeltas sends the signatures of the pending files while it applies
+// the deltas from the sender, so neither side blocks on a full connection.
+func (r *receiver) receiveDeltas(ctx context.Context, files map[string]entry, pending []entry) error {
+	ctx, cancel := context.WithCancel(ctx)
+	signaturesDone := make(chan error, 1)
+	go func() {
+		signaturesDone <- r.sendSignatures(ctx, pending)
+	}()
+	err := r.applyDeltas(files)
+	if err != nil {
+		cancel()
+		// The signatures might be blocked on a write that fails once
+		// the connection is closed, so they aren't waited on.
+		return err
+	}
+	defer cancel()
+	return <-signaturesDone
+}
+
+func (r *receiver) applyDeltas(files map[string]entry) error {
+	for {
+		msg, err := r.conn.read()
+		if err != nil {
+			return err
+		}
+		if msg.EndDeltas {
+			return nil
+		}
+		if msg.Delta == nil {
+			return xerrors.New("unexpected message")
+		}
+		e, ok := files[msg.Delta.Path]
+		if !ok {
+			return xerrors.Errorf("unexpected delta for %q", msg.Delta.Path)
+		}
+		err = r.applyDelta(e, *msg.Delta)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// validPath returns whether a path from the sender is inside the root.
+func validPath(name string) bool {
+	if name == "" || path.IsAbs(name) || strings.Contains(name, "\\") {
+		return false
+	}
+	clean := path.Clean(name)
+	return clean == name && clean != "." && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+func (r *receiver) local(name string) string {
+	return filepath.Join(r.root, filepath.FromSlash(name))
+}
+
+func (r *receiver) lstat(name string) (fs.FileInfo, error) {
+	if lstater, ok := r.fs.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(name)
+		return info, err
+	}
+	return r.fs.Stat(name)
+}
+
+// checkParents returns an error if a parent of an entry is a symbolic link
+// on the receiver, so links from the sender can't be used to write outside
+// of the root.
+func (r *receiver) checkParents(name string) error {
+	dir := path.Dir(name)
+	var parts []string
+	for dir != "." {
+		parts = append(parts, dir)
+		dir = path.Dir(dir)
+	}
+	for i := len(parts) - 1; i >= 0; i-- {
+		if _, ok := r.checkedDirs[parts[i]]; ok {
+			continue
+		}
+		info, err := r.lstat(r.local(parts[i]))
+		if err != nil {
+			return xerrors.Errorf("stat %q: %w", parts[i], err)
+		}
+		if !info.IsDir() {
+			return xerrors.Errorf("parent %q of %q isn't a directory", parts[i], name)
+		}
+		r.checkedDirs[parts[i]] = struct{}{}
+	}
+	return nil
+}
+
+// prepare creates directories and links, and returns whether a file needs
+// to be updated.
+func (r *receiver) prepare(e entry) (bool, error) {
+	err := r.checkParents(e.Path)
+	if err != nil {
+		return false, err
+	}
+	name := r.local(e.Path)
+	info, err := r.lstat(name)
+	if err != nil && !xerrors.Is(err, os.ErrNotExist) {
+		return false, xerrors.Errorf("stat %q: %w", e.Path, err)
+	}
+	exists := err == nil
+	if exists && info.Mode().Type() != e.Mode.Type() {
+		// The type changed, like a directory that became a file.
+		err = r.fs.RemoveAll(name)
+		if err != nil {
+			return false, xerrors.Errorf("remove %q: %w", e.Path, err)
+		}
+		exists = false
+	}
+
+	switch {
+	case e.Mode.IsDir():
+		if !exists {
+			err = r.fs.Mkdir(name, e.Mode.Perm())
+			if err != nil {
+				return false, xerrors.Errorf("create directory %q: %w", e.Path, err)
+			}
+		} else if info.Mode().Perm() != e.Mode.Perm() {
+			err = r.fs.Chmod(name, e.Mode.Perm())
+			if err != nil {
+				return false, xerrors.Errorf("chmod %q: %w", e.Path, err)
+			}
+		}
+		return false, nil
+	case e.Mode&fs.ModeSymlink != 0:
+		linker, ok := r.fs.(afero.Symlinker)
+		if !ok {
+			return false, xerrors.Errorf("symbolic link %q isn't supported", e.Path)
+		}
+		if exists {
+			target, err := linker.ReadlinkIfPossible(name)
+			if err == nil && target == e.LinkTarget {
+				return false, nil
+			}
+			err = r.fs.Remove(name)
+			if err != nil {
+				return false, xerrors.Errorf("remove %q: %w", e.Path, err)
+			}
+		}
+		err = linker.SymlinkIfPossible(e.LinkTarget, name)
+		if err != nil {
+			return false, xerrors.Errorf("create link %q: %w", e.Path, err)
+		}
+		return false, nil
+	default:
+		if !exists {
+			return true, nil
+		}
+		if info.Size() == e.Size && info.ModTime().Unix() == e.ModTime.Unix() {
+			if info.Mode().Perm() != e.Mode.Perm() {
+				err = r.fs.Chmod(name, e.Mode.Perm())
+				if err != nil {
+					return false, xerrors.Errorf("chmod %q: %w", e.Path, err)
+				}
+			}
+			return false, nil
+		}
+		return true, nil
+	}
+}
+
+func (r *receiver) sendSignatures(ctx context.Context, pending []entry) error {
+	for _, e := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sig, err := r.signature(e)
+		if err != nil {
+			return err
+		}
+		r.signaturesMutex.Lock()
+		r.signatures[e.Path] = sig
+		r.signaturesMutex.Unlock()
+		err = r.conn.write(message{Signature: &sig}, false)
+		if err != nil {
+			return err
+		}
+	}
+	return r.conn.write(message{EndSignatures: true}, true)
+}
+
+func (r *receiver) signature(e entry) (signature, error) {
+	sig := signature{Path: e.Path}
+	file, err := r.fs.Open(r.local(e.Path))
+	if xerrors.Is(err, os.ErrNotExist) {
+		return sig, nil
+	}
+	if err != nil {
+		return signature{}, xerrors.Errorf("open %q: %w", e.Path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return signature{}, xerrors.Errorf("stat %q: %w", e.Path, err)
+	}
+	sig.Size = info.Size()
+	sig.Blocks, sig.BlockSize, err = computeSignature(file, sig.Size)
+	if err != nil {
+		return signature{}, xerrors.Errorf("read %q: %w", e.Path, err)
+	}
+	return sig, nil
+}
+
+func (r *receiver) applyDelta(e entry, d delta) error {
+	if r.current == nil || r.current.entry.Path != d.Path {
+		if r.current != nil {
+			return xerrors.Errorf("delta for %q started before %q was done", d.Path, r.current.entry.Path)
+		}
+		err := r.startFile(e)
+		if err != nil {
+			return err
+		}
+	}
+	current := r.current
+	for _, op := range d.Operations {
+		data := op.Data
+		if op.Block >= 0 {
+			if current.base == nil || op.Block >= len(current.sig.Blocks) {
+				return xerrors.Errorf("invalid block %d of %q", op.Block, d.Path)
+			}
+			length := int64(current.sig.BlockSize)
+			offset := int64(op.Block) * length
+			if op.Block == len(current.sig.Blocks)-1 {
+				length = current.sig.Size - offset
+			}
+			data = make([]byte, length)
+			_, err := current.base.ReadAt(data, offset)
+			if err != nil && !(xerrors.Is(err, io.EOF) && offset+length == current.sig.Size) {
+				return xerrors.Errorf("read block %d of %q: %w", op.Block, d.Path, err)
+			}
+			r.stats.MatchedBytes += length
+		} else {
+			r.stats.LiteralBytes += int64(len(data))
+		}
+		_, err := current.temp.Write(data)
+		if err != nil {
+			return xerrors.Errorf("write %q: %w", d.Path, err)
+		}
+		_, _ = current.hash.Write(data)
+	}
+	if !d.Final {
+		return nil
+	}
+	return r.finishFile(d.SHA256)
+}
+
+func (r *receiver) startFile(e entry) error {
+	r.signaturesMutex.Lock()
+	sig, ok := r.signatures[e.Path]
+	r.signaturesMutex.Unlock()
+	if !ok {
+		return xerrors.Errorf("unexpected delta for %q", e.Path)
+	}
+	name := r.local(e.Path)
+	current := &pendingFile{
+		entry: e,
+		sig:   sig,
+	}
+	if len(sig.Blocks) > 0 {
+		base, err := r.fs.Open(name)
+		if err != nil {
+			return xerrors.Errorf("open %q: %w", e.Path, err)
+		}
+		current.base = base
+	}
+	temp, err := afero.TempFile(r.fs, filepath.Dir(name), "."+filepath.Base(name)+".coder-sync-*")
+	if err != nil {
+		current.close(r.fs)
+		return xerrors.Errorf("create temporary file for %q: %w", e.Path, err)
+	}
+	current.temp = temp
+	hash := sha256.New()
+	current.hash = hash
+	current.sum = func() []byte { return hash.Sum(nil) }
+	r.current = current
+	return nil
+}
+
+func (r *receiver) finishFile(sum []byte) error {
+	current := r.current
+	r.current = nil
+	if !bytes.Equal(current.sum(), sum) {
+		current.close(r.fs)
+		return xerrors.Errorf("checksum of %q doesn't match", current.entry.Path)
+	}
+	if current.base != nil {
+		_ = current.base.Close()
+		current.base = nil
+	}
+	tempName := current.temp.Name()
+	err := current.temp.Close()
+	current.temp = nil
+	if err != nil {
+		_ = r.fs.Remove(tempName)
+		return xerrors.Errorf("close %q: %w", current.entry.Path, err)
+	}
+	name := r.local(current.entry.Path)
+	err = r.fs.Chmod(tempName, current.entry.Mode.Perm())
+	if err == nil {
+		err = r.fs.Chtimes(tempName, current.entry.ModTime, current.entry.ModTime)
+	}
+	if err == nil {
+		err = r.fs.Rename(tempName, name)
+	}
+	if err != nil {
+		_ = r.fs.Remove(tempName)
+		return xerrors.Errorf("replace %q: %w", current.entry.Path, err)
+	}
+	r.stats.Transferred++
+	return nil
+}
+
+// close discards a file that wasn't finished.
+func (p *pendingFile) close(fsys afero.Fs) {
+	if p.base != nil {
+		_ = p.base.Close()
+	}
+	if p.temp != nil {
+		name := p.temp.Name()
+		_ = p.temp.Close()
+		_ = fsys.Remove(name)
+	}
+}
+
+// deleteExtraneous removes the files and directories under the root that the
+// sender doesn't have.
+func (r *receiver) deleteExtraneous(entries []entry) error {
+	keep := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		keep[e.Path] = struct{}{}
+	}
+	var extraneous []string
+	err := afero.Walk(r.fs, r.root, func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(r.root, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := keep[rel]; ok {
+			return nil
+		}
+		extraneous = append(extraneous, name)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return xerrors.Errorf("walk %q: %w", r.root, err)
+	}
+	sort.Strings(extraneous)
+	for _, name := range extraneous {
+		err = r.fs.RemoveAll(name)
+		if err != nil {
+			return xerrors.Errorf("remove %q: %w", name, err)
+		}
+		r.stats.Deleted++
+	}
+	return nil
+}
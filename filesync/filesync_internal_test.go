@@ -0,0 +1,97 @@
+package filesync
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/testutil"
+)
+
+func TestValidPath(t *testing.T) {
+	t.Parallel()
+
+	for name, valid := range map[string]bool{
+		"file":        true,
+		"dir/file":    true,
+		".hidden":     true,
+		"":            false,
+		".":           false,
+		"..":          false,
+		"../file":     false,
+		"dir/../file": false,
+		"/file":       false,
+		"dir//file":   false,
+		"dir/":        false,
+		"dir\\file":   false,
+	} {
+		require.Equal(t, valid, validPath(name), name)
+	}
+}
+
+// TestReceiveOutsideRoot ensures a sender can't write outside of the root,
+// even if it doesn't walk a tree like Send.
+func TestReceiveOutsideRoot(t *testing.T) {
+	t.Parallel()
+
+	for name, entries := range map[string][]entry{
+		"Parent": {{
+			Path: "../escape",
+			Mode: 0o644,
+		}},
+		"Symlink": {{
+			Path:       "link",
+			Mode:       fs.ModeSymlink | 0o777,
+			LinkTarget: "/",
+		}, {
+			Path: "link/escape",
+			Mode: 0o644,
+		}},
+	} {
+		entries := entries
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+			defer cancel()
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				c := newConn(client)
+				for i := range entries {
+					_ = c.write(message{Entry: &entries[i]}, false)
+				}
+				_ = c.write(message{EndEntries: true}, true)
+				_, _ = c.read()
+				_ = client.Close()
+			}()
+			_, err := Receive(ctx, server, symlinkFs{afero.NewMemMapFs()}, "/root", Options{})
+			require.Error(t, err)
+		})
+	}
+}
+
+// symlinkFs records symbolic links as files, since the memory filesystem
+// doesn't support them.
+type symlinkFs struct {
+	afero.Fs
+}
+
+func (s symlinkFs) SymlinkIfPossible(oldname, newname string) error {
+	return afero.WriteFile(s.Fs, newname, []byte(oldname), 0o777)
+}
+
+func (s symlinkFs) ReadlinkIfPossible(name string) (string, error) {
+	data, err := afero.ReadFile(s.Fs, name)
+	return string(data), err
+}
+
+func (s symlinkFs) LstatIfPossible(name string) (fs.FileInfo, bool, error) {
+	info, err := s.Fs.Stat(name)
+	return info, false, err
+}
@@ -0,0 +1,198 @@
+package filesync_test
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+
+	"github.com/coder/coder/filesync"
+	"github.com/coder/coder/testutil"
+)
+
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Tree", func(t *testing.T) {
+		t.Parallel()
+		src := afero.NewMemMapFs()
+		writeFile(t, src, "/src/a.txt", []byte("hello"))
+		writeFile(t, src, "/src/dir/b.txt", []byte("world"))
+		require.NoError(t, src.MkdirAll("/src/empty", 0o755))
+		dst := afero.NewMemMapFs()
+
+		stats := syncDirs(t, src, "/src", dst, "/dst", filesync.Options{})
+		require.Equal(t, 2, stats.Files)
+		require.Equal(t, 2, stats.Transferred)
+		require.Equal(t, int64(10), stats.LiteralBytes)
+		requireFile(t, dst, "/dst/a.txt", []byte("hello"))
+		requireFile(t, dst, "/dst/dir/b.txt", []byte("world"))
+		info, err := dst.Stat("/dst/empty")
+		require.NoError(t, err)
+		require.True(t, info.IsDir())
+
+		// Files that match aren't sent again.
+		stats = syncDirs(t, src, "/src", dst, "/dst", filesync.Options{})
+		require.Equal(t, 2, stats.Files)
+		require.Equal(t, 0, stats.Transferred)
+		require.Zero(t, stats.LiteralBytes)
+	})
+
+	t.Run("Delta", func(t *testing.T) {
+		t.Parallel()
+		data := make([]byte, 1<<20)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+		dst := afero.NewMemMapFs()
+		writeFile(t, dst, "/dst/large", data)
+
+		// Insert and change data in the middle of the file, so the
+		// blocks after the change are at different offsets.
+		changed := append([]byte(nil), data[:300000]...)
+		changed = append(changed, []byte("inserted")...)
+		changed = append(changed, data[300000:]...)
+		copy(changed[700000:], "changed")
+		src := afero.NewMemMapFs()
+		writeFile(t, src, "/src/large", changed)
+		modTime := time.Now().Add(time.Hour)
+		require.NoError(t, src.Chtimes("/src/large", modTime, modTime))
+
+		stats := syncDirs(t, src, "/src", dst, "/dst", filesync.Options{})
+		require.Equal(t, 1, stats.Transferred)
+		require.Equal(t, int64(len(changed)), stats.LiteralBytes+stats.MatchedBytes)
+		require.Less(t, stats.LiteralBytes, int64(16<<10))
+		requireFile(t, dst, "/dst/large", changed)
+		info, err := dst.Stat("/dst/large")
+		require.NoError(t, err)
+		require.Equal(t, modTime.Unix(), info.ModTime().Unix())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		t.Parallel()
+		src := afero.NewMemMapFs()
+		writeFile(t, src, "/src/keep", []byte("keep"))
+		dst := afero.NewMemMapFs()
+		writeFile(t, dst, "/dst/keep", []byte("old"))
+		writeFile(t, dst, "/dst/extra", []byte("extra"))
+		writeFile(t, dst, "/dst/dir/extra", []byte("extra"))
+
+		stats := syncDirs(t, src, "/src", dst, "/dst", filesync.Options{})
+		require.Zero(t, stats.Deleted)
+		requireFile(t, dst, "/dst/extra", []byte("extra"))
+
+		stats = syncDirs(t, src, "/src", dst, "/dst", filesync.Options{Delete: true})
+		require.Equal(t, 2, stats.Deleted)
+		requireFile(t, dst, "/dst/keep", []byte("keep"))
+		_, err := dst.Stat("/dst/extra")
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = dst.Stat("/dst/dir")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("TypeChanged", func(t *testing.T) {
+		t.Parallel()
+		src := afero.NewMemMapFs()
+		writeFile(t, src, "/src/name", []byte("file"))
+		dst := afero.NewMemMapFs()
+		writeFile(t, dst, "/dst/name/nested", []byte("nested"))
+
+		stats := syncDirs(t, src, "/src", dst, "/dst", filesync.Options{})
+		require.Equal(t, 1, stats.Transferred)
+		requireFile(t, dst, "/dst/name", []byte("file"))
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("symbolic links require privileges on Windows")
+		}
+		srcDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, "target"), []byte("target"), 0o600))
+		require.NoError(t, os.Symlink("target", filepath.Join(srcDir, "link")))
+		dstDir := filepath.Join(t.TempDir(), "dst")
+
+		fs := afero.NewOsFs()
+		stats := syncDirs(t, fs, srcDir, fs, dstDir, filesync.Options{})
+		require.Equal(t, 1, stats.Files)
+		target, err := os.Readlink(filepath.Join(dstDir, "link"))
+		require.NoError(t, err)
+		require.Equal(t, "target", target)
+	})
+
+	t.Run("NotDirectory", func(t *testing.T) {
+		t.Parallel()
+		src := afero.NewMemMapFs()
+		writeFile(t, src, "/src", []byte("file"))
+		dst := afero.NewMemMapFs()
+
+		sendErr, receiveErr := syncErr(t, src, "/src", dst, "/dst", filesync.Options{})
+		require.ErrorContains(t, sendErr, "isn't a directory")
+		require.ErrorContains(t, receiveErr, "isn't a directory")
+	})
+}
+
+func writeFile(t *testing.T, fs afero.Fs, name string, data []byte) {
+	t.Helper()
+	require.NoError(t, fs.MkdirAll(filepath.Dir(name), 0o755))
+	require.NoError(t, afero.WriteFile(fs, name, data, 0o644))
+}
+
+func requireFile(t *testing.T, fs afero.Fs, name string, data []byte) {
+	t.Helper()
+	got, err := afero.ReadFile(fs, name)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func syncDirs(t *testing.T, src afero.Fs, srcRoot string, dst afero.Fs, dstRoot string, options filesync.Options) filesync.Stats {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sent := make(chan filesync.Stats, 1)
+	go func() {
+		stats, err := filesync.Send(ctx, client, src, srcRoot)
+		if err != nil {
+			t.Errorf("send: %s", err)
+		}
+		sent <- stats
+	}()
+	stats, err := filesync.Receive(ctx, server, dst, dstRoot, options)
+	require.NoError(t, err)
+	require.Equal(t, stats, <-sent)
+	return stats
+}
+
+func syncErr(t *testing.T, src afero.Fs, srcRoot string, dst afero.Fs, dstRoot string, options filesync.Options) (error, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := filesync.Send(ctx, client, src, srcRoot)
+		_ = client.Close()
+		sent <- err
+	}()
+	_, err := filesync.Receive(ctx, server, dst, dstRoot, options)
+	_ = server.Close()
+	return <-sent, err
+}
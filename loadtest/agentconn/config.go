@@ -25,6 +25,9 @@ type Config struct {
 	// 0, the connection will be closed immediately after making each request
 	// once.
 	HoldDuration httpapi.Duration `json:"hold_duration"`
+	// ExperimentalQUIC makes connections to services over QUIC streams when
+	// the agent supports it, so latency can be compared with TCP.
+	ExperimentalQUIC bool `json:"experimental_quic"`
 
 	// Connections is the list of connections to make to services running
 	// inside the workspace. Only HTTP connections are supported.
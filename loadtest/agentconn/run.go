@@ -61,11 +61,15 @@ func (r *Runner) Run(ctx context.Context, _ string, logs io.Writer) error {
 	case ConnectionModeDerp:
 		_, _ = fmt.Fprintln(logs, "\tUsing proxied DERP connection through coder server...")
 	}
+	if r.cfg.ExperimentalQUIC {
+		_, _ = fmt.Fprintln(logs, "\tUsing QUIC for service connections if available...")
+	}
 
 	conn, err := r.client.DialWorkspaceAgent(ctx, r.cfg.AgentID, &codersdk.DialWorkspaceAgentOptions{
 		Logger: logger.Named("agentconn"),
 		// If the config requested DERP, then force DERP.
-		BlockEndpoints: r.cfg.ConnectionMode == ConnectionModeDerp,
+		BlockEndpoints:   r.cfg.ConnectionMode == ConnectionModeDerp,
+		ExperimentalQUIC: r.cfg.ExperimentalQUIC,
 	})
 	if err != nil {
 		return xerrors.Errorf("dial workspace agent: %w", err)
@@ -270,6 +274,7 @@ func performInitialConnections(ctx context.Context, logs io.Writer, conn *coders
 			return xerrors.Errorf("create request: %w", err)
 		}
 
+		start := time.Now()
 		res, err := client.Do(req)
 		cancel()
 		if err != nil {
@@ -278,7 +283,7 @@ func performInitialConnections(ctx context.Context, logs io.Writer, conn *coders
 		}
 		_ = res.Body.Close()
 
-		_, _ = fmt.Fprintln(logs, "\t\tOK")
+		_, _ = fmt.Fprintf(logs, "\t\tOK (%s)\n", time.Since(start))
 	}
 
 	return nil
@@ -320,6 +325,7 @@ func holdConnection(ctx context.Context, logs io.Writer, conn *codersdk.AgentCon
 						return xerrors.Errorf("create request: %w", err)
 					}
 
+					start := time.Now()
 					res, err := client.Do(req)
 					cancel()
 					if err != nil {
@@ -328,7 +334,7 @@ func holdConnection(ctx context.Context, logs io.Writer, conn *codersdk.AgentCon
 					}
 					res.Body.Close()
 
-					_, _ = fmt.Fprintf(logs, "\tOK: %s (%d)\n", connSpec.URL, i)
+					_, _ = fmt.Fprintf(logs, "\tOK: %s (%d) in %s\n", connSpec.URL, i, time.Since(start))
 					t.Reset(time.Duration(connSpec.Interval))
 				}
 			}
@@ -375,7 +381,8 @@ func agentHTTPClient(conn *codersdk.AgentConn) *http.Client {
 				if err != nil {
 					return nil, xerrors.Errorf("parse port %q: %w", port, err)
 				}
-				return conn.DialContextTCP(ctx, netip.AddrPortFrom(codersdk.TailnetIP, uint16(portUint)))
+				// DialContext uses QUIC if it's enabled on the connection.
+				return conn.DialContext(ctx, "tcp", netip.AddrPortFrom(codersdk.TailnetIP, uint16(portUint)).String())
 			},
 		},
 	}
@@ -46,6 +46,11 @@ type Process interface {
 
 	// Kill the command process.  Returned error is as for os.Process.Kill()
 	Kill() error
+
+	// Signal sends a signal to the command, like a terminal would. An
+	// interrupt is delivered to the foreground process group on POSIX
+	// systems, and as a Ctrl+C console event on Windows.
+	Signal(sig os.Signal) error
 }
 
 // WithFlags represents a PTY whose flags can be inspected, in particular
@@ -57,6 +62,17 @@ type WithFlags interface {
 	EchoEnabled() (bool, error)
 }
 
+// WithHangup represents a PTY whose TTY can be closed by the parent while
+// the PTY is still read, so reading the output ends once the processes that
+// were started with it exit.
+type WithHangup interface {
+	PTY
+
+	// Hangup closes the TTY held by the parent. Writing to the output
+	// fails afterwards.
+	Hangup() error
+}
+
 // Options represents a an option for a PTY.
 type Option func(*ptyOptions)
 
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"runtime"
 	"sync"
+	"syscall"
 
 	"github.com/creack/pty"
 	"github.com/u-root/u-root/pkg/termios"
@@ -50,6 +51,7 @@ func newPty(opt ...Option) (retPTY *otherPty, err error) {
 type otherPty struct {
 	mutex    sync.Mutex
 	closed   bool
+	hungUp   bool
 	err      error
 	pty, tty *os.File
 	opts     ptyOptions
@@ -123,9 +125,11 @@ func (p *otherPty) Close() error {
 	p.closed = true
 
 	err := p.pty.Close()
-	err2 := p.tty.Close()
-	if err == nil {
-		err = err2
+	if !p.hungUp {
+		err2 := p.tty.Close()
+		if err == nil {
+			err = err2
+		}
 	}
 
 	if err != nil {
@@ -137,6 +141,19 @@ func (p *otherPty) Close() error {
 	return err
 }
 
+// Hangup closes the TTY, so reading from the PTY fails once other processes
+// close it too, after the output they wrote is read.
+func (p *otherPty) Hangup() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed || p.hungUp {
+		return nil
+	}
+	p.hungUp = true
+	return p.tty.Close()
+}
+
 type otherProcess struct {
 	pty *os.File
 	cmd *exec.Cmd
@@ -155,6 +172,36 @@ func (p *otherProcess) Kill() error {
 	return p.cmd.Process.Kill()
 }
 
+// Signal sends sig to the foreground process group of the TTY, like the
+// line discipline does for Ctrl+C, so a program run by a shell receives it
+// rather than the shell.
+func (p *otherProcess) Signal(sig os.Signal) error {
+	unixSig, ok := sig.(syscall.Signal)
+	if !ok {
+		return xerrors.Errorf("unsupported signal %s", sig)
+	}
+	// The process group could be reused after the command exits.
+	select {
+	case <-p.cmdDone:
+		return os.ErrProcessDone
+	default:
+	}
+	// Fd() would put the PTY into blocking mode, so reads couldn't be
+	// interrupted by closing it.
+	var pgrp int
+	if rawConn, err := p.pty.SyscallConn(); err == nil {
+		_ = rawConn.Control(func(fd uintptr) {
+			pgrp, _ = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+		})
+	}
+	if pgrp <= 0 {
+		// The command leads its own process group, since it's started
+		// in a new session.
+		pgrp = p.cmd.Process.Pid
+	}
+	return unix.Kill(-pgrp, unixSig)
+}
+
 func (p *otherProcess) waitInternal() {
 	// The GC can garbage collect the TTY FD before the command
 	// has finished running. See:
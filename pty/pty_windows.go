@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"syscall"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -52,12 +53,12 @@ func newPty(opt ...Option) (PTY, error) {
 		return nil, err
 	}
 
-	consoleSize := uintptr(80) + (uintptr(80) << 16)
+	width, height := 80, 24
 	if opts.sshReq != nil {
-		consoleSize = uintptr(opts.sshReq.Window.Width) + (uintptr(opts.sshReq.Window.Height) << 16)
+		width, height = opts.sshReq.Window.Width, opts.sshReq.Window.Height
 	}
 	ret, _, err := procCreatePseudoConsole.Call(
-		consoleSize,
+		consoleSize(uint16(height), uint16(width)),
 		uintptr(pty.inputRead.Fd()),
 		uintptr(pty.outputWrite.Fd()),
 		0,
@@ -88,6 +89,54 @@ type windowsProcess struct {
 	cmdDone chan any
 	cmdErr  error
 	proc    *os.Process
+	// input is the input of the pseudo console, which interrupts are
+	// written to.
+	input *os.File
+
+	// job holds the process and its children, so they're killed
+	// together. It's closed once the process exits.
+	jobMutex sync.Mutex
+	job      windows.Handle
+}
+
+// newJob creates a job object that kills its processes when it's closed,
+// so the children of a command don't outlive it. Windows doesn't respect
+// exec.CommandContext for processes started in a pseudo console, and
+// killing only the process would leave its children running.
+func newJob() (windows.Handle, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return 0, xerrors.Errorf("create job object: %w", err)
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		_ = windows.CloseHandle(job)
+		return 0, xerrors.Errorf("set job object information: %w", err)
+	}
+	return job, nil
+}
+
+// consoleSize packs a size into the COORD that the pseudo console APIs
+// take by value. The pseudo console can't be empty, so zero sizes, which
+// some SSH clients send, are raised to one.
+func consoleSize(height uint16, width uint16) uintptr {
+	if height == 0 {
+		height = 1
+	}
+	if width == 0 {
+		width = 1
+	}
+	// Taken from: https://github.com/microsoft/hcsshim/blob/54a5ad86808d761e3e396aff3e2022840f39f9a8/internal/winapi/zsyscall_windows.go#L144
+	return uintptr(*((*uint32)(unsafe.Pointer(&windows.Coord{
+		Y: int16(height),
+		X: int16(width),
+	}))))
 }
 
 // Name returns the TTY name on Windows.
@@ -112,13 +161,17 @@ func (p *ptyWindows) Input() ReadWriter {
 }
 
 func (p *ptyWindows) Resize(height uint16, width uint16) error {
-	// Taken from: https://github.com/microsoft/hcsshim/blob/54a5ad86808d761e3e396aff3e2022840f39f9a8/internal/winapi/zsyscall_windows.go#L144
-	ret, _, err := procResizePseudoConsole.Call(uintptr(p.console), uintptr(*((*uint32)(unsafe.Pointer(&windows.Coord{
-		Y: int16(height),
-		X: int16(width),
-	})))))
+	// The console handle is invalid once it's closed.
+	p.closeMutex.Lock()
+	defer p.closeMutex.Unlock()
+	if p.closed {
+		return xerrors.New("pty: closed")
+	}
+	// ResizePseudoConsole returns an HRESULT rather than setting the last
+	// error.
+	ret, _, _ := procResizePseudoConsole.Call(uintptr(p.console), consoleSize(height, width))
 	if ret != 0 {
-		return err
+		return xerrors.Errorf("resize pseudo console: HRESULT %#x", uint32(ret))
 	}
 	return nil
 }
@@ -135,16 +188,16 @@ func (p *ptyWindows) Close() error {
 	_ = p.inputWrite.Close()
 	_ = p.inputRead.Close()
 
-	ret, _, err := procClosePseudoConsole.Call(uintptr(p.console))
-	if ret < 0 {
-		return xerrors.Errorf("close pseudo console: %w", err)
-	}
-
+	// ClosePseudoConsole doesn't return a result.
+	_, _, _ = procClosePseudoConsole.Call(uintptr(p.console))
 	return nil
 }
 
 func (p *windowsProcess) waitInternal() {
 	defer close(p.cmdDone)
+	// Children that are still running are killed with the job, like
+	// they're hung up on POSIX systems when the terminal closes.
+	defer p.closeJob()
 	state, err := p.proc.Wait()
 	if err != nil {
 		p.cmdErr = err
@@ -161,6 +214,46 @@ func (p *windowsProcess) Wait() error {
 	return p.cmdErr
 }
 
+// Kill terminates the process and its children.
 func (p *windowsProcess) Kill() error {
-	return p.proc.Kill()
+	p.jobMutex.Lock()
+	defer p.jobMutex.Unlock()
+	if p.job == 0 {
+		return p.proc.Kill()
+	}
+	err := windows.TerminateJobObject(p.job, 1)
+	if err != nil {
+		return xerrors.Errorf("terminate job object: %w", err)
+	}
+	return nil
+}
+
+// Signal delivers an interrupt as a Ctrl+C console event to the processes
+// attached to the pseudo console. Windows doesn't have other signals, so
+// termination signals kill the process and its children.
+func (p *windowsProcess) Signal(sig os.Signal) error {
+	switch sig {
+	case os.Interrupt:
+		// The pseudo console turns Ctrl+C input into a console event,
+		// since its input is processed.
+		_, err := p.input.Write([]byte{0x03})
+		if err != nil {
+			return xerrors.Errorf("write interrupt: %w", err)
+		}
+		return nil
+	case os.Kill, syscall.SIGTERM:
+		return p.Kill()
+	default:
+		return xerrors.Errorf("signal %s isn't supported on Windows", sig)
+	}
+}
+
+func (p *windowsProcess) closeJob() {
+	p.jobMutex.Lock()
+	defer p.jobMutex.Unlock()
+	if p.job == 0 {
+		return
+	}
+	_ = windows.CloseHandle(p.job)
+	p.job = 0
 }
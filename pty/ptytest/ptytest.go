@@ -32,8 +32,19 @@ func New(t *testing.T, opts ...pty.Option) *PTY {
 
 func Start(t *testing.T, cmd *exec.Cmd, opts ...pty.StartOption) (*PTY, pty.Process) {
 	t.Helper()
+	return start(t, pty.Start, cmd, opts...)
+}
+
+// StartVirtual starts the command with pty.StartVirtual.
+func StartVirtual(t *testing.T, cmd *exec.Cmd, opts ...pty.StartOption) (*PTY, pty.Process) {
+	t.Helper()
+	return start(t, pty.StartVirtual, cmd, opts...)
+}
+
+func start(t *testing.T, startPTY func(*exec.Cmd, ...pty.StartOption) (pty.PTY, pty.Process, error), cmd *exec.Cmd, opts ...pty.StartOption) (*PTY, pty.Process) {
+	t.Helper()
 
-	ptty, ps, err := pty.Start(cmd, opts...)
+	ptty, ps, err := startPTY(cmd, opts...)
 	require.NoError(t, err)
 	t.Cleanup(func() {
 		_ = ps.Kill()
@@ -1,6 +1,7 @@
 package pty
 
 import (
+	"fmt"
 	"os/exec"
 )
 
@@ -18,6 +19,21 @@ func WithPTYOption(opts ...Option) StartOption {
 	}
 }
 
+// AllocateError is returned by Start when a PTY can't be allocated, e.g.
+// because mandatory access control denies opening /dev/ptmx. The command
+// isn't started, so it can be started without a PTY instead.
+type AllocateError struct {
+	Err error
+}
+
+func (e *AllocateError) Error() string {
+	return fmt.Sprintf("newPty failed: %s", e.Err)
+}
+
+func (e *AllocateError) Unwrap() error {
+	return e.Err
+}
+
 // Start the command in a TTY.  The calling code must not use cmd after passing it to the PTY, and
 // instead rely on the returned Process to manage the command/process.
 func Start(cmd *exec.Cmd, opt ...StartOption) (PTY, Process, error) {
@@ -20,7 +20,7 @@ func startPty(cmd *exec.Cmd, opt ...StartOption) (retPTY *otherPty, proc Process
 
 	opty, err := newPty(opts.ptyOpts...)
 	if err != nil {
-		return nil, nil, xerrors.Errorf("newPty failed: %w", err)
+		return nil, nil, &AllocateError{Err: err}
 	}
 
 	origEnv := cmd.Env
@@ -3,6 +3,7 @@
 package pty_test
 
 import (
+	"os"
 	"os/exec"
 	"testing"
 
@@ -41,6 +42,19 @@ func TestStart(t *testing.T) {
 		assert.NotEqual(t, 0, exitErr.ExitCode())
 	})
 
+	t.Run("Interrupt", func(t *testing.T) {
+		t.Parallel()
+		pty, ps := ptytest.Start(t, exec.Command("sh", "-c", `trap "echo interrupted; exit 3" INT; echo ready; while :; do sleep 0.1; done`))
+		pty.ExpectMatch("ready")
+		err := ps.Signal(os.Interrupt)
+		require.NoError(t, err)
+		pty.ExpectMatch("interrupted")
+		err = ps.Wait()
+		var exitErr *exec.ExitError
+		require.True(t, xerrors.As(err, &exitErr))
+		assert.Equal(t, 3, exitErr.ExitCode())
+	})
+
 	t.Run("SSH_TTY", func(t *testing.T) {
 		t.Parallel()
 		opts := pty.WithPTYOption(pty.WithSSHRequest(ssh.Pty{
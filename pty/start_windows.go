@@ -17,7 +17,7 @@ import (
 
 // Allocates a PTY and starts the specified command attached to it.
 // See: https://docs.microsoft.com/en-us/windows/console/creating-a-pseudoconsole-session#creating-the-hosted-process
-func startPty(cmd *exec.Cmd, opt ...StartOption) (PTY, Process, error) {
+func startPty(cmd *exec.Cmd, opt ...StartOption) (_ PTY, _ Process, retErr error) {
 	var opts startOptions
 	for _, o := range opt {
 		o(&opts)
@@ -47,9 +47,14 @@ func startPty(cmd *exec.Cmd, opt ...StartOption) (PTY, Process, error) {
 	}
 	pty, err := newPty(opts.ptyOpts...)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &AllocateError{Err: err}
 	}
 	winPty := pty.(*ptyWindows)
+	defer func() {
+		if retErr != nil {
+			_ = winPty.Close()
+		}
+	}()
 	if winPty.opts.sshReq != nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_TTY=%s", winPty.Name()))
 	}
@@ -58,12 +63,23 @@ func startPty(cmd *exec.Cmd, opt ...StartOption) (PTY, Process, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	defer attrs.Delete()
 	// Taken from: https://github.com/microsoft/hcsshim/blob/2314362e977aa03b3ed245a4beb12d00422af0e2/internal/winapi/process.go#L6
 	err = attrs.Update(0x20016, unsafe.Pointer(winPty.console), unsafe.Sizeof(winPty.console))
 	if err != nil {
 		return nil, nil, err
 	}
 
+	job, err := newJob()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			_ = windows.CloseHandle(job)
+		}
+	}()
+
 	startupInfo := &windows.StartupInfoEx{}
 	startupInfo.ProcThreadAttributeList = attrs.List()
 	startupInfo.StartupInfo.Flags = windows.STARTF_USESTDHANDLES
@@ -76,7 +92,9 @@ func startPty(cmd *exec.Cmd, opt ...StartOption) (PTY, Process, error) {
 		nil,
 		false,
 		// https://docs.microsoft.com/en-us/windows/win32/procthread/process-creation-flags#create_unicode_environment
-		windows.CREATE_UNICODE_ENVIRONMENT|windows.EXTENDED_STARTUPINFO_PRESENT,
+		// The process is suspended until it's in the job, so children it
+		// starts right away are in the job too.
+		windows.CREATE_UNICODE_ENVIRONMENT|windows.EXTENDED_STARTUPINFO_PRESENT|windows.CREATE_SUSPENDED,
 		createEnvBlock(addCriticalEnv(dedupEnvCase(true, cmd.Env))),
 		dirPtr,
 		&startupInfo.StartupInfo,
@@ -88,13 +106,27 @@ func startPty(cmd *exec.Cmd, opt ...StartOption) (PTY, Process, error) {
 	defer windows.CloseHandle(processInfo.Thread)
 	defer windows.CloseHandle(processInfo.Process)
 
+	err = windows.AssignProcessToJobObject(job, processInfo.Process)
+	if err != nil {
+		_ = windows.TerminateProcess(processInfo.Process, 1)
+		return nil, nil, xerrors.Errorf("assign process to job object: %w", err)
+	}
+	_, err = windows.ResumeThread(processInfo.Thread)
+	if err != nil {
+		_ = windows.TerminateJobObject(job, 1)
+		return nil, nil, xerrors.Errorf("resume process: %w", err)
+	}
+
 	process, err := os.FindProcess(int(processInfo.ProcessId))
 	if err != nil {
+		_ = windows.TerminateJobObject(job, 1)
 		return nil, nil, xerrors.Errorf("find process %d: %w", processInfo.ProcessId, err)
 	}
 	wp := &windowsProcess{
 		cmdDone: make(chan any),
 		proc:    process,
+		input:   winPty.inputWrite,
+		job:     job,
 	}
 	go wp.waitInternal()
 	return pty, wp, nil
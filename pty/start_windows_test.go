@@ -4,10 +4,13 @@
 package pty_test
 
 import (
+	"os"
 	"os/exec"
 	"testing"
+	"time"
 
 	"github.com/coder/coder/pty/ptytest"
+	"github.com/coder/coder/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
@@ -43,4 +46,35 @@ func TestStart(t *testing.T) {
 		require.True(t, xerrors.As(err, &exitErr))
 		assert.NotEqual(t, 0, exitErr.ExitCode())
 	})
+	t.Run("KillTree", func(t *testing.T) {
+		t.Parallel()
+		// cmd.exe and its child are terminated with their job, which
+		// exits them with 1.
+		pty, ps := ptytest.Start(t, exec.Command("cmd.exe", "/c", "ping", "-n", "60", "127.0.0.1"))
+		pty.ExpectMatch("127.0.0.1")
+		err := ps.Kill()
+		assert.NoError(t, err)
+		err = ps.Wait()
+		var exitErr *exec.ExitError
+		require.True(t, xerrors.As(err, &exitErr))
+		assert.Equal(t, 1, exitErr.ExitCode())
+	})
+	t.Run("Interrupt", func(t *testing.T) {
+		t.Parallel()
+		pty, ps := ptytest.Start(t, exec.Command("ping", "-t", "127.0.0.1"))
+		pty.ExpectMatch("127.0.0.1")
+		err := ps.Signal(os.Interrupt)
+		require.NoError(t, err)
+		// ping exits on Ctrl+C.
+		done := make(chan struct{})
+		go func() {
+			_ = ps.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(testutil.WaitShort):
+			t.Fatal("ping wasn't interrupted")
+		}
+	})
 }
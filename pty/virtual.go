@@ -0,0 +1,132 @@
+package pty
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// StartVirtual starts the command with a virtual PTY that's backed by pipes
+// rather than a terminal device. It can replace Start where a PTY can't be
+// allocated, such as containers without /dev/ptmx, and behaves the same on
+// every platform.
+//
+// There is no line discipline: input isn't echoed, control characters aren't
+// interpreted, and resizing only records the window size. Options are
+// accepted for compatibility with Start, but terminal modes aren't applied.
+func StartVirtual(cmd *exec.Cmd, _ ...StartOption) (PTY, Process, error) {
+	inputReader, inputWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("create input pipe: %w", err)
+	}
+	outputReader, outputWriter, err := os.Pipe()
+	if err != nil {
+		_ = inputReader.Close()
+		_ = inputWriter.Close()
+		return nil, nil, xerrors.Errorf("create output pipe: %w", err)
+	}
+	vpty := &virtualPty{
+		inputReader:  inputReader,
+		inputWriter:  inputWriter,
+		outputReader: outputReader,
+		outputWriter: outputWriter,
+	}
+
+	cmd.Stdin = inputReader
+	cmd.Stdout = outputWriter
+	cmd.Stderr = outputWriter
+	err = cmd.Start()
+	if err != nil {
+		_ = vpty.Close()
+		return nil, nil, xerrors.Errorf("start: %w", err)
+	}
+	process := &virtualProcess{
+		cmd:     cmd,
+		cmdDone: make(chan any),
+	}
+	go process.waitInternal()
+	return vpty, process, nil
+}
+
+type virtualPty struct {
+	inputReader, inputWriter   *os.File
+	outputReader, outputWriter *os.File
+
+	mutex         sync.Mutex
+	closed        bool
+	height, width uint16
+}
+
+func (*virtualPty) Name() string {
+	return "virtual"
+}
+
+func (p *virtualPty) Input() ReadWriter {
+	return ReadWriter{
+		Reader: p.inputReader,
+		Writer: p.inputWriter,
+	}
+}
+
+func (p *virtualPty) Output() ReadWriter {
+	return ReadWriter{
+		Reader: p.outputReader,
+		Writer: p.outputWriter,
+	}
+}
+
+func (p *virtualPty) Resize(height uint16, width uint16) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return xerrors.New("pty: closed")
+	}
+	p.height, p.width = height, width
+	return nil
+}
+
+func (p *virtualPty) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var err error
+	for _, f := range []*os.File{p.inputReader, p.inputWriter, p.outputReader, p.outputWriter} {
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type virtualProcess struct {
+	cmd *exec.Cmd
+
+	// cmdDone protects access to cmdErr: anything reading cmdErr should read from cmdDone first.
+	cmdDone chan any
+	cmdErr  error
+}
+
+func (p *virtualProcess) Wait() error {
+	<-p.cmdDone
+	return p.cmdErr
+}
+
+func (p *virtualProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+func (p *virtualProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *virtualProcess) waitInternal() {
+	p.cmdErr = p.cmd.Wait()
+	close(p.cmdDone)
+}
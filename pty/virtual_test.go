@@ -0,0 +1,41 @@
+package pty_test
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/coder/coder/pty/ptytest"
+)
+
+func TestStartVirtual(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("The commands used in these tests aren't available on Windows.")
+	}
+
+	t.Run("Echo", func(t *testing.T) {
+		t.Parallel()
+		pty, ps := ptytest.StartVirtual(t, exec.Command("echo", "test"))
+		pty.ExpectMatch("test")
+		err := ps.Wait()
+		require.NoError(t, err)
+	})
+
+	t.Run("Input", func(t *testing.T) {
+		t.Parallel()
+		pty, ps := ptytest.StartVirtual(t, exec.Command("cat"))
+		pty.WriteLine("hello")
+		pty.ExpectMatch("hello")
+		require.NoError(t, pty.Resize(24, 80))
+		err := ps.Kill()
+		assert.NoError(t, err)
+		err = ps.Wait()
+		var exitErr *exec.ExitError
+		require.True(t, xerrors.As(err, &exitErr))
+	})
+}
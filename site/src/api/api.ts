@@ -646,6 +646,32 @@ export const getAgentListeningPorts = async (
   return response.data
 }
 
+export const getWorkspaceAgentStartupLogs = async (
+  agentID: string,
+  after = 0,
+): Promise<TypesGen.WorkspaceAgentStartupLog[]> => {
+  const response = await axios.get(
+    `/api/v2/workspaceagents/${agentID}/startup-logs?after=${after}`,
+  )
+  return response.data
+}
+
+export const getWorkspaceAgentBootTiming = async (
+  agentID: string,
+): Promise<TypesGen.WorkspaceAgentBootTiming> => {
+  const response = await axios.get(
+    `/api/v2/workspaceagents/${agentID}/boot-timing`,
+  )
+  return response.data
+}
+
+export const getWorkspaceAgentTunnels = async (
+  agentID: string,
+): Promise<TypesGen.WorkspaceAgentTunnel[]> => {
+  const response = await axios.get(`/api/v2/workspaceagents/${agentID}/tunnels`)
+  return response.data
+}
+
 export const getDeploymentConfig =
   async (): Promise<TypesGen.DeploymentConfig> => {
     const response = await axios.get(`/api/v2/config/deployment`)
@@ -18,6 +18,21 @@ export interface AddLicenseRequest {
   readonly license: string
 }
 
+// From codersdk/agentconnectionevents.go
+export interface AgentConnectionEvent {
+  readonly id: string
+  readonly agent_id?: string
+  readonly connection_id: string
+  readonly session_id?: string
+  readonly type: AgentConnectionType
+  readonly action: AgentConnectionAction
+  readonly time: string
+  readonly peer: string
+  readonly user?: string
+  readonly command?: string
+  readonly destination?: string
+}
+
 // From codersdk/gitsshkey.go
 export interface AgentGitSSHKey {
   readonly public_key: string
@@ -31,6 +46,15 @@ export interface AgentStatsReportResponse {
   readonly tx_bytes: number
 }
 
+// From codersdk/workspaceagents.go
+export interface AgentUsage {
+  readonly sftp_sessions: number
+  readonly port_forwards: number
+  readonly reverse_port_forwards: number
+  readonly speedtests: number
+  readonly socks_connections: number
+}
+
 // From codersdk/roles.go
 export interface AssignableRoles extends Role {
   readonly assignable: boolean
@@ -214,6 +238,12 @@ export interface CreateUserRequest {
   readonly organization_id: string
 }
 
+// From codersdk/sshpublickeys.go
+export interface CreateUserSSHPublicKeyRequest {
+  readonly name: string
+  readonly public_key: string
+}
+
 // From codersdk/workspaces.go
 export interface CreateWorkspaceBuildRequest {
   readonly template_version_id?: string
@@ -289,10 +319,14 @@ export interface DeploymentConfig {
   readonly trace: TraceConfig
   readonly secure_auth_cookie: DeploymentConfigField<boolean>
   readonly ssh_keygen_algorithm: DeploymentConfigField<string>
+  readonly ssh_user_ca_key_file: DeploymentConfigField<string>
+  readonly ssh_user_certificate_ttl: DeploymentConfigField<number>
+  readonly ssh_public_key_auth: DeploymentConfigField<boolean>
   readonly auto_import_templates: DeploymentConfigField<string[]>
   readonly metrics_cache_refresh_interval: DeploymentConfigField<number>
   readonly agent_stat_refresh_interval: DeploymentConfigField<number>
   readonly agent_fallback_troubleshooting_url: DeploymentConfigField<string>
+  readonly agent_reconnect_max_interval: DeploymentConfigField<number>
   readonly audit_logging: DeploymentConfigField<boolean>
   readonly browser_only: DeploymentConfigField<boolean>
   readonly scim_api_key: DeploymentConfigField<string>
@@ -300,6 +334,7 @@ export interface DeploymentConfig {
   readonly api_rate_limit: DeploymentConfigField<number>
   readonly experimental: DeploymentConfigField<boolean>
   readonly update_check: DeploymentConfigField<boolean>
+  readonly tunnels: DeploymentConfigField<boolean>
 }
 
 // From codersdk/deploymentconfig.go
@@ -382,9 +417,24 @@ export interface Group {
 
 // From codersdk/workspaceapps.go
 export interface Healthcheck {
+  readonly type?: HealthcheckType
   readonly url: string
   readonly interval: number
   readonly threshold: number
+  readonly healthy_threshold?: number
+  readonly method?: string
+  readonly headers?: Record<string, string>
+  readonly body?: string
+  readonly expected_statuses?: HealthcheckStatusRange[]
+  readonly body_regex?: string
+  readonly insecure_skip_verify?: boolean
+  readonly grpc_service?: string
+}
+
+// From codersdk/workspaceapps.go
+export interface HealthcheckStatusRange {
+  readonly min: number
+  readonly max: number
 }
 
 // From codersdk/licenses.go
@@ -401,6 +451,8 @@ export interface ListeningPort {
   readonly process_name: string
   readonly network: ListeningPortNetwork
   readonly port: number
+  readonly name?: string
+  readonly declared?: boolean
 }
 
 // From codersdk/agentconn.go
@@ -512,6 +564,11 @@ export interface PatchGroupRequest {
   readonly quota_allowance?: number
 }
 
+// From codersdk/workspaceagents.go
+export interface PatchStartupLogs {
+  readonly logs: StartupLog[]
+}
+
 // From codersdk/deploymentconfig.go
 export interface PprofConfig {
   readonly enable: DeploymentConfigField<boolean>
@@ -571,6 +628,38 @@ export interface PutExtendWorkspaceRequest {
   readonly deadline: string
 }
 
+// From codersdk/agentconn.go
+export interface ReconnectingPTYControl {
+  readonly type: ReconnectingPTYControlType
+  readonly height?: number
+  readonly width?: number
+  readonly participants?: ReconnectingPTYParticipant[]
+  readonly participant_id?: string
+  readonly terminals?: ReconnectingPTYInfo[]
+}
+
+// From codersdk/agentconn.go
+export interface ReconnectingPTYInfo {
+  readonly id: string
+  readonly name?: string
+  readonly label?: string
+  readonly command: string
+  readonly started_at: string
+  readonly participants: number
+}
+
+// From codersdk/agentconn.go
+export interface ReconnectingPTYParticipant {
+  readonly id: string
+  readonly name?: string
+  readonly role: ReconnectingPTYRole
+  readonly remote_address: string
+  readonly connected_at: string
+  readonly queued_bytes: number
+  readonly dropped_bytes: number
+  readonly lag_milliseconds: number
+}
+
 // From codersdk/replicas.go
 export interface Replica {
   readonly id: string
@@ -602,6 +691,12 @@ export interface ServerSentEvent {
   readonly data: any
 }
 
+// From codersdk/workspaceagents.go
+export interface StartupLog {
+  readonly created_at: string
+  readonly output: string
+}
+
 // From codersdk/deploymentconfig.go
 export interface TLSConfig {
   readonly enable: DeploymentConfigField<boolean>
@@ -648,6 +743,15 @@ export interface TemplateACL {
   readonly group: TemplateGroup[]
 }
 
+// From codersdk/templateagentsettings.go
+export interface TemplateAgentSettings {
+  readonly disable_direct_connections: boolean
+  readonly quick_actions: WorkspaceAgentQuickAction[]
+  readonly feature_flags: Record<WorkspaceAgentFeatureFlag, boolean>
+  readonly reconnecting_pty_timeout_seconds: number
+  readonly language_servers: WorkspaceAgentLanguageServer[]
+}
+
 // From codersdk/templates.go
 export type TemplateBuildTimeStats = Record<
   WorkspaceTransition,
@@ -783,6 +887,16 @@ export interface UserRoles {
   readonly organization_roles: Record<string, string[]>
 }
 
+// From codersdk/sshpublickeys.go
+export interface UserSSHPublicKey {
+  readonly id: string
+  readonly user_id: string
+  readonly created_at: string
+  readonly name: string
+  readonly public_key: string
+  readonly fingerprint: string
+}
+
 // From codersdk/users.go
 export interface UsersRequest extends Pagination {
   readonly q?: string
@@ -838,6 +952,36 @@ export interface WorkspaceAgent {
   readonly troubleshooting_url: string
 }
 
+// From codersdk/workspaceagents.go
+export interface WorkspaceAgentBootTiming {
+  readonly started_at: string
+  readonly token_exchange_ms?: number
+  readonly metadata_fetch_ms?: number
+  readonly tailnet_up_ms?: number
+  readonly coordinator_connected_ms?: number
+  readonly startup_script_ms?: number
+  readonly first_session_ms?: number
+}
+
+// From codersdk/workspaceagentdrift.go
+export interface WorkspaceAgentDrift {
+  readonly type: WorkspaceAgentDriftType
+  readonly name: string
+  readonly expected: string
+  readonly actual: string
+  readonly error?: string
+}
+
+// From codersdk/workspaceagentdrift.go
+export interface WorkspaceAgentDriftReport {
+  readonly agent_id?: string
+  readonly workspace_id?: string
+  readonly checked_at: string
+  readonly checks: number
+  readonly drifted: boolean
+  readonly drifts: WorkspaceAgentDrift[]
+}
+
 // From codersdk/workspaceagents.go
 export interface WorkspaceAgentGitAuthResponse {
   readonly username: string
@@ -858,6 +1002,46 @@ export interface WorkspaceAgentInstanceMetadata {
   readonly vnc: boolean
 }
 
+// From codersdk/workspaceagents.go
+export interface WorkspaceAgentLanguageServer {
+  readonly name: string
+  readonly command: string
+  readonly directory?: string
+}
+
+// From codersdk/workspaceagents.go
+export interface WorkspaceAgentQuickAction {
+  readonly name: string
+  readonly display_name?: string
+  readonly command: string
+  readonly directory?: string
+  readonly timeout_seconds?: number
+}
+
+// From codersdk/agentconn.go
+export interface WorkspaceAgentQuickActionRun {
+  readonly id: string
+  readonly status: WorkspaceAgentQuickActionRunStatus
+  readonly started_at: string
+  readonly finished_at?: string
+  readonly exit_code?: number
+  readonly output: string
+  readonly output_truncated: boolean
+}
+
+// From codersdk/agentconn.go
+export interface WorkspaceAgentQuickActionState {
+  readonly name: string
+  readonly display_name: string
+  readonly command: string
+  readonly last_run?: WorkspaceAgentQuickActionRun
+}
+
+// From codersdk/agentconn.go
+export interface WorkspaceAgentQuickActionsResponse {
+  readonly quick_actions: WorkspaceAgentQuickActionState[]
+}
+
 // From codersdk/workspaceagents.go
 export interface WorkspaceAgentResourceMetadata {
   readonly memory_total: number
@@ -867,12 +1051,62 @@ export interface WorkspaceAgentResourceMetadata {
   readonly cpu_mhz: number
 }
 
+// From codersdk/agentconn.go
+export interface WorkspaceAgentSession {
+  readonly id: string
+  readonly type: WorkspaceAgentSessionType
+  readonly user?: string
+  readonly command?: string
+  readonly peer: string
+  readonly started_at: string
+  readonly bytes_in: number
+  readonly bytes_out: number
+  readonly label?: string
+  readonly title?: string
+  readonly reason_codes?: string[]
+}
+
+// From codersdk/agentconn.go
+export interface WorkspaceAgentSessionsResponse {
+  readonly sessions: WorkspaceAgentSession[]
+}
+
+// From codersdk/workspaceagents.go
+export interface WorkspaceAgentStartupLog {
+  readonly id: number
+  readonly created_at: string
+  readonly output: string
+}
+
+// From codersdk/workspaceagents.go
+export interface WorkspaceAgentTunnel {
+  readonly id: string
+  readonly agent_id: string
+  readonly port: number
+  readonly url: string
+  readonly auth: WorkspaceAgentTunnelAuth
+  readonly created_at: string
+  readonly expires_at: string
+  readonly token?: string
+  readonly traffic: WorkspaceAgentTunnelTraffic
+}
+
+// From codersdk/workspaceagents.go
+export interface WorkspaceAgentTunnelTraffic {
+  readonly requests: number
+  readonly rejected: number
+  readonly bytes_received: number
+  readonly bytes_sent: number
+  readonly last_request_at?: string
+}
+
 // From codersdk/workspaceapps.go
 export interface WorkspaceApp {
   readonly id: string
   readonly slug: string
   readonly display_name: string
   readonly command?: string
+  readonly url?: string
   readonly icon?: string
   readonly subdomain: boolean
   readonly sharing_level: WorkspaceAppSharingLevel
@@ -909,6 +1143,11 @@ export interface WorkspaceBuildsRequest extends Pagination {
   readonly Since: string
 }
 
+// From codersdk/workspaceenvironmentvariables.go
+export interface WorkspaceEnvironmentVariables {
+  readonly variables: Record<string, string>
+}
+
 // From codersdk/workspaces.go
 export interface WorkspaceFilter {
   readonly q?: string
@@ -961,6 +1200,30 @@ export interface WorkspacesResponse {
 // From codersdk/apikey.go
 export type APIKeyScope = "all" | "application_connect"
 
+// From codersdk/agentconnectionevents.go
+export type AgentConnectionAction = "connect" | "disconnect"
+
+// From codersdk/agentconnectionevents.go
+export type AgentConnectionType =
+  | "exec"
+  | "file_sync"
+  | "port_forward"
+  | "reconnecting_pty"
+  | "sftp"
+  | "ssh"
+
+// From codersdk/agentcontrol.go
+export type AgentControlServiceType = "language_server"
+
+// From codersdk/agentcontrol.go
+export type AgentEventType =
+  | "connected"
+  | "disconnected"
+  | "panic"
+  | "started"
+  | "startup_failed"
+  | "stopped"
+
 // From codersdk/audit.go
 export type AuditAction = "create" | "delete" | "start" | "stop" | "write"
 
@@ -970,6 +1233,15 @@ export type BuildReason = "autostart" | "autostop" | "initiator"
 // From codersdk/features.go
 export type Entitlement = "entitled" | "grace_period" | "not_entitled"
 
+// From codersdk/agentconnexec.go
+export type ExecStream = "stderr" | "stdout"
+
+// From codersdk/agentconnfilesync.go
+export type FileSyncDirection = "download" | "upload"
+
+// From codersdk/workspaceapps.go
+export type HealthcheckType = "grpc" | "http"
+
 // From codersdk/agentconn.go
 export type ListeningPortNetwork = "tcp"
 
@@ -1012,6 +1284,18 @@ export type ProvisionerStorageMethod = "file"
 // From codersdk/organizations.go
 export type ProvisionerType = "echo" | "terraform"
 
+// From codersdk/agentconn.go
+export type ReconnectingPTYControlType =
+  | "list"
+  | "participants"
+  | "ping"
+  | "pong"
+  | "resize"
+  | "terminals"
+
+// From codersdk/agentconn.go
+export type ReconnectingPTYRole = "read_only" | "read_write"
+
 // From codersdk/audit.go
 export type ResourceType =
   | "api_key"
@@ -1033,6 +1317,75 @@ export type TemplateRole = "" | "admin" | "use"
 // From codersdk/users.go
 export type UserStatus = "active" | "suspended"
 
+// From codersdk/workspaceagents.go
+export type WorkspaceAgentCapability =
+  | "app-health"
+  | "boot-timing"
+  | "connection-events"
+  | "crash-report"
+  | "declared-ports"
+  | "drift"
+  | "listening-ports"
+  | "metadata-watch"
+  | "startup-logs"
+  | "startup-script-result"
+  | "stats-report"
+
+// From codersdk/agentconn.go
+export type WorkspaceAgentDiagnosticStatus = "failed" | "ok" | "warning"
+
+// From codersdk/workspaceagentdrift.go
+export type WorkspaceAgentDriftType = "environment_variable" | "file" | "tool"
+
+// From codersdk/agenterror.go
+export type WorkspaceAgentErrorCode =
+  | "COMMAND_START_FAILED"
+  | "COORDINATOR_FAILED"
+  | "FILE_DESCRIPTORS_EXHAUSTED"
+  | "METADATA_FETCH_FAILED"
+  | "METADATA_UNAVAILABLE"
+  | "METADATA_UNSUPPORTED"
+  | "PTY_FAILED"
+  | "PTY_INPUT_TOO_LARGE"
+  | "SESSION_DENIED"
+  | "SHELL_LOOKUP_FAILED"
+  | "STARTUP_SCRIPT_FAILED"
+  | "TAILNET_INIT_FAILED"
+  | "TOKEN_EXCHANGE_FAILED"
+  | "TOKEN_INVALID"
+  | "UNKNOWN"
+  | "USER_LOOKUP_FAILED"
+
+// From codersdk/workspaceagents.go
+export type WorkspaceAgentFeatureFlag =
+  | "pty_v2"
+  | "quic"
+  | "screen_snapshot_reconnect"
+
+// From codersdk/agentconn.go
+export type WorkspaceAgentQuickActionRunStatus =
+  | "failed"
+  | "running"
+  | "succeeded"
+  | "timed_out"
+
+// From codersdk/agentconn.go
+export type WorkspaceAgentSessionType =
+  | "exec"
+  | "quick_action"
+  | "reconnecting_pty"
+  | "sftp"
+  | "ssh"
+
+// From codersdk/workspaceagentstartupscript.go
+export type WorkspaceAgentStartupScriptFailurePolicy = "block" | "warn"
+
+// From codersdk/workspaceagentstartupscript.go
+export type WorkspaceAgentStartupScriptState = "failed" | "ok" | "timed_out"
+
+// From codersdk/agentconn.go
+export type WorkspaceAgentStartupState = "error" | "ready" | "running"
+
 // From codersdk/workspaceagents.go
 export type WorkspaceAgentStatus =
   | "connected"
@@ -1040,6 +1393,9 @@ export type WorkspaceAgentStatus =
   | "disconnected"
   | "timeout"
 
+// From codersdk/workspaceagents.go
+export type WorkspaceAgentTunnelAuth = "public" | "token"
+
 // From codersdk/workspaceapps.go
 export type WorkspaceAppHealth =
   | "disabled"
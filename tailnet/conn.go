@@ -5,10 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/netip"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -34,6 +35,7 @@ import (
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/wgcfg"
 	"tailscale.com/wgengine/wgcfg/nmcfg"
 
 	"cdr.dev/slog"
@@ -60,6 +62,12 @@ type Options struct {
 	// ExtractTrafficStats must be called to reset the counters and be
 	// periodically called while enabled to avoid unbounded memory use.
 	EnableTrafficStats bool
+
+	// KeepAliveInterval overrides the WireGuard persistent keepalive
+	// interval used for active peers. Defaults to 25 seconds.
+	KeepAliveInterval time.Duration
+	// DisableKeepAlive disables WireGuard persistent keepalives.
+	DisableKeepAlive bool
 }
 
 // NewConn constructs a new Wireguard server that will accept connections from the addresses provided.
@@ -187,7 +195,8 @@ func NewConn(options *Options) (*Conn, error) {
 	wireguardEngine.SetFilter(filter.New(netMap.PacketFilter, localIPs, logIPs, nil, Logger(options.Logger.Named("packet-filter"))))
 	dialContext, dialCancel := context.WithCancel(context.Background())
 	server := &Conn{
-		blockEndpoints:   options.BlockEndpoints,
+		keepAlive:        options.KeepAliveInterval,
+		disableKeepAlive: options.DisableKeepAlive,
 		dialContext:      dialContext,
 		dialCancel:       dialCancel,
 		closed:           make(chan struct{}),
@@ -204,7 +213,9 @@ func NewConn(options *Options) (*Conn, error) {
 			LocalAddrs: netMap.Addresses,
 		},
 		wireguardEngine: wireguardEngine,
+		derpHealth:      newDERPHealth(),
 	}
+	server.blockEndpoints.Store(options.BlockEndpoints)
 	wireguardEngine.SetStatusCallback(func(s *wgengine.Status, err error) {
 		server.logger.Debug(context.Background(), "wireguard status", slog.F("status", s), slog.F("err", err))
 		if err != nil {
@@ -221,8 +232,11 @@ func NewConn(options *Options) (*Conn, error) {
 		for _, addr := range s.LocalAddrs {
 			server.lastEndpoints = append(server.lastEndpoints, addr.Addr.String())
 		}
+		server.lastCGNAT = endpointsBehindCGNAT(s.LocalAddrs)
+		server.lastCLAT = endpointsBehindCLAT(s.LocalAddrs)
 		server.lastMutex.Unlock()
 		server.sendNode()
+		server.updateNATInfo()
 	})
 	wireguardEngine.SetNetInfoCallback(func(ni *tailcfg.NetInfo) {
 		server.logger.Debug(context.Background(), "netinfo callback", slog.F("netinfo", ni))
@@ -239,10 +253,25 @@ func NewConn(options *Options) (*Conn, error) {
 		server.lastNetInfo = asOf
 		server.lastPreferredDERP = ni.PreferredDERP
 		server.lastDERPLatency = ni.DERPLatency
+		families := netInfoIPFamilies(ni)
+		familiesChanged := families != server.lastIPFamilies
+		server.lastIPFamilies = families
 		server.lastMutex.Unlock()
+		if familiesChanged {
+			server.logger.Info(context.Background(), "detected ip families",
+				slog.F("families", families.String()),
+				slog.F("ipv4", families.IPv4),
+				slog.F("ipv6", families.IPv6),
+			)
+		}
 		server.sendNode()
+		server.updatePreferredDERP(ni.PreferredDERP)
+		// NetInfo changes when netcheck runs, which happens when
+		// the network changes.
+		server.probeNAT64()
 	})
 	netStack.ForwardTCPIn = server.forwardTCP
+	go server.watchDERPHealth()
 	return server, nil
 }
 
@@ -269,7 +298,10 @@ type Conn struct {
 	mutex          sync.Mutex
 	closed         chan struct{}
 	logger         slog.Logger
-	blockEndpoints bool
+	blockEndpoints atomic.Bool
+
+	keepAlive        time.Duration
+	disableKeepAlive bool
 
 	dialer             *tsdial.Dialer
 	tunDevice          *tstun.Wrapper
@@ -282,6 +314,7 @@ type Conn struct {
 	wireguardEngine    wgengine.Engine
 	listeners          map[listenKey]*listener
 	forwardTCPCallback func(conn net.Conn, listenerExists bool) net.Conn
+	unboundPortHandler func(conn net.Conn, port uint16) bool
 
 	lastMutex   sync.Mutex
 	nodeSending bool
@@ -293,20 +326,41 @@ type Conn struct {
 	lastEndpoints     []string
 	lastPreferredDERP int
 	lastDERPLatency   map[string]float64
+	lastIPFamilies    IPFamilies
 	nodeCallback      func(node *Node)
+	// Address translation is detected from the endpoints and DNS, and
+	// hints are logged when it changes.
+	lastCGNAT       bool
+	lastCLAT        bool
+	lastNAT64Prefix netip.Prefix
+	lastNAT64Probe  time.Time
+	nat64Probing    bool
+	lastNATInfo     NATInfo
+
+	derpHealth *derpHealth
 }
 
 // SetForwardTCPCallback is called every time a TCP connection is initiated inbound.
 // listenerExists is true if a listener is registered for the target port. If there
 // isn't one, traffic is forwarded to the local listening port.
 //
-// This allows wrapping a Conn to track reads and writes.
+// This allows wrapping a Conn to track reads and writes. Returning nil
+// refuses the connection, which the callback must close.
 func (c *Conn) SetForwardTCPCallback(callback func(conn net.Conn, listenerExists bool) net.Conn) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.forwardTCPCallback = callback
 }
 
+// SetUnboundPortHandler is called when a connection is forwarded to a local
+// port that nothing is listening on. It returns whether it handled the
+// connection, which is closed when it returns either way.
+func (c *Conn) SetUnboundPortHandler(handler func(conn net.Conn, port uint16) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unboundPortHandler = handler
+}
+
 func (c *Conn) SetNodeCallback(callback func(node *Node)) {
 	c.lastMutex.Lock()
 	c.nodeCallback = callback
@@ -324,6 +378,70 @@ func (c *Conn) SetDERPMap(derpMap *tailcfg.DERPMap) {
 	c.wireguardEngine.SetDERPMap(derpMap)
 }
 
+// SetKeepAlive updates the WireGuard persistent keepalive interval for
+// active peers. It takes effect the next time nodes are updated.
+func (c *Conn) SetKeepAlive(interval time.Duration, disable bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.keepAlive = interval
+	c.disableKeepAlive = disable
+}
+
+// SetBlockEndpoints updates whether P2P endpoints are blocked. Blocking
+// them removes the endpoints of the node that's sent to peers, and the
+// endpoints of peers, so traffic is relayed through DERP. Peers get their
+// endpoints back the next time nodes are updated.
+func (c *Conn) SetBlockEndpoints(block bool) {
+	if c.blockEndpoints.Swap(block) == block {
+		return
+	}
+	c.logger.Debug(context.Background(), "updating blocked endpoints", slog.F("block", block))
+	c.sendNode()
+	if !block {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, peer := range c.peerMap {
+		peer.Endpoints = nil
+	}
+	err := c.reconfigLocked()
+	if err != nil {
+		c.logger.Warn(context.Background(), "remove endpoints of peers", slog.Error(err))
+	}
+}
+
+// BlockEndpoints returns whether P2P endpoints are blocked.
+func (c *Conn) BlockEndpoints() bool {
+	return c.blockEndpoints.Load()
+}
+
+// applyKeepAlive overrides the persistent keepalive of peers that have
+// keepalives enabled by the network map.
+func applyKeepAlive(cfg *wgcfg.Config, interval time.Duration, disable bool) {
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		if peer.PersistentKeepalive == 0 {
+			continue
+		}
+		if disable {
+			peer.PersistentKeepalive = 0
+			continue
+		}
+		if interval <= 0 {
+			continue
+		}
+		seconds := interval / time.Second
+		if seconds < 1 {
+			seconds = 1
+		}
+		if seconds > math.MaxUint16 {
+			seconds = math.MaxUint16
+		}
+		peer.PersistentKeepalive = uint16(seconds)
+	}
+}
+
 // UpdateNodes connects with a set of peers. This can be constantly updated,
 // and peers will continually be reconnected as necessary.
 func (c *Conn) UpdateNodes(nodes []*Node) error {
@@ -371,11 +489,17 @@ func (c *Conn) UpdateNodes(nodes []*Node) error {
 		if node.PreferredDERP == 0 {
 			peerNode.DERP = ""
 		}
-		if c.blockEndpoints {
+		if c.blockEndpoints.Load() {
 			peerNode.Endpoints = nil
 		}
 		c.peerMap[node.ID] = peerNode
 	}
+	return c.reconfigLocked()
+}
+
+// reconfigLocked applies the peers to the WireGuard engine. c.mutex must
+// be held.
+func (c *Conn) reconfigLocked() error {
 	c.netMap.Peers = make([]*tailcfg.Node, 0, len(c.peerMap))
 	for _, peer := range c.peerMap {
 		c.netMap.Peers = append(c.netMap.Peers, peer.Clone())
@@ -386,6 +510,7 @@ func (c *Conn) UpdateNodes(nodes []*Node) error {
 	if err != nil {
 		return xerrors.Errorf("update wireguard config: %w", err)
 	}
+	applyKeepAlive(cfg, c.keepAlive, c.disableKeepAlive)
 	err = c.wireguardEngine.Reconfig(cfg, c.wireguardRouter, &dns.Config{}, &tailcfg.Debug{})
 	if err != nil {
 		if c.isClosed() {
@@ -406,6 +531,77 @@ func (c *Conn) Status() *ipnstate.Status {
 	return sb.Status()
 }
 
+// NATInfo returns the address translation detected for the connection.
+func (c *Conn) NATInfo() NATInfo {
+	c.lastMutex.Lock()
+	defer c.lastMutex.Unlock()
+	return c.lastNATInfo
+}
+
+// IPFamilies returns the IP families that DERP regions were last reached
+// with.
+func (c *Conn) IPFamilies() IPFamilies {
+	c.lastMutex.Lock()
+	defer c.lastMutex.Unlock()
+	return c.lastIPFamilies
+}
+
+// probeNAT64 looks for DNS64 in the background, unless it was done
+// recently.
+func (c *Conn) probeNAT64() {
+	c.lastMutex.Lock()
+	if c.nat64Probing || (!c.lastNAT64Probe.IsZero() && time.Since(c.lastNAT64Probe) < nat64ProbeInterval) {
+		c.lastMutex.Unlock()
+		return
+	}
+	c.nat64Probing = true
+	c.lastMutex.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(c.dialContext, 5*time.Second)
+		defer cancel()
+		prefix, err := DetectNAT64(ctx, net.DefaultResolver)
+		if err != nil {
+			c.logger.Debug(ctx, "probe nat64", slog.Error(err))
+		}
+		c.lastMutex.Lock()
+		c.nat64Probing = false
+		c.lastNAT64Probe = time.Now()
+		if err == nil {
+			c.lastNAT64Prefix = prefix
+		}
+		c.lastMutex.Unlock()
+		c.updateNATInfo()
+	}()
+}
+
+// updateNATInfo logs hints when the detected address translation changes,
+// since it's the most common reason for connections to be relayed.
+func (c *Conn) updateNATInfo() {
+	c.lastMutex.Lock()
+	info := NATInfo{
+		CGNAT:       c.lastCGNAT,
+		NAT64:       c.lastCLAT || c.lastNAT64Prefix.IsValid(),
+		NAT64Prefix: c.lastNAT64Prefix,
+	}
+	changed := info != c.lastNATInfo
+	c.lastNATInfo = info
+	c.lastMutex.Unlock()
+	if !changed {
+		return
+	}
+
+	ctx := context.Background()
+	hints := info.Hints()
+	if len(hints) == 0 {
+		c.logger.Info(ctx, "address translation is no longer detected")
+		return
+	}
+	for _, hint := range hints {
+		c.logger.Info(ctx, "detected address translation that may prevent direct connections", slog.F("hint", hint))
+	}
+}
+
 // Ping sends a Disco ping to the Wireguard engine.
 func (c *Conn) Ping(ctx context.Context, ip netip.Addr) (time.Duration, error) {
 	errCh := make(chan error, 1)
@@ -534,7 +730,7 @@ func (c *Conn) sendNode() {
 		PreferredDERP: c.lastPreferredDERP,
 		DERPLatency:   c.lastDERPLatency,
 	}
-	if c.blockEndpoints {
+	if c.blockEndpoints.Load() {
 		node.Endpoints = nil
 	}
 	nodeCallback := c.nodeCallback
@@ -608,6 +804,9 @@ func (c *Conn) forwardTCP(conn net.Conn, port uint16) {
 		conn = c.forwardTCPCallback(conn, ok)
 	}
 	c.mutex.Unlock()
+	if conn == nil {
+		return
+	}
 	if !ok {
 		c.forwardTCPToLocal(conn, port)
 		return
@@ -626,14 +825,21 @@ func (c *Conn) forwardTCP(conn net.Conn, port uint16) {
 
 func (c *Conn) forwardTCPToLocal(conn net.Conn, port uint16) {
 	defer conn.Close()
-	dialAddrStr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
-	var stdDialer net.Dialer
-	server, err := stdDialer.DialContext(c.dialContext, "tcp", dialAddrStr)
+	// Applications may only be listening on one of the
+	// IPv4 or IPv6 loopback addresses, so both are tried.
+	server, err := DialLoopback(c.dialContext, port, false)
 	if err != nil {
+		c.mutex.Lock()
+		handler := c.unboundPortHandler
+		c.mutex.Unlock()
+		if handler != nil && handler(conn, port) {
+			return
+		}
 		c.logger.Debug(c.dialContext, "dial local port", slog.F("port", port), slog.Error(err))
 		return
 	}
 	defer server.Close()
+	dialAddrStr := server.RemoteAddr().String()
 
 	connClosed := make(chan error, 2)
 	go func() {
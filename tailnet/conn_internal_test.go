@@ -0,0 +1,53 @@
+package tailnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestApplyKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	newConfig := func() *wgcfg.Config {
+		return &wgcfg.Config{
+			Peers: []wgcfg.Peer{
+				{PersistentKeepalive: 25},
+				// Inactive peers don't have keepalives enabled.
+				{PersistentKeepalive: 0},
+			},
+		}
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		t.Parallel()
+		cfg := newConfig()
+		applyKeepAlive(cfg, 0, false)
+		require.EqualValues(t, 25, cfg.Peers[0].PersistentKeepalive)
+		require.EqualValues(t, 0, cfg.Peers[1].PersistentKeepalive)
+	})
+
+	t.Run("Interval", func(t *testing.T) {
+		t.Parallel()
+		cfg := newConfig()
+		applyKeepAlive(cfg, 10*time.Second, false)
+		require.EqualValues(t, 10, cfg.Peers[0].PersistentKeepalive)
+		require.EqualValues(t, 0, cfg.Peers[1].PersistentKeepalive)
+	})
+
+	t.Run("SubSecond", func(t *testing.T) {
+		t.Parallel()
+		cfg := newConfig()
+		applyKeepAlive(cfg, time.Millisecond, false)
+		require.EqualValues(t, 1, cfg.Peers[0].PersistentKeepalive)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Parallel()
+		cfg := newConfig()
+		applyKeepAlive(cfg, 10*time.Second, true)
+		require.EqualValues(t, 0, cfg.Peers[0].PersistentKeepalive)
+	})
+}
@@ -2,7 +2,11 @@ package tailnet_test
 
 import (
 	"context"
+	"net"
 	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,6 +17,7 @@ import (
 	"cdr.dev/slog/sloggers/slogtest"
 	"github.com/coder/coder/tailnet"
 	"github.com/coder/coder/tailnet/tailnettest"
+	"github.com/coder/coder/testutil"
 )
 
 func TestMain(m *testing.M) {
@@ -84,4 +89,101 @@ func TestTailnet(t *testing.T) {
 		w1.Close()
 		w2.Close()
 	})
+
+	t.Run("BlockEndpoints", func(t *testing.T) {
+		t.Parallel()
+		w1IP := tailnet.IP()
+		w1, err := tailnet.NewConn(&tailnet.Options{
+			Addresses: []netip.Prefix{netip.PrefixFrom(w1IP, 128)},
+			Logger:    logger.Named("w1"),
+			DERPMap:   derpMap,
+		})
+		require.NoError(t, err)
+
+		w2, err := tailnet.NewConn(&tailnet.Options{
+			Addresses: []netip.Prefix{netip.PrefixFrom(tailnet.IP(), 128)},
+			Logger:    logger.Named("w2"),
+			DERPMap:   derpMap,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = w1.Close()
+			_ = w2.Close()
+		})
+		var lastNode atomic.Pointer[tailnet.Node]
+		w1.SetNodeCallback(func(node *tailnet.Node) {
+			err := w2.UpdateNodes([]*tailnet.Node{node})
+			assert.NoError(t, err)
+			lastNode.Store(node)
+		})
+		w2.SetNodeCallback(func(node *tailnet.Node) {
+			err := w1.UpdateNodes([]*tailnet.Node{node})
+			assert.NoError(t, err)
+		})
+		require.True(t, w2.AwaitReachable(context.Background(), w1IP))
+		require.Eventually(t, func() bool {
+			node := lastNode.Load()
+			return node != nil && len(node.Endpoints) > 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+
+		// The node is sent again without its endpoints, and peers
+		// are still reachable through DERP.
+		w1.SetBlockEndpoints(true)
+		require.True(t, w1.BlockEndpoints())
+		require.Eventually(t, func() bool {
+			node := lastNode.Load()
+			return node != nil && len(node.Endpoints) == 0
+		}, testutil.WaitShort, testutil.IntervalFast)
+		require.True(t, w2.AwaitReachable(context.Background(), w1IP))
+	})
+}
+
+func TestTailnetIPv6Only(t *testing.T) {
+	t.Parallel()
+	logger := slogtest.Make(t, nil).Leveled(slog.LevelDebug)
+	ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitLong)
+	defer cancel()
+	derpMap := tailnet.ResolveDERPNodesIPv6(ctx, net.DefaultResolver, tailnettest.RunDERPAndSTUNIPv6(t))
+
+	w1IP := tailnet.IP()
+	w1, err := tailnet.NewConn(&tailnet.Options{
+		Addresses: []netip.Prefix{netip.PrefixFrom(w1IP, 128)},
+		Logger:    logger.Named("w1"),
+		DERPMap:   derpMap,
+	})
+	require.NoError(t, err)
+	defer w1.Close()
+	w2, err := tailnet.NewConn(&tailnet.Options{
+		Addresses: []netip.Prefix{netip.PrefixFrom(tailnet.IP(), 128)},
+		Logger:    logger.Named("w2"),
+		DERPMap:   derpMap,
+	})
+	require.NoError(t, err)
+	defer w2.Close()
+	// STUN only works with the resolved IPv6 address of the DERP node,
+	// and finds the endpoint of the node on the IPv6 loopback address.
+	stunEndpoint := make(chan struct{})
+	var stunOnce sync.Once
+	w1.SetNodeCallback(func(node *tailnet.Node) {
+		for _, endpoint := range node.Endpoints {
+			if strings.HasPrefix(endpoint, "[::1]:") {
+				stunOnce.Do(func() { close(stunEndpoint) })
+			}
+		}
+		err := w2.UpdateNodes([]*tailnet.Node{node})
+		assert.NoError(t, err)
+	})
+	w2.SetNodeCallback(func(node *tailnet.Node) {
+		err := w1.UpdateNodes([]*tailnet.Node{node})
+		assert.NoError(t, err)
+	})
+	require.True(t, w2.AwaitReachable(ctx, w1IP))
+	select {
+	case <-stunEndpoint:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for an endpoint discovered with stun")
+	}
+	require.Eventually(t, func() bool {
+		return w2.IPFamilies() == tailnet.IPFamilies{IPv6: true}
+	}, testutil.WaitLong, testutil.IntervalFast)
 }
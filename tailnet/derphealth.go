@@ -0,0 +1,324 @@
+package tailnet
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+	"tailscale.com/tailcfg"
+
+	"cdr.dev/slog"
+)
+
+const (
+	// derpHealthInterval is how often the preferred DERP region is probed
+	// while it's healthy.
+	derpHealthInterval = 15 * time.Second
+	// derpSuspectHealthInterval is how often the preferred DERP region is
+	// probed after a probe failed, so a degraded region is detected in
+	// seconds instead of minutes.
+	derpSuspectHealthInterval = 2 * time.Second
+	// derpProbeTimeout limits how long a region has to respond to a probe.
+	derpProbeTimeout = 5 * time.Second
+	// derpLivenessWeight is how much each probe moves the liveness of a
+	// region, which smooths over a single dropped request.
+	derpLivenessWeight = 0.5
+	// derpDegradedLiveness is the liveness below which a region is
+	// degraded. Two failed probes in a row degrade a healthy region.
+	derpDegradedLiveness = 0.5
+)
+
+// DERPRegionHealth is the health of a DERP region, as measured by probing
+// its latency check endpoint.
+type DERPRegionHealth struct {
+	RegionID int `json:"region_id"`
+	// Liveness is a score from 0 to 1 that weighs recent probes more
+	// than older ones. A region that answers every probe scores 1.
+	Liveness     float64   `json:"liveness"`
+	LatencyMS    float64   `json:"latency_ms"`
+	LastProbedAt time.Time `json:"last_probed_at"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// DERPHealth is the health of the DERP regions of a connection.
+type DERPHealth struct {
+	// PreferredRegion is the region that peers reach the connection
+	// through when a direct connection isn't possible.
+	PreferredRegion int `json:"preferred_region"`
+	// Degraded is whether the preferred region is failing probes.
+	Degraded bool `json:"degraded"`
+	// Failovers is the number of times the preferred region changed
+	// because it was degraded.
+	Failovers      int64              `json:"failovers"`
+	LastFailoverAt time.Time          `json:"last_failover_at"`
+	Regions        []DERPRegionHealth `json:"regions"`
+}
+
+// derpHealth scores DERP regions by their liveness, and detects when the
+// preferred region is degraded or replaced.
+type derpHealth struct {
+	mutex          sync.Mutex
+	regions        map[int]*DERPRegionHealth
+	preferred      int
+	degraded       bool
+	failovers      int64
+	lastFailoverAt time.Time
+}
+
+func newDERPHealth() *derpHealth {
+	return &derpHealth{
+		regions: map[int]*DERPRegionHealth{},
+	}
+}
+
+// observe records the result of a probe of a region. It returns whether
+// the preferred region became degraded or recovered.
+func (h *derpHealth) observe(regionID int, latency time.Duration, err error) (degraded bool, changed bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	region, ok := h.regions[regionID]
+	if !ok {
+		region = &DERPRegionHealth{
+			RegionID: regionID,
+			Liveness: 1,
+		}
+		h.regions[regionID] = region
+	}
+	sample := 1.0
+	region.LastError = ""
+	if err != nil {
+		sample = 0
+		region.LastError = err.Error()
+	} else {
+		region.LatencyMS = float64(latency) / float64(time.Millisecond)
+	}
+	region.Liveness = region.Liveness*(1-derpLivenessWeight) + sample*derpLivenessWeight
+	region.LastProbedAt = time.Now()
+	if regionID != h.preferred {
+		return h.degraded, false
+	}
+	return h.updateDegradedLocked()
+}
+
+// setPreferred records the region that was picked by netcheck. It returns
+// the previous region and whether this is a failover from a degraded one.
+func (h *derpHealth) setPreferred(regionID int) (previous int, failover bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	previous = h.preferred
+	if previous == regionID {
+		return previous, false
+	}
+	h.preferred = regionID
+	failover = h.degraded && previous != 0
+	if failover {
+		h.failovers++
+		h.lastFailoverAt = time.Now()
+	}
+	h.updateDegradedLocked()
+	return previous, failover
+}
+
+func (h *derpHealth) updateDegradedLocked() (degraded bool, changed bool) {
+	degraded = false
+	if region, ok := h.regions[h.preferred]; ok {
+		degraded = region.Liveness < derpDegradedLiveness
+	}
+	changed = degraded != h.degraded
+	h.degraded = degraded
+	return degraded, changed
+}
+
+// suspect returns whether the last probe of the preferred region failed.
+func (h *derpHealth) suspect() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	region, ok := h.regions[h.preferred]
+	return ok && region.LastError != ""
+}
+
+func (h *derpHealth) preferredRegion() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.preferred
+}
+
+// health returns the health of every probed region, ordered by region ID.
+func (h *derpHealth) health() DERPHealth {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	health := DERPHealth{
+		PreferredRegion: h.preferred,
+		Degraded:        h.degraded,
+		Failovers:       h.failovers,
+		LastFailoverAt:  h.lastFailoverAt,
+		Regions:         make([]DERPRegionHealth, 0, len(h.regions)),
+	}
+	for _, region := range h.regions {
+		health.Regions = append(health.Regions, *region)
+	}
+	sort.Slice(health.Regions, func(i, j int) bool {
+		return health.Regions[i].RegionID < health.Regions[j].RegionID
+	})
+	return health
+}
+
+// DERPHealth returns the health of the DERP regions of the connection.
+func (c *Conn) DERPHealth() DERPHealth {
+	return c.derpHealth.health()
+}
+
+// watchDERPHealth probes the preferred DERP region until the connection is
+// closed. Netcheck only runs every few minutes or when the network changes,
+// so without probes peers keep sending to a region that's gone. When the
+// preferred region is degraded, every region is probed to score them, and
+// netcheck is run again so it picks a region that's reachable.
+func (c *Conn) watchDERPHealth() {
+	ctx := c.dialContext
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: derpProbeTimeout,
+			// Reusing connections would hide a region that no longer
+			// accepts them.
+			DisableKeepAlives: true,
+		},
+		Timeout: derpProbeTimeout,
+	}
+	defer client.CloseIdleConnections()
+
+	timer := time.NewTimer(derpSuspectHealthInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		c.probeDERPHealth(ctx, client)
+		interval := derpHealthInterval
+		if c.derpHealth.suspect() {
+			interval = derpSuspectHealthInterval
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (c *Conn) probeDERPHealth(ctx context.Context, client *http.Client) {
+	c.mutex.Lock()
+	derpMap := c.netMap.DERPMap
+	c.mutex.Unlock()
+	preferred := c.derpHealth.preferredRegion()
+	if derpMap == nil || preferred == 0 {
+		return
+	}
+	region, ok := derpMap.Regions[preferred]
+	if !ok {
+		return
+	}
+	latency, err := probeDERPRegion(ctx, client, region)
+	if ctx.Err() != nil {
+		return
+	}
+	degraded, changed := c.derpHealth.observe(preferred, latency, err)
+	if changed && degraded {
+		c.logger.Warn(ctx, "preferred derp region is degraded, probing other regions",
+			slog.F("region_id", preferred), slog.Error(err))
+	} else if changed {
+		c.logger.Info(ctx, "preferred derp region recovered", slog.F("region_id", preferred))
+	}
+	if !degraded {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for id, region := range derpMap.Regions {
+		if id == preferred {
+			continue
+		}
+		wg.Add(1)
+		go func(id int, region *tailcfg.DERPRegion) {
+			defer wg.Done()
+			latency, err := probeDERPRegion(ctx, client, region)
+			if ctx.Err() != nil {
+				return
+			}
+			c.derpHealth.observe(id, latency, err)
+		}(id, region)
+	}
+	wg.Wait()
+	c.magicConn.ReSTUN("derp-region-degraded")
+}
+
+// updatePreferredDERP records the region picked by netcheck, and logs
+// when it replaces a degraded region.
+func (c *Conn) updatePreferredDERP(regionID int) {
+	previous, failover := c.derpHealth.setPreferred(regionID)
+	if failover {
+		c.logger.Info(context.Background(), "failed over from degraded derp region",
+			slog.F("from_region_id", previous), slog.F("to_region_id", regionID))
+	}
+}
+
+// probeDERPRegion measures the latency of the latency check endpoint of
+// the first DERP node of a region. This is the endpoint netcheck uses when
+// UDP is blocked.
+func probeDERPRegion(ctx context.Context, client *http.Client, region *tailcfg.DERPRegion) (time.Duration, error) {
+	var node *tailcfg.DERPNode
+	for _, candidate := range region.Nodes {
+		if !candidate.STUNOnly {
+			node = candidate
+			break
+		}
+	}
+	if node == nil {
+		return 0, xerrors.Errorf("region %d has no derp nodes", region.RegionID)
+	}
+	host := node.HostName
+	if host == "" && node.IPv4 != "" && node.IPv4 != "none" {
+		host = node.IPv4
+	}
+	if host == "" {
+		return 0, xerrors.Errorf("derp node %q has no address", node.Name)
+	}
+	scheme := "https"
+	if node.ForceHTTP {
+		scheme = "http"
+	}
+	if node.DERPPort != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(node.DERPPort))
+	}
+	ctx, cancel := context.WithTimeout(ctx, derpProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/derp/latency-check", scheme, host), nil)
+	if err != nil {
+		return 0, xerrors.Errorf("create request: %w", err)
+	}
+	if node.InsecureForTests {
+		transport, ok := client.Transport.(*http.Transport)
+		if ok {
+			transport = transport.Clone()
+			//nolint:gosec // Only test DERP maps skip verification.
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			client = &http.Client{Transport: transport, Timeout: client.Timeout}
+			defer transport.CloseIdleConnections()
+		}
+	}
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, xerrors.Errorf("probe derp region %d: %w", region.RegionID, err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, xerrors.Errorf("probe derp region %d: unexpected status code %d", region.RegionID, res.StatusCode)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,129 @@
+package tailnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestDERPHealth(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Failover", func(t *testing.T) {
+		t.Parallel()
+		health := newDERPHealth()
+		_, failover := health.setPreferred(1)
+		require.False(t, failover)
+
+		// A single failed probe isn't enough to degrade a region.
+		degraded, changed := health.observe(1, 0, errors.New("timeout"))
+		require.False(t, degraded)
+		require.False(t, changed)
+		degraded, changed = health.observe(1, 0, errors.New("timeout"))
+		require.True(t, degraded)
+		require.True(t, changed)
+
+		// Other regions don't affect the preferred region.
+		degraded, changed = health.observe(2, 10*time.Millisecond, nil)
+		require.True(t, degraded)
+		require.False(t, changed)
+
+		previous, failover := health.setPreferred(2)
+		require.Equal(t, 1, previous)
+		require.True(t, failover)
+
+		state := health.health()
+		require.Equal(t, 2, state.PreferredRegion)
+		require.False(t, state.Degraded)
+		require.EqualValues(t, 1, state.Failovers)
+		require.False(t, state.LastFailoverAt.IsZero())
+		require.Len(t, state.Regions, 2)
+		require.Equal(t, 1, state.Regions[0].RegionID)
+		require.Equal(t, 0.25, state.Regions[0].Liveness)
+		require.Equal(t, "timeout", state.Regions[0].LastError)
+		require.Equal(t, 2, state.Regions[1].RegionID)
+		require.Equal(t, 1.0, state.Regions[1].Liveness)
+		require.Equal(t, 10.0, state.Regions[1].LatencyMS)
+	})
+
+	t.Run("Recovered", func(t *testing.T) {
+		t.Parallel()
+		health := newDERPHealth()
+		health.setPreferred(1)
+		health.observe(1, 0, errors.New("timeout"))
+		health.observe(1, 0, errors.New("timeout"))
+		require.True(t, health.suspect())
+
+		degraded, changed := health.observe(1, time.Millisecond, nil)
+		require.False(t, degraded)
+		require.True(t, changed)
+		require.False(t, health.suspect())
+
+		// Netcheck picking another region isn't a failover when the
+		// preferred region is healthy.
+		_, failover := health.setPreferred(2)
+		require.False(t, failover)
+		require.Zero(t, health.health().Failovers)
+	})
+}
+
+func TestProbeDERPRegion(t *testing.T) {
+	t.Parallel()
+
+	region := func(t *testing.T, handler http.HandlerFunc) *tailcfg.DERPRegion {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		tcpAddr, ok := server.Listener.Addr().(*net.TCPAddr)
+		require.True(t, ok)
+		return &tailcfg.DERPRegion{
+			RegionID: 1,
+			Nodes: []*tailcfg.DERPNode{{
+				Name:     "1stun0",
+				RegionID: 1,
+				STUNOnly: true,
+			}, {
+				Name:      "1a",
+				RegionID:  1,
+				IPv4:      "127.0.0.1",
+				DERPPort:  tcpAddr.Port,
+				ForceHTTP: true,
+			}},
+		}
+	}
+
+	t.Run("OK", func(t *testing.T) {
+		t.Parallel()
+		region := region(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/derp/latency-check" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		})
+		latency, err := probeDERPRegion(context.Background(), &http.Client{Transport: &http.Transport{}}, region)
+		require.NoError(t, err)
+		require.Greater(t, latency, time.Duration(0))
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		t.Parallel()
+		region := region(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		})
+		_, err := probeDERPRegion(context.Background(), &http.Client{Transport: &http.Transport{}}, region)
+		require.ErrorContains(t, err, "unexpected status code 502")
+	})
+
+	t.Run("NoNodes", func(t *testing.T) {
+		t.Parallel()
+		_, err := probeDERPRegion(context.Background(), &http.Client{}, &tailcfg.DERPRegion{RegionID: 1})
+		require.ErrorContains(t, err, "no derp nodes")
+	})
+}
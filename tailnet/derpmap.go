@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
 
@@ -76,3 +77,51 @@ func NewDERPMap(ctx context.Context, region *tailcfg.DERPRegion, stunAddrs []str
 	}
 	return derpMap, nil
 }
+
+// ResolveDERPNodesIPv6 returns a copy of the DERP map with the IPv6
+// addresses of nodes that only have a hostname resolved. netcheck resolves
+// hostnames to IPv4 addresses only, so without them STUN fails in IPv6-only
+// networks and connections are always relayed. The addresses are only
+// resolved once, so the map should be resolved again when it's updated.
+func ResolveDERPNodesIPv6(ctx context.Context, resolver *net.Resolver, derpMap *tailcfg.DERPMap) *tailcfg.DERPMap {
+	if derpMap == nil {
+		return nil
+	}
+	derpMap = derpMap.Clone()
+	resolved := map[string]string{}
+	for _, region := range derpMap.Regions {
+		for _, node := range region.Nodes {
+			if node.IPv6 != "" || node.HostName == "" || node.STUNPort < 0 {
+				continue
+			}
+			addr, ok := resolved[node.HostName]
+			if !ok {
+				addr = lookupIPv6(ctx, resolver, node.HostName)
+				resolved[node.HostName] = addr
+			}
+			node.IPv6 = addr
+		}
+	}
+	return derpMap
+}
+
+// lookupIPv6 returns the first IPv6 address of the host, or an empty string
+// if it has none.
+func lookupIPv6(ctx context.Context, resolver *net.Resolver, host string) string {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is6() && !addr.Is4In6() {
+			return addr.String()
+		}
+		return ""
+	}
+	addrs, err := resolver.LookupNetIP(ctx, "ip6", host)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if addr.Is6() && !addr.Is4In6() {
+			return addr.String()
+		}
+	}
+	return ""
+}
@@ -3,6 +3,7 @@ package tailnet_test
 import (
 	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -77,3 +78,37 @@ func TestNewDERPMap(t *testing.T) {
 		require.Len(t, derpMap.Regions, 2)
 	})
 }
+
+func TestResolveDERPNodesIPv6(t *testing.T) {
+	t.Parallel()
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID: 1,
+				Nodes: []*tailcfg.DERPNode{{
+					Name:     "ipv6",
+					HostName: "2001:db8::1",
+				}, {
+					Name:     "ipv4",
+					HostName: "192.0.2.1",
+				}, {
+					Name:     "explicit",
+					HostName: "2001:db8::1",
+					IPv6:     "none",
+				}, {
+					Name:     "nostun",
+					HostName: "2001:db8::1",
+					STUNPort: -1,
+				}},
+			},
+		},
+	}
+	resolved := tailnet.ResolveDERPNodesIPv6(context.Background(), net.DefaultResolver, derpMap)
+	nodes := resolved.Regions[1].Nodes
+	require.Equal(t, "2001:db8::1", nodes[0].IPv6)
+	require.Empty(t, nodes[1].IPv6)
+	require.Equal(t, "none", nodes[2].IPv6)
+	require.Empty(t, nodes[3].IPv6)
+	// The DERP map is copied.
+	require.Empty(t, derpMap.Regions[1].Nodes[0].IPv6)
+}
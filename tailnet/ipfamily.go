@@ -0,0 +1,47 @@
+package tailnet
+
+import (
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+// IPFamilies are the IP families a node reached DERP regions with, over
+// STUN or HTTPS, which shows whether it's in an IPv4-only, IPv6-only or
+// dual-stack network. Both are false until netcheck completes.
+type IPFamilies struct {
+	IPv4 bool `json:"ipv4"`
+	IPv6 bool `json:"ipv6"`
+}
+
+// String returns the families for logging.
+func (f IPFamilies) String() string {
+	switch {
+	case f.IPv4 && f.IPv6:
+		return "dual-stack"
+	case f.IPv4:
+		return "ipv4-only"
+	case f.IPv6:
+		return "ipv6-only"
+	default:
+		return "unknown"
+	}
+}
+
+// netInfoIPFamilies returns the IP families that netcheck measured the
+// latency of DERP regions with. Latencies are keyed by the region ID and
+// family, like "1-v4".
+func netInfoIPFamilies(ni *tailcfg.NetInfo) IPFamilies {
+	families := IPFamilies{
+		IPv6: ni.WorkingIPv6.EqualBool(true),
+	}
+	for key := range ni.DERPLatency {
+		switch {
+		case strings.HasSuffix(key, "-v4"):
+			families.IPv4 = true
+		case strings.HasSuffix(key, "-v6"):
+			families.IPv6 = true
+		}
+	}
+	return families
+}
@@ -0,0 +1,48 @@
+package tailnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestNetInfoIPFamilies(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		netInfo  *tailcfg.NetInfo
+		families IPFamilies
+	}{{
+		name:    "None",
+		netInfo: &tailcfg.NetInfo{},
+	}, {
+		name: "IPv4Only",
+		netInfo: &tailcfg.NetInfo{
+			WorkingIPv6: "false",
+			DERPLatency: map[string]float64{"1-v4": 0.01},
+		},
+		families: IPFamilies{IPv4: true},
+	}, {
+		name: "IPv6Only",
+		netInfo: &tailcfg.NetInfo{
+			WorkingIPv6: "true",
+			DERPLatency: map[string]float64{"1-v6": 0.01},
+		},
+		families: IPFamilies{IPv6: true},
+	}, {
+		name: "DualStack",
+		netInfo: &tailcfg.NetInfo{
+			DERPLatency: map[string]float64{"1-v4": 0.01, "2-v6": 0.02},
+		},
+		families: IPFamilies{IPv4: true, IPv6: true},
+	}}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, c.families, netInfoIPFamilies(c.netInfo))
+		})
+	}
+}
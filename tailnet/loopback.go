@@ -0,0 +1,102 @@
+package tailnet
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// loopbackFallbackDelay is how long to wait for the preferred loopback
+// address before racing the other one. This matches net.Dialer.
+const loopbackFallbackDelay = 300 * time.Millisecond
+
+// IsLoopbackHost returns whether host refers to the loopback interface.
+func IsLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return addr.IsLoopback()
+}
+
+// DialLoopback dials the port on both the IPv4 and IPv6 loopback
+// addresses in a happy-eyeballs style, since applications increasingly
+// bind to only one of them. The IPv6 address is attempted first if
+// preferIPv6 is true.
+func DialLoopback(ctx context.Context, port uint16, preferIPv6 bool) (net.Conn, error) {
+	primary, fallback := "127.0.0.1", "::1"
+	if preferIPv6 {
+		primary, fallback = fallback, primary
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	// This is buffered so dials that complete after a
+	// winner has been returned never block.
+	results := make(chan dialResult, 2)
+	dial := func(host string, isPrimary bool) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		results <- dialResult{conn: conn, err: err, primary: isPrimary}
+	}
+
+	pending := 1
+	fallbackStarted := false
+	startFallback := func() {
+		if fallbackStarted {
+			return
+		}
+		fallbackStarted = true
+		pending++
+		go dial(fallback, false)
+	}
+	go dial(primary, true)
+
+	fallbackTimer := time.NewTimer(loopbackFallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr, fallbackErr error
+	for pending > 0 {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the connection of the losing dial.
+					go func() {
+						res := <-results
+						if res.conn != nil {
+							_ = res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			startFallback()
+		}
+	}
+	// Both dials failed, so the primary error is the
+	// most relevant to report.
+	if primaryErr != nil {
+		return nil, primaryErr
+	}
+	return nil, fallbackErr
+}
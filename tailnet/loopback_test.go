@@ -0,0 +1,73 @@
+package tailnet_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/coder/coder/tailnet"
+	"github.com/coder/coder/testutil"
+)
+
+func TestIsLoopbackHost(t *testing.T) {
+	t.Parallel()
+	require.True(t, tailnet.IsLoopbackHost("localhost"))
+	require.True(t, tailnet.IsLoopbackHost("127.0.0.1"))
+	require.True(t, tailnet.IsLoopbackHost("::1"))
+	require.False(t, tailnet.IsLoopbackHost("example.com"))
+	require.False(t, tailnet.IsLoopbackHost("10.0.0.1"))
+}
+
+func TestDialLoopback(t *testing.T) {
+	t.Parallel()
+
+	for _, network := range []struct {
+		name    string
+		address string
+	}{
+		{name: "IPv4", address: "127.0.0.1:0"},
+		{name: "IPv6", address: "[::1]:0"},
+	} {
+		network := network
+		t.Run(network.name, func(t *testing.T) {
+			t.Parallel()
+			listener, err := net.Listen("tcp", network.address)
+			require.NoError(t, err)
+			defer listener.Close()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					_ = conn.Close()
+				}
+			}()
+			port := uint16(listener.Addr().(*net.TCPAddr).Port)
+
+			ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitShort)
+			defer cancel()
+			for _, preferIPv6 := range []bool{false, true} {
+				conn, err := tailnet.DialLoopback(ctx, port, preferIPv6)
+				require.NoError(t, err)
+				require.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+				_ = conn.Close()
+			}
+		})
+	}
+
+	t.Run("Refused", func(t *testing.T) {
+		t.Parallel()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		port := uint16(listener.Addr().(*net.TCPAddr).Port)
+		require.NoError(t, listener.Close())
+
+		ctx, cancel := context.WithTimeout(context.Background(), testutil.WaitShort)
+		defer cancel()
+		_, err = tailnet.DialLoopback(ctx, port, false)
+		require.Error(t, err)
+	})
+}
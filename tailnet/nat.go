@@ -0,0 +1,142 @@
+package tailnet
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.org/x/xerrors"
+	"tailscale.com/tailcfg"
+)
+
+var (
+	// cgnatPrefix is the shared address space that carriers assign to
+	// subscribers behind a carrier-grade NAT.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc6598
+	cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+	// clatPrefix is assigned to the IPv4 interface of 464XLAT clients,
+	// which translate IPv4 traffic for NAT64 networks.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7335
+	clatPrefix = netip.MustParsePrefix("192.0.0.0/29")
+	// nat64KnownAddrs are the addresses of ipv4only.arpa, which are
+	// embedded in the addresses that DNS64 synthesizes for it.
+	//
+	// https://datatracker.ietf.org/doc/html/rfc7050
+	nat64KnownAddrs = []netip.Addr{
+		netip.AddrFrom4([4]byte{192, 0, 0, 170}),
+		netip.AddrFrom4([4]byte{192, 0, 0, 171}),
+	}
+)
+
+// nat64ProbeInterval is how often NAT64 is probed for when the network
+// changes, since it requires a DNS query.
+const nat64ProbeInterval = 10 * time.Minute
+
+// NATInfo describes address translation between a node and the internet
+// that commonly prevents direct connections.
+type NATInfo struct {
+	// CGNAT is whether the node has an address in the shared address space,
+	// which means it's behind a carrier-grade NAT.
+	CGNAT bool `json:"cgnat"`
+	// NAT64 is whether IPv4 traffic of the node is translated to IPv6,
+	// either by DNS64 or 464XLAT.
+	NAT64 bool `json:"nat64"`
+	// NAT64Prefix is the prefix that DNS64 synthesizes addresses in, if
+	// it was discovered.
+	NAT64Prefix netip.Prefix `json:"nat64_prefix"`
+}
+
+// Hints returns explanations of how the NAT affects connections, to be
+// logged for troubleshooting.
+func (n NATInfo) Hints() []string {
+	hints := []string{}
+	if n.CGNAT {
+		hints = append(hints, "this node is behind a carrier-grade NAT (shared address space 100.64.0.0/10), "+
+			"so direct connections only succeed if the peer has a public address or both NATs allow UDP hole punching")
+	}
+	if n.NAT64 {
+		hint := "IPv4 traffic of this node is translated by NAT64"
+		if n.NAT64Prefix.IsValid() {
+			hint += " (prefix " + n.NAT64Prefix.String() + ")"
+		}
+		hints = append(hints, hint+", so direct connections require IPv6 connectivity on both peers")
+	}
+	return hints
+}
+
+// endpointsBehindCGNAT returns whether any local endpoint is in the shared
+// address space. Endpoints discovered with STUN are public addresses, so
+// they're ignored.
+func endpointsBehindCGNAT(endpoints []tailcfg.Endpoint) bool {
+	for _, endpoint := range endpoints {
+		if endpoint.Type == tailcfg.EndpointLocal && cgnatPrefix.Contains(endpoint.Addr.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointsBehindCLAT returns whether any local endpoint has an address
+// assigned by a 464XLAT client.
+func endpointsBehindCLAT(endpoints []tailcfg.Endpoint) bool {
+	for _, endpoint := range endpoints {
+		if endpoint.Type == tailcfg.EndpointLocal && clatPrefix.Contains(endpoint.Addr.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectNAT64 discovers the NAT64 prefix of the network by resolving
+// ipv4only.arpa, which only has IPv4 addresses, so any IPv6 address
+// returned for it was synthesized by DNS64. The prefix is invalid if
+// there's no DNS64.
+func DetectNAT64(ctx context.Context, resolver *net.Resolver) (netip.Prefix, error) {
+	addrs, err := resolver.LookupNetIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		var dnsErr *net.DNSError
+		if xerrors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return netip.Prefix{}, nil
+		}
+		return netip.Prefix{}, xerrors.Errorf("lookup ipv4only.arpa: %w", err)
+	}
+	for _, addr := range addrs {
+		prefix, ok := nat64Prefix(addr)
+		if ok {
+			return prefix, nil
+		}
+	}
+	return netip.Prefix{}, nil
+}
+
+// nat64Prefix extracts the prefix from an address that DNS64 synthesized
+// for ipv4only.arpa. The IPv4 address is embedded at a different offset for
+// each prefix length, skipping bits 64 to 71.
+//
+// https://datatracker.ietf.org/doc/html/rfc6052#section-2.2
+func nat64Prefix(addr netip.Addr) (netip.Prefix, bool) {
+	if !addr.Is6() || addr.Is4In6() {
+		return netip.Prefix{}, false
+	}
+	raw := addr.As16()
+	for _, bits := range []int{96, 64, 56, 48, 40, 32} {
+		var embedded [4]byte
+		n := 0
+		for i := bits / 8; n < len(embedded); i++ {
+			if i == 8 {
+				continue
+			}
+			embedded[n] = raw[i]
+			n++
+		}
+		for _, known := range nat64KnownAddrs {
+			if netip.AddrFrom4(embedded) == known {
+				return netip.PrefixFrom(addr, bits).Masked(), true
+			}
+		}
+	}
+	return netip.Prefix{}, false
+}
@@ -0,0 +1,85 @@
+package tailnet
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestNAT64Prefix(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		addr   string
+		prefix string
+	}{
+		// The well-known prefix.
+		{addr: "64:ff9b::c000:aa", prefix: "64:ff9b::/96"},
+		{addr: "64:ff9b::c000:ab", prefix: "64:ff9b::/96"},
+		// Network-specific prefixes of other lengths embed the address
+		// around bits 64 to 71.
+		{addr: "2001:db8:c000:aa::", prefix: "2001:db8::/32"},
+		{addr: "2001:db8:1c0:0:aa::", prefix: "2001:db8:100::/40"},
+		{addr: "2001:db8:122:c000:0:aa00::", prefix: "2001:db8:122::/48"},
+		{addr: "2001:db8:122:3c0:0:aa::", prefix: "2001:db8:122:300::/56"},
+		{addr: "2001:db8:122:344:c0:0:aa00:0", prefix: "2001:db8:122:344::/64"},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.addr, func(t *testing.T) {
+			t.Parallel()
+			prefix, ok := nat64Prefix(netip.MustParseAddr(c.addr))
+			require.True(t, ok)
+			require.Equal(t, netip.MustParsePrefix(c.prefix), prefix)
+		})
+	}
+
+	t.Run("NotSynthesized", func(t *testing.T) {
+		t.Parallel()
+		_, ok := nat64Prefix(netip.MustParseAddr("2001:db8::1"))
+		require.False(t, ok)
+		_, ok = nat64Prefix(netip.MustParseAddr("192.0.0.170"))
+		require.False(t, ok)
+	})
+}
+
+func TestEndpointsBehindNAT(t *testing.T) {
+	t.Parallel()
+
+	endpoints := []tailcfg.Endpoint{{
+		Addr: netip.MustParseAddrPort("100.72.1.5:41641"),
+		Type: tailcfg.EndpointLocal,
+	}, {
+		Addr: netip.MustParseAddrPort("203.0.113.7:41641"),
+		Type: tailcfg.EndpointSTUN,
+	}}
+	require.True(t, endpointsBehindCGNAT(endpoints))
+	require.False(t, endpointsBehindCLAT(endpoints))
+
+	// Public addresses discovered with STUN aren't local.
+	endpoints = []tailcfg.Endpoint{{
+		Addr: netip.MustParseAddrPort("100.72.1.5:41641"),
+		Type: tailcfg.EndpointSTUN,
+	}, {
+		Addr: netip.MustParseAddrPort("192.0.0.4:41641"),
+		Type: tailcfg.EndpointLocal,
+	}}
+	require.False(t, endpointsBehindCGNAT(endpoints))
+	require.True(t, endpointsBehindCLAT(endpoints))
+}
+
+func TestNATInfoHints(t *testing.T) {
+	t.Parallel()
+
+	require.Empty(t, NATInfo{}.Hints())
+	hints := NATInfo{
+		CGNAT:       true,
+		NAT64:       true,
+		NAT64Prefix: netip.MustParsePrefix("64:ff9b::/96"),
+	}.Hints()
+	require.Len(t, hints, 2)
+	require.Contains(t, hints[0], "carrier-grade NAT")
+	require.Contains(t, hints[1], "64:ff9b::/96")
+}
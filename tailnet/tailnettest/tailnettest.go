@@ -1,6 +1,7 @@
 package tailnettest
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
@@ -21,20 +22,7 @@ import (
 
 // RunDERPAndSTUN creates a DERP mapping for tests.
 func RunDERPAndSTUN(t *testing.T) *tailcfg.DERPMap {
-	logf := tailnet.Logger(slogtest.Make(t, nil))
-	d := derp.NewServer(key.NewNode(), logf)
-	server := httptest.NewUnstartedServer(derphttp.Handler(d))
-	server.Config.ErrorLog = tslogger.StdLogger(logf)
-	server.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
-	server.StartTLS()
-
-	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(t, nettype.Std{})
-	t.Cleanup(func() {
-		server.CloseClientConnections()
-		server.Close()
-		d.Close()
-		stunCleanup()
-	})
+	server, stunAddr := runDERPAndSTUN(t, nil, nettype.Std{})
 	tcpAddr, ok := server.Listener.Addr().(*net.TCPAddr)
 	if !ok {
 		t.FailNow()
@@ -61,3 +49,80 @@ func RunDERPAndSTUN(t *testing.T) *tailcfg.DERPMap {
 		},
 	}
 }
+
+// RunDERPAndSTUNIPv6 creates a DERP mapping for tests that is only
+// reachable over IPv6, like in IPv6-only networks. The node only has a
+// hostname, like most DERP nodes, so netcheck needs its IPv6 address to be
+// resolved with tailnet.ResolveDERPNodesIPv6. The test is skipped if IPv6
+// isn't available.
+func RunDERPAndSTUNIPv6(t *testing.T) *tailcfg.DERPMap {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 is not available: %s", err)
+	}
+	server, stunAddr := runDERPAndSTUN(t, listener, ipv6PacketListener{})
+	tcpAddr, ok := server.Listener.Addr().(*net.TCPAddr)
+	if !ok {
+		t.FailNow()
+	}
+
+	return &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				RegionName: "Test",
+				Nodes: []*tailcfg.DERPNode{
+					{
+						Name:             "t2",
+						RegionID:         1,
+						HostName:         "::1",
+						IPv4:             "none",
+						STUNPort:         stunAddr.Port,
+						DERPPort:         tcpAddr.Port,
+						InsecureForTests: true,
+					},
+				},
+			},
+		},
+	}
+}
+
+// ipv6PacketListener listens on the IPv6 loopback address, whatever
+// network is requested.
+type ipv6PacketListener struct{}
+
+func (ipv6PacketListener) ListenPacket(ctx context.Context, _, _ string) (net.PacketConn, error) {
+	var config net.ListenConfig
+	return config.ListenPacket(ctx, "udp6", "[::1]:0")
+}
+
+// runDERPAndSTUN starts a DERP server on the listener, or on the IPv4
+// loopback address if it's nil, and a STUN server.
+func runDERPAndSTUN(t *testing.T, listener net.Listener, packetListener nettype.PacketListener) (*httptest.Server, *net.UDPAddr) {
+	logf := tailnet.Logger(slogtest.Make(t, nil))
+	d := derp.NewServer(key.NewNode(), logf)
+	mux := http.NewServeMux()
+	mux.Handle("/derp", derphttp.Handler(d))
+	// This is used when UDP is blocked, and latency must be checked via HTTP(s).
+	mux.HandleFunc("/derp/latency-check", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewUnstartedServer(mux)
+	if listener != nil {
+		_ = server.Listener.Close()
+		server.Listener = listener
+	}
+	server.Config.ErrorLog = tslogger.StdLogger(logf)
+	server.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	server.StartTLS()
+
+	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(t, packetListener)
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+		d.Close()
+		stunCleanup()
+	})
+	return server, stunAddr
+}